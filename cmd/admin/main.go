@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"zooid/zooid"
+
+	"fiatjaf.com/nostr"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: zooid-admin [--config name] [--json] <command> [args]
+
+Runs administrative commands directly against a relay's database. --config
+names a file in the CONFIG directory; it may be omitted when there's only one.
+
+Commands:
+%s
+  instances [--retry] (asks a running relay at OPS_ADDR, needs no --config)
+`, zooid.AdminUsage())
+}
+
+// listInstances prints the instance registry of the relay serving its ops
+// endpoints on OPS_ADDR, after having it retry its failed configs if retry is
+// set.
+func listInstances(asJSON, retry bool) error {
+	addr := os.Getenv("OPS_ADDR")
+	if addr == "" {
+		return fmt.Errorf("OPS_ADDR is not set")
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	if retry {
+		res, err := client.Post("http://"+addr+"/instances/retry", "", nil)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusAccepted {
+			return fmt.Errorf("%s: %s", addr, res.Status)
+		}
+	}
+
+	res, err := client.Get("http://" + addr + "/instances")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", addr, res.Status)
+	}
+
+	var infos []zooid.InstanceInfo
+	if err := json.NewDecoder(res.Body).Decode(&infos); err != nil {
+		return err
+	}
+
+	if asJSON {
+		return json.NewEncoder(os.Stdout).Encode(infos)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CONFIG\tHOST\tSCHEMA\tLOADED\tRELOADED\tSTATUS")
+	for _, info := range infos {
+		status := "ok"
+		if !info.Healthy {
+			status = info.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", info.Config, info.Host, info.Schema,
+			formatTimestamp(info.LoadedAt), formatTimestamp(info.ReloadedAt), status)
+	}
+
+	return w.Flush()
+}
+
+func formatTimestamp(ts nostr.Timestamp) string {
+	if ts == 0 {
+		return "-"
+	}
+	return ts.Time().Format(time.DateTime)
+}
+
+// findConfig picks the only config file in the CONFIG directory.
+func findConfig() (string, error) {
+	entries, err := os.ReadDir(zooid.Env("CONFIG"))
+	if err != nil {
+		return "", err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+
+	if len(names) != 1 {
+		return "", fmt.Errorf("found %d configs in %s, pick one with --config", len(names), zooid.Env("CONFIG"))
+	}
+
+	return names[0], nil
+}
+
+func main() {
+	log.SetFlags(0)
+
+	config := flag.String("config", "", "config file name in the CONFIG directory")
+	asJSON := flag.Bool("json", false, "print JSON output")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	// The registry lives in the running relay, not in any one config.
+	if flag.Arg(0) == "instances" {
+		if err := listInstances(*asJSON, slices.Contains(flag.Args()[1:], "--retry")); err != nil {
+			log.Fatalf("instances: %v", err)
+		}
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if *config == "" {
+		name, err := findConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		*config = name
+	}
+
+	instance, err := zooid.MakeInstance(ctx, *config)
+	if err != nil {
+		log.Fatalf("Failed to load %s: %v", *config, err)
+	}
+	defer instance.Cleanup()
+
+	// Apply list rewrites before exiting rather than on a debounce timer.
+	instance.Groups.DebounceDelay = 0
+
+	// Nothing here passes through khatru's checks.
+	instance.Events.VerifyOnSave = true
+
+	admin := &zooid.Admin{Instance: instance, In: os.Stdin, Out: os.Stdout, JSON: *asJSON}
+	if err := admin.Run(flag.Args()); err != nil {
+		log.Printf("%s: %v", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// PostgreSQL's wire protocol numbers bind parameters with a uint16, so one
+// statement can carry at most this many.
+const maxParams = 65535
+
+// insertBatch writes rows with multi-row INSERT statements, as many rows per
+// statement as the parameter limit allows, all in one transaction. If cp is
+// set it is saved in the same transaction, even if every row was filtered out.
+func insertBatch(db *sql.DB, table string, cols []string, rows [][]interface{}, cp *checkpoint) error {
+	if len(rows) == 0 && cp == nil {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	perStatement := maxParams / len(cols)
+	for start := 0; start < len(rows); start += perStatement {
+		chunk := rows[start:min(start+perStatement, len(rows))]
+
+		query, args := buildInsert(table, cols, chunk)
+		if _, err := tx.Exec(query, args...); err != nil {
+			return fmt.Errorf("inserting into %s: %w", table, err)
+		}
+	}
+
+	if cp != nil {
+		if _, err := tx.Exec(saveCheckpoint, cp.args()...); err != nil {
+			return fmt.Errorf("saving checkpoint for %s: %w", table, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func buildInsert(table string, cols []string, rows [][]interface{}) (string, []interface{}) {
+	var query strings.Builder
+	args := make([]interface{}, 0, len(rows)*len(cols))
+
+	fmt.Fprintf(&query, "INSERT INTO %s (%s) VALUES ", table, strings.Join(cols, ", "))
+	for i, row := range rows {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString("(")
+		for j, value := range row {
+			if j > 0 {
+				query.WriteString(", ")
+			}
+			args = append(args, value)
+			fmt.Fprintf(&query, "$%d", len(args))
+		}
+		query.WriteString(")")
+	}
+	query.WriteString(" ON CONFLICT DO NOTHING")
+
+	return query.String(), args
+}
+
+// copyBatch streams rows with COPY into a temporary table shaped like table,
+// then moves them across with INSERT ... SELECT so conflicts are skipped the
+// same way insertBatch skips them. COPY itself can't skip conflicting rows.
+func copyBatch(db *sql.DB, table string, cols []string, rows [][]interface{}, cp *checkpoint) error {
+	if len(rows) == 0 && cp == nil {
+		return nil
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		pgConn := driverConn.(*stdlib.Conn).Conn()
+
+		tx, err := pgConn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		staging := "migrate_staging"
+		if _, err := tx.Exec(ctx, fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP", staging, table)); err != nil {
+			return fmt.Errorf("creating staging table for %s: %w", table, err)
+		}
+
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{staging}, cols, pgx.CopyFromRows(rows)); err != nil {
+			return fmt.Errorf("copying into %s: %w", table, err)
+		}
+
+		colList := strings.Join(cols, ", ")
+		insert := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT DO NOTHING", table, colList, colList, staging)
+		if _, err := tx.Exec(ctx, insert); err != nil {
+			return fmt.Errorf("inserting into %s: %w", table, err)
+		}
+
+		if cp != nil {
+			if _, err := tx.Exec(ctx, saveCheckpoint, cp.args()...); err != nil {
+				return fmt.Errorf("saving checkpoint for %s: %w", table, err)
+			}
+		}
+
+		return tx.Commit(ctx)
+	})
+}
+
+// progress logs how far a table's migration has got, at most once every
+// progressInterval, with the average rate so far. Lines are prefixed with the
+// table so that tables migrating in parallel can be told apart.
+type progress struct {
+	table  string
+	total  int64
+	done   int64
+	start  time.Time
+	logged time.Time
+}
+
+const progressInterval = 5 * time.Second
+
+func newProgress(table string, total int64) *progress {
+	now := time.Now()
+	return &progress{table: table, total: total, start: now, logged: now}
+}
+
+func (p *progress) add(n int) {
+	p.done += int64(n)
+
+	if time.Since(p.logged) >= progressInterval {
+		p.logged = time.Now()
+		log.Printf("[%s] %d/%d rows (%.0f rows/s)", p.table, p.done, p.total, p.rate())
+	}
+}
+
+func (p *progress) rate() float64 {
+	elapsed := time.Since(p.start).Seconds()
+	if elapsed == 0 {
+		return 0
+	}
+	return float64(p.done) / elapsed
+}
+
+func (p *progress) finish() {
+	log.Printf("[%s] done: %d rows in %s (%.0f rows/s)", p.table, p.done, time.Since(p.start).Round(time.Millisecond), p.rate())
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBuildInsert(t *testing.T) {
+	query, args := buildInsert("kv", []string{"key", "value"}, [][]interface{}{{"a", "1"}, {"b", "2"}})
+
+	want := "INSERT INTO kv (key, value) VALUES ($1, $2), ($3, $4) ON CONFLICT DO NOTHING"
+	if query != want {
+		t.Errorf("query = %q, want %q", query, want)
+	}
+	if len(args) != 4 || args[2] != "b" {
+		t.Errorf("args = %v", args)
+	}
+}
+
+// fillSourceEvents inserts n synthetic events, each with one tag row.
+func fillSourceEvents(t *testing.T, src *sql.DB, prefix string, n int) {
+	t.Helper()
+
+	tx, err := src.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	events, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s__events VALUES (?, ?, ?, ?, ?, ?, ?)", prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s__event_tags VALUES (?, ?, ?)", prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range n {
+		id := fmt.Sprintf("%064x", i)
+		group := fmt.Sprintf("group%d", i%10)
+		if _, err := events.Exec(id, 1700000000+i, 9, fmt.Sprintf("%064x", i%100), fmt.Sprintf("message %d", i), `[["h","`+group+`"]]`, fmt.Sprintf("%0128x", i)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tags.Exec(id, "h", group); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tableDigest(t *testing.T, db *sql.DB, table string) string {
+	t.Helper()
+
+	var digest string
+	query := fmt.Sprintf("SELECT md5(string_agg(id || created_at || kind || pubkey || content || tags || sig, ',' ORDER BY id)) FROM %s", table)
+	if err := db.QueryRow(query).Scan(&digest); err != nil {
+		t.Fatalf("Failed to digest %s: %v", table, err)
+	}
+	return digest
+}
+
+func TestMigrateTable_InsertAndCopy(t *testing.T) {
+	const rows = 50000
+
+	src, dst := openTestDatabases(t)
+	createSourceEvents(t, src, "inserted")
+	createSourceEvents(t, src, "copied")
+	fillSourceEvents(t, src, "inserted", rows)
+	fillSourceEvents(t, src, "copied", rows)
+
+	tables := []string{"copied__event_tags", "copied__events", "inserted__event_tags", "inserted__events"}
+	if err := createSchema(dst, tables); err != nil {
+		t.Fatalf("createSchema failed: %v", err)
+	}
+	if err := ensureStateTable(dst); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []struct {
+		prefix string
+		copy   bool
+	}{{"inserted", false}, {"copied", true}} {
+		m := newMigrator(src, dst)
+		m.copy = mode.copy
+
+		start := time.Now()
+		for _, table := range []string{mode.prefix + "__events", mode.prefix + "__event_tags"} {
+			if err := m.migrateTable(table); err != nil {
+				t.Fatalf("migrating %s: %v", table, err)
+			}
+		}
+		t.Logf("copy=%v: %d events and %d tags in %s", mode.copy, rows, rows, time.Since(start))
+
+		for _, table := range []string{mode.prefix + "__events", mode.prefix + "__event_tags"} {
+			if n := countRows(t, dst, table); n != rows {
+				t.Errorf("%s has %d rows, want %d", table, n, rows)
+			}
+		}
+	}
+
+	if a, b := tableDigest(t, dst, "inserted__events"), tableDigest(t, dst, "copied__events"); a != b {
+		t.Errorf("INSERT and COPY produced different events (%s vs %s)", a, b)
+	}
+
+	// Migrating again must skip every row rather than fail or duplicate
+	if _, err := dst.Exec("DELETE FROM migration_state"); err != nil {
+		t.Fatal(err)
+	}
+	m := newMigrator(src, dst)
+	m.copy = true
+	if err := m.migrateTable("copied__events"); err != nil {
+		t.Fatalf("re-migrating: %v", err)
+	}
+	if n := countRows(t, dst, "copied__events"); n != rows {
+		t.Errorf("copied__events has %d rows after re-migrating, want %d", n, rows)
+	}
+}
+
+func TestInsertBatch_SplitsAtParameterLimit(t *testing.T) {
+	_, dst := openTestDatabases(t)
+	if _, err := dst.Exec("CREATE TABLE split_test (a TEXT PRIMARY KEY, b TEXT, c TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Three columns allow 21845 rows per statement, so this needs two
+	rows := make([][]interface{}, 30000)
+	for i := range rows {
+		rows[i] = []interface{}{fmt.Sprint(i), "b", "c"}
+	}
+
+	if err := insertBatch(dst, "split_test", []string{"a", "b", "c"}, rows, nil); err != nil {
+		t.Fatalf("insertBatch failed: %v", err)
+	}
+	if n := countRows(t, dst, "split_test"); n != int64(len(rows)) {
+		t.Errorf("split_test has %d rows, want %d", n, len(rows))
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Checkpoints.
+//
+// Source rows are read in SQLite rowid order, and every batch commits the
+// rowid of its last row to migration_state in the same transaction as the
+// rows themselves. A migration that dies partway therefore resumes right
+// after the last committed batch instead of re-reading the whole table.
+
+const createStateTable = `CREATE TABLE IF NOT EXISTS migration_state (
+	table_name TEXT PRIMARY KEY,
+	last_rowid BIGINT NOT NULL,
+	rows BIGINT NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+const saveCheckpoint = `INSERT INTO migration_state (table_name, last_rowid, rows, updated_at)
+	VALUES ($1, $2, $3, now())
+	ON CONFLICT (table_name) DO UPDATE SET last_rowid = EXCLUDED.last_rowid, rows = EXCLUDED.rows, updated_at = now()`
+
+// checkpoint is how far a table's migration has got: the last source rowid
+// written and the total number of rows written up to it.
+type checkpoint struct {
+	table     string
+	lastRowid int64
+	rows      int64
+}
+
+func (c *checkpoint) args() []interface{} {
+	return []interface{}{c.table, c.lastRowid, c.rows}
+}
+
+// ensureStateTable creates the tables recording checkpoints and the events
+// --validate rejected.
+func ensureStateTable(db *sql.DB) error {
+	for _, stmt := range []string{createStateTable, createRejectedTable} {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadCheckpoint returns the saved checkpoint for table, or a zero one if the
+// table hasn't been started.
+func loadCheckpoint(db *sql.DB, table string) (checkpoint, error) {
+	c := checkpoint{table: table}
+
+	err := db.QueryRow("SELECT last_rowid, rows FROM migration_state WHERE table_name = $1", table).Scan(&c.lastRowid, &c.rows)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, nil
+	}
+	if err != nil {
+		return c, fmt.Errorf("loading checkpoint for %s: %w", table, err)
+	}
+
+	return c, nil
+}
+
+// clearCheckpoints forgets the progress of tables and of their rowid ranges,
+// and the events rejected from them, for --fresh.
+func clearCheckpoints(db *sql.DB, tables []string) error {
+	for _, table := range tables {
+		if _, err := db.Exec("DELETE FROM migration_state WHERE table_name = $1 OR starts_with(table_name, $1 || '#')", table); err != nil {
+			return fmt.Errorf("clearing checkpoint for %s: %w", table, err)
+		}
+		if _, err := db.Exec("DELETE FROM migration_rejected WHERE table_name = $1", table); err != nil {
+			return fmt.Errorf("clearing rejected events for %s: %w", table, err)
+		}
+	}
+	return nil
+}
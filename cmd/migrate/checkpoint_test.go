@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMigrateTable_ResumesFromCheckpoint(t *testing.T) {
+	const rows = 12000
+
+	src, dst := openTestDatabases(t)
+	createSourceEvents(t, src, "resume")
+	fillSourceEvents(t, src, "resume", rows)
+
+	tables := []string{"resume__events", "resume__event_tags"}
+	if err := createSchema(dst, tables); err != nil {
+		t.Fatalf("createSchema failed: %v", err)
+	}
+	if err := ensureStateTable(dst); err != nil {
+		t.Fatal(err)
+	}
+
+	// Die once the first batch has been written
+	crash := errors.New("simulated crash")
+	m := newMigrator(src, dst)
+	m.beforeBatch = func(table string, migrated int64) error {
+		if migrated >= batchSize {
+			return crash
+		}
+		return nil
+	}
+	if err := m.migrateTable("resume__events"); !errors.Is(err, crash) {
+		t.Fatalf("migrateTable error = %v, want the simulated crash", err)
+	}
+
+	if n := countRows(t, dst, "resume__events"); n != batchSize {
+		t.Fatalf("%d rows migrated before the crash, want %d", n, batchSize)
+	}
+	saved, err := loadCheckpoint(dst, "resume__events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.rows != batchSize || saved.lastRowid != batchSize {
+		t.Fatalf("checkpoint = %+v, want %d rows up to rowid %d", saved, batchSize, batchSize)
+	}
+
+	// Resume
+	m = newMigrator(src, dst)
+	for _, table := range tables {
+		if err := m.migrateTable(table); err != nil {
+			t.Fatalf("resuming %s: %v", table, err)
+		}
+	}
+
+	if run := m.runs["resume__events"]; run.from.lastRowid != batchSize || run.rows != rows-batchSize {
+		t.Errorf("resumed run = %+v, want %d rows after rowid %d", run, rows-batchSize, batchSize)
+	}
+	for _, table := range tables {
+		if n := countRows(t, dst, table); n != rows {
+			t.Errorf("%s has %d rows, want %d", table, n, rows)
+		}
+	}
+	if err := m.verifyCounts(tables); err != nil {
+		t.Errorf("verifyCounts failed after resuming: %v", err)
+	}
+
+	// A finished table resumes with nothing left to do
+	m = newMigrator(src, dst)
+	if err := m.migrateTable("resume__events"); err != nil {
+		t.Fatal(err)
+	}
+	if run := m.runs["resume__events"]; run.rows != 0 {
+		t.Errorf("finished table migrated %d more rows", run.rows)
+	}
+
+	// --fresh starts over without duplicating anything
+	if err := clearCheckpoints(dst, tables); err != nil {
+		t.Fatal(err)
+	}
+	m = newMigrator(src, dst)
+	if err := m.migrateTable("resume__events"); err != nil {
+		t.Fatal(err)
+	}
+	if run := m.runs["resume__events"]; run.from.lastRowid != 0 || run.rows != rows {
+		t.Errorf("fresh run = %+v, want all %d rows", run, rows)
+	}
+	if err := m.verifyCounts([]string{"resume__events"}); err != nil {
+		t.Errorf("verifyCounts failed after a fresh run: %v", err)
+	}
+}
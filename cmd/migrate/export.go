@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Reverse migration.
+//
+// exportTenant pulls one schema prefix out of PostgreSQL into a new SQLite
+// database in the layout of the old SQLite store, for local development and
+// forensics. Only the original columns are read, so PostgreSQL-only
+// additions such as search_vector, event_tags.kind and kv.expires_at are left
+// behind. Of the shared kv table, only the tenant's own keys (those under
+// "zooid:{prefix}:") are exported. Contents stored compressed in content_zstd
+// are decompressed into content, which is all the old store has.
+
+// exportMain runs --reverse: it refuses to touch an existing SQLite file, so
+// an export can never overwrite a database.
+func exportMain(sqlitePath, databaseURL, prefix string) {
+	if prefix == "" {
+		log.Fatal("--reverse needs --schema-prefix to choose the tenant to export")
+	}
+	if _, err := os.Stat(sqlitePath); err == nil {
+		log.Fatalf("%s already exists; export into a new file", sqlitePath)
+	}
+
+	pgDb, err := sql.Open("pgx", databaseURL)
+	if err != nil {
+		log.Fatalf("Failed to open PostgreSQL: %v", err)
+	}
+	defer pgDb.Close()
+
+	liteDb, err := sql.Open("sqlite3", sqlitePath)
+	if err != nil {
+		log.Fatalf("Failed to open SQLite: %v", err)
+	}
+	defer liteDb.Close()
+
+	log.Printf("Exporting %s to %s", strings.TrimSuffix(prefix, "__"), sqlitePath)
+	if err := exportTenant(pgDb, liteDb, strings.TrimSuffix(prefix, "__")); err != nil {
+		log.Fatalf("Export failed: %v", err)
+	}
+
+	log.Println("Export completed successfully!")
+}
+
+func sqliteSchema(prefix string) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE %s__events (
+			id TEXT PRIMARY KEY,
+			created_at INTEGER NOT NULL,
+			kind INTEGER NOT NULL,
+			pubkey TEXT NOT NULL,
+			content TEXT NOT NULL,
+			tags TEXT NOT NULL,
+			sig TEXT NOT NULL
+		)`, prefix),
+		fmt.Sprintf(`CREATE INDEX %s__idx_events_created_at ON %s__events(created_at)`, prefix, prefix),
+		fmt.Sprintf(`CREATE INDEX %s__idx_events_kind_pubkey ON %s__events(kind, pubkey)`, prefix, prefix),
+		fmt.Sprintf(`CREATE TABLE %s__event_tags (
+			event_id TEXT NOT NULL,
+			key TEXT NOT NULL,
+			value TEXT NOT NULL
+		)`, prefix),
+		fmt.Sprintf(`CREATE INDEX %s__idx_event_tags_event_id ON %s__event_tags(event_id)`, prefix, prefix),
+		fmt.Sprintf(`CREATE INDEX %s__idx_event_tags_key_value ON %s__event_tags(key, value)`, prefix, prefix),
+		`CREATE TABLE IF NOT EXISTS kv (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		)`,
+	}
+}
+
+// export is one table to copy: the rows query runs against PostgreSQL and
+// counts with the same filter for verification. extra columns are read after
+// cols for decode, which folds them into the values of cols.
+type export struct {
+	table  string
+	cols   []string
+	where  string
+	args   []interface{}
+	extra  []string
+	decode func(values []interface{}) error
+}
+
+// tenantExports lists prefix's tables. compressed is whether the events table
+// has content_zstd, which a database zooid never ran against lacks.
+func tenantExports(prefix string, compressed bool) []export {
+	events := export{table: prefix + "__events", cols: []string{"id", "created_at", "kind", "pubkey", "content", "tags", "sig"}}
+	if compressed {
+		events.extra = []string{"content_zstd"}
+		events.decode = decompressRow
+	}
+
+	return []export{
+		events,
+		{table: prefix + "__event_tags", cols: []string{"event_id", "key", "value"}},
+		{table: "kv", cols: []string{"key", "value"}, where: "starts_with(key, $1)", args: []interface{}{"zooid:" + prefix + ":"}},
+	}
+}
+
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// decompressRow replaces the empty content of an events row with its
+// content_zstd, decompressed.
+func decompressRow(values []interface{}) error {
+	data, ok := values[7].([]byte)
+	if !ok || data == nil {
+		return nil
+	}
+
+	content, err := zstdDecoder.DecodeAll(data, nil)
+	if err != nil {
+		return fmt.Errorf("decompressing event %v: %w", values[0], err)
+	}
+	values[4] = string(content)
+	return nil
+}
+
+// hasColumn reports whether table has column in pg's current schema.
+func hasColumn(pg *sql.DB, table, column string) (bool, error) {
+	var exists bool
+	err := pg.QueryRow(`SELECT EXISTS (
+		SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2
+	)`, table, column).Scan(&exists)
+	return exists, err
+}
+
+func (e export) query(selection string) string {
+	query := fmt.Sprintf("SELECT %s FROM %s", selection, e.table)
+	if e.where != "" {
+		query += " WHERE " + e.where
+	}
+	return query
+}
+
+// exportTenant copies prefix's tables from pg into lite, which must be
+// empty, and verifies the row counts match.
+func exportTenant(pg, lite *sql.DB, prefix string) error {
+	if !safeTableName.MatchString(prefix) {
+		return fmt.Errorf("unsafe schema prefix %q", prefix)
+	}
+
+	for _, stmt := range sqliteSchema(prefix) {
+		if _, err := lite.Exec(stmt); err != nil {
+			return fmt.Errorf("creating SQLite schema: %w", err)
+		}
+	}
+
+	compressed, err := hasColumn(pg, prefix+"__events", "content_zstd")
+	if err != nil {
+		return fmt.Errorf("checking for compressed contents: %w", err)
+	}
+
+	for _, e := range tenantExports(prefix, compressed) {
+		if err := exportTable(pg, lite, e); err != nil {
+			return fmt.Errorf("exporting %s: %w", e.table, err)
+		}
+	}
+
+	var mismatches []string
+	for _, e := range tenantExports(prefix, compressed) {
+		var pgCount, liteCount int64
+		if err := pg.QueryRow(e.query("COUNT(*)"), e.args...).Scan(&pgCount); err != nil {
+			return fmt.Errorf("counting %s: %w", e.table, err)
+		}
+		if err := lite.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", e.table)).Scan(&liteCount); err != nil {
+			return fmt.Errorf("counting exported %s: %w", e.table, err)
+		}
+
+		status := "OK"
+		if pgCount != liteCount {
+			status = "MISMATCH"
+			mismatches = append(mismatches, fmt.Sprintf("%s (postgres=%d, sqlite=%d)", e.table, pgCount, liteCount))
+		}
+		log.Printf("  %s: postgres=%d sqlite=%d [%s]", e.table, pgCount, liteCount, status)
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("row count mismatches: %s", strings.Join(mismatches, ", "))
+	}
+
+	return nil
+}
+
+// exportTable streams e's rows out of PostgreSQL and writes them to SQLite
+// in transactions of batchSize rows.
+func exportTable(pg, lite *sql.DB, e export) error {
+	var total int64
+	if err := pg.QueryRow(e.query("COUNT(*)"), e.args...).Scan(&total); err != nil {
+		return err
+	}
+
+	rows, err := pg.Query(e.query(strings.Join(append(slices.Clone(e.cols), e.extra...), ", ")), e.args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(e.cols)), ", ")
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", e.table, strings.Join(e.cols, ", "), placeholders)
+
+	progress := newProgress(e.table, total)
+	batch := make([][]interface{}, 0, batchSize)
+
+	flush := func() error {
+		tx, err := lite.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		stmt, err := tx.Prepare(insert)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, row := range batch {
+			if _, err := stmt.Exec(row...); err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		progress.add(len(batch))
+		batch = batch[:0]
+		return nil
+	}
+
+	for rows.Next() {
+		values := make([]interface{}, len(e.cols)+len(e.extra))
+		ptrs := make([]interface{}, len(values))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		if e.decode != nil {
+			if err := e.decode(values); err != nil {
+				return err
+			}
+		}
+
+		batch = append(batch, values[:len(e.cols)])
+		if len(batch) >= batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+
+	progress.finish()
+	return nil
+}
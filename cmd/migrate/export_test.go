@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestExportTenant_RoundTrip(t *testing.T) {
+	const rows = 7000
+
+	src, dst := openTestDatabases(t)
+	createSourceEvents(t, src, "trip")
+	createSourceEvents(t, src, "other")
+	fillSourceEvents(t, src, "trip", rows)
+	fillSourceEvents(t, src, "other", 10)
+	if _, err := src.Exec("CREATE TABLE kv (key TEXT PRIMARY KEY, value TEXT NOT NULL)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"zooid:trip:a", "zooid:trip:b", "zooid:other:a", "zooid:tripping:a"} {
+		if _, err := src.Exec("INSERT INTO kv VALUES (?, ?)", key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// sqlite -> pg
+	tables, err := discoverTables(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createSchema(dst, tables); err != nil {
+		t.Fatalf("createSchema failed: %v", err)
+	}
+	if err := ensureStateTable(dst); err != nil {
+		t.Fatal(err)
+	}
+	m := newMigrator(src, dst)
+	m.concurrency = 4
+	if err := m.migrateAll(tables); err != nil {
+		t.Fatalf("migrateAll failed: %v", err)
+	}
+	if err := backfillSearchVectors(dst, tables); err != nil {
+		t.Fatal(err)
+	}
+
+	// pg -> sqlite
+	exported, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "export.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { exported.Close() })
+
+	if err := exportTenant(dst, exported, "trip"); err != nil {
+		t.Fatalf("exportTenant failed: %v", err)
+	}
+
+	for _, table := range []string{"trip__events", "trip__event_tags"} {
+		if a, b := countRows(t, src, table), countRows(t, exported, table); a != b {
+			t.Errorf("%s has %d rows after the round trip, want %d", table, b, a)
+		}
+	}
+
+	var keys []string
+	kvRows, err := exported.Query("SELECT key FROM kv ORDER BY key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for kvRows.Next() {
+		var key string
+		if err := kvRows.Scan(&key); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	kvRows.Close()
+	if want := []string{"zooid:trip:a", "zooid:trip:b"}; !slices.Equal(keys, want) {
+		t.Errorf("exported kv keys = %v, want %v", keys, want)
+	}
+
+	var others int
+	if err := exported.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name LIKE 'other%'").Scan(&others); err != nil {
+		t.Fatal(err)
+	}
+	if others != 0 {
+		t.Errorf("another tenant's tables were exported")
+	}
+
+	// Spot check rows across the whole range, field by field
+	for _, i := range []int{0, 1, rows / 2, rows - 1} {
+		id := fmt.Sprintf("%064x", i)
+		query := "SELECT id, created_at, kind, pubkey, content, tags, sig FROM trip__events WHERE id = ?"
+
+		want := make([]string, len(eventColumns))
+		got := make([]string, len(eventColumns))
+		if err := src.QueryRow(query, id).Scan(stringPtrs(want)...); err != nil {
+			t.Fatal(err)
+		}
+		if err := exported.QueryRow(query, id).Scan(stringPtrs(got)...); err != nil {
+			t.Fatalf("event %d missing from the export: %v", i, err)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("event %d = %v after the round trip, want %v", i, got, want)
+		}
+
+		var key, value string
+		if err := exported.QueryRow("SELECT key, value FROM trip__event_tags WHERE event_id = ?", id).Scan(&key, &value); err != nil {
+			t.Fatal(err)
+		}
+		if key != "h" || value != fmt.Sprintf("group%d", i%10) {
+			t.Errorf("event %d has tag %s=%s after the round trip", i, key, value)
+		}
+	}
+}
+
+func TestExportTenant_DecompressesContent(t *testing.T) {
+	src, dst := openTestDatabases(t)
+	createSourceEvents(t, src, "packed")
+	fillSourceEvents(t, src, "packed", 10)
+
+	tables, err := discoverTables(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createSchema(dst, tables); err != nil {
+		t.Fatalf("createSchema failed: %v", err)
+	}
+	if err := ensureStateTable(dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := newMigrator(src, dst).migrateAll(tables); err != nil {
+		t.Fatalf("migrateAll failed: %v", err)
+	}
+
+	// As zooid stores contents over storage.compress_above
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := fmt.Sprintf("%064x", 3)
+	for _, stmt := range []string{
+		"CREATE TABLE IF NOT EXISTS kv (key TEXT PRIMARY KEY, value TEXT NOT NULL)",
+		"ALTER TABLE packed__events ADD COLUMN content_zstd BYTEA",
+	} {
+		if _, err := dst.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := dst.Exec("UPDATE packed__events SET content = '', content_zstd = $1 WHERE id = $2", encoder.EncodeAll([]byte("message 3"), nil), id); err != nil {
+		t.Fatal(err)
+	}
+
+	exported, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "export.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { exported.Close() })
+
+	if err := exportTenant(dst, exported, "packed"); err != nil {
+		t.Fatalf("exportTenant failed: %v", err)
+	}
+
+	for i, want := range map[int]string{3: "message 3", 4: "message 4"} {
+		var content string
+		if err := exported.QueryRow("SELECT content FROM packed__events WHERE id = ?", fmt.Sprintf("%064x", i)).Scan(&content); err != nil {
+			t.Fatal(err)
+		}
+		if content != want {
+			t.Errorf("event %d exported with content %q, want %q", i, content, want)
+		}
+	}
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"database/sql"
+	"flag"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 	_ "github.com/mattn/go-sqlite3"
@@ -14,19 +17,88 @@ import (
 
 var safeTableName = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
 
+// batchSize is how many source rows are read before being written in one
+// destination transaction.
+const batchSize = 5000
+
+// migrator copies tables from the SQLite source to PostgreSQL.
+type migrator struct {
+	src, dst *sql.DB
+
+	// copy loads batches with COPY instead of multi-row INSERTs
+	copy bool
+
+	// concurrency is how many tables or ranges are migrated at once, and
+	// split how many rowid ranges each events table is divided into
+	concurrency int
+	split       int
+
+	// runs records what this run migrated per checkpoint key, for
+	// verifyCounts
+	mu   sync.Mutex
+	runs map[string]tableRun
+
+	// validate checks every event's id and signature, skipping invalid ones
+	// or, with strict, failing on them. rejected holds the skipped event
+	// ids and reasons per events table.
+	validate, strict bool
+	rejected         map[string]map[string]string
+
+	// backfills maps the tag tables rebuilt from events JSON to the number
+	// of rows they should hold
+	backfills map[string]int64
+
+	// beforeBatch, if set, runs before each batch is written with the
+	// number of rows written so far. Tests use it to fail partway.
+	beforeBatch func(table string, rows int64) error
+}
+
+// tableRun is the checkpoint a migration of a table or rowid range started
+// from, where the range ends, and how many rows it wrote.
+type tableRun struct {
+	table string
+	from  checkpoint
+	to    int64
+	rows  int64
+}
+
+func newMigrator(src, dst *sql.DB) *migrator {
+	return &migrator{src: src, dst: dst, concurrency: 1, split: 1, runs: make(map[string]tableRun), backfills: make(map[string]int64), rejected: make(map[string]map[string]string)}
+}
+
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 
+	copyMode := flag.Bool("copy", false, "load rows with COPY into a staging table instead of multi-row INSERTs")
+	concurrency := flag.Int("concurrency", 4, "number of tables or rowid ranges to migrate at once")
+	split := flag.Int("split-events", 1, "split each events table into this many rowid ranges migrated in parallel")
+	fresh := flag.Bool("fresh", false, "ignore checkpoints from earlier runs and migrate every table from the start")
+	verifyOnly := flag.Bool("verify-only", false, "skip migrating and only compare the destination with the source")
+	spotChecks := flag.Int("spot-check", 100, "number of random events per table to compare field by field")
+	dryRun := flag.Bool("dry-run", false, "show what would be migrated without writing anything")
+	tableList := flag.String("tables", "", "comma-separated tables to migrate instead of all of them")
+	schemaPrefix := flag.String("schema-prefix", "", "only migrate the tables of this schema prefix")
+	validate := flag.Bool("validate", false, "check every event's id and signature and skip invalid ones")
+	strict := flag.Bool("strict", false, "with --validate, abort on the first invalid event instead of skipping it")
+	rejectedOut := flag.String("rejected-out", "rejected_events.txt", "file listing the events --validate skipped")
+	reverse := flag.Bool("reverse", false, "export the --schema-prefix tenant from DATABASE_URL into a new SQLite file at SQLITE_PATH")
+	flag.Parse()
+
 	sqlitePath := os.Getenv("SQLITE_PATH")
 	databaseURL := os.Getenv("DATABASE_URL")
 
 	if sqlitePath == "" {
 		log.Fatal("SQLITE_PATH environment variable is required")
 	}
-	if databaseURL == "" {
+	if databaseURL == "" && (!*dryRun || *reverse) {
 		log.Fatal("DATABASE_URL environment variable is required")
 	}
 
+	if *reverse {
+		exportMain(sqlitePath, databaseURL, *schemaPrefix)
+		return
+	}
+
 	// Open SQLite (read-only)
 	srcDb, err := sql.Open("sqlite3", sqlitePath+"?mode=ro")
 	if err != nil {
@@ -34,52 +106,129 @@ func main() {
 	}
 	defer srcDb.Close()
 
-	// Open PostgreSQL
-	dstDb, err := sql.Open("pgx", databaseURL)
-	if err != nil {
-		log.Fatalf("Failed to open PostgreSQL: %v", err)
-	}
-	defer dstDb.Close()
+	// Open PostgreSQL, which a dry run only reads checkpoints from
+	var dstDb *sql.DB
+	if databaseURL != "" {
+		dstDb, err = sql.Open("pgx", databaseURL)
+		if err != nil {
+			log.Fatalf("Failed to open PostgreSQL: %v", err)
+		}
+		defer dstDb.Close()
 
-	if err := dstDb.Ping(); err != nil {
-		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
-	}
+		if err := dstDb.Ping(); err != nil {
+			log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+		}
 
-	log.Println("Connected to both databases")
+		log.Println("Connected to both databases")
+	}
 
 	// Discover tables to migrate by listing SQLite tables
-	tables, err := discoverTables(srcDb)
+	discovered, err := discoverTables(srcDb)
 	if err != nil {
 		log.Fatalf("Failed to discover tables: %v", err)
 	}
 
-	log.Printf("Found tables: %v", tables)
+	log.Printf("Found tables: %v", discovered)
+
+	var only []string
+	if *tableList != "" {
+		only = strings.Split(*tableList, ",")
+	}
+	selected, err := selectTables(discovered, only, *schemaPrefix)
+	if err != nil {
+		log.Fatalf("Failed to select tables: %v", err)
+	}
+
+	tables, unknown := splitUnknown(selected)
+	if err := reportUnknown(srcDb, unknown); err != nil {
+		log.Fatalf("Failed to report unknown tables: %v", err)
+	}
+	if len(tables) == 0 {
+		log.Fatal("No known tables to migrate")
+	}
+
+	log.Printf("Migrating tables: %v", tables)
+
+	m := newMigrator(srcDb, dstDb)
+	m.copy = *copyMode
+	m.concurrency = max(*concurrency, 1)
+	m.split = max(*split, 1)
+	m.validate = *validate || *strict
+	m.strict = *strict
+
+	if *dryRun {
+		if err := m.dryRun(tables); err != nil {
+			log.Fatalf("Dry run failed: %v", err)
+		}
+		return
+	}
+
+	if *verifyOnly {
+		if err := m.loadRejections(); err != nil {
+			log.Fatalf("Failed to load rejected events: %v", err)
+		}
+		if err := m.findTagBackfills(tables); err != nil {
+			log.Fatalf("Failed to check tag tables: %v", err)
+		}
+		m.verify(m.withBackfills(tables), *spotChecks)
+		log.Println("Verification passed")
+		return
+	}
 
-	// Create PostgreSQL schema
-	if err := createSchema(dstDb, tables); err != nil {
+	// Create PostgreSQL schema, including tag tables to backfill
+	if err := createSchema(dstDb, withTagTables(tables)); err != nil {
 		log.Fatalf("Failed to create PostgreSQL schema: %v", err)
 	}
 
-	// Migrate each table
-	for _, table := range tables {
-		if err := migrateTable(srcDb, dstDb, table); err != nil {
-			log.Fatalf("Failed to migrate table %s: %v", table, err)
+	if err := ensureStateTable(dstDb); err != nil {
+		log.Fatalf("Failed to create migration_state table: %v", err)
+	}
+	if *fresh {
+		if err := clearCheckpoints(dstDb, tables); err != nil {
+			log.Fatalf("Failed to clear checkpoints: %v", err)
 		}
 	}
+	if err := m.loadRejections(); err != nil {
+		log.Fatalf("Failed to load rejected events: %v", err)
+	}
+
+	// Migrate every table, resuming from its checkpoints
+	if err := m.migrateAll(tables); err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+
+	// Rebuild tag tables missing or mostly missing from the source
+	if err := m.backfillTags(tables); err != nil {
+		log.Fatalf("Failed to backfill tags: %v", err)
+	}
 
 	// Backfill tsvector for events tables
 	if err := backfillSearchVectors(dstDb, tables); err != nil {
 		log.Fatalf("Failed to backfill search vectors: %v", err)
 	}
 
-	// Verify row counts
-	if err := verifyCounts(srcDb, dstDb, tables); err != nil {
-		log.Fatalf("Verification failed: %v", err)
+	if err := m.reportRejections(*rejectedOut); err != nil {
+		log.Fatalf("Failed to write rejected events: %v", err)
 	}
 
+	m.verify(m.withBackfills(tables), *spotChecks)
+
 	log.Println("Migration completed successfully!")
 }
 
+// verify checks row counts and then content, exiting on any mismatch.
+func (m *migrator) verify(tables []string, spotChecks int) {
+	log.Println("Verifying row counts...")
+	if err := m.verifyCounts(tables); err != nil {
+		log.Fatalf("Verification failed: %v", err)
+	}
+
+	log.Println("Verifying content...")
+	if err := m.verifyIntegrity(tables, spotChecks); err != nil {
+		log.Fatalf("Verification failed: %v", err)
+	}
+}
+
 func discoverTables(db *sql.DB) ([]string, error) {
 	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' AND name NOT LIKE '%_fts%' ORDER BY name")
 	if err != nil {
@@ -102,9 +251,9 @@ func discoverTables(db *sql.DB) ([]string, error) {
 	return tables, nil
 }
 
-func createSchema(db *sql.DB, tables []string) error {
-	// Process __events tables first, then __event_tags (which have FK references to __events).
-	// Sort tables so __events come before __event_tags and other tables.
+// orderTables puts __events tables first, then __event_tags (which have FK
+// references to __events), then everything else.
+func orderTables(tables []string) []string {
 	sorted := make([]string, 0, len(tables))
 	var tagTables, otherTables []string
 	for _, t := range tables {
@@ -117,14 +266,33 @@ func createSchema(db *sql.DB, tables []string) error {
 		}
 	}
 	sorted = append(sorted, tagTables...)
-	sorted = append(sorted, otherTables...)
-
-	for _, table := range sorted {
-		switch {
-		case strings.HasSuffix(table, "__events"):
-			prefix := table[:len(table)-len("__events")]
-			stmts := []string{
-				fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	return append(sorted, otherTables...)
+}
+
+func createSchema(db *sql.DB, tables []string) error {
+	for _, table := range orderTables(tables) {
+		stmts := schemaStatements(table)
+		if stmts == nil {
+			log.Printf("Skipping unknown table: %s", table)
+			continue
+		}
+		for _, s := range stmts {
+			if _, err := db.Exec(s); err != nil {
+				return fmt.Errorf("creating schema for %s: %w", table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// schemaStatements returns the statements creating table and its indexes in
+// PostgreSQL, or nil if the table isn't one the relay knows.
+func schemaStatements(table string) []string {
+	switch {
+	case strings.HasSuffix(table, "__events"):
+		prefix := table[:len(table)-len("__events")]
+		return []string{
+			fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
 					id TEXT PRIMARY KEY,
 					created_at BIGINT NOT NULL,
 					kind INTEGER NOT NULL,
@@ -133,89 +301,95 @@ func createSchema(db *sql.DB, tables []string) error {
 					tags TEXT NOT NULL,
 					sig TEXT NOT NULL
 				)`, table),
-				fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s__idx_events_created_at ON %s(created_at)`, prefix, table),
-				fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s__idx_events_kind ON %s(kind)`, prefix, table),
-				fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s__idx_events_pubkey ON %s(pubkey)`, prefix, table),
-				fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s__idx_events_kind_pubkey ON %s(kind, pubkey)`, prefix, table),
-				fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s__idx_events_kind_pubkey_created_at ON %s(kind, pubkey, created_at DESC)`, prefix, table),
-				// FTS: tsvector column + GIN index + trigger
-				fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS search_vector tsvector`, table),
-				fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s__idx_events_search ON %s USING GIN(search_vector)`, prefix, table),
-				fmt.Sprintf(`CREATE OR REPLACE FUNCTION %s_update_search_vector() RETURNS trigger AS $$
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s__idx_events_created_at ON %s(created_at)`, prefix, table),
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s__idx_events_kind ON %s(kind)`, prefix, table),
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s__idx_events_pubkey ON %s(pubkey)`, prefix, table),
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s__idx_events_kind_pubkey ON %s(kind, pubkey)`, prefix, table),
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s__idx_events_kind_pubkey_created_at ON %s(kind, pubkey, created_at DESC)`, prefix, table),
+			// FTS: tsvector column + GIN index + trigger
+			fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS search_vector tsvector`, table),
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s__idx_events_search ON %s USING GIN(search_vector)`, prefix, table),
+			fmt.Sprintf(`CREATE OR REPLACE FUNCTION %s_update_search_vector() RETURNS trigger AS $$
 					BEGIN
 						NEW.search_vector := to_tsvector('english', COALESCE(NEW.content, ''));
 						RETURN NEW;
 					END;
 					$$ LANGUAGE plpgsql`, prefix),
-				fmt.Sprintf(`DROP TRIGGER IF EXISTS %s_events_search_update ON %s`, prefix, table),
-				fmt.Sprintf(`CREATE TRIGGER %s_events_search_update
+			fmt.Sprintf(`DROP TRIGGER IF EXISTS %s_events_search_update ON %s`, prefix, table),
+			fmt.Sprintf(`CREATE TRIGGER %s_events_search_update
 					BEFORE INSERT OR UPDATE ON %s
 					FOR EACH ROW EXECUTE FUNCTION %s_update_search_vector()`, prefix, table, prefix),
-			}
-			for _, s := range stmts {
-				if _, err := db.Exec(s); err != nil {
-					return fmt.Errorf("creating schema for %s: %w", table, err)
-				}
-			}
-			continue
+		}
 
-		case strings.HasSuffix(table, "__event_tags"):
-			prefix := table[:len(table)-len("__event_tags")]
-			eventsTable := prefix + "__events"
-			stmts := []string{
-				fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	case strings.HasSuffix(table, "__event_tags"):
+		prefix := table[:len(table)-len("__event_tags")]
+		eventsTable := prefix + "__events"
+		return []string{
+			fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
 					event_id TEXT NOT NULL,
 					key TEXT NOT NULL,
 					value TEXT NOT NULL,
 					FOREIGN KEY (event_id) REFERENCES %s(id) ON DELETE CASCADE
 				)`, table, eventsTable),
-				fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s__idx_event_tags_event_id ON %s(event_id)`, prefix, table),
-				fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s__idx_event_tags_key ON %s(key)`, prefix, table),
-				fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s__idx_event_tags_key_value ON %s(key, value)`, prefix, table),
-			}
-			for _, s := range stmts {
-				if _, err := db.Exec(s); err != nil {
-					return fmt.Errorf("creating schema for %s: %w", table, err)
-				}
-			}
-			continue
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s__idx_event_tags_event_id ON %s(event_id)`, prefix, table),
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s__idx_event_tags_key ON %s(key)`, prefix, table),
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s__idx_event_tags_key_value ON %s(key, value)`, prefix, table),
+		}
 
-		case table == "kv":
-			stmts := []string{
-				`CREATE TABLE IF NOT EXISTS kv (
+	case table == "kv":
+		return []string{
+			`CREATE TABLE IF NOT EXISTS kv (
 					key TEXT PRIMARY KEY,
 					value TEXT NOT NULL
 				)`,
-			}
-			for _, s := range stmts {
-				if _, err := db.Exec(s); err != nil {
-					return fmt.Errorf("creating schema for kv: %w", err)
-				}
-			}
-			continue
-
-		default:
-			log.Printf("Skipping unknown table: %s", table)
-			continue
 		}
+
+	default:
+		return nil
 	}
-	return nil
 }
 
-func migrateTable(srcDb, dstDb *sql.DB, table string) error {
-	// Count source rows
+// migrateTable migrates a whole table from its checkpoint.
+func (m *migrator) migrateTable(table string) error {
+	return m.migrateRange(job{table: table, key: table, to: math.MaxInt64})
+}
+
+// migrateRange migrates the source rows of job's rowid range, resuming from
+// the checkpoint saved under job.key.
+func (m *migrator) migrateRange(j job) error {
+	table := j.table
+
+	start, err := loadCheckpoint(m.dst, j.key)
+	if err != nil {
+		return err
+	}
+	resumed := start.rows > 0
+	start.lastRowid = max(start.lastRowid, j.from)
+
+	// Count source rows still to migrate
 	var srcCount int64
-	if err := srcDb.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", table)).Scan(&srcCount); err != nil {
+	if err := m.src.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE rowid > ? AND rowid <= ?", table), start.lastRowid, j.to).Scan(&srcCount); err != nil {
 		return fmt.Errorf("counting source rows: %w", err)
 	}
-	log.Printf("Migrating %s: %d rows", table, srcCount)
+	if resumed {
+		log.Printf("[%s] resuming after rowid %d (%d rows already migrated): %d rows left", j.key, start.lastRowid, start.rows, srcCount)
+	} else {
+		log.Printf("[%s] migrating %d rows", j.key, srcCount)
+	}
+
+	cp := start
+	defer func() {
+		m.mu.Lock()
+		m.runs[j.key] = tableRun{table: table, from: start, to: j.to, rows: cp.rows - start.rows}
+		m.mu.Unlock()
+	}()
 
 	if srcCount == 0 {
 		return nil
 	}
 
 	// Get columns from source
-	rows, err := srcDb.Query(fmt.Sprintf("SELECT * FROM %s LIMIT 0", table))
+	rows, err := m.src.Query(fmt.Sprintf("SELECT * FROM %s LIMIT 0", table))
 	if err != nil {
 		return fmt.Errorf("getting columns: %w", err)
 	}
@@ -225,22 +399,44 @@ func migrateTable(srcDb, dstDb *sql.DB, table string) error {
 		return fmt.Errorf("getting column names: %w", err)
 	}
 
-	// Read all rows from source
-	srcRows, err := srcDb.Query(fmt.Sprintf("SELECT * FROM %s", table))
+	// Read the remaining rows from source in rowid order
+	srcRows, err := m.src.Query(fmt.Sprintf("SELECT rowid, * FROM %s WHERE rowid > ? AND rowid <= ? ORDER BY rowid", table), start.lastRowid, j.to)
 	if err != nil {
 		return fmt.Errorf("querying source: %w", err)
 	}
 	defer srcRows.Close()
 
 	// Batch insert into destination
-	const batchSize = 500
 	batch := make([][]interface{}, 0, batchSize)
+	progress := newProgress(j.key, srcCount)
+	next := cp
+
+	flush := func() error {
+		if m.beforeBatch != nil {
+			if err := m.beforeBatch(j.key, cp.rows); err != nil {
+				return err
+			}
+		}
+		rows, err := m.filterBatch(table, cols, batch)
+		if err != nil {
+			return err
+		}
+		if err := m.writeBatch(table, cols, rows, &next); err != nil {
+			return err
+		}
+		cp = next
+		progress.add(len(batch))
+		batch = batch[:0]
+		return nil
+	}
 
 	for srcRows.Next() {
+		var rowid int64
 		values := make([]interface{}, len(cols))
-		valuePtrs := make([]interface{}, len(cols))
+		valuePtrs := make([]interface{}, len(cols)+1)
+		valuePtrs[0] = &rowid
 		for i := range values {
-			valuePtrs[i] = &values[i]
+			valuePtrs[i+1] = &values[i]
 		}
 
 		if err := srcRows.Scan(valuePtrs...); err != nil {
@@ -248,63 +444,35 @@ func migrateTable(srcDb, dstDb *sql.DB, table string) error {
 		}
 
 		batch = append(batch, values)
+		next.lastRowid = rowid
+		next.rows++
 
 		if len(batch) >= batchSize {
-			if err := insertBatch(dstDb, table, cols, batch); err != nil {
+			if err := flush(); err != nil {
 				return fmt.Errorf("inserting batch: %w", err)
 			}
-			batch = batch[:0]
 		}
 	}
+	if err := srcRows.Err(); err != nil {
+		return fmt.Errorf("reading source: %w", err)
+	}
 
 	// Insert remaining rows
 	if len(batch) > 0 {
-		if err := insertBatch(dstDb, table, cols, batch); err != nil {
+		if err := flush(); err != nil {
 			return fmt.Errorf("inserting final batch: %w", err)
 		}
 	}
 
-	log.Printf("Migrated %s: %d rows", table, srcCount)
+	progress.finish()
 	return nil
 }
 
-func insertBatch(db *sql.DB, table string, cols []string, rows [][]interface{}) error {
-	if len(rows) == 0 {
-		return nil
+func (m *migrator) writeBatch(table string, cols []string, rows [][]interface{}, cp *checkpoint) error {
+	if m.copy {
+		return copyBatch(m.dst, table, cols, rows, cp)
 	}
-
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-
-	// Build parameterized INSERT statement once, then prepare it
-	colList := ""
-	placeholders := ""
-	for i, col := range cols {
-		if i > 0 {
-			colList += ", "
-			placeholders += ", "
-		}
-		colList += col
-		placeholders += fmt.Sprintf("$%d", i+1)
-	}
-
-	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT DO NOTHING", table, colList, placeholders)
-	stmt, err := tx.Prepare(query)
-	if err != nil {
-		return fmt.Errorf("preparing insert for %s: %w", table, err)
-	}
-	defer stmt.Close()
-
-	for _, row := range rows {
-		if _, err := stmt.Exec(row...); err != nil {
-			return fmt.Errorf("inserting into %s: %w", table, err)
-		}
-	}
-
-	return tx.Commit()
+	return insertBatch(m.dst, table, cols, rows, cp)
 }
 
 func backfillSearchVectors(db *sql.DB, tables []string) error {
@@ -321,24 +489,64 @@ func backfillSearchVectors(db *sql.DB, tables []string) error {
 	return nil
 }
 
-func verifyCounts(srcDb, dstDb *sql.DB, tables []string) error {
+// verifyCounts compares source and destination row counts. A table resumed
+// from a checkpoint is only checked beyond it: the source rows after each
+// run's starting point must all have been migrated by that run.
+func (m *migrator) verifyCounts(tables []string) error {
 	var mismatches []string
 	for _, table := range tables {
+		if expected, ok := m.backfills[table]; ok {
+			ok, err := m.verifyBackfill(table, expected)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				mismatches = append(mismatches, fmt.Sprintf("%s (expected=%d from events)", table, expected))
+			}
+			continue
+		}
+
+		if runs := m.resumedRuns(table); runs != nil {
+			for _, run := range runs {
+				var srcCount int64
+				if err := m.src.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE rowid > ? AND rowid <= ?", table), run.from.lastRowid, run.to).Scan(&srcCount); err != nil {
+					return fmt.Errorf("counting source %s: %w", table, err)
+				}
+
+				status := "OK"
+				if srcCount != run.rows {
+					status = "MISMATCH"
+					mismatches = append(mismatches, fmt.Sprintf("%s after rowid %d (source=%d, migrated=%d)", run.from.table, run.from.lastRowid, srcCount, run.rows))
+				}
+				log.Printf("  %s: source=%d migrated=%d after rowid %d [%s]", run.from.table, srcCount, run.rows, run.from.lastRowid, status)
+			}
+			continue
+		}
+
 		var srcCount, dstCount int64
 
-		if err := srcDb.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", table)).Scan(&srcCount); err != nil {
+		if err := m.src.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", table)).Scan(&srcCount); err != nil {
 			return fmt.Errorf("counting source %s: %w", table, err)
 		}
-		if err := dstDb.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", table)).Scan(&dstCount); err != nil {
+		if err := m.dst.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", table)).Scan(&dstCount); err != nil {
 			return fmt.Errorf("counting dest %s: %w", table, err)
 		}
 
+		skipped, err := m.skippedRows(table)
+		if err != nil {
+			return err
+		}
+
 		status := "OK"
-		if srcCount != dstCount {
+		if srcCount-skipped != dstCount {
 			status = "MISMATCH"
-			mismatches = append(mismatches, fmt.Sprintf("%s (source=%d, dest=%d)", table, srcCount, dstCount))
+			mismatches = append(mismatches, fmt.Sprintf("%s (source=%d, skipped=%d, dest=%d)", table, srcCount, skipped, dstCount))
+		}
+		if skipped > 0 {
+			log.Printf("  %s: source=%d skipped=%d dest=%d [%s]", table, srcCount, skipped, dstCount, status)
+		} else {
+			log.Printf("  %s: source=%d dest=%d [%s]", table, srcCount, dstCount, status)
 		}
-		log.Printf("  %s: source=%d dest=%d [%s]", table, srcCount, dstCount, status)
 	}
 	if len(mismatches) > 0 {
 		return fmt.Errorf("row count mismatches: %s", strings.Join(mismatches, ", "))
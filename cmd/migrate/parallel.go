@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Parallel migration.
+//
+// Tables are migrated by a pool of m.concurrency workers. Events tables can
+// also be split into m.split rowid ranges, each migrated as its own job with
+// its own checkpoint, keyed "{table}#{i}/{n}". A tag table references its
+// events table, so it isn't started until every range of that table is done.
+
+// job is one unit of work: the source rows of table with rowids in
+// (from, to], checkpointed under key.
+type job struct {
+	table    string
+	key      string
+	from, to int64
+}
+
+// eventsDone tracks the outstanding jobs of one events table.
+type eventsDone struct {
+	remaining int
+	failed    bool
+	done      chan struct{}
+}
+
+// jobs lists the work for tables in dependency order, splitting events
+// tables into ranges if m.split asks for it.
+func (m *migrator) jobs(tables []string) ([]job, error) {
+	var jobs []job
+	for _, table := range orderTables(tables) {
+		if m.split <= 1 || !strings.HasSuffix(table, "__events") {
+			jobs = append(jobs, job{table: table, key: table, to: math.MaxInt64})
+			continue
+		}
+
+		var maxRowid int64
+		if err := m.src.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(rowid), 0) FROM %s", table)).Scan(&maxRowid); err != nil {
+			return nil, fmt.Errorf("finding rowid range of %s: %w", table, err)
+		}
+
+		n := int64(m.split)
+		for i := range n {
+			j := job{
+				table: table,
+				key:   fmt.Sprintf("%s#%d/%d", table, i+1, n),
+				from:  maxRowid * i / n,
+				to:    maxRowid * (i + 1) / n,
+			}
+			// The last range is open-ended, like an unsplit table
+			if i == n-1 {
+				j.to = math.MaxInt64
+			}
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs, nil
+}
+
+// migrateAll migrates tables with m.concurrency workers, running every job
+// even if some fail, and returns all the failures.
+func (m *migrator) migrateAll(tables []string) error {
+	jobs, err := m.jobs(tables)
+	if err != nil {
+		return err
+	}
+
+	deps := make(map[string]*eventsDone)
+	for _, j := range jobs {
+		if strings.HasSuffix(j.table, "__events") {
+			if deps[j.table] == nil {
+				deps[j.table] = &eventsDone{done: make(chan struct{})}
+			}
+			deps[j.table].remaining++
+		}
+	}
+
+	var mu sync.Mutex
+	var errs []error
+
+	finish := func(j job, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", j.key, err))
+		}
+		if d := deps[j.table]; d != nil {
+			d.failed = d.failed || err != nil
+			if d.remaining--; d.remaining == 0 {
+				close(d.done)
+			}
+		}
+	}
+
+	// Jobs are queued in dependency order, so by the time a worker waits
+	// on an events table all of its jobs have been taken by other workers
+	queue := make(chan job)
+	var wg sync.WaitGroup
+	for range max(m.concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				if strings.HasSuffix(j.table, "__event_tags") {
+					if d := deps[strings.TrimSuffix(j.table, "__event_tags")+"__events"]; d != nil {
+						<-d.done
+						mu.Lock()
+						failed := d.failed
+						mu.Unlock()
+						if failed {
+							log.Printf("[%s] skipped: its events table failed", j.key)
+							finish(j, errors.New("events table failed"))
+							continue
+						}
+					}
+				}
+				finish(j, m.migrateRange(j))
+			}
+		}()
+	}
+
+	for _, j := range jobs {
+		queue <- j
+	}
+	close(queue)
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// resumedRuns returns the runs that migrated table if any of them resumed
+// from a checkpoint, in which case only their ranges can be verified.
+func (m *migrator) resumedRuns(table string) []tableRun {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var runs []tableRun
+	resumed := false
+	for _, run := range m.runs {
+		if run.table == table {
+			runs = append(runs, run)
+			resumed = resumed || run.from.rows > 0
+		}
+	}
+	if !resumed {
+		return nil
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].from.lastRowid < runs[j].from.lastRowid })
+	return runs
+}
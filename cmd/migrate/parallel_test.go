@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMigrateAll_Parallel(t *testing.T) {
+	const rows = 12000
+
+	src, dst := openTestDatabases(t)
+	prefixes := []string{"alpha", "beta", "gamma"}
+	for _, prefix := range prefixes {
+		createSourceEvents(t, src, prefix)
+		fillSourceEvents(t, src, prefix, rows)
+	}
+	if _, err := src.Exec("CREATE TABLE kv (key TEXT PRIMARY KEY, value TEXT NOT NULL)"); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 100 {
+		if _, err := src.Exec("INSERT INTO kv VALUES (?, ?)", fmt.Sprint("key", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Alphabetical order puts every tag table before its events table
+	tables, err := discoverTables(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createSchema(dst, tables); err != nil {
+		t.Fatalf("createSchema failed: %v", err)
+	}
+	if err := ensureStateTable(dst); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newMigrator(src, dst)
+	m.concurrency = 4
+	m.split = 3
+
+	// No tag batch may be written before its events table is complete
+	var mu sync.Mutex
+	var early []string
+	m.beforeBatch = func(key string, migrated int64) error {
+		if prefix, ok := strings.CutSuffix(key, "__event_tags"); ok && migrated == 0 {
+			var n int64
+			if err := dst.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s__events", prefix)).Scan(&n); err != nil {
+				return err
+			}
+			if n != rows {
+				mu.Lock()
+				early = append(early, key)
+				mu.Unlock()
+			}
+		}
+		return nil
+	}
+
+	if err := m.migrateAll(tables); err != nil {
+		t.Fatalf("migrateAll failed: %v", err)
+	}
+	if len(early) > 0 {
+		t.Errorf("tag tables started before their events: %v", early)
+	}
+
+	for _, prefix := range prefixes {
+		for _, table := range []string{prefix + "__events", prefix + "__event_tags"} {
+			if n := countRows(t, dst, table); n != rows {
+				t.Errorf("%s has %d rows, want %d", table, n, rows)
+			}
+		}
+		for i := 1; i <= 3; i++ {
+			if _, ok := m.runs[fmt.Sprintf("%s__events#%d/3", prefix, i)]; !ok {
+				t.Errorf("%s__events range %d was not migrated separately", prefix, i)
+			}
+		}
+	}
+	if n := countRows(t, dst, "kv"); n != 100 {
+		t.Errorf("kv has %d rows, want 100", n)
+	}
+
+	if err := m.verifyCounts(tables); err != nil {
+		t.Errorf("verifyCounts failed: %v", err)
+	}
+	if err := m.verifyIntegrity(tables, 10); err != nil {
+		t.Errorf("verifyIntegrity failed: %v", err)
+	}
+
+	// Every range resumes finished
+	m = newMigrator(src, dst)
+	m.concurrency = 4
+	m.split = 3
+	if err := m.migrateAll(tables); err != nil {
+		t.Fatalf("resuming failed: %v", err)
+	}
+	for key, run := range m.runs {
+		if run.rows != 0 {
+			t.Errorf("%s migrated %d more rows on resume", key, run.rows)
+		}
+	}
+	if err := m.verifyCounts(tables); err != nil {
+		t.Errorf("verifyCounts failed after resuming: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// selectTables narrows the discovered tables to those named in only, if any,
+// and to those of the schema prefix, if set. Naming a table the source
+// doesn't have is an error, as is selecting nothing.
+func selectTables(discovered, only []string, prefix string) ([]string, error) {
+	present := make(map[string]bool, len(discovered))
+	for _, table := range discovered {
+		present[table] = true
+	}
+
+	wanted := make(map[string]bool, len(only))
+	for _, table := range only {
+		if !present[table] {
+			return nil, fmt.Errorf("table %s not found in source", table)
+		}
+		wanted[table] = true
+	}
+
+	prefix = strings.TrimSuffix(prefix, "__")
+
+	var selected []string
+	for _, table := range discovered {
+		if len(only) > 0 && !wanted[table] {
+			continue
+		}
+		if prefix != "" && !strings.HasPrefix(table, prefix+"__") {
+			continue
+		}
+		selected = append(selected, table)
+	}
+
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no tables selected")
+	}
+	return selected, nil
+}
+
+// splitUnknown separates the tables the relay knows from those it doesn't,
+// which have no PostgreSQL schema and are never migrated.
+func splitUnknown(tables []string) (known, unknown []string) {
+	for _, table := range tables {
+		if schemaStatements(table) == nil {
+			unknown = append(unknown, table)
+		} else {
+			known = append(known, table)
+		}
+	}
+	return known, unknown
+}
+
+// reportUnknown warns about every table that will be left behind, with its
+// size, so nothing is dropped unnoticed.
+func reportUnknown(src *sql.DB, unknown []string) error {
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	log.Printf("WARNING: %d unknown tables will NOT be migrated:", len(unknown))
+	for _, table := range unknown {
+		var n int64
+		if err := src.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", table)).Scan(&n); err != nil {
+			return fmt.Errorf("counting source %s: %w", table, err)
+		}
+		log.Printf("WARNING:   %s (%d rows)", table, n)
+	}
+	return nil
+}
+
+// dryRun logs what a migration of tables would do without writing anything:
+// the schema it would create, the rows it would copy or rebuild, and where it
+// would resume. The destination is only read, and only if m.dst is set.
+func (m *migrator) dryRun(tables []string) error {
+	log.Println("Dry run: nothing will be written")
+	log.Printf("Mode: concurrency=%d split-events=%d copy=%v", m.concurrency, m.split, m.copy)
+
+	if err := m.findTagBackfills(tables); err != nil {
+		return err
+	}
+
+	hasState := false
+	if m.dst != nil {
+		if err := m.dst.QueryRow("SELECT to_regclass('migration_state') IS NOT NULL").Scan(&hasState); err != nil {
+			return fmt.Errorf("checking for migration_state: %w", err)
+		}
+	}
+
+	for _, table := range orderTables(m.withBackfills(tables)) {
+		if expected, ok := m.backfills[table]; ok {
+			log.Printf("%s: rebuild from events, %d rows", table, expected)
+		} else {
+			var n int64
+			if err := m.src.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", table)).Scan(&n); err != nil {
+				return fmt.Errorf("counting source %s: %w", table, err)
+			}
+			log.Printf("%s: %d source rows", table, n)
+		}
+
+		if hasState {
+			var ranges, rows int64
+			err := m.dst.QueryRow("SELECT COUNT(*), COALESCE(SUM(rows), 0) FROM migration_state WHERE table_name = $1 OR starts_with(table_name, $1 || '#')", table).Scan(&ranges, &rows)
+			if err != nil {
+				return fmt.Errorf("loading checkpoints for %s: %w", table, err)
+			}
+			if ranges > 0 {
+				log.Printf("  resumes with %d rows already migrated", rows)
+			}
+		}
+
+		for _, stmt := range schemaStatements(table) {
+			log.Printf("  %s", strings.Join(strings.Fields(stmt), " "))
+		}
+	}
+
+	return nil
+}
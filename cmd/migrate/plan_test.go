@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSelectTables(t *testing.T) {
+	discovered := []string{"a__event_tags", "a__events", "b__event_tags", "b__events", "kv"}
+
+	tests := []struct {
+		name   string
+		only   []string
+		prefix string
+		want   []string
+	}{
+		{"everything", nil, "", discovered},
+		{"by prefix", nil, "b", []string{"b__event_tags", "b__events"}},
+		{"by prefix with separator", nil, "a__", []string{"a__event_tags", "a__events"}},
+		{"by name", []string{"kv", "a__events"}, "", []string{"a__events", "kv"}},
+		{"both", []string{"a__events", "b__events"}, "b", []string{"b__events"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectTables(discovered, tt.only, tt.prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("selectTables = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := selectTables(discovered, []string{"c__events"}, ""); err == nil {
+		t.Error("selecting a missing table should fail")
+	}
+	if _, err := selectTables(discovered, nil, "c"); err == nil {
+		t.Error("selecting nothing should fail")
+	}
+}
+
+func TestDryRun_WritesNothing(t *testing.T) {
+	src, dst := openTestDatabases(t)
+	createSourceEvents(t, src, "dry")
+	fillSourceEvents(t, src, "dry", 50)
+	if _, err := src.Exec("CREATE TABLE mystery (x TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another run's checkpoint, which the dry run should only read
+	if err := ensureStateTable(dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dst.Exec(saveCheckpoint, "dry__events", 20, 20); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clearCheckpoints(dst, []string{"dry__events"}) })
+
+	var before int64
+	if err := dst.QueryRow("SELECT COUNT(*) FROM pg_class").Scan(&before); err != nil {
+		t.Fatal(err)
+	}
+
+	discovered, err := discoverTables(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables, unknown := splitUnknown(discovered)
+	if !slices.Equal(unknown, []string{"mystery"}) {
+		t.Fatalf("unknown = %v, want [mystery]", unknown)
+	}
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	if err := reportUnknown(src, unknown); err != nil {
+		t.Fatal(err)
+	}
+	m := newMigrator(src, dst)
+	if err := m.dryRun(tables); err != nil {
+		t.Fatalf("dryRun failed: %v", err)
+	}
+
+	logged := out.String()
+	for _, want := range []string{
+		"WARNING:   mystery (0 rows)",
+		"dry__events: 50 source rows",
+		"resumes with 20 rows already migrated",
+		"CREATE TABLE IF NOT EXISTS dry__event_tags",
+	} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("dry run output lacks %q:\n%s", want, logged)
+		}
+	}
+
+	var after, exists int64
+	if err := dst.QueryRow("SELECT COUNT(*) FROM pg_class").Scan(&after); err != nil {
+		t.Fatal(err)
+	}
+	if after != before {
+		t.Errorf("dry run created %d relations", after-before)
+	}
+	if err := dst.QueryRow("SELECT COUNT(*) FROM information_schema.tables WHERE table_name LIKE 'dry%'").Scan(&exists); err != nil {
+		t.Fatal(err)
+	}
+	if exists != 0 {
+		t.Errorf("dry run created %d tables", exists)
+	}
+	if saved, err := loadCheckpoint(dst, "dry__events"); err != nil || saved.rows != 20 {
+		t.Errorf("checkpoint = %+v, %v; want it untouched", saved, err)
+	}
+}
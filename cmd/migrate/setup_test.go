@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+var testDatabaseURL string
+
+func TestMain(m *testing.M) {
+	ctx := context.Background()
+
+	pgContainer, err := postgres.Run(ctx, "postgres:16-alpine",
+		postgres.WithDatabase("migrate_test"),
+		postgres.WithUsername("test"),
+		postgres.WithPassword("test"),
+		testcontainers.WithWaitStrategy(
+			wait.ForLog("database system is ready to accept connections").
+				WithOccurrence(2).
+				WithStartupTimeout(30*time.Second),
+		),
+	)
+	if err != nil {
+		log.Fatalf("Failed to start PostgreSQL container: %v", err)
+	}
+
+	testDatabaseURL, err = pgContainer.ConnectionString(ctx, "sslmode=disable")
+	if err != nil {
+		pgContainer.Terminate(ctx)
+		log.Fatalf("Failed to get connection string: %v", err)
+	}
+
+	code := m.Run()
+
+	// Terminate container explicitly before os.Exit (which skips defers)
+	pgContainer.Terminate(ctx)
+
+	os.Exit(code)
+}
+
+// openTestDatabases returns a writable SQLite database in a temp dir and a
+// connection to the test PostgreSQL database.
+func openTestDatabases(t *testing.T) (src *sql.DB, dst *sql.DB) {
+	t.Helper()
+
+	src, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "source.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	t.Cleanup(func() { src.Close() })
+
+	dst, err = sql.Open("pgx", testDatabaseURL)
+	if err != nil {
+		t.Fatalf("Failed to open PostgreSQL: %v", err)
+	}
+	t.Cleanup(func() { dst.Close() })
+
+	return src, dst
+}
+
+// createSourceEvents creates prefix__events and prefix__event_tags in the
+// SQLite source, in the layout of the old SQLite event store.
+func createSourceEvents(t *testing.T, src *sql.DB, prefix string) {
+	t.Helper()
+
+	stmts := []string{
+		`CREATE TABLE ` + prefix + `__events (
+			id TEXT PRIMARY KEY,
+			created_at INTEGER NOT NULL,
+			kind INTEGER NOT NULL,
+			pubkey TEXT NOT NULL,
+			content TEXT NOT NULL,
+			tags TEXT NOT NULL,
+			sig TEXT NOT NULL
+		)`,
+		`CREATE TABLE ` + prefix + `__event_tags (
+			event_id TEXT NOT NULL,
+			key TEXT NOT NULL,
+			value TEXT NOT NULL
+		)`,
+	}
+	for _, stmt := range stmts {
+		if _, err := src.Exec(stmt); err != nil {
+			t.Fatalf("Failed to create source table: %v", err)
+		}
+	}
+}
+
+// countRows returns the number of rows in table.
+func countRows(t *testing.T, db *sql.DB, table string) int64 {
+	t.Helper()
+
+	var n int64
+	if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+		t.Fatalf("Failed to count %s: %v", table, err)
+	}
+	return n
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Tag backfill.
+//
+// SQLite databases from before the tag table have only {prefix}__events, and
+// some have a tag table that was never fully populated. Migrated as-is, every
+// tag filter on them returns nothing, so after migrating we rebuild the
+// destination's tag table from the events' tags JSON whenever the source's
+// has fewer than half the rows the events imply.
+
+// countIndexableTags counts the tags SaveEvent would index: those with at
+// least two string elements and a one-byte name. Events whose tags aren't a
+// JSON array are skipped, as backfillTags skips them, and so are events
+// --validate rejected, whose tags are subtracted with rejectedTags.
+const countIndexableTags = `SELECT COUNT(*) FROM %s e,
+	json_each(CASE WHEN NOT json_valid(e.tags) THEN '[]' WHEN json_type(e.tags) = 'array' THEN e.tags ELSE '[]' END) t
+	WHERE CASE WHEN t.type = 'array' THEN
+		json_type(t.value, '$[0]') = 'text'
+		AND json_type(t.value, '$[1]') = 'text'
+		AND length(CAST(json_extract(t.value, '$[0]') AS BLOB)) = 1
+	ELSE 0 END`
+
+func tagsTableFor(eventsTable string) string {
+	return strings.TrimSuffix(eventsTable, "__events") + "__event_tags"
+}
+
+// withTagTables adds the tag table of every events table that lacks one, so
+// createSchema creates it for the backfill to fill.
+func withTagTables(tables []string) []string {
+	present := make(map[string]bool, len(tables))
+	for _, table := range tables {
+		present[table] = true
+	}
+
+	result := append([]string(nil), tables...)
+	for _, table := range tables {
+		if strings.HasSuffix(table, "__events") && !present[tagsTableFor(table)] {
+			result = append(result, tagsTableFor(table))
+		}
+	}
+	return result
+}
+
+// findTagBackfills records in m.backfills every tag table that needs
+// rebuilding and how many rows it should end up with. Verification checks
+// those tables against that number instead of the source.
+func (m *migrator) findTagBackfills(tables []string) error {
+	present := make(map[string]bool, len(tables))
+	for _, table := range tables {
+		present[table] = true
+	}
+
+	for _, table := range tables {
+		if !strings.HasSuffix(table, "__events") {
+			continue
+		}
+		tagsTable := tagsTableFor(table)
+
+		var expected int64
+		if err := m.src.QueryRow(fmt.Sprintf(countIndexableTags, table)).Scan(&expected); err != nil {
+			return fmt.Errorf("counting tags in %s: %w", table, err)
+		}
+		rejected, err := m.rejectedTags(table)
+		if err != nil {
+			return err
+		}
+		expected -= rejected
+
+		var actual int64
+		if present[tagsTable] {
+			if err := m.src.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", tagsTable)).Scan(&actual); err != nil {
+				return fmt.Errorf("counting source %s: %w", tagsTable, err)
+			}
+		}
+
+		if actual*2 >= expected {
+			continue
+		}
+
+		if present[tagsTable] {
+			log.Printf("%s has %d rows but %s has %d indexable tags; rebuilding it", tagsTable, actual, table, expected)
+		} else {
+			log.Printf("%s has no tag table; building %s from %d indexable tags", table, tagsTable, expected)
+		}
+		m.backfills[tagsTable] = expected
+	}
+
+	return nil
+}
+
+// rejectedTags counts the indexable tags of the events of table that
+// --validate rejected.
+func (m *migrator) rejectedTags(table string) (int64, error) {
+	m.mu.Lock()
+	var ids []interface{}
+	for id := range m.rejected[table] {
+		ids = append(ids, id)
+	}
+	m.mu.Unlock()
+
+	// Stay well below SQLite's bound parameter limit
+	const chunk = 500
+	var total int64
+	for start := 0; start < len(ids); start += chunk {
+		part := ids[start:min(start+chunk, len(ids))]
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(part)), ", ")
+
+		var n int64
+		query := fmt.Sprintf(countIndexableTags, table) + fmt.Sprintf(" AND e.id IN (%s)", placeholders)
+		if err := m.src.QueryRow(query, part...).Scan(&n); err != nil {
+			return 0, fmt.Errorf("counting rejected tags in %s: %w", table, err)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// backfillTags rebuilds each tag table found by findTagBackfills from the
+// source events, replacing whatever was migrated into it.
+func (m *migrator) backfillTags(tables []string) error {
+	if err := m.findTagBackfills(tables); err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		if !strings.HasSuffix(table, "__events") {
+			continue
+		}
+		tagsTable := tagsTableFor(table)
+		expected, ok := m.backfills[tagsTable]
+		if !ok {
+			continue
+		}
+
+		if _, err := m.dst.Exec(fmt.Sprintf("DELETE FROM %s", tagsTable)); err != nil {
+			return fmt.Errorf("clearing %s: %w", tagsTable, err)
+		}
+		if err := m.backfillTagTable(table, tagsTable, expected); err != nil {
+			return fmt.Errorf("backfilling %s: %w", tagsTable, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *migrator) backfillTagTable(eventsTable, tagsTable string, expected int64) error {
+	rows, err := m.src.Query(fmt.Sprintf("SELECT id, tags FROM %s ORDER BY rowid", eventsTable))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	cols := []string{"event_id", "key", "value"}
+	batch := make([][]interface{}, 0, batchSize)
+	progress := newProgress(tagsTable, expected)
+	skipped := 0
+
+	for rows.Next() {
+		var id, tagsJSON string
+		if err := rows.Scan(&id, &tagsJSON); err != nil {
+			return err
+		}
+		if m.isRejected(eventsTable, id) {
+			continue
+		}
+
+		// Decoded loosely so one odd tag doesn't lose the rest
+		var tags []interface{}
+		if err := json.Unmarshal([]byte(tagsJSON), &tags); err != nil {
+			skipped++
+			continue
+		}
+
+		for _, element := range tags {
+			tag, ok := element.([]interface{})
+			if !ok || len(tag) < 2 {
+				continue
+			}
+			key, ok := tag[0].(string)
+			value, ok2 := tag[1].(string)
+			if !ok || !ok2 || len(key) != 1 {
+				continue
+			}
+			batch = append(batch, []interface{}{id, key, value})
+		}
+
+		if len(batch) >= batchSize {
+			if err := insertBatch(m.dst, tagsTable, cols, batch, nil); err != nil {
+				return err
+			}
+			progress.add(len(batch))
+			batch = batch[:0]
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if err := insertBatch(m.dst, tagsTable, cols, batch, nil); err != nil {
+		return err
+	}
+	progress.add(len(batch))
+
+	if skipped > 0 {
+		log.Printf("Skipped %d events in %s with unreadable tags", skipped, eventsTable)
+	}
+	progress.finish()
+	return nil
+}
+
+// withBackfills adds the rebuilt tag tables the source has no table for, so
+// they are verified too.
+func (m *migrator) withBackfills(tables []string) []string {
+	result := append([]string(nil), tables...)
+	for _, table := range withTagTables(tables)[len(tables):] {
+		if _, ok := m.backfills[table]; ok {
+			result = append(result, table)
+		}
+	}
+	return result
+}
+
+// verifyBackfill checks a rebuilt tag table holds the expected number of rows.
+func (m *migrator) verifyBackfill(table string, expected int64) (bool, error) {
+	var dstCount int64
+	if err := m.dst.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", table)).Scan(&dstCount); err != nil {
+		return false, fmt.Errorf("counting dest %s: %w", table, err)
+	}
+
+	ok := dstCount == expected
+	status := "OK"
+	if !ok {
+		status = "MISMATCH"
+	}
+	log.Printf("  %s: expected=%d dest=%d, rebuilt from events [%s]", table, expected, dstCount, status)
+	return ok, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import "testing"
+
+func TestBackfillTags_MissingTagsTable(t *testing.T) {
+	const rows = 300
+
+	src, dst := openTestDatabases(t)
+	createSourceEvents(t, src, "legacy")
+	fillSourceEvents(t, src, "legacy", rows)
+
+	// A pre-tag-table database, with some tags SaveEvent would not index
+	extra := []struct{ id, tags string }{
+		{"multi", `[["h","group1"],["alt","not indexed"],["p"]]`},
+		{"numeric", `[["h",5],["e","abc"],"junk"]`},
+		{"broken", `not json`},
+	}
+	for i, e := range extra {
+		if _, err := src.Exec("INSERT INTO legacy__events VALUES (?, ?, 1, 'pk', '', ?, 'sig')", e.id, 1800000000+i, e.tags); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := src.Exec("DROP TABLE legacy__event_tags"); err != nil {
+		t.Fatal(err)
+	}
+
+	tables, err := discoverTables(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 1 {
+		t.Fatalf("tables = %v, want only the events table", tables)
+	}
+	if err := createSchema(dst, withTagTables(tables)); err != nil {
+		t.Fatalf("createSchema failed: %v", err)
+	}
+	if err := ensureStateTable(dst); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newMigrator(src, dst)
+	if err := m.migrateTable("legacy__events"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.backfillTags(tables); err != nil {
+		t.Fatalf("backfillTags failed: %v", err)
+	}
+
+	// One h tag per synthetic event, plus h=group1 and e=abc
+	const want = rows + 2
+	if got := m.backfills["legacy__event_tags"]; got != want {
+		t.Errorf("expected %d backfilled rows, want %d", got, want)
+	}
+	if n := countRows(t, dst, "legacy__event_tags"); n != want {
+		t.Errorf("legacy__event_tags has %d rows, want %d", n, want)
+	}
+
+	var matched int64
+	if err := dst.QueryRow("SELECT COUNT(DISTINCT event_id) FROM legacy__event_tags WHERE key = 'h' AND value = 'group1'").Scan(&matched); err != nil {
+		t.Fatal(err)
+	}
+	if matched != rows/10+1 {
+		t.Errorf("h=group1 matches %d events, want %d", matched, rows/10+1)
+	}
+
+	verified := m.withBackfills(tables)
+	if len(verified) != 2 {
+		t.Fatalf("verifying %v, want the events and rebuilt tag tables", verified)
+	}
+	if err := m.verifyCounts(verified); err != nil {
+		t.Errorf("verifyCounts failed: %v", err)
+	}
+	if err := m.verifyIntegrity(verified, 10); err != nil {
+		t.Errorf("verifyIntegrity failed: %v", err)
+	}
+}
+
+func TestBackfillTags_SparseTagsTable(t *testing.T) {
+	const rows = 100
+
+	src, dst := openTestDatabases(t)
+	createSourceEvents(t, src, "sparse")
+	createSourceEvents(t, src, "full")
+	fillSourceEvents(t, src, "sparse", rows)
+	fillSourceEvents(t, src, "full", rows)
+
+	if _, err := src.Exec("DELETE FROM sparse__event_tags WHERE rowid > 10"); err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []string{"full__events", "full__event_tags", "sparse__events", "sparse__event_tags"}
+	if err := createSchema(dst, tables); err != nil {
+		t.Fatalf("createSchema failed: %v", err)
+	}
+	if err := ensureStateTable(dst); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newMigrator(src, dst)
+	for _, table := range tables {
+		if err := m.migrateTable(table); err != nil {
+			t.Fatalf("migrating %s: %v", table, err)
+		}
+	}
+	if err := m.backfillTags(tables); err != nil {
+		t.Fatalf("backfillTags failed: %v", err)
+	}
+
+	if _, ok := m.backfills["full__event_tags"]; ok {
+		t.Error("a complete tag table should be migrated, not rebuilt")
+	}
+	for _, table := range []string{"full__event_tags", "sparse__event_tags"} {
+		if n := countRows(t, dst, table); n != rows {
+			t.Errorf("%s has %d rows, want %d", table, n, rows)
+		}
+	}
+
+	// The ten migrated rows were replaced rather than duplicated
+	var dupes int64
+	if err := dst.QueryRow("SELECT COUNT(*) - COUNT(DISTINCT event_id) FROM sparse__event_tags").Scan(&dupes); err != nil {
+		t.Fatal(err)
+	}
+	if dupes != 0 {
+		t.Errorf("sparse__event_tags has %d duplicate rows", dupes)
+	}
+
+	if err := m.verifyCounts(tables); err != nil {
+		t.Errorf("verifyCounts failed: %v", err)
+	}
+	if err := m.verifyIntegrity(tables, 0); err != nil {
+		t.Errorf("verifyIntegrity failed: %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"fiatjaf.com/nostr"
+)
+
+// Event validation.
+//
+// With --validate every events row is parsed and its id and signature
+// checked before it is written. Invalid events are skipped, or abort the
+// migration with --strict, and the tag rows of skipped events are dropped
+// with them. Rejections are recorded in migration_rejected alongside the
+// checkpoints so a resumed run still drops their tags, and are written to a
+// file at the end for review.
+
+const createRejectedTable = `CREATE TABLE IF NOT EXISTS migration_rejected (
+	table_name TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	PRIMARY KEY (table_name, event_id)
+)`
+
+// rejection is an event --validate refused to migrate.
+type rejection struct {
+	table, id, reason string
+}
+
+// parseEvent reads an events row with the given columns into an event.
+func parseEvent(cols []string, row []interface{}) (nostr.Event, error) {
+	var evt nostr.Event
+	for i, col := range cols {
+		switch col {
+		case "id":
+			id, err := nostr.IDFromHex(asString(row[i]))
+			if err != nil {
+				return evt, fmt.Errorf("invalid id: %w", err)
+			}
+			evt.ID = id
+		case "pubkey":
+			pubkey, err := nostr.PubKeyFromHex(asString(row[i]))
+			if err != nil {
+				return evt, fmt.Errorf("invalid pubkey: %w", err)
+			}
+			evt.PubKey = pubkey
+		case "created_at":
+			n, ok := row[i].(int64)
+			if !ok {
+				return evt, errors.New("invalid created_at")
+			}
+			evt.CreatedAt = nostr.Timestamp(n)
+		case "kind":
+			n, ok := row[i].(int64)
+			if !ok {
+				return evt, errors.New("invalid kind")
+			}
+			evt.Kind = nostr.Kind(n)
+		case "content":
+			evt.Content = asString(row[i])
+		case "tags":
+			if err := json.Unmarshal([]byte(asString(row[i])), &evt.Tags); err != nil {
+				return evt, fmt.Errorf("invalid tags: %w", err)
+			}
+		case "sig":
+			sig, err := hex.DecodeString(asString(row[i]))
+			if err != nil || len(sig) != 64 {
+				return evt, errors.New("invalid sig")
+			}
+			copy(evt.Sig[:], sig)
+		}
+	}
+	return evt, nil
+}
+
+func asString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// checkEvent returns why an events row is invalid, or "" if it isn't.
+func checkEvent(cols []string, row []interface{}) string {
+	evt, err := parseEvent(cols, row)
+	switch {
+	case err != nil:
+		return err.Error()
+	case !evt.CheckID():
+		return "id does not match content"
+	case !evt.VerifySignature():
+		return "invalid signature"
+	}
+	return ""
+}
+
+// validateBatch checks rows across all CPUs and returns the valid ones, in
+// order, and the rejections.
+func validateBatch(table string, cols []string, rows [][]interface{}) ([][]interface{}, []rejection) {
+	idCol := slices.Index(cols, "id")
+	reasons := make([]string, len(rows))
+
+	workers := runtime.NumCPU()
+	chunk := (len(rows) + workers - 1) / workers
+	var wg sync.WaitGroup
+	for start := 0; start < len(rows); start += chunk {
+		end := min(start+chunk, len(rows))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				reasons[i] = checkEvent(cols, rows[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	kept := rows[:0:0]
+	var rejected []rejection
+	for i, row := range rows {
+		if reasons[i] == "" {
+			kept = append(kept, row)
+		} else {
+			rejected = append(rejected, rejection{table, asString(row[idCol]), reasons[i]})
+		}
+	}
+	return kept, rejected
+}
+
+// filterBatch drops the rows of a batch that must not be migrated: invalid
+// events when validating, and the tags of every rejected event.
+func (m *migrator) filterBatch(table string, cols []string, rows [][]interface{}) ([][]interface{}, error) {
+	switch {
+	case m.validate && strings.HasSuffix(table, "__events"):
+		kept, rejected := validateBatch(table, cols, rows)
+		if len(rejected) == 0 {
+			return kept, nil
+		}
+		if m.strict {
+			r := rejected[0]
+			return nil, fmt.Errorf("event %s is invalid (%s) and --strict is set", r.id, r.reason)
+		}
+		if err := m.reject(rejected); err != nil {
+			return nil, err
+		}
+		return kept, nil
+
+	case strings.HasSuffix(table, "__event_tags"):
+		m.mu.Lock()
+		rejected := m.rejected[strings.TrimSuffix(table, "__event_tags")+"__events"]
+		m.mu.Unlock()
+		if len(rejected) == 0 {
+			return rows, nil
+		}
+
+		idCol := slices.Index(cols, "event_id")
+		kept := rows[:0:0]
+		for _, row := range rows {
+			if _, ok := rejected[asString(row[idCol])]; !ok {
+				kept = append(kept, row)
+			}
+		}
+		return kept, nil
+	}
+
+	return rows, nil
+}
+
+// reject records rejections in memory and in migration_rejected. They are
+// saved before the batch they were dropped from, so a crash in between only
+// means they are rejected again on resume.
+func (m *migrator) reject(rejected []rejection) error {
+	for _, r := range rejected {
+		_, err := m.dst.Exec(`INSERT INTO migration_rejected (table_name, event_id, reason) VALUES ($1, $2, $3)
+			ON CONFLICT (table_name, event_id) DO UPDATE SET reason = EXCLUDED.reason`, r.table, r.id, r.reason)
+		if err != nil {
+			return fmt.Errorf("recording rejected event %s: %w", r.id, err)
+		}
+	}
+
+	m.remember(rejected)
+	return nil
+}
+
+func (m *migrator) remember(rejected []rejection) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range rejected {
+		if m.rejected[r.table] == nil {
+			m.rejected[r.table] = make(map[string]string)
+		}
+		m.rejected[r.table][r.id] = r.reason
+	}
+}
+
+// isRejected reports whether event id of table was rejected.
+func (m *migrator) isRejected(table, id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.rejected[table][id]
+	return ok
+}
+
+// loadRejections reads the rejections of earlier runs.
+func (m *migrator) loadRejections() error {
+	rows, err := m.dst.Query("SELECT table_name, event_id, reason FROM migration_rejected")
+	if err != nil {
+		return fmt.Errorf("loading rejected events: %w", err)
+	}
+	defer rows.Close()
+
+	var rejected []rejection
+	for rows.Next() {
+		var r rejection
+		if err := rows.Scan(&r.table, &r.id, &r.reason); err != nil {
+			return err
+		}
+		rejected = append(rejected, r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	m.remember(rejected)
+	return nil
+}
+
+// skippedRows returns how many source rows of table were deliberately not
+// migrated: its rejected events, or the tags of its events table's.
+func (m *migrator) skippedRows(table string) (int64, error) {
+	if strings.HasSuffix(table, "__events") {
+		return int64(len(m.rejected[table])), nil
+	}
+	if !strings.HasSuffix(table, "__event_tags") {
+		return 0, nil
+	}
+
+	var ids []interface{}
+	for id := range m.rejected[strings.TrimSuffix(table, "__event_tags")+"__events"] {
+		ids = append(ids, id)
+	}
+
+	// Stay well below SQLite's bound parameter limit
+	const chunk = 500
+	var total int64
+	for start := 0; start < len(ids); start += chunk {
+		part := ids[start:min(start+chunk, len(ids))]
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(part)), ", ")
+
+		var n int64
+		query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE event_id IN (%s)", table, placeholders)
+		if err := m.src.QueryRow(query, part...).Scan(&n); err != nil {
+			return 0, fmt.Errorf("counting skipped tags in %s: %w", table, err)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// reportRejections logs how many events each table lost and writes every
+// rejection to path, one tab-separated table, id and reason per line.
+func (m *migrator) reportRejections(path string) error {
+	var rejected []rejection
+	for table, ids := range m.rejected {
+		log.Printf("Rejected %d invalid events from %s", len(ids), table)
+		for id, reason := range ids {
+			rejected = append(rejected, rejection{table, id, reason})
+		}
+	}
+	if len(rejected) == 0 {
+		return nil
+	}
+	sort.Slice(rejected, func(i, j int) bool {
+		if rejected[i].table != rejected[j].table {
+			return rejected[i].table < rejected[j].table
+		}
+		return rejected[i].id < rejected[j].id
+	})
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, r := range rejected {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.table, r.id, r.reason)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	log.Printf("Wrote %d rejected event IDs to %s", len(rejected), path)
+	return f.Close()
+}
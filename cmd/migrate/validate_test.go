@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+// fillSignedEvents inserts n properly signed events, each with one h tag,
+// and returns their ids.
+func fillSignedEvents(t *testing.T, src *sql.DB, prefix string, n int) []string {
+	t.Helper()
+
+	sk := nostr.Generate()
+	ids := make([]string, n)
+	for i := range n {
+		evt := nostr.Event{
+			CreatedAt: nostr.Timestamp(1700000000 + i),
+			Kind:      9,
+			Tags:      nostr.Tags{{"h", "group"}},
+			Content:   fmt.Sprintf("message %d", i),
+		}
+		if err := evt.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+		tags, _ := json.Marshal(evt.Tags)
+
+		ids[i] = evt.ID.Hex()
+		_, err := src.Exec(fmt.Sprintf("INSERT INTO %s__events VALUES (?, ?, ?, ?, ?, ?, ?)", prefix),
+			ids[i], int64(evt.CreatedAt), int(evt.Kind), evt.PubKey.Hex(), evt.Content, string(tags), hex.EncodeToString(evt.Sig[:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := src.Exec(fmt.Sprintf("INSERT INTO %s__event_tags VALUES (?, 'h', 'group')", prefix), ids[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ids
+}
+
+func TestValidate_SkipsInvalidEvents(t *testing.T) {
+	const rows = 50
+
+	src, dst := openTestDatabases(t)
+	createSourceEvents(t, src, "signed")
+	ids := fillSignedEvents(t, src, "signed", rows)
+
+	// One event whose content no longer matches its id, one with a
+	// signature from someone else
+	if _, err := src.Exec("UPDATE signed__events SET content = 'edited' WHERE id = ?", ids[3]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Exec("UPDATE signed__events SET sig = (SELECT sig FROM signed__events WHERE id = ?) WHERE id = ?", ids[5], ids[7]); err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []string{"signed__events", "signed__event_tags"}
+	if err := createSchema(dst, tables); err != nil {
+		t.Fatalf("createSchema failed: %v", err)
+	}
+	if err := ensureStateTable(dst); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clearCheckpoints(dst, tables) })
+
+	// --strict aborts before writing the batch
+	strict := newMigrator(src, dst)
+	strict.validate, strict.strict = true, true
+	if err := strict.migrateTable("signed__events"); err == nil || !strings.Contains(err.Error(), "--strict") {
+		t.Fatalf("strict migration error = %v, want an invalid event", err)
+	}
+	if n := countRows(t, dst, "signed__events"); n != 0 {
+		t.Fatalf("strict migration wrote %d events", n)
+	}
+
+	m := newMigrator(src, dst)
+	m.validate = true
+	if err := m.migrateAll(tables); err != nil {
+		t.Fatalf("migrateAll failed: %v", err)
+	}
+
+	rejected := m.rejected["signed__events"]
+	if len(rejected) != 2 {
+		t.Fatalf("rejected = %v, want two events", rejected)
+	}
+	if rejected[ids[3]] != "id does not match content" || rejected[ids[7]] != "invalid signature" {
+		t.Errorf("rejected = %v", rejected)
+	}
+
+	for _, table := range tables {
+		if n := countRows(t, dst, table); n != rows-2 {
+			t.Errorf("%s has %d rows, want %d", table, n, rows-2)
+		}
+	}
+	if err := m.verifyCounts(tables); err != nil {
+		t.Errorf("verifyCounts failed: %v", err)
+	}
+	if err := m.verifyIntegrity(tables, rows); err != nil {
+		t.Errorf("verifyIntegrity failed: %v", err)
+	}
+
+	// The report lists both
+	path := filepath.Join(t.TempDir(), "rejected.txt")
+	if err := m.reportRejections(path); err != nil {
+		t.Fatal(err)
+	}
+	report, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(report)), "\n"); len(lines) != 2 || !strings.Contains(string(report), ids[3]) || !strings.Contains(string(report), ids[7]) {
+		t.Errorf("report = %q", report)
+	}
+
+	// A later run remembers the rejections, so the tags stay dropped
+	again := newMigrator(src, dst)
+	if err := again.loadRejections(); err != nil {
+		t.Fatal(err)
+	}
+	if len(again.rejected["signed__events"]) != 2 {
+		t.Errorf("reloaded rejections = %v", again.rejected)
+	}
+	if _, err := dst.Exec("DELETE FROM migration_state WHERE table_name = 'signed__event_tags'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := again.migrateTable("signed__event_tags"); err != nil {
+		t.Fatalf("re-migrating tags failed: %v", err)
+	}
+}
+
+func TestValidate_BackfillSkipsRejected(t *testing.T) {
+	const rows = 20
+
+	src, dst := openTestDatabases(t)
+	createSourceEvents(t, src, "unindexed")
+	ids := fillSignedEvents(t, src, "unindexed", rows)
+
+	if _, err := src.Exec("UPDATE unindexed__events SET content = 'edited' WHERE id = ?", ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Exec("DROP TABLE unindexed__event_tags"); err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []string{"unindexed__events"}
+	if err := createSchema(dst, withTagTables(tables)); err != nil {
+		t.Fatalf("createSchema failed: %v", err)
+	}
+	if err := ensureStateTable(dst); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clearCheckpoints(dst, tables) })
+
+	m := newMigrator(src, dst)
+	m.validate = true
+	if err := m.migrateAll(tables); err != nil {
+		t.Fatalf("migrateAll failed: %v", err)
+	}
+	if err := m.backfillTags(tables); err != nil {
+		t.Fatalf("backfillTags failed: %v", err)
+	}
+
+	if got := m.backfills["unindexed__event_tags"]; got != rows-1 {
+		t.Errorf("expected %d backfilled rows, want %d", got, rows-1)
+	}
+	var orphans int64
+	if err := dst.QueryRow("SELECT COUNT(*) FROM unindexed__event_tags WHERE event_id = $1", ids[2]).Scan(&orphans); err != nil {
+		t.Fatal(err)
+	}
+	if orphans != 0 {
+		t.Errorf("the rejected event's tags were backfilled")
+	}
+	if ok, err := m.verifyBackfill("unindexed__event_tags", m.backfills["unindexed__event_tags"]); err != nil || !ok {
+		t.Errorf("verifyBackfill = %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Integrity checks.
+//
+// verifyCounts only proves both sides have the same number of rows. These
+// checks hash row contents on both sides: PostgreSQL computes the hashes in
+// SQL so only ids and digests cross the network, and the SQLite side, which
+// has no md5(), computes the same strings in Go.
+//
+// Events tables are compared row by row in id order, so every missing,
+// unexpected or changed event is reported by id. Other tables have no
+// usable key (event_tags has none at all), so they are compared by row count
+// and the sum of a 60-bit prefix of each row's hash.
+
+// eventColumns are the events columns that are hashed and spot checked.
+var eventColumns = []string{"id", "created_at", "kind", "pubkey", "content", "tags", "sig"}
+
+// pgEventDigest must produce exactly what eventDigest does.
+const pgEventDigest = `md5(id || created_at::text || kind::text || pubkey || md5(content) || md5(tags) || sig)`
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func eventDigest(id string, createdAt, kind int64, pubkey, content, tags, sig string) string {
+	return md5Hex(id + strconv.FormatInt(createdAt, 10) + strconv.FormatInt(kind, 10) + pubkey + md5Hex(content) + md5Hex(tags) + sig)
+}
+
+// integrityProblem is one difference found by an integrity check.
+type integrityProblem struct {
+	table  string
+	id     string // empty for table-level problems
+	detail string
+}
+
+func (p integrityProblem) String() string {
+	if p.id == "" {
+		return fmt.Sprintf("%s: %s", p.table, p.detail)
+	}
+	return fmt.Sprintf("%s: %s %s", p.table, p.id, p.detail)
+}
+
+// verifyIntegrity checksums every table and spot checks spotChecks random
+// rows of each events table field by field. It logs every problem found and
+// fails if there were any.
+func (m *migrator) verifyIntegrity(tables []string, spotChecks int) error {
+	var problems []integrityProblem
+
+	for _, table := range tables {
+		var found []integrityProblem
+		var err error
+
+		if _, ok := m.backfills[table]; ok {
+			// Rebuilt from events rather than copied, so there is no
+			// source to compare with
+			continue
+		} else if strings.HasSuffix(table, "__events") {
+			found, err = m.compareEvents(table)
+			if err == nil {
+				var spot []integrityProblem
+				spot, err = m.spotCheckEvents(table, spotChecks)
+				found = append(found, spot...)
+			}
+		} else {
+			found, err = m.compareChecksums(table)
+		}
+		if err != nil {
+			return fmt.Errorf("checking %s: %w", table, err)
+		}
+
+		status := "OK"
+		if len(found) > 0 {
+			status = fmt.Sprintf("%d problems", len(found))
+		}
+		log.Printf("  %s: content [%s]", table, status)
+
+		problems = append(problems, found...)
+	}
+
+	const maxReported = 100
+	for i, problem := range problems {
+		if i == maxReported {
+			log.Printf("  ... and %d more", len(problems)-maxReported)
+			break
+		}
+		log.Printf("  %s", problem)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d integrity problems", len(problems))
+	}
+	return nil
+}
+
+// compareEvents walks both events tables in id order, comparing row digests.
+func (m *migrator) compareEvents(table string) ([]integrityProblem, error) {
+	srcRows, err := m.src.Query(fmt.Sprintf("SELECT %s FROM %s ORDER BY id", strings.Join(eventColumns, ", "), table))
+	if err != nil {
+		return nil, err
+	}
+	defer srcRows.Close()
+
+	dstRows, err := m.dst.Query(fmt.Sprintf(`SELECT id, %s FROM %s ORDER BY id COLLATE "C"`, pgEventDigest, table))
+	if err != nil {
+		return nil, err
+	}
+	defer dstRows.Close()
+
+	nextSrc := func() (id, digest string, ok bool, err error) {
+		if !srcRows.Next() {
+			return "", "", false, srcRows.Err()
+		}
+		var createdAt, kind int64
+		var pubkey, content, tags, sig string
+		if err := srcRows.Scan(&id, &createdAt, &kind, &pubkey, &content, &tags, &sig); err != nil {
+			return "", "", false, err
+		}
+		return id, eventDigest(id, createdAt, kind, pubkey, content, tags, sig), true, nil
+	}
+
+	nextDst := func() (id, digest string, ok bool, err error) {
+		if !dstRows.Next() {
+			return "", "", false, dstRows.Err()
+		}
+		err = dstRows.Scan(&id, &digest)
+		return id, digest, err == nil, err
+	}
+
+	var problems []integrityProblem
+
+	srcID, srcDigest, srcOK, err := nextSrc()
+	if err != nil {
+		return nil, err
+	}
+	dstID, dstDigest, dstOK, err := nextDst()
+	if err != nil {
+		return nil, err
+	}
+
+	for srcOK || dstOK {
+		switch {
+		case srcOK && (!dstOK || srcID < dstID):
+			if !m.isRejected(table, srcID) {
+				problems = append(problems, integrityProblem{table, srcID, "is missing from the destination"})
+			}
+			srcID, srcDigest, srcOK, err = nextSrc()
+		case dstOK && (!srcOK || dstID < srcID):
+			problems = append(problems, integrityProblem{table, dstID, "is not in the source"})
+			dstID, dstDigest, dstOK, err = nextDst()
+		default:
+			if srcDigest != dstDigest {
+				problems = append(problems, integrityProblem{table, srcID, "has different content"})
+			}
+			if srcID, srcDigest, srcOK, err = nextSrc(); err != nil {
+				return nil, err
+			}
+			dstID, dstDigest, dstOK, err = nextDst()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return problems, nil
+}
+
+// spotCheckEvents compares n random source events with the destination
+// field by field, naming the fields that differ. Rejected events are passed
+// over.
+func (m *migrator) spotCheckEvents(table string, n int) ([]integrityProblem, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	cols := strings.Join(eventColumns, ", ")
+	srcRows, err := m.src.Query(fmt.Sprintf("SELECT %s FROM %s ORDER BY RANDOM() LIMIT ?", cols, table), n)
+	if err != nil {
+		return nil, err
+	}
+	defer srcRows.Close()
+
+	var problems []integrityProblem
+	for srcRows.Next() {
+		src := make([]string, len(eventColumns))
+		dst := make([]string, len(eventColumns))
+		if err := srcRows.Scan(stringPtrs(src)...); err != nil {
+			return nil, err
+		}
+		if m.isRejected(table, src[0]) {
+			continue
+		}
+
+		// Integer columns compare as text, as both drivers format them
+		// the same way
+		err := m.dst.QueryRow(fmt.Sprintf("SELECT id, created_at::text, kind::text, pubkey, content, tags, sig FROM %s WHERE id = $1", table), src[0]).Scan(stringPtrs(dst)...)
+		if err == sql.ErrNoRows {
+			problems = append(problems, integrityProblem{table, src[0], "is missing from the destination"})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var differing []string
+		for i, col := range eventColumns {
+			if src[i] != dst[i] {
+				differing = append(differing, col)
+			}
+		}
+		if len(differing) > 0 {
+			problems = append(problems, integrityProblem{table, src[0], "differs in " + strings.Join(differing, ", ")})
+		}
+	}
+
+	return problems, srcRows.Err()
+}
+
+func stringPtrs(values []string) []interface{} {
+	ptrs := make([]interface{}, len(values))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	return ptrs
+}
+
+// checksumMask keeps the sum of row hashes to 60 bits: small enough that
+// PostgreSQL can sum the prefixes as bigints, and a divisor of 2^64 so the Go
+// side can let its uint64 sum wrap.
+const checksumMask = 1<<60 - 1
+
+// compareChecksums compares the row count and summed row hashes of a table
+// without a usable key. Each row hashes its columns as text, joined by the
+// unit separator.
+func (m *migrator) compareChecksums(table string) ([]integrityProblem, error) {
+	rows, err := m.src.Query(fmt.Sprintf("SELECT * FROM %s", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	// Tag rows of events --validate rejected were never migrated
+	eventsTable := strings.TrimSuffix(table, "__event_tags") + "__events"
+	eventCol := -1
+	if strings.HasSuffix(table, "__event_tags") {
+		eventCol = slices.Index(cols, "event_id")
+	}
+
+	var srcCount int64
+	var srcSum uint64
+	values := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		if eventCol >= 0 && m.isRejected(eventsTable, asString(values[eventCol])) {
+			continue
+		}
+
+		fields := make([]string, 0, len(values))
+		for _, value := range values {
+			switch v := value.(type) {
+			case nil:
+				// concat_ws skips NULLs
+			case []byte:
+				fields = append(fields, string(v))
+			default:
+				fields = append(fields, fmt.Sprint(v))
+			}
+		}
+
+		prefix, _ := strconv.ParseUint(md5Hex(strings.Join(fields, "\x1f"))[:15], 16, 64)
+		srcSum += prefix
+		srcCount++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	srcSum &= checksumMask
+
+	texts := make([]string, len(cols))
+	for i, col := range cols {
+		texts[i] = col + "::text"
+	}
+	rowHash := fmt.Sprintf("md5(concat_ws(chr(31), %s))", strings.Join(texts, ", "))
+
+	var dstCount int64
+	var dstSum string
+	query := fmt.Sprintf("SELECT count(*), (coalesce(sum(('x' || substr(%s, 1, 15))::bit(60)::bigint), 0) %% %d)::text FROM %s", rowHash, uint64(checksumMask)+1, table)
+	if err := m.dst.QueryRow(query).Scan(&dstCount, &dstSum); err != nil {
+		return nil, err
+	}
+
+	if srcCount != dstCount || strconv.FormatUint(srcSum, 10) != dstSum {
+		return []integrityProblem{{table: table, detail: fmt.Sprintf("checksums differ (source %d rows, destination %d rows)", srcCount, dstCount)}}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestEventDigest_MatchesPostgres(t *testing.T) {
+	_, dst := openTestDatabases(t)
+
+	var digest string
+	query := fmt.Sprintf("SELECT %s FROM (SELECT 'abc' AS id, 1700000000::bigint AS created_at, 9 AS kind, 'pk' AS pubkey, 'héllo' AS content, '[]' AS tags, 'sig' AS sig) e", pgEventDigest)
+	if err := dst.QueryRow(query).Scan(&digest); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := eventDigest("abc", 1700000000, 9, "pk", "héllo", "[]", "sig"); digest != want {
+		t.Errorf("PostgreSQL digest = %s, Go digest = %s", digest, want)
+	}
+}
+
+func TestVerifyIntegrity(t *testing.T) {
+	const rows = 200
+
+	src, dst := openTestDatabases(t)
+	createSourceEvents(t, src, "verify")
+	fillSourceEvents(t, src, "verify", rows)
+
+	tables := []string{"verify__events", "verify__event_tags"}
+	if err := createSchema(dst, tables); err != nil {
+		t.Fatalf("createSchema failed: %v", err)
+	}
+	if err := ensureStateTable(dst); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newMigrator(src, dst)
+	for _, table := range tables {
+		if err := m.migrateTable(table); err != nil {
+			t.Fatalf("migrating %s: %v", table, err)
+		}
+	}
+	if err := backfillSearchVectors(dst, tables); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.verifyIntegrity(tables, rows); err != nil {
+		t.Fatalf("verifyIntegrity failed on a clean migration: %v", err)
+	}
+
+	// Corrupt one event without changing any counts
+	corrupted := fmt.Sprintf("%064x", 42)
+	if _, err := dst.Exec("UPDATE verify__events SET content = 'tampered' WHERE id = $1", corrupted); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.verifyCounts(tables); err != nil {
+		t.Fatalf("verifyCounts should not notice changed content: %v", err)
+	}
+
+	problems, err := m.compareEvents("verify__events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].id != corrupted {
+		t.Errorf("compareEvents found %v, want only %s", problems, corrupted)
+	}
+
+	// Spot checking every row is sure to hit it and name the field
+	problems, err = m.spotCheckEvents("verify__events", rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].id != corrupted || problems[0].detail != "differs in content" {
+		t.Errorf("spotCheckEvents found %v, want content of %s", problems, corrupted)
+	}
+
+	// Change a tag value, which only the checksum can catch
+	if _, err := dst.Exec("UPDATE verify__event_tags SET value = 'elsewhere' WHERE event_id = $1", fmt.Sprintf("%064x", 7)); err != nil {
+		t.Fatal(err)
+	}
+	problems, err = m.compareChecksums("verify__event_tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0].detail, "checksums differ") {
+		t.Errorf("compareChecksums found %v, want a checksum mismatch", problems)
+	}
+
+	if err := m.verifyIntegrity(tables, 0); err == nil || !strings.Contains(err.Error(), "2 integrity problems") {
+		t.Errorf("verifyIntegrity error = %v, want 2 integrity problems", err)
+	}
+}
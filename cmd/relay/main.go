@@ -16,11 +16,12 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// pprofAddrIsLoopback rejects PPROF_ADDR values that would expose pprof on a
-// public interface. Documentation says "bind to localhost"; this enforces it
-// at startup so a stray PPROF_ADDR=":6060" doesn't leak heap/goroutine dumps.
-// Returns (ok, reason) — reason is empty when ok is true.
-func pprofAddrIsLoopback(addr string) (bool, string) {
+// addrIsLoopback rejects PPROF_ADDR and OPS_ADDR values that would expose
+// pprof or the ops endpoints on a public interface. Documentation says "bind
+// to localhost"; this enforces it at startup so a stray PPROF_ADDR=":6060"
+// doesn't leak heap/goroutine dumps. Returns (ok, reason) — reason is empty
+// when ok is true.
+func addrIsLoopback(addr string) (bool, string) {
 	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
 		return false, fmt.Sprintf("invalid host:port: %v", err)
@@ -71,7 +72,7 @@ func main() {
 
 				instance, exists := zooid.Dispatch(r.Host)
 				if exists {
-					instance.Relay.ServeHTTP(w, r)
+					instance.ServeHTTP(w, r)
 				} else {
 					http.Error(w, "Not Found", http.StatusNotFound)
 				}
@@ -91,7 +92,7 @@ func main() {
 	// must not be reachable from the public internet (issue #18 needed
 	// `goroutine?debug=2` from a leaking task to localize the leak).
 	if pprofAddr := os.Getenv("PPROF_ADDR"); pprofAddr != "" {
-		if ok, reason := pprofAddrIsLoopback(pprofAddr); !ok {
+		if ok, reason := addrIsLoopback(pprofAddr); !ok {
 			log.Fatalf("refusing to start pprof on %q: %s — pprof must bind to a loopback address; use SSH/port-forward to access it remotely", pprofAddr, reason)
 		}
 		go func() {
@@ -102,9 +103,33 @@ func main() {
 		}()
 	}
 
+	// Optional ops server, for the admin CLI's view of the instance registry.
+	// Like pprof it lists every relay on the process, failed ones included,
+	// so it's loopback only.
+	if opsAddr := os.Getenv("OPS_ADDR"); opsAddr != "" {
+		if ok, reason := addrIsLoopback(opsAddr); !ok {
+			log.Fatalf("refusing to start the ops server on %q: %s — use SSH/port-forward to access it remotely", opsAddr, reason)
+		}
+		ops := http.NewServeMux()
+		ops.HandleFunc("GET /instances", zooid.ServeInstances)
+		ops.HandleFunc("POST /instances/retry", zooid.ServeRetryInstances)
+		go func() {
+			log.Printf("ops server listening on %s\n", opsAddr)
+			if err := http.ListenAndServe(opsAddr, ops); err != nil {
+				log.Printf("ops server error: %v\n", err)
+			}
+		}()
+	}
+
 	go zooid.Start(rootCtx)
+	zooid.StartLeaderElection(rootCtx)
 	zooid.StartMetricsCollector(rootCtx)
 	zooid.StartRetentionCleaner(rootCtx)
+	zooid.StartKVSweeper(rootCtx)
+	zooid.StartActivityFlusher(rootCtx)
+	zooid.StartMembershipSweeper(rootCtx)
+	zooid.StartDeadLetterRetrier(rootCtx)
+	zooid.StartCacheSnapshotter(rootCtx)
 
 	<-rootCtx.Done()
 
@@ -2,7 +2,7 @@ package main
 
 import "testing"
 
-func TestPprofAddrIsLoopback(t *testing.T) {
+func TestAddrIsLoopback(t *testing.T) {
 	cases := []struct {
 		addr   string
 		wantOK bool
@@ -20,12 +20,12 @@ func TestPprofAddrIsLoopback(t *testing.T) {
 	}
 	for _, c := range cases {
 		t.Run(c.addr, func(t *testing.T) {
-			got, reason := pprofAddrIsLoopback(c.addr)
+			got, reason := addrIsLoopback(c.addr)
 			if got != c.wantOK {
-				t.Errorf("pprofAddrIsLoopback(%q) = %v (%s), want %v", c.addr, got, reason, c.wantOK)
+				t.Errorf("addrIsLoopback(%q) = %v (%s), want %v", c.addr, got, reason, c.wantOK)
 			}
 			if !got && reason == "" {
-				t.Errorf("pprofAddrIsLoopback(%q) returned ok=false but no reason", c.addr)
+				t.Errorf("addrIsLoopback(%q) returned ok=false but no reason", c.addr)
 			}
 		})
 	}
@@ -18,6 +18,9 @@ ADMIN_PUBKEYS="${ADMIN_PUBKEYS:-}"
 GROUPS_ADMIN_CREATE_ONLY="${GROUPS_ADMIN_CREATE_ONLY:-true}"
 GROUPS_PRIVATE_ADMIN_ONLY="${GROUPS_PRIVATE_ADMIN_ONLY:-true}"
 GROUPS_PRIVATE_RELAY_ADMIN_ACCESS="${GROUPS_PRIVATE_RELAY_ADMIN_ACCESS:-false}"
+GROUPS_TRUSTED_SIGNERS="${GROUPS_TRUSTED_SIGNERS:-}"
+GROUPS_PRESENCE_NOTICES="${GROUPS_PRESENCE_NOTICES:-false}"
+DMS_MAX_AGE="${DMS_MAX_AGE:-}"
 
 # Create directories
 mkdir -p "$CONFIG_DIR" "$MEDIA_DIR"
@@ -67,8 +70,21 @@ auto_join = true
 admin_create_only = $GROUPS_ADMIN_CREATE_ONLY
 private_admin_only = $GROUPS_PRIVATE_ADMIN_ONLY
 private_relay_admin_access = $GROUPS_PRIVATE_RELAY_ADMIN_ACCESS
+presence_notices = $GROUPS_PRESENCE_NOTICES
 EOF
 
+    if [ -n "$GROUPS_TRUSTED_SIGNERS" ]; then
+        echo "trusted_signers = [$GROUPS_TRUSTED_SIGNERS]" >> "$CONFIG_FILE"
+    fi
+
+    if [ -n "$DMS_MAX_AGE" ]; then
+        cat >> "$CONFIG_FILE" << EOF
+
+[dms]
+max_age = "$DMS_MAX_AGE"
+EOF
+    fi
+
     # Add admin role if pubkeys provided
     if [ -n "$ADMIN_PUBKEYS" ]; then
         cat >> "$CONFIG_FILE" << EOF
@@ -0,0 +1,200 @@
+package zooid
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// Member activity tracking.
+//
+// The last time each relay member published an event or made an
+// authenticated request is kept in memory and written to the kv store every
+// activityFlushInterval, in a single batch, under
+// zooid:<schema>:lastseen:<pubkey>. Activity since the last flush is lost if
+// the process dies, which is fine for pruning members inactive for months.
+
+const activityFlushInterval = time.Minute
+
+// memberActivity holds last-seen timestamps and which of them still need
+// writing to the kv store.
+type memberActivity struct {
+	mu       sync.Mutex
+	lastSeen map[nostr.PubKey]nostr.Timestamp
+	dirty    map[nostr.PubKey]struct{}
+}
+
+// InactiveMember is a relay member and when they were last seen, or 0 if
+// they haven't been seen since activity tracking started.
+type InactiveMember struct {
+	PubKey   nostr.PubKey    `json:"pubkey"`
+	LastSeen nostr.Timestamp `json:"last_seen"`
+}
+
+func (m *ManagementStore) activityKV() *KV {
+	return &KV{Name: "zooid:" + m.Events.Schema.Name}
+}
+
+// TouchMember records activity by pubkey if it's a relay member.
+func (m *ManagementStore) TouchMember(pubkey nostr.PubKey) {
+	if !m.IsMember(pubkey) {
+		return
+	}
+
+	m.touch(pubkey, nostr.Now())
+}
+
+func (m *ManagementStore) touch(pubkey nostr.PubKey, at nostr.Timestamp) {
+	m.activity.mu.Lock()
+	defer m.activity.mu.Unlock()
+
+	if m.activity.lastSeen == nil {
+		m.activity.lastSeen = make(map[nostr.PubKey]nostr.Timestamp)
+		m.activity.dirty = make(map[nostr.PubKey]struct{})
+	}
+
+	// Most activity comes in bursts; skip the write-back when nothing changed.
+	if m.activity.lastSeen[pubkey] >= at {
+		return
+	}
+
+	m.activity.lastSeen[pubkey] = at
+	m.activity.dirty[pubkey] = struct{}{}
+}
+
+// LastSeen returns when pubkey was last active, if known.
+func (m *ManagementStore) LastSeen(pubkey nostr.PubKey) (nostr.Timestamp, bool) {
+	m.activity.mu.Lock()
+	defer m.activity.mu.Unlock()
+
+	at, ok := m.activity.lastSeen[pubkey]
+	return at, ok
+}
+
+// GetInactiveMembers returns the relay members not seen within olderThan,
+// least recently seen first. Members with no recorded activity are included
+// with a LastSeen of 0.
+func (m *ManagementStore) GetInactiveMembers(olderThan time.Duration) []InactiveMember {
+	cutoff := nostr.Now() - nostr.Timestamp(olderThan/time.Second)
+
+	m.activity.mu.Lock()
+	defer m.activity.mu.Unlock()
+
+	inactive := make([]InactiveMember, 0)
+	for _, pubkey := range m.GetMembers() {
+		if at := m.activity.lastSeen[pubkey]; at < cutoff {
+			inactive = append(inactive, InactiveMember{PubKey: pubkey, LastSeen: at})
+		}
+	}
+
+	slices.SortFunc(inactive, func(a, b InactiveMember) int {
+		return cmp.Compare(a.LastSeen, b.LastSeen)
+	})
+
+	return inactive
+}
+
+// FlushActivity writes activity recorded since the last flush to the kv
+// store. Entries that fail to write are retried on the next flush.
+func (m *ManagementStore) FlushActivity(ctx context.Context) error {
+	m.activity.mu.Lock()
+	items := make([]KeyValue, 0, len(m.activity.dirty))
+	for pubkey := range m.activity.dirty {
+		items = append(items, KeyValue{
+			Key:   "lastseen:" + pubkey.Hex(),
+			Value: strconv.FormatInt(int64(m.activity.lastSeen[pubkey]), 10),
+		})
+	}
+	m.activity.dirty = make(map[nostr.PubKey]struct{})
+	m.activity.mu.Unlock()
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	if err := m.activityKV().SetMany(ctx, items); err != nil {
+		m.activity.mu.Lock()
+		for _, item := range items {
+			if pubkey, err := nostr.PubKeyFromHex(item.Key[len("lastseen:"):]); err == nil {
+				m.activity.dirty[pubkey] = struct{}{}
+			}
+		}
+		m.activity.mu.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+// loadActivity reads persisted last-seen timestamps back into memory.
+func (m *ManagementStore) loadActivity(ctx context.Context) error {
+	items, err := m.activityKV().List(ctx, "lastseen:")
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		pubkey, err := nostr.PubKeyFromHex(item.Key[len("lastseen:"):])
+		if err != nil {
+			continue
+		}
+
+		at, err := strconv.ParseInt(item.Value, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		m.activity.mu.Lock()
+		if m.activity.lastSeen == nil {
+			m.activity.lastSeen = make(map[nostr.PubKey]nostr.Timestamp)
+			m.activity.dirty = make(map[nostr.PubKey]struct{})
+		}
+		if m.activity.lastSeen[pubkey] < nostr.Timestamp(at) {
+			m.activity.lastSeen[pubkey] = nostr.Timestamp(at)
+		}
+		m.activity.mu.Unlock()
+	}
+
+	return nil
+}
+
+// StartActivityFlusher launches a background goroutine that periodically
+// persists member activity and usage for every instance until ctx is
+// cancelled.
+func StartActivityFlusher(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(activityFlushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				// One last best-effort flush on shutdown, which needs a
+				// context that isn't already cancelled.
+				final, cancel := context.WithTimeout(context.WithoutCancel(ctx), dbOpTimeout)
+				flushAllActivity(final)
+				flushAllUsage(final)
+				cancel()
+				return
+			case <-ticker.C:
+				flushAllActivity(ctx)
+				flushAllUsage(ctx)
+			}
+		}
+	}()
+}
+
+func flushAllActivity(ctx context.Context) {
+	for _, inst := range GetAllInstances() {
+		if err := inst.Management.FlushActivity(ctx); err != nil {
+			log.Printf("Failed to flush member activity for %s: %v", inst.Config.Schema, err)
+		}
+	}
+}
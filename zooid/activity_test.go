@@ -0,0 +1,116 @@
+package zooid
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestMemberActivity_PersistsAcrossRestart(t *testing.T) {
+	instance := createTestInstance()
+	member := nostr.Generate().Public()
+	instance.Management.AddMember(member)
+
+	// Later than AddMember's own touch
+	seen := nostr.Now() + 3600
+	instance.Management.touch(member, seen)
+	if err := instance.Management.FlushActivity(context.Background()); err != nil {
+		t.Fatalf("FlushActivity: %v", err)
+	}
+
+	// A fresh store over the same schema, as after a restart.
+	restarted := &ManagementStore{Config: instance.Config, Events: instance.Events}
+	restarted.WarmCaches(context.Background())
+
+	at, ok := restarted.LastSeen(member)
+	if !ok || at != seen {
+		t.Errorf("LastSeen after restart = %d, %v; want %d, true", at, ok, seen)
+	}
+}
+
+func TestMemberActivity_OnlyMembersTracked(t *testing.T) {
+	instance := createTestInstance()
+	outsider := nostr.Generate().Public()
+
+	instance.Management.TouchMember(outsider)
+	if _, ok := instance.Management.LastSeen(outsider); ok {
+		t.Error("activity should only be tracked for relay members")
+	}
+}
+
+func TestMemberActivity_FlushBatchesOnlyDirty(t *testing.T) {
+	instance := createTestInstance()
+	members := []nostr.PubKey{nostr.Generate().Public(), nostr.Generate().Public()}
+	for _, member := range members {
+		instance.Management.AddMember(member)
+	}
+
+	ctx := context.Background()
+	if err := instance.Management.FlushActivity(ctx); err != nil {
+		t.Fatalf("FlushActivity: %v", err)
+	}
+
+	// Older activity than what's recorded doesn't need writing.
+	instance.Management.touch(members[0], 1)
+	instance.Management.activity.mu.Lock()
+	dirty := len(instance.Management.activity.dirty)
+	instance.Management.activity.mu.Unlock()
+	if dirty != 0 {
+		t.Errorf("expected nothing to flush, got %d dirty entries", dirty)
+	}
+
+	items, err := instance.Management.activityKV().List(ctx, "lastseen:")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(items) < len(members) {
+		t.Errorf("expected at least %d persisted entries, got %d", len(members), len(items))
+	}
+}
+
+func TestGetInactiveMembers(t *testing.T) {
+	instance := createTestInstance()
+	active := nostr.Generate().Public()
+	idle := nostr.Generate().Public()
+	instance.Management.AddMember(active)
+	instance.Management.AddMember(idle)
+
+	instance.Management.activity.mu.Lock()
+	instance.Management.activity.lastSeen[idle] = nostr.Now() - 200*24*3600
+	instance.Management.activity.mu.Unlock()
+
+	inactive := instance.Management.GetInactiveMembers(180 * 24 * time.Hour)
+
+	found := false
+	for _, m := range inactive {
+		if m.PubKey == active {
+			t.Error("recently active member should not be listed")
+		}
+		if m.PubKey == idle {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("member idle for 200 days should be listed")
+	}
+}
+
+func TestManagementStore_ServeAPI_ListInactive(t *testing.T) {
+	instance := createTestInstance()
+	instance.Management.enableAPIMethods(instance)
+
+	member := nostr.Generate().Public()
+	instance.Management.AddMember(member)
+
+	resp := serveTestAPIRequest(t, instance.Management, newTestAPIRequest(t, instance.Config.secret, "listinactive", 0))
+	if resp.Error != "" {
+		t.Fatalf("listinactive returned error: %s", resp.Error)
+	}
+
+	resp = serveTestAPIRequest(t, instance.Management, newTestAPIRequest(t, instance.Config.secret, "listinactive", "6 months"))
+	if resp.Error == "" {
+		t.Error("listinactive should reject non-numeric params")
+	}
+}
@@ -0,0 +1,643 @@
+package zooid
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// Admin runs zooid-admin subcommands against an instance. Everything goes
+// through the same store methods (and, for group changes, the same
+// OnEventSaved handling) as the relay, so caches and published lists end up
+// exactly as if the change had come in over the websocket.
+type Admin struct {
+	Instance *Instance
+	In       io.Reader
+	Out      io.Writer
+	JSON     bool
+}
+
+// AdminCommand is a single zooid-admin subcommand.
+type AdminCommand struct {
+	Usage string
+	Run   func(a *Admin, fs *flag.FlagSet, args func() ([]string, error)) error
+}
+
+// AdminCommands lists the subcommands zooid-admin supports, by name.
+var AdminCommands = map[string]AdminCommand{
+	"ban-pubkey": {
+		Usage: "ban-pubkey <pubkey> [--reason text]",
+		Run: func(a *Admin, fs *flag.FlagSet, args func() ([]string, error)) error {
+			reason := fs.String("reason", "", "reason for the ban")
+			pubkey, err := a.pubkeyArg(args)
+			if err != nil {
+				return err
+			}
+
+			if err := a.Instance.Management.BanPubkey(pubkey, *reason); err != nil {
+				return err
+			}
+
+			return a.done("banned pubkey " + pubkey.Hex())
+		},
+	},
+	"allow-pubkey": {
+		Usage: "allow-pubkey <pubkey>",
+		Run: func(a *Admin, fs *flag.FlagSet, args func() ([]string, error)) error {
+			pubkey, err := a.pubkeyArg(args)
+			if err != nil {
+				return err
+			}
+
+			if err := a.Instance.Management.AllowPubkey(pubkey); err != nil {
+				return err
+			}
+
+			return a.done("allowed pubkey " + pubkey.Hex())
+		},
+	},
+	"ban-event": {
+		Usage: "ban-event <id> [--reason text]",
+		Run: func(a *Admin, fs *flag.FlagSet, args func() ([]string, error)) error {
+			reason := fs.String("reason", "", "reason for the ban")
+			positional, err := args()
+			if err != nil {
+				return err
+			}
+			if len(positional) != 1 {
+				return errors.New("expected an event id")
+			}
+
+			id, err := nostr.IDFromHex(positional[0])
+			if err != nil {
+				return fmt.Errorf("invalid event id: %w", err)
+			}
+
+			if err := a.Instance.Management.BanEvent(id, *reason); err != nil {
+				return err
+			}
+
+			return a.done("banned event " + id.Hex())
+		},
+	},
+	"list-groups": {
+		Usage: "list-groups",
+		Run: func(a *Admin, fs *flag.FlagSet, args func() ([]string, error)) error {
+			if _, err := args(); err != nil {
+				return err
+			}
+
+			return a.listGroups()
+		},
+	},
+	"create-group": {
+		Usage: "create-group <id> [--name text] [--about text] [--private] [--closed]",
+		Run: func(a *Admin, fs *flag.FlagSet, args func() ([]string, error)) error {
+			name := fs.String("name", "", "group name")
+			about := fs.String("about", "", "group description")
+			private := fs.Bool("private", false, "only members can read")
+			closed := fs.Bool("closed", false, "joining requires approval")
+			h, err := a.groupArg(args, 0)
+			if err != nil {
+				return err
+			}
+
+			if _, found := a.Instance.Groups.GetMetadata(h[0]); found {
+				return fmt.Errorf("group %q already exists", h[0])
+			}
+
+			content, _ := json.Marshal(map[string]any{
+				"name":    *name,
+				"about":   *about,
+				"private": *private,
+				"closed":  *closed,
+			})
+
+			if err := a.publishGroupEvent(nostr.KindSimpleGroupCreateGroup, h[0], string(content)); err != nil {
+				return err
+			}
+
+			return a.done("created group " + h[0])
+		},
+	},
+	"delete-group": {
+		Usage: "delete-group <id>",
+		Run: func(a *Admin, fs *flag.FlagSet, args func() ([]string, error)) error {
+			h, err := a.groupArg(args, 0)
+			if err != nil {
+				return err
+			}
+
+			if err := a.publishGroupEvent(nostr.KindSimpleGroupDeleteGroup, h[0], ""); err != nil {
+				return err
+			}
+
+			return a.done("deleted group " + h[0])
+		},
+	},
+	"add-member": {
+		Usage: "add-member <group> <pubkey> [--role name]",
+		Run: func(a *Admin, fs *flag.FlagSet, args func() ([]string, error)) error {
+			role := fs.String("role", "", "role to give the member")
+			positional, err := a.groupArg(args, 1)
+			if err != nil {
+				return err
+			}
+
+			pubkey, err := nostr.PubKeyFromHex(positional[1])
+			if err != nil {
+				return fmt.Errorf("invalid pubkey: %w", err)
+			}
+
+			p := nostr.Tag{"p", pubkey.Hex()}
+			if *role != "" {
+				p = append(p, *role)
+			}
+
+			if err := a.publishGroupEvent(nostr.KindSimpleGroupPutUser, positional[0], "", p); err != nil {
+				return err
+			}
+
+			return a.done(fmt.Sprintf("added %s to group %s", pubkey.Hex(), positional[0]))
+		},
+	},
+	"remove-member": {
+		Usage: "remove-member <group> <pubkey>",
+		Run: func(a *Admin, fs *flag.FlagSet, args func() ([]string, error)) error {
+			positional, err := a.groupArg(args, 1)
+			if err != nil {
+				return err
+			}
+
+			pubkey, err := nostr.PubKeyFromHex(positional[1])
+			if err != nil {
+				return fmt.Errorf("invalid pubkey: %w", err)
+			}
+
+			if err := a.publishGroupEvent(nostr.KindSimpleGroupRemoveUser, positional[0], "", nostr.Tag{"p", pubkey.Hex()}); err != nil {
+				return err
+			}
+
+			return a.done(fmt.Sprintf("removed %s from group %s", pubkey.Hex(), positional[0]))
+		},
+	},
+	"metadata-history": {
+		Usage: "metadata-history <group> [--limit n]",
+		Run: func(a *Admin, fs *flag.FlagSet, args func() ([]string, error)) error {
+			limit := fs.Int("limit", 20, "how many versions to list")
+			h, err := a.groupArg(args, 0)
+			if err != nil {
+				return err
+			}
+
+			versions := a.Instance.Groups.GetMetadataHistory(h[0], *limit)
+			if a.JSON {
+				return json.NewEncoder(a.Out).Encode(versions)
+			}
+
+			w := tabwriter.NewWriter(a.Out, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tCREATED_AT\tAUTHOR\tNAME")
+			for _, version := range versions {
+				var content struct {
+					Name string `json:"name"`
+				}
+				json.Unmarshal([]byte(version.Content), &content)
+				fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", version.ID.Hex(), version.CreatedAt, version.PubKey.Hex(), content.Name)
+			}
+
+			return w.Flush()
+		},
+	},
+	"restore-metadata": {
+		Usage: "restore-metadata <group> <id>",
+		Run: func(a *Admin, fs *flag.FlagSet, args func() ([]string, error)) error {
+			positional, err := a.groupArg(args, 1)
+			if err != nil {
+				return err
+			}
+
+			id, err := nostr.IDFromHex(positional[1])
+			if err != nil {
+				return fmt.Errorf("invalid event id: %w", err)
+			}
+
+			if _, err := a.Instance.Groups.RestoreMetadata(positional[0], id, a.Instance.Config.GetSelf()); err != nil {
+				return err
+			}
+
+			return a.done(fmt.Sprintf("restored the metadata of group %s from %s", positional[0], id.Hex()))
+		},
+	},
+	"export": {
+		Usage: "export [--kind n]... [--received-at]",
+		Run: func(a *Admin, fs *flag.FlagSet, args func() ([]string, error)) error {
+			var kinds kindList
+			fs.Var(&kinds, "kind", "only export events of this kind (repeatable)")
+			withReceived := fs.Bool("received-at", false, "add when each event was stored")
+			if _, err := args(); err != nil {
+				return err
+			}
+
+			return a.export(nostr.Filter{Kinds: kinds}, *withReceived)
+		},
+	},
+	"received": {
+		Usage: "received [--since duration] [--limit n]",
+		Run: func(a *Admin, fs *flag.FlagSet, args func() ([]string, error)) error {
+			since := fs.Duration("since", time.Hour, "how far back to look")
+			limit := fs.Int("limit", 100, "how many events to list")
+			if _, err := args(); err != nil {
+				return err
+			}
+
+			// By when they arrived, not when they say they were created
+			from := nostr.Timestamp(time.Now().Add(-*since).Unix())
+			received := slices.Collect(a.Instance.Events.QueryEventsReceivedSince(from, *limit))
+			if a.JSON {
+				return json.NewEncoder(a.Out).Encode(received)
+			}
+
+			w := tabwriter.NewWriter(a.Out, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tRECEIVED_AT\tCREATED_AT\tKIND\tAUTHOR")
+			for _, evt := range received {
+				fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", evt.ID.Hex(), evt.ReceivedAt, evt.CreatedAt, evt.Kind, evt.PubKey.Hex())
+			}
+
+			return w.Flush()
+		},
+	},
+	"find-corrupt": {
+		Usage: "find-corrupt [--delete]",
+		Run: func(a *Admin, fs *flag.FlagSet, args func() ([]string, error)) error {
+			remove := fs.Bool("delete", false, "delete the rows that are found")
+			if _, err := args(); err != nil {
+				return err
+			}
+
+			corrupt, err := a.Instance.Events.FindCorruptEvents(a.Instance.Ctx, *remove)
+			if err != nil {
+				return err
+			}
+
+			if a.JSON {
+				return json.NewEncoder(a.Out).Encode(corrupt)
+			}
+
+			for _, c := range corrupt {
+				fmt.Fprintf(a.Out, "%s\t%s\n", c.ID, c.Reason)
+			}
+			fmt.Fprintf(a.Out, "%d corrupt event(s)\n", len(corrupt))
+
+			return nil
+		},
+	},
+	"rotate-key": {
+		Usage: "rotate-key [--generate]",
+		Run: func(a *Admin, fs *flag.FlagSet, args func() ([]string, error)) error {
+			generate := fs.Bool("generate", false, "generate the new secret instead of reading it from stdin")
+			if _, err := args(); err != nil {
+				return err
+			}
+
+			// Read from stdin so the secret stays out of shell history and ps
+			secret, err := a.secretArg(*generate)
+			if err != nil {
+				return err
+			}
+
+			if err := a.Instance.RotateKey(secret); err != nil {
+				return err
+			}
+
+			return a.done("rotated the relay key to " + secret.Public().Hex())
+		},
+	},
+	"stats": {
+		Usage: "stats",
+		Run: func(a *Admin, fs *flag.FlagSet, args func() ([]string, error)) error {
+			if _, err := args(); err != nil {
+				return err
+			}
+
+			stats, err := a.Instance.Events.Stats(a.Instance.Ctx)
+			if err != nil {
+				return err
+			}
+
+			if a.JSON {
+				return json.NewEncoder(a.Out).Encode(stats)
+			}
+
+			w := tabwriter.NewWriter(a.Out, 0, 4, 2, ' ', 0)
+			fmt.Fprintf(w, "events\t%d\n", stats.Events)
+			fmt.Fprintf(w, "tag rows\t%d\n", stats.TagRows)
+			fmt.Fprintf(w, "created_at\t%d - %d\n", stats.OldestCreatedAt, stats.NewestCreatedAt)
+			fmt.Fprintf(w, "received in the last hour\t%d\n", stats.ReceivedLastHour)
+			fmt.Fprintf(w, "events table\t%d bytes (+%d index)\n", stats.EventsTableBytes, stats.EventsIndexBytes)
+			fmt.Fprintf(w, "tags table\t%d bytes (+%d index)\n", stats.TagsTableBytes, stats.TagsIndexBytes)
+			for _, kc := range stats.TopKinds {
+				fmt.Fprintf(w, "kind %d\t%d\n", kc.Kind, kc.Count)
+			}
+
+			return w.Flush()
+		},
+	},
+}
+
+// AdminUsage describes every subcommand, one per line.
+func AdminUsage() string {
+	var lines []string
+	for _, name := range Keys(AdminCommands) {
+		lines = append(lines, "  "+AdminCommands[name].Usage)
+	}
+	slices.Sort(lines)
+
+	return strings.Join(lines, "\n")
+}
+
+// Run executes the subcommand named by args[0]. Flags may come before or
+// after positional arguments.
+func (a *Admin) Run(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing command")
+	}
+
+	command, ok := AdminCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&a.JSON, "json", a.JSON, "print JSON output")
+
+	rest := args[1:]
+	parse := func() ([]string, error) {
+		var positional []string
+		for {
+			if err := fs.Parse(rest); err != nil {
+				return nil, fmt.Errorf("usage: %s: %w", command.Usage, err)
+			}
+			if fs.NArg() == 0 {
+				return positional, nil
+			}
+			positional = append(positional, fs.Arg(0))
+			rest = fs.Args()[1:]
+		}
+	}
+
+	return command.Run(a, fs, parse)
+}
+
+func (a *Admin) done(message string) error {
+	if a.JSON {
+		return json.NewEncoder(a.Out).Encode(map[string]any{"ok": true, "message": message})
+	}
+
+	_, err := fmt.Fprintln(a.Out, message)
+	return err
+}
+
+func (a *Admin) pubkeyArg(args func() ([]string, error)) (nostr.PubKey, error) {
+	positional, err := args()
+	if err != nil {
+		return nostr.PubKey{}, err
+	}
+	if len(positional) != 1 {
+		return nostr.PubKey{}, errors.New("expected a pubkey")
+	}
+
+	pubkey, err := nostr.PubKeyFromHex(positional[0])
+	if err != nil {
+		return nostr.PubKey{}, fmt.Errorf("invalid pubkey: %w", err)
+	}
+
+	return pubkey, nil
+}
+
+// secretArg reads a hex secret key from the first line of a.In, or
+// generates one.
+func (a *Admin) secretArg(generate bool) (nostr.SecretKey, error) {
+	if generate {
+		return nostr.Generate(), nil
+	}
+	if a.In == nil {
+		return nostr.SecretKey{}, errors.New("expected the new secret key on stdin")
+	}
+
+	line, err := bufio.NewReader(a.In).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nostr.SecretKey{}, err
+	}
+
+	secret, err := nostr.SecretKeyFromHex(strings.TrimSpace(line))
+	if err != nil {
+		return nostr.SecretKey{}, fmt.Errorf("invalid secret key: %w", err)
+	}
+
+	return secret, nil
+}
+
+// groupArg returns a group id followed by extra positional arguments.
+func (a *Admin) groupArg(args func() ([]string, error), extra int) ([]string, error) {
+	if !a.Instance.Config.Groups.Enabled {
+		return nil, errors.New("groups are not enabled for this relay")
+	}
+
+	positional, err := args()
+	if err != nil {
+		return nil, err
+	}
+	if len(positional) != 1+extra {
+		return nil, fmt.Errorf("expected %d argument(s)", 1+extra)
+	}
+	if positional[0] == "" || positional[0] == "_" {
+		return nil, fmt.Errorf("invalid group id %q", positional[0])
+	}
+
+	return positional, nil
+}
+
+// publishGroupEvent stores a moderation event signed by the relay and runs
+// the relay's usual post-save handling for it.
+func (a *Admin) publishGroupEvent(kind nostr.Kind, h string, content string, tags ...nostr.Tag) error {
+	event := nostr.Event{
+		Kind:      kind,
+		CreatedAt: nostr.Now(),
+		Content:   content,
+		Tags:      append(nostr.Tags{{"h", h}}, tags...),
+	}
+
+	if err := a.Instance.Events.SignAndStoreEvent(&event, true); err != nil {
+		return err
+	}
+
+	a.Instance.OnEventSaved(a.Instance.Ctx, event)
+
+	return nil
+}
+
+type adminGroup struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+	Private bool   `json:"private"`
+	Closed  bool   `json:"closed"`
+}
+
+func (a *Admin) listGroups() error {
+	groups := make([]adminGroup, 0)
+	a.Instance.Groups.metadataCache.Range(func(key, value any) bool {
+		cached := value.(*groupMetaCache)
+		if !cached.found {
+			return true
+		}
+
+		group := adminGroup{
+			ID:      key.(string),
+			Members: a.Instance.Groups.GetMemberCount(key.(string)),
+			Private: cached.private,
+			Closed:  cached.closed,
+		}
+
+		var content struct {
+			Name string `json:"name"`
+		}
+		if json.Unmarshal([]byte(cached.event.Content), &content) == nil {
+			group.Name = content.Name
+		}
+
+		groups = append(groups, group)
+		return true
+	})
+
+	slices.SortFunc(groups, func(x, y adminGroup) int { return strings.Compare(x.ID, y.ID) })
+
+	if a.JSON {
+		return json.NewEncoder(a.Out).Encode(groups)
+	}
+
+	w := tabwriter.NewWriter(a.Out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tMEMBERS\tPRIVATE\tCLOSED")
+	for _, group := range groups {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%t\t%t\n", group.ID, group.Name, group.Members, group.Private, group.Closed)
+	}
+
+	return w.Flush()
+}
+
+// exportBatch is how many events export reads per query.
+const exportBatch = 1000
+
+// export writes every matching event but the relay's internal ones as a line
+// of JSON, newest first. withReceived adds a received_at field saying when
+// each was stored, which nostr's own decoder refuses, so it's left out unless
+// asked for. Pages are keyed on created_at (Until is inclusive), and the ids
+// already written at the boundary timestamp are skipped on the next page.
+// Each page asks for that many extra rows so it always makes progress.
+func (a *Admin) export(filter nostr.Filter, withReceived bool) error {
+	enc := json.NewEncoder(a.Out)
+	boundary := make(map[nostr.ID]struct{})
+
+	for {
+		filter.Limit = exportBatch + len(boundary)
+
+		count := 0
+		until, bounded := untilBound(filter)
+		last := until
+		atLast := make(map[nostr.ID]struct{})
+		var page []nostr.Event
+
+		for event := range a.Instance.Events.QueryEvents(filter, 0) {
+			count++
+			if _, seen := boundary[event.ID]; seen {
+				continue
+			}
+
+			// The relay's own lists, with who is banned and why, are for
+			// backups, not exports. They still count towards the page.
+			if !a.Instance.IsInternalEvent(event) {
+				page = append(page, event)
+			}
+
+			if event.CreatedAt != last {
+				last = event.CreatedAt
+				atLast = make(map[nostr.ID]struct{})
+			}
+			atLast[event.ID] = struct{}{}
+		}
+
+		if err := a.writeExportPage(enc, page, withReceived); err != nil {
+			return err
+		}
+
+		if count < filter.Limit {
+			return nil
+		}
+
+		if bounded && last == until {
+			for id := range atLast {
+				boundary[id] = struct{}{}
+			}
+		} else {
+			boundary = atLast
+		}
+		filter.Until = Until(last)
+	}
+}
+
+// writeExportPage writes a page of export, see export.
+func (a *Admin) writeExportPage(enc *json.Encoder, page []nostr.Event, withReceived bool) error {
+	var received map[nostr.ID]nostr.Timestamp
+	if withReceived {
+		ids := make([]nostr.ID, len(page))
+		for i, event := range page {
+			ids[i] = event.ID
+		}
+
+		var err error
+		if received, err = a.Instance.Events.ReceivedTimes(ids); err != nil {
+			return err
+		}
+	}
+
+	for _, event := range page {
+		var err error
+		if withReceived {
+			err = enc.Encode(ReceivedEvent{Event: event, ReceivedAt: received[event.ID]})
+		} else {
+			err = enc.Encode(event)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// kindList is a repeatable --kind flag.
+type kindList []nostr.Kind
+
+func (k *kindList) String() string {
+	return fmt.Sprint(*k)
+}
+
+func (k *kindList) Set(value string) error {
+	var kind nostr.Kind
+	if _, err := fmt.Sscan(value, &kind); err != nil {
+		return fmt.Errorf("invalid kind %q", value)
+	}
+
+	*k = append(*k, kind)
+	return nil
+}
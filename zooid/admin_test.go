@@ -0,0 +1,187 @@
+package zooid
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func runTestAdmin(t *testing.T, instance *Instance, args ...string) string {
+	t.Helper()
+
+	var out bytes.Buffer
+	admin := &Admin{Instance: instance, Out: &out}
+	if err := admin.Run(args); err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+
+	return out.String()
+}
+
+func TestAdmin_BanAndAllowPubkey(t *testing.T) {
+	instance := createTestInstance()
+	pubkey := nostr.Generate().Public()
+	instance.Management.AddMember(pubkey)
+
+	runTestAdmin(t, instance, "ban-pubkey", pubkey.Hex(), "--reason", "spam")
+
+	if !instance.Management.PubkeyIsBanned(pubkey) {
+		t.Error("ban-pubkey should ban the pubkey")
+	}
+	if instance.Management.IsMember(pubkey) {
+		t.Error("ban-pubkey should remove the pubkey from the members list, as the NIP 86 method does")
+	}
+
+	found := false
+	for _, item := range instance.Management.GetBannedPubkeyItems() {
+		if item.PubKey == pubkey && item.Reason == "spam" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("ban reason should be recorded")
+	}
+
+	runTestAdmin(t, instance, "allow-pubkey", pubkey.Hex())
+	if instance.Management.PubkeyIsBanned(pubkey) {
+		t.Error("allow-pubkey should lift the ban")
+	}
+}
+
+func TestAdmin_BanEvent(t *testing.T) {
+	instance := createTestInstance()
+	note := createTestEvent(nostr.KindTextNote, "spam")
+	instance.Events.SaveEvent(note)
+
+	out := runTestAdmin(t, instance, "ban-event", note.ID.Hex(), "--json")
+
+	var result struct{ OK bool }
+	if err := json.Unmarshal([]byte(out), &result); err != nil || !result.OK {
+		t.Errorf("expected a JSON ok result, got %q", out)
+	}
+	if !instance.Management.EventIsBanned(note.ID) {
+		t.Error("ban-event should ban the event")
+	}
+	for range instance.Events.QueryEvents(nostr.Filter{IDs: []nostr.ID{note.ID}}, 1) {
+		t.Error("ban-event should delete the event")
+	}
+}
+
+func TestAdmin_Groups(t *testing.T) {
+	instance := createTestInstance()
+	member := nostr.Generate().Public()
+
+	runTestAdmin(t, instance, "create-group", "cli", "--name", "From the CLI", "--private")
+
+	if !instance.Groups.IsPrivateGroup("cli") {
+		t.Fatal("create-group should create a private group")
+	}
+	if err := (&Admin{Instance: instance, Out: &bytes.Buffer{}}).Run([]string{"create-group", "cli"}); err == nil {
+		t.Error("create-group should refuse to overwrite an existing group")
+	}
+
+	runTestAdmin(t, instance, "add-member", "cli", member.Hex(), "--role", "moderator")
+	if !instance.Groups.IsMember("cli", member) {
+		t.Error("add-member should add the member")
+	}
+	if !instance.Groups.HasRole("cli", member, "moderator") {
+		t.Error("add-member should assign the role")
+	}
+
+	// The published members list must match, as it would for a kind 9000.
+	filter := nostr.Filter{Kinds: []nostr.Kind{nostr.KindSimpleGroupMembers}, Tags: nostr.TagMap{"d": []string{"cli"}}}
+	listed := false
+	for event := range instance.Events.QueryEvents(filter, 1) {
+		listed = event.Tags.FindWithValue("p", member.Hex()) != nil
+	}
+	if !listed {
+		t.Error("add-member should update the group's members list")
+	}
+
+	var groups []adminGroup
+	if err := json.Unmarshal([]byte(runTestAdmin(t, instance, "list-groups", "--json")), &groups); err != nil {
+		t.Fatalf("invalid list-groups output: %v", err)
+	}
+	if len(groups) != 1 || groups[0].ID != "cli" || groups[0].Name != "From the CLI" || !groups[0].Private {
+		t.Errorf("unexpected groups %+v", groups)
+	}
+	if !strings.Contains(runTestAdmin(t, instance, "list-groups"), "From the CLI") {
+		t.Error("text list-groups should include the group name")
+	}
+
+	runTestAdmin(t, instance, "remove-member", "cli", member.Hex())
+	if instance.Groups.IsMember("cli", member) {
+		t.Error("remove-member should remove the member")
+	}
+
+	runTestAdmin(t, instance, "delete-group", "cli")
+	if _, found := instance.Groups.GetMetadata("cli"); found {
+		t.Error("delete-group should remove the group")
+	}
+}
+
+func TestAdmin_Export(t *testing.T) {
+	instance := createTestInstance()
+
+	// More than one page, with many events sharing a timestamp.
+	secret := nostr.Generate()
+	want := make(map[nostr.ID]bool)
+	for i := 0; i < exportBatch+50; i++ {
+		evt := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Timestamp(1000 + i%3), Content: strings.Repeat("x", i)}
+		evt.Sign(secret)
+		instance.Events.SaveEvent(evt)
+		want[evt.ID] = true
+	}
+
+	out := runTestAdmin(t, instance, "export", "--kind", "1")
+
+	got := make(map[nostr.ID]bool)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		var evt nostr.Event
+		if err := json.Unmarshal([]byte(line), &evt); err != nil {
+			t.Fatalf("invalid export line %q: %v", line, err)
+		}
+		if got[evt.ID] {
+			t.Errorf("event %s exported twice", evt.ID)
+		}
+		got[evt.ID] = true
+	}
+
+	for id := range want {
+		if !got[id] {
+			t.Errorf("event %s missing from export", id)
+		}
+	}
+}
+
+func TestAdmin_ExportSkipsInternalEvents(t *testing.T) {
+	instance := createTestInstance()
+	runTestAdmin(t, instance, "ban-pubkey", nostr.Generate().Public().Hex())
+
+	if out := runTestAdmin(t, instance, "export", "--kind", "30078"); strings.TrimSpace(out) != "" {
+		t.Errorf("export wrote the relay's app data: %s", out)
+	}
+}
+
+func TestAdmin_Stats(t *testing.T) {
+	instance := createTestInstance()
+	instance.Events.SaveEvent(createTestEvent(nostr.KindTextNote, "hello"))
+
+	var stats EventStats
+	if err := json.Unmarshal([]byte(runTestAdmin(t, instance, "stats", "--json")), &stats); err != nil {
+		t.Fatalf("invalid stats output: %v", err)
+	}
+	if stats.Events == 0 {
+		t.Error("stats should count events")
+	}
+}
+
+func TestAdmin_UnknownCommand(t *testing.T) {
+	admin := &Admin{Out: &bytes.Buffer{}}
+	if err := admin.Run([]string{"frobnicate"}); err == nil {
+		t.Error("unknown commands should fail")
+	}
+}
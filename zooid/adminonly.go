@@ -0,0 +1,101 @@
+package zooid
+
+import (
+	"maps"
+	"slices"
+
+	"fiatjaf.com/nostr"
+)
+
+// Admin-only kinds.
+//
+// Kinds listed in policy.admin_only_read_kinds, such as reports (1984) and
+// join requests (9021), are stored as usual but served, by REQ or broadcast,
+// only to relay managers and the event's author: members can't see who
+// reported whom. A group's creator also reads the join requests for their
+// own group, since they're the ones answering them.
+//
+// The relay's membership events are always admin-only, since together they
+// show everyone who joined and left: its members list only goes to managers,
+// and the add and remove member events to managers and the member they name,
+// so a client can still tell whether its user is a member. Purge receipts
+// go to the same. A REQ for them from anyone else is narrowed to the
+// requester's own.
+
+// membershipKinds are the relay's membership events.
+var membershipKinds = []nostr.Kind{RELAY_ADD_MEMBER, RELAY_REMOVE_MEMBER, RELAY_MEMBERS, RELAY_PURGE_RECEIPT}
+
+// isAdminOnly reports whether events of kind are only served to some.
+func (instance *Instance) isAdminOnly(kind nostr.Kind) bool {
+	return slices.Contains(membershipKinds, kind) || slices.Contains(instance.Config.Policy.AdminOnlyReadKinds, int(kind))
+}
+
+// canReadAdminOnly reports whether pubkey may read event as far as
+// admin-only kinds are concerned.
+func (instance *Instance) canReadAdminOnly(pubkey nostr.PubKey, event nostr.Event) bool {
+	if !instance.isAdminOnly(event.Kind) {
+		return true
+	}
+
+	if instance.Config.CanManage(pubkey) {
+		return true
+	}
+
+	switch event.Kind {
+	case RELAY_MEMBERS:
+		return false
+	case RELAY_ADD_MEMBER, RELAY_REMOVE_MEMBER, RELAY_PURGE_RECEIPT:
+		return event.Tags.FindWithValue("p", pubkey.Hex()) != nil
+	}
+
+	if pubkey == event.PubKey {
+		return true
+	}
+
+	if event.Kind == nostr.KindSimpleGroupJoinRequest && instance.Config.Groups.Enabled {
+		if h := GetGroupIDFromEvent(event); h != "" && instance.Groups.IsGroupCreator(h, pubkey) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hidesAdminOnly reports whether none of a connection's pubkeys may read
+// event.
+func (instance *Instance) hidesAdminOnly(pubkeys []nostr.PubKey, event nostr.Event) bool {
+	if !instance.isAdminOnly(event.Kind) {
+		return false
+	}
+
+	return !slices.ContainsFunc(pubkeys, func(pubkey nostr.PubKey) bool {
+		return instance.canReadAdminOnly(pubkey, event)
+	})
+}
+
+// membershipFilter narrows a REQ from someone who isn't a manager for the add
+// and remove member events to those about themselves, so it isn't answered
+// with fewer events than asked for once the others are dropped.
+func (instance *Instance) membershipFilter(pubkey nostr.PubKey, filter nostr.Filter) nostr.Filter {
+	if len(filter.Kinds) == 0 || instance.Config.CanManage(pubkey) {
+		return filter
+	}
+
+	for _, kind := range filter.Kinds {
+		if kind != RELAY_ADD_MEMBER && kind != RELAY_REMOVE_MEMBER && kind != RELAY_PURGE_RECEIPT {
+			return filter
+		}
+	}
+
+	tags := maps.Clone(filter.Tags)
+	if tags == nil {
+		tags = make(nostr.TagMap)
+	}
+	if len(tags["p"]) == 0 {
+		tags["p"] = []string{pubkey.Hex()}
+	}
+
+	filter.Tags = tags
+
+	return filter
+}
@@ -0,0 +1,119 @@
+package zooid
+
+import (
+	"context"
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+func TestAdminOnlyReadKinds(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+	instance.Config.Policy.AdminOnlyReadKinds = []int{int(nostr.KindReporting), int(nostr.KindSimpleGroupJoinRequest)}
+	runTestAdmin(t, instance, "create-group", "theirs")
+
+	creatorSecret := nostr.Generate()
+	creator := creatorSecret.Public()
+	create := signedBy(creatorSecret, nostr.Event{Kind: nostr.KindSimpleGroupCreateGroup, Tags: nostr.Tags{{"h", "mine"}}})
+	if err := instance.Events.StoreEvent(create); err != nil {
+		t.Fatalf("StoreEvent failed: %v", err)
+	}
+	instance.OnEventSaved(context.Background(), create)
+
+	reporter := nostr.Generate()
+	member := nostr.Generate().Public()
+	report := signedBy(reporter, nostr.Event{Kind: nostr.KindReporting, Tags: nostr.Tags{{"p", member.Hex(), "spam"}}})
+	joinMine := signedBy(nostr.Generate(), nostr.Event{Kind: nostr.KindSimpleGroupJoinRequest, Tags: nostr.Tags{{"h", "mine"}}})
+	joinTheirs := signedBy(nostr.Generate(), nostr.Event{Kind: nostr.KindSimpleGroupJoinRequest, Tags: nostr.Tags{{"h", "theirs"}}})
+	for _, event := range []nostr.Event{report, joinMine, joinTheirs} {
+		if err := instance.Events.StoreEvent(event); err != nil {
+			t.Fatalf("StoreEvent failed: %v", err)
+		}
+	}
+
+	query := func(pubkey nostr.PubKey, kind nostr.Kind) []nostr.ID {
+		var ids []nostr.ID
+		for event := range instance.QueryStored(authedContext(pubkey), nostr.Filter{Kinds: []nostr.Kind{kind}}) {
+			ids = append(ids, event.ID)
+		}
+		return ids
+	}
+
+	if ids := query(member, nostr.KindReporting); len(ids) != 0 {
+		t.Errorf("a member read %d reports, want none", len(ids))
+	}
+	if ids := query(instance.Config.secret.Public(), nostr.KindReporting); len(ids) != 1 || ids[0] != report.ID {
+		t.Errorf("an admin read reports %v, want the report", ids)
+	}
+	if ids := query(reporter.Public(), nostr.KindReporting); len(ids) != 1 {
+		t.Errorf("the reporter read %d reports, want their own", len(ids))
+	}
+	if ids := query(creator, nostr.KindSimpleGroupJoinRequest); len(ids) != 1 || ids[0] != joinMine.ID {
+		t.Errorf("a group creator read join requests %v, want only their group's", ids)
+	}
+	if ids := query(member, nostr.KindSimpleGroupJoinRequest); len(ids) != 0 {
+		t.Errorf("a member read %d join requests, want none", len(ids))
+	}
+
+	ws := &khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{creator}}
+	if instance.PreventBroadcast(ws, nostr.Filter{}, joinMine) {
+		t.Error("a group creator isn't sent their group's join request")
+	}
+	if !instance.PreventBroadcast(ws, nostr.Filter{}, joinTheirs) {
+		t.Error("a group creator is sent another group's join request")
+	}
+	if !instance.PreventBroadcast(&khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{member}}, nostr.Filter{}, report) {
+		t.Error("a member is sent a report")
+	}
+}
+
+func TestMembershipEvents_AdminsOnly(t *testing.T) {
+	instance := createTestInstance()
+
+	alice, bob := nostr.Generate().Public(), nostr.Generate().Public()
+	for _, pubkey := range []nostr.PubKey{alice, bob} {
+		if err := instance.Management.AddMember(pubkey); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := func(pubkey nostr.PubKey, filter nostr.Filter) []nostr.Event {
+		var events []nostr.Event
+		for event := range instance.QueryStored(authedContext(pubkey), filter) {
+			events = append(events, event)
+		}
+		return events
+	}
+
+	adds := nostr.Filter{Kinds: []nostr.Kind{RELAY_ADD_MEMBER}, Limit: 1}
+	list := nostr.Filter{Kinds: []nostr.Kind{RELAY_MEMBERS}}
+
+	admin := instance.Config.secret.Public()
+	if events := query(admin, nostr.Filter{Kinds: []nostr.Kind{RELAY_ADD_MEMBER}}); len(events) != 2 {
+		t.Errorf("an admin read %d add member events, want 2", len(events))
+	}
+	if events := query(admin, list); len(events) != 1 {
+		t.Errorf("an admin read %d members lists, want 1", len(events))
+	}
+
+	// Even with a limit of one, alice gets her own rather than bob's
+	if events := query(alice, adds); len(events) != 1 || events[0].Tags.FindWithValue("p", alice.Hex()) == nil {
+		t.Errorf("a member read add member events %v, want only their own", events)
+	}
+	if events := query(alice, nostr.Filter{Kinds: []nostr.Kind{RELAY_ADD_MEMBER}, Tags: nostr.TagMap{"p": []string{bob.Hex()}}}); len(events) != 0 {
+		t.Errorf("a member read %d add member events about someone else, want none", len(events))
+	}
+	if events := query(alice, list); len(events) != 0 {
+		t.Error("a member read the members list")
+	}
+
+	bobAdded := firstEvent(t, instance, nostr.Filter{Kinds: []nostr.Kind{RELAY_ADD_MEMBER}, Tags: nostr.TagMap{"p": []string{bob.Hex()}}})
+	if !instance.PreventBroadcast(&khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{alice}}, nostr.Filter{}, bobAdded) {
+		t.Error("a member is sent another member's add member event")
+	}
+	if instance.PreventBroadcast(&khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{bob}}, nostr.Filter{}, bobAdded) {
+		t.Error("a member isn't sent their own add member event")
+	}
+}
@@ -0,0 +1,564 @@
+package zooid
+
+import (
+	"archive/tar"
+	"bufio"
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// Backups.
+//
+// Backup writes one schema as a tar stream: manifest.json first, then one
+// JSONL file per table. Everything is read in a single repeatable-read
+// transaction, so the files agree with each other and with the manifest's
+// counts even while the relay keeps writing. Blossom's blob index lives in
+// the events table and comes along with it.
+//
+// kv keys are stored without their "zooid:{schema}:" namespace so a backup
+// can be restored under another schema name. Applied migrations are recorded
+// in the manifest rather than copied, since the restoring instance has
+// already run its own.
+
+const backupFormatVersion = 1
+
+// restoreBatchSize is how many rows each restore INSERT carries. Events have
+// the most columns (9), which keeps a statement well below Postgres's 65535
+// parameter limit.
+const restoreBatchSize = 1000
+
+// ErrRestoreNotEmpty is returned by Restore when the schema already holds
+// data and force wasn't set.
+var ErrRestoreNotEmpty = errors.New("schema is not empty")
+
+type backupManifest struct {
+	FormatVersion int              `json:"format_version"`
+	Schema        string           `json:"schema"`
+	SchemaVersion string           `json:"schema_version"`
+	Migrations    []string         `json:"migrations"`
+	CreatedAt     int64            `json:"created_at"`
+	Counts        map[string]int64 `json:"counts"`
+}
+
+type backupEvent struct {
+	ID        string          `json:"id"`
+	PubKey    string          `json:"pubkey"`
+	CreatedAt int64           `json:"created_at"`
+	Kind      int             `json:"kind"`
+	Tags      json.RawMessage `json:"tags"`
+	Content   string          `json:"content"`
+	Sig       string          `json:"sig"`
+	// Left out by backups from before received_at, see received.go
+	ReceivedAt int64 `json:"received_at,omitempty"`
+	// Set for soft-deleted events, see softdelete.go
+	DeletedAt *int64 `json:"deleted_at,omitempty"`
+}
+
+type backupTag struct {
+	EventID string `json:"event_id"`
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Kind    *int   `json:"kind,omitempty"`
+}
+
+type backupKV struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	ExpiresAt *int64 `json:"expires_at,omitempty"`
+}
+
+// backupSection is one JSONL file of a backup, in the order they are written
+// and must be restored.
+type backupSection struct {
+	name string
+	dump func(ctx context.Context, tx *sql.Tx, w *json.Encoder) (int64, error)
+}
+
+func (instance *Instance) backupSections() []backupSection {
+	events := instance.Events
+	return []backupSection{
+		{"events", events.dumpEvents},
+		{"event_tags", events.dumpTags},
+		{"kv", events.dumpKV},
+	}
+}
+
+func (events *EventStore) kvNamespace() string {
+	return "zooid:" + events.Schema.Name + ":"
+}
+
+// Backup writes a consistent snapshot of the instance's schema to w.
+func (instance *Instance) Backup(w io.Writer) error {
+	if usesMemory() {
+		return errNeedsDatabase("backup")
+	}
+
+	ctx := instance.Ctx
+
+	tx, err := GetDb().BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	manifest := backupManifest{
+		FormatVersion: backupFormatVersion,
+		Schema:        instance.Events.Schema.Name,
+		CreatedAt:     time.Now().Unix(),
+		Counts:        make(map[string]int64),
+	}
+
+	manifest.Migrations, err = instance.Events.appliedMigrations(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if n := len(manifest.Migrations); n > 0 {
+		manifest.SchemaVersion = manifest.Migrations[n-1]
+	}
+
+	// Sections are spooled to temp files, as tar needs each size up front
+	sections := instance.backupSections()
+	files := make([]*os.File, len(sections))
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+				os.Remove(f.Name())
+			}
+		}
+	}()
+
+	for i, section := range sections {
+		f, err := os.CreateTemp("", "zooid-backup-*.jsonl")
+		if err != nil {
+			return err
+		}
+		files[i] = f
+
+		buf := bufio.NewWriter(f)
+		n, err := section.dump(ctx, tx, json.NewEncoder(buf))
+		if err != nil {
+			return fmt.Errorf("backing up %s: %w", section.name, err)
+		}
+		if err := buf.Flush(); err != nil {
+			return err
+		}
+		manifest.Counts[section.name] = n
+	}
+
+	tw := tar.NewWriter(w)
+
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "manifest.json", int64(len(raw)), strings.NewReader(string(raw))); err != nil {
+		return err
+	}
+
+	for i, section := range sections {
+		size, err := files[i].Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if _, err := files[i].Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, section.name+".jsonl", size, files[i]); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.CopyN(tw, r, size)
+	return err
+}
+
+func (events *EventStore) appliedMigrations(ctx context.Context, tx *sql.Tx) ([]string, error) {
+	rows, err := sb.Select("name").
+		From(events.Schema.Prefix("schema_migrations")).
+		OrderBy("version").
+		RunWith(tx).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var migrations []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, name)
+	}
+	return migrations, rows.Err()
+}
+
+func (events *EventStore) dumpEvents(ctx context.Context, tx *sql.Tx, enc *json.Encoder) (int64, error) {
+	rows, err := sb.Select(append(slices.Clone(eventColumns), "received_at", "deleted_at")...).
+		From(events.Schema.Prefix("events")).
+		RunWith(tx).
+		QueryContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int64
+	for rows.Next() {
+		var row eventRow
+		var receivedAt int64
+		var deletedAt *int64
+		if err := rows.Scan(&row.id, &row.createdAt, &row.kind, &row.pubkey, &row.content, &row.tags, &row.sig, &row.zstd, &receivedAt, &deletedAt); err != nil {
+			return n, err
+		}
+		// Backups hold plain content, whatever the storage settings
+		content, err := row.text()
+		if err != nil {
+			return n, fmt.Errorf("event %s: %w", row.id, err)
+		}
+		err = enc.Encode(backupEvent{
+			ID:         row.id,
+			PubKey:     row.pubkey,
+			CreatedAt:  row.createdAt,
+			Kind:       row.kind,
+			Tags:       json.RawMessage(row.tags),
+			Content:    content,
+			Sig:        row.sig,
+			ReceivedAt: receivedAt,
+			DeletedAt:  deletedAt,
+		})
+		if err != nil {
+			return n, fmt.Errorf("event %s: %w", row.id, err)
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+func (events *EventStore) dumpTags(ctx context.Context, tx *sql.Tx, enc *json.Encoder) (int64, error) {
+	rows, err := sb.Select("event_id", "key", "value", "kind").
+		From(events.Schema.Prefix("event_tags")).
+		RunWith(tx).
+		QueryContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int64
+	for rows.Next() {
+		var tag backupTag
+		var kind sql.NullInt64
+		if err := rows.Scan(&tag.EventID, &tag.Key, &tag.Value, &kind); err != nil {
+			return n, err
+		}
+		if kind.Valid {
+			k := int(kind.Int64)
+			tag.Kind = &k
+		}
+		if err := enc.Encode(tag); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+func (events *EventStore) dumpKV(ctx context.Context, tx *sql.Tx, enc *json.Encoder) (int64, error) {
+	namespace := events.kvNamespace()
+	rows, err := sb.Select("key", "value", "expires_at").
+		From("kv").
+		Where("key LIKE ? ESCAPE '\\'", escapeLike(namespace)+"%").
+		Where(kvLive()).
+		RunWith(tx).
+		QueryContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int64
+	for rows.Next() {
+		var item backupKV
+		var expiresAt sql.NullInt64
+		if err := rows.Scan(&item.Key, &item.Value, &expiresAt); err != nil {
+			return n, err
+		}
+		item.Key = strings.TrimPrefix(item.Key, namespace)
+		if expiresAt.Valid {
+			item.ExpiresAt = &expiresAt.Int64
+		}
+		if err := enc.Encode(item); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// Restore loads a backup written by Backup into the instance's schema, which
+// may have a different name from the one backed up. It refuses to touch a
+// schema that already holds events or kv keys unless force is set, in which
+// case their contents are replaced. Everything is written in one
+// transaction, and the caches are rebuilt afterwards.
+func (instance *Instance) Restore(r io.Reader, force bool) error {
+	if usesMemory() {
+		return errNeedsDatabase("restore")
+	}
+
+	ctx := instance.Ctx
+	events := instance.Events
+	tr := tar.NewReader(r)
+
+	header, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("reading backup: %w", err)
+	}
+	if header.Name != "manifest.json" {
+		return fmt.Errorf("backup starts with %s, want manifest.json", header.Name)
+	}
+	var manifest backupManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return fmt.Errorf("reading manifest: %w", err)
+	}
+	if err := checkBackupManifest(manifest); err != nil {
+		return err
+	}
+
+	tx, err := GetDb().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	empty, err := events.isEmpty(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if !empty && !force {
+		return fmt.Errorf("%w: %s", ErrRestoreNotEmpty, events.Schema.Name)
+	}
+	if err := events.clearForRestore(ctx, tx); err != nil {
+		return err
+	}
+
+	restorers := map[string]func(context.Context, *sql.Tx, *json.Decoder) (int64, error){
+		"events":     events.restoreEvents,
+		"event_tags": events.restoreTags,
+		"kv":         events.restoreKV,
+	}
+
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading backup: %w", err)
+		}
+
+		name := strings.TrimSuffix(header.Name, ".jsonl")
+		restore, ok := restorers[name]
+		if !ok {
+			return fmt.Errorf("unexpected file %s in backup", header.Name)
+		}
+
+		n, err := restore(ctx, tx, json.NewDecoder(tr))
+		if err != nil {
+			return fmt.Errorf("restoring %s: %w", name, err)
+		}
+		if n != manifest.Counts[name] {
+			return fmt.Errorf("restored %d %s rows, manifest says %d", n, name, manifest.Counts[name])
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	GetKeyValueStore(ctx).forget(events.kvNamespace())
+	instance.Management.clearCaches()
+	instance.Groups.clearCaches()
+	instance.warmCaches(func(ctx context.Context) error {
+		return errors.Join(
+			instance.Management.WarmCaches(ctx),
+			instance.Groups.WarmCaches(ctx),
+			instance.loadRelayLists(ctx),
+		)
+	})
+
+	return nil
+}
+
+// checkBackupManifest refuses backups this build can't read: a newer
+// format, or a schema with migrations it doesn't have.
+func checkBackupManifest(manifest backupManifest) error {
+	if manifest.FormatVersion != backupFormatVersion {
+		return fmt.Errorf("backup format version %d, want %d", manifest.FormatVersion, backupFormatVersion)
+	}
+
+	for _, migration := range manifest.Migrations {
+		if !knownMigration(migration) {
+			return fmt.Errorf("backup has migration %s, which this version doesn't know", migration)
+		}
+	}
+	return nil
+}
+
+// isEmpty reports whether the schema holds nothing worth keeping. An
+// instance stores its empty lists as soon as it's loaded, so those don't
+// count; anything else does, including lists the relay has written to.
+func (events *EventStore) isEmpty(ctx context.Context, tx *sql.Tx) (bool, error) {
+	rows, err := sb.Select(eventColumns...).
+		From(events.Schema.Prefix("events")).
+		RunWith(tx).
+		QueryContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	self := events.Config.GetSelf().Hex()
+	for rows.Next() {
+		var row eventRow
+		if err := row.scan(rows); err != nil {
+			return false, err
+		}
+		if row.pubkey != self || !isBootstrapList(row) {
+			return false, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	var hasKV bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM kv WHERE key LIKE $1 ESCAPE '\')`, escapeLike(events.kvNamespace())+"%").Scan(&hasKV)
+	if err != nil {
+		return false, err
+	}
+	return !hasKV, nil
+}
+
+// isBootstrapList reports whether row is one of the lists a new instance
+// creates, still empty: an app data list or the members list with nothing
+// but its d and - tags.
+func isBootstrapList(row eventRow) bool {
+	if row.kind != int(nostr.KindApplicationSpecificData) && row.kind != RELAY_MEMBERS {
+		return false
+	}
+
+	var tags nostr.Tags
+	if err := json.Unmarshal([]byte(row.tags), &tags); err != nil {
+		return false
+	}
+	for _, tag := range tags {
+		if len(tag) == 0 || (tag[0] != "d" && tag[0] != "-") {
+			return false
+		}
+	}
+
+	content, err := row.text()
+	return err == nil && content == ""
+}
+
+func (events *EventStore) clearForRestore(ctx context.Context, tx *sql.Tx) error {
+	// event_tags rows go with their events via ON DELETE CASCADE
+	if _, err := sb.Delete(events.Schema.Prefix("events")).RunWith(tx).ExecContext(ctx); err != nil {
+		return err
+	}
+	_, err := sb.Delete("kv").
+		Where("key LIKE ? ESCAPE '\\'", escapeLike(events.kvNamespace())+"%").
+		RunWith(tx).
+		ExecContext(ctx)
+	return err
+}
+
+// restoreRows decodes JSONL values of type T and inserts them in batches,
+// returning how many there were.
+func restoreRows[T any](ctx context.Context, tx *sql.Tx, dec *json.Decoder, table string, cols []string, values func(T) []any) (int64, error) {
+	var n int64
+	batch := sb.Insert(table).Columns(cols...)
+	pending := 0
+
+	flush := func() error {
+		if pending == 0 {
+			return nil
+		}
+		_, err := batch.RunWith(tx).ExecContext(ctx)
+		batch = sb.Insert(table).Columns(cols...)
+		pending = 0
+		return err
+	}
+
+	for {
+		var row T
+		if err := dec.Decode(&row); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return n, err
+		}
+
+		batch = batch.Values(values(row)...)
+		pending++
+		n++
+
+		if pending >= restoreBatchSize {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, flush()
+}
+
+func (events *EventStore) restoreEvents(ctx context.Context, tx *sql.Tx, dec *json.Decoder) (int64, error) {
+	cols := []string{"id", "created_at", "kind", "pubkey", "content", "tags", "sig", "received_at", "deleted_at"}
+	return restoreRows(ctx, tx, dec, events.Schema.Prefix("events"), cols, func(e backupEvent) []any {
+		// As the migration took events stored before received_at to have
+		// arrived when they were created
+		receivedAt := cmp.Or(e.ReceivedAt, e.CreatedAt)
+		return []any{e.ID, e.CreatedAt, e.Kind, e.PubKey, e.Content, string(e.Tags), e.Sig, receivedAt, e.DeletedAt}
+	})
+}
+
+func (events *EventStore) restoreTags(ctx context.Context, tx *sql.Tx, dec *json.Decoder) (int64, error) {
+	cols := []string{"event_id", "key", "value", "kind"}
+	return restoreRows(ctx, tx, dec, events.Schema.Prefix("event_tags"), cols, func(t backupTag) []any {
+		return []any{t.EventID, t.Key, t.Value, t.Kind}
+	})
+}
+
+func (events *EventStore) restoreKV(ctx context.Context, tx *sql.Tx, dec *json.Decoder) (int64, error) {
+	namespace := events.kvNamespace()
+	return restoreRows(ctx, tx, dec, "kv", []string{"key", "value", "expires_at"}, func(item backupKV) []any {
+		return []any{namespace + item.Key, item.Value, item.ExpiresAt}
+	})
+}
@@ -0,0 +1,154 @@
+package zooid
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+func countSchemaRows(t *testing.T, instance *Instance) map[string]int64 {
+	t.Helper()
+
+	counts := make(map[string]int64)
+	for name, query := range map[string]string{
+		"events":     "SELECT COUNT(*) FROM " + instance.Events.Schema.Prefix("events"),
+		"event_tags": "SELECT COUNT(*) FROM " + instance.Events.Schema.Prefix("event_tags"),
+	} {
+		var n int64
+		if err := GetDb().QueryRow(query).Scan(&n); err != nil {
+			t.Fatalf("counting %s: %v", name, err)
+		}
+		counts[name] = n
+	}
+
+	var n int64
+	err := GetDb().QueryRow(`SELECT COUNT(*) FROM kv WHERE key LIKE $1 ESCAPE '\'`, escapeLike(instance.Events.kvNamespace())+"%").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts["kv"] = n
+
+	return counts
+}
+
+func TestBackupRestore(t *testing.T) {
+	skipOnMemory(t, "backups")
+	ctx := context.Background()
+
+	source := populateSnapshotInstance(t)
+	if err := source.SaveCacheSnapshots(ctx); err != nil {
+		t.Fatal(err)
+	}
+	kv := &KV{Name: "zooid:" + source.Events.Schema.Name}
+	if err := kv.Set(ctx, "custom", "kept"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.SetWithTTL(ctx, "expiring", "kept too", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	want := countSchemaRows(t, source)
+
+	var backup bytes.Buffer
+	if err := source.Backup(&backup); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	// The manifest comes first and matches the data
+	tr := tar.NewReader(bytes.NewReader(backup.Bytes()))
+	header, err := tr.Next()
+	if err != nil || header.Name != "manifest.json" {
+		t.Fatalf("first entry = %v, %v; want manifest.json", header, err)
+	}
+	var manifest backupManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Schema != source.Events.Schema.Name || manifest.SchemaVersion == "" {
+		t.Errorf("manifest = %+v", manifest)
+	}
+	for name, n := range want {
+		if manifest.Counts[name] != n {
+			t.Errorf("manifest counts %d %s, schema has %d", manifest.Counts[name], name, n)
+		}
+	}
+
+	// A relay whose only data is its own lists isn't empty once they say
+	// something
+	populated := createTestInstance()
+	member := nostr.Generate().Public()
+	if err := populated.Management.AddMember(member); err != nil {
+		t.Fatal(err)
+	}
+	if err := populated.Restore(bytes.NewReader(backup.Bytes()), false); !errors.Is(err, ErrRestoreNotEmpty) {
+		t.Errorf("restore onto a relay with members = %v, want ErrRestoreNotEmpty", err)
+	}
+	if !populated.Management.IsMember(member) {
+		t.Error("refused restore removed the relay's members")
+	}
+
+	// Restore under another schema name, for a relay with the same key
+	target := createTestInstance()
+	self := nostr.Filter{Authors: []nostr.PubKey{target.Config.GetSelf()}}
+	for _, event := range slices.Collect(target.Events.QueryEvents(self, 0)) {
+		if err := target.Events.DeleteEvent(event.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	target.Config.secret = source.Config.secret
+	if err := target.Restore(bytes.NewReader(backup.Bytes()), false); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if got := countSchemaRows(t, target); got["events"] != want["events"] || got["event_tags"] != want["event_tags"] || got["kv"] != want["kv"] {
+		t.Errorf("restored counts = %v, want %v", got, want)
+	}
+
+	targetKV := &KV{Name: "zooid:" + target.Events.Schema.Name}
+	if value, err := targetKV.Get(ctx, "custom"); err != nil || value != "kept" {
+		t.Errorf("restored custom key = %q, %v", value, err)
+	}
+
+	// Caches were rebuilt from the restored events
+	for _, h := range []string{"alpha", "beta"} {
+		if _, ok := target.Groups.GetMetadata(h); !ok {
+			t.Errorf("group %s missing after restore", h)
+		}
+	}
+	if len(target.Management.GetMembers()) != len(source.Management.GetMembers()) {
+		t.Errorf("restored %d relay members, want %d", len(target.Management.GetMembers()), len(source.Management.GetMembers()))
+	}
+
+	// A second restore needs force, and replaces rather than duplicates
+	if err := target.Restore(bytes.NewReader(backup.Bytes()), false); !errors.Is(err, ErrRestoreNotEmpty) {
+		t.Errorf("restore into a populated schema = %v, want ErrRestoreNotEmpty", err)
+	}
+	if err := target.Restore(bytes.NewReader(backup.Bytes()), true); err != nil {
+		t.Fatalf("forced Restore failed: %v", err)
+	}
+	if got := countSchemaRows(t, target); got["events"] != want["events"] || got["event_tags"] != want["event_tags"] || got["kv"] != want["kv"] {
+		t.Errorf("counts after forced restore = %v, want %v", got, want)
+	}
+}
+
+func TestRestore_RejectsUnknownMigrations(t *testing.T) {
+	manifest := backupManifest{FormatVersion: backupFormatVersion, Migrations: []string{"001_covering_indexes.sql", "999_from_the_future.sql"}}
+	if err := checkBackupManifest(manifest); err == nil {
+		t.Error("a backup with an unknown migration should be refused")
+	}
+
+	manifest.Migrations = manifest.Migrations[:1]
+	if err := checkBackupManifest(manifest); err != nil {
+		t.Errorf("checkBackupManifest of an older backup = %v", err)
+	}
+
+	manifest.Migrations = []string{"001_base", "002_covering_indexes"}
+	if err := checkBackupManifest(manifest); err != nil {
+		t.Errorf("checkBackupManifest = %v", err)
+	}
+}
@@ -53,6 +53,10 @@ func (bl *BlossomStore) Enable(instance *Instance) {
 	}
 
 	backend.RejectUpload = func(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+		if bl.Config.IsReadOnly() {
+			return true, "relay is in read-only maintenance mode", 503
+		}
+
 		if size > 10*1024*1024 {
 			return true, "file too large", 413
 		}
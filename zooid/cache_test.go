@@ -15,7 +15,7 @@ func createTestGroupStore() (*GroupStore, *ManagementStore) {
 		secret: nostr.Generate(),
 	}
 	config.Groups.Enabled = true
-	schema := &Schema{Name: "test_" + RandomString(8)}
+	schema := testSchema("test_")
 	relay := &khatru.Relay{}
 	events := &EventStore{
 		Relay:   relay,
@@ -55,7 +55,7 @@ func TestRelayMembershipCache_WarmUp(t *testing.T) {
 		Config: mgmt.Config,
 		Events: mgmt.Events,
 	}
-	mgmt2.WarmCaches()
+	mgmt2.WarmCaches(context.Background())
 
 	if !mgmt2.IsMember(pk1) {
 		t.Error("IsMember should return true for pk1 after WarmCaches")
@@ -72,7 +72,7 @@ func TestRelayMembershipCache_WarmUp(t *testing.T) {
 
 func TestRelayMembershipCache_AddRemove(t *testing.T) {
 	mgmt := createTestManagementStore()
-	mgmt.WarmCaches()
+	mgmt.WarmCaches(context.Background())
 
 	pk := nostr.Generate().Public()
 
@@ -89,7 +89,7 @@ func TestRelayMembershipCache_AddRemove(t *testing.T) {
 
 func TestRelayMembershipCache_GetMembers(t *testing.T) {
 	mgmt := createTestManagementStore()
-	mgmt.WarmCaches()
+	mgmt.WarmCaches(context.Background())
 
 	pk1 := nostr.Generate().Public()
 	pk2 := nostr.Generate().Public()
@@ -130,7 +130,7 @@ func TestBannedPubkeysCache_WarmUp(t *testing.T) {
 		Config: mgmt.Config,
 		Events: mgmt.Events,
 	}
-	mgmt2.WarmCaches()
+	mgmt2.WarmCaches(context.Background())
 
 	if !mgmt2.PubkeyIsBanned(pk) {
 		t.Error("PubkeyIsBanned should return true after WarmCaches")
@@ -150,7 +150,7 @@ func TestBannedPubkeysCache_WarmUp(t *testing.T) {
 
 func TestBannedPubkeysCache_BanAllow(t *testing.T) {
 	mgmt := createTestManagementStore()
-	mgmt.WarmCaches()
+	mgmt.WarmCaches(context.Background())
 
 	pk := nostr.Generate().Public()
 
@@ -178,7 +178,7 @@ func TestBannedEventsCache_WarmUp(t *testing.T) {
 		Config: mgmt.Config,
 		Events: mgmt.Events,
 	}
-	mgmt2.WarmCaches()
+	mgmt2.WarmCaches(context.Background())
 
 	if !mgmt2.EventIsBanned(eventID) {
 		t.Error("EventIsBanned should return true after WarmCaches")
@@ -198,7 +198,7 @@ func TestBannedEventsCache_WarmUp(t *testing.T) {
 
 func TestBannedEventsCache_BanAllow(t *testing.T) {
 	mgmt := createTestManagementStore()
-	mgmt.WarmCaches()
+	mgmt.WarmCaches(context.Background())
 
 	eventID := nostr.MustIDFromHex("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
 
@@ -238,7 +238,7 @@ func TestGroupMetadataCache_WarmUp(t *testing.T) {
 		Events:     groups.Events,
 		Management: groups.Management,
 	}
-	groups2.WarmCaches()
+	groups2.WarmCaches(context.Background())
 
 	meta, found := groups2.GetMetadata("testgrp")
 	if !found {
@@ -251,7 +251,7 @@ func TestGroupMetadataCache_WarmUp(t *testing.T) {
 
 func TestGroupMetadataCache_Update(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	// Create group metadata
 	createEvent := nostr.Event{
@@ -292,7 +292,7 @@ func TestGroupMetadataCache_Update(t *testing.T) {
 
 func TestGroupMetadataCache_Private(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	// Create a private group
 	createEvent := nostr.Event{
@@ -325,7 +325,7 @@ func TestGroupMetadataCache_Private(t *testing.T) {
 
 func TestGroupMetadataCache_Delete(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	// Populate cache entries directly (test cache clearing, not DB deletion)
 	groups.metadataCache.Store("delgrp", &groupMetaCache{
@@ -341,7 +341,7 @@ func TestGroupMetadataCache_Delete(t *testing.T) {
 	}
 
 	// DeleteGroup clears all cache entries for the group
-	groups.DeleteGroup("delgrp")
+	groups.DeleteGroup("delgrp", nostr.Generate().Public())
 
 	_, found = groups.GetMetadata("delgrp")
 	if found {
@@ -384,7 +384,7 @@ func TestGroupMembershipCache_WarmUp(t *testing.T) {
 		Events:     groups.Events,
 		Management: groups.Management,
 	}
-	groups2.WarmCaches()
+	groups2.WarmCaches(context.Background())
 
 	if !groups2.IsMember("grp1", pk1) {
 		t.Error("IsMember should return true for pk1 after WarmCaches")
@@ -401,7 +401,7 @@ func TestGroupMembershipCache_WarmUp(t *testing.T) {
 
 func TestGroupMembershipCache_AddRemove(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	pk := nostr.Generate().Public()
 
@@ -428,7 +428,7 @@ func TestGroupMembershipCache_AddRemove(t *testing.T) {
 
 func TestGroupMembershipCache_GetMembers(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	pk1 := nostr.Generate().Public()
 	pk2 := nostr.Generate().Public()
@@ -478,7 +478,7 @@ func TestGroupMembershipCache_Creator(t *testing.T) {
 		Events:     groups.Events,
 		Management: groups.Management,
 	}
-	groups2.WarmCaches()
+	groups2.WarmCaches(context.Background())
 
 	gotCreator := groups2.GetGroupCreator("creatgrp")
 	if gotCreator != creator {
@@ -499,7 +499,7 @@ func TestGroupMembershipCache_Creator(t *testing.T) {
 
 func TestGroupMetadataCache_WriteRestricted(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	// Create a write-restricted group
 	createEvent := nostr.Event{
@@ -549,7 +549,7 @@ func TestGroupMetadataCache_WriteRestrictedWarmUp(t *testing.T) {
 		Events:     groups.Events,
 		Management: groups.Management,
 	}
-	groups2.WarmCaches()
+	groups2.WarmCaches(context.Background())
 
 	if !groups2.IsWriteRestricted("wrgrp") {
 		t.Error("IsWriteRestricted should return true after WarmCaches")
@@ -558,7 +558,7 @@ func TestGroupMetadataCache_WriteRestrictedWarmUp(t *testing.T) {
 
 func TestRoleCache_SetAndCheck(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	pk := nostr.Generate().Public()
 
@@ -584,7 +584,7 @@ func TestRoleCache_SetAndCheck(t *testing.T) {
 
 func TestRoleCache_ClearOnRemove(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	pk := nostr.Generate().Public()
 
@@ -629,7 +629,7 @@ func TestRoleCache_WarmUpFromMembersSnapshot(t *testing.T) {
 		Events:     groups.Events,
 		Management: groups.Management,
 	}
-	groups2.WarmCaches()
+	groups2.WarmCaches(context.Background())
 
 	if !groups2.HasRole("rolegrp", pk, "writer") {
 		t.Error("HasRole should return true after WarmCaches with members-snapshot role")
@@ -708,7 +708,7 @@ func TestRoleCache_WarmUp_NewerSnapshotWins(t *testing.T) {
 		Events:     groups.Events,
 		Management: groups.Management,
 	}
-	groups2.WarmCaches()
+	groups2.WarmCaches(context.Background())
 
 	if groups2.HasRole("replacegrp", pk, "writer") {
 		t.Error("HasRole should be false: newer members snapshot dropped the role, older snapshot must not stomp it")
@@ -720,7 +720,7 @@ func TestRoleCache_WarmUp_NewerSnapshotWins(t *testing.T) {
 
 func TestCanWrite_NotWriteRestricted(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	// Create normal group
 	createEvent := nostr.Event{
@@ -739,7 +739,7 @@ func TestCanWrite_NotWriteRestricted(t *testing.T) {
 func TestCanWrite_WriteRestricted_NoRole(t *testing.T) {
 	groups, _ := createTestGroupStore()
 	groups.Config.Info.Pubkey = nostr.Generate().Public().Hex()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	// Create write-restricted group
 	createEvent := nostr.Event{
@@ -760,7 +760,7 @@ func TestCanWrite_WriteRestricted_NoRole(t *testing.T) {
 func TestCanWrite_WriteRestricted_WithWriterRole(t *testing.T) {
 	groups, _ := createTestGroupStore()
 	groups.Config.Info.Pubkey = nostr.Generate().Public().Hex()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	createEvent := nostr.Event{
 		CreatedAt: nostr.Now(),
@@ -782,7 +782,7 @@ func TestCanWrite_WriteRestricted_Admin(t *testing.T) {
 	groups, _ := createTestGroupStore()
 	owner := nostr.Generate().Public()
 	groups.Config.Info.Pubkey = owner.Hex()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	createEvent := nostr.Event{
 		CreatedAt: nostr.Now(),
@@ -799,7 +799,7 @@ func TestCanWrite_WriteRestricted_Admin(t *testing.T) {
 func TestCanWrite_WriteRestricted_Creator(t *testing.T) {
 	groups, _ := createTestGroupStore()
 	groups.Config.Info.Pubkey = nostr.Generate().Public().Hex()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	creator := nostr.Generate().Public()
 
@@ -822,7 +822,7 @@ func TestCheckWrite_WriteRestrictedCreation_AdminAllowed(t *testing.T) {
 	groups, _ := createTestGroupStore()
 	admin := nostr.Generate().Public()
 	groups.Config.Info.Pubkey = admin.Hex()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	event := nostr.Event{
 		Kind:      nostr.KindSimpleGroupCreateGroup,
@@ -841,7 +841,7 @@ func TestCheckWrite_WriteRestrictedCreation_AdminAllowed(t *testing.T) {
 func TestCheckWrite_WriteRestrictedCreation_NonAdminRejected(t *testing.T) {
 	groups, _ := createTestGroupStore()
 	groups.Config.Info.Pubkey = nostr.Generate().Public().Hex()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	nonAdmin := nostr.Generate().Public()
 	event := nostr.Event{
@@ -864,7 +864,7 @@ func TestCheckWrite_WriteRestrictedCreation_NonAdminRejected(t *testing.T) {
 func TestCheckWrite_NormalCreation_NonAdminAllowed(t *testing.T) {
 	groups, _ := createTestGroupStore()
 	groups.Config.Info.Pubkey = nostr.Generate().Public().Hex()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	nonAdmin := nostr.Generate().Public()
 	event := nostr.Event{
@@ -883,7 +883,7 @@ func TestCheckWrite_NormalCreation_NonAdminAllowed(t *testing.T) {
 
 func TestGroupDeleteClearsRoleCache(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	pk := nostr.Generate().Public()
 	groups.SetMemberRoles("delgrp", pk, []string{"writer"})
@@ -892,7 +892,7 @@ func TestGroupDeleteClearsRoleCache(t *testing.T) {
 		t.Fatal("HasRole should return true before delete")
 	}
 
-	groups.DeleteGroup("delgrp")
+	groups.DeleteGroup("delgrp", nostr.Generate().Public())
 
 	if groups.HasRole("delgrp", pk, "writer") {
 		t.Error("HasRole should return false after DeleteGroup")
@@ -901,7 +901,7 @@ func TestGroupDeleteClearsRoleCache(t *testing.T) {
 
 func TestGroupMembershipCache_DeleteClearsAll(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	pk := nostr.Generate().Public()
 
@@ -929,7 +929,7 @@ func TestGroupMembershipCache_DeleteClearsAll(t *testing.T) {
 		t.Fatal("Member should exist before delete")
 	}
 
-	groups.DeleteGroup("delall")
+	groups.DeleteGroup("delall", nostr.Generate().Public())
 
 	_, found = groups.GetMetadata("delall")
 	if found {
@@ -957,7 +957,7 @@ func findTagValue(tags nostr.Tags, name string) string {
 
 func TestGetMemberCount_Empty(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	count := groups.GetMemberCount("nonexistent")
 	if count != 0 {
@@ -967,7 +967,7 @@ func TestGetMemberCount_Empty(t *testing.T) {
 
 func TestGetMemberCount_AfterAddRemove(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	pk1 := nostr.Generate().Public()
 	pk2 := nostr.Generate().Public()
@@ -992,7 +992,7 @@ func TestGetMemberCount_AfterAddRemove(t *testing.T) {
 
 func TestUpdateMetadata_IncludesMemberCount(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	pk1 := nostr.Generate().Public()
 	pk2 := nostr.Generate().Public()
@@ -1021,7 +1021,7 @@ func TestUpdateMetadata_IncludesMemberCount(t *testing.T) {
 
 func TestUpdateMetadata_ZeroMemberCount(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	createEvent := nostr.Event{
 		CreatedAt: nostr.Now(),
@@ -1045,7 +1045,7 @@ func TestUpdateMetadata_ZeroMemberCount(t *testing.T) {
 
 func TestRefreshMemberCount_UpdatesExisting(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	// Create metadata with 0 members initially
 	createEvent := nostr.Event{
@@ -1091,7 +1091,7 @@ func TestRefreshMemberCount_UpdatesExisting(t *testing.T) {
 
 func TestRefreshMemberCount_NoMetadata(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	// Should return nil and not panic when no metadata exists
 	err := groups.RefreshMemberCount("nometadata")
@@ -1102,7 +1102,7 @@ func TestRefreshMemberCount_NoMetadata(t *testing.T) {
 
 func TestRefreshMemberCount_PreservesOtherTags(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	// Create metadata for a closed (non-private) group
 	createEvent := nostr.Event{
@@ -1161,7 +1161,7 @@ func TestRefreshMemberCount_PreservesOtherTags(t *testing.T) {
 
 func TestUpdateMetadata_PrivateGroupOmitsMemberCount(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	pk := nostr.Generate().Public()
 	groups.AddMember("privgrp", pk)
@@ -1187,7 +1187,7 @@ func TestUpdateMetadata_PrivateGroupOmitsMemberCount(t *testing.T) {
 
 func TestRefreshMemberCount_PrivateGroupSkipped(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	createEvent := nostr.Event{
 		CreatedAt: nostr.Now(),
@@ -1214,7 +1214,7 @@ func TestRefreshMemberCount_PrivateGroupSkipped(t *testing.T) {
 
 func TestUpdateMetadata_StripsClientMemberCount(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	groups.AddMember("stripgrp", nostr.Generate().Public())
 
@@ -1242,7 +1242,7 @@ func TestUpdateMetadata_StripsClientMemberCount(t *testing.T) {
 
 func TestRefreshMemberCount_ShortCircuitsWhenUnchanged(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	createEvent := nostr.Event{
 		CreatedAt: nostr.Now(),
@@ -1270,7 +1270,7 @@ func TestRefreshMemberCount_ShortCircuitsWhenUnchanged(t *testing.T) {
 
 func TestMemberCount_WarmCachesPreservesTag(t *testing.T) {
 	groups, _ := createTestGroupStore()
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	// Create metadata and add 5 members
 	createEvent := nostr.Event{
@@ -1295,7 +1295,7 @@ func TestMemberCount_WarmCachesPreservesTag(t *testing.T) {
 		Events:     groups.Events,
 		Management: groups.Management,
 	}
-	groups2.WarmCaches()
+	groups2.WarmCaches(context.Background())
 
 	meta, found := groups2.GetMetadata("warmgrp")
 	if !found {
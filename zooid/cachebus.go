@@ -0,0 +1,338 @@
+package zooid
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"github.com/jackc/pgx/v5"
+)
+
+// Cache invalidation.
+//
+// Each instance caches its schema's state, so when several serve one schema,
+// like the old and new instance during a blue/green deploy, a change made
+// through one leaves the others serving what they cached. Changes their
+// caches wouldn't otherwise pick up are announced on the zooid_cache channel,
+// naming the schema, the group, pubkey or event concerned and what happened,
+// and every other instance of the schema drops what it cached or reads it
+// again. With PostgreSQL they go out by NOTIFY and each process reads them
+// back on a LISTEN connection of its own, which is reopened if it drops.
+// Messages sent while it's down are lost, so meanwhile, and once it's back,
+// the relay's ban and member lists are reconciled with the database instead.
+// Instances in the same process are told directly, which is all there is
+// with SQLite or in memory.
+
+const cacheChannel = "zooid_cache"
+
+// Actions of cache messages
+const (
+	cacheDeleteGroup = "delete_group"
+	cacheMember      = "member"
+	cacheBanPubkey   = "ban_pubkey"
+	cacheShadowBan   = "shadow_ban"
+	cacheBanEvent    = "ban_event"
+	cacheNIP05       = "nip05"
+	cacheResync      = "resync" // only delivered within the process
+)
+
+type cacheMessage struct {
+	Process string `json:"process"`
+	Schema  string `json:"schema"`
+	Group   string `json:"group,omitempty"`
+	PubKey  string `json:"pubkey,omitempty"`
+	Event   string `json:"event,omitempty"`
+	Action  string `json:"action"`
+}
+
+// cacheProcess tells this process's messages apart from other processes'.
+var cacheProcess = RandomString(16)
+
+// cacheSubscribers are the instances to tell, by schema and event store.
+var (
+	cacheSubscribersMu sync.Mutex
+	cacheSubscribers   = make(map[string]map[*EventStore]func(cacheMessage))
+	cacheListenerOnce  sync.Once
+)
+
+// subscribeCaches calls handle with the cache messages other instances of
+// events' schema send, until the returned function is called.
+func subscribeCaches(events *EventStore, handle func(cacheMessage)) (unsubscribe func()) {
+	if !usesMemory() && !usesSQLite() {
+		cacheListenerOnce.Do(func() { go listenCaches() })
+	}
+
+	schema := events.Schema.Name
+
+	cacheSubscribersMu.Lock()
+	defer cacheSubscribersMu.Unlock()
+
+	if cacheSubscribers[schema] == nil {
+		cacheSubscribers[schema] = make(map[*EventStore]func(cacheMessage))
+	}
+	cacheSubscribers[schema][events] = handle
+
+	return func() {
+		cacheSubscribersMu.Lock()
+		defer cacheSubscribersMu.Unlock()
+
+		delete(cacheSubscribers[schema], events)
+		if len(cacheSubscribers[schema]) == 0 {
+			delete(cacheSubscribers, schema)
+		}
+	}
+}
+
+// deliverCache hands msg to the instances of its schema in this process,
+// except from, if it sent it.
+func deliverCache(msg cacheMessage, from *EventStore) {
+	cacheSubscribersMu.Lock()
+	handlers := make([]func(cacheMessage), 0, len(cacheSubscribers[msg.Schema]))
+	for events, handle := range cacheSubscribers[msg.Schema] {
+		if events != from {
+			handlers = append(handlers, handle)
+		}
+	}
+	cacheSubscribersMu.Unlock()
+
+	for _, handle := range handlers {
+		handle(msg)
+	}
+}
+
+// deliverAllCaches hands msg to every instance in this process.
+func deliverAllCaches(msg cacheMessage) {
+	cacheSubscribersMu.Lock()
+	schemas := Keys(cacheSubscribers)
+	cacheSubscribersMu.Unlock()
+
+	for _, schema := range schemas {
+		msg.Schema = schema
+		deliverCache(msg, nil)
+	}
+}
+
+// announce tells the other instances of the schema about a change.
+func (events *EventStore) announce(msg cacheMessage) {
+	msg.Process = cacheProcess
+	msg.Schema = events.Schema.Name
+
+	deliverCache(msg, events)
+
+	if usesMemory() || usesSQLite() {
+		return
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to encode cache message: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(events.rootCtx, dbOpTimeout)
+	defer cancel()
+
+	if _, err := GetDb().ExecContext(ctx, "SELECT pg_notify($1, $2)", cacheChannel, string(payload)); err != nil {
+		log.Printf("Failed to announce %s for %s: %v", msg.Action, msg.Schema, err)
+	}
+}
+
+// onCacheMessage applies a change another instance announced.
+func (instance *Instance) onCacheMessage(msg cacheMessage) {
+	switch msg.Action {
+	case cacheDeleteGroup:
+		instance.Groups.forgetGroup(msg.Group)
+	case cacheMember, cacheBanPubkey, cacheShadowBan:
+		if pubkey, err := nostr.PubKeyFromHex(msg.PubKey); err == nil {
+			instance.Management.refreshPubkey(msg.Action, pubkey)
+		}
+	case cacheBanEvent:
+		if id, err := nostr.IDFromHex(msg.Event); err == nil {
+			instance.Management.refreshBannedEvent(id)
+		}
+	case cacheNIP05:
+		instance.Management.refreshNIP05Names()
+	case cacheResync:
+		instance.Management.resync()
+	}
+}
+
+// listenCaches reads the cache messages of other processes for as long as
+// the process runs, reconnecting with a growing delay when the connection
+// drops.
+func listenCaches() {
+	delay := time.Second
+	for {
+		start := time.Now()
+		err := listenCachesOnce(context.Background())
+		if time.Since(start) > time.Minute {
+			delay = time.Second
+		}
+		log.Printf("Cache invalidation listener stopped, reconnecting in %s: %v", delay, err)
+		deliverAllCaches(cacheMessage{Action: cacheResync})
+		time.Sleep(delay)
+		delay = min(delay*2, time.Minute)
+	}
+}
+
+func listenCachesOnce(ctx context.Context) error {
+	conn, err := pgx.Connect(ctx, Env("DATABASE_URL"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.WithoutCancel(ctx))
+
+	if _, err := conn.Exec(ctx, "LISTEN "+cacheChannel); err != nil {
+		return err
+	}
+
+	// Whatever was sent before this point is lost
+	deliverAllCaches(cacheMessage{Action: cacheResync})
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var msg cacheMessage
+		if err := json.Unmarshal([]byte(notification.Payload), &msg); err != nil {
+			log.Printf("Ignoring malformed cache message %q: %v", notification.Payload, err)
+			continue
+		}
+
+		// Instances in this process were told directly
+		if msg.Process != cacheProcess {
+			deliverCache(msg, nil)
+		}
+	}
+}
+
+// Relay lists
+
+// refreshPubkey reads what the list action names says about pubkey again.
+func (m *ManagementStore) refreshPubkey(action string, pubkey nostr.PubKey) {
+	if !m.cachesWarmed {
+		return
+	}
+
+	switch action {
+	case cacheMember:
+		tag := m.Events.GetOrCreateRelayMembersList().Tags.FindWithValue("member", pubkey.Hex())
+		if tag == nil {
+			m.relayMembers.Delete(pubkey)
+			m.memberExpiry.Delete(pubkey)
+			m.accessLost(pubkey)
+			return
+		}
+		m.relayMembers.Store(pubkey, struct{}{})
+		if expires := memberTagExpiry(tag); expires != 0 {
+			m.memberExpiry.Store(pubkey, expires)
+		} else {
+			m.memberExpiry.Delete(pubkey)
+		}
+	case cacheBanPubkey:
+		if tag := m.Events.GetOrCreateApplicationSpecificData(BANNED_PUBKEYS).Tags.FindWithValue("banned", pubkey.Hex()); tag != nil {
+			m.bannedPubkeys.Store(pubkey, tagReason(tag))
+			m.accessLost(pubkey)
+		} else {
+			m.bannedPubkeys.Delete(pubkey)
+		}
+	case cacheShadowBan:
+		if tag := m.Events.GetOrCreateApplicationSpecificData(SHADOW_BANNED_PUBKEYS).Tags.FindWithValue("banned", pubkey.Hex()); tag != nil {
+			m.shadowBannedPubkeys.Store(pubkey, tagReason(tag))
+		} else {
+			m.shadowBannedPubkeys.Delete(pubkey)
+		}
+	}
+}
+
+// refreshBannedEvent reads whether id is banned again.
+func (m *ManagementStore) refreshBannedEvent(id nostr.ID) {
+	if !m.cachesWarmed {
+		return
+	}
+
+	if tag := m.Events.GetOrCreateApplicationSpecificData(BANNED_EVENTS).Tags.FindWithValue("event", id.Hex()); tag != nil {
+		m.bannedEvents.Store(id, tagReason(tag))
+	} else {
+		m.bannedEvents.Delete(id)
+	}
+}
+
+// resync makes the relay list caches match the database, for when changes
+// may have been missed. Pubkeys that lost access have their connections
+// closed.
+func (m *ManagementStore) resync() {
+	if !m.cachesWarmed {
+		return
+	}
+
+	members := make(map[nostr.PubKey]nostr.Timestamp)
+	for tag := range m.Events.GetOrCreateRelayMembersList().Tags.FindAll("member") {
+		if pubkey, err := nostr.PubKeyFromHex(tag[1]); err == nil {
+			members[pubkey] = memberTagExpiry(tag)
+		}
+	}
+	m.relayMembers.Range(func(key, _ any) bool {
+		if _, ok := members[key.(nostr.PubKey)]; !ok {
+			m.relayMembers.Delete(key)
+			m.memberExpiry.Delete(key)
+			m.accessLost(key.(nostr.PubKey))
+		}
+		return true
+	})
+	for pubkey, expires := range members {
+		m.relayMembers.Store(pubkey, struct{}{})
+		if expires != 0 {
+			m.memberExpiry.Store(pubkey, expires)
+		} else {
+			m.memberExpiry.Delete(pubkey)
+		}
+	}
+
+	for pubkey := range resyncReasons(&m.bannedPubkeys, m.Events.GetOrCreateApplicationSpecificData(BANNED_PUBKEYS), "banned", nostr.PubKeyFromHex) {
+		m.accessLost(pubkey)
+	}
+	resyncReasons(&m.shadowBannedPubkeys, m.Events.GetOrCreateApplicationSpecificData(SHADOW_BANNED_PUBKEYS), "banned", nostr.PubKeyFromHex)
+	resyncReasons(&m.bannedEvents, m.Events.GetOrCreateApplicationSpecificData(BANNED_EVENTS), "event", nostr.IDFromHex)
+	m.loadNIP05Names()
+}
+
+// resyncReasons makes cache hold the key and reason of every name tag of
+// list, and nothing else, and returns the keys it didn't hold before.
+func resyncReasons[K comparable](cache *sync.Map, list nostr.Event, name string, parse func(string) (K, error)) map[K]struct{} {
+	stored := make(map[K]string)
+	for tag := range list.Tags.FindAll(name) {
+		if key, err := parse(tag[1]); err == nil {
+			stored[key] = tagReason(tag)
+		}
+	}
+
+	cache.Range(func(key, _ any) bool {
+		if _, ok := stored[key.(K)]; !ok {
+			cache.Delete(key)
+		}
+		return true
+	})
+
+	added := make(map[K]struct{})
+	for key, reason := range stored {
+		if _, loaded := cache.Swap(key, reason); !loaded {
+			added[key] = struct{}{}
+		}
+	}
+
+	return added
+}
+
+// tagReason returns the reason a ban list tag records, if any.
+func tagReason(tag nostr.Tag) string {
+	if len(tag) < 3 {
+		return ""
+	}
+	return tag[2]
+}
@@ -0,0 +1,171 @@
+package zooid
+
+import (
+	"context"
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// createTestPeer returns a second instance of instance's schema, as during a
+// blue/green deploy, both listening for each other's cache messages.
+func createTestPeer(t *testing.T, instance *Instance) *Instance {
+	t.Helper()
+
+	relay := &khatru.Relay{}
+	events := &EventStore{
+		Relay:   relay,
+		Config:  instance.Config,
+		Schema:  instance.Events.Schema,
+		rootCtx: context.Background(),
+	}
+	management := &ManagementStore{Config: instance.Config, Events: events}
+	groups := &GroupStore{Config: instance.Config, Events: events, Management: management}
+	peer := &Instance{
+		Ctx:        context.Background(),
+		Relay:      relay,
+		Config:     instance.Config,
+		Events:     events,
+		Management: management,
+		Groups:     groups,
+	}
+
+	management.WarmCaches(context.Background())
+	groups.WarmCaches(context.Background())
+
+	for _, i := range []*Instance{instance, peer} {
+		t.Cleanup(subscribeCaches(i.Events, i.onCacheMessage))
+	}
+
+	return peer
+}
+
+func TestDeleteGroup_InvalidatesPeers(t *testing.T) {
+	instance := createTestInstance()
+	runTestAdmin(t, instance, "create-group", "doomed")
+	member := nostr.Generate().Public()
+	runTestAdmin(t, instance, "add-member", "doomed", member.Hex())
+
+	peer := createTestPeer(t, instance)
+	if _, found := peer.Groups.GetMetadata("doomed"); !found || !peer.Groups.IsMember("doomed", member) {
+		t.Fatal("the peer didn't load the group")
+	}
+
+	admin := nostr.Generate().Public()
+	instance.Groups.DeleteGroup("doomed", admin)
+
+	if _, found := peer.Groups.GetMetadata("doomed"); found {
+		t.Error("the peer still serves the deleted group's metadata")
+	}
+	if peer.Groups.IsMember("doomed", member) {
+		t.Error("the peer still has the deleted group's members")
+	}
+	if creator := peer.Groups.GetGroupCreator("doomed"); creator != (nostr.PubKey{}) {
+		t.Error("the peer still has the deleted group's creator")
+	}
+
+	// Anyone asking after the group finds the tombstone
+	var tombstones []nostr.Event
+	filter := nostr.Filter{Kinds: []nostr.Kind{nostr.KindSimpleGroupDeleteGroup}, Tags: nostr.TagMap{"h": []string{"doomed"}}}
+	for event := range peer.QueryStored(authedContext(nostr.Generate().Public()), filter) {
+		tombstones = append(tombstones, event)
+	}
+	if len(tombstones) != 1 {
+		t.Fatalf("got %d tombstones, want 1", len(tombstones))
+	}
+	if tombstone := tombstones[0]; !instance.Config.IsSelf(tombstone.PubKey) || !tombstone.VerifySignature() {
+		t.Error("the tombstone should be signed by the relay")
+	} else if actor := tombstone.Tags.Find("actor"); actor == nil || actor[1] != admin.Hex() {
+		t.Errorf("tombstone actor = %v, want %s", actor, admin.Hex())
+	}
+}
+
+func TestManagementChanges_ReachPeers(t *testing.T) {
+	instance := createTestInstance()
+	peer := createTestPeer(t, instance)
+
+	var dropped []nostr.PubKey
+	peer.Management.onAccessLost = func(pubkey nostr.PubKey) { dropped = append(dropped, pubkey) }
+
+	user := nostr.Generate().Public()
+	if err := instance.Management.AddMember(user); err != nil {
+		t.Fatal(err)
+	}
+	if !peer.Management.IsMember(user) {
+		t.Error("the peer didn't learn about the new member")
+	}
+
+	if err := instance.Management.BanPubkey(user, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	if !peer.Management.PubkeyIsBanned(user) || peer.Management.IsMember(user) {
+		t.Error("the peer still lets the banned pubkey in")
+	}
+	if len(dropped) == 0 || dropped[0] != user {
+		t.Errorf("the peer closed connections of %v, want %s", dropped, user.Hex())
+	}
+
+	if err := instance.Management.ShadowBanPubkey(user, "quiet"); err != nil {
+		t.Fatal(err)
+	}
+	if !peer.Management.PubkeyIsShadowBanned(user) {
+		t.Error("the peer didn't learn about the shadow ban")
+	}
+
+	if err := instance.Management.AllowPubkey(user); err != nil {
+		t.Fatal(err)
+	}
+	if peer.Management.PubkeyIsBanned(user) || !peer.Management.IsMember(user) {
+		t.Error("the peer didn't learn the pubkey was allowed again")
+	}
+
+	id := nostr.Generate().Public() // any 32 bytes will do
+	if err := instance.Management.BanEvent(nostr.ID(id), "bad"); err != nil {
+		t.Fatal(err)
+	}
+	if !peer.Management.EventIsBanned(nostr.ID(id)) {
+		t.Error("the peer didn't learn about the banned event")
+	}
+}
+
+func TestManagementStore_Resync(t *testing.T) {
+	instance := createTestInstance()
+	peer := createTestPeer(t, instance)
+
+	kept, removed, banned := nostr.Generate().Public(), nostr.Generate().Public(), nostr.Generate().Public()
+	for _, pubkey := range []nostr.PubKey{kept, removed} {
+		if err := instance.Management.AddMember(pubkey); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Changes the peer misses, as while the listener is down
+	peer.Management.relayMembers.Store(nostr.Generate().Public(), struct{}{})
+	unsubscribe := subscribeCaches(peer.Events, func(cacheMessage) {})
+	if err := instance.Management.RemoveMember(removed); err != nil {
+		t.Fatal(err)
+	}
+	if err := instance.Management.AddBannedPubkey(banned, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	unsubscribe()
+	if !peer.Management.IsMember(removed) || peer.Management.PubkeyIsBanned(banned) {
+		t.Fatal("the peer heard about the changes it should have missed")
+	}
+
+	peer.Management.resync()
+
+	if !peer.Management.IsMember(kept) {
+		t.Error("resync dropped a member")
+	}
+	if peer.Management.IsMember(removed) {
+		t.Error("resync kept a removed member")
+	}
+	if !peer.Management.PubkeyIsBanned(banned) {
+		t.Error("resync missed a ban")
+	}
+	if n := len(peer.Management.GetMembers()); n != len(instance.Management.GetMembers()) {
+		t.Errorf("the peer has %d members after resync, want %d", n, len(instance.Management.GetMembers()))
+	}
+}
@@ -0,0 +1,134 @@
+package zooid
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// Client policy.
+//
+// A relay run for one app can refuse other clients. Patterns in
+// clients.allow and clients.deny are matched, ignoring case, anywhere in the
+// name from a published event's client tag and in the connection's
+// User-Agent and Origin headers (clients.check picks which of the three).
+// A client is refused if anything matches a deny pattern, or if allow is set
+// and nothing matches it, so a client that sends none of them is refused by
+// an allow list. Refused events and REQs get "blocked: client not allowed";
+// with clients.refuse_connections the websocket upgrade is refused too.
+// Admins are never refused once authenticated, but an upgrade is refused
+// before anyone has authenticated. The policy is off while both lists are
+// empty.
+
+const (
+	clientCheckTag       = "tag"
+	clientCheckUserAgent = "user_agent"
+	clientCheckOrigin    = "origin"
+)
+
+var clientChecks = []string{clientCheckTag, clientCheckUserAgent, clientCheckOrigin}
+
+func (config *Config) hasClientPolicy() bool {
+	return len(config.Clients.Allow) > 0 || len(config.Clients.Deny) > 0
+}
+
+func (config *Config) checksClient(check string) bool {
+	return len(config.Clients.Check) == 0 || slices.Contains(config.Clients.Check, check)
+}
+
+// checksHeaders reports whether the policy looks at connections at all, and
+// not just at events.
+func (config *Config) checksHeaders() bool {
+	return config.checksClient(clientCheckUserAgent) || config.checksClient(clientCheckOrigin)
+}
+
+// clientNames returns what identifies the client: the client tag of event,
+// if there is one, and the headers of r, if there is one.
+func (config *Config) clientNames(event *nostr.Event, r *http.Request) []string {
+	var names []string
+
+	if event != nil && config.checksClient(clientCheckTag) {
+		if tag := event.Tags.Find("client"); tag != nil {
+			names = append(names, tag[1])
+		}
+	}
+
+	if r != nil {
+		if ua := r.Header.Get("User-Agent"); ua != "" && config.checksClient(clientCheckUserAgent) {
+			names = append(names, ua)
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && config.checksClient(clientCheckOrigin) {
+			names = append(names, origin)
+		}
+	}
+
+	return names
+}
+
+// clientAllowed reports whether a client known by names passes the allow and
+// deny lists.
+func (config *Config) clientAllowed(names []string) bool {
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			for _, name := range names {
+				if strings.Contains(strings.ToLower(name), strings.ToLower(pattern)) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if matches(config.Clients.Deny) {
+		return false
+	}
+
+	return len(config.Clients.Allow) == 0 || matches(config.Clients.Allow)
+}
+
+// checkClient applies the client policy to an event (or, with event nil, a
+// REQ) from pubkey.
+func (instance *Instance) checkClient(ctx context.Context, pubkey nostr.PubKey, event *nostr.Event) (reject bool, msg string) {
+	if !instance.Config.hasClientPolicy() || instance.Config.CanManage(pubkey) {
+		return false, ""
+	}
+
+	if event == nil && !instance.Config.checksHeaders() {
+		return false, ""
+	}
+
+	var r *http.Request
+	if ws := khatru.GetConnection(ctx); ws != nil {
+		r = ws.Request
+	}
+
+	names := instance.Config.clientNames(event, r)
+	if instance.Config.clientAllowed(names) {
+		return false, ""
+	}
+
+	log.Printf("Refused client %q of %s", names, pubkey.Hex())
+	return RejectBlocked.Reject("client not allowed")
+}
+
+// refuseClient refuses a websocket upgrade whose headers don't pass the
+// client policy, if clients.refuse_connections is set.
+func (instance *Instance) refuseClient(w http.ResponseWriter, r *http.Request) bool {
+	if !instance.Config.hasClientPolicy() || !instance.Config.Clients.RefuseConnections || !instance.Config.checksHeaders() {
+		return false
+	}
+
+	names := instance.Config.clientNames(nil, r)
+	if instance.Config.clientAllowed(names) {
+		return false
+	}
+
+	log.Printf("Refused connection from client %q at %s", names, khatru.GetIPFromRequest(r))
+	http.Error(w, RejectBlocked.Reason("client not allowed"), http.StatusForbidden)
+	return true
+}
@@ -0,0 +1,119 @@
+package zooid
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+func TestClientAllowed(t *testing.T) {
+	config := &Config{}
+	config.Clients.Allow = []string{"sphere"}
+	config.Clients.Deny = []string{"sphere-bot"}
+
+	for _, c := range []struct {
+		names []string
+		want  bool
+	}{
+		{[]string{"Sphere"}, true},
+		{[]string{"Mozilla/5.0", "https://sphere.unicity.network"}, true},
+		{[]string{"Sphere-Bot/2"}, false},
+		{[]string{"noStrudel"}, false},
+		{nil, false},
+	} {
+		if got := config.clientAllowed(c.names); got != c.want {
+			t.Errorf("clientAllowed(%q) = %v, want %v", c.names, got, c.want)
+		}
+	}
+
+	config.Clients.Allow = nil
+	if !config.clientAllowed(nil) {
+		t.Error("with only a deny list, clients that don't say who they are should be allowed")
+	}
+}
+
+func TestClientPolicy_Tag(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+	instance.Config.Clients.Allow = []string{"sphere"}
+	instance.Config.Clients.Check = []string{"tag"}
+
+	author := nostr.Generate()
+	ctx := authedContext(author.Public())
+	note := func(tags nostr.Tags) nostr.Event {
+		return signedBy(author, nostr.Event{Kind: nostr.KindTextNote, Tags: tags})
+	}
+
+	if reject, msg := instance.OnEvent(ctx, note(nostr.Tags{{"client", "Sphere Web"}})); reject {
+		t.Errorf("allowed client refused: %s", msg)
+	}
+
+	for name, event := range map[string]nostr.Event{
+		"other client": note(nostr.Tags{{"client", "noStrudel"}}),
+		"no client":    note(nil),
+	} {
+		reject, msg := instance.OnEvent(ctx, event)
+		if !reject {
+			t.Errorf("%s: allowed", name)
+			continue
+		}
+		if msg != "blocked: client not allowed" {
+			t.Errorf("%s: message %q", name, msg)
+		}
+	}
+
+	// Only events carry tags, so REQs aren't checked
+	if reject, msg := instance.OnRequest(ctx, nostr.Filter{}); reject {
+		t.Errorf("REQ refused by a tag-only policy: %s", msg)
+	}
+
+	// Admins bypass the policy
+	owner := instance.Config.secret
+	if reject, msg := instance.OnEvent(authedContext(owner.Public()), signedBy(owner, nostr.Event{Kind: nostr.KindTextNote})); reject {
+		t.Errorf("admin refused: %s", msg)
+	}
+}
+
+func TestClientPolicy_Headers(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+	instance.Config.Clients.Deny = []string{"bot"}
+	instance.Config.Clients.Check = []string{"user_agent", "origin"}
+
+	pubkey := nostr.Generate().Public()
+	connect := func(userAgent string) context.Context {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("User-Agent", userAgent)
+		return context.WithValue(context.Background(), 0, &khatru.WebSocket{Request: r, AuthedPublicKeys: []nostr.PubKey{pubkey}})
+	}
+
+	if reject, msg := instance.OnRequest(connect("Sphere/1.0"), nostr.Filter{}); reject {
+		t.Errorf("allowed client refused: %s", msg)
+	}
+	reject, msg := instance.OnRequest(connect("HammerBot/0.1"), nostr.Filter{})
+	if !reject {
+		t.Fatal("denied client allowed to subscribe")
+	}
+	assertPrefix(t, "denied client", msg, RejectBlocked)
+
+	// Upgrades are only refused when asked to
+	upgrade := httptest.NewRequest("GET", "/", nil)
+	upgrade.Header.Set("Upgrade", "websocket")
+	upgrade.Header.Set("User-Agent", "HammerBot/0.1")
+
+	if instance.refuseClient(httptest.NewRecorder(), upgrade) {
+		t.Error("upgrade refused without refuse_connections")
+	}
+
+	instance.Config.Clients.RefuseConnections = true
+	w := httptest.NewRecorder()
+	if !instance.refuseClient(w, upgrade) {
+		t.Fatal("denied client allowed to connect")
+	}
+	if w.Code != 403 {
+		t.Errorf("status %d, want 403", w.Code)
+	}
+}
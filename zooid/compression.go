@@ -0,0 +1,205 @@
+package zooid
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content compression.
+//
+// Long-form articles and the like dominate the events table, and TOAST only
+// compresses what doesn't fit in a page. With storage.compress_above set,
+// contents longer than that many bytes are stored zstd-compressed in
+// content_zstd, with content left empty and the compressed flag set, and
+// are decompressed as rows are read. The search trigger can't read them, so
+// search_vector for a compressed row is written along with it, from the
+// uncompressed text, and the trigger leaves it alone.
+//
+// Only new events are compressed. CompressEvents, run through the
+// compressevents management method, compresses the ones already stored.
+
+const compressBatchSize = 500
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func compressContent(content string) []byte {
+	return zstdEncoder.EncodeAll([]byte(content), nil)
+}
+
+func decompressContent(data []byte) (string, error) {
+	content, err := zstdDecoder.DecodeAll(data, nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid compressed content: %w", err)
+	}
+
+	return string(content), nil
+}
+
+// compresses reports whether content should be stored compressed.
+func (events *EventStore) compresses(content string) bool {
+	threshold := events.Config.GetCompressAbove()
+	return threshold > 0 && len(content) > threshold && !usesSQLite() && !usesMemory()
+}
+
+// compressedColumns returns the columns and values that store content
+// compressed, search_vector included.
+func (events *EventStore) compressedColumns(content string, tagsJSON string) ([]string, []any) {
+	return []string{"content", "content_zstd", "compressed", "search_vector"}, []any{
+		"",
+		compressContent(content),
+		true,
+		squirrel.Expr(events.searchVector("?::text", "?::text"), content, tagsJSON),
+	}
+}
+
+// CompressEvents compresses the stored events whose content is over
+// storage.compress_above, in id order and in batches, and returns how many
+// it compressed.
+func (events *EventStore) CompressEvents(ctx context.Context) (int, error) {
+	threshold := events.Config.GetCompressAbove()
+	if threshold <= 0 {
+		return 0, fmt.Errorf("storage.compress_above is not set")
+	}
+	if usesSQLite() || usesMemory() {
+		return 0, fmt.Errorf("compression needs PostgreSQL")
+	}
+
+	stmt := events.Schema.Render(`
+		SELECT id, content, tags FROM {{.Prefix "events"}}
+		WHERE id > $1 AND NOT compressed AND octet_length(content) > $2
+		ORDER BY id LIMIT $3`)
+
+	total := 0
+	cursor := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+
+		n, last, err := events.compressBatch(ctx, stmt, cursor, threshold)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if last == "" {
+			break
+		}
+		cursor = last
+	}
+
+	if total > 0 {
+		log.Printf("Compressed %d events in schema %s", total, events.Schema.Name)
+	}
+
+	return total, nil
+}
+
+// compressBatch compresses the next batch after cursor, returning how many
+// it compressed and the last id it looked at, or "" when there are none
+// left.
+func (events *EventStore) compressBatch(ctx context.Context, stmt string, cursor string, threshold int) (int, string, error) {
+	subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
+	defer cancel()
+
+	type pending struct{ id, content, tags string }
+
+	rows, err := GetDb().QueryContext(subctx, stmt, cursor, threshold, compressBatchSize)
+	if err != nil {
+		return 0, "", fmt.Errorf("compress batch: %w", err)
+	}
+
+	var batch []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.content, &p.tags); err != nil {
+			rows.Close()
+			return 0, "", err
+		}
+		batch = append(batch, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, "", err
+	}
+
+	n := 0
+	last := ""
+	for _, p := range batch {
+		columns, values := events.compressedColumns(p.content, p.tags)
+
+		update := sb.Update(events.Schema.Prefix("events")).
+			Where("id = ? AND NOT compressed", p.id)
+		for i, column := range columns {
+			update = update.Set(column, values[i])
+		}
+
+		if _, err := update.RunWith(GetDb()).ExecContext(subctx); err != nil {
+			return n, last, fmt.Errorf("compressing event %s: %w", p.id, err)
+		}
+		n++
+		last = p.id
+	}
+
+	return n, last, nil
+}
+
+// indexCompressed writes search_vector for compressed events, which the
+// search trigger can't read.
+func (events *EventStore) indexCompressed(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	rows, err := sb.Select("id", "tags", "content_zstd").
+		From(events.Schema.Prefix("events")).
+		Where(squirrel.Eq{"id": ids}).
+		RunWith(GetDb()).
+		QueryContext(ctx)
+	if err != nil {
+		return fmt.Errorf("reading compressed events: %w", err)
+	}
+
+	type compressed struct {
+		id, tags string
+		data     []byte
+	}
+	var found []compressed
+	for rows.Next() {
+		var c compressed
+		if err := rows.Scan(&c.id, &c.tags, &c.data); err != nil {
+			rows.Close()
+			return err
+		}
+		found = append(found, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range found {
+		content, err := decompressContent(c.data)
+		if err != nil {
+			log.Printf("Can't index compressed event %s: %v", c.id, err)
+			continue
+		}
+
+		_, err = sb.Update(events.Schema.Prefix("events")).
+			Set("search_vector", squirrel.Expr(events.searchVector("?::text", "?::text"), content, c.tags)).
+			Where("id = ?", c.id).
+			RunWith(GetDb()).
+			ExecContext(ctx)
+		if err != nil {
+			return fmt.Errorf("indexing compressed event %s: %w", c.id, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package zooid
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+// article is long-form prose of about size bytes, drawn from a small
+// vocabulary so it compresses roughly like real text.
+func article(size int) string {
+	words := strings.Fields(`the relay stores events from clients and serves them back to anyone
+		who asks with a filter groups keep their members in memory while long articles
+		about bitcoin nostr privacy and protocol design take most of the space`)
+	rng := rand.New(rand.NewSource(1))
+
+	var b strings.Builder
+	for b.Len() < size {
+		b.WriteString(words[rng.Intn(len(words))])
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+func TestEventRow_Compressed(t *testing.T) {
+	event := createTestEvent(nostr.KindArticle, article(5000))
+	row := eventRow{
+		id:     event.ID.Hex(),
+		pubkey: event.PubKey.Hex(),
+		tags:   "[]",
+		sig:    fmt.Sprintf("%x", event.Sig[:]),
+		kind:   int(event.Kind),
+		zstd:   compressContent(event.Content),
+	}
+	if len(row.zstd) >= len(event.Content) {
+		t.Errorf("compressed to %d bytes from %d", len(row.zstd), len(event.Content))
+	}
+
+	parsed, err := row.event()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Content != event.Content {
+		t.Error("content changed on its way through compression")
+	}
+
+	row.zstd = []byte("not zstd")
+	if _, err := row.event(); err == nil {
+		t.Error("garbled compressed content should fail to parse")
+	}
+}
+
+func TestSaveEvent_Compressed(t *testing.T) {
+	skipOnSQLite(t, "compression")
+	skipOnMemory(t, "compression")
+	store := createTestEventStore()
+	store.Config.Storage.CompressAbove = 1000
+	store.Init()
+
+	stored := func(event nostr.Event) (compressed bool, content string) {
+		query := fmt.Sprintf("SELECT compressed, content FROM %s WHERE id = $1", store.Schema.Prefix("events"))
+		if err := GetDb().QueryRow(query, event.ID.Hex()).Scan(&compressed, &content); err != nil {
+			t.Fatal(err)
+		}
+		return compressed, content
+	}
+	roundTrips := func(event nostr.Event, search string) {
+		t.Helper()
+		for found := range store.QueryEvents(nostr.Filter{IDs: []nostr.ID{event.ID}}, 1) {
+			if found.Content != event.Content || !found.CheckID() {
+				t.Error("event read back differently")
+			}
+		}
+		for found := range store.QueryEvents(nostr.Filter{Search: search}, 0) {
+			if found.ID == event.ID {
+				return
+			}
+		}
+		t.Errorf("search for %q didn't find the event", search)
+	}
+
+	long := createTestEvent(nostr.KindArticle, article(5000)+" zebra")
+	short := createTestEvent(nostr.KindTextNote, "a short note about giraffes")
+	for _, event := range []nostr.Event{long, short} {
+		if err := store.SaveEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if compressed, content := stored(long); !compressed || content != "" {
+		t.Error("long content wasn't stored compressed")
+	}
+	if compressed, _ := stored(short); compressed {
+		t.Error("short content was compressed")
+	}
+	roundTrips(long, "zebra")
+	roundTrips(short, "giraffes")
+
+	// Events stored before compression was turned on are compressed in
+	// batches, staying searchable
+	store.Config.Storage.CompressAbove = 0
+	earlier := createTestEvent(nostr.KindArticle, article(3000)+" okapi")
+	if err := store.SaveEvent(earlier); err != nil {
+		t.Fatal(err)
+	}
+	store.Config.Storage.CompressAbove = 1000
+
+	n, err := store.CompressEvents(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("compressed %d events, want only the one stored uncompressed", n)
+	}
+	if compressed, _ := stored(earlier); !compressed {
+		t.Error("stored event wasn't compressed")
+	}
+	roundTrips(earlier, "okapi")
+
+	// Rebuilding the search index reads compressed content too
+	if err := store.rebuildSearchVectors(context.Background(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	roundTrips(long, "zebra")
+}
+
+// BenchmarkCompression measures what compressing a long-form article costs
+// and saves. The ratio is reported as stored bytes per content byte.
+func BenchmarkCompression(b *testing.B) {
+	for _, size := range []int{2000, 20000, 200000} {
+		content := article(size)
+		compressed := compressContent(content)
+
+		b.Run(fmt.Sprintf("compress/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(len(content)))
+			b.ReportMetric(float64(len(compressed))/float64(len(content)), "ratio")
+			for i := 0; i < b.N; i++ {
+				compressContent(content)
+			}
+		})
+		b.Run(fmt.Sprintf("decompress/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(len(content)))
+			for i := 0; i < b.N; i++ {
+				if _, err := decompressContent(compressed); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
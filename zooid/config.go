@@ -1,14 +1,20 @@
 package zooid
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"math"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"fiatjaf.com/nostr"
@@ -21,33 +27,78 @@ type Role struct {
 	CanManage bool     `toml:"can_manage"`
 }
 
+// Info populates the relay's NIP-11 document. Pubkey is the primary owner
+// (advertised in NIP-11); Owners lists additional co-owners with the same
+// privileges. Either may be omitted. The rest are optional links for the
+// document, see relayinfo.go.
+type Info struct {
+	Name        string   `toml:"name"`
+	Icon        string   `toml:"icon"`
+	Pubkey      string   `toml:"pubkey"`
+	Owners      []string `toml:"owners,omitempty"`
+	Description string   `toml:"description"`
+
+	PostingPolicy string     `toml:"posting_policy,omitempty"` // URL of the relay's rules
+	PaymentsURL   string     `toml:"payments_url,omitempty"`   // URL where membership can be paid for
+	Links         []InfoLink `toml:"links,omitempty"`          // Community links, e.g. a website or a chat
+}
+
+// GroupOverride is a per-group policy override from [groups.overrides.<h>].
+// Unset fields fall back to the global [groups] setting; see
+// GroupStore.GroupPolicy for the merged view.
+type GroupOverride struct {
+	AutoJoin        *bool   `toml:"auto_join,omitempty"`
+	WriteRestricted *bool   `toml:"write_restricted,omitempty"`
+	MaxMembers      int     `toml:"max_members,omitempty"`      // 0 = unlimited
+	RetentionExempt bool    `toml:"retention_exempt,omitempty"` // never delete messages from this group
+	RateMultiplier  float64 `toml:"rate_multiplier,omitempty"`  // scales per-group rate limits; 0 = 1
+}
+
 type Config struct {
 	Host   string `toml:"host"`
 	Schema string `toml:"schema"`
 	Secret string `toml:"secret"`
-	Info   struct {
-		Name        string `toml:"name"`
-		Icon        string `toml:"icon"`
-		Pubkey      string `toml:"pubkey"`
-		Description string `toml:"description"`
-	} `toml:"info"`
+	Info   Info   `toml:"info"`
+
+	// AllowSharedSchema lets this instance use the same schema as one for a
+	// different host, if that one allows it too. See claimSchema.
+	AllowSharedSchema bool `toml:"allow_shared_schema"`
+
+	// SearchLanguage is the Postgres text search configuration used for
+	// NIP-50 search, e.g. "portuguese". Defaults to "english".
+	SearchLanguage string `toml:"search_language"`
 
 	Policy struct {
-		Open            bool `toml:"open"` // Allow all authenticated users (no membership required)
-		PublicJoin      bool `toml:"public_join"`
-		StripSignatures bool `toml:"strip_signatures"`
+		Open             bool `toml:"open"` // Allow all authenticated users (no membership required)
+		PublicJoin       bool `toml:"public_join"`
+		StripSignatures  bool `toml:"strip_signatures"`
+		ReadOnly         bool `toml:"read_only"`         // Serve reads but refuse all writes (maintenance mode)
+		DefaultLimit     int  `toml:"default_limit"`     // Events returned for a REQ without a limit; 0 = 500
+		VerifySignatures bool `toml:"verify_signatures"` // Re-check signatures in the event store (khatru already checks them)
+		QueueUntilReady  bool `toml:"queue_until_ready"` // Hold REQs and EVENTs while the caches warm instead of refusing them
+
+		EphemeralPerMinute int    `toml:"ephemeral_per_minute"`  // Ephemeral events one pubkey may send per minute; 0 = 120
+		MaxAuthAge         string `toml:"max_auth_age"`          // Re-challenge connections authenticated this long ago (e.g. "12h"); empty = never
+		ReplaceInterval    string `toml:"replace_interval"`      // Least time between updates to one replaceable event (e.g. "5s"); empty = 2s, "0" = off
+		AdminOnlyReadKinds []int  `toml:"admin_only_read_kinds"` // Kinds only managers and their authors can read (e.g. 1984 reports)
+		AllowSelfPurge     bool   `toml:"allow_self_purge"`      // Let users leave and have their events deleted, see purge.go
 	} `toml:"policy"`
 
 	Groups struct {
-		Enabled                 bool `toml:"enabled"`
-		AutoJoin                bool `toml:"auto_join"`
-		AdminCreateOnly         bool `toml:"admin_create_only"`          // Only admins can create groups
-		PrivateAdminOnly        bool `toml:"private_admin_only"`         // Only admins can create private groups
-		PrivateRelayAdminAccess bool `toml:"private_relay_admin_access"` // Relay admins can see and moderate private groups
+		Enabled                 bool     `toml:"enabled"`
+		AutoJoin                bool     `toml:"auto_join"`
+		AdminCreateOnly         bool     `toml:"admin_create_only"`          // Only admins can create groups
+		PrivateAdminOnly        bool     `toml:"private_admin_only"`         // Only admins can create private groups
+		PrivateRelayAdminAccess bool     `toml:"private_relay_admin_access"` // Relay admins can see and moderate private groups
+		AdminsExceedMaxMembers  bool     `toml:"admins_exceed_max_members"`  // Admin adds (kind 9000) ignore max_members
+		TrustedSigners          []string `toml:"trusted_signers"`            // Pubkeys whose put/remove user and edit metadata events are mirrored
+		PresenceNotices         bool     `toml:"presence_notices"`           // Broadcast an ephemeral notice when someone joins or leaves a group
+		MaxMemberTags           int      `toml:"max_member_tags"`            // p tags allowed on one put/remove user event; 0 = 50
 		Retention               struct {
 			Default string            `toml:"default"` // Default retention duration (e.g. "7d", "24h"); empty = unlimited
 			Groups  map[string]string `toml:"groups"`  // Per-group retention overrides keyed by group ID
 		} `toml:"retention"`
+		Overrides map[string]GroupOverride `toml:"overrides"` // Per-group policy overrides keyed by group ID
 	} `toml:"groups"`
 
 	Management struct {
@@ -59,11 +110,101 @@ type Config struct {
 		Enabled bool `toml:"enabled"`
 	} `toml:"blossom"`
 
+	Reconcile struct {
+		Interval string `toml:"interval"` // How often to check caches against the database (e.g. "1h"); empty = never
+		Sample   int    `toml:"sample"`   // Groups and relay members checked per run; 0 = all
+		Repair   bool   `toml:"repair"`   // Overwrite drifted cache entries with the stored state
+	} `toml:"reconcile"`
+
+	Limits struct {
+		MaxMessageSize    int64  `toml:"max_message_size"`     // Largest message a client may send, in bytes; 0 = 512000
+		MaxResults        int    `toml:"max_results"`          // Stored events sent per subscription before EOSE; 0 = 1000
+		SendQueueBytes    int    `toml:"send_queue_bytes"`     // Bytes queued for one connection before it's dropped; 0 = 4 MiB
+		WriteTimeout      string `toml:"write_timeout"`        // How long one write may block before the connection is dropped; empty = 10s
+		BroadcastDedup    int    `toml:"broadcast_dedup"`      // Recent event ids remembered per connection so it gets each live event once; 0 = 256, negative = off
+		MaxEventTags      int    `toml:"max_event_tags"`       // Most tags an event may have, contact lists aside; 0 = 2000
+		MaxTagValueLength int    `toml:"max_tag_value_length"` // Longest tag element, in bytes; 0 = 4096
+	} `toml:"limits"`
+
+	Clients struct {
+		Allow             []string `toml:"allow"`              // Only these clients may publish or subscribe; empty = any not denied
+		Deny              []string `toml:"deny"`               // These clients may not publish or subscribe
+		Check             []string `toml:"check"`              // What to match: "tag", "user_agent" and/or "origin"; empty = all three
+		RefuseConnections bool     `toml:"refuse_connections"` // Also refuse the websocket upgrade when the headers don't pass
+	} `toml:"clients"`
+
+	Spam struct {
+		Duplicates int    `toml:"duplicates"` // Refuse content posted more than this often across groups by non-members; 0 = off
+		Window     string `toml:"window"`     // How far back duplicates are counted (e.g. "10m"); empty = 10m
+		Shadow     bool   `toml:"shadow"`     // Accept spam with an OK but don't store it, rather than refusing it
+	} `toml:"spam"`
+
+	Storage struct {
+		CompressAbove   int  `toml:"compress_above"`    // Store contents longer than this many bytes zstd-compressed; 0 = never
+		NativeSchema    bool `toml:"native_schema"`     // Keep the tables in a Postgres schema of their own instead of prefixing their names
+		DBMaxConcurrent int  `toml:"db_max_concurrent"` // Event queries and writes run at once, out of the shared pool; 0 = unlimited
+
+		SoftDelete       bool   `toml:"soft_delete"`        // Mark deleted events deleted instead of removing them, so they can be restored
+		SoftDeleteWindow string `toml:"soft_delete_window"` // How long deleted events can be restored before they're purged (e.g. "7d"); empty = 7d
+	} `toml:"storage"`
+
+	DMs struct {
+		InboxQuota int    `toml:"inbox_quota"` // Gift wraps kept for a recipient who isn't a member, under the open policy; 0 = 1000
+		MaxAge     string `toml:"max_age"`     // Delete gift wraps older than this (e.g. "30d"); empty = keep them
+	} `toml:"dms"`
+
+	Negentropy struct {
+		AdminsOnly bool   `toml:"admins_only"` // Refuse negentropy sync to anyone who can't manage the relay
+		Window     string `toml:"window"`      // Only reconcile events this recent (e.g. "30d"); empty = all
+	} `toml:"negentropy"`
+
+	Push struct {
+		URL       string `toml:"url"`        // Where to POST batches of group mentions; empty = no push
+		Interval  string `toml:"interval"`   // How often batches are sent (e.g. "5s"); empty = 5s
+		PerMinute int    `toml:"per_minute"` // Notifications per recipient per minute; 0 = 10
+	} `toml:"push"`
+
+	Transforms struct {
+		StripTags []string `toml:"strip_tags"` // Tags removed from the relay's own events and refused on others
+	} `toml:"transforms"`
+
+	Payments struct {
+		Price   int64  `toml:"price"`   // Sats a membership costs; 0 = memberships aren't sold
+		Period  string `toml:"period"`  // How long a paid membership lasts (e.g. "30d"); empty = 30d
+		Backend string `toml:"backend"` // Where payments are checked: "lnbits" or "lnd"; empty = only by an embedder's verifier
+		URL     string `toml:"url"`     // The LNbits or LND REST endpoint
+		Key     string `toml:"key"`     // The LNbits invoice key, or the hex LND invoice macaroon
+	} `toml:"payments"`
+
+	NIP05 struct {
+		Enabled  bool     `toml:"enabled"`  // Serve /.well-known/nostr.json and let members claim names
+		Reserved []string `toml:"reserved"` // Names only managers can give out, besides the built-in ones like admin and _
+	} `toml:"nip05"`
+
+	Metrics struct {
+		TopGroups   int  `toml:"top_groups"`   // Most active groups given per-group activity metrics; 0 = 20
+		HashPrivate bool `toml:"hash_private"` // Include private and hidden groups, labelled by a hash of their id
+	} `toml:"metrics"`
+
+	Stats struct {
+		Interval string   `toml:"interval"` // How often the relay publishes its stats event (e.g. "15m"); empty = never
+		Fields   []string `toml:"fields"`   // What it includes: "members", "groups", "events_24h" and/or "version"; empty = all
+	} `toml:"stats"`
+
 	Roles map[string]Role `toml:"roles"`
 
 	// Private/parsed values
 	path   string
 	secret nostr.SecretKey
+
+	// trustedSigners is Groups.TrustedSigners parsed, so keys compare
+	// whatever case they were written in.
+	trustedSigners []nostr.PubKey
+
+	// readOnly is the runtime override of Policy.ReadOnly set via the
+	// setreadonly management method. nil means "use the config value". It
+	// isn't saved, so a config reload falls back to Policy.ReadOnly.
+	readOnly atomic.Pointer[bool]
 }
 
 func LoadConfig(filename string) (*Config, error) {
@@ -74,22 +215,22 @@ func LoadConfig(filename string) (*Config, error) {
 		return nil, fmt.Errorf("Failed to parse config file %s: %w", path, err)
 	}
 
-	if config.Host == "" {
-		return nil, fmt.Errorf("host is required")
-	}
-
-	if config.Schema == "" {
-		return nil, fmt.Errorf("schema is required")
+	if err := config.Validate(); err != nil {
+		return nil, &ConfigError{Path: path, Err: err}
 	}
-
-	// Validate retention config early so operators get immediate feedback
-	if err := config.validateRetention(); err != nil {
-		return nil, fmt.Errorf("invalid retention config in %s: %w", path, err)
+	for _, warning := range config.validateFlags() {
+		log.Printf("Warning: %s: %s", path, warning)
 	}
 
 	secret, err := nostr.SecretKeyFromHex(config.Secret)
 	if err != nil {
-		return nil, err
+		return nil, &ConfigError{Path: path, Err: fmt.Errorf("secret: %w", err)}
+	}
+
+	// Validate has checked these parse
+	for _, hex := range config.Groups.TrustedSigners {
+		pubkey, _ := nostr.PubKeyFromHex(hex)
+		config.trustedSigners = append(config.trustedSigners, pubkey)
 	}
 
 	// Save the path for later
@@ -102,6 +243,353 @@ func LoadConfig(filename string) (*Config, error) {
 	return &config, nil
 }
 
+// sameExceptOverrides reports whether a and b are the same config, but for
+// their [groups.overrides]. LoadConfig clears the secret that would be
+// written out, so it's compared on its own.
+func sameExceptOverrides(a, b *Config) bool {
+	asTOML := func(config *Config) (map[string]any, error) {
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(config); err != nil {
+			return nil, err
+		}
+
+		var m map[string]any
+		if _, err := toml.Decode(buf.String(), &m); err != nil {
+			return nil, err
+		}
+		if groups, ok := m["groups"].(map[string]any); ok {
+			delete(groups, "overrides")
+		}
+		return m, nil
+	}
+
+	am, err := asTOML(a)
+	if err != nil {
+		return false
+	}
+	bm, err := asTOML(b)
+	if err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(am, bm) && a.secret == b.secret
+}
+
+// ConfigError wraps every problem found while loading a config file. Err is
+// usually an errors.Join of individual problems; Problems splits it back out
+// so callers can log one line per problem.
+type ConfigError struct {
+	Path string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid config %s: %s", e.Path, strings.Join(e.problemStrings(), "; "))
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ConfigError) Problems() []error {
+	if joined, ok := e.Err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{e.Err}
+}
+
+func (e *ConfigError) problemStrings() []string {
+	problems := e.Problems()
+	strs := make([]string, len(problems))
+	for i, problem := range problems {
+		strs[i] = problem.Error()
+	}
+	return strs
+}
+
+// hostnamePattern matches a DNS hostname (or IPv4 address) with an optional
+// port, e.g. "relay.example.com", "localhost:3334".
+var hostnamePattern = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*(:[0-9]{1,5})?$`)
+
+// searchLanguagePattern matches a Postgres text search configuration name.
+// The name is interpolated into the search trigger, so nothing else is allowed.
+var searchLanguagePattern = regexp.MustCompile(`^[a-z_]+$`)
+
+// Validate checks the whole config and returns every problem at once (joined
+// with errors.Join), so an operator can fix a file in one pass instead of
+// reloading once per typo. A nil return means the config is safe to load.
+func (config *Config) Validate() error {
+	var errs []error
+
+	if config.Host == "" {
+		errs = append(errs, fmt.Errorf("host is required"))
+	} else if len(config.Host) > 253 || !hostnamePattern.MatchString(config.Host) {
+		errs = append(errs, fmt.Errorf("host %q is not a valid hostname", config.Host))
+	}
+
+	if config.Schema == "" {
+		errs = append(errs, fmt.Errorf("schema is required"))
+	} else if name := SchemaName(config.Schema); name == "" {
+		errs = append(errs, fmt.Errorf("schema %q has no usable characters (use letters, digits and underscores)", config.Schema))
+	} else if !schemaNamePattern.MatchString(name) {
+		errs = append(errs, fmt.Errorf("schema %q becomes %q, which isn't a valid schema name (start with a letter, use at most 41 letters, digits and underscores)", config.Schema, name))
+	} else if config.Storage.NativeSchema && strings.HasPrefix(name, "pg_") {
+		errs = append(errs, fmt.Errorf("schema %q can't be a native schema, Postgres reserves names starting with pg_", config.Schema))
+	}
+
+	if config.SearchLanguage != "" && !searchLanguagePattern.MatchString(config.SearchLanguage) {
+		errs = append(errs, fmt.Errorf("search_language %q is not a valid text search configuration name", config.SearchLanguage))
+	}
+
+	if config.Info.Pubkey != "" {
+		if _, err := nostr.PubKeyFromHex(config.Info.Pubkey); err != nil {
+			errs = append(errs, fmt.Errorf("info.pubkey %q: %w", config.Info.Pubkey, err))
+		}
+	}
+
+	for i, hex := range config.Info.Owners {
+		if _, err := nostr.PubKeyFromHex(hex); err != nil {
+			errs = append(errs, fmt.Errorf("info.owners[%d] %q: %w", i, hex, err))
+		}
+	}
+
+	if config.Info.PostingPolicy != "" && !isHTTPURL(config.Info.PostingPolicy) {
+		errs = append(errs, fmt.Errorf("info.posting_policy %q is not an http(s) url", config.Info.PostingPolicy))
+	}
+	if config.Info.PaymentsURL != "" && !isHTTPURL(config.Info.PaymentsURL) {
+		errs = append(errs, fmt.Errorf("info.payments_url %q is not an http(s) url", config.Info.PaymentsURL))
+	}
+	for i, link := range config.Info.Links {
+		if link.Name == "" {
+			errs = append(errs, fmt.Errorf("info.links[%d] needs a name", i))
+		}
+		if !isHTTPURL(link.URL) {
+			errs = append(errs, fmt.Errorf("info.links[%d].url %q is not an http(s) url", i, link.URL))
+		}
+	}
+
+	// Sort role names so the problem list is stable across reloads.
+	roleNames := Keys(config.Roles)
+	slices.Sort(roleNames)
+	for _, name := range roleNames {
+		for i, hex := range config.Roles[name].Pubkeys {
+			if _, err := nostr.PubKeyFromHex(hex); err != nil {
+				errs = append(errs, fmt.Errorf("roles.%s.pubkeys[%d] %q: %w", name, i, hex, err))
+			}
+		}
+	}
+
+	for i, hex := range config.Groups.TrustedSigners {
+		if _, err := nostr.PubKeyFromHex(hex); err != nil {
+			errs = append(errs, fmt.Errorf("groups.trusted_signers[%d] %q: %w", i, hex, err))
+		}
+	}
+
+	if config.Groups.MaxMemberTags < 0 {
+		errs = append(errs, fmt.Errorf("groups.max_member_tags must not be negative"))
+	}
+
+	if config.Policy.DefaultLimit < 0 {
+		errs = append(errs, fmt.Errorf("policy.default_limit must not be negative"))
+	}
+
+	if config.Policy.EphemeralPerMinute < 0 {
+		errs = append(errs, fmt.Errorf("policy.ephemeral_per_minute must not be negative"))
+	}
+	for i, kind := range config.Policy.AdminOnlyReadKinds {
+		if kind < 0 || kind > 65535 {
+			errs = append(errs, fmt.Errorf("policy.admin_only_read_kinds[%d] %d is not a valid kind", i, kind))
+		}
+	}
+	if config.Policy.ReplaceInterval != "" && strings.TrimSpace(config.Policy.ReplaceInterval) != "0" {
+		if _, err := ParseRetentionDuration(config.Policy.ReplaceInterval); err != nil {
+			errs = append(errs, fmt.Errorf("policy.replace_interval: %w", err))
+		}
+	}
+	if config.Policy.MaxAuthAge != "" {
+		if _, err := ParseRetentionDuration(config.Policy.MaxAuthAge); err != nil {
+			errs = append(errs, fmt.Errorf("policy.max_auth_age: %w", err))
+		}
+	}
+
+	if err := config.validateRetention(); err != nil {
+		errs = append(errs, fmt.Errorf("groups.retention: %w", err))
+	}
+
+	if config.Reconcile.Interval != "" {
+		if _, err := ParseRetentionDuration(config.Reconcile.Interval); err != nil {
+			errs = append(errs, fmt.Errorf("reconcile.interval: %w", err))
+		}
+	}
+	if config.Reconcile.Sample < 0 {
+		errs = append(errs, fmt.Errorf("reconcile.sample must not be negative"))
+	}
+
+	if config.Limits.MaxMessageSize < 0 {
+		errs = append(errs, fmt.Errorf("limits.max_message_size must not be negative"))
+	}
+	if config.Limits.MaxResults < 0 {
+		errs = append(errs, fmt.Errorf("limits.max_results must not be negative"))
+	}
+	if config.Limits.MaxEventTags < 0 {
+		errs = append(errs, fmt.Errorf("limits.max_event_tags must not be negative"))
+	}
+	if config.Limits.MaxTagValueLength < 0 {
+		errs = append(errs, fmt.Errorf("limits.max_tag_value_length must not be negative"))
+	}
+	if config.Storage.CompressAbove < 0 {
+		errs = append(errs, fmt.Errorf("storage.compress_above must not be negative"))
+	}
+	if config.Storage.DBMaxConcurrent < 0 {
+		errs = append(errs, fmt.Errorf("storage.db_max_concurrent must not be negative"))
+	}
+	if config.Storage.SoftDeleteWindow != "" {
+		if _, err := ParseRetentionDuration(config.Storage.SoftDeleteWindow); err != nil {
+			errs = append(errs, fmt.Errorf("storage.soft_delete_window: %w", err))
+		}
+	}
+	if config.Limits.SendQueueBytes < 0 {
+		errs = append(errs, fmt.Errorf("limits.send_queue_bytes must not be negative"))
+	}
+	if config.Limits.WriteTimeout != "" {
+		if _, err := ParseRetentionDuration(config.Limits.WriteTimeout); err != nil {
+			errs = append(errs, fmt.Errorf("limits.write_timeout: %w", err))
+		}
+	}
+
+	for _, check := range config.Clients.Check {
+		if !slices.Contains(clientChecks, check) {
+			errs = append(errs, fmt.Errorf("clients.check: unknown %q, want one of %v", check, clientChecks))
+		}
+	}
+
+	if config.Spam.Duplicates < 0 {
+		errs = append(errs, fmt.Errorf("spam.duplicates must not be negative"))
+	}
+	if config.Spam.Window != "" {
+		if _, err := ParseRetentionDuration(config.Spam.Window); err != nil {
+			errs = append(errs, fmt.Errorf("spam.window: %w", err))
+		}
+	}
+
+	if config.DMs.InboxQuota < 0 {
+		errs = append(errs, fmt.Errorf("dms.inbox_quota must not be negative"))
+	}
+	if config.DMs.MaxAge != "" {
+		if _, err := ParseRetentionDuration(config.DMs.MaxAge); err != nil {
+			errs = append(errs, fmt.Errorf("dms.max_age: %w", err))
+		}
+	}
+
+	if config.Negentropy.Window != "" {
+		if _, err := ParseRetentionDuration(config.Negentropy.Window); err != nil {
+			errs = append(errs, fmt.Errorf("negentropy.window: %w", err))
+		}
+	}
+
+	if config.Push.URL != "" && !isHTTPURL(config.Push.URL) {
+		errs = append(errs, fmt.Errorf("push.url %q is not an http(s) url", config.Push.URL))
+	}
+	if config.Push.Interval != "" {
+		if _, err := ParseRetentionDuration(config.Push.Interval); err != nil {
+			errs = append(errs, fmt.Errorf("push.interval: %w", err))
+		}
+	}
+	if config.Push.PerMinute < 0 {
+		errs = append(errs, fmt.Errorf("push.per_minute must not be negative"))
+	}
+	for i, name := range config.Transforms.StripTags {
+		if name == "" {
+			errs = append(errs, fmt.Errorf("transforms.strip_tags[%d] is empty", i))
+		}
+	}
+	if config.Payments.Price < 0 {
+		errs = append(errs, fmt.Errorf("payments.price must not be negative"))
+	}
+	if config.Payments.Period != "" {
+		if _, err := ParseRetentionDuration(config.Payments.Period); err != nil {
+			errs = append(errs, fmt.Errorf("payments.period: %w", err))
+		}
+	}
+	switch config.Payments.Backend {
+	case "":
+	case "lnbits", "lnd":
+		if !isHTTPURL(config.Payments.URL) {
+			errs = append(errs, fmt.Errorf("payments.url must be an http(s) URL, got %q", config.Payments.URL))
+		}
+		if config.Payments.Key == "" {
+			errs = append(errs, fmt.Errorf("payments.key is required with payments.backend %q", config.Payments.Backend))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("payments.backend must be \"lnbits\" or \"lnd\", got %q", config.Payments.Backend))
+	}
+	if config.Metrics.TopGroups < 0 {
+		errs = append(errs, fmt.Errorf("metrics.top_groups must not be negative"))
+	}
+	if config.Stats.Interval != "" {
+		if _, err := ParseRetentionDuration(config.Stats.Interval); err != nil {
+			errs = append(errs, fmt.Errorf("stats.interval: %w", err))
+		}
+	}
+	for _, field := range config.Stats.Fields {
+		if !slices.Contains(statsFields, field) {
+			errs = append(errs, fmt.Errorf("stats.fields: unknown %q, want one of %v", field, statsFields))
+		}
+	}
+	for i, name := range config.NIP05.Reserved {
+		if _, err := normalizeNIP05Name(name); err != nil {
+			errs = append(errs, fmt.Errorf("nip05.reserved[%d]: %w", i, err))
+		}
+	}
+
+	groupIDs := Keys(config.Groups.Overrides)
+	slices.Sort(groupIDs)
+	for _, h := range groupIDs {
+		override := config.Groups.Overrides[h]
+		if override.MaxMembers < 0 {
+			errs = append(errs, fmt.Errorf("groups.overrides.%s.max_members must not be negative", h))
+		}
+		if override.RateMultiplier < 0 {
+			errs = append(errs, fmt.Errorf("groups.overrides.%s.rate_multiplier must not be negative", h))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateFlags returns a warning for each option that can never take effect
+// in combination with another setting — almost always a sign the operator
+// forgot to enable the parent feature. They're harmless, so LoadConfig only
+// logs them.
+func (config *Config) validateFlags() []string {
+	var warnings []string
+
+	if !config.Groups.Enabled {
+		groupFlags := []struct {
+			name string
+			set  bool
+		}{
+			{"groups.auto_join", config.Groups.AutoJoin},
+			{"groups.admin_create_only", config.Groups.AdminCreateOnly},
+			{"groups.private_admin_only", config.Groups.PrivateAdminOnly},
+			{"groups.private_relay_admin_access", config.Groups.PrivateRelayAdminAccess},
+			{"groups.retention", config.HasRetention()},
+			{"groups.overrides", len(config.Groups.Overrides) > 0},
+		}
+		for _, flag := range groupFlags {
+			if flag.set {
+				warnings = append(warnings, fmt.Sprintf("%s has no effect unless groups.enabled = true", flag.name))
+			}
+		}
+	}
+
+	if !config.Management.Enabled && len(config.Management.Methods) > 0 {
+		warnings = append(warnings, "management.methods has no effect unless management.enabled = true")
+	}
+
+	return warnings
+}
+
 func (config *Config) Save() error {
 	// Restore the secret key to the public field for saving
 	config.Secret = config.secret.Hex()
@@ -141,6 +629,20 @@ func (config *Config) SetIcon(icon string) error {
 	return config.Save()
 }
 
+// IsReadOnly reports whether the relay is in read-only maintenance mode.
+func (config *Config) IsReadOnly() bool {
+	if readOnly := config.readOnly.Load(); readOnly != nil {
+		return *readOnly
+	}
+	return config.Policy.ReadOnly
+}
+
+// SetReadOnly flips read-only maintenance mode at runtime, overriding
+// Policy.ReadOnly until the config is reloaded.
+func (config *Config) SetReadOnly(readOnly bool) {
+	config.readOnly.Store(&readOnly)
+}
+
 func (config *Config) Sign(event *nostr.Event) error {
 	return event.Sign(config.secret)
 }
@@ -153,12 +655,45 @@ func (config *Config) IsSelf(pubkey nostr.PubKey) bool {
 	return pubkey == config.GetSelf()
 }
 
+// ownerHexes returns the configured owner pubkeys in order: info.pubkey first,
+// then info.owners.
+func (config *Config) ownerHexes() []string {
+	hexes := make([]string, 0, 1+len(config.Info.Owners))
+	if config.Info.Pubkey != "" {
+		hexes = append(hexes, config.Info.Pubkey)
+	}
+
+	return append(hexes, config.Info.Owners...)
+}
+
+// GetOwners returns all relay owners, deduplicated, with the primary owner
+// first. Entries that aren't hex are skipped; whether they're points on the
+// curve is left to Validate, which checks them at load time.
+func (config *Config) GetOwners() []nostr.PubKey {
+	owners := make([]nostr.PubKey, 0, 1+len(config.Info.Owners))
+	for _, hex := range config.ownerHexes() {
+		pubkey, err := nostr.PubKeyFromHexCheap(hex)
+		if err != nil || slices.Contains(owners, pubkey) {
+			continue
+		}
+		owners = append(owners, pubkey)
+	}
+
+	return owners
+}
+
+// GetOwner returns the primary owner, or the zero pubkey if none is configured.
 func (config *Config) GetOwner() nostr.PubKey {
-	return nostr.MustPubKeyFromHex(config.Info.Pubkey)
+	return First(config.GetOwners())
 }
 
 func (config *Config) IsOwner(pubkey nostr.PubKey) bool {
-	return pubkey == config.GetOwner()
+	return slices.Contains(config.GetOwners(), pubkey)
+}
+
+// IsTrustedSigner reports whether pubkey is listed in groups.trusted_signers.
+func (config *Config) IsTrustedSigner(pubkey nostr.PubKey) bool {
+	return slices.Contains(config.trustedSigners, pubkey)
 }
 
 func (config *Config) GetAssignedRoles(pubkey nostr.PubKey) []Role {
@@ -275,8 +810,257 @@ func (config *Config) validateRetention() error {
 	return nil
 }
 
+// GetDefaultLimit returns how many events to return for a filter without a
+// limit.
+func (config *Config) GetDefaultLimit() int {
+	if config.Policy.DefaultLimit <= 0 {
+		return 500
+	}
+
+	return config.Policy.DefaultLimit
+}
+
+// GetMaxMemberTags returns how many p tags one put or remove user event may
+// have.
+func (config *Config) GetMaxMemberTags() int {
+	if config.Groups.MaxMemberTags <= 0 {
+		return 50
+	}
+
+	return config.Groups.MaxMemberTags
+}
+
+// GetEphemeralPerMinute returns how many ephemeral events one pubkey may
+// send per minute.
+func (config *Config) GetEphemeralPerMinute() int {
+	if config.Policy.EphemeralPerMinute <= 0 {
+		return 120
+	}
+
+	return config.Policy.EphemeralPerMinute
+}
+
+// GetMaxAuthAge returns how long a connection's authentication lasts before
+// it's challenged again, or 0 for as long as the connection.
+func (config *Config) GetMaxAuthAge() time.Duration {
+	age, err := ParseRetentionDuration(config.Policy.MaxAuthAge)
+	if err != nil {
+		return 0
+	}
+
+	return age
+}
+
+// GetReplaceInterval returns the least time between accepted updates to one
+// replaceable event, 0 if they aren't limited.
+func (config *Config) GetReplaceInterval() time.Duration {
+	if strings.TrimSpace(config.Policy.ReplaceInterval) == "0" {
+		return 0
+	}
+
+	interval, err := ParseRetentionDuration(config.Policy.ReplaceInterval)
+	if err != nil || interval <= 0 {
+		return defaultReplaceInterval
+	}
+
+	return interval
+}
+
+// GetMaxMessageSize returns the largest message a client may send, in bytes.
+func (config *Config) GetMaxMessageSize() int64 {
+	if config.Limits.MaxMessageSize <= 0 {
+		return defaultMaxMessageSize
+	}
+
+	return config.Limits.MaxMessageSize
+}
+
+// GetMaxResults returns how many stored events a subscription gets before
+// EOSE.
+func (config *Config) GetMaxResults() int {
+	if config.Limits.MaxResults <= 0 {
+		return defaultMaxResults
+	}
+
+	return config.Limits.MaxResults
+}
+
+// GetSendQueueBytes returns how much may be queued for one connection.
+func (config *Config) GetSendQueueBytes() int {
+	if config.Limits.SendQueueBytes <= 0 {
+		return defaultSendQueueBytes
+	}
+
+	return config.Limits.SendQueueBytes
+}
+
+// GetWriteTimeout returns how long one write to a connection may block.
+func (config *Config) GetWriteTimeout() time.Duration {
+	timeout, err := ParseRetentionDuration(config.Limits.WriteTimeout)
+	if err != nil || timeout <= 0 {
+		return defaultWriteTimeout
+	}
+
+	return timeout
+}
+
+// GetMaxEventTags returns how many tags an event other than a contact list
+// may have, and how many of a contact list's are indexed.
+func (config *Config) GetMaxEventTags() int {
+	if config.Limits.MaxEventTags <= 0 {
+		return defaultMaxEventTags
+	}
+
+	return config.Limits.MaxEventTags
+}
+
+// GetMaxTagValueLength returns the longest a tag element may be, in bytes.
+func (config *Config) GetMaxTagValueLength() int {
+	if config.Limits.MaxTagValueLength <= 0 {
+		return defaultMaxTagValueLength
+	}
+
+	return config.Limits.MaxTagValueLength
+}
+
+// GetCompressAbove returns how long a content must be, in bytes, to be
+// stored compressed, or 0 if nothing is.
+func (config *Config) GetCompressAbove() int {
+	return max(config.Storage.CompressAbove, 0)
+}
+
+// isHTTPURL reports whether s is an absolute http or https URL.
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// GetSoftDeleteWindow returns how long soft-deleted events are kept.
+func (config *Config) GetSoftDeleteWindow() time.Duration {
+	window, err := ParseRetentionDuration(config.Storage.SoftDeleteWindow)
+	if err != nil || window <= 0 {
+		return 7 * 24 * time.Hour
+	}
+
+	return window
+}
+
+// GetBroadcastDedup returns how many event ids to remember per connection
+// to skip sending one twice, or 0 if events aren't deduplicated.
+func (config *Config) GetBroadcastDedup() int {
+	if config.Limits.BroadcastDedup < 0 {
+		return 0
+	}
+	if config.Limits.BroadcastDedup == 0 {
+		return defaultBroadcastDedup
+	}
+
+	return config.Limits.BroadcastDedup
+}
+
+// GetSpamWindow returns how far back duplicate posts are counted.
+func (config *Config) GetSpamWindow() time.Duration {
+	window, err := ParseRetentionDuration(config.Spam.Window)
+	if err != nil || window <= 0 {
+		return defaultSpamWindow
+	}
+
+	return window
+}
+
+// GetInboxQuota returns how many gift wraps are kept for a recipient who
+// isn't a relay member.
+func (config *Config) GetInboxQuota() int {
+	if config.DMs.InboxQuota <= 0 {
+		return defaultInboxQuota
+	}
+
+	return config.DMs.InboxQuota
+}
+
+// GetDMMaxAge returns how long gift wraps are kept, or 0 for as long as
+// anything else.
+func (config *Config) GetDMMaxAge() time.Duration {
+	age, err := ParseRetentionDuration(config.DMs.MaxAge)
+	if err != nil {
+		return 0
+	}
+
+	return age
+}
+
+// GetNegentropyWindow returns how far back negentropy sync reaches, or 0 for
+// no limit.
+func (config *Config) GetNegentropyWindow() time.Duration {
+	window, err := ParseRetentionDuration(config.Negentropy.Window)
+	if err != nil {
+		return 0
+	}
+
+	return window
+}
+
+// GetPaymentPeriod returns how long a paid membership lasts.
+func (config *Config) GetPaymentPeriod() time.Duration {
+	period, err := ParseRetentionDuration(config.Payments.Period)
+	if err != nil || period <= 0 {
+		return defaultPaymentPeriod
+	}
+
+	return period
+}
+
+// GetPushInterval returns how often batches of mentions are sent.
+func (config *Config) GetPushInterval() time.Duration {
+	interval, err := ParseRetentionDuration(config.Push.Interval)
+	if err != nil || interval <= 0 {
+		return defaultPushInterval
+	}
+
+	return interval
+}
+
+// GetPushPerMinute returns how many push notifications one recipient may get
+// per minute.
+func (config *Config) GetPushPerMinute() int {
+	if config.Push.PerMinute <= 0 {
+		return defaultPushPerMinute
+	}
+
+	return config.Push.PerMinute
+}
+
+// GetMetricsTopGroups returns how many of the most active groups get
+// activity metrics.
+func (config *Config) GetMetricsTopGroups() int {
+	if config.Metrics.TopGroups <= 0 {
+		return defaultTopGroups
+	}
+
+	return config.Metrics.TopGroups
+}
+
+// GetStatsFields returns what the relay's stats event includes.
+func (config *Config) GetStatsFields() []string {
+	if len(config.Stats.Fields) == 0 {
+		return statsFields
+	}
+
+	return config.Stats.Fields
+}
+
+// GetSearchLanguage returns the text search configuration for NIP-50 search.
+func (config *Config) GetSearchLanguage() string {
+	if config.SearchLanguage == "" {
+		return "english"
+	}
+
+	return config.SearchLanguage
+}
+
 // HasRetention returns true if any effective retention policy is configured
-// (a non-empty default or at least one per-group override that parses to a positive duration).
+// (a non-empty default or at least one per-group override that parses to a
+// positive duration).
 func (config *Config) HasRetention() bool {
 	if d, err := ParseRetentionDuration(config.Groups.Retention.Default); err == nil && d > 0 {
 		return true
@@ -290,10 +1074,15 @@ func (config *Config) HasRetention() bool {
 }
 
 // GetRetention returns the retention duration for a group. Per-group overrides
-// take precedence over the default. Returns 0 (unlimited) if no retention is configured.
+// take precedence over the default. Returns 0 (unlimited) if no retention is configured
+// or the group is marked retention_exempt in [groups.overrides].
 // Since values are validated at config load time, parse errors here are unexpected
 // and logged as warnings.
 func (config *Config) GetRetention(groupID string) time.Duration {
+	if config.Groups.Overrides[groupID].RetentionExempt {
+		return 0
+	}
+
 	if config.Groups.Retention.Groups != nil {
 		if s, ok := config.Groups.Retention.Groups[groupID]; ok {
 			d, err := ParseRetentionDuration(s)
@@ -1,22 +1,37 @@
 package zooid
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 
 	"fiatjaf.com/nostr"
 )
 
+// writeTestConfig writes body to a uniquely named file in the CONFIG dir and
+// returns the filename for LoadConfig. The file is removed on cleanup.
+func writeTestConfig(t *testing.T, body string) string {
+	t.Helper()
+
+	filename := "test_" + RandomString(8)
+	path := filepath.Join(Env("CONFIG"), filename)
+	if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+	t.Cleanup(func() { os.Remove(path) })
+
+	return filename
+}
+
 func TestConfig_IsOwner(t *testing.T) {
 	ownerPubkey := nostr.MustPubKeyFromHex("1234567890123456789012345678901234567890123456789012345678901234")
 	otherPubkey := nostr.MustPubKeyFromHex("abcdef1234567890123456789012345678901234567890123456789012345678")
 
 	config := &Config{
-		Info: struct {
-			Name        string `toml:"name"`
-			Icon        string `toml:"icon"`
-			Pubkey      string `toml:"pubkey"`
-			Description string `toml:"description"`
-		}{
+		Info: Info{
 			Pubkey: ownerPubkey.Hex(),
 		},
 	}
@@ -87,12 +102,7 @@ func TestConfig_CanManage(t *testing.T) {
 
 	config := &Config{
 		secret: nostr.Generate(),
-		Info: struct {
-			Name        string `toml:"name"`
-			Icon        string `toml:"icon"`
-			Pubkey      string `toml:"pubkey"`
-			Description string `toml:"description"`
-		}{
+		Info: Info{
 			Pubkey: ownerPubkey.Hex(),
 		},
 		Roles: map[string]Role{
@@ -123,12 +133,7 @@ func TestConfig_CanInvite(t *testing.T) {
 
 	config := &Config{
 		secret: nostr.Generate(),
-		Info: struct {
-			Name        string `toml:"name"`
-			Icon        string `toml:"icon"`
-			Pubkey      string `toml:"pubkey"`
-			Description string `toml:"description"`
-		}{
+		Info: Info{
 			Pubkey: ownerPubkey.Hex(),
 		},
 		Roles: map[string]Role{
@@ -158,12 +163,7 @@ func TestConfig_MemberRole(t *testing.T) {
 
 	config := &Config{
 		secret: nostr.Generate(),
-		Info: struct {
-			Name        string `toml:"name"`
-			Icon        string `toml:"icon"`
-			Pubkey      string `toml:"pubkey"`
-			Description string `toml:"description"`
-		}{
+		Info: Info{
 			Pubkey: ownerPubkey.Hex(),
 		},
 		Roles: map[string]Role{
@@ -183,3 +183,334 @@ func TestConfig_MemberRole(t *testing.T) {
 		t.Error("Any pubkey should have member role permissions")
 	}
 }
+
+func TestConfig_MultipleOwners(t *testing.T) {
+	owner1 := nostr.Generate().Public()
+	owner2 := nostr.Generate().Public()
+	other := nostr.Generate().Public()
+
+	config := &Config{
+		secret: nostr.Generate(),
+		Info: Info{
+			Pubkey: owner1.Hex(),
+			Owners: []string{owner2.Hex(), owner1.Hex()},
+		},
+	}
+
+	owners := config.GetOwners()
+	if len(owners) != 2 || owners[0] != owner1 || owners[1] != owner2 {
+		t.Errorf("GetOwners() = %v, want [%s %s] with duplicates removed", owners, owner1, owner2)
+	}
+
+	if config.GetOwner() != owner1 {
+		t.Error("GetOwner() should return info.pubkey as the primary owner")
+	}
+
+	for _, pubkey := range []nostr.PubKey{owner1, owner2} {
+		if !config.IsOwner(pubkey) || !config.CanManage(pubkey) || !config.CanInvite(pubkey) {
+			t.Errorf("co-owner %s should be an owner with manage and invite rights", pubkey)
+		}
+	}
+
+	if config.IsOwner(other) || config.CanManage(other) {
+		t.Error("non-owner should not be treated as an owner")
+	}
+
+	mgmt := &ManagementStore{Config: config}
+	admins := mgmt.GetAdmins()
+	if !slices.Contains(admins, owner1) || !slices.Contains(admins, owner2) {
+		t.Errorf("GetAdmins() = %v, want both owners included", admins)
+	}
+	if !mgmt.IsAdmin(owner2) {
+		t.Error("IsAdmin() should return true for co-owner")
+	}
+}
+
+func TestConfig_OwnersOnly(t *testing.T) {
+	owner := nostr.Generate().Public()
+
+	config := &Config{Info: Info{Owners: []string{owner.Hex()}}}
+
+	if config.GetOwner() != owner {
+		t.Error("GetOwner() should fall back to the first entry of info.owners")
+	}
+}
+
+func TestConfig_NoOwner(t *testing.T) {
+	config := &Config{}
+
+	if len(config.GetOwners()) != 0 {
+		t.Error("GetOwners() should be empty when no owner is configured")
+	}
+
+	if config.IsOwner(nostr.PubKey{}) {
+		t.Error("IsOwner() should not match the zero pubkey when no owner is configured")
+	}
+}
+
+func TestLoadConfig_Owners(t *testing.T) {
+	secret := nostr.Generate()
+	owner1 := nostr.Generate().Public()
+	owner2 := nostr.Generate().Public()
+
+	filename := writeTestConfig(t, `
+host = "owners.example.com"
+schema = "owners"
+secret = "`+secret.Hex()+`"
+
+[info]
+pubkey = "`+owner1.Hex()+`"
+owners = ["`+owner2.Hex()+`"]
+`)
+
+	config, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatalf("LoadConfig() failed: %v", err)
+	}
+
+	if !config.IsOwner(owner1) || !config.IsOwner(owner2) {
+		t.Error("both info.pubkey and info.owners should be owners after LoadConfig")
+	}
+}
+
+func TestLoadConfig_TrustedSigners(t *testing.T) {
+	upstream := nostr.Generate().Public()
+
+	filename := writeTestConfig(t, `
+host = "mirror.example.com"
+schema = "mirror"
+secret = "`+nostr.Generate().Hex()+`"
+
+[groups]
+trusted_signers = ["`+strings.ToUpper(upstream.Hex())+`"]
+`)
+
+	config, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatalf("LoadConfig() failed: %v", err)
+	}
+
+	if !config.IsTrustedSigner(upstream) {
+		t.Error("a trusted signer written in uppercase should match")
+	}
+	if config.IsTrustedSigner(nostr.Generate().Public()) {
+		t.Error("IsTrustedSigner() matched a key that isn't listed")
+	}
+}
+
+func TestLoadConfig_InvalidOwner(t *testing.T) {
+	secret := nostr.Generate()
+	owner := nostr.Generate().Public()
+
+	tests := []struct {
+		name string
+		info string
+	}{
+		{"invalid pubkey", `pubkey = "not-a-pubkey"`},
+		{"invalid owners entry", `pubkey = "` + owner.Hex() + `"` + "\nowners = [\"abc123\"]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := writeTestConfig(t, `
+host = "owners.example.com"
+schema = "owners"
+secret = "`+secret.Hex()+`"
+
+[info]
+`+tt.info+`
+`)
+
+			_, err := LoadConfig(filename)
+			if err == nil {
+				t.Fatal("LoadConfig() should reject an invalid owner pubkey")
+			}
+			if !strings.Contains(err.Error(), "info.") {
+				t.Errorf("error %q should mention the owner config", err)
+			}
+		})
+	}
+}
+
+// validTestConfig returns a config that passes Validate, for tests that
+// mutate one field at a time.
+func validTestConfig() *Config {
+	config := &Config{
+		Host:   "relay.example.com",
+		Schema: "relay",
+		Info:   Info{Pubkey: nostr.Generate().Public().Hex()},
+		Roles: map[string]Role{
+			"admin": {Pubkeys: []string{nostr.Generate().Public().Hex()}, CanManage: true},
+		},
+	}
+	config.Groups.Enabled = true
+	config.Groups.AutoJoin = true
+	config.Management.Enabled = true
+	config.Management.Methods = []string{"banpubkey"}
+
+	return config
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(*Config)
+		wantErr string
+	}{
+		{"valid", func(c *Config) {}, ""},
+		{"host with port", func(c *Config) { c.Host = "localhost:3334" }, ""},
+		{"missing host", func(c *Config) { c.Host = "" }, "host is required"},
+		{"host with scheme", func(c *Config) { c.Host = "wss://relay.example.com" }, "not a valid hostname"},
+		{"host with spaces", func(c *Config) { c.Host = "my relay" }, "not a valid hostname"},
+		{"missing schema", func(c *Config) { c.Schema = "" }, "schema is required"},
+		{"schema slugs to empty", func(c *Config) { c.Schema = "!!!" }, "no usable characters"},
+		{"schema with spaces", func(c *Config) { c.Schema = "My Relay" }, ""},
+		{"schema injection", func(c *Config) { c.Schema = "a; DROP TABLE kv" }, ""},
+		{"schema with leading digit", func(c *Config) { c.Schema = "1relay" }, "isn't a valid schema name"},
+		{"schema too long", func(c *Config) { c.Schema = strings.Repeat("r", 42) }, "isn't a valid schema name"},
+		{"native schema", func(c *Config) { c.Storage.NativeSchema = true }, ""},
+		{"reserved native schema", func(c *Config) {
+			c.Schema = "pg_relay"
+			c.Storage.NativeSchema = true
+		}, "reserves names starting with pg_"},
+		{"search language", func(c *Config) { c.SearchLanguage = "portuguese" }, ""},
+		{"invalid search language", func(c *Config) { c.SearchLanguage = "english'); DROP TABLE kv; --" }, "search_language"},
+		{"invalid owner", func(c *Config) { c.Info.Pubkey = "nope" }, "info.pubkey"},
+		{"invalid co-owner", func(c *Config) { c.Info.Owners = []string{"nope"} }, "info.owners[0]"},
+		{"invalid role pubkey", func(c *Config) {
+			c.Roles["moderator"] = Role{Pubkeys: []string{nostr.Generate().Public().Hex(), "typo"}}
+		}, "roles.moderator.pubkeys[1]"},
+		{"invalid retention", func(c *Config) { c.Groups.Retention.Default = "7 days" }, "groups.retention"},
+		{"replace interval off", func(c *Config) { c.Policy.ReplaceInterval = "0" }, ""},
+		{"invalid replace interval", func(c *Config) { c.Policy.ReplaceInterval = "2" }, "policy.replace_interval"},
+		{"group flag without groups", func(c *Config) { c.Groups.Enabled = false }, ""},
+		{"methods without management", func(c *Config) { c.Management.Enabled = false }, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := validTestConfig()
+			tt.mutate(config)
+
+			err := config.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate() = nil, want error containing %q", tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %q, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfig_ValidateFlags(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(*Config)
+		want   []string
+	}{
+		{"consistent", func(c *Config) {}, nil},
+		{"group flag without groups", func(c *Config) { c.Groups.Enabled = false }, []string{
+			"groups.auto_join has no effect unless groups.enabled = true",
+		}},
+		{"retention without groups", func(c *Config) {
+			c.Groups.Enabled = false
+			c.Groups.AutoJoin = false
+			c.Groups.Retention.Default = "7d"
+		}, []string{"groups.retention has no effect unless groups.enabled = true"}},
+		{"methods without management", func(c *Config) { c.Management.Enabled = false }, []string{
+			"management.methods has no effect unless management.enabled = true",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := validTestConfig()
+			tt.mutate(config)
+
+			if got := config.validateFlags(); !slices.Equal(got, tt.want) {
+				t.Errorf("validateFlags() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_ReportsAllProblems(t *testing.T) {
+	filename := writeTestConfig(t, `
+host = "not a host"
+schema = ""
+secret = "`+nostr.Generate().Hex()+`"
+
+[info]
+pubkey = "bad-owner"
+
+[roles.admin]
+pubkeys = ["bad-admin"]
+can_manage = true
+`)
+
+	_, err := LoadConfig(filename)
+
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("LoadConfig() error = %v, want *ConfigError", err)
+	}
+
+	problems := configErr.Problems()
+	if len(problems) != 4 {
+		t.Fatalf("got %d problems, want 4 (host, schema, owner, role): %v", len(problems), problems)
+	}
+
+	for _, want := range []string{"host", "schema is required", "info.pubkey", "roles.admin.pubkeys[0]"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q should mention %q", err, want)
+		}
+	}
+}
+
+func TestLoadConfig_InvalidSecret(t *testing.T) {
+	filename := writeTestConfig(t, `
+host = "relay.example.com"
+schema = "relay"
+secret = "not-a-secret"
+`)
+
+	_, err := LoadConfig(filename)
+	if err == nil || !strings.Contains(err.Error(), "secret") {
+		t.Fatalf("LoadConfig() error = %v, want secret error", err)
+	}
+}
+
+func TestSameExceptOverrides(t *testing.T) {
+	secret := nostr.Generate().Hex()
+	load := func(extra string) *Config {
+		t.Helper()
+
+		config, err := LoadConfig(writeTestConfig(t, `
+host = "overrides.example.com"
+schema = "overrides"
+secret = "`+secret+`"
+
+[groups]
+enabled = true
+`+extra))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+
+	base := load("")
+	if !sameExceptOverrides(base, load("\n[groups.overrides.general]\nmax_members = 10\n")) {
+		t.Error("configs differing only in overrides should match")
+	}
+	if sameExceptOverrides(base, load("auto_join = true\n")) {
+		t.Error("configs differing in groups.auto_join shouldn't match")
+	}
+}
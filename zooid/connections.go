@@ -0,0 +1,342 @@
+package zooid
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+	"github.com/fasthttp/websocket"
+)
+
+// Connection re-validation.
+//
+// Access is checked when a subscription is opened, but a subscription lasts
+// as long as its connection. So broadcasts are checked again as they go out:
+// a connection only gets events while it's authenticated as someone who can
+// still use the relay, and group events only while one of its pubkeys can
+// read the group. Someone kicked from a group simply stops getting its
+// events. Someone banned or removed from the relay has their connections sent
+// a NOTICE and closed.
+//
+// With policy.max_auth_age set, authentication also expires. khatru keeps
+// who a connection authenticated as, but not when, so that's kept here,
+// alongside: the AUTH messages a client sends are picked out of its frames
+// as they're read (see authReader). A connection whose authentication is that
+// old gets no more broadcasts, has its requests and events refused with
+// auth-required, and is sent its challenge again until it answers. khatru's
+// own record, ws.Challenge and ws.AuthedPublicKeys, is never changed.
+
+// connections keeps track of open websockets and when each last
+// authenticated.
+type connections struct {
+	mu    sync.RWMutex
+	conns map[*khatru.WebSocket]*connAuth
+}
+
+// connAuth is when a connection last authenticated, as unix nanoseconds, or
+// 0 until it's known to have.
+type connAuth struct {
+	authedAt     atomic.Int64
+	rechallenged atomic.Bool // expired and sent the challenge again
+}
+
+func (c *connections) add(ws *khatru.WebSocket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conns == nil {
+		c.conns = make(map[*khatru.WebSocket]*connAuth)
+	}
+	c.conns[ws] = &connAuth{}
+}
+
+func (c *connections) remove(ws *khatru.WebSocket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.conns, ws)
+}
+
+func (c *connections) get(ws *khatru.WebSocket) *connAuth {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.conns[ws]
+}
+
+// authedAs returns the connections authenticated as pubkey.
+func (c *connections) authedAs(pubkey nostr.PubKey) []*khatru.WebSocket {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var found []*khatru.WebSocket
+	for ws := range c.conns {
+		if slices.Contains(ws.AuthedPublicKeys, pubkey) {
+			found = append(found, ws)
+		}
+	}
+
+	return found
+}
+
+// authenticated records that ws answered its challenge at now.
+func (c *connections) authenticated(ws *khatru.WebSocket, now time.Time) {
+	if auth := c.get(ws); auth != nil {
+		auth.authedAt.Store(now.UnixNano())
+		auth.rechallenged.Store(false)
+	}
+}
+
+// expired reports whether ws authenticated maxAge or more before now. An
+// authentication that went unnoticed counts from the first time it's seen.
+func (c *connections) expired(ws *khatru.WebSocket, now time.Time, maxAge time.Duration) bool {
+	auth := c.get(ws)
+	if maxAge <= 0 || auth == nil {
+		return false
+	}
+
+	at := auth.authedAt.Load()
+	if at == 0 {
+		if len(ws.AuthedPublicKeys) > 0 {
+			auth.authedAt.CompareAndSwap(0, now.UnixNano())
+		}
+		return false
+	}
+
+	return now.Sub(time.Unix(0, at)) >= maxAge
+}
+
+// toRechallenge returns the expired connections that haven't been sent
+// their challenge again yet, counting them as sent it.
+func (c *connections) toRechallenge(now time.Time, maxAge time.Duration) []*khatru.WebSocket {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var found []*khatru.WebSocket
+	for ws, auth := range c.conns {
+		at := auth.authedAt.Load()
+		if at != 0 && now.Sub(time.Unix(0, at)) >= maxAge && auth.rechallenged.CompareAndSwap(false, true) {
+			found = append(found, ws)
+		}
+	}
+
+	return found
+}
+
+func (instance *Instance) OnDisconnect(ctx context.Context) {
+	if ws := khatru.GetConnection(ctx); ws != nil {
+		instance.connections.remove(ws)
+		instance.sent.Delete(ws)
+	}
+}
+
+// hasRelayAccess reports whether pubkey may use the relay at all.
+func (instance *Instance) hasRelayAccess(pubkey nostr.PubKey) bool {
+	if instance.Management.PubkeyIsBanned(pubkey) {
+		return false
+	}
+
+	return instance.Config.Policy.Open || instance.Management.IsMember(pubkey)
+}
+
+// canListen reports whether a connection may still be sent events: its
+// authentication mustn't have expired, and one of the pubkeys it
+// authenticated as must have access to the relay.
+func (instance *Instance) canListen(ws *khatru.WebSocket) bool {
+	if instance.connections.expired(ws, time.Now(), instance.Config.GetMaxAuthAge()) {
+		return false
+	}
+
+	return slices.ContainsFunc(ws.AuthedPublicKeys, instance.hasRelayAccess)
+}
+
+// dropConnections closes the connections of a pubkey that has lost access to
+// the relay. Connections also authenticated as someone who still has access
+// are left open.
+func (instance *Instance) dropConnections(pubkey nostr.PubKey) {
+	if instance.hasRelayAccess(pubkey) {
+		return
+	}
+
+	for _, ws := range instance.connections.authedAs(pubkey) {
+		if !slices.ContainsFunc(ws.AuthedPublicKeys, instance.hasRelayAccess) {
+			closeConnection(ws, RejectRestricted.Reason("you no longer have access to this relay"))
+		}
+	}
+}
+
+// closeConnection sends notice and closes the connection once the message
+// being written is complete.
+func closeConnection(ws *khatru.WebSocket, notice string) {
+	if conn := sendQueueOf(ws.Request); conn != nil {
+		conn.closeWith(notice, closePolicyViolation, "access revoked")
+		return
+	}
+
+	// Without a send queue the best we can do is ask the client to leave
+	ws.WriteJSON(nostr.NoticeEnvelope(notice))
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closePolicyViolation, "access revoked"))
+}
+
+// authExpired reports whether the connection behind ctx must authenticate
+// again before it's served.
+func (instance *Instance) authExpired(ctx context.Context) bool {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return false
+	}
+
+	return instance.connections.expired(ws, time.Now(), instance.Config.GetMaxAuthAge())
+}
+
+// watchAuth has the AUTH messages ws sends recorded as they arrive, once
+// they're found valid.
+func (instance *Instance) watchAuth(ws *khatru.WebSocket) {
+	conn := sendQueueOf(ws.Request)
+	if conn == nil {
+		return
+	}
+
+	conn.watchAuth(func(event nostr.Event) {
+		if validAuth(ws, event, time.Now()) {
+			instance.connections.authenticated(ws, time.Now())
+		}
+	})
+}
+
+// validAuth reports whether event answers ws's challenge, checked as khatru
+// will check it before accepting it.
+func validAuth(ws *khatru.WebSocket, event nostr.Event, now time.Time) bool {
+	if event.Kind != nostr.KindClientAuthentication || event.Tags.FindWithValue("challenge", ws.Challenge) == nil {
+		return false
+	}
+
+	if age := now.Sub(event.CreatedAt.Time()); age > 10*time.Minute || age < -10*time.Minute {
+		return false
+	}
+
+	tag := event.Tags.Find("relay")
+	if tag == nil {
+		return false
+	}
+	relay, err := url.Parse(strings.ToLower(tag[1]))
+	if err != nil || ws.Request == nil {
+		return false
+	}
+	host := ws.Request.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = ws.Request.Host
+	}
+	if relay.Host != strings.ToLower(host) {
+		return false
+	}
+
+	return event.CheckID() && event.VerifySignature()
+}
+
+// startReauthenticator sends its challenge again to each connection whose
+// authentication is older than policy.max_auth_age, until ctx is cancelled.
+// Requests and events from them are refused in the meantime, see
+// authExpired.
+func (instance *Instance) startReauthenticator(ctx context.Context) {
+	maxAge := instance.Config.GetMaxAuthAge()
+	if maxAge <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(min(max(maxAge/4, time.Second), time.Minute))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, ws := range instance.connections.toRechallenge(now, maxAge) {
+					challenge := ws.Challenge
+					ws.WriteJSON(nostr.AuthEnvelope{Challenge: &challenge})
+				}
+			}
+		}
+	}()
+}
+
+// authReader picks the AUTH messages out of the websocket frames a client
+// sends. Only unfragmented text frames small enough to be one are kept, and
+// only until their start shows they aren't.
+type authReader struct {
+	header    []byte // header bytes of the next frame seen so far
+	mask      [4]byte
+	remaining uint64 // payload bytes left in the current frame
+	inFrame   bool
+	keep      bool // the current frame may be an AUTH message
+	payload   []byte
+}
+
+const maxAuthMessage = 16 << 10
+
+// consume reads p, calling found with the event of each AUTH message it
+// completes.
+func (a *authReader) consume(p []byte, found func(nostr.Event)) {
+	for len(p) > 0 {
+		if a.inFrame {
+			n := min(uint64(len(p)), a.remaining)
+			if a.keep {
+				for _, b := range p[:n] {
+					a.payload = append(a.payload, b^a.mask[len(a.payload)%4])
+				}
+				if len(a.payload) >= 16 && !isAuthMessage(a.payload) {
+					a.keep = false
+				}
+			}
+			p = p[n:]
+			a.remaining -= n
+			if a.remaining == 0 {
+				a.endFrame(found)
+			}
+			continue
+		}
+
+		a.header = append(a.header, p[0])
+		p = p[1:]
+
+		if header, ok := parseFrameHeader(a.header); ok {
+			a.header = a.header[:0]
+			a.remaining = header.length
+			a.inFrame = true
+			a.keep = header.fin && header.opcode == 0x1 && header.length <= maxAuthMessage
+			a.mask = header.mask
+			a.payload = a.payload[:0]
+			if header.length == 0 {
+				a.endFrame(found)
+			}
+		}
+	}
+}
+
+func (a *authReader) endFrame(found func(nostr.Event)) {
+	a.inFrame = false
+	if !a.keep || !isAuthMessage(a.payload) {
+		return
+	}
+
+	if env, err := nostr.ParseMessage(string(a.payload)); err == nil {
+		if auth, ok := env.(*nostr.AuthEnvelope); ok {
+			found(auth.Event)
+		}
+	}
+}
+
+// isAuthMessage reports whether a message starting with prefix may be an
+// AUTH message.
+func isAuthMessage(prefix []byte) bool {
+	return bytes.Contains(prefix[:min(len(prefix), 16)], []byte(`"AUTH"`))
+}
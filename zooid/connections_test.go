@@ -0,0 +1,234 @@
+package zooid
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+func TestConnections_Expired(t *testing.T) {
+	var conns connections
+	ws := &khatru.WebSocket{}
+	now := time.Now()
+	conns.add(ws)
+
+	if conns.expired(ws, now.Add(10*time.Hour), time.Hour) {
+		t.Error("a connection that never authenticated has nothing to expire")
+	}
+
+	ws.AuthedPublicKeys = []nostr.PubKey{nostr.Generate().Public()}
+	if conns.expired(ws, now, time.Hour) || conns.expired(ws, now.Add(30*time.Minute), time.Hour) {
+		t.Error("authentication expired early")
+	}
+	if !conns.expired(ws, now.Add(time.Hour), time.Hour) {
+		t.Error("authentication should expire max_auth_age after it's first seen")
+	}
+	if found := conns.toRechallenge(now.Add(time.Hour), time.Hour); len(found) != 1 || found[0] != ws {
+		t.Errorf("toRechallenge = %v, want the connection", found)
+	}
+	if found := conns.toRechallenge(now.Add(2*time.Hour), time.Hour); len(found) != 0 {
+		t.Error("a connection should only be challenged again once")
+	}
+
+	conns.authenticated(ws, now.Add(time.Hour))
+	if conns.expired(ws, now.Add(90*time.Minute), time.Hour) {
+		t.Error("answering the challenge should start over")
+	}
+	if ws.Challenge != "" || len(ws.AuthedPublicKeys) != 1 {
+		t.Error("khatru's record of the connection was changed")
+	}
+
+	conns.remove(ws)
+	if conns.expired(ws, now.Add(10*time.Hour), time.Hour) {
+		t.Error("a closed connection should be forgotten")
+	}
+}
+
+// clientFrame builds a masked, unfragmented client frame.
+func clientFrame(opcode byte, payload []byte) []byte {
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	frame := []byte{0x80 | opcode}
+
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	default:
+		frame = append(frame, 0x80|126, byte(n>>8), byte(n))
+	}
+	frame = append(frame, mask[:]...)
+
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func TestAuthReader_FindsAuthMessages(t *testing.T) {
+	secret := nostr.Generate()
+	auth := signedBy(secret, nostr.Event{
+		Kind: nostr.KindClientAuthentication,
+		Tags: nostr.Tags{{"relay", "wss://relay.example.com"}, {"challenge", "abc"}},
+	})
+	message, _ := json.Marshal(nostr.AuthEnvelope{Event: auth})
+	note, _ := json.Marshal(nostr.EventEnvelope{Event: signedBy(secret, nostr.Event{Kind: nostr.KindTextNote})})
+
+	var stream []byte
+	stream = append(stream, clientFrame(0x1, note)...)
+	stream = append(stream, clientFrame(0x9, []byte("ping"))...)
+	stream = append(stream, clientFrame(0x1, message)...)
+
+	var found []nostr.Event
+	var reader authReader
+	for chunk := range slices.Chunk(stream, 7) {
+		reader.consume(chunk, func(event nostr.Event) { found = append(found, event) })
+	}
+
+	if len(found) != 1 || found[0].ID != auth.ID {
+		t.Fatalf("found %v, want the AUTH event", found)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "relay.example.com"
+	ws := &khatru.WebSocket{Request: r, Challenge: "abc"}
+	if !validAuth(ws, auth, time.Now()) {
+		t.Error("the AUTH event answers the challenge")
+	}
+	ws.Challenge = "xyz"
+	if validAuth(ws, auth, time.Now()) {
+		t.Error("an AUTH event for another challenge was accepted")
+	}
+}
+
+func TestOnRequest_ExpiredAuth(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+	instance.Config.Policy.MaxAuthAge = "1h"
+
+	secret := nostr.Generate()
+	ctx := authedContext(secret.Public())
+	ws := khatru.GetConnection(ctx)
+	instance.connections.add(ws)
+	instance.connections.authenticated(ws, time.Now().Add(-2*time.Hour))
+
+	reject, msg := instance.OnRequest(ctx, nostr.Filter{Kinds: []nostr.Kind{nostr.KindTextNote}})
+	if !reject {
+		t.Fatal("a connection whose authentication expired should be refused")
+	}
+	assertPrefix(t, "expired subscriber", msg, RejectAuthRequired)
+
+	note := signedBy(secret, nostr.Event{Kind: nostr.KindTextNote})
+	reject, msg = instance.OnEvent(ctx, note)
+	if !reject {
+		t.Fatal("a connection whose authentication expired should not publish")
+	}
+	assertPrefix(t, "expired publisher", msg, RejectAuthRequired)
+
+	if !instance.PreventBroadcast(ws, nostr.Filter{}, note) {
+		t.Error("a connection whose authentication expired should get no broadcasts")
+	}
+
+	instance.connections.authenticated(ws, time.Now())
+	if reject, msg := instance.OnRequest(ctx, nostr.Filter{Kinds: []nostr.Kind{nostr.KindTextNote}}); reject {
+		t.Errorf("refused after authenticating again: %s", msg)
+	}
+}
+
+func TestPreventBroadcast_RechecksAccess(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+	runTestAdmin(t, instance, "create-group", "secret", "--private")
+
+	member := nostr.Generate()
+	runTestAdmin(t, instance, "add-member", "secret", member.Public().Hex())
+
+	ws := &khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{member.Public()}}
+	message := signedBy(member, nostr.Event{Kind: nostr.KindSimpleGroupChatMessage, Tags: nostr.Tags{{"h", "secret"}}})
+	note := signedBy(nostr.Generate(), nostr.Event{Kind: nostr.KindTextNote})
+	filter := nostr.Filter{Kinds: []nostr.Kind{nostr.KindSimpleGroupChatMessage}, Tags: nostr.TagMap{"#h": []string{"secret"}}}
+
+	if instance.PreventBroadcast(ws, filter, message) {
+		t.Fatal("a member should receive the group's messages")
+	}
+
+	runTestAdmin(t, instance, "remove-member", "secret", member.Public().Hex())
+	if !instance.PreventBroadcast(ws, filter, message) {
+		t.Error("a kicked member's open subscription should stop receiving the group's messages")
+	}
+	if instance.PreventBroadcast(ws, nostr.Filter{}, note) {
+		t.Error("a kicked member should still receive events outside the group")
+	}
+
+	if err := instance.Management.AddBannedPubkey(member.Public(), "spam"); err != nil {
+		t.Fatal(err)
+	}
+	if !instance.PreventBroadcast(ws, nostr.Filter{}, note) {
+		t.Error("a banned pubkey should receive nothing")
+	}
+
+	reject, msg := instance.OnRequest(authedContext(member.Public()), nostr.Filter{})
+	if !reject {
+		t.Fatal("a banned pubkey should not be able to subscribe")
+	}
+	assertPrefix(t, "banned subscriber", msg, RejectBlocked)
+}
+
+func TestDropConnections_ClosesBannedConnections(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+	instance.Management.onAccessLost = instance.dropConnections
+
+	connect := func(pubkey nostr.PubKey) net.Conn {
+		server, client := tcpPair(t)
+
+		writer := &sendQueueWriter{conn: newSendQueueConn(server, 1<<20, time.Second, func(string) {})}
+		writer.conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n\r\n"))
+
+		r := httptest.NewRequest("GET", "/", nil)
+		ws := &khatru.WebSocket{
+			Request:          r.WithContext(context.WithValue(r.Context(), sendQueueKey{}, writer)),
+			AuthedPublicKeys: []nostr.PubKey{pubkey},
+		}
+		instance.connections.add(ws)
+
+		return client
+	}
+
+	banned := nostr.Generate().Public()
+	bannedClient := connect(banned)
+	defer bannedClient.Close()
+	bystanderClient := connect(nostr.Generate().Public())
+	defer bystanderClient.Close()
+
+	if err := instance.Management.BanPubkey(banned, "spam"); err != nil {
+		t.Fatal(err)
+	}
+
+	bannedClient.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, err := io.ReadAll(bannedClient)
+	if err != nil {
+		t.Fatalf("the banned pubkey's connection was not closed: %v", err)
+	}
+	if !bytes.Contains(got, []byte("you no longer have access to this relay")) {
+		t.Errorf("no NOTICE before closing, got %q", got)
+	}
+	if !bytes.Contains(got, []byte("access revoked")) {
+		t.Errorf("no close frame, got %q", got)
+	}
+
+	bystanderClient.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	got, err = io.ReadAll(bystanderClient)
+	if !errors.Is(err, os.ErrDeadlineExceeded) || bytes.Contains(got, []byte("NOTICE")) {
+		t.Errorf("someone else's connection was closed: %q, %v", got, err)
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"database/sql"
 	"log"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 var (
@@ -15,14 +17,25 @@ var (
 	dbOnce sync.Once
 )
 
+// GetDb opens the database DATABASE_URL points to: PostgreSQL, or with a
+// sqlite:// URL a SQLite file, see sqlite.go. With memory:// there is no
+// database, see memory.go, and anything that still reaches for one is a bug.
 func GetDb() *sql.DB {
 	dbOnce.Do(func() {
 		dsn := Env("DATABASE_URL")
 		if dsn == "" {
 			log.Fatal("DATABASE_URL environment variable is required")
 		}
+		if usesMemory() {
+			log.Fatal("DATABASE_URL is memory://, which has no database")
+		}
+
+		driver := "pgx"
+		if path, ok := strings.CutPrefix(dsn, "sqlite://"); ok {
+			driver, dsn = "sqlite3", sqliteDSN(path)
+		}
 
-		newDb, err := sql.Open("pgx", dsn)
+		newDb, err := sql.Open(driver, dsn)
 		if err != nil {
 			log.Fatalf("Failed to open database: %v", err)
 		}
@@ -45,6 +58,17 @@ func GetDb() *sql.DB {
 	return db
 }
 
+// usesSQLite reports whether the database is SQLite rather than PostgreSQL.
+func usesSQLite() bool {
+	return strings.HasPrefix(Env("DATABASE_URL"), "sqlite://")
+}
+
+// usesMemory reports whether events and kv are kept in memory rather than
+// in a database.
+func usesMemory() bool {
+	return Env("DATABASE_URL") == "memory://"
+}
+
 func envInt(key string, fallback int) int {
 	if v := Env(key); v != "" {
 		if n, err := strconv.Atoi(v); err == nil {
@@ -0,0 +1,79 @@
+package zooid
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Per-instance database concurrency.
+//
+// Every instance shares one connection pool, so a relay serving heavy history
+// queries can hold all of it while a small relay's writes wait. With
+// storage.db_max_concurrent set, an instance's event queries and writes first
+// take one of its own slots, and only then a pooled connection: a noisy
+// neighbor queues behind itself. The relay's own writes (SignAndStoreEvent)
+// may also take one reserved slot, so membership lists and group metadata
+// aren't stuck behind the relay's clients. Other database work, such as kv,
+// retention and migrations, isn't limited.
+
+var dbSlotWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "zooid_db_slot_wait_seconds",
+	Help:    "Time spent waiting for one of the instance's database slots (storage.db_max_concurrent)",
+	Buckets: queryDurationBuckets,
+}, []string{"instance"})
+
+func init() {
+	prometheus.MustRegister(dbSlotWait)
+}
+
+// dbSlots limits how many event queries and writes an instance runs at once.
+// A nil *dbSlots doesn't limit anything.
+type dbSlots struct {
+	schema   string
+	slots    chan struct{}
+	reserved chan struct{}
+}
+
+// newDBSlots returns n slots plus a reserved one, or nil if n is 0.
+func newDBSlots(schema string, n int) *dbSlots {
+	if n <= 0 {
+		return nil
+	}
+
+	return &dbSlots{
+		schema:   schema,
+		slots:    make(chan struct{}, n),
+		reserved: make(chan struct{}, 1),
+	}
+}
+
+// acquire waits for a slot, or with reserved for a slot or the reserved one,
+// whichever frees up first. The slot is held until release is called.
+func (s *dbSlots) acquire(ctx context.Context, reserved bool) (release func(), err error) {
+	if s == nil {
+		return func() {}, nil
+	}
+
+	start := time.Now()
+	defer func() {
+		dbSlotWait.WithLabelValues(s.schema).Observe(time.Since(start).Seconds())
+	}()
+
+	// A nil channel is never ready, so only reserved callers can take it
+	var reserve chan struct{}
+	if reserved {
+		reserve = s.reserved
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		return func() { <-s.slots }, nil
+	case reserve <- struct{}{}:
+		return func() { <-reserve }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for a database slot: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,119 @@
+package zooid
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestDBSlots_NoisyNeighbor(t *testing.T) {
+	skipOnMemory(t, "connection pool")
+
+	noisy := createTestEventStore()
+	quiet := createTestEventStore()
+	for _, store := range []*EventStore{noisy, quiet} {
+		if err := store.Init(); err != nil {
+			t.Fatalf("Init failed: %v", err)
+		}
+	}
+	noisy.slots = newDBSlots(noisy.Config.Schema, 1)
+
+	if err := noisy.SaveEvent(createTestEvent(nostr.KindTextNote, "history")); err != nil {
+		t.Fatalf("SaveEvent failed: %v", err)
+	}
+
+	db := GetDb()
+	origMaxOpen := db.Stats().MaxOpenConnections
+	db.SetMaxOpenConns(2)
+	defer db.SetMaxOpenConns(origMaxOpen)
+
+	// Park more of noisy's queries mid-iteration than the pool has
+	// connections; all but one wait on noisy's own slot
+	release := make(chan struct{})
+	done := make(chan struct{})
+	const queries = 4
+	for range queries {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for range noisy.QueryEvents(nostr.Filter{Kinds: []nostr.Kind{nostr.KindTextNote}}, 0) {
+				<-release
+			}
+		}()
+	}
+	defer func() {
+		close(release)
+		for range queries {
+			<-done
+		}
+	}()
+
+	// Let the queries reach the pool
+	time.Sleep(100 * time.Millisecond)
+
+	finished := make(chan error, 1)
+	go func() {
+		_, err := quiet.CountEvents(nostr.Filter{})
+		finished <- err
+	}()
+
+	select {
+	case err := <-finished:
+		if err != nil {
+			t.Fatalf("quiet store's count failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("quiet store's count is stuck behind the noisy store's queries")
+	}
+
+	// The relay's own writes get the reserved slot
+	stored := make(chan error, 1)
+	go func() {
+		event := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Content: "from the relay"}
+		stored <- noisy.SignAndStoreEvent(&event, false)
+	}()
+
+	select {
+	case err := <-stored:
+		if err != nil {
+			t.Fatalf("SignAndStoreEvent failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the relay's own write is stuck behind its clients' queries")
+	}
+}
+
+func TestDBSlots_Acquire(t *testing.T) {
+	slots := newDBSlots("test", 1)
+
+	release, err := slots.acquire(context.Background(), false)
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := slots.acquire(ctx, false); err == nil {
+		t.Error("acquired a second slot out of one")
+	}
+
+	reserved, err := slots.acquire(context.Background(), true)
+	if err != nil {
+		t.Fatalf("acquiring the reserved slot failed: %v", err)
+	}
+	reserved()
+	release()
+
+	if _, err := slots.acquire(context.Background(), false); err != nil {
+		t.Errorf("acquire after release failed: %v", err)
+	}
+
+	// No limit
+	var unlimited *dbSlots
+	for range 10 {
+		if _, err := unlimited.acquire(context.Background(), false); err != nil {
+			t.Fatalf("unlimited acquire failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package zooid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// Dead letters.
+//
+// OnEventSaved runs side effects once an event is stored: creating a group
+// writes its metadata, members and admins lists, a join adds the member, and
+// so on. The event has already been accepted by then, so a failing step
+// can't be reported to the client. Instead the event and the steps still to
+// run are saved under zooid:<schema>:deadletter:<event id>, and
+// RetryDeadLetters runs them again until they succeed. Debounced list
+// rewrites fail later, on their timer; those are only logged and are
+// repaired by the group's next membership change.
+
+const deadLetterRetryInterval = 5 * time.Minute
+
+// DeadLetter is an event whose OnEventSaved side effects didn't all
+// complete. Steps holds the first failed step and every step after it,
+// since later steps may depend on it.
+type DeadLetter struct {
+	Event    nostr.Event     `json:"event"`
+	Steps    []string        `json:"steps"`
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`
+	FailedAt nostr.Timestamp `json:"failed_at"`
+}
+
+type sideEffect func(instance *Instance, event nostr.Event) error
+
+// sideEffects maps the step names stored in dead letters to their
+// implementation. Every step must be safe to repeat.
+var sideEffects = map[string]sideEffect{
+	"add_member": func(instance *Instance, event nostr.Event) error {
+		return instance.Groups.AddMember(GetGroupIDFromEvent(event), event.PubKey)
+	},
+	"remove_member": func(instance *Instance, event nostr.Event) error {
+		return instance.Groups.RemoveMember(GetGroupIDFromEvent(event), event.PubKey)
+	},
+	"update_metadata": func(instance *Instance, event nostr.Event) error {
+		return instance.Groups.UpdateMetadata(event)
+	},
+	"update_members_list": func(instance *Instance, event nostr.Event) error {
+		return instance.Groups.UpdateMembersList(GetGroupIDFromEvent(event))
+	},
+	"schedule_members_list": func(instance *Instance, event nostr.Event) error {
+		return instance.Groups.ScheduleMembersListUpdate(GetGroupIDFromEvent(event))
+	},
+	"schedule_member_count": func(instance *Instance, event nostr.Event) error {
+		return instance.Groups.ScheduleMemberCountRefresh(GetGroupIDFromEvent(event))
+	},
+	"update_admins_list": func(instance *Instance, event nostr.Event) error {
+		return instance.Groups.UpdateAdminsList(GetGroupIDFromEvent(event))
+	},
+	"update_pins": func(instance *Instance, event nostr.Event) error {
+		return instance.Groups.UpdatePins(event)
+	},
+	"update_join_requests": func(instance *Instance, event nostr.Event) error {
+		return instance.Groups.UpdateJoinRequests(GetGroupIDFromEvent(event))
+	},
+	"publish_member_delta": func(instance *Instance, event nostr.Event) error {
+		return instance.Groups.resignMemberDelta(event)
+	},
+}
+
+func (instance *Instance) deadLetterKV() *KV {
+	return &KV{Name: "zooid:" + instance.Events.Schema.Name}
+}
+
+// applySideEffects runs steps for event and records a dead letter if any of
+// them fail. Later steps still run after a failure, as they always have, so
+// a single failure doesn't hold up unrelated work.
+func (instance *Instance) applySideEffects(event nostr.Event, steps ...string) {
+	remaining, err := instance.runSideEffects(event, steps)
+	if err == nil {
+		return
+	}
+
+	instance.recordDeadLetter(event, remaining, err)
+}
+
+func (instance *Instance) recordDeadLetter(event nostr.Event, steps []string, err error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(instance.Ctx), dbOpTimeout)
+	defer cancel()
+
+	instance.saveDeadLetter(ctx, DeadLetter{
+		Event:    event,
+		Steps:    steps,
+		Error:    err.Error(),
+		Attempts: 1,
+		FailedAt: nostr.Now(),
+	})
+}
+
+// coalescedSideEffects rebuild a group's lists from current state, so when
+// several events in a batch ask for one, running it once at the end of the
+// batch gives the same result.
+var coalescedSideEffects = map[string]bool{
+	"update_members_list":   true,
+	"schedule_members_list": true,
+	"schedule_member_count": true,
+	"update_admins_list":    true,
+	"update_join_requests":  true,
+}
+
+// sideEffectBatch collects the coalesced steps of a batch of events from one
+// group, remembering the latest event that asked for each.
+type sideEffectBatch struct {
+	steps  []string
+	events map[string]nostr.Event
+}
+
+// apply runs event's steps, except coalesced ones, which wait for flush. A
+// failure is recorded with the coalesced steps too, since they may depend
+// on the step that failed.
+func (b *sideEffectBatch) apply(instance *Instance, event nostr.Event, steps ...string) {
+	var now, later []string
+	for _, step := range steps {
+		if coalescedSideEffects[step] {
+			later = append(later, step)
+		} else {
+			now = append(now, step)
+		}
+	}
+
+	for _, step := range later {
+		if b.events == nil {
+			b.events = make(map[string]nostr.Event)
+		}
+		if _, ok := b.events[step]; !ok {
+			b.steps = append(b.steps, step)
+		}
+		b.events[step] = event
+	}
+
+	if remaining, err := instance.runSideEffects(event, now); err != nil {
+		instance.recordDeadLetter(event, append(remaining, later...), err)
+	}
+}
+
+// merge adds other's coalesced steps, which replace the event of any step
+// both batches have.
+func (b *sideEffectBatch) merge(other *sideEffectBatch) {
+	for _, step := range other.steps {
+		if b.events == nil {
+			b.events = make(map[string]nostr.Event)
+		}
+		if _, ok := b.events[step]; !ok {
+			b.steps = append(b.steps, step)
+		}
+		b.events[step] = other.events[step]
+	}
+}
+
+// empty reports whether b has no coalesced steps to run.
+func (b *sideEffectBatch) empty() bool {
+	return b == nil || len(b.steps) == 0
+}
+
+// discard drops the coalesced steps collected so far.
+func (b *sideEffectBatch) discard() {
+	b.steps, b.events = nil, nil
+}
+
+// flush runs each coalesced step once, in the order first requested.
+func (b *sideEffectBatch) flush(instance *Instance) {
+	for _, step := range b.steps {
+		instance.applySideEffects(b.events[step], step)
+	}
+}
+
+// runSideEffects runs every step and returns the steps from the first
+// failure on, along with that failure.
+func (instance *Instance) runSideEffects(event nostr.Event, steps []string) ([]string, error) {
+	var remaining []string
+	var first error
+
+	for i, step := range steps {
+		run, ok := sideEffects[step]
+		if !ok {
+			return nil, fmt.Errorf("unknown side effect %q", step)
+		}
+
+		err := run(instance, event)
+		if errors.Is(err, ErrGroupFull) {
+			// Not a fault: the group filled up after the join was
+			// accepted. Retrying would only fail again.
+			log.Printf("Not adding %s to full group %q", event.PubKey.Hex(), GetGroupIDFromEvent(event))
+			continue
+		}
+
+		if err != nil {
+			slog.Error("event side effect failed",
+				"schema", instance.Events.Schema.Name,
+				"event", event.ID.Hex(),
+				"kind", int(event.Kind),
+				"step", step,
+				"error", err)
+
+			if first == nil {
+				remaining, first = steps[i:], err
+			}
+		}
+	}
+
+	return remaining, first
+}
+
+func (instance *Instance) saveDeadLetter(ctx context.Context, letter DeadLetter) {
+	if err := instance.deadLetterKV().SetJSON(ctx, "deadletter:"+letter.Event.ID.Hex(), letter); err != nil {
+		slog.Error("failed to save dead letter",
+			"schema", instance.Events.Schema.Name,
+			"event", letter.Event.ID.Hex(),
+			"steps", letter.Steps,
+			"error", err)
+	}
+}
+
+// ListDeadLetters returns the events whose side effects are waiting to be
+// retried, ordered by event id.
+func (instance *Instance) ListDeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	items, err := instance.deadLetterKV().List(ctx, "deadletter:")
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]DeadLetter, 0, len(items))
+	for _, item := range items {
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(item.Value), &letter); err != nil {
+			log.Printf("Skipping unreadable dead letter %s: %v", item.Key, err)
+			continue
+		}
+		letters = append(letters, letter)
+	}
+
+	return letters, nil
+}
+
+// RetryDeadLetters runs the outstanding steps of every dead letter again.
+// Letters that complete are removed, as are those whose event has since
+// been deleted or replaced, whose side effects would only undo later
+// changes; the rest are updated with the steps still failing. It returns
+// how many were removed and how many remain.
+func (instance *Instance) RetryDeadLetters(ctx context.Context) (resolved int, remaining int, err error) {
+	// Every step writes events, which read-only mode refuses.
+	if instance.Config.IsReadOnly() {
+		return 0, 0, ErrReadOnly
+	}
+
+	letters, err := instance.ListDeadLetters(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, letter := range letters {
+		stored, err := instance.isStored(letter.Event.ID)
+		if err != nil {
+			return resolved, len(letters) - resolved, err
+		}
+		if !stored {
+			log.Printf("Dropping dead letter for %s: the event was deleted or replaced", letter.Event.ID.Hex())
+			if err := instance.dropDeadLetter(ctx, letter.Event.ID); err != nil {
+				return resolved, len(letters) - resolved, err
+			}
+			resolved++
+			continue
+		}
+
+		steps, stepErr := instance.runSideEffects(letter.Event, letter.Steps)
+		if stepErr == nil {
+			if err := instance.deadLetterKV().Delete(ctx, "deadletter:"+letter.Event.ID.Hex()); err != nil {
+				return resolved, len(letters) - resolved, err
+			}
+			resolved++
+			continue
+		}
+
+		letter.Steps = steps
+		letter.Error = stepErr.Error()
+		letter.Attempts++
+		letter.FailedAt = nostr.Now()
+		instance.saveDeadLetter(ctx, letter)
+	}
+
+	return resolved, len(letters) - resolved, nil
+}
+
+// isStored reports whether the event with id is still stored, neither
+// deleted nor replaced.
+func (instance *Instance) isStored(id nostr.ID) (bool, error) {
+	failures := instance.Events.queryErrors.Load()
+	for range instance.Events.QueryEvents(nostr.Filter{IDs: []nostr.ID{id}}, 1) {
+		return true, nil
+	}
+	if instance.Events.queryErrors.Load() != failures {
+		return false, fmt.Errorf("looking up %s failed", id.Hex())
+	}
+
+	return false, nil
+}
+
+// dropDeadLetter removes the dead letter of the event with id, along with
+// the seq kept for its member delta, see memberdeltas.go.
+func (instance *Instance) dropDeadLetter(ctx context.Context, id nostr.ID) error {
+	if err := instance.deadLetterKV().Delete(ctx, "deadletter:"+id.Hex()); err != nil {
+		return err
+	}
+
+	return memberDeltaKV(instance.Events).Delete(ctx, "member_delta:"+id.Hex())
+}
+
+// StartDeadLetterRetrier launches a background goroutine that retries the
+// dead letters of the instances this process leads every
+// deadLetterRetryInterval until ctx is cancelled.
+func StartDeadLetterRetrier(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(deadLetterRetryInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				retryAllDeadLetters(ctx)
+			}
+		}
+	}()
+}
+
+func retryAllDeadLetters(ctx context.Context) {
+	for _, inst := range leadingInstances(ctx) {
+		resolved, remaining, err := inst.RetryDeadLetters(ctx)
+		if err != nil {
+			log.Printf("Failed to retry dead letters for %s: %v", inst.Config.Schema, err)
+		} else if resolved > 0 || remaining > 0 {
+			log.Printf("Retried dead letters for %s: %d resolved, %d remaining", inst.Config.Schema, resolved, remaining)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package zooid
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestDeadLetters_RetryCompletesGroupCreation(t *testing.T) {
+	instance := createTestInstance()
+	ctx := context.Background()
+
+	// Fail the members list once, as a database error would.
+	updateMembersList := sideEffects["update_members_list"]
+	failing := true
+	sideEffects["update_members_list"] = func(instance *Instance, event nostr.Event) error {
+		if failing {
+			return errors.New("simulated failure")
+		}
+		return updateMembersList(instance, event)
+	}
+	t.Cleanup(func() { sideEffects["update_members_list"] = updateMembersList })
+
+	creatorSecret := nostr.Generate()
+	createEvent := nostr.Event{
+		Kind:      nostr.KindSimpleGroupCreateGroup,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "flaky"}},
+		Content:   `{"name":"Flaky"}`,
+	}
+	createEvent.Sign(creatorSecret)
+	instance.Events.SaveEvent(createEvent)
+	instance.OnEventSaved(ctx, createEvent)
+
+	membersFilter := nostr.Filter{
+		Kinds: []nostr.Kind{nostr.KindSimpleGroupMembers},
+		Tags:  nostr.TagMap{"d": []string{"flaky"}},
+	}
+	if count, _ := instance.Events.CountEvents(membersFilter); count != 0 {
+		t.Fatalf("members list should be missing after the simulated failure, found %d", count)
+	}
+
+	letters, err := instance.ListDeadLetters(ctx)
+	if err != nil {
+		t.Fatalf("ListDeadLetters() error = %v", err)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(letters))
+	}
+	if letters[0].Event.ID != createEvent.ID {
+		t.Errorf("dead letter event = %s, want %s", letters[0].Event.ID, createEvent.ID)
+	}
+	if want := []string{"update_members_list"}; !slices.Equal(letters[0].Steps, want) {
+		t.Errorf("dead letter steps = %v, want %v", letters[0].Steps, want)
+	}
+
+	// Still failing: the letter stays, with another attempt counted.
+	if resolved, remaining, err := instance.RetryDeadLetters(ctx); err != nil || resolved != 0 || remaining != 1 {
+		t.Fatalf("RetryDeadLetters() = (%d, %d, %v), want (0, 1, nil)", resolved, remaining, err)
+	}
+	letters, _ = instance.ListDeadLetters(ctx)
+	if len(letters) != 1 || letters[0].Attempts != 2 {
+		t.Fatalf("dead letters after failed retry = %+v, want one with 2 attempts", letters)
+	}
+
+	failing = false
+	if resolved, remaining, err := instance.RetryDeadLetters(ctx); err != nil || resolved != 1 || remaining != 0 {
+		t.Fatalf("RetryDeadLetters() = (%d, %d, %v), want (1, 0, nil)", resolved, remaining, err)
+	}
+
+	members := 0
+	for event := range instance.Events.QueryEvents(membersFilter, 0) {
+		if event.Tags.FindWithValue("p", creatorSecret.Public().Hex()) == nil {
+			t.Error("members list should include the creator")
+		}
+		members++
+	}
+	if members != 1 {
+		t.Errorf("found %d members lists after retry, want 1", members)
+	}
+
+	if letters, _ := instance.ListDeadLetters(ctx); len(letters) != 0 {
+		t.Errorf("got %d dead letters after a successful retry, want 0", len(letters))
+	}
+}
+
+func TestDeadLetters_NoneOnSuccess(t *testing.T) {
+	instance := createTestInstance()
+
+	createEvent := nostr.Event{
+		Kind:      nostr.KindSimpleGroupCreateGroup,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "fine"}},
+		Content:   `{"name":"Fine"}`,
+	}
+	createEvent.Sign(nostr.Generate())
+	instance.OnEventSaved(context.Background(), createEvent)
+
+	if letters, _ := instance.ListDeadLetters(context.Background()); len(letters) != 0 {
+		t.Errorf("got %d dead letters, want 0", len(letters))
+	}
+}
+
+func TestDeadLetters_DroppedWhenEventGone(t *testing.T) {
+	instance := createTestInstance()
+	ctx := context.Background()
+	runTestAdmin(t, instance, "create-group", "gone")
+
+	updateMetadata := sideEffects["update_metadata"]
+	runs := 0
+	sideEffects["update_metadata"] = func(instance *Instance, event nostr.Event) error {
+		runs++
+		return errors.New("simulated failure")
+	}
+	t.Cleanup(func() { sideEffects["update_metadata"] = updateMetadata })
+
+	edit := signedBy(instance.Config.secret, nostr.Event{
+		Kind:    nostr.KindSimpleGroupEditMetadata,
+		Tags:    nostr.Tags{{"h", "gone"}, {"name", "Renamed"}},
+		Content: "",
+	})
+	if err := instance.Events.SaveEvent(edit); err != nil {
+		t.Fatal(err)
+	}
+	instance.OnEventSaved(ctx, edit)
+
+	if letters, _ := instance.ListDeadLetters(ctx); len(letters) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(letters))
+	}
+	if err := instance.DeleteEvent(ctx, edit.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	runs = 0
+	if resolved, remaining, err := instance.RetryDeadLetters(ctx); err != nil || resolved != 1 || remaining != 0 {
+		t.Fatalf("RetryDeadLetters() = (%d, %d, %v), want (1, 0, nil)", resolved, remaining, err)
+	}
+	if runs != 0 {
+		t.Errorf("ran the side effects of a deleted event %d times", runs)
+	}
+	if letters, _ := instance.ListDeadLetters(ctx); len(letters) != 0 {
+		t.Errorf("got %d dead letters after dropping, want 0", len(letters))
+	}
+}
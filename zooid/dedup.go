@@ -0,0 +1,86 @@
+package zooid
+
+import (
+	"sync"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Broadcast dedup.
+//
+// khatru sends a live event once per matching subscription, so a client with
+// overlapping subscriptions, say one for #h general and one for kind 9, gets
+// every message in general twice. Each connection remembers the ids of the
+// last limits.broadcast_dedup events it was sent, and an event it has already
+// had isn't sent again for another subscription. That's a ring of ids plus an
+// index into it, about 100 bytes per id remembered, so 26 KiB per connection
+// by default. Stored events sent in answer to a REQ aren't affected.
+
+const defaultBroadcastDedup = 256
+
+var duplicateBroadcasts = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "zooid_duplicate_broadcasts_total",
+	Help: "Live events not sent again to a connection that already had them",
+}, []string{"instance"})
+
+func init() {
+	prometheus.MustRegister(duplicateBroadcasts)
+}
+
+// sentEvents remembers the ids of the last events sent to a connection.
+type sentEvents struct {
+	mu   sync.Mutex
+	ring []nostr.ID
+	next int
+	ids  map[nostr.ID]struct{}
+}
+
+func newSentEvents(size int) *sentEvents {
+	return &sentEvents{
+		ring: make([]nostr.ID, 0, size),
+		ids:  make(map[nostr.ID]struct{}, size),
+	}
+}
+
+// add remembers id, forgetting the oldest one if the ring is full, and
+// reports false if it was remembered already.
+func (s *sentEvents) add(id nostr.ID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+
+	if len(s.ring) < cap(s.ring) {
+		s.ring = append(s.ring, id)
+	} else {
+		delete(s.ids, s.ring[s.next])
+		s.ring[s.next] = id
+		s.next = (s.next + 1) % len(s.ring)
+	}
+	s.ids[id] = struct{}{}
+
+	return true
+}
+
+// trackSent starts remembering what's broadcast to ws, unless dedup is off.
+func (instance *Instance) trackSent(ws *khatru.WebSocket) {
+	if size := instance.Config.GetBroadcastDedup(); size > 0 {
+		instance.sent.Store(ws, newSentEvents(size))
+	}
+}
+
+// alreadySent records that event is going out to ws, reporting true if it
+// went out to ws before.
+func (instance *Instance) alreadySent(ws *khatru.WebSocket, event nostr.Event) bool {
+	sent, ok := instance.sent.Load(ws)
+	if !ok || sent.(*sentEvents).add(event.ID) {
+		return false
+	}
+
+	duplicateBroadcasts.WithLabelValues(instanceLabel(instance)).Inc()
+	return true
+}
@@ -0,0 +1,95 @@
+package zooid
+
+import (
+	"runtime"
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+func randomID() nostr.ID {
+	return signedAt(nostr.Generate(), nostr.KindTextNote, 0, nil).ID
+}
+
+func TestSentEvents_ForgetsTheOldest(t *testing.T) {
+	sent := newSentEvents(3)
+	ids := []nostr.ID{randomID(), randomID(), randomID(), randomID()}
+
+	for _, id := range ids {
+		if !sent.add(id) {
+			t.Fatal("a new id was taken for one already sent")
+		}
+	}
+	if sent.add(ids[3]) || sent.add(ids[1]) {
+		t.Error("recent ids should be remembered")
+	}
+	if !sent.add(ids[0]) {
+		t.Error("the oldest id should have been forgotten")
+	}
+	if len(sent.ids) != 3 {
+		t.Errorf("%d ids indexed, want at most 3", len(sent.ids))
+	}
+}
+
+func TestSentEvents_MemoryIsBounded(t *testing.T) {
+	const connections = 100
+	ids := make([]nostr.ID, defaultBroadcastDedup*4)
+	for i := range ids {
+		ids[i] = nostr.ID{byte(i), byte(i >> 8), byte(i >> 16)}
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	all := make([]*sentEvents, connections)
+	for i := range all {
+		all[i] = newSentEvents(defaultBroadcastDedup)
+		for _, id := range ids {
+			all[i].add(id)
+		}
+	}
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(all)
+
+	perConnection := (after.HeapAlloc - before.HeapAlloc) / connections
+	t.Logf("%d bytes per connection remembering %d ids", perConnection, defaultBroadcastDedup)
+	if perConnection > 128*defaultBroadcastDedup {
+		t.Errorf("%d bytes per connection, want at most %d", perConnection, 128*defaultBroadcastDedup)
+	}
+}
+
+func TestPreventBroadcast_SendsEachEventOnce(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+
+	reader := nostr.Generate().Public()
+	ws := &khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{reader}}
+	instance.trackSent(ws)
+
+	note := signedBy(nostr.Generate(), nostr.Event{Kind: nostr.KindTextNote, Content: "hello"})
+	if instance.PreventBroadcast(ws, nostr.Filter{Kinds: []nostr.Kind{nostr.KindTextNote}}, note) {
+		t.Fatal("the first subscription should get the event")
+	}
+	if !instance.PreventBroadcast(ws, nostr.Filter{Authors: []nostr.PubKey{note.PubKey}}, note) {
+		t.Error("an overlapping subscription on the same connection got the event again")
+	}
+
+	other := &khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{reader}}
+	instance.trackSent(other)
+	if instance.PreventBroadcast(other, nostr.Filter{}, note) {
+		t.Error("another connection should get the event too")
+	}
+
+	instance.Config.Limits.BroadcastDedup = -1
+	untracked := &khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{reader}}
+	instance.trackSent(untracked)
+	for range 2 {
+		if instance.PreventBroadcast(untracked, nostr.Filter{}, note) {
+			t.Error("with dedup off every subscription should get the event")
+		}
+	}
+}
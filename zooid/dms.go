@@ -0,0 +1,132 @@
+package zooid
+
+import (
+	"maps"
+	"slices"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// Private messages (NIP 17).
+//
+// The relay can be used as a DM inbox. Gift wraps (kind 1059) are signed by
+// throwaway keys, so they're accepted on behalf of the recipient they p-tag
+// rather than their author: always for relay members, and for anyone under
+// the open policy, where a recipient who isn't a member holds at most
+// dms.inbox_quota of them. A gift wrap is only ever served to its recipient.
+// Nobody can delete them, so with dms.max_age set, older ones are no longer
+// served and the retention cleaner deletes them. Gift wraps are backdated by
+// up to two days, so max_age should be longer than that. DM relay lists
+// (kind 10050) are stored like any other replaceable event, as long as the
+// relays they list are valid URLs.
+
+const defaultInboxQuota = 1000
+
+// giftWrapRecipient returns the pubkey a gift wrap is addressed to.
+func giftWrapRecipient(event nostr.Event) (nostr.PubKey, bool) {
+	tag := event.Tags.Find("p")
+	if tag == nil {
+		return nostr.PubKey{}, false
+	}
+
+	pubkey, err := nostr.PubKeyFromHex(tag[1])
+	return pubkey, err == nil
+}
+
+// dmSince returns the oldest created_at of a gift wrap that's still kept, or
+// 0 if they're kept for good.
+func (config *Config) dmSince(now time.Time) nostr.Timestamp {
+	age := config.GetDMMaxAge()
+	if age <= 0 {
+		return 0
+	}
+
+	return nostr.Timestamp(now.Add(-age).Unix())
+}
+
+// checkGiftWrap decides whether to accept a gift wrap for its recipient.
+func (instance *Instance) checkGiftWrap(event nostr.Event) (reject bool, msg string) {
+	recipient, ok := giftWrapRecipient(event)
+	if !ok {
+		return RejectInvalid.Reject("gift wrap must p-tag its recipient")
+	}
+
+	since := instance.Config.dmSince(time.Now())
+	if event.CreatedAt < since {
+		return RejectInvalid.Reject("gift wrap is older than this relay keeps them")
+	}
+
+	if instance.Management.PubkeyIsBanned(recipient) {
+		return RejectBlocked.Reject("recipient has been banned from this relay")
+	}
+
+	if instance.Management.IsMember(recipient) {
+		return false, ""
+	}
+
+	if !instance.Config.Policy.Open {
+		return RejectRestricted.Reject("recipient is not a member of this relay")
+	}
+
+	count, err := instance.Events.CountEvents(nostr.Filter{
+		Kinds: []nostr.Kind{nostr.KindGiftWrap},
+		Tags:  nostr.TagMap{"p": []string{recipient.Hex()}},
+		Since: since,
+	})
+	if err != nil {
+		return RejectError.Reject("failed to check the recipient's inbox")
+	}
+
+	if int(count) >= instance.Config.GetInboxQuota() {
+		return RejectRateLimited.Reject("recipient's inbox is full")
+	}
+
+	return false, ""
+}
+
+// canReadGiftWrap reports whether pubkey may be served a gift wrap.
+func (instance *Instance) canReadGiftWrap(pubkey nostr.PubKey, event nostr.Event) bool {
+	recipient, ok := giftWrapRecipient(event)
+	return ok && recipient == pubkey && event.CreatedAt >= instance.Config.dmSince(time.Now())
+}
+
+// giftWrapFilter narrows a filter for nothing but gift wraps to those pubkey
+// may read, so that other people's don't use up its limit.
+func (instance *Instance) giftWrapFilter(pubkey nostr.PubKey, filter nostr.Filter) nostr.Filter {
+	if len(filter.Kinds) != 1 || filter.Kinds[0] != nostr.KindGiftWrap {
+		return filter
+	}
+
+	tags := maps.Clone(filter.Tags)
+	if tags == nil {
+		tags = make(nostr.TagMap)
+	}
+	if len(tags["p"]) == 0 {
+		tags["p"] = []string{pubkey.Hex()}
+	}
+
+	filter.Tags = tags
+	filter.Since = max(filter.Since, instance.Config.dmSince(time.Now()))
+
+	return filter
+}
+
+// checkDMRelayList refuses a DM relay list with anything but relay URLs in
+// its relay tags.
+func checkDMRelayList(event nostr.Event) string {
+	for tag := range event.Tags.FindAll("relay") {
+		if !nostr.IsValidRelayURL(tag[1]) {
+			return RejectInvalid.Reason("DM relay list has an invalid relay url")
+		}
+	}
+
+	return ""
+}
+
+// hidesGiftWrap reports whether a broadcast gift wrap should be kept from
+// someone authenticated as pubkeys.
+func hidesGiftWrap(pubkeys []nostr.PubKey, event nostr.Event) bool {
+	recipient, ok := giftWrapRecipient(event)
+	return !ok || !slices.Contains(pubkeys, recipient)
+}
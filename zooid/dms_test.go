@@ -0,0 +1,143 @@
+package zooid
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func giftWrapTo(recipient nostr.PubKey) nostr.Event {
+	return signedBy(nostr.Generate(), nostr.Event{
+		Kind:    nostr.KindGiftWrap,
+		Tags:    nostr.Tags{{"p", recipient.Hex()}},
+		Content: "ciphertext",
+	})
+}
+
+func TestCheckGiftWrap(t *testing.T) {
+	instance := createTestInstance()
+	member := nostr.Generate().Public()
+	instance.Management.AddMember(member)
+	stranger := nostr.Generate().Public()
+
+	// Gift wraps are accepted for the recipient, without authenticating
+	if reject, msg := instance.OnEvent(context.Background(), giftWrapTo(member)); reject {
+		t.Errorf("gift wrap to a member refused: %s", msg)
+	}
+
+	reject, msg := instance.OnEvent(context.Background(), giftWrapTo(stranger))
+	if !reject {
+		t.Fatal("gift wrap to a non-member accepted by a closed relay")
+	}
+	assertPrefix(t, "non-member recipient", msg, RejectRestricted)
+
+	reject, msg = instance.OnEvent(context.Background(), signedBy(nostr.Generate(), nostr.Event{Kind: nostr.KindGiftWrap}))
+	if !reject {
+		t.Fatal("gift wrap without a recipient accepted")
+	}
+	assertPrefix(t, "no recipient", msg, RejectInvalid)
+
+	// The open policy takes gift wraps for anyone, up to the inbox quota
+	instance.Config.Policy.Open = true
+	instance.Config.DMs.InboxQuota = 2
+
+	for range 2 {
+		wrap := giftWrapTo(stranger)
+		if reject, msg := instance.OnEvent(context.Background(), wrap); reject {
+			t.Fatalf("gift wrap within the quota refused: %s", msg)
+		}
+		if err := instance.StoreEvent(context.Background(), wrap); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reject, msg = instance.OnEvent(context.Background(), giftWrapTo(stranger))
+	if !reject {
+		t.Fatal("gift wrap over the inbox quota accepted")
+	}
+	assertPrefix(t, "full inbox", msg, RejectRateLimited)
+
+	if reject, msg := instance.OnEvent(context.Background(), giftWrapTo(member)); reject {
+		t.Errorf("members' inboxes have no quota, but a gift wrap was refused: %s", msg)
+	}
+}
+
+func TestGiftWraps_OnlyServedToRecipient(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+
+	recipient := nostr.Generate().Public()
+	wrap := giftWrapTo(recipient)
+	if err := instance.StoreEvent(context.Background(), wrap); err != nil {
+		t.Fatal(err)
+	}
+
+	served := func(pubkey nostr.PubKey, filter nostr.Filter) bool {
+		for event := range instance.QueryStored(authedContext(pubkey), filter) {
+			if event.ID == wrap.ID {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !served(recipient, nostr.Filter{Kinds: []nostr.Kind{nostr.KindGiftWrap}}) {
+		t.Error("recipient wasn't served their gift wrap")
+	}
+	if served(instance.Config.secret.Public(), nostr.Filter{Tags: nostr.TagMap{"p": []string{recipient.Hex()}}}) {
+		t.Error("a relay admin was served someone else's gift wrap")
+	}
+
+	instance.Config.DMs.MaxAge = "1h"
+	old := signedAt(nostr.Generate(), nostr.KindGiftWrap, nostr.Now()-2*60*60, nostr.Tags{{"p", recipient.Hex()}})
+	if reject, _ := instance.OnEvent(context.Background(), old); !reject {
+		t.Error("gift wrap older than dms.max_age accepted")
+	}
+}
+
+func TestGiftWrapFilter(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.DMs.MaxAge = "30d"
+	pubkey := nostr.Generate().Public()
+
+	filter := instance.giftWrapFilter(pubkey, nostr.Filter{Kinds: []nostr.Kind{nostr.KindGiftWrap}})
+	if !slices.Equal(filter.Tags["p"], []string{pubkey.Hex()}) || filter.Since == 0 {
+		t.Errorf("filter for gift wraps not narrowed to the requester's inbox: %+v", filter)
+	}
+
+	mixed := nostr.Filter{Kinds: []nostr.Kind{nostr.KindGiftWrap, nostr.KindTextNote}}
+	if filter := instance.giftWrapFilter(pubkey, mixed); filter.Tags != nil || filter.Since != 0 {
+		t.Errorf("filter for other kinds too was narrowed: %+v", filter)
+	}
+
+	if !hidesGiftWrap([]nostr.PubKey{nostr.Generate().Public()}, giftWrapTo(pubkey)) || hidesGiftWrap([]nostr.PubKey{pubkey}, giftWrapTo(pubkey)) {
+		t.Error("gift wraps should be broadcast to their recipient only")
+	}
+}
+
+func TestDMRelayList(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+
+	author := nostr.Generate()
+	ctx := authedContext(author.Public())
+	list := func(urls ...string) nostr.Event {
+		tags := nostr.Tags{}
+		for _, url := range urls {
+			tags = append(tags, nostr.Tag{"relay", url})
+		}
+		return signedBy(author, nostr.Event{Kind: nostr.KindDMRelayList, Tags: tags})
+	}
+
+	if reject, msg := instance.OnEvent(ctx, list("wss://relay.example.com", "wss://inbox.example.com/")); reject {
+		t.Errorf("DM relay list refused: %s", msg)
+	}
+
+	reject, msg := instance.OnEvent(ctx, list("wss://relay.example.com", "not a relay"))
+	if !reject {
+		t.Fatal("DM relay list with an invalid url accepted")
+	}
+	assertPrefix(t, "invalid relay url", msg, RejectInvalid)
+}
@@ -0,0 +1,97 @@
+package zooid
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// Ephemeral events.
+//
+// Ephemeral events (kinds 20000-29999) are relayed to current subscribers
+// and never stored. Those tagged with a group, like typing indicators and
+// presence, are only accepted from people with access to the group (see
+// CheckWrite) and only delivered to subscribers who can read it, so they
+// don't leak who is active in a private group. Since they cost nothing to
+// store, each pubkey may only send policy.ephemeral_per_minute of them, or
+// that times the rate_multiplier of the group they're tagged with.
+
+// rateLimiter is a token bucket per pubkey. The zero value is ready to
+// use.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[nostr.PubKey]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// allow takes a token from pubkey's bucket, which holds perMinute tokens and
+// refills continuously, and reports whether there was one.
+func (l *rateLimiter) allow(pubkey nostr.PubKey, perMinute int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	capacity := float64(perMinute)
+	perSecond := capacity / 60
+
+	refill := func(b *tokenBucket) {
+		b.tokens = min(capacity, b.tokens+now.Sub(b.at).Seconds()*perSecond)
+		b.at = now
+	}
+
+	// Full buckets are no different from missing ones, so drop them now and
+	// then to keep idle pubkeys from piling up
+	if now.Sub(l.lastSweep) >= time.Minute {
+		for key, b := range l.buckets {
+			refill(b)
+			if b.tokens >= capacity {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	if l.buckets == nil {
+		l.buckets = make(map[nostr.PubKey]*tokenBucket)
+	}
+
+	b, ok := l.buckets[pubkey]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, at: now}
+		l.buckets[pubkey] = b
+	}
+	refill(b)
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// ephemeralPerMinute returns how many ephemeral events like event its
+// author may send per minute, scaled by its group's rate_multiplier.
+func (instance *Instance) ephemeralPerMinute(event nostr.Event) int {
+	perMinute := float64(instance.Config.GetEphemeralPerMinute()) * instance.Groups.RateMultiplier(event)
+	return max(1, int(math.Round(perMinute)))
+}
+
+// canReceive reports whether a group event may be sent to a subscriber: one
+// of the pubkeys it authenticated as must be able to read the group. For
+// ephemeral events, which aren't stored, this is the only check.
+func (instance *Instance) canReceive(ws *khatru.WebSocket, event nostr.Event) bool {
+	for _, pubkey := range ws.AuthedPublicKeys {
+		if instance.Groups.CanRead(pubkey, event) {
+			return true
+		}
+	}
+
+	return false
+}
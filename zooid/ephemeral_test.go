@@ -0,0 +1,125 @@
+package zooid
+
+import (
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+const kindTyping nostr.Kind = 20001
+
+func TestRateLimiter(t *testing.T) {
+	var limiter rateLimiter
+	pubkey := nostr.Generate().Public()
+	now := time.Now()
+
+	for i := range 3 {
+		if !limiter.allow(pubkey, 3, now) {
+			t.Fatalf("event %d refused within the limit", i+1)
+		}
+	}
+	if limiter.allow(pubkey, 3, now) {
+		t.Error("event over the limit allowed")
+	}
+	if !limiter.allow(nostr.Generate().Public(), 3, now) {
+		t.Error("other pubkeys should have their own bucket")
+	}
+
+	// Three per minute is one every twenty seconds
+	if !limiter.allow(pubkey, 3, now.Add(20*time.Second)) {
+		t.Error("the bucket should have refilled")
+	}
+	if limiter.allow(pubkey, 3, now.Add(20*time.Second)) {
+		t.Error("only one token should have been refilled")
+	}
+
+	// Idle pubkeys are swept
+	limiter.allow(pubkey, 3, now.Add(10*time.Minute))
+	if len(limiter.buckets) != 1 {
+		t.Errorf("%d buckets after a sweep, want 1", len(limiter.buckets))
+	}
+}
+
+func TestEphemeral_GroupMembersOnly(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+	runTestAdmin(t, instance, "create-group", "typing", "--private")
+
+	member := nostr.Generate()
+	outsider := nostr.Generate()
+	runTestAdmin(t, instance, "add-member", "typing", member.Public().Hex())
+
+	typing := func(author nostr.SecretKey) nostr.Event {
+		return signedBy(author, nostr.Event{Kind: kindTyping, Tags: nostr.Tags{{"h", "typing"}}})
+	}
+
+	if reason := instance.Groups.CheckWrite(typing(member)); reason != "" {
+		t.Errorf("member's typing event refused: %s", reason)
+	}
+	if reason := instance.Groups.CheckWrite(typing(outsider)); reason == "" {
+		t.Error("an outsider's typing event should be refused")
+	} else {
+		assertPrefix(t, "outsider typing", reason, RejectRestricted)
+	}
+
+	event := typing(member)
+	filter := nostr.Filter{Kinds: []nostr.Kind{kindTyping}}
+	if instance.PreventBroadcast(&khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{member.Public()}}, filter, event) {
+		t.Error("a member should receive typing events")
+	}
+	if !instance.PreventBroadcast(&khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{outsider.Public()}}, filter, event) {
+		t.Error("an outsider should not receive typing events")
+	}
+	if !instance.PreventBroadcast(&khatru.WebSocket{}, filter, event) {
+		t.Error("an unauthenticated subscriber should not receive typing events")
+	}
+}
+
+func TestEphemeral_RateLimited(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+	instance.Config.Policy.EphemeralPerMinute = 2
+
+	author := nostr.Generate()
+	ctx := authedContext(author.Public())
+	event := signedBy(author, nostr.Event{Kind: kindTyping})
+
+	for range 2 {
+		if reject, msg := instance.OnEvent(ctx, event); reject {
+			t.Fatalf("event within the limit refused: %s", msg)
+		}
+	}
+
+	reject, msg := instance.OnEvent(ctx, event)
+	if !reject {
+		t.Fatal("event over the limit allowed")
+	}
+	assertPrefix(t, "over the limit", msg, RejectRateLimited)
+}
+
+func TestEphemeral_GroupRateMultiplier(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+	instance.Config.Policy.EphemeralPerMinute = 2
+	instance.Config.Groups.Overrides = map[string]GroupOverride{"busy": {RateMultiplier: 2}}
+	runTestAdmin(t, instance, "create-group", "busy")
+
+	author := nostr.Generate()
+	ctx := authedContext(author.Public())
+	runTestAdmin(t, instance, "add-member", "busy", author.Public().Hex())
+	event := signedBy(author, nostr.Event{Kind: kindTyping, Tags: nostr.Tags{{"h", "busy"}}})
+
+	for range 4 {
+		if reject, msg := instance.OnEvent(ctx, event); reject {
+			t.Fatalf("event within the group's limit refused: %s", msg)
+		}
+	}
+
+	reject, msg := instance.OnEvent(ctx, event)
+	if !reject {
+		t.Fatal("event over the group's limit allowed")
+	}
+	assertPrefix(t, "over the group's limit", msg, RejectRateLimited)
+}
@@ -1,18 +1,21 @@
 package zooid
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"iter"
 	"log"
+	"math"
 	"math/rand/v2"
 	"sort"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"fiatjaf.com/nostr"
@@ -81,80 +84,190 @@ type EventStore struct {
 	// set this to context.Background() via createTestEventStore.
 	// Never read directly outside this package.
 	rootCtx context.Context
+
+	// searchUnaccent is set by Init when the unaccent extension is
+	// available, in which case search ignores diacritics.
+	searchUnaccent bool
+
+	// VerifyOnSave makes SaveEvent, ReplaceEvent and StoreEvent check each
+	// event's signature before writing it. khatru verifies events from
+	// clients already; this guards paths that bypass it. Events the relay
+	// signs itself through SignAndStoreEvent are never re-checked.
+	VerifyOnSave bool
+
+	// transform, set by startTransformers, runs the instance's transformers
+	// on the events SignAndStoreEvent signs, see transform.go.
+	transform func(ctx context.Context, event *nostr.Event) error
+
+	// slots limits the store's concurrent queries and writes, see dbslots.go.
+	// nil means unlimited.
+	slots *dbSlots
+
+	// queryErrors counts queries that stopped on an error. QueryEvents can't
+	// return one, so this is how WarmCaches tells a failed read from a short
+	// one.
+	queryErrors atomic.Int64
+
+	statsMu sync.Mutex
+	stats   *EventStats // cached by Stats
 }
 
 var _ eventstore.Store = (*EventStore)(nil)
 
+// eventBackend keeps an EventStore's events: in the schema's tables, or with
+// DATABASE_URL=memory:// in memory, see memory.go. Events reach it already
+// verified, and only replaceable and addressable events are replaced.
+// Everything above it, from verification to signing, is shared, and the test
+// suite runs against every backend so they can't drift apart.
+type eventBackend interface {
+	query(filter nostr.Filter, maxLimit int, order queryOrder) iter.Seq[nostr.Event]
+	count(filter nostr.Filter) (uint32, error)
+	// save returns eventstore.ErrDupEvent for an event that's stored already
+	save(evt nostr.Event) error
+	replace(evt nostr.Event) error
+	delete(id nostr.ID) error
+	// softDelete, restore and purgeDeleted keep deleted events for a while,
+	// see softdelete.go
+	softDelete(id nostr.ID, at nostr.Timestamp) error
+	restore(id nostr.ID) error
+	purgeDeleted(ctx context.Context, before nostr.Timestamp) (rowsAffected int64, more bool, err error)
+	// membership returns the kind of the latest put (9000) or remove (9001)
+	// of pubkey in group h, or false if there is none
+	membership(h string, pubkey nostr.PubKey) (nostr.Kind, bool, error)
+	// receivedSince and receivedTimes read received_at, see received.go
+	receivedSince(since nostr.Timestamp, maxLimit int) iter.Seq[ReceivedEvent]
+	receivedTimes(ids []nostr.ID) (map[nostr.ID]nostr.Timestamp, error)
+}
+
+// sqlEvents keeps events in the schema's tables.
+type sqlEvents struct {
+	*EventStore
+	reserved bool // may take the store's reserved slot
+}
+
+// backend returns where the store's events are kept.
+func (events *EventStore) backend() eventBackend {
+	if usesMemory() {
+		return memoryEvents{events, memoryTablesFor(events.Schema.Name)}
+	}
+
+	return sqlEvents{EventStore: events}
+}
+
+// reservedBackend is backend for the relay's own writes, which may use the
+// slot reserved for them when the store's others are busy.
+func (events *EventStore) reservedBackend() eventBackend {
+	if usesMemory() {
+		return events.backend()
+	}
+
+	return sqlEvents{EventStore: events, reserved: true}
+}
+
+// eventIndex is an index on one of the schema's tables. Name and Table are
+// unprefixed, Columns is the column list as it appears in CREATE INDEX.
+type eventIndex struct {
+	Name    string
+	Table   string
+	Columns string
+}
+
+func (idx eventIndex) create(concurrently bool) string {
+	verb := "CREATE INDEX"
+	if concurrently {
+		verb += " CONCURRENTLY"
+	}
+
+	return fmt.Sprintf(`%s IF NOT EXISTS {{.Index %q}} ON {{.Prefix %q}}(%s)`, verb, idx.Name, idx.Table, idx.Columns)
+}
+
+// initIndexes are created by the base migration. They only reference columns
+// present in its CREATE TABLE statements; see migrations/ for the rest.
+var initIndexes = []eventIndex{
+	{"idx_events_created_at", "events", "created_at"},
+	{"idx_events_kind", "events", "kind"},
+	{"idx_events_pubkey", "events", "pubkey"},
+	{"idx_events_kind_pubkey", "events", "kind, pubkey"},
+	{"idx_events_kind_pubkey_created_at", "events", "kind, pubkey, created_at DESC"},
+	{"idx_events_kind_created_at", "events", "kind, created_at DESC"},
+	{"idx_event_tags_event_id", "event_tags", "event_id"},
+	{"idx_event_tags_key", "event_tags", "key"},
+	{"idx_event_tags_key_value", "event_tags", "key, value"},
+	// Covering index: (key, value) -> event_id without heap fetches.
+	{"idx_event_tags_key_value_event_id", "event_tags", "key, value, event_id"},
+}
+
+// migratedIndexes are created by migrations, listed here so Reindex can
+// repair them too.
+var migratedIndexes = []eventIndex{
+	{"idx_event_tags_key_value_kind_event_id", "event_tags", "key, value, kind, event_id"},
+	// The order queries return events in, see buildSelectQuery
+	{"idx_events_created_at_id", "events", "created_at DESC, id DESC"},
+	// Serves the dominant `kinds IN (...) AND #h = ...` query once the tag
+	// CTE has produced event ids: kind filter, ordering and the join key
+	// all come from the index.
+	{"idx_events_kind_created_at_id_desc", "events", "kind, created_at DESC, id DESC"},
+	// What arrived lately, see received.go
+	{"idx_events_received_at_id", "events", "received_at DESC, id DESC"},
+	// Soft-deleted events due to be purged, see softdelete.go
+	{"idx_events_deleted_at", "events", "deleted_at"},
+}
+
 func (events *EventStore) Init() error {
-	// Base tables and the indexes whose definitions reference only
-	// columns present in those CREATE TABLE statements. Indexes that
-	// depend on columns added by later migrations live in those
-	// migration files, not here, so we don't reference a column that
-	// doesn't exist yet on a pre-migration schema.
-	statements := []string{
-		events.Schema.Render(`
-			CREATE TABLE IF NOT EXISTS {{.Name}}__events (
-				id TEXT PRIMARY KEY,
-				created_at BIGINT NOT NULL,
-				kind INTEGER NOT NULL,
-				pubkey TEXT NOT NULL,
-				content TEXT NOT NULL,
-				tags TEXT NOT NULL,
-				sig TEXT NOT NULL
-			)`),
-		events.Schema.Render(`CREATE INDEX IF NOT EXISTS {{.Name}}__idx_events_created_at ON {{.Name}}__events(created_at)`),
-		events.Schema.Render(`CREATE INDEX IF NOT EXISTS {{.Name}}__idx_events_kind ON {{.Name}}__events(kind)`),
-		events.Schema.Render(`CREATE INDEX IF NOT EXISTS {{.Name}}__idx_events_pubkey ON {{.Name}}__events(pubkey)`),
-		events.Schema.Render(`CREATE INDEX IF NOT EXISTS {{.Name}}__idx_events_kind_pubkey ON {{.Name}}__events(kind, pubkey)`),
-		events.Schema.Render(`CREATE INDEX IF NOT EXISTS {{.Name}}__idx_events_kind_pubkey_created_at ON {{.Name}}__events(kind, pubkey, created_at DESC)`),
-		events.Schema.Render(`
-			CREATE TABLE IF NOT EXISTS {{.Name}}__event_tags (
-				event_id TEXT NOT NULL,
-				key TEXT NOT NULL,
-				value TEXT NOT NULL,
-				kind INTEGER,
-				FOREIGN KEY (event_id) REFERENCES {{.Name}}__events(id) ON DELETE CASCADE
-			)`),
-		events.Schema.Render(`CREATE INDEX IF NOT EXISTS {{.Name}}__idx_event_tags_event_id ON {{.Name}}__event_tags(event_id)`),
-		events.Schema.Render(`CREATE INDEX IF NOT EXISTS {{.Name}}__idx_event_tags_key ON {{.Name}}__event_tags(key)`),
-		events.Schema.Render(`CREATE INDEX IF NOT EXISTS {{.Name}}__idx_event_tags_key_value ON {{.Name}}__event_tags(key, value)`),
-		events.Schema.Render(`CREATE INDEX IF NOT EXISTS {{.Name}}__idx_event_tags_key_value_event_id ON {{.Name}}__event_tags(key, value, event_id)`),
-		events.Schema.Render(`CREATE INDEX IF NOT EXISTS {{.Name}}__idx_events_kind_created_at ON {{.Name}}__events(kind, created_at DESC)`),
-	}
-
-	for _, stmt := range statements {
-		if _, err := GetDb().ExecContext(events.rootCtx, stmt); err != nil {
-			return fmt.Errorf("schema init failed: %w", err)
-		}
+	if usesSQLite() {
+		return events.initSQLite()
 	}
 
-	if err := events.initFTS(); err != nil {
-		return fmt.Errorf("FTS init failed: %w", err)
+	// There's nothing to create in memory
+	if usesMemory() {
+		return nil
+	}
+
+	if events.Schema.Native {
+		if err := events.initNativeSchema(events.rootCtx); err != nil {
+			return fmt.Errorf("schema init failed: %w", err)
+		}
 	}
 
 	if err := RunMigrations(events.rootCtx, events.Schema); err != nil {
 		return fmt.Errorf("migrations failed: %w", err)
 	}
 
+	if err := events.initFTS(); err != nil {
+		return fmt.Errorf("FTS init failed: %w", err)
+	}
+
 	return nil
 }
 
 func (events *EventStore) initFTS() error {
+	// The language ends up in the trigger body, where an unknown name would
+	// only fail on the first insert. Check it up front instead.
+	if _, err := GetDb().ExecContext(events.rootCtx, `SELECT $1::regconfig`, events.Config.GetSearchLanguage()); err != nil {
+		return fmt.Errorf("search_language %q: %w", events.Config.GetSearchLanguage(), err)
+	}
+
+	events.searchUnaccent = detectUnaccent(events.rootCtx)
+
 	ftsStatements := []string{
-		events.Schema.Render(`ALTER TABLE {{.Name}}__events ADD COLUMN IF NOT EXISTS search_vector tsvector`),
-		events.Schema.Render(`CREATE INDEX IF NOT EXISTS {{.Name}}__idx_events_search ON {{.Name}}__events USING GIN(search_vector)`),
+		events.Schema.Render(`ALTER TABLE {{.Prefix "events"}} ADD COLUMN IF NOT EXISTS search_vector tsvector`),
+		events.Schema.Render(`CREATE INDEX IF NOT EXISTS {{.Index "idx_events_search"}} ON {{.Prefix "events"}} USING GIN(search_vector)`),
 		events.Schema.Render(`
-			CREATE OR REPLACE FUNCTION {{.Name}}_update_search_vector() RETURNS trigger AS $$
+			CREATE OR REPLACE FUNCTION {{.Function "update_search_vector"}}() RETURNS trigger AS $$
 			BEGIN
-				NEW.search_vector := to_tsvector('english', COALESCE(NEW.content, ''));
+				-- Compressed rows are indexed by whoever writes them
+				IF NEW.compressed THEN
+					RETURN NEW;
+				END IF;
+				NEW.search_vector := ` + events.searchVector("NEW.content", "NEW.tags") + `;
 				RETURN NEW;
 			END;
 			$$ LANGUAGE plpgsql`),
-		events.Schema.Render(`DROP TRIGGER IF EXISTS {{.Name}}_events_search_update ON {{.Name}}__events`),
+		events.Schema.Render(`DROP TRIGGER IF EXISTS {{.Trigger "events_search_update"}} ON {{.Prefix "events"}}`),
 		events.Schema.Render(`
-			CREATE TRIGGER {{.Name}}_events_search_update
-				BEFORE INSERT OR UPDATE ON {{.Name}}__events
-				FOR EACH ROW EXECUTE FUNCTION {{.Name}}_update_search_vector()`),
+			CREATE TRIGGER {{.Trigger "events_search_update"}}
+				BEFORE INSERT OR UPDATE ON {{.Prefix "events"}}
+				FOR EACH ROW EXECUTE FUNCTION {{.Function "update_search_vector"}}()`),
 	}
 
 	for _, stmt := range ftsStatements {
@@ -162,24 +275,53 @@ func (events *EventStore) initFTS() error {
 			return fmt.Errorf("statement failed: %w", err)
 		}
 	}
-	return nil
+
+	return events.scheduleSearchRebuild()
 }
 
 func (events *EventStore) Close() {
 	// Never close the database, since it's a shared resource
 }
 
-// QueryEvents satisfies eventstore.Store. Top-level callers don't have a
-// ctx (the interface signature predates context propagation), so we apply
+// queryOrder is the order queries return events in.
+type queryOrder int
+
+const (
+	newestFirst queryOrder = iota // as REQs get them
+	oldestFirst                   // for replaying a log
+)
+
+func (events *EventStore) QueryEvents(filter nostr.Filter, maxLimit int) iter.Seq[nostr.Event] {
+	return events.backend().query(filter, maxLimit, newestFirst)
+}
+
+// QueryEventsOldestFirst is QueryEvents in the order a log is replayed in:
+// oldest first, with ties broken by id, so callers can stream it instead of
+// collecting and reversing the newest first. A limit keeps the oldest.
+func (events *EventStore) QueryEventsOldestFirst(filter nostr.Filter, maxLimit int) iter.Seq[nostr.Event] {
+	return events.backend().query(filter, maxLimit, oldestFirst)
+}
+
+// query satisfies eventBackend. Top-level callers don't have a ctx (the
+// eventstore.Store signature predates context propagation), so we apply
 // dbOpTimeout inside the iter.Seq closure — this bounds the connection
 // acquire and the query+iteration without holding the timer past the
 // caller's last yield. Internal callers that already own a ctx (e.g.
 // replaceEventOnce) should call queryEventsWith directly and pass it.
-func (events *EventStore) QueryEvents(filter nostr.Filter, maxLimit int) iter.Seq[nostr.Event] {
+func (events sqlEvents) query(filter nostr.Filter, maxLimit int, order queryOrder) iter.Seq[nostr.Event] {
 	return func(yield func(nostr.Event) bool) {
 		ctx, cancel := context.WithTimeout(events.rootCtx, dbOpTimeout)
 		defer cancel()
-		for evt := range events.queryEventsWith(ctx, GetDb(), filter, maxLimit) {
+
+		release, err := events.slots.acquire(ctx, events.reserved)
+		if err != nil {
+			events.queryErrors.Add(1)
+			log.Printf("QueryEvents: %v", err)
+			return
+		}
+		defer release()
+
+		for evt := range events.queryEventsWith(ctx, GetDb(), filter, maxLimit, order) {
 			if !yield(evt) {
 				return
 			}
@@ -190,7 +332,7 @@ func (events *EventStore) QueryEvents(filter nostr.Filter, maxLimit int) iter.Se
 // queryEventsWith runs the read query under the caller's ctx so timeouts
 // and cancellation flow from the parent (e.g. replaceEventOnce's 60s
 // budget). The caller is responsible for setting any deadline on ctx.
-func (events *EventStore) queryEventsWith(ctx context.Context, runner squirrel.BaseRunner, filter nostr.Filter, maxLimit int) iter.Seq[nostr.Event] {
+func (events *EventStore) queryEventsWith(ctx context.Context, runner squirrel.BaseRunner, filter nostr.Filter, maxLimit int, order queryOrder) iter.Seq[nostr.Event] {
 	return func(yield func(nostr.Event) bool) {
 		if filter.LimitZero {
 			return
@@ -208,58 +350,30 @@ func (events *EventStore) queryEventsWith(ctx context.Context, runner squirrel.B
 		queryStart := time.Now()
 		var drainTotal time.Duration
 
-		qb, err := events.buildSelectQuery(filter)
+		qb, err := events.buildSelectQuery(filter, order)
 		if err != nil {
 			observeQueryTimings(totalObserver, dbObserver, drainObserver, queryStart, drainTotal)
+			events.queryErrors.Add(1)
 			log.Printf("QueryEvents buildSelectQuery error: %v", err)
 			return
 		}
 		rows, err := qb.RunWith(runner).QueryContext(ctx)
 		if err != nil {
 			observeQueryTimings(totalObserver, dbObserver, drainObserver, queryStart, drainTotal)
+			events.queryErrors.Add(1)
 			log.Printf("QueryEvents query error: %v", err)
 			return
 		}
 		defer rows.Close()
 
 		for rows.Next() {
-			var evt nostr.Event
-			var idStr, pubkeyStr, sigStr, tagsStr string
-			var createdAt int64
-			var kind int
-
-			err := rows.Scan(&idStr, &createdAt, &kind, &pubkeyStr, &evt.Content, &tagsStr, &sigStr)
-			if err != nil {
-				continue
-			}
-
-			// Parse ID
-			if id, err := nostr.IDFromHex(idStr); err == nil {
-				evt.ID = id
-			} else {
-				continue
-			}
-
-			// Parse PubKey
-			if pubkey, err := nostr.PubKeyFromHex(pubkeyStr); err == nil {
-				evt.PubKey = pubkey
-			} else {
-				continue
-			}
-
-			// Parse Signature
-			if sigBytes, err := hex.DecodeString(sigStr); err == nil && len(sigBytes) == 64 {
-				copy(evt.Sig[:], sigBytes)
-			} else {
+			var row eventRow
+			if err := row.scan(rows); err != nil {
 				continue
 			}
 
-			// Set other fields
-			evt.CreatedAt = nostr.Timestamp(createdAt)
-			evt.Kind = nostr.Kind(kind)
-
-			// Parse Tags
-			if err := json.Unmarshal([]byte(tagsStr), &evt.Tags); err != nil {
+			evt, err := row.event()
+			if err != nil {
 				continue
 			}
 
@@ -275,11 +389,74 @@ func (events *EventStore) queryEventsWith(ctx context.Context, runner squirrel.B
 		observeQueryTimings(totalObserver, dbObserver, drainObserver, queryStart, drainTotal)
 
 		if err := rows.Err(); err != nil {
+			events.queryErrors.Add(1)
 			log.Printf("QueryEvents row iteration error: %v", err)
 		}
 	}
 }
 
+// eventColumns are the columns eventRow.scan reads, in order.
+var eventColumns = []string{"id", "created_at", "kind", "pubkey", "content", "tags", "sig", "content_zstd"}
+
+// eventRow is an events table row as stored, before parsing.
+type eventRow struct {
+	id, pubkey, content, tags, sig string
+	createdAt                      int64
+	kind                           int
+	zstd                           []byte // content, if it's stored compressed
+}
+
+// scan reads eventColumns.
+func (row *eventRow) scan(rows *sql.Rows) error {
+	return rows.Scan(&row.id, &row.createdAt, &row.kind, &row.pubkey, &row.content, &row.tags, &row.sig, &row.zstd)
+}
+
+// text returns the row's content, decompressed if need be.
+func (row *eventRow) text() (string, error) {
+	if row.zstd == nil {
+		return row.content, nil
+	}
+
+	return decompressContent(row.zstd)
+}
+
+func (row *eventRow) event() (nostr.Event, error) {
+	evt := nostr.Event{
+		CreatedAt: nostr.Timestamp(row.createdAt),
+		Kind:      nostr.Kind(row.kind),
+	}
+
+	content, err := row.text()
+	if err != nil {
+		return evt, err
+	}
+	evt.Content = content
+
+	id, err := nostr.IDFromHex(row.id)
+	if err != nil {
+		return evt, fmt.Errorf("invalid id: %w", err)
+	}
+	evt.ID = id
+
+	pubkey, err := nostr.PubKeyFromHex(row.pubkey)
+	if err != nil {
+		return evt, fmt.Errorf("invalid pubkey: %w", err)
+	}
+	evt.PubKey = pubkey
+
+	sig, err := hex.DecodeString(row.sig)
+	if err != nil || len(sig) != 64 {
+		return evt, errors.New("invalid sig")
+	}
+	copy(evt.Sig[:], sig)
+
+	if err := json.Unmarshal([]byte(row.tags), &evt.Tags); err != nil {
+		return evt, fmt.Errorf("invalid tags: %w", err)
+	}
+
+	return evt, nil
+}
+
 // observeQueryTimings emits the three query-duration histograms in one
 // place: total wall time, DB-side time (total - drain), and consumer-drain
 // time. (wall - drainTotal) is non-negative because drainTotal is the sum
@@ -292,7 +469,7 @@ func observeQueryTimings(total, db, drain prometheus.Observer, queryStart time.T
 	drain.Observe(drainTotal.Seconds())
 }
 
-func (events *EventStore) buildSelectQuery(filter nostr.Filter) (squirrel.SelectBuilder, error) {
+func (events *EventStore) buildSelectQuery(filter nostr.Filter, order queryOrder) (squirrel.SelectBuilder, error) {
 	eventsTable := events.Schema.Prefix("events")
 	eventTagsTable := events.Schema.Prefix("event_tags")
 
@@ -346,81 +523,111 @@ func (events *EventStore) buildSelectQuery(filter nostr.Filter) (squirrel.Select
 	if len(tagFilters) > 0 {
 		col = "e."
 
-		// Build one SELECT per tag filter, INTERSECT them for AND logic.
-		var cteParts []string
-		var cteArgs []interface{}
-		for _, tf := range tagFilters {
-			subQ := squirrel.Select("event_id").
-				From(eventTagsTable).
-				Where(squirrel.Eq{"key": tf.key}).
-				Where(squirrel.Eq{"value": tf.values})
-			if len(kindInts) > 0 {
-				// `kind IS NULL` keeps reads correct for un-backfilled
-				// rows (event_tags.kind is added nullable; backfill is a
-				// separate ops step). Drop the IS NULL branch in a
-				// follow-up once the backfill is verified complete.
-				subQ = subQ.Where(squirrel.Or{
-					squirrel.Eq{"kind": kindInts},
-					squirrel.Expr("kind IS NULL"),
-				})
+		// A single pass over event_tags: rows matching any of the
+		// (key, values) pairs, grouped per event, keeping events that
+		// matched every key. With one key the GROUP BY is unnecessary.
+		// This replaced one subquery per key joined with INTERSECT,
+		// where the planner often picked a bad order for the common
+		// {#h, #p} NIP-29 filter under load.
+		keyConds := make(squirrel.Or, len(tagFilters))
+		for i, tf := range tagFilters {
+			keyConds[i] = squirrel.And{
+				squirrel.Eq{"key": tf.key},
+				squirrel.Eq{"value": tf.values},
 			}
-			sql, args, err := subQ.ToSql()
-			if err != nil {
-				// squirrel.Select.ToSql only fails for malformed builder
-				// state, not user input. Propagate so callers in the
-				// query and count paths can log and short-circuit
-				// instead of crashing the process.
-				return squirrel.SelectBuilder{}, fmt.Errorf("buildSelectQuery: tag CTE ToSql: %w", err)
-			}
-			cteParts = append(cteParts, sql)
-			cteArgs = append(cteArgs, args...)
 		}
 
-		cteSql := "WITH _tag_ids AS MATERIALIZED (" +
-			strings.Join(cteParts, " INTERSECT ") + ")"
+		subQ := squirrel.Select("event_id").From(eventTagsTable)
+		if len(keyConds) == 1 {
+			subQ = subQ.Where(keyConds[0])
+		} else {
+			subQ = subQ.Where(keyConds).
+				GroupBy("event_id").
+				Having("COUNT(DISTINCT key) = ?", len(tagFilters))
+		}
+		if len(kindInts) > 0 {
+			// `kind IS NULL` keeps reads correct for un-backfilled
+			// rows (event_tags.kind is added nullable; backfill is a
+			// separate ops step). Drop the IS NULL branch in a
+			// follow-up once the backfill is verified complete.
+			subQ = subQ.Where(squirrel.Or{
+				squirrel.Eq{"kind": kindInts},
+				squirrel.Expr("kind IS NULL"),
+			})
+		}
+		cteInner, cteArgs, err := subQ.ToSql()
+		if err != nil {
+			// squirrel.Select.ToSql only fails for malformed builder
+			// state, not user input. Propagate so callers in the
+			// query and count paths can log and short-circuit
+			// instead of crashing the process.
+			return squirrel.SelectBuilder{}, fmt.Errorf("buildSelectQuery: tag CTE ToSql: %w", err)
+		}
+
+		cteSql := "WITH _tag_ids AS MATERIALIZED (" + cteInner + ")"
+
+		columns := make([]string, len(eventColumns))
+		for i, column := range eventColumns {
+			columns[i] = "e." + column
+		}
 
-		qb = sb.Select("e.id", "e.created_at", "e.kind", "e.pubkey",
-			"e.content", "e.tags", "e.sig").
+		qb = sb.Select(columns...).
 			Prefix(cteSql, cteArgs...).
 			From(eventsTable + " e").
 			Join("_tag_ids t ON t.event_id = e.id")
 	} else {
-		qb = sb.Select("id", "created_at", "kind", "pubkey", "content", "tags", "sig").
+		qb = sb.Select(eventColumns...).
 			From(eventsTable)
 	}
 
-	qb = qb.OrderBy(col + "created_at DESC")
+	// Soft-deleted events are gone as far as anyone reading is concerned,
+	// tag matches included, see softdelete.go
+	qb = qb.Where(col + "deleted_at IS NULL")
 
-	if filter.Search != "" {
-		qb = qb.Where(col+"search_vector @@ plainto_tsquery('english', ?)", filter.Search)
+	// Ties are broken by id, so events of the same second come back in
+	// the same order every time
+	if order == oldestFirst {
+		qb = qb.OrderBy(col+"created_at ASC", col+"id ASC")
+	} else {
+		qb = qb.OrderBy(col+"created_at DESC", col+"id DESC")
+	}
+
+	if filter.Search != "" && usesSQLite() {
+		qb = qb.Where(events.sqliteSearch(col, filter.Search))
+	} else if filter.Search != "" {
+		qb = qb.Where(col+"search_vector @@ "+events.searchQuery(), events.Config.GetSearchLanguage(), filter.Search)
 	}
 
 	if len(filter.IDs) > 0 {
-		idStrs := make([]interface{}, len(filter.IDs))
+		idStrs := make([]string, len(filter.IDs))
 		for i, id := range filter.IDs {
 			idStrs[i] = id.Hex()
 		}
-		qb = qb.Where(squirrel.Eq{col + "id": idStrs})
+		qb = qb.Where(inList(col+"id", idStrs))
 	}
 
 	if len(filter.Authors) > 0 {
-		authorStrs := make([]interface{}, len(filter.Authors))
+		authorStrs := make([]string, len(filter.Authors))
 		for i, author := range filter.Authors {
 			authorStrs[i] = author.Hex()
 		}
-		qb = qb.Where(squirrel.Eq{col + "pubkey": authorStrs})
+		qb = qb.Where(inList(col+"pubkey", authorStrs))
 	}
 
-	if len(kindInts) > 0 {
-		qb = qb.Where(squirrel.Eq{col + "kind": kindInts})
+	if len(filter.Kinds) > 0 {
+		kinds := make([]int, len(filter.Kinds))
+		for i, k := range filter.Kinds {
+			kinds[i] = int(k)
+		}
+		qb = qb.Where(inList(col+"kind", kinds))
 	}
 
 	if filter.Since != 0 {
 		qb = qb.Where(squirrel.GtOrEq{col + "created_at": filter.Since})
 	}
 
-	if filter.Until != 0 {
-		qb = qb.Where(squirrel.LtOrEq{col + "created_at": filter.Until})
+	if until, ok := untilBound(filter); ok {
+		qb = qb.Where(squirrel.LtOrEq{col + "created_at": until})
 	}
 
 	if filter.Limit > 0 {
@@ -430,6 +637,53 @@ func (events *EventStore) buildSelectQuery(filter nostr.Filter) (squirrel.Select
 	return qb, nil
 }
 
+// inListArrayThreshold is the list length above which inList binds a single
+// array parameter instead of one placeholder per value.
+const inListArrayThreshold = 8
+
+// inList matches column against values. Short lists use a plain IN (...);
+// longer ones use `= ANY($n)` with one array parameter, so a filter with 500
+// ids is one placeholder instead of 500 — the statement text (and plan
+// cache entry) is the same whatever the list length, and large negentropy or
+// "fetch these ids" requests can't run into the bind parameter limit. SQLite
+// has no arrays, and allows 32766 parameters, so it always gets IN (...).
+func inList[T any](column string, values []T) squirrel.Sqlizer {
+	if len(values) <= inListArrayThreshold || usesSQLite() {
+		return squirrel.Eq{column: values}
+	}
+
+	return squirrel.Expr(column+" = ANY(?)", values)
+}
+
+// UntilZero is the Until of a filter for the events up to created_at 0.
+// nostr.Filter can't tell "until": 0 from no until, both leave Until at 0,
+// so a filter that means the former sets this instead. It can't come from a
+// REQ, as the library parses "until": 0 as no until. Since needs nothing of
+// the kind: since 0 and no since only differ for timestamps before 1970.
+const UntilZero = nostr.Timestamp(math.MinInt64)
+
+// Until returns the Until of a filter for the events up to ts, even if ts
+// is 0.
+func Until(ts nostr.Timestamp) nostr.Timestamp {
+	if ts == 0 {
+		return UntilZero
+	}
+	return ts
+}
+
+// untilBound returns the latest created_at filter selects, or false if any
+// will do.
+func untilBound(filter nostr.Filter) (nostr.Timestamp, bool) {
+	switch filter.Until {
+	case 0:
+		return 0, false
+	case UntilZero:
+		return 0, true
+	default:
+		return filter.Until, true
+	}
+}
+
 // buildTagFilteredQuery constructs a raw SQL query using a materialized CTE
 // to force PostgreSQL to resolve tag lookups via the covering index before
 // joining to the events table.
@@ -438,16 +692,14 @@ func (events *EventStore) buildSelectQuery(filter nostr.Filter) (squirrel.Select
 //
 //	WITH _tag_ids AS MATERIALIZED (
 //	    SELECT event_id FROM {event_tags}
-//	    WHERE key = $1 AND value IN ($2)
-//	    INTERSECT
-//	    SELECT event_id FROM {event_tags}
-//	    WHERE key = $3 AND value IN ($4)
+//	    WHERE (key = $1 AND value IN ($2)) OR (key = $3 AND value IN ($4))
+//	    GROUP BY event_id HAVING COUNT(DISTINCT key) = $5
 //	)
 //	SELECT e.id, e.created_at, e.kind, e.pubkey, e.content, e.tags, e.sig
 //	FROM {events} e
 //	JOIN _tag_ids t ON t.event_id = e.id
 //	WHERE e.kind IN ($5) AND e.created_at >= $6
-//	ORDER BY e.created_at DESC
+//	ORDER BY e.created_at DESC, e.id DESC
 //	LIMIT 1000
 //
 // Squirrel cannot express materialized CTEs, so we build the CTE prefix as
@@ -463,11 +715,28 @@ func (events *EventStore) buildTagFilteredQuery(filter nostr.Filter, tagFilters
 	panic("unreachable — see buildSelectQueryWithTags")
 }
 
-// DeleteEvent satisfies eventstore.Store; applies dbOpTimeout to the
-// delete. Internal callers with their own ctx should call deleteEventWith.
+// DeleteEvent deletes the event with id, or with storage.soft_delete only
+// marks it deleted, see softdelete.go.
 func (events *EventStore) DeleteEvent(id nostr.ID) error {
+	if events.Config.Storage.SoftDelete {
+		return events.backend().softDelete(id, nostr.Now())
+	}
+
+	return events.backend().delete(id)
+}
+
+// delete satisfies eventBackend; applies dbOpTimeout to the delete.
+// Internal callers with their own ctx should call deleteEventWith.
+func (events sqlEvents) delete(id nostr.ID) error {
 	ctx, cancel := context.WithTimeout(events.rootCtx, dbOpTimeout)
 	defer cancel()
+
+	release, err := events.slots.acquire(ctx, events.reserved)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	return events.deleteEventWith(ctx, GetDb(), id)
 }
 
@@ -478,10 +747,60 @@ func (events *EventStore) deleteEventWith(ctx context.Context, runner squirrel.B
 	return err
 }
 
+// ErrBadSignature is returned when VerifyOnSave is set and an event's
+// signature doesn't verify.
+var ErrBadSignature = errors.New(RejectInvalid.Reason("bad signature"))
+
+// ErrIDMismatch is returned for an event whose id isn't the hash of its
+// content. Clients compute ids themselves, so such an event could never be
+// referenced or deleted by them.
+var ErrIDMismatch = errors.New(RejectInvalid.Reason("event id does not match its content"))
+
+// ErrNotRelaySigned is returned for an event of a relay-only kind (see
+// IsRelayOnlyKind) that wasn't signed by the relay.
+var ErrNotRelaySigned = errors.New(RejectRestricted.Reason("only the relay can publish this kind of event"))
+
+// verify checks an event from outside the relay before it is written. The
+// id and author are always checked, since they're cheap; the signature only
+// with VerifyOnSave.
+func (events *EventStore) verify(evt nostr.Event) error {
+	if !evt.CheckID() {
+		return ErrIDMismatch
+	}
+
+	if IsRelayOnlyKind(evt.Kind) && !events.Config.IsSelf(evt.PubKey) {
+		return ErrNotRelaySigned
+	}
+
+	if events.VerifyOnSave && !evt.VerifySignature() {
+		return ErrBadSignature
+	}
+
+	return nil
+}
+
 func (events *EventStore) SaveEvent(evt nostr.Event) error {
+	if err := events.verify(evt); err != nil {
+		return err
+	}
+
+	return events.saveEvent(evt)
+}
+
+func (events *EventStore) saveEvent(evt nostr.Event) error {
+	return events.backend().save(evt)
+}
+
+func (events sqlEvents) save(evt nostr.Event) error {
 	ctx, cancel := context.WithTimeout(events.rootCtx, saveEventTxTimeout)
 	defer cancel()
 
+	release, err := events.slots.acquire(ctx, events.reserved)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	tx, err := GetDb().BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
@@ -507,19 +826,30 @@ func (events *EventStore) saveEventWith(ctx context.Context, runner squirrel.Bas
 		return fmt.Errorf("failed to marshal tags: %w", err)
 	}
 
+	columns := []string{"id", "created_at", "received_at", "kind", "pubkey", "tags", "sig"}
+	values := []any{
+		evt.ID.Hex(),
+		int64(evt.CreatedAt),
+		int64(receivedNow()),
+		int(evt.Kind),
+		evt.PubKey.Hex(),
+		string(tagsJSON),
+		hex.EncodeToString(evt.Sig[:]),
+	}
+	if events.compresses(evt.Content) {
+		contentColumns, contentValues := events.compressedColumns(evt.Content, string(tagsJSON))
+		columns = append(columns, contentColumns...)
+		values = append(values, contentValues...)
+	} else {
+		columns = append(columns, "content")
+		values = append(values, evt.Content)
+	}
+
 	// Insert the event, using ON CONFLICT to atomically detect duplicates.
 	// This is race-safe with PostgreSQL's concurrent connections (unlike SELECT-then-INSERT).
 	insertQb := sb.Insert(events.Schema.Prefix("events")).
-		Columns("id", "created_at", "kind", "pubkey", "content", "tags", "sig").
-		Values(
-			evt.ID.Hex(),
-			int64(evt.CreatedAt),
-			int(evt.Kind),
-			evt.PubKey.Hex(),
-			evt.Content,
-			string(tagsJSON),
-			hex.EncodeToString(evt.Sig[:]),
-		).
+		Columns(columns...).
+		Values(values...).
 		Suffix("ON CONFLICT(id) DO NOTHING")
 
 	result, err := insertQb.RunWith(runner).ExecContext(ctx)
@@ -539,9 +869,15 @@ func (events *EventStore) saveEventWith(ctx context.Context, runner squirrel.Bas
 	// matters most for kind-39002 (NIP-29 member list) saves — those run
 	// under SERIALIZABLE isolation and contention is dominated by the
 	// wall-clock duration of the critical section (issues #13, #16). If
-	// another column is ever added here the batch size must drop.
+	// another column is ever added here the batch size must drop. SQLite's
+	// limit is 32766, so it gets batches of 8000.
 	const tagInsertBatchSize = 15000
 
+	batchSize := tagInsertBatchSize
+	if usesSQLite() {
+		batchSize = 8000
+	}
+
 	eventID := evt.ID.Hex()
 	eventKind := int(evt.Kind)
 	tagsTable := events.Schema.Prefix("event_tags")
@@ -553,13 +889,11 @@ func (events *EventStore) saveEventWith(ctx context.Context, runner squirrel.Bas
 	batch := sb.Insert(tagsTable).Columns("event_id", "key", "value", "kind")
 	n := 0
 
-	for _, tag := range evt.Tags {
-		if len(tag) < 2 || len(tag[0]) != 1 {
-			continue
-		}
+	// See taglimits.go for which tags are left out
+	for _, tag := range events.indexedTags(evt) {
 		batch = batch.Values(eventID, tag[0], tag[1], eventKind)
 		n++
-		if n >= tagInsertBatchSize {
+		if n >= batchSize {
 			if _, err := batch.RunWith(runner).ExecContext(ctx); err != nil {
 				return fmt.Errorf("failed to save tags for event '%s': %w", evt.ID, err)
 			}
@@ -577,7 +911,32 @@ func (events *EventStore) saveEventWith(ctx context.Context, runner squirrel.Bas
 	return nil
 }
 
+// ErrMissingDTag is returned when an addressable event has no d tag. Storing
+// it would lump every such event from the author into a single d="" slot,
+// each one silently replacing the last.
+var ErrMissingDTag = errors.New("missing d tag")
+
 func (events *EventStore) ReplaceEvent(evt nostr.Event) error {
+	if err := events.verify(evt); err != nil {
+		return err
+	}
+
+	return events.replaceEvent(evt)
+}
+
+func (events *EventStore) replaceEvent(evt nostr.Event) error {
+	return events.replaceEventIn(events.backend(), evt)
+}
+
+func (events *EventStore) replaceEventIn(backend eventBackend, evt nostr.Event) error {
+	if evt.Kind.IsAddressable() && evt.Tags.Find("d") == nil {
+		return fmt.Errorf("kind %d event %s: %w", evt.Kind, evt.ID, ErrMissingDTag)
+	}
+
+	return backend.replace(evt)
+}
+
+func (events sqlEvents) replace(evt nostr.Event) error {
 	// Use a serializable transaction so the read-decide-write-delete cycle is
 	// atomic. Without this, two concurrent goroutines could both read "no
 	// existing event", both insert, and leave duplicate replaceable events.
@@ -649,7 +1008,14 @@ func (events *EventStore) ReplaceEvent(evt nostr.Event) error {
 	return fmt.Errorf("serialization conflict after %d attempts: %w", maxAttempts, err)
 }
 
-func (events *EventStore) replaceEventOnce(ctx context.Context, evt nostr.Event) error {
+func (events sqlEvents) replaceEventOnce(ctx context.Context, evt nostr.Event) error {
+	// The slot is held per attempt, so others can run during the backoff
+	release, err := events.slots.acquire(ctx, events.reserved)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	tx, err := GetDb().BeginTx(ctx, &sql.TxOptions{
 		Isolation: sql.LevelSerializable,
 	})
@@ -658,20 +1024,7 @@ func (events *EventStore) replaceEventOnce(ctx context.Context, evt nostr.Event)
 	}
 	defer tx.Rollback()
 
-	filter := nostr.Filter{Kinds: []nostr.Kind{evt.Kind}, Authors: []nostr.PubKey{evt.PubKey}}
-	if evt.Kind.IsAddressable() {
-		filter.Tags = nostr.TagMap{"d": []string{evt.Tags.GetD()}}
-	}
-
-	shouldSave := true
-	shouldDelete := make([]nostr.ID, 0)
-	for previous := range events.queryEventsWith(ctx, tx, filter, 0) {
-		if previous.CreatedAt <= evt.CreatedAt {
-			shouldDelete = append(shouldDelete, previous.ID)
-		} else {
-			shouldSave = false
-		}
-	}
+	shouldSave, shouldDelete := replacement(evt, events.queryEventsWith(ctx, tx, replaceableFilter(evt), 0, newestFirst))
 
 	if shouldSave {
 		if err := events.saveEventWith(ctx, tx, evt); err != nil && err != eventstore.ErrDupEvent {
@@ -688,11 +1041,56 @@ func (events *EventStore) replaceEventOnce(ctx context.Context, evt nostr.Event)
 	return tx.Commit()
 }
 
+// replacement decides what storing evt does to the events already in its
+// slot: whether evt is saved, and which of them it replaces.
+func replacement(evt nostr.Event, previous iter.Seq[nostr.Event]) (save bool, replaced []nostr.ID) {
+	save = true
+	for prev := range previous {
+		if prev.ID == evt.ID {
+			// Already stored; deleting it as "older" would lose it
+			save = false
+		} else if supersedes(evt, prev) {
+			replaced = append(replaced, prev.ID)
+		} else {
+			save = false
+		}
+	}
+
+	return save, replaced
+}
+
+// replaceableFilter matches the events occupying the same replaceable or
+// addressable slot as evt.
+func replaceableFilter(evt nostr.Event) nostr.Filter {
+	filter := nostr.Filter{Kinds: []nostr.Kind{evt.Kind}, Authors: []nostr.PubKey{evt.PubKey}}
+	if evt.Kind.IsAddressable() {
+		filter.Tags = nostr.TagMap{"d": []string{evt.Tags.GetD()}}
+	}
+
+	return filter
+}
+
+// supersedes reports whether evt replaces previous in the same slot. Per
+// NIP-01 the newer event wins, and on equal timestamps the one with the
+// lexically lowest ID is kept, so every relay converges on the same event
+// regardless of arrival order.
+func supersedes(evt nostr.Event, previous nostr.Event) bool {
+	if evt.CreatedAt != previous.CreatedAt {
+		return evt.CreatedAt > previous.CreatedAt
+	}
+
+	return bytes.Compare(evt.ID[:], previous.ID[:]) < 0
+}
+
 func (events *EventStore) CountEvents(filter nostr.Filter) (uint32, error) {
+	return events.backend().count(filter)
+}
+
+func (events sqlEvents) count(filter nostr.Filter) (uint32, error) {
 	// Strip limit for a true total count; ORDER BY in the subquery is
 	// optimized away by PostgreSQL's planner inside COUNT(*).
 	filter.Limit = 0
-	qb, err := events.buildSelectQuery(filter)
+	qb, err := events.buildSelectQuery(filter, newestFirst)
 	if err != nil {
 		return 0, fmt.Errorf("failed to build count query: %w", err)
 	}
@@ -703,6 +1101,12 @@ func (events *EventStore) CountEvents(filter nostr.Filter) (uint32, error) {
 	ctx, cancel := context.WithTimeout(events.rootCtx, dbOpTimeout)
 	defer cancel()
 
+	release, err := events.slots.acquire(ctx, events.reserved)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
 	var count uint32
 	if err := countQb.RunWith(GetDb()).QueryRowContext(ctx).Scan(&count); err != nil {
 		return 0, fmt.Errorf("failed to count events: %w", err)
@@ -711,26 +1115,122 @@ func (events *EventStore) CountEvents(filter nostr.Filter) (uint32, error) {
 	return count, nil
 }
 
+// membership looks up the put/remove events by pubkey's p tag rows, which
+// there are few of, and keeps the ones in group h. The id breaks ties between
+// events of the same second, so the answer doesn't flip between queries.
+func (events sqlEvents) membership(h string, pubkey nostr.PubKey) (nostr.Kind, bool, error) {
+	kinds := []int{int(nostr.KindSimpleGroupPutUser), int(nostr.KindSimpleGroupRemoveUser)}
+	// Nested, so with ? placeholders for the outer query to number
+	hTags := squirrel.Select("1").
+		From(events.Schema.Prefix("event_tags") + " h").
+		Where("h.event_id = e.id").
+		Where(squirrel.Eq{"h.key": "h", "h.value": h})
+
+	qb := sb.Select("e.kind").
+		From(events.Schema.Prefix("event_tags")+" p").
+		Join(events.Schema.Prefix("events")+" e ON e.id = p.event_id").
+		Where(squirrel.Eq{"p.key": "p", "p.value": pubkey.Hex()}).
+		Where(squirrel.Or{squirrel.Eq{"p.kind": kinds}, squirrel.Eq{"p.kind": nil}}).
+		Where(squirrel.Eq{"e.kind": kinds}).
+		Where("e.deleted_at IS NULL").
+		Where(squirrel.Expr("EXISTS (?)", hTags)).
+		OrderBy("e.created_at DESC", "e.id DESC").
+		Limit(1)
+
+	ctx, cancel := context.WithTimeout(events.rootCtx, dbOpTimeout)
+	defer cancel()
+
+	release, err := events.slots.acquire(ctx, events.reserved)
+	if err != nil {
+		return 0, false, err
+	}
+	defer release()
+
+	var kind int
+	if err := qb.RunWith(GetDb()).QueryRowContext(ctx).Scan(&kind); errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, fmt.Errorf("failed to look up group membership: %w", err)
+	}
+
+	return nostr.Kind(kind), true, nil
+}
+
 // Non-eventstore methods
 
+// GroupMembership reports whether pubkey's latest put/remove event in group
+// h added them, straight from the database.
+func (events *EventStore) GroupMembership(h string, pubkey nostr.PubKey) (bool, error) {
+	kind, found, err := events.backend().membership(h, pubkey)
+	if err != nil {
+		events.queryErrors.Add(1)
+		return false, err
+	}
+
+	return found && kind == nostr.KindSimpleGroupPutUser, nil
+}
+
 func (events *EventStore) StoreEvent(event nostr.Event) error {
+	if err := events.verify(event); err != nil {
+		return err
+	}
+
+	return events.storeEvent(event)
+}
+
+func (events *EventStore) storeEvent(event nostr.Event) error {
+	return events.storeEventIn(events.backend(), event)
+}
+
+func (events *EventStore) storeEventIn(backend eventBackend, event nostr.Event) error {
 	if event.Kind.IsReplaceable() || event.Kind.IsAddressable() {
-		return events.ReplaceEvent(event)
+		return events.replaceEventIn(backend, event)
 	}
 
-	if err := events.SaveEvent(event); err != nil && err != eventstore.ErrDupEvent {
+	if err := backend.save(event); err != nil && err != eventstore.ErrDupEvent {
 		return err
 	}
 
 	return nil
 }
 
+// ErrReadOnly is returned when the relay would write an event of its own while
+// in read-only maintenance mode.
+var ErrReadOnly = errors.New("relay is in read-only maintenance mode")
+
 func (events *EventStore) SignAndStoreEvent(event *nostr.Event, broadcast bool) error {
+	if events.Config.IsReadOnly() {
+		return ErrReadOnly
+	}
+
+	// The relay often rewrites its own lists several times a second. With
+	// NIP-01's lowest-ID tie-break a same-second update would lose to the
+	// version it's meant to replace about half the time, so step past the
+	// stored version's timestamp instead.
+	if event.Kind.IsReplaceable() || event.Kind.IsAddressable() {
+		event.PubKey = events.Config.GetSelf()
+		for previous := range events.reservedBackend().query(replaceableFilter(*event), 1, newestFirst) {
+			if previous.CreatedAt >= event.CreatedAt {
+				event.CreatedAt = previous.CreatedAt + 1
+			}
+		}
+	}
+
 	if err := events.Config.Sign(event); err != nil {
 		return err
 	}
 
-	if err := events.StoreEvent(*event); err != nil {
+	if events.transform != nil {
+		ctx, cancel := context.WithTimeout(events.rootCtx, dbOpTimeout)
+		defer cancel()
+
+		if err := events.transform(ctx, event); err != nil {
+			return err
+		}
+	}
+
+	// Just signed, so there's nothing to verify.
+	if err := events.storeEventIn(events.reservedBackend(), *event); err != nil {
 		return err
 	}
 
@@ -749,33 +1249,119 @@ func (events *EventStore) GetOrCreateApplicationSpecificData(d string) nostr.Eve
 		},
 	}
 
+	return events.getOrCreate("app-data:"+d, filter, func() nostr.Event {
+		return nostr.Event{
+			Kind:      nostr.KindApplicationSpecificData,
+			CreatedAt: nostr.Now(),
+			Tags: nostr.Tags{
+				[]string{"d", d},
+			},
+		}
+	})
+}
+
+// GetOrCreateRelayMembersList only trusts a list signed by this relay and
+// carrying the RELAY_MEMBERS_D tag, so a stray event of the same kind (synced
+// from elsewhere, or written by another relay sharing the schema) can't be
+// mistaken for the membership list.
+func (events *EventStore) GetOrCreateRelayMembersList() nostr.Event {
+	filter := nostr.Filter{
+		Kinds:   []nostr.Kind{RELAY_MEMBERS},
+		Authors: []nostr.PubKey{events.Config.GetSelf()},
+		Tags: nostr.TagMap{
+			"d": []string{RELAY_MEMBERS_D},
+		},
+	}
+
+	return events.getOrCreate("relay-members", filter, func() nostr.Event {
+		// Lists written before the d tag was introduced are migrated by
+		// re-signing them with the tag added.
+		legacy := nostr.Filter{
+			Kinds:   []nostr.Kind{RELAY_MEMBERS},
+			Authors: []nostr.PubKey{events.Config.GetSelf()},
+		}
+
+		for event := range events.QueryEvents(legacy, 1) {
+			event.Tags = append(event.Tags, nostr.Tag{"d", RELAY_MEMBERS_D})
+			event.CreatedAt = max(nostr.Now(), event.CreatedAt+1)
+			return event
+		}
+
+		return nostr.Event{
+			Kind:      RELAY_MEMBERS,
+			CreatedAt: nostr.Now(),
+			Tags: nostr.Tags{
+				[]string{"-"},
+				[]string{"d", RELAY_MEMBERS_D},
+			},
+		}
+	})
+}
+
+// getOrCreate returns the first event matching filter, or stores the result
+// of create if there is none. Creation happens under a Postgres advisory lock
+// keyed by schema and name, and the query is repeated once the lock is held,
+// so relay processes sharing a schema (including an old and new process
+// overlapping during a deploy) can't each create their own empty event and
+// have the fresher one silently replace the other's. If the lock can't be
+// taken or the event can't be stored (e.g. read-only mode), the unsaved event
+// is returned, which is how this behaved before locking.
+func (events *EventStore) getOrCreate(name string, filter nostr.Filter, create func() nostr.Event) nostr.Event {
+	failures := events.queryErrors.Load()
 	for event := range events.QueryEvents(filter, 1) {
 		return event
 	}
 
-	return nostr.Event{
-		Kind:      nostr.KindApplicationSpecificData,
-		CreatedAt: nostr.Now(),
-		Tags: nostr.Tags{
-			[]string{"d", d},
-		},
+	// If the lookup failed the event may well exist, and storing a new one
+	// would replace it
+	if events.queryErrors.Load() != failures {
+		log.Printf("Not creating %q, looking it up failed", name)
+		return create()
 	}
-}
 
-func (events *EventStore) GetOrCreateRelayMembersList() nostr.Event {
-	filter := nostr.Filter{
-		Kinds: []nostr.Kind{RELAY_MEMBERS},
+	if usesSQLite() || usesMemory() {
+		return events.getOrCreateLocally(name, filter, create)
 	}
 
-	for event := range events.QueryEvents(filter, 1) {
+	ctx, cancel := context.WithTimeout(events.rootCtx, dbOpTimeout)
+	defer cancel()
+
+	// The lock is transaction-scoped so it's released on commit/rollback
+	// even if this goroutine panics.
+	tx, err := GetDb().BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("Failed to lock %q for creation: %v", name, err)
+		return create()
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", events.advisoryLockKey(name)); err != nil {
+		log.Printf("Failed to lock %q for creation: %v", name, err)
+		return create()
+	}
+
+	for event := range events.queryEventsWith(ctx, tx, filter, 1, newestFirst) {
 		return event
 	}
 
-	return nostr.Event{
-		Kind:      RELAY_MEMBERS,
-		CreatedAt: nostr.Now(),
-		Tags: nostr.Tags{
-			[]string{"-"},
-		},
+	event := create()
+	if err := events.SignAndStoreEvent(&event, false); err != nil && !errors.Is(err, ErrReadOnly) {
+		log.Printf("Failed to create %q: %v", name, err)
 	}
+
+	return event
+}
+
+// advisoryLockKey maps name to a pg_advisory_lock key that is unique per schema.
+func (events *EventStore) advisoryLockKey(name string) int64 {
+	return schemaLockKey(events.Schema.Name, name)
+}
+
+// schemaLockKey maps name to a pg_advisory_lock key that is unique to schema.
+func schemaLockKey(schema, name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(schema))
+	h.Write([]byte{0})
+	h.Write([]byte(name))
+	return int64(h.Sum64())
 }
@@ -1,18 +1,40 @@
 package zooid
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"os"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"fiatjaf.com/nostr"
 )
 
+// testNativeSchema runs the database tests against native schemas (see
+// storage.native_schema) when ZOOID_TEST_NATIVE_SCHEMA is set. CI runs them
+// both ways.
+var testNativeSchema = os.Getenv("ZOOID_TEST_NATIVE_SCHEMA") != ""
+
+// testSchemaName returns a fresh schema name starting with prefix.
+func testSchemaName(prefix string) string {
+	return prefix + strings.ToLower(RandomString(8))
+}
+
+// testSchema returns a fresh schema whose name starts with prefix.
+func testSchema(prefix string) *Schema {
+	return &Schema{Name: testSchemaName(prefix), Native: testNativeSchema}
+}
+
 func createTestEventStore() *EventStore {
-	schema := &Schema{Name: "test_" + RandomString(8)}
+	schema := testSchema("test_")
 	config := &Config{
 		Host:   "test.com",
 		secret: nostr.Generate(),
@@ -269,6 +291,58 @@ func TestEventStore_QueryEvents_TimeRange(t *testing.T) {
 	}
 }
 
+func TestEventStore_QueryEvents_ZeroTimestamps(t *testing.T) {
+	store := createTestEventStore()
+	store.Init()
+
+	// Imported data has events from timestamp 0
+	secret := nostr.Generate()
+	byTime := make(map[nostr.Timestamp]nostr.ID)
+	for _, at := range []nostr.Timestamp{0, 1, 1000} {
+		event := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: at, Content: "at " + strconv.Itoa(int(at))}
+		event.Sign(secret)
+		if err := store.SaveEvent(event); err != nil {
+			t.Fatal(err)
+		}
+		byTime[at] = event.ID
+	}
+
+	times := func(filter nostr.Filter) []nostr.Timestamp {
+		filter.Authors = []nostr.PubKey{secret.Public()}
+		var result []nostr.Timestamp
+		for event := range store.QueryEvents(filter, 0) {
+			if byTime[event.CreatedAt] != event.ID {
+				t.Errorf("unexpected event %s", event.ID)
+			}
+			result = append(result, event.CreatedAt)
+		}
+		return result
+	}
+
+	for _, tc := range []struct {
+		name   string
+		filter nostr.Filter
+		want   []nostr.Timestamp
+	}{
+		{"no bounds", nostr.Filter{}, []nostr.Timestamp{1000, 1, 0}},
+		{"until 0", nostr.Filter{Until: Until(0)}, []nostr.Timestamp{0}},
+		{"until 1", nostr.Filter{Until: Until(1)}, []nostr.Timestamp{1, 0}},
+		{"since 1", nostr.Filter{Since: 1}, []nostr.Timestamp{1000, 1}},
+		{"since 0", nostr.Filter{Since: 0}, []nostr.Timestamp{1000, 1, 0}},
+		{"since 0 until 0", nostr.Filter{Until: UntilZero}, []nostr.Timestamp{0}},
+		// What a REQ with "until": 0 turns into
+		{"unset until", nostr.Filter{Until: 0}, []nostr.Timestamp{1000, 1, 0}},
+	} {
+		if got := times(tc.filter); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	if n, err := store.CountEvents(nostr.Filter{Authors: []nostr.PubKey{secret.Public()}, Until: UntilZero}); err != nil || n != 1 {
+		t.Errorf("CountEvents until 0 = %d %v, want 1", n, err)
+	}
+}
+
 func TestEventStore_QueryEvents_Limit(t *testing.T) {
 	store := createTestEventStore()
 	store.Init()
@@ -291,6 +365,110 @@ func TestEventStore_QueryEvents_Limit(t *testing.T) {
 	}
 }
 
+func TestEventStore_QueryEventsOldestFirst(t *testing.T) {
+	store := createTestEventStore()
+	store.Init()
+
+	// Put and remove events of a group, several in the same second and one
+	// tagged with another group
+	secret := nostr.Generate()
+	user := nostr.Generate().Public().Hex()
+	var saved []nostr.Event
+	for i, at := range []nostr.Timestamp{100, 200, 200, 200, 300, 400, 500} {
+		kind := nostr.KindSimpleGroupPutUser
+		if i%2 == 1 {
+			kind = nostr.KindSimpleGroupRemoveUser
+		}
+		h := "replayed"
+		if i == 4 {
+			h = "elsewhere"
+		}
+		event := nostr.Event{Kind: kind, CreatedAt: at, Content: strconv.Itoa(i), Tags: nostr.Tags{{"h", h}, {"p", user}}}
+		event.Sign(secret)
+		if err := store.SaveEvent(event); err != nil {
+			t.Fatal(err)
+		}
+		saved = append(saved, event)
+	}
+
+	ids := func(events []nostr.Event) []nostr.ID {
+		result := make([]nostr.ID, len(events))
+		for i, event := range events {
+			result[i] = event.ID
+		}
+		return result
+	}
+
+	filter := nostr.Filter{
+		Kinds: []nostr.Kind{nostr.KindSimpleGroupPutUser, nostr.KindSimpleGroupRemoveUser},
+		Tags:  nostr.TagMap{"h": []string{"replayed"}},
+	}
+	got := slices.Collect(store.QueryEventsOldestFirst(filter, 0))
+
+	// The same events the old path collected and sorted, in the same order
+	want := slices.Collect(store.QueryEvents(filter, 0))
+	slices.SortFunc(want, CompareEvents)
+	if !slices.Equal(ids(got), ids(want)) {
+		t.Errorf("oldest first = %v, want %v", ids(got), ids(want))
+	}
+	if len(got) != 6 {
+		t.Errorf("got %d events, want 6", len(got))
+	}
+
+	// Without ties, it's what reversing the newest first gave
+	noTies := nostr.Filter{Kinds: filter.Kinds, Tags: filter.Tags, Since: 300}
+	reversed := Reversed(slices.Collect(store.QueryEvents(noTies, 0)))
+	if got := slices.Collect(store.QueryEventsOldestFirst(noTies, 0)); len(got) != 2 || !slices.Equal(ids(got), ids(reversed)) {
+		t.Errorf("oldest first since 300 = %v, want %v", ids(got), ids(reversed))
+	}
+
+	// A limit keeps the oldest
+	if got := slices.Collect(store.QueryEventsOldestFirst(filter, 2)); !slices.Equal(ids(got), ids(want[:2])) {
+		t.Errorf("oldest two = %v, want %v", ids(got), ids(want[:2]))
+	}
+
+	// REQs still get the newest first
+	if newest := slices.Collect(store.QueryEvents(filter, 1)); len(newest) != 1 || newest[0].CreatedAt != 500 {
+		t.Errorf("newest = %v, want an event from 500", newest)
+	}
+}
+
+func TestEventStore_QueryEvents_SameSecondLatest(t *testing.T) {
+	store := createTestEventStore()
+	store.Init()
+
+	// Two versions of the relay's app data from the same second, both
+	// stored, as when one superseded the other before replacement ran
+	at := nostr.Now()
+	var versions []nostr.Event
+	for _, content := range []string{"first", "second", "third"} {
+		event := nostr.Event{Kind: nostr.KindApplicationSpecificData, CreatedAt: at, Content: content, Tags: nostr.Tags{{"d", "settings"}}}
+		event.Sign(store.Config.secret)
+		if err := store.SaveEvent(event); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, event)
+	}
+	want := slices.MaxFunc(versions, CompareEvents)
+
+	filter := nostr.Filter{Kinds: []nostr.Kind{nostr.KindApplicationSpecificData}, Tags: nostr.TagMap{"d": []string{"settings"}}}
+	for range 10 {
+		latest := slices.Collect(store.QueryEvents(filter, 1))
+		if len(latest) != 1 || latest[0].ID != want.ID {
+			t.Fatalf("limit-1 query = %v, want the larger id %s", latest, want.ID)
+		}
+		if got := store.GetOrCreateApplicationSpecificData("settings"); got.ID != want.ID {
+			t.Fatalf("GetOrCreateApplicationSpecificData = %s (%q), want the larger id %s", got.ID, got.Content, want.ID)
+		}
+	}
+
+	// Without tags too
+	latest := slices.Collect(store.QueryEvents(nostr.Filter{Kinds: filter.Kinds}, 1))
+	if len(latest) != 1 || latest[0].ID != want.ID {
+		t.Errorf("limit-1 query without tags = %v, want the larger id %s", latest, want.ID)
+	}
+}
+
 func TestEventStore_QueryEvents_MaxLimitCapsUnlimitedFilter(t *testing.T) {
 	store := createTestEventStore()
 	store.Init()
@@ -505,6 +683,7 @@ func TestEventStore_ReplaceEvent_OlderEvent(t *testing.T) {
 // ReplaceEvent tries to touch the same rows. The first attempt should fail
 // with SQLSTATE 40001 and the retry should succeed.
 func TestEventStore_ReplaceEvent_SerializationRetry(t *testing.T) {
+	skipOnMemory(t, "transactions")
 	store := createTestEventStore()
 	store.Init()
 
@@ -664,6 +843,7 @@ func TestEventStore_ReplaceEvent_PoolSaturation_Issue18(t *testing.T) {
 // instead of parking forever when the pool is full.
 func withSaturatedPool(t *testing.T, body func()) {
 	t.Helper()
+	skipOnMemory(t, "connection pool")
 	db := GetDb()
 
 	// Capture the live pool size so we don't leak a hard-coded value into
@@ -925,7 +1105,7 @@ func TestEventStore_SaveEvent_LargeMemberListExceedsPgParamLimit(t *testing.T) {
 		CreatedAt: nostr.Now(),
 		Tags:      tags,
 	}
-	evt.Sign(nostr.Generate())
+	evt.Sign(store.Config.secret)
 
 	if err := store.SaveEvent(evt); err != nil {
 		t.Fatalf("SaveEvent() with %d single-letter tags failed: %v", memberCount, err)
@@ -1033,9 +1213,135 @@ func TestEventStore_GetOrCreateApplicationSpecificData(t *testing.T) {
 	}
 }
 
+// Two relays receiving the same pair of equal-timestamp replaceable events in
+// opposite orders must keep the same one: the lowest ID, per NIP-01.
+func TestEventStore_ReplaceEvent_EqualTimestampTieBreak(t *testing.T) {
+	for _, kind := range []nostr.Kind{nostr.KindProfileMetadata, nostr.KindApplicationSpecificData} {
+		secret := nostr.Generate()
+		createdAt := nostr.Now()
+
+		a := nostr.Event{Kind: kind, CreatedAt: createdAt, Content: "a", Tags: nostr.Tags{{"d", "slot"}}}
+		b := nostr.Event{Kind: kind, CreatedAt: createdAt, Content: "b", Tags: nostr.Tags{{"d", "slot"}}}
+		a.Sign(secret)
+		b.Sign(secret)
+
+		want := a.ID
+		if bytes.Compare(b.ID[:], a.ID[:]) < 0 {
+			want = b.ID
+		}
+
+		for _, order := range [][]nostr.Event{{a, b}, {b, a}} {
+			store := createTestEventStore()
+			store.Init()
+
+			for _, evt := range order {
+				if err := store.ReplaceEvent(evt); err != nil {
+					t.Fatalf("ReplaceEvent: %v", err)
+				}
+			}
+
+			var got []nostr.ID
+			for evt := range store.QueryEvents(replaceableFilter(a), 0) {
+				got = append(got, evt.ID)
+			}
+
+			if len(got) != 1 || got[0] != want {
+				t.Errorf("kind %d, order %s then %s: stored %v, want only %s",
+					kind, order[0].Content, order[1].Content, got, want)
+			}
+		}
+	}
+}
+
+func TestEventStore_SignAndStoreEvent_SameSecondUpdate(t *testing.T) {
+	store := createTestEventStore()
+	store.Init()
+
+	createdAt := nostr.Now()
+	for i := 0; i < 5; i++ {
+		event := nostr.Event{
+			Kind:      nostr.KindApplicationSpecificData,
+			CreatedAt: createdAt,
+			Content:   fmt.Sprint(i),
+			Tags:      nostr.Tags{{"d", "zooid/rapid"}},
+		}
+		if err := store.SignAndStoreEvent(&event, false); err != nil {
+			t.Fatalf("SignAndStoreEvent: %v", err)
+		}
+	}
+
+	event := store.GetOrCreateApplicationSpecificData("zooid/rapid")
+	if event.Content != "4" {
+		t.Errorf("latest content = %q, want the last write %q", event.Content, "4")
+	}
+}
+
+// Two processes sharing a schema must not each create their own empty list.
+func TestEventStore_GetOrCreateApplicationSpecificData_Concurrent(t *testing.T) {
+	store := createTestEventStore()
+	store.Init()
+
+	// A second store on the same schema stands in for another relay process
+	other := &EventStore{
+		Config:  store.Config,
+		Schema:  &Schema{Name: store.Schema.Name, Native: store.Schema.Native},
+		rootCtx: context.Background(),
+	}
+
+	results := make([]nostr.Event, 2)
+	var wg sync.WaitGroup
+	for i, s := range []*EventStore{store, other} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = s.GetOrCreateApplicationSpecificData("zooid/concurrent")
+		}()
+	}
+	wg.Wait()
+
+	if results[0].ID != results[1].ID {
+		t.Errorf("concurrent get-or-create returned different events: %s vs %s", results[0].ID, results[1].ID)
+	}
+
+	filter := nostr.Filter{
+		Kinds: []nostr.Kind{nostr.KindApplicationSpecificData},
+		Tags:  nostr.TagMap{"d": []string{"zooid/concurrent"}},
+	}
+	if count, err := store.CountEvents(filter); err != nil || count != 1 {
+		t.Errorf("stored events = (%d, %v), want exactly 1", count, err)
+	}
+}
+
+func TestEventStore_GetOrCreateRelayMembersList_Concurrent(t *testing.T) {
+	store := createTestEventStore()
+	store.Init()
+
+	results := make([]nostr.Event, 10)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = store.GetOrCreateRelayMembersList()
+		}()
+	}
+	wg.Wait()
+
+	for _, event := range results[1:] {
+		if event.ID != results[0].ID {
+			t.Fatalf("concurrent get-or-create returned different events: %s vs %s", results[0].ID, event.ID)
+		}
+	}
+
+	if count, err := store.CountEvents(nostr.Filter{Kinds: []nostr.Kind{RELAY_MEMBERS}}); err != nil || count != 1 {
+		t.Errorf("stored members lists = (%d, %v), want exactly 1", count, err)
+	}
+}
+
 // TestEventStore_SaveEvent_PopulatesTagKind verifies that the kind
 // denormalization on event_tags actually populates on insert. Issue #23.
 func TestEventStore_SaveEvent_PopulatesTagKind(t *testing.T) {
+	skipOnMemory(t, "event_tags table")
 	store := createTestEventStore()
 	if err := store.Init(); err != nil {
 		t.Fatalf("Init: %v", err)
@@ -1156,7 +1462,7 @@ func TestEventStore_QueryEvents_TagAndKindCTE(t *testing.T) {
 	// close `)<whitespace>SELECT`. Both lazy quantifiers anchor to
 	// the closest CTE end, so an outer-only `e.kind` doesn't satisfy
 	// it (there is no `) SELECT` after the outer query's kind).
-	qb, err := store.buildSelectQuery(filter)
+	qb, err := store.buildSelectQuery(filter, newestFirst)
 	if err != nil {
 		t.Fatalf("buildSelectQuery: %v", err)
 	}
@@ -1184,23 +1490,25 @@ func TestEventStore_QueryEvents_TagAndKindCTE(t *testing.T) {
 	}
 }
 
-// TestEventStore_Init_UpgradeFromPre002 simulates the production
+// TestEventStore_Init_UpgradeFromPre003 simulates the production
 // upgrade path: a schema that was already initialized before
-// migration 002 existed. The `event_tags.kind` column is missing, the
-// kvstore has no row for `migration:.../002_event_tags_kind.sql`, and
+// migration 003 existed. The `event_tags.kind` column is missing, the
+// schema_migrations has no row for 003_event_tags_kind, and
 // the new code path's startup index references the column.
 //
 // Init() must:
 //  1. Defer index creation until AFTER migrations run, so the
 //     post-migrate `(key, value, kind, event_id)` index doesn't try to
 //     reference a column that doesn't exist yet.
-//  2. Apply migration 002 to add the column.
+//  2. Apply migration 003 to add the column.
 //  3. Then create the new covering index successfully.
 //
 // This is the test that would have caught the original ordering bug
 // where the index was created in the same pre-migration block as the
 // base table.
-func TestEventStore_Init_UpgradeFromPre002(t *testing.T) {
+func TestEventStore_Init_UpgradeFromPre003(t *testing.T) {
+	skipOnSQLite(t, "migrations")
+	skipOnMemory(t, "migrations")
 	store := createTestEventStore()
 
 	// Initial Init: gives us a fully-up-to-date schema.
@@ -1208,12 +1516,12 @@ func TestEventStore_Init_UpgradeFromPre002(t *testing.T) {
 		t.Fatalf("first Init: %v", err)
 	}
 
-	// Now reverse-engineer the pre-002 production state:
+	// Now reverse-engineer the pre-003 production state:
 	//  - drop the kind column
 	//  - drop the new covering index
-	//  - delete the kv row marking 002 as applied so migrations re-run
+	//  - delete the rows marking 003 on as applied so migrations re-run
 	tagsTable := store.Schema.Prefix("event_tags")
-	indexName := store.Schema.Name + "__idx_event_tags_key_value_kind_event_id"
+	indexName := store.Schema.Prefix("idx_event_tags_key_value_kind_event_id")
 
 	if _, err := GetDb().ExecContext(store.rootCtx, "DROP INDEX IF EXISTS "+indexName); err != nil {
 		t.Fatalf("drop index: %v", err)
@@ -1221,17 +1529,14 @@ func TestEventStore_Init_UpgradeFromPre002(t *testing.T) {
 	if _, err := GetDb().ExecContext(store.rootCtx, "ALTER TABLE "+tagsTable+" DROP COLUMN IF EXISTS kind"); err != nil {
 		t.Fatalf("drop column: %v", err)
 	}
-	kvKey := fmt.Sprintf("migration:%s:002_event_tags_kind.sql", store.Schema.Name)
-	if _, err := GetDb().ExecContext(store.rootCtx, "DELETE FROM kv WHERE key = $1", kvKey); err != nil {
-		t.Fatalf("delete migration marker: %v", err)
-	}
+	forgetMigrations(t, store.Schema, 2)
 
 	// Sanity-check: column really is gone.
 	var hasKind bool
 	if err := GetDb().QueryRowContext(store.rootCtx,
-		"SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE LOWER(table_name)=LOWER($1) AND column_name='kind')",
+		"SELECT EXISTS (SELECT 1 FROM pg_attribute WHERE attrelid = to_regclass($1) AND attname = 'kind' AND NOT attisdropped)",
 		tagsTable).Scan(&hasKind); err != nil {
-		t.Fatalf("information_schema check: %v", err)
+		t.Fatalf("pg_attribute check: %v", err)
 	}
 	if hasKind {
 		t.Fatalf("expected kind column to be dropped before upgrade test")
@@ -1246,18 +1551,18 @@ func TestEventStore_Init_UpgradeFromPre002(t *testing.T) {
 
 	// Column and index must exist after the upgrade.
 	if err := GetDb().QueryRowContext(store.rootCtx,
-		"SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE LOWER(table_name)=LOWER($1) AND column_name='kind')",
+		"SELECT EXISTS (SELECT 1 FROM pg_attribute WHERE attrelid = to_regclass($1) AND attname = 'kind' AND NOT attisdropped)",
 		tagsTable).Scan(&hasKind); err != nil {
-		t.Fatalf("information_schema re-check: %v", err)
+		t.Fatalf("pg_attribute re-check: %v", err)
 	}
 	if !hasKind {
-		t.Errorf("kind column not added by migration 002")
+		t.Errorf("kind column not added by migration 003")
 	}
 
 	var hasIndex bool
 	if err := GetDb().QueryRowContext(store.rootCtx,
-		"SELECT EXISTS (SELECT 1 FROM pg_indexes WHERE LOWER(indexname)=LOWER($1))", indexName).Scan(&hasIndex); err != nil {
-		t.Fatalf("pg_indexes re-check: %v", err)
+		"SELECT to_regclass($1) IS NOT NULL", indexName).Scan(&hasIndex); err != nil {
+		t.Fatalf("index re-check: %v", err)
 	}
 	if !hasIndex {
 		t.Errorf("post-migrate index %s not created", indexName)
@@ -1266,10 +1571,11 @@ func TestEventStore_Init_UpgradeFromPre002(t *testing.T) {
 
 // TestEventStore_QueryEvents_TagKindNullCompat ensures the read path
 // still returns historical event_tags rows whose `kind` column is NULL
-// (the state during the backfill window after migration 002 lands but
+// (the state during the backfill window after migration 003 lands but
 // before the dbops UPDATE has run). The CTE uses
 // `kind IN (...) OR kind IS NULL` to keep these rows visible. Issue #23.
 func TestEventStore_QueryEvents_TagKindNullCompat(t *testing.T) {
+	skipOnMemory(t, "event_tags table")
 	store := createTestEventStore()
 	if err := store.Init(); err != nil {
 		t.Fatalf("Init: %v", err)
@@ -1308,3 +1614,350 @@ func TestEventStore_QueryEvents_TagKindNullCompat(t *testing.T) {
 		t.Errorf("returned wrong event")
 	}
 }
+
+func TestEventStore_ReplaceEvent_MissingDTag(t *testing.T) {
+	store := createTestEventStore()
+	store.Init()
+
+	for _, kind := range []nostr.Kind{nostr.KindSimpleGroupMetadata, nostr.KindApplicationSpecificData} {
+		evt := nostr.Event{Kind: kind, CreatedAt: nostr.Now(), Content: "no d tag"}
+		evt.Sign(store.Config.secret)
+
+		if err := store.ReplaceEvent(evt); !errors.Is(err, ErrMissingDTag) {
+			t.Errorf("kind %d: ReplaceEvent error = %v, want ErrMissingDTag", kind, err)
+		}
+
+		if count, _ := store.CountEvents(nostr.Filter{Kinds: []nostr.Kind{kind}}); count != 0 {
+			t.Errorf("kind %d: %d events stored, want 0", kind, count)
+		}
+	}
+
+	// An explicitly empty d tag is a valid address
+	evt := nostr.Event{Kind: nostr.KindApplicationSpecificData, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"d", ""}}}
+	evt.Sign(nostr.Generate())
+	if err := store.ReplaceEvent(evt); err != nil {
+		t.Errorf("ReplaceEvent with empty d tag: %v", err)
+	}
+}
+
+// Multi-key tag filters are resolved in a single GROUP BY pass over
+// event_tags; results must match AND-across-keys, OR-within-key semantics.
+func TestEventStore_QueryEvents_TagFilterMatrix(t *testing.T) {
+	store := createTestEventStore()
+	store.Init()
+
+	secret := nostr.Generate()
+	pA := nostr.Generate().Public().Hex()
+	pB := nostr.Generate().Public().Hex()
+
+	save := func(kind nostr.Kind, tags nostr.Tags) nostr.ID {
+		evt := nostr.Event{Kind: kind, CreatedAt: nostr.Now(), Content: RandomString(8), Tags: tags}
+		evt.Sign(secret)
+		if err := store.SaveEvent(evt); err != nil {
+			t.Fatalf("SaveEvent: %v", err)
+		}
+		return evt.ID
+	}
+
+	hOnly := save(9, nostr.Tags{{"h", "g1"}})
+	hp := save(9, nostr.Tags{{"h", "g1"}, {"p", pA}})
+	hpp := save(9, nostr.Tags{{"h", "g1"}, {"p", pA}, {"p", pB}})
+	hpt := save(9, nostr.Tags{{"h", "g1"}, {"p", pB}, {"t", "news"}})
+	hpKind := save(9000, nostr.Tags{{"h", "g1"}, {"p", pA}})
+	otherGroup := save(9, nostr.Tags{{"h", "g2"}, {"p", pA}, {"t", "news"}})
+	twoGroups := save(9, nostr.Tags{{"h", "g1"}, {"h", "g2"}, {"p", pB}})
+
+	tests := []struct {
+		name   string
+		filter nostr.Filter
+		want   []nostr.ID
+	}{
+		{"one key", nostr.Filter{Tags: nostr.TagMap{"h": {"g1"}}},
+			[]nostr.ID{hOnly, hp, hpp, hpt, hpKind, twoGroups}},
+		{"one key with kinds", nostr.Filter{Kinds: []nostr.Kind{9}, Tags: nostr.TagMap{"h": {"g1"}}},
+			[]nostr.ID{hOnly, hp, hpp, hpt, twoGroups}},
+		{"two keys", nostr.Filter{Tags: nostr.TagMap{"h": {"g1"}, "p": {pA}}},
+			[]nostr.ID{hp, hpp, hpKind}},
+		{"two keys with kinds", nostr.Filter{Kinds: []nostr.Kind{9}, Tags: nostr.TagMap{"h": {"g1"}, "p": {pA}}},
+			[]nostr.ID{hp, hpp}},
+		{"two keys, several values each", nostr.Filter{Tags: nostr.TagMap{"h": {"g1", "g2"}, "p": {pA, pB}}},
+			[]nostr.ID{hp, hpp, hpt, hpKind, otherGroup, twoGroups}},
+		{"three keys", nostr.Filter{Tags: nostr.TagMap{"h": {"g1"}, "p": {pA, pB}, "t": {"news"}}},
+			[]nostr.ID{hpt}},
+		{"three keys with kinds", nostr.Filter{Kinds: []nostr.Kind{9000}, Tags: nostr.TagMap{"h": {"g1"}, "p": {pA}, "t": {"news"}}},
+			nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make(map[nostr.ID]bool)
+			for evt := range store.QueryEvents(tt.filter, 0) {
+				if got[evt.ID] {
+					t.Errorf("event %s returned twice", evt.ID)
+				}
+				got[evt.ID] = true
+			}
+
+			if len(got) != len(tt.want) {
+				t.Errorf("got %d events, want %d", len(got), len(tt.want))
+			}
+			for _, id := range tt.want {
+				if !got[id] {
+					t.Errorf("missing event %s", id)
+				}
+			}
+		})
+	}
+}
+
+func TestInList(t *testing.T) {
+	skipOnSQLite(t, "arrays")
+	tests := []struct {
+		n        int
+		wantSQL  string
+		wantArgs int
+	}{
+		{1, "id IN ($1)", 1},
+		{inListArrayThreshold, "id IN ($1,$2,$3,$4,$5,$6,$7,$8)", inListArrayThreshold},
+		{10, "id = ANY($1)", 1},
+		{1000, "id = ANY($1)", 1},
+	}
+
+	for _, tt := range tests {
+		values := make([]string, tt.n)
+		for i := range values {
+			values[i] = fmt.Sprint(i)
+		}
+
+		sqlText, args, err := sb.Select("id").From("events").Where(inList("id", values)).ToSql()
+		if err != nil {
+			t.Fatalf("%d values: ToSql: %v", tt.n, err)
+		}
+		if !strings.Contains(sqlText, "WHERE "+tt.wantSQL) {
+			t.Errorf("%d values: SQL = %q, want %q", tt.n, sqlText, tt.wantSQL)
+		}
+		if len(args) != tt.wantArgs {
+			t.Errorf("%d values: %d args, want %d", tt.n, len(args), tt.wantArgs)
+		}
+	}
+}
+
+// Long id/author/kind lists bind a single array parameter. With
+// pg_stat_statements enabled, every such query normalizes to the same
+// `id = ANY($1)` entry regardless of list length, where IN lists produced one
+// entry per distinct length.
+func TestEventStore_QueryEvents_LongLists(t *testing.T) {
+	store := createTestEventStore()
+	store.Init()
+
+	secret := nostr.Generate()
+	var saved []nostr.ID
+	for i := 0; i < 12; i++ {
+		evt := nostr.Event{Kind: nostr.Kind(1 + i%3), CreatedAt: nostr.Now(), Content: fmt.Sprint(i)}
+		evt.Sign(secret)
+		if err := store.SaveEvent(evt); err != nil {
+			t.Fatalf("SaveEvent: %v", err)
+		}
+		saved = append(saved, evt.ID)
+	}
+
+	for _, n := range []int{1, 10, 1000} {
+		// Pad with ids that don't exist to reach n
+		ids := make([]nostr.ID, 0, n)
+		ids = append(ids, saved[:min(n, len(saved))]...)
+		for len(ids) < n {
+			ids = append(ids, nostr.ID(nostr.Generate().Public()))
+		}
+
+		authors := make([]nostr.PubKey, n)
+		authors[0] = secret.Public()
+		for i := 1; i < n; i++ {
+			authors[i] = nostr.Generate().Public()
+		}
+
+		kinds := make([]nostr.Kind, n)
+		for i := range kinds {
+			kinds[i] = nostr.Kind(1 + i)
+		}
+
+		filter := nostr.Filter{IDs: ids, Authors: authors, Kinds: kinds}
+		count := 0
+		for range store.QueryEvents(filter, 0) {
+			count++
+		}
+
+		want := min(n, len(saved))
+		if count != want {
+			t.Errorf("%d-element lists: got %d events, want %d", n, count, want)
+		}
+	}
+}
+
+func TestEventStore_QueryEvents_NoLimitUsesMaxLimit(t *testing.T) {
+	store := createTestEventStore()
+	store.Init()
+
+	for i := 0; i < 8; i++ {
+		store.SaveEvent(createTestEvent(nostr.KindTextNote, fmt.Sprint(i)))
+	}
+
+	count := 0
+	for range store.QueryEvents(nostr.Filter{Kinds: []nostr.Kind{nostr.KindTextNote}}, 5) {
+		count++
+	}
+	if count != 5 {
+		t.Errorf("no-limit query returned %d events, want maxLimit 5", count)
+	}
+
+	count = 0
+	for range store.QueryEvents(nostr.Filter{Kinds: []nostr.Kind{nostr.KindTextNote}, LimitZero: true}, 5) {
+		count++
+	}
+	if count != 0 {
+		t.Errorf("LimitZero query returned %d events, want 0", count)
+	}
+}
+
+func TestEventStore_VerifyOnSave(t *testing.T) {
+	store := createTestEventStore()
+	store.Init()
+
+	forged := createTestEvent(nostr.KindTextNote, "original")
+	forged.Content = "tampered"
+	forged.ID = forged.GetID()
+
+	if err := store.SaveEvent(forged); err != nil {
+		t.Fatalf("without VerifyOnSave the store should trust its caller, got %v", err)
+	}
+
+	store.VerifyOnSave = true
+
+	forged = createTestEvent(nostr.KindTextNote, "original")
+	forged.Content = "tampered"
+	forged.ID = forged.GetID()
+
+	if err := store.SaveEvent(forged); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("SaveEvent: expected ErrBadSignature, got %v", err)
+	}
+	if err := store.StoreEvent(forged); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("StoreEvent: expected ErrBadSignature, got %v", err)
+	}
+
+	profile := createTestEvent(nostr.KindProfileMetadata, "{}")
+	profile.Sig[0] ^= 0xff
+	if err := store.ReplaceEvent(profile); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("ReplaceEvent: expected ErrBadSignature, got %v", err)
+	}
+
+	if err := store.SaveEvent(createTestEvent(nostr.KindTextNote, "valid")); err != nil {
+		t.Errorf("valid events should still be saved, got %v", err)
+	}
+
+	own := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Content: "from the relay"}
+	if err := store.SignAndStoreEvent(&own, false); err != nil {
+		t.Errorf("SignAndStoreEvent should work with VerifyOnSave, got %v", err)
+	}
+}
+
+// BenchmarkVerifySignature is the per-event cost VerifyOnSave adds, without
+// any database time.
+func BenchmarkVerifySignature(b *testing.B) {
+	evt := createTestEvent(nostr.KindTextNote, strings.Repeat("hello nostr ", 40))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if !evt.VerifySignature() {
+			b.Fatal("signature should verify")
+		}
+	}
+}
+
+// BenchmarkSaveEvent_VerifyOnSave compares saves with and without the check,
+// to show how much of a save it accounts for.
+func BenchmarkSaveEvent_VerifyOnSave(b *testing.B) {
+	for _, verify := range []bool{false, true} {
+		b.Run(fmt.Sprintf("verify=%t", verify), func(b *testing.B) {
+			store := createTestEventStore()
+			store.Init()
+			store.VerifyOnSave = verify
+
+			evts := make([]nostr.Event, b.N)
+			for i := range evts {
+				evts[i] = createTestEvent(nostr.KindTextNote, fmt.Sprint(i))
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := store.SaveEvent(evts[i]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestEventStore_RejectsIDMismatch(t *testing.T) {
+	store := createTestEventStore()
+	store.Init()
+
+	evt := createTestEvent(nostr.KindTextNote, "original")
+	evt.Content = "changed after signing"
+
+	if err := store.SaveEvent(evt); !errors.Is(err, ErrIDMismatch) {
+		t.Errorf("SaveEvent: expected ErrIDMismatch, got %v", err)
+	}
+	if err := store.StoreEvent(evt); !errors.Is(err, ErrIDMismatch) {
+		t.Errorf("StoreEvent: expected ErrIDMismatch, got %v", err)
+	}
+	for range store.QueryEvents(nostr.Filter{IDs: []nostr.ID{evt.ID}}, 1) {
+		t.Error("mismatched event should not be stored")
+	}
+}
+
+func TestEventStore_FindCorruptEvents(t *testing.T) {
+	skipOnMemory(t, "corrupt rows")
+	store := createTestEventStore()
+	store.Init()
+
+	good := createTestEvent(nostr.KindTextNote, "good")
+	tampered := createTestEvent(nostr.KindTextNote, "tampered")
+	for _, evt := range []nostr.Event{good, tampered} {
+		if err := store.SaveEvent(evt); err != nil {
+			t.Fatalf("SaveEvent: %v", err)
+		}
+	}
+
+	// Simulate a row written before ids were checked.
+	_, err := GetDb().Exec("UPDATE "+store.Schema.Prefix("events")+" SET content = 'edited' WHERE id = $1", tampered.ID.Hex())
+	if err != nil {
+		t.Fatalf("tampering failed: %v", err)
+	}
+
+	corrupt, err := store.FindCorruptEvents(context.Background(), false)
+	if err != nil {
+		t.Fatalf("FindCorruptEvents: %v", err)
+	}
+	if len(corrupt) != 1 || corrupt[0].ID != tampered.ID.Hex() {
+		t.Fatalf("expected only the tampered event, got %+v", corrupt)
+	}
+
+	// Reporting alone leaves the row in place.
+	count, _ := store.CountEvents(nostr.Filter{})
+	if count != 2 {
+		t.Errorf("expected 2 events after a report-only scan, got %d", count)
+	}
+
+	if _, err := store.FindCorruptEvents(context.Background(), true); err != nil {
+		t.Fatalf("FindCorruptEvents(delete): %v", err)
+	}
+
+	count, _ = store.CountEvents(nostr.Filter{})
+	if count != 1 {
+		t.Errorf("expected 1 event after deleting corrupt rows, got %d", count)
+	}
+
+	corrupt, _ = store.FindCorruptEvents(context.Background(), false)
+	if len(corrupt) != 0 {
+		t.Errorf("expected no corrupt events left, got %+v", corrupt)
+	}
+}
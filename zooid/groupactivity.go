@@ -0,0 +1,429 @@
+package zooid
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"github.com/Masterminds/squirrel"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Group activity.
+//
+// Each group's chat messages and their authors are counted as they're saved,
+// along with its joins and leaves: the put user and remove user deltas the
+// relay signs for every change to its members, see memberdeltas.go. Counts
+// are kept a minute at a time over the last hour. Every metrics collection
+// exports, for the metrics.top_groups groups with the most messages in that
+// hour, messages, joins and leaves per minute over the last groupRateWindow
+// and the authors active in the hour, labelled by group. Private and hidden
+// groups are left out, as in the other per-group metrics, unless
+// metrics.hash_private is set, which labels them with a hash of their id
+// instead.
+//
+// Managers get every group's counts for the last 24 hours from
+// GET /admin/groups. Those come from the database, cached for statsCacheTTL.
+
+const (
+	// groupActivityWindow is how far back groups are ranked and authors
+	// counted.
+	groupActivityWindow = time.Hour
+
+	// groupRateWindow is how far back the per-minute rates are averaged.
+	groupRateWindow = 10 * time.Minute
+
+	defaultTopGroups = 20
+)
+
+var (
+	groupMessagesPerMinute = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zooid_group_messages_per_minute",
+		Help: "Chat messages per minute in the most active groups, over the last 10 minutes",
+	}, []string{"instance", "group"})
+
+	groupActiveAuthors = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zooid_group_active_authors",
+		Help: "Distinct authors of chat messages in the most active groups in the last hour",
+	}, []string{"instance", "group"})
+
+	groupJoinsPerMinute = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zooid_group_joins_per_minute",
+		Help: "Members added per minute in the most active groups, over the last 10 minutes",
+	}, []string{"instance", "group"})
+
+	groupLeavesPerMinute = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zooid_group_leaves_per_minute",
+		Help: "Members removed per minute in the most active groups, over the last 10 minutes",
+	}, []string{"instance", "group"})
+)
+
+func init() {
+	prometheus.MustRegister(groupMessagesPerMinute, groupActiveAuthors, groupJoinsPerMinute, groupLeavesPerMinute)
+}
+
+// groupActivityNow is the clock activity is counted by, swappable in tests.
+var groupActivityNow = time.Now
+
+// groupMinute is a group's counts in one minute, by Unix minute.
+type groupMinute struct {
+	minute                  int64
+	messages, joins, leaves int
+}
+
+// groupCounters is a group's activity over the last groupActivityWindow.
+type groupCounters struct {
+	minutes [60]groupMinute
+	authors map[nostr.PubKey]int64 // Unix minute of each author's last message
+}
+
+// groupActivity holds the counters of the groups with recent activity.
+type groupActivity struct {
+	mu     sync.Mutex
+	groups map[string]*groupCounters
+}
+
+// GroupActivity is a group's recent activity, for metrics.
+type GroupActivity struct {
+	Group             string
+	Messages          int     // in the last groupActivityWindow
+	MessagesPerMinute float64 // over the last groupRateWindow
+	JoinsPerMinute    float64
+	LeavesPerMinute   float64
+	ActiveAuthors     int
+}
+
+// recordActivity counts event towards its group's activity.
+func (g *GroupStore) recordActivity(event nostr.Event) {
+	h := GetGroupIDFromEvent(event)
+	if h == "" {
+		return
+	}
+
+	var messages, joins, leaves int
+	switch {
+	case slices.Contains(chatKinds, event.Kind):
+		messages = 1
+	case g.isMemberDelta(event) && event.Kind == nostr.KindSimpleGroupPutUser:
+		joins = 1
+	case g.isMemberDelta(event):
+		leaves = 1
+	default:
+		return
+	}
+
+	minute := groupActivityNow().Unix() / 60
+
+	g.activity.mu.Lock()
+	defer g.activity.mu.Unlock()
+
+	if g.activity.groups == nil {
+		g.activity.groups = make(map[string]*groupCounters)
+	}
+	counters := g.activity.groups[h]
+	if counters == nil {
+		counters = &groupCounters{authors: make(map[nostr.PubKey]int64)}
+		g.activity.groups[h] = counters
+	}
+
+	slot := &counters.minutes[minute%int64(len(counters.minutes))]
+	if slot.minute != minute {
+		*slot = groupMinute{minute: minute}
+	}
+	slot.messages += messages
+	slot.joins += joins
+	slot.leaves += leaves
+
+	if messages > 0 {
+		counters.authors[event.PubKey] = minute
+	}
+}
+
+// RecentActivity returns the groups active in the last groupActivityWindow,
+// most messages first, and forgets the others.
+func (g *GroupStore) RecentActivity() []GroupActivity {
+	now := groupActivityNow().Unix() / 60
+	since := now - int64(groupActivityWindow/time.Minute)
+	rateSince := now - int64(groupRateWindow/time.Minute)
+	rateMinutes := float64(groupRateWindow / time.Minute)
+
+	g.activity.mu.Lock()
+	defer g.activity.mu.Unlock()
+
+	result := make([]GroupActivity, 0, len(g.activity.groups))
+	for h, counters := range g.activity.groups {
+		activity := GroupActivity{Group: h}
+		var joins, leaves, recentMessages int
+		active := false
+		for _, slot := range counters.minutes {
+			if slot.minute <= since {
+				continue
+			}
+			active = true
+			activity.Messages += slot.messages
+			if slot.minute > rateSince {
+				recentMessages += slot.messages
+				joins += slot.joins
+				leaves += slot.leaves
+			}
+		}
+
+		for pubkey, minute := range counters.authors {
+			if minute <= since {
+				delete(counters.authors, pubkey)
+			}
+		}
+
+		if !active {
+			delete(g.activity.groups, h)
+			continue
+		}
+
+		activity.ActiveAuthors = len(counters.authors)
+		activity.MessagesPerMinute = float64(recentMessages) / rateMinutes
+		activity.JoinsPerMinute = float64(joins) / rateMinutes
+		activity.LeavesPerMinute = float64(leaves) / rateMinutes
+		result = append(result, activity)
+	}
+
+	slices.SortFunc(result, func(a, b GroupActivity) int {
+		if c := cmp.Compare(b.Messages, a.Messages); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Group, b.Group)
+	})
+
+	return result
+}
+
+// groupLabel returns the metrics label for group h, and false if it's to be
+// left out. A group whose metadata isn't cached might be private, so it's
+// treated as one rather than have its id exported.
+func (g *GroupStore) groupLabel(h string) (string, bool) {
+	if v, ok := g.metadataCache.Load(h); ok && !v.(*groupMetaCache).private && !v.(*groupMetaCache).hidden {
+		return h, true
+	}
+	if !g.Config.Metrics.HashPrivate {
+		return "", false
+	}
+
+	sum := sha256.Sum256([]byte(g.Config.Schema + ":" + h))
+	return "sha256:" + hex.EncodeToString(sum[:8]), true
+}
+
+// collectGroupActivity exports the activity of inst's most active groups.
+func collectGroupActivity(inst *Instance) {
+	instLabel := instanceLabel(inst)
+	match := prometheus.Labels{"instance": instLabel}
+	groupMessagesPerMinute.DeletePartialMatch(match)
+	groupActiveAuthors.DeletePartialMatch(match)
+	groupJoinsPerMinute.DeletePartialMatch(match)
+	groupLeavesPerMinute.DeletePartialMatch(match)
+
+	exported := 0
+	for _, activity := range inst.Groups.RecentActivity() {
+		if exported >= inst.Config.GetMetricsTopGroups() {
+			break
+		}
+
+		group, ok := inst.Groups.groupLabel(activity.Group)
+		if !ok {
+			continue
+		}
+
+		labels := prometheus.Labels{"instance": instLabel, "group": group}
+		groupMessagesPerMinute.With(labels).Set(activity.MessagesPerMinute)
+		groupActiveAuthors.With(labels).Set(float64(activity.ActiveAuthors))
+		groupJoinsPerMinute.With(labels).Set(activity.JoinsPerMinute)
+		groupLeavesPerMinute.With(labels).Set(activity.LeavesPerMinute)
+		exported++
+	}
+}
+
+// GroupDayCounts is a group's activity over the last 24 hours, for
+// GET /admin/groups.
+type GroupDayCounts struct {
+	Group    string `json:"group"`
+	Name     string `json:"name"`
+	Private  bool   `json:"private"`
+	Hidden   bool   `json:"hidden"`
+	Messages int64  `json:"messages"`
+	Authors  int64  `json:"authors"`
+	Joins    int64  `json:"joins"`
+	Leaves   int64  `json:"leaves"`
+}
+
+// groupRollup is the cached result of DayCounts.
+type groupRollup struct {
+	groups      []GroupDayCounts
+	collectedAt time.Time
+}
+
+// DayCounts returns every group's activity over the last 24 hours, most
+// messages first, cached for statsCacheTTL.
+func (g *GroupStore) DayCounts(ctx context.Context) ([]GroupDayCounts, error) {
+	g.rollupMu.Lock()
+	defer g.rollupMu.Unlock()
+
+	if g.rollup != nil && time.Since(g.rollup.collectedAt) < statsCacheTTL {
+		return g.rollup.groups, nil
+	}
+
+	counts, err := g.countDay(ctx, nostr.Timestamp(groupActivityNow().Add(-24*time.Hour).Unix()))
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]GroupDayCounts, 0)
+	g.metadataCache.Range(func(key, value any) bool {
+		h := key.(string)
+		meta := value.(*groupMetaCache)
+		if !meta.found {
+			return true
+		}
+
+		var content struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal([]byte(meta.event.Content), &content)
+
+		day := counts[h]
+		day.Group = h
+		day.Name = content.Name
+		day.Private = meta.private
+		day.Hidden = meta.hidden
+		groups = append(groups, day)
+		return true
+	})
+	slices.SortFunc(groups, func(a, b GroupDayCounts) int {
+		if c := cmp.Compare(b.Messages, a.Messages); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Group, b.Group)
+	})
+
+	g.rollup = &groupRollup{groups: groups, collectedAt: time.Now()}
+	return groups, nil
+}
+
+// countDay counts messages, authors, joins and leaves by group since since.
+func (g *GroupStore) countDay(ctx context.Context, since nostr.Timestamp) (map[string]GroupDayCounts, error) {
+	kinds := slices.Concat(chatKinds, []nostr.Kind{nostr.KindSimpleGroupPutUser, nostr.KindSimpleGroupRemoveUser})
+	counts := make(map[string]GroupDayCounts)
+
+	// Memory has no GROUP BY, but holds few enough events to go through
+	if usesMemory() {
+		authors := make(map[string]map[nostr.PubKey]struct{})
+		for event := range g.Events.QueryEvents(nostr.Filter{Kinds: kinds, Since: since}, 0) {
+			h := GetGroupIDFromEvent(event)
+			if h == "" {
+				continue
+			}
+
+			day := counts[h]
+			switch {
+			case slices.Contains(chatKinds, event.Kind):
+				day.Messages++
+				if authors[h] == nil {
+					authors[h] = make(map[nostr.PubKey]struct{})
+				}
+				authors[h][event.PubKey] = struct{}{}
+				day.Authors = int64(len(authors[h]))
+			case !g.isMemberDelta(event):
+			case event.Kind == nostr.KindSimpleGroupPutUser:
+				day.Joins++
+			default:
+				day.Leaves++
+			}
+			counts[h] = day
+		}
+		return counts, nil
+	}
+
+	// Only the relay's deltas count, not the admins' events they copy
+	chat := sqlKindList(chatKinds)
+	relay := "e.pubkey = '" + g.Config.GetSelf().Hex() + "'"
+
+	kindArgs := make([]any, len(kinds))
+	for i, kind := range kinds {
+		kindArgs[i] = int(kind)
+	}
+
+	subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
+	defer cancel()
+
+	rows, err := sb.Select(
+		"t.value",
+		"SUM(CASE WHEN e.kind IN ("+chat+") THEN 1 ELSE 0 END)",
+		"COUNT(DISTINCT CASE WHEN e.kind IN ("+chat+") THEN e.pubkey END)",
+		fmt.Sprintf("SUM(CASE WHEN e.kind = %d AND %s THEN 1 ELSE 0 END)", nostr.KindSimpleGroupPutUser, relay),
+		fmt.Sprintf("SUM(CASE WHEN e.kind = %d AND %s THEN 1 ELSE 0 END)", nostr.KindSimpleGroupRemoveUser, relay),
+	).
+		From(g.Events.Schema.Prefix("event_tags") + " t").
+		Join(g.Events.Schema.Prefix("events") + " e ON e.id = t.event_id").
+		Where(squirrel.Eq{"t.key": "h"}).
+		Where(squirrel.Eq{"e.kind": kindArgs}).
+		Where(squirrel.GtOrEq{"e.created_at": int64(since)}).
+		Where("e.deleted_at IS NULL").
+		GroupBy("t.value").
+		RunWith(GetDb()).
+		QueryContext(subctx)
+	if err != nil {
+		return nil, fmt.Errorf("counting group activity: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var h string
+		var day GroupDayCounts
+		if err := rows.Scan(&h, &day.Messages, &day.Authors, &day.Joins, &day.Leaves); err != nil {
+			return nil, err
+		}
+		counts[h] = day
+	}
+
+	return counts, rows.Err()
+}
+
+// sqlKindList formats kinds for an IN (...) list. They're numbers, so
+// nothing needs escaping.
+func sqlKindList(kinds []nostr.Kind) string {
+	list := make([]string, len(kinds))
+	for i, kind := range kinds {
+		list[i] = strconv.Itoa(int(kind))
+	}
+	return strings.Join(list, ", ")
+}
+
+// ServeGroupActivity handles GET /admin/groups behind HTTPAuth, for
+// managers only.
+func (instance *Instance) ServeGroupActivity(w http.ResponseWriter, r *http.Request) {
+	pubkey, authed := GetHTTPAuthed(r.Context())
+	if !authed {
+		http.Error(w, RejectAuthRequired.Reason("authentication is required for access"), http.StatusUnauthorized)
+		return
+	}
+	if !instance.Config.CanManage(pubkey) {
+		http.Error(w, RejectRestricted.Reason("only relay admins can manage this relay"), http.StatusForbidden)
+		return
+	}
+
+	groups, err := instance.Groups.DayCounts(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"groups": groups})
+}
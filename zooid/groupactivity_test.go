@@ -0,0 +1,186 @@
+package zooid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// activityAt makes group activity from now on count as happening at t.
+func activityAt(t *testing.T, at time.Time) {
+	t.Helper()
+
+	previous := groupActivityNow
+	groupActivityNow = func() time.Time { return at }
+	t.Cleanup(func() { groupActivityNow = previous })
+}
+
+// saveGroupEvent saves event the way khatru would, skipping OnEvent, and
+// returns it signed.
+func saveGroupEvent(t *testing.T, instance *Instance, secret nostr.SecretKey, event nostr.Event) nostr.Event {
+	t.Helper()
+
+	event = signedBy(secret, event)
+	if err := instance.Events.SaveEvent(event); err != nil {
+		t.Fatal(err)
+	}
+	instance.OnEventSaved(context.Background(), event)
+	return event
+}
+
+func TestGroupActivity_Metrics(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	activityAt(t, now)
+
+	instance := createTestInstance()
+	runTestAdmin(t, instance, "create-group", "busy")
+	runTestAdmin(t, instance, "create-group", "quiet")
+	runTestAdmin(t, instance, "create-group", "secret", "--private")
+
+	alice, bob := nostr.Generate(), nostr.Generate()
+	sent := 0
+	chat := func(secret nostr.SecretKey, h string) {
+		sent++
+		saveGroupEvent(t, instance, secret, nostr.Event{Kind: nostr.KindSimpleGroupChatMessage, Content: fmt.Sprint("hi ", sent), Tags: nostr.Tags{{"h", h}}})
+	}
+	for range 15 {
+		chat(alice, "busy")
+	}
+	for range 5 {
+		chat(bob, "busy")
+	}
+	chat(alice, "quiet")
+	chat(alice, "secret")
+	chat(alice, "secret")
+	saveGroupEvent(t, instance, instance.Config.secret, nostr.Event{
+		Kind: nostr.KindSimpleGroupPutUser,
+		Tags: nostr.Tags{{"h", "busy"}, {"p", alice.Public().Hex()}, {"p", bob.Public().Hex()}},
+	})
+	saveGroupEvent(t, instance, bob, nostr.Event{Kind: nostr.KindSimpleGroupLeaveRequest, Tags: nostr.Tags{{"h", "busy"}}})
+
+	gauge := func(vec *prometheus.GaugeVec, group string) float64 {
+		return testutil.ToFloat64(vec.With(prometheus.Labels{"instance": instanceLabel(instance), "group": group}))
+	}
+	exported := func() int {
+		return testutil.CollectAndCount(groupMessagesPerMinute, "zooid_group_messages_per_minute")
+	}
+
+	collectGroupActivity(instance)
+	if n := gauge(groupMessagesPerMinute, "busy"); n != 2 {
+		t.Errorf("busy messages per minute = %v, want 2", n)
+	}
+	if n := gauge(groupActiveAuthors, "busy"); n != 2 {
+		t.Errorf("busy active authors = %v, want 2", n)
+	}
+	if n := gauge(groupJoinsPerMinute, "busy"); n != 0.2 {
+		t.Errorf("busy joins per minute = %v, want 0.2", n)
+	}
+	if n := gauge(groupLeavesPerMinute, "busy"); n != 0.1 {
+		t.Errorf("busy leaves per minute = %v, want 0.1", n)
+	}
+	if n := exported(); n != 2 {
+		t.Errorf("%d groups exported, want busy and quiet", n)
+	}
+
+	// Hashing labels private groups without giving away their id
+	instance.Config.Metrics.HashPrivate = true
+	collectGroupActivity(instance)
+	label, _ := instance.Groups.groupLabel("secret")
+	if !strings.HasPrefix(label, "sha256:") || gauge(groupMessagesPerMinute, label) != 0.2 {
+		t.Errorf("secret is labelled %q with %v messages per minute", label, gauge(groupMessagesPerMinute, label))
+	}
+
+	// A group whose metadata isn't cached is labelled as a private one
+	cached, _ := instance.Groups.metadataCache.LoadAndDelete("busy")
+	if label, ok := instance.Groups.groupLabel("busy"); !ok || !strings.HasPrefix(label, "sha256:") {
+		t.Errorf("uncached busy is labelled (%q, %v), want a hash", label, ok)
+	}
+	instance.Config.Metrics.HashPrivate = false
+	if label, ok := instance.Groups.groupLabel("busy"); ok {
+		t.Errorf("uncached busy is labelled %q without hash_private, want it left out", label)
+	}
+	instance.Groups.metadataCache.Store("busy", cached)
+
+	// Only the most active groups are exported
+	instance.Config.Metrics.TopGroups = 1
+	collectGroupActivity(instance)
+	if n := exported(); n != 1 || gauge(groupMessagesPerMinute, "busy") != 2 {
+		t.Errorf("%d groups exported with top_groups = 1, want busy alone", n)
+	}
+
+	// Rates cover the last ten minutes, authors the last hour
+	activityAt(t, now.Add(30*time.Minute))
+	collectGroupActivity(instance)
+	if n := gauge(groupMessagesPerMinute, "busy"); n != 0 {
+		t.Errorf("busy messages per minute half an hour later = %v, want 0", n)
+	}
+	if n := gauge(groupActiveAuthors, "busy"); n != 2 {
+		t.Errorf("busy active authors half an hour later = %v, want 2", n)
+	}
+
+	activityAt(t, now.Add(2*time.Hour))
+	if activity := instance.Groups.RecentActivity(); len(activity) != 0 {
+		t.Errorf("activity two hours later = %+v, want none", activity)
+	}
+
+	groupMessagesPerMinute.DeletePartialMatch(prometheus.Labels{"instance": instanceLabel(instance)})
+}
+
+func TestGroupActivity_DayCounts(t *testing.T) {
+	instance := createTestInstance()
+	runTestAdmin(t, instance, "create-group", "busy", "--name", "Busy")
+	runTestAdmin(t, instance, "create-group", "quiet", "--private")
+
+	alice, bob := nostr.Generate(), nostr.Generate()
+	for i, secret := range []nostr.SecretKey{alice, alice, bob} {
+		saveGroupEvent(t, instance, secret, nostr.Event{Kind: nostr.KindSimpleGroupChatMessage, Content: fmt.Sprint("hi ", i), Tags: nostr.Tags{{"h", "busy"}}})
+	}
+	saveGroupEvent(t, instance, bob, nostr.Event{Kind: nostr.KindSimpleGroupJoinRequest, Tags: nostr.Tags{{"h", "quiet"}}})
+
+	serve := func(ctx context.Context) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "https://test.com/admin/groups", nil).WithContext(ctx)
+		instance.ServeGroupActivity(rec, r)
+		return rec
+	}
+
+	if rec := serve(context.Background()); rec.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated request: %d", rec.Code)
+	}
+	if rec := serve(context.WithValue(context.Background(), httpAuthKey{}, alice.Public())); rec.Code != http.StatusForbidden {
+		t.Errorf("request from a non-manager: %d", rec.Code)
+	}
+
+	rec := serve(context.WithValue(context.Background(), httpAuthKey{}, instance.Config.secret.Public()))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("request from a manager: %d %s", rec.Code, rec.Body)
+	}
+
+	var body struct {
+		Groups []GroupDayCounts `json:"groups"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	want := []GroupDayCounts{
+		{Group: "busy", Name: "Busy", Messages: 3, Authors: 2, Joins: 1},
+		{Group: "quiet", Private: true, Joins: 2},
+	}
+	if len(body.Groups) != len(want) {
+		t.Fatalf("groups = %+v, want %+v", body.Groups, want)
+	}
+	for i := range want {
+		if body.Groups[i] != want[i] {
+			t.Errorf("groups[%d] = %+v, want %+v", i, body.Groups[i], want[i])
+		}
+	}
+}
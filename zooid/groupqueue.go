@@ -0,0 +1,135 @@
+package zooid
+
+import (
+	"sync"
+	"time"
+)
+
+// groupQueue runs the list and snapshot rewrites OnEventSaved defers (see
+// sideEffectBatch) off the websocket goroutine. Membership and cache
+// changes have been made by the time a batch is queued; only the rewrites
+// wait here. Batches are merged per group and a fixed pool of `workers`
+// goroutines takes groups with queued rewrites in turn, one worker per group
+// at a time, so a burst of joins shares a single members list rewrite.
+type groupQueue struct {
+	process func(h string, batch *sideEffectBatch)
+
+	mu        sync.Mutex
+	ready     *sync.Cond
+	pending   map[string]*sideEffectBatch // present, possibly empty, while h is queued or being processed
+	groups    []string                    // groups waiting for a worker, in the order they were queued
+	closed    bool
+	abandoned bool // Close timed out, so queued groups are dropped
+	wg        sync.WaitGroup
+}
+
+func newGroupQueue(workers int, process func(h string, batch *sideEffectBatch)) *groupQueue {
+	if workers < 1 {
+		workers = 1
+	}
+
+	q := &groupQueue{
+		process: process,
+		pending: make(map[string]*sideEffectBatch),
+	}
+	q.ready = sync.NewCond(&q.mu)
+
+	q.wg.Add(workers)
+	for range workers {
+		go q.work()
+	}
+
+	return q
+}
+
+// Enqueue merges batch into what's queued for group h and reports whether
+// it did. After Close it returns false and the caller should flush the
+// batch itself.
+func (q *groupQueue) Enqueue(h string, batch *sideEffectBatch) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+	if batch.empty() {
+		return true
+	}
+
+	queued, ok := q.pending[h]
+	if !ok {
+		queued = &sideEffectBatch{}
+		q.pending[h] = queued
+		q.groups = append(q.groups, h)
+		q.ready.Signal()
+	}
+	queued.merge(batch)
+
+	return true
+}
+
+// Discard drops the rewrites queued for group h, as after it's deleted.
+func (q *groupQueue) Discard(h string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.pending[h]; ok {
+		q.pending[h] = &sideEffectBatch{}
+	}
+}
+
+func (q *groupQueue) work() {
+	defer q.wg.Done()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		for len(q.groups) == 0 && !q.closed {
+			q.ready.Wait()
+		}
+		if len(q.groups) == 0 || q.abandoned {
+			return
+		}
+
+		h := q.groups[0]
+		q.groups = q.groups[1:]
+
+		for batch := q.pending[h]; !batch.empty() && !q.abandoned; batch = q.pending[h] {
+			q.pending[h] = &sideEffectBatch{}
+			q.mu.Unlock()
+			q.process(h, batch)
+			q.mu.Lock()
+		}
+		delete(q.pending, h)
+	}
+}
+
+// Close stops accepting batches and waits up to timeout for the queued ones
+// to be processed. It reports whether they all were; if not, the rest are
+// dropped, and it still waits for the batches being processed to finish.
+func (q *groupQueue) Close(timeout time.Duration) bool {
+	q.mu.Lock()
+	q.closed = true
+	q.ready.Broadcast()
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+	}
+
+	q.mu.Lock()
+	q.abandoned = true
+	q.mu.Unlock()
+
+	<-done
+	return false
+}
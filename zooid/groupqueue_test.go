@@ -0,0 +1,207 @@
+package zooid
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// rewrite returns a batch asking for step, on behalf of event.
+func rewrite(step string, event nostr.Event) *sideEffectBatch {
+	return &sideEffectBatch{
+		steps:  []string{step},
+		events: map[string]nostr.Event{step: event},
+	}
+}
+
+func TestGroupQueue_MergesPerGroup(t *testing.T) {
+	var mu sync.Mutex
+	var busy bool
+	seen := make(map[string]nostr.Timestamp)
+
+	q := newGroupQueue(2, func(h string, batch *sideEffectBatch) {
+		mu.Lock()
+		if busy && h == "a" {
+			t.Error("group a processed concurrently")
+		}
+		busy = busy || h == "a"
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if h == "a" {
+			busy = false
+		}
+		if at := batch.events["update_members_list"].CreatedAt; at < seen[h] {
+			t.Errorf("group %s: rewrite for %d after %d", h, at, seen[h])
+		} else {
+			seen[h] = at
+		}
+	})
+
+	for i := 1; i <= 100; i++ {
+		for _, h := range []string{"a", "b", "c"} {
+			q.Enqueue(h, rewrite("update_members_list", nostr.Event{CreatedAt: nostr.Timestamp(i)}))
+		}
+	}
+
+	if !q.Close(5 * time.Second) {
+		t.Fatal("Close() timed out")
+	}
+
+	for _, h := range []string{"a", "b", "c"} {
+		if seen[h] != 100 {
+			t.Errorf("group %s: last rewrite was for %d, want 100", h, seen[h])
+		}
+	}
+
+	if q.Enqueue("a", rewrite("update_members_list", nostr.Event{})) {
+		t.Error("Enqueue() should refuse batches after Close")
+	}
+}
+
+func TestGroupQueue_ConcurrentJoinsCoalesce(t *testing.T) {
+	instance := createTestInstance()
+
+	createEvent := nostr.Event{
+		Kind:      nostr.KindSimpleGroupCreateGroup,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "busy"}},
+		Content:   `{"name":"Busy"}`,
+	}
+	createEvent.Sign(nostr.Generate())
+	instance.OnEventSaved(context.Background(), createEvent)
+
+	var writes atomic.Int32
+	scheduleMembersList := sideEffects["schedule_members_list"]
+	sideEffects["schedule_members_list"] = func(instance *Instance, event nostr.Event) error {
+		writes.Add(1)
+		return scheduleMembersList(instance, event)
+	}
+	t.Cleanup(func() { sideEffects["schedule_members_list"] = scheduleMembersList })
+
+	// Hold the workers until all joins are queued, as a slow database
+	// would, so the burst is handled in one or two batches.
+	slow := make(chan struct{})
+	instance.groupQueue = newGroupQueue(4, func(h string, batch *sideEffectBatch) {
+		<-slow
+		batch.flush(instance)
+	})
+
+	const joins = 50
+	joiners := make([]nostr.PubKey, joins)
+	var wg sync.WaitGroup
+	for i := range joins {
+		secret := nostr.Generate()
+		joiners[i] = secret.Public()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			join := nostr.Event{
+				Kind:      nostr.KindSimpleGroupJoinRequest,
+				CreatedAt: nostr.Now(),
+				Tags:      nostr.Tags{{"h", "busy"}},
+			}
+			join.Sign(secret)
+			instance.OnEventSaved(context.Background(), join)
+		}()
+	}
+	wg.Wait()
+
+	// Only the list rewrites wait for the workers
+	for _, pubkey := range joiners {
+		if !instance.Groups.IsMember("busy", pubkey) {
+			t.Errorf("%s should be a member as soon as the join is saved", pubkey.Hex())
+		}
+	}
+
+	close(slow)
+
+	if !instance.groupQueue.Close(30 * time.Second) {
+		t.Fatal("Close() timed out draining joins")
+	}
+
+	var snapshot nostr.Event
+	for event := range instance.Events.QueryEvents(nostr.Filter{
+		Kinds: []nostr.Kind{nostr.KindSimpleGroupMembers},
+		Tags:  nostr.TagMap{"d": []string{"busy"}},
+	}, 1) {
+		snapshot = event
+	}
+	for _, pubkey := range joiners {
+		if snapshot.Tags.FindWithValue("p", pubkey.Hex()) == nil {
+			t.Errorf("members list is missing %s", pubkey.Hex())
+		}
+	}
+
+	if n := writes.Load(); n >= joins/2 {
+		t.Errorf("%d members list writes for %d joins, want far fewer", n, joins)
+	}
+}
+
+func TestGroupQueue_FixedWorkers(t *testing.T) {
+	var mu sync.Mutex
+	var running, most int
+	release := make(chan struct{})
+	q := newGroupQueue(3, func(h string, batch *sideEffectBatch) {
+		mu.Lock()
+		running++
+		most = max(most, running)
+		mu.Unlock()
+
+		<-release
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+
+	before := runtime.NumGoroutine()
+	for i := range 1000 {
+		q.Enqueue(fmt.Sprintf("group-%d", i), rewrite("update_members_list", nostr.Event{}))
+	}
+	if n := runtime.NumGoroutine() - before; n > 0 {
+		t.Errorf("queueing 1000 groups started %d goroutines", n)
+	}
+
+	close(release)
+	if !q.Close(5 * time.Second) {
+		t.Fatal("Close() timed out")
+	}
+	if most > 3 {
+		t.Errorf("%d groups processed at once, want at most 3", most)
+	}
+}
+
+func TestGroupQueue_CloseWaitsForBatches(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	var finished atomic.Bool
+	q := newGroupQueue(1, func(h string, batch *sideEffectBatch) {
+		if h == "slow" {
+			close(started)
+			<-release
+			finished.Store(true)
+		}
+	})
+
+	q.Enqueue("slow", rewrite("update_members_list", nostr.Event{}))
+	q.Enqueue("dropped", rewrite("update_members_list", nostr.Event{}))
+	<-started
+
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	if q.Close(10 * time.Millisecond) {
+		t.Error("Close() reported everything processed although it timed out")
+	}
+	if !finished.Load() {
+		t.Error("Close() returned before the batch being processed finished")
+	}
+}
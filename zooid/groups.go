@@ -2,11 +2,15 @@ package zooid
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"fiatjaf.com/nostr"
@@ -70,6 +74,19 @@ type groupMetaCache struct {
 	hidden          bool
 	closed          bool
 	writeRestricted bool
+	archived        bool
+}
+
+func newGroupMetaCache(event nostr.Event) *groupMetaCache {
+	return &groupMetaCache{
+		event:           event,
+		found:           true,
+		private:         HasTag(event.Tags, "private"),
+		hidden:          HasTag(event.Tags, "hidden"),
+		closed:          HasTag(event.Tags, "closed"),
+		writeRestricted: HasTag(event.Tags, "write-restricted"),
+		archived:        HasTag(event.Tags, "archived"),
+	}
 }
 
 type roleSet struct {
@@ -89,11 +106,24 @@ type GroupStore struct {
 	Events     *EventStore
 	Management *ManagementStore
 
-	metadataCache   sync.Map // map[string]*groupMetaCache  (key = group h)
-	membershipCache sync.Map // map[string]*memberSet        (key = group h)
-	roleCache       sync.Map // map[string]*roleSet           (key = group h)
-	creatorCache    sync.Map // map[string]nostr.PubKey       (key = group h)
-	cachesWarmed    bool
+	metadataCache     sync.Map // map[string]*groupMetaCache  (key = group h)
+	membershipCache   sync.Map // map[string]*memberSet        (key = group h)
+	roleCache         sync.Map // map[string]*roleSet           (key = group h)
+	creatorCache      sync.Map // map[string]nostr.PubKey       (key = group h)
+	pinsCache         sync.Map // map[string]*groupPins         (key = group h)
+	pinsMu            sync.Mutex
+	joinRequestsCache sync.Map // map[string]map[nostr.PubKey]nostr.Timestamp (key = group h)
+	joinRequestsMu    sync.Mutex
+	eventGroups       eventGroupCache // recent event id → group h, see threads.go
+	unreadLogs        sync.Map        // map[string]*unreadLog         (key = group h)
+	cachesWarmed      bool
+
+	memberSnapshots sync.Map // map[string]nostr.ID, latest 39002 by group h, see memberdeltas.go
+	lastMessages    sync.Map // map[string]nostr.Timestamp, latest chat message by group h, see metadatahints.go
+
+	activity groupActivity // recent activity, see groupactivity.go
+	rollup   *groupRollup  // cached 24h counts, see groupactivity.go
+	rollupMu sync.Mutex
 
 	// membershipFullyLoaded tracks groups for which WarmCaches
 	// successfully applied a kind-39002 snapshot — meaning the
@@ -113,6 +143,21 @@ type GroupStore struct {
 	DebounceDelay   time.Duration
 	debounceMu      sync.Mutex
 	debouncePending map[string]*debounceEntry
+
+	// appliedConfig, when set by ApplyConfig, replaces Config as the
+	// source of per-group policy (see GroupPolicy).
+	appliedConfig atomic.Pointer[Config]
+}
+
+// GroupPolicy is the effective policy for a single group: the global
+// [groups] settings with any [groups.overrides.<h>] entry applied on top.
+type GroupPolicy struct {
+	AutoJoin        bool
+	WriteRestricted bool
+	MaxMembers      int           // 0 = unlimited
+	AdminsExceedMax bool          // admin adds ignore MaxMembers
+	Retention       time.Duration // 0 = unlimited
+	RateMultiplier  float64
 }
 
 // debounceEntry tracks one key's pending or in-flight rewrite. While
@@ -128,34 +173,52 @@ type debounceEntry struct {
 	dirty   bool
 }
 
-func (g *GroupStore) WarmCaches() {
+// WarmCaches loads the caches from the database. If a query fails they'd be
+// incomplete, so they're left unused, every lookup going to the database
+// instead, and the error is returned. So they are if ctx is canceled, which
+// stops the scans.
+func (g *GroupStore) WarmCaches(ctx context.Context) error {
+	failures := g.Events.queryErrors.Load()
+	start := time.Now()
+	canceled := func() error {
+		if err := ctx.Err(); err != nil {
+			g.cachesWarmed = false
+			return fmt.Errorf("warming group caches: %w", err)
+		}
+		return nil
+	}
+
 	// Load all group metadata
 	metaFilter := nostr.Filter{
 		Kinds: []nostr.Kind{nostr.KindSimpleGroupMetadata},
 	}
 	for event := range g.Events.QueryEvents(metaFilter, 0) {
+		if ctx.Err() != nil {
+			break
+		}
 		h := event.Tags.GetD()
 		if h == "" {
 			continue
 		}
-		g.metadataCache.Store(h, &groupMetaCache{
-			event:           event,
-			found:           true,
-			private:         HasTag(event.Tags, "private"),
-			hidden:          HasTag(event.Tags, "hidden"),
-			closed:          HasTag(event.Tags, "closed"),
-			writeRestricted: HasTag(event.Tags, "write-restricted"),
-		})
+		g.metadataCache.Store(h, newGroupMetaCache(event))
 	}
 
 	// Load all group creators (and collect creation events for self-healing below).
 	// QueryEvents returns created_at DESC, so the first event per group ID is the
 	// newest. We keep only that one to avoid older duplicates overwriting metadata.
 	missingMeta := make(map[string]nostr.Event) // group h → newest creation event
+	if err := canceled(); err != nil {
+		return err
+	}
+	metadataDone := time.Now()
+
 	createFilter := nostr.Filter{
 		Kinds: []nostr.Kind{nostr.KindSimpleGroupCreateGroup},
 	}
 	for event := range g.Events.QueryEvents(createFilter, 0) {
+		if ctx.Err() != nil {
+			break
+		}
 		h := GetGroupIDFromEvent(event)
 		if h == "" {
 			continue
@@ -169,6 +232,11 @@ func (g *GroupStore) WarmCaches() {
 		}
 	}
 
+	if err := canceled(); err != nil {
+		return err
+	}
+	creatorsDone := time.Now()
+
 	// Load group memberships from the kind-39002 (members) snapshot
 	// and the kind-39001 (admins) snapshot the relay maintains.
 	//
@@ -214,6 +282,9 @@ func (g *GroupStore) WarmCaches() {
 	for event := range g.Events.QueryEvents(nostr.Filter{
 		Kinds: []nostr.Kind{nostr.KindSimpleGroupMembers},
 	}, 0) {
+		if ctx.Err() != nil {
+			break
+		}
 		h := event.Tags.GetD()
 		if h == "" {
 			continue
@@ -270,6 +341,9 @@ func (g *GroupStore) WarmCaches() {
 	for event := range g.Events.QueryEvents(nostr.Filter{
 		Kinds: []nostr.Kind{nostr.KindSimpleGroupAdmins},
 	}, 0) {
+		if ctx.Err() != nil {
+			break
+		}
 		h := event.Tags.GetD()
 		if h == "" {
 			continue
@@ -318,6 +392,9 @@ func (g *GroupStore) WarmCaches() {
 	// the tail size proportional to time-since-newest-snapshot
 	// (typically seconds-to-minutes thanks to the debounced 39002
 	// emission pipeline), not to total membership history.
+	if err := canceled(); err != nil {
+		return err
+	}
 	if len(seenMembers) > 0 {
 		oldest := nostr.Timestamp(0)
 		first := true
@@ -327,16 +404,15 @@ func (g *GroupStore) WarmCaches() {
 				first = false
 			}
 		}
-		// QueryEvents returns DESC; replaying put/remove DESC gives
-		// the wrong final state when an Add+Remove pair lands in
-		// the tail (the remove fires against an empty set, then the
-		// add re-introduces the user). Collect and reverse to
-		// process oldest-first.
-		tail := slices.Collect(g.Events.QueryEvents(nostr.Filter{
+		// Replaying put/remove newest first gives the wrong final
+		// state when an Add+Remove pair lands in the tail (the
+		// remove fires against an empty set, then the add
+		// re-introduces the user), so process oldest-first.
+		tail := g.Events.QueryEventsOldestFirst(nostr.Filter{
 			Kinds: []nostr.Kind{nostr.KindSimpleGroupPutUser, nostr.KindSimpleGroupRemoveUser},
 			Since: oldest,
-		}, 0))
-		for _, event := range Reversed(tail) {
+		}, 0)
+		for event := range tail {
 			h := GetGroupIDFromEvent(event)
 			if h == "" {
 				continue
@@ -398,6 +474,13 @@ func (g *GroupStore) WarmCaches() {
 		}
 	}
 
+	if err := canceled(); err != nil {
+		return err
+	}
+	log.Printf("Warmed group caches of %s in %s: metadata %s, creators %s, membership %s",
+		g.Events.Schema.Name, time.Since(start).Round(time.Millisecond), metadataDone.Sub(start).Round(time.Millisecond),
+		creatorsDone.Sub(metadataDone).Round(time.Millisecond), time.Since(creatorsDone).Round(time.Millisecond))
+
 	// Self-heal: regenerate metadata for groups that have a creation event but
 	// no kind 39000 metadata (e.g. UpdateMetadata failed silently during creation).
 	// This runs after membership loading so member_count is accurate.
@@ -408,27 +491,34 @@ func (g *GroupStore) WarmCaches() {
 		}
 	}
 
-	// Heuristic warm-up failure detection. The QueryEvents iter.Seq
-	// surface can't return errors — queryEventsWith logs and stops on
-	// timeout but the consumer just sees a short sequence. If the
-	// metadata cache shows we have groups but the members/admins
-	// snapshot reads came back with no data at all, the most likely
-	// explanation is a query timeout under DB pressure (the very
-	// scenario that motivated issue #25 in the first place). Stay in
-	// pre-warm mode so IsMember falls back to its DB query path —
-	// slow per-call but correct, vs. setting cachesWarmed=true and
-	// silently false-rejecting members.
+	// Stay in pre-warm mode if anything failed to load, so IsMember falls
+	// back to its DB query path — slow per-call but correct, vs. setting
+	// cachesWarmed=true and silently false-rejecting members. The
+	// QueryEvents iter.Seq surface can't return errors, so failures are
+	// read off the store's count of them.
+	if n := g.Events.queryErrors.Load() - failures; n > 0 {
+		g.cachesWarmed = false
+		return fmt.Errorf("warming group caches: %d queries failed", n)
+	}
+
+	// The heuristic from before failures were counted stays as a
+	// backstop. If the metadata cache shows we have groups but the
+	// members/admins snapshot reads came back with no data at all, the
+	// most likely explanation is a query timeout under DB pressure (the
+	// very scenario that motivated issue #25 in the first place).
 	metadataCount := 0
 	g.metadataCache.Range(func(_, _ any) bool {
 		metadataCount++
 		return true
 	})
 	if metadataCount > 0 && len(seenMembers) == 0 && len(seenAdmins) == 0 {
-		log.Printf("WarmCaches: %d groups in metadata but 0 members/admins snapshot events read — staying in pre-warm mode (IsMember will fall back to DB)", metadataCount)
-		return
+		g.cachesWarmed = false
+		return fmt.Errorf("warming group caches: %d groups in metadata but 0 members/admins snapshot events read", metadataCount)
 	}
 
 	g.cachesWarmed = true
+
+	return nil
 }
 
 func (g *GroupStore) getOrCreateMemberSet(h string) *memberSet {
@@ -449,6 +539,177 @@ func (g *GroupStore) getOrCreateRoleSet(h string) *roleSet {
 	return actual.(*roleSet)
 }
 
+// Policy
+
+// ApplyConfig swaps in the group policy from a reloaded config without
+// rebuilding caches. Only what GroupPolicy reads is affected.
+func (g *GroupStore) ApplyConfig(config *Config) {
+	g.appliedConfig.Store(config)
+}
+
+func (g *GroupStore) policyConfig() *Config {
+	if config := g.appliedConfig.Load(); config != nil {
+		return config
+	}
+	return g.Config
+}
+
+// GroupPolicy merges the global group settings with the override for h.
+// Groups without an override get the defaults. An explicit write_restricted
+// override wins over the group's own metadata flag in either direction.
+func (g *GroupStore) GroupPolicy(h string) GroupPolicy {
+	config := g.policyConfig()
+	override := config.Groups.Overrides[h]
+
+	policy := GroupPolicy{
+		AutoJoin:        config.Groups.AutoJoin,
+		MaxMembers:      override.MaxMembers,
+		AdminsExceedMax: config.Groups.AdminsExceedMaxMembers,
+		Retention:       config.GetRetention(h),
+		RateMultiplier:  1,
+	}
+
+	if override.AutoJoin != nil {
+		policy.AutoJoin = *override.AutoJoin
+	}
+
+	if override.WriteRestricted != nil {
+		policy.WriteRestricted = *override.WriteRestricted
+	} else {
+		policy.WriteRestricted = g.IsWriteRestricted(h)
+	}
+
+	if override.RateMultiplier > 0 {
+		policy.RateMultiplier = override.RateMultiplier
+	}
+
+	// Without a configured cap, group admins can set one with a max_members
+	// tag on the group's metadata.
+	if policy.MaxMembers == 0 {
+		if meta, found := g.GetMetadata(h); found {
+			policy.MaxMembers = metadataMaxMembers(meta.Tags)
+		}
+	}
+
+	return policy
+}
+
+// RateMultiplier returns how much event's group scales the rate limits
+// it's subject to, 1 if it isn't a group event.
+func (g *GroupStore) RateMultiplier(event nostr.Event) float64 {
+	if !g.Config.Groups.Enabled {
+		return 1
+	}
+
+	h := GetGroupIDFromEvent(event)
+	if h == "" {
+		return 1
+	}
+
+	return g.GroupPolicy(h).RateMultiplier
+}
+
+// metadataMaxMembers reads a ["max_members", "<n>"] tag, returning 0
+// (unlimited) if it's missing or not a positive number.
+func metadataMaxMembers(tags nostr.Tags) int {
+	tag := tags.Find("max_members")
+	if tag == nil {
+		return 0
+	}
+
+	max, err := strconv.Atoi(tag[1])
+	if err != nil || max < 0 {
+		return 0
+	}
+
+	return max
+}
+
+// ErrGroupFull is returned when adding a member would take a group past its
+// max_members cap.
+var ErrGroupFull = errors.New(RejectRestricted.Reason("group is full"))
+
+// checkCapacity returns ErrGroupFull if adding those of pubkeys who aren't
+// yet members of h would take the group past its cap. byAdmin exempts the
+// add when admins_exceed_max_members is set.
+//
+// The count comes from the membership cache, or the put/remove log when the
+// group's cache isn't fully loaded, and isn't reserved, so concurrent joins
+// can each pass the check and overshoot the cap by a few members. That's
+// accepted in exchange for keeping joins lock-free; once the cap is reached,
+// every later join is refused.
+func (g *GroupStore) checkCapacity(h string, pubkeys []nostr.PubKey, byAdmin bool) error {
+	policy := g.GroupPolicy(h)
+	if policy.MaxMembers == 0 || (byAdmin && policy.AdminsExceedMax) {
+		return nil
+	}
+
+	isMember, count := g.capacityMembers(h)
+	added := make(map[nostr.PubKey]struct{}, len(pubkeys))
+	for _, pubkey := range pubkeys {
+		if !isMember(pubkey) {
+			added[pubkey] = struct{}{}
+		}
+	}
+
+	if len(added) > 0 && count+len(added) > policy.MaxMembers {
+		return ErrGroupFull
+	}
+
+	return nil
+}
+
+// capacityMembers returns who's a member of h and how many there are, for
+// checkCapacity.
+func (g *GroupStore) capacityMembers(h string) (func(nostr.PubKey) bool, int) {
+	if _, fullyLoaded := g.membershipFullyLoaded.Load(h); fullyLoaded {
+		if v, ok := g.membershipCache.Load(h); ok {
+			ms := v.(*memberSet)
+			ms.mu.RLock()
+			count := len(ms.members)
+			ms.mu.RUnlock()
+
+			return func(pubkey nostr.PubKey) bool {
+				ms.mu.RLock()
+				defer ms.mu.RUnlock()
+				_, ok := ms.members[pubkey]
+				return ok
+			}, count
+		}
+	}
+
+	members := g.membersFromLog(h)
+	return func(pubkey nostr.PubKey) bool {
+		_, ok := members[pubkey]
+		return ok
+	}, len(members)
+}
+
+// checkMemberTags checks the p tags of a put or remove user event: each must
+// be a pubkey, naming the failing tag by its index, and there may be at most
+// groups.max_member_tags of them, so one event can't churn the members list.
+func (g *GroupStore) checkMemberTags(event nostr.Event) string {
+	count := 0
+	for i, tag := range event.Tags {
+		if len(tag) < 1 || tag[0] != "p" {
+			continue
+		}
+		if len(tag) < 2 {
+			return RejectInvalid.Reason(fmt.Sprintf("tag %d: p tag has no pubkey", i))
+		}
+		if _, err := nostr.PubKeyFromHex(tag[1]); err != nil {
+			return RejectInvalid.Reason(fmt.Sprintf("tag %d: %q is not a valid pubkey", i, tag[1]))
+		}
+		count++
+	}
+
+	if limit := g.Config.GetMaxMemberTags(); count > limit {
+		return RejectInvalid.Reason(fmt.Sprintf("too many p tags: %d, at most %d per event", count, limit))
+	}
+
+	return ""
+}
+
 // Metadata
 
 func (g *GroupStore) GetMetadata(h string) (nostr.Event, bool) {
@@ -482,13 +743,19 @@ func (g *GroupStore) UpdateMetadata(event nostr.Event) error {
 		if len(tag) >= 2 && tag[0] == "h" {
 			h = tag[1]
 			tags = append(tags, nostr.Tag{"d", tag[1]})
-		} else if len(tag) >= 1 && tag[0] == "member_count" {
-			continue // strip client-supplied member_count; relay computes it
+		} else if isMetadataHint(tag) {
+			continue // strip client-supplied hints; relay computes them
 		} else {
 			tags = append(tags, tag)
 		}
 	}
 
+	// The h tag becomes the metadata event's d tag; without it every such
+	// group would share (and overwrite) one metadata event.
+	if h == "" {
+		return fmt.Errorf("group metadata for event %s: %w", event.ID, ErrMissingDTag)
+	}
+
 	// Parse content JSON and add appropriate visibility tags
 	var contentData map[string]interface{}
 	if err := json.Unmarshal([]byte(event.Content), &contentData); err == nil {
@@ -504,12 +771,14 @@ func (g *GroupStore) UpdateMetadata(event nostr.Event) error {
 		if wr, ok := contentData["write-restricted"].(bool); ok && wr {
 			tags = append(tags, nostr.Tag{"write-restricted"})
 		}
+		if archived, ok := contentData["archived"].(bool); ok && archived {
+			tags = append(tags, nostr.Tag{"archived"})
+		}
 	}
 
-	// Add member_count tag only for non-private groups to avoid leaking membership info
-	if h != "" && !HasTag(tags, "private") {
-		tags = append(tags, nostr.Tag{"member_count", strconv.Itoa(g.GetMemberCount(h))})
-	}
+	// Add hints, leaving member_count and last_message_at off private groups
+	// to avoid leaking membership info
+	tags = append(tags, g.metadataHintTags(h, HasTag(tags, "private"), event.CreatedAt)...)
 
 	metadataEvent := nostr.Event{
 		Kind:      nostr.KindSimpleGroupMetadata,
@@ -523,19 +792,14 @@ func (g *GroupStore) UpdateMetadata(event nostr.Event) error {
 	}
 
 	if h != "" {
-		g.metadataCache.Store(h, &groupMetaCache{
-			event:           metadataEvent,
-			found:           true,
-			private:         HasTag(tags, "private"),
-			hidden:          HasTag(tags, "hidden"),
-			closed:          HasTag(tags, "closed"),
-			writeRestricted: HasTag(tags, "write-restricted"),
-		})
+		g.metadataCache.Store(h, newGroupMetaCache(metadataEvent))
 	}
 
 	return nil
 }
 
+// RefreshMemberCount rewrites group h's metadata hints if its member_count
+// has changed. See metadatahints.go.
 func (g *GroupStore) RefreshMemberCount(h string) error {
 	v, ok := g.metadataCache.Load(h)
 	if !ok {
@@ -543,28 +807,34 @@ func (g *GroupStore) RefreshMemberCount(h string) error {
 	}
 	cached := v.(*groupMetaCache)
 
-	// Private groups don't expose member_count
+	// Private groups only have updated_at, which a refresh doesn't change
 	if cached.private {
 		return nil
 	}
 
-	countStr := strconv.Itoa(g.GetMemberCount(h))
-
-	// Short-circuit if the count hasn't changed
-	for _, tag := range cached.event.Tags {
-		if len(tag) >= 2 && tag[0] == "member_count" && tag[1] == countStr {
-			return nil
+	updatedAt := cached.event.CreatedAt
+	if tag := cached.event.Tags.Find("updated_at"); tag != nil {
+		if ts, err := strconv.ParseInt(tag[1], 10, 64); err == nil {
+			updatedAt = nostr.Timestamp(ts)
 		}
 	}
+	hints := g.metadataHintTags(h, false, updatedAt)
 
 	tags := make(nostr.Tags, 0, len(cached.event.Tags))
+	var current nostr.Tags
 	for _, tag := range cached.event.Tags {
-		if len(tag) >= 1 && tag[0] == "member_count" {
+		if isMetadataHint(tag) {
+			current = append(current, tag)
 			continue
 		}
 		tags = append(tags, tag)
 	}
-	tags = append(tags, nostr.Tag{"member_count", countStr})
+
+	// Short-circuit unless member_count changed, see metadatahints.go
+	if slices.Equal(current.Find("member_count"), hints.Find("member_count")) {
+		return nil
+	}
+	tags = append(tags, hints...)
 
 	metadataEvent := nostr.Event{
 		Kind:      nostr.KindSimpleGroupMetadata,
@@ -584,6 +854,7 @@ func (g *GroupStore) RefreshMemberCount(h string) error {
 		hidden:          cached.hidden,
 		closed:          cached.closed,
 		writeRestricted: cached.writeRestricted,
+		archived:        cached.archived,
 	})
 
 	return nil
@@ -591,7 +862,12 @@ func (g *GroupStore) RefreshMemberCount(h string) error {
 
 // Deletion
 
-func (g *GroupStore) DeleteGroup(h string) {
+// DeleteGroup removes group h and everything posted to it, on behalf of by.
+// Deletion events are kept, and a kind 9008 signed by the relay with by in
+// an actor tag is left as a tombstone, so clients asking after the group
+// learn that it's gone and who removed it. A deletion the relay signed
+// itself is its own tombstone.
+func (g *GroupStore) DeleteGroup(h string, by nostr.PubKey) {
 	filters := []nostr.Filter{
 		{
 			Kinds: nip29.MetadataEventKinds,
@@ -619,11 +895,39 @@ func (g *GroupStore) DeleteGroup(h string) {
 		}
 	}
 
+	g.deletePins(h)
+	g.forgetGroup(h)
+
+	if !g.Config.IsSelf(by) {
+		tombstone := nostr.Event{
+			Kind:      nostr.KindSimpleGroupDeleteGroup,
+			CreatedAt: nostr.Now(),
+			Tags: nostr.Tags{
+				nostr.Tag{"h", h},
+				nostr.Tag{"actor", by.Hex()},
+			},
+		}
+		if err := g.Events.SignAndStoreEvent(&tombstone, true); err != nil {
+			log.Printf("Failed to store the tombstone of group %q: %v", h, err)
+		}
+	}
+
+	g.Events.announce(cacheMessage{Group: h, Action: cacheDeleteGroup})
+}
+
+// forgetGroup drops everything cached about group h.
+func (g *GroupStore) forgetGroup(h string) {
 	g.metadataCache.Delete(h)
 	g.membershipCache.Delete(h)
 	g.membershipFullyLoaded.Delete(h)
 	g.roleCache.Delete(h)
 	g.creatorCache.Delete(h)
+	g.pinsCache.Delete(h)
+	g.forgetUnread(h)
+	g.forgetJoinRequests(h)
+
+	// The group's events are gone, and a new group may take its id
+	g.eventGroups.clear()
 }
 
 // Admins
@@ -660,63 +964,91 @@ func (g *GroupStore) UpdateAdminsList(h string) error {
 		Tags:      tags,
 	}
 
-	return g.Events.SignAndStoreEvent(&event, true)
+	return g.Events.signAndStoreList("admins", &event, true)
 }
 
 // Membership
 
+// AddMember adds pubkey to group h, or returns ErrGroupFull if the group is at
+// its member cap. Admin adds are checked in CheckWrite instead.
 func (g *GroupStore) AddMember(h string, pubkey nostr.PubKey) error {
-	event := nostr.Event{
-		Kind:      nostr.KindSimpleGroupPutUser,
-		CreatedAt: nostr.Now(),
-		Tags: nostr.Tags{
-			nostr.Tag{"p", pubkey.Hex()},
-			nostr.Tag{"h", h},
-		},
-	}
-
-	if err := g.Events.SignAndStoreEvent(&event, true); err != nil {
+	if err := g.checkCapacity(h, []nostr.PubKey{pubkey}, false); err != nil {
 		return err
 	}
 
+	// The cache changes first so a 39002 with the delta's seq includes it,
+	// see memberdeltas.go
 	ms := g.getOrCreateMemberSet(h)
 	ms.mu.Lock()
+	_, wasMember := ms.members[pubkey]
 	ms.members[pubkey] = struct{}{}
 	ms.mu.Unlock()
 
+	if err := g.publishMemberDelta(nostr.KindSimpleGroupPutUser, h, []nostr.Tag{{"p", pubkey.Hex()}}, nostr.Now()); err != nil {
+		if !wasMember {
+			ms.mu.Lock()
+			delete(ms.members, pubkey)
+			ms.mu.Unlock()
+		}
+		return err
+	}
+
 	// AddMember adds without roles, so clear any existing roles
 	g.ClearMemberRoles(h, pubkey)
+	g.resolveJoinRequest(h, pubkey)
+
+	if !wasMember {
+		g.announcePresence(h, "join", pubkey)
+	}
 
 	return nil
 }
 
 func (g *GroupStore) RemoveMember(h string, pubkey nostr.PubKey) error {
-	event := nostr.Event{
-		Kind:      nostr.KindSimpleGroupRemoveUser,
-		CreatedAt: nostr.Now(),
-		Tags: nostr.Tags{
-			nostr.Tag{"p", pubkey.Hex()},
-			nostr.Tag{"h", h},
-		},
-	}
-
-	if err := g.Events.SignAndStoreEvent(&event, true); err != nil {
-		return err
-	}
-
-	if v, ok := g.membershipCache.Load(h); ok {
+	wasMember := false
+	v, cached := g.membershipCache.Load(h)
+	if cached {
 		ms := v.(*memberSet)
 		ms.mu.Lock()
+		_, wasMember = ms.members[pubkey]
 		delete(ms.members, pubkey)
 		ms.mu.Unlock()
 	}
 
+	if err := g.publishMemberDelta(nostr.KindSimpleGroupRemoveUser, h, []nostr.Tag{{"p", pubkey.Hex()}}, nostr.Now()); err != nil {
+		if wasMember {
+			ms := v.(*memberSet)
+			ms.mu.Lock()
+			ms.members[pubkey] = struct{}{}
+			ms.mu.Unlock()
+		}
+		return err
+	}
+
 	g.ClearMemberRoles(h, pubkey)
+	g.resolveJoinRequest(h, pubkey)
+
+	// Without the cache there's no telling, so it's announced anyway
+	if wasMember || !cached {
+		g.announcePresence(h, "leave", pubkey)
+	}
 
 	return nil
 }
 
+// IsMember reports whether pubkey is a member of h. It fails closed: when
+// membership can't be checked it says no, see CheckMember.
 func (g *GroupStore) IsMember(h string, pubkey nostr.PubKey) bool {
+	member, err := g.CheckMember(h, pubkey)
+	if err != nil {
+		log.Printf("Failed to check membership of %s in group %q: %v", pubkey.Hex(), h, err)
+	}
+	return member
+}
+
+// CheckMember reports whether pubkey is a member of h, or the error that
+// kept it from finding out, so callers can decide which way to fail.
+func (g *GroupStore) CheckMember(h string, pubkey nostr.PubKey) (bool, error) {
 	// Per-group authoritative check: only trust the cache if WarmCaches
 	// successfully loaded a kind-39002 snapshot for this group. If not
 	// (partial WarmCaches scan, group created post-restart with no
@@ -728,46 +1060,18 @@ func (g *GroupStore) IsMember(h string, pubkey nostr.PubKey) bool {
 			ms.mu.RLock()
 			_, found := ms.members[pubkey]
 			ms.mu.RUnlock()
-			return found
+			return found, nil
 		}
 		// Marked fully loaded but no cache entry — shouldn't happen
 		// because they're set together. Defensive: treat as unloaded
 		// and fall through.
 	}
 
-	filter := nostr.Filter{
-		Kinds: []nostr.Kind{nostr.KindSimpleGroupPutUser, nostr.KindSimpleGroupRemoveUser},
-		Tags: nostr.TagMap{
-			"p": []string{pubkey.Hex()},
-			"h": []string{h},
-		},
-	}
-
-	// Walk all (typically very few) put/remove events for this
-	// (pubkey, group) pair and pick the strictly latest by
-	// (created_at, id). QueryEvents orders by created_at DESC but
-	// with no secondary tiebreak — when add+remove land in the same
-	// second (test rapid-fire, real bursts), `LIMIT 1` returns an
-	// arbitrary one and the membership decision flips run-to-run.
-	// id is the canonical event hash so bytes.Compare gives a
-	// deterministic, total tiebreak.
-	var latest nostr.Event
-	var have bool
-	for event := range g.Events.QueryEvents(filter, 0) {
-		if !have {
-			latest = event
-			have = true
-			continue
-		}
-		if event.CreatedAt > latest.CreatedAt ||
-			(event.CreatedAt == latest.CreatedAt && bytes.Compare(event.ID[:], latest.ID[:]) > 0) {
-			latest = event
-		}
-	}
-	if !have {
-		return false
-	}
-	return latest.Kind == nostr.KindSimpleGroupPutUser
+	// The latest put/remove event for this (pubkey, group) pair decides,
+	// by (created_at, id) so that an add and a remove in the same second
+	// give the same answer every time. A put/remove event may list several
+	// p tags, so this can't be a replaceable-style lookup.
+	return g.Events.GroupMembership(h, pubkey)
 }
 
 func (g *GroupStore) GetMembers(h string) []nostr.PubKey {
@@ -794,7 +1098,7 @@ func (g *GroupStore) GetMembers(h string) []nostr.PubKey {
 
 	members := make(map[nostr.PubKey]struct{})
 
-	for _, event := range Reversed(slices.Collect(g.Events.QueryEvents(filter, 0))) {
+	for event := range g.Events.QueryEventsOldestFirst(filter, 0) {
 		for tag := range event.Tags.FindAll("p") {
 			if pubkey, err := nostr.PubKeyFromHex(tag[1]); err == nil {
 				if event.Kind == nostr.KindSimpleGroupPutUser {
@@ -846,6 +1150,15 @@ func (g *GroupStore) UpdateMembersList(h string) error {
 		nostr.Tag{"d", h},
 	}
 
+	// Read before the members, so the list includes every change up to it
+	seq, err := g.MemberSeq(g.Events.rootCtx, h)
+	if err != nil {
+		return err
+	}
+	if seq > 0 {
+		tags = append(tags, nostr.Tag{"seq", strconv.FormatInt(seq, 10)})
+	}
+
 	// Snapshot role data once to avoid repeated sync.Map lookups and lock churn
 	var roleSnapshot map[nostr.PubKey]map[string]struct{}
 	if v, ok := g.roleCache.Load(h); ok {
@@ -895,7 +1208,16 @@ func (g *GroupStore) UpdateMembersList(h string) error {
 	//    explicitly before the first AddMember/UpdateMembersList,
 	//    because a brand-new group has no pre-existing members and
 	//    the cache trivially reflects full membership.
-	return g.Events.SignAndStoreEvent(&event, true)
+	if err := g.Events.signAndStoreList("members", &event, true); err != nil {
+		return err
+	}
+
+	// Unsigned means the stored list was already the same
+	if event.Sig != [64]byte{} {
+		g.memberSnapshots.Store(h, event.ID)
+	}
+
+	return nil
 }
 
 // ScheduleMembersListUpdate publishes a fresh kind-39002 for h, debounced by
@@ -1062,6 +1384,24 @@ func (g *GroupStore) IsWriteRestricted(h string) bool {
 	return HasTag(meta.Tags, "write-restricted")
 }
 
+// IsArchived reports whether group h has been archived with an
+// "archived": true metadata flag. Archived groups stay readable but only
+// admins can write to them; editing the flag away unarchives the group.
+func (g *GroupStore) IsArchived(h string) bool {
+	if g.cachesWarmed {
+		if v, ok := g.metadataCache.Load(h); ok {
+			return v.(*groupMetaCache).archived
+		}
+		return false
+	}
+
+	meta, found := g.GetMetadata(h)
+	if !found {
+		return false
+	}
+	return HasTag(meta.Tags, "archived")
+}
+
 func (g *GroupStore) HasRole(h string, pubkey nostr.PubKey, role string) bool {
 	if v, ok := g.roleCache.Load(h); ok {
 		rs := v.(*roleSet)
@@ -1076,10 +1416,11 @@ func (g *GroupStore) HasRole(h string, pubkey nostr.PubKey, role string) bool {
 }
 
 // CanWrite checks if a user can post content to a write-restricted group.
-// Returns true if the group is not write-restricted, or if the user is an
-// admin, group creator, or has the "writer" role AND is a current member.
+// Returns true if the group is not write-restricted (per GroupPolicy), or if
+// the user is an admin, group creator, or has the "writer" role AND is a
+// current member.
 func (g *GroupStore) CanWrite(h string, pubkey nostr.PubKey) bool {
-	if !g.IsWriteRestricted(h) {
+	if !g.GroupPolicy(h).WriteRestricted {
 		return true
 	}
 	if g.Config.CanManage(pubkey) || g.IsGroupCreator(h, pubkey) {
@@ -1159,12 +1500,21 @@ func (g *GroupStore) CanRead(pubkey nostr.PubKey, event nostr.Event) bool {
 		return true
 	}
 
+	// Deletions outlive the group, so anyone can learn that it's gone
+	if event.Kind == nostr.KindSimpleGroupDeleteGroup {
+		return true
+	}
+
 	meta, found := g.GetMetadata(h)
 
 	if !found {
 		return false
 	}
 
+	if event.Kind == KindSimpleGroupJoinRequests {
+		return g.canAnswerJoinRequests(h, pubkey)
+	}
+
 	if HasTag(meta.Tags, "hidden") && !g.HasAccess(h, pubkey) {
 		return false
 	}
@@ -1173,10 +1523,6 @@ func (g *GroupStore) CanRead(pubkey nostr.PubKey, event nostr.Event) bool {
 		return true
 	}
 
-	if event.Kind == nostr.KindSimpleGroupDeleteGroup {
-		return true
-	}
-
 	// For private groups, require membership
 	if HasTag(meta.Tags, "private") && !g.HasAccess(h, pubkey) {
 		return false
@@ -1193,11 +1539,11 @@ func (g *GroupStore) CanRead(pubkey nostr.PubKey, event nostr.Event) bool {
 
 func (g *GroupStore) CheckWrite(event nostr.Event) string {
 	if !g.Config.Groups.Enabled {
-		return "invalid: groups are not enabled"
+		return RejectInvalid.Reason("groups are not enabled")
 	}
 
 	if slices.Contains(nip29.MetadataEventKinds, event.Kind) {
-		return "invalid: group metadata cannot be set directly"
+		return RejectRestricted.Reason("group metadata cannot be set directly")
 	}
 
 	h := GetGroupIDFromEvent(event)
@@ -1205,51 +1551,108 @@ func (g *GroupStore) CheckWrite(event nostr.Event) string {
 
 	if event.Kind == nostr.KindSimpleGroupCreateGroup {
 		if found {
-			return "invalid: that group already exists"
+			return RejectInvalid.Reason("that group already exists")
 		}
 		// If admin_create_only is set, only admins can create groups
 		if g.Config.Groups.AdminCreateOnly && !g.Config.CanManage(event.PubKey) {
-			return "restricted: only admins can create groups"
+			return RejectRestricted.Reason("only admins can create groups")
 		}
 		// If private_admin_only is set, check if group is private
 		if g.Config.Groups.PrivateAdminOnly && !g.Config.CanManage(event.PubKey) {
 			if isPrivateGroupContent(event.Content) {
-				return "restricted: only admins can create private groups"
+				return RejectRestricted.Reason("only admins can create private groups")
 			}
 		}
 		// Write-restricted groups can only be created by relay admins
 		if isWriteRestrictedGroupContent(event.Content) && !g.Config.CanManage(event.PubKey) {
-			return "restricted: only admins can create write-restricted groups"
+			return RejectRestricted.Reason("only admins can create write-restricted groups")
 		}
 		// Group creation check passed, don't apply general ModerationEventKinds check
 		return ""
 	} else if !found {
-		return "invalid: group not found"
+		return RejectInvalid.Reason("group not found")
+	}
+
+	if event.Kind == nostr.KindSimpleGroupPutUser || event.Kind == nostr.KindSimpleGroupRemoveUser {
+		if reason := g.checkMemberTags(event); reason != "" {
+			return reason
+		}
+	}
+
+	// Trusted signers mirror another relay's decisions, so this relay's
+	// rules for who may manage a group don't apply to them
+	if g.isTrustedSignerEvent(event) {
+		if h == "_" {
+			return RejectRestricted.Reason("trusted signers cannot change relay-level state")
+		}
+		return ""
 	}
 
 	if slices.Contains(nip29.ModerationEventKinds, event.Kind) {
 		if g.IsPrivateGroup(h) && !g.Config.Groups.PrivateRelayAdminAccess {
 			// For private groups without relay admin access, only the creator can moderate
 			if !g.IsGroupCreator(h, event.PubKey) {
-				return "restricted: only the group creator can manage private groups"
+				return RejectRestricted.Reason("only the group creator can manage private groups")
 			}
 		} else if !g.Config.CanManage(event.PubKey) && !g.IsGroupCreator(h, event.PubKey) {
-			return "restricted: you are not authorized to manage groups"
+			return RejectRestricted.Reason("you are not authorized to manage groups")
 		}
 		// Only relay admins can change the write-restricted flag on a group
 		if event.Kind == nostr.KindSimpleGroupEditMetadata && !g.Config.CanManage(event.PubKey) {
 			wasWriteRestricted := g.IsWriteRestricted(h)
 			willBeWriteRestricted := isWriteRestrictedGroupContent(event.Content)
 			if wasWriteRestricted != willBeWriteRestricted {
-				return "restricted: only admins can change write-restricted on groups"
+				return RejectRestricted.Reason("only admins can change write-restricted on groups")
+			}
+		}
+	}
+
+	// Archived groups are frozen: only relay admins and the creator, who can
+	// also unarchive the group, may still write to it.
+	if g.IsArchived(h) && !g.Config.CanManage(event.PubKey) && !g.IsGroupCreator(h, event.PubKey) {
+		return RejectRestricted.Reason("group is archived")
+	}
+
+	if event.Kind == KindSimpleGroupPin {
+		return g.checkPin(h, event)
+	}
+
+	// Ephemeral events such as typing indicators are never stored; all that
+	// matters is that they don't come from outside the group
+	if event.Kind.IsEphemeral() {
+		if !g.HasAccess(h, event.PubKey) {
+			return RejectRestricted.Reason("you are not a member of that group")
+		}
+		return ""
+	}
+
+	if event.Kind == nostr.KindSimpleGroupPutUser {
+		var pubkeys []nostr.PubKey
+		for i, tag := range event.Tags {
+			if len(tag) < 2 || tag[0] != "p" {
+				continue
 			}
+			pubkey := nostr.MustPubKeyFromHex(tag[1])
+			if g.Management.PubkeyIsBanned(pubkey) {
+				return RejectRestricted.Reason(fmt.Sprintf("tag %d: %s is banned from this relay", i, tag[1]))
+			}
+			pubkeys = append(pubkeys, pubkey)
+		}
+		if err := g.checkCapacity(h, pubkeys, true); err != nil {
+			return err.Error()
 		}
 	}
 
 	// Handle join requests - check invite code for private/hidden groups
 	if event.Kind == nostr.KindSimpleGroupJoinRequest {
-		if g.IsMember(h, event.PubKey) {
-			return "duplicate: already a member"
+		if member, err := g.CheckMember(h, event.PubKey); err != nil {
+			return RejectError.Reason("couldn't check group membership, try again")
+		} else if member {
+			return RejectDuplicate.Reason("already a member")
+		}
+
+		if err := g.checkCapacity(h, []nostr.PubKey{event.PubKey}, false); err != nil {
+			return err.Error()
 		}
 
 		isPrivate := HasTag(meta.Tags, "private")
@@ -1261,9 +1664,9 @@ func (g *GroupStore) CheckWrite(event nostr.Event) string {
 			if !g.ValidateInviteCode(h, inviteCode) {
 				if isHidden {
 					// Don't reveal that the group exists
-					return "invalid: group not found"
+					return RejectInvalid.Reason("group not found")
 				}
-				return "restricted: valid invite code required to join this group"
+				return RejectRestricted.Reason("valid invite code required to join this group")
 			}
 		}
 
@@ -1272,27 +1675,42 @@ func (g *GroupStore) CheckWrite(event nostr.Event) string {
 
 	// For non-join requests, hidden groups require access
 	if HasTag(meta.Tags, "hidden") && !g.HasAccess(h, event.PubKey) {
-		return "invalid: group not found"
+		return RejectInvalid.Reason("group not found")
 	}
 
 	if event.Kind == nostr.KindSimpleGroupLeaveRequest {
-		if !g.IsMember(h, event.PubKey) {
-			return "duplicate: not currently a member"
+		if member, err := g.CheckMember(h, event.PubKey); err != nil {
+			return RejectError.Reason("couldn't check group membership, try again")
+		} else if !member {
+			return RejectDuplicate.Reason("not currently a member")
 		} else {
 			return ""
 		}
 	}
 
 	if HasTag(meta.Tags, "closed") && !g.HasAccess(h, event.PubKey) {
-		return "restricted: you are not a member of that group"
+		return RejectRestricted.Reason("you are not a member of that group")
 	}
 
 	// Write-restricted check: only users with "writer" role, admins, or creator can post
-	if HasTag(meta.Tags, "write-restricted") && !g.CanWrite(h, event.PubKey) {
-		return "restricted: this group only allows designated writers to post"
+	if !g.CanWrite(h, event.PubKey) {
+		return RejectRestricted.Reason("this group only allows designated writers to post")
 	}
 
-	return ""
+	return g.checkParents(h, event)
+}
+
+// isTrustedSignerEvent reports whether event is a membership or metadata
+// change signed by one of groups.trusted_signers.
+func (g *GroupStore) isTrustedSignerEvent(event nostr.Event) bool {
+	switch event.Kind {
+	case nostr.KindSimpleGroupPutUser,
+		nostr.KindSimpleGroupRemoveUser,
+		nostr.KindSimpleGroupEditMetadata:
+		return g.Config.IsTrustedSigner(event.PubKey)
+	}
+
+	return false
 }
 
 // Middleware
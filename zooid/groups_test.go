@@ -1,6 +1,10 @@
 package zooid
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -349,7 +353,7 @@ func TestGroupStore_WarmCaches_FromMembersSnapshot(t *testing.T) {
 	inst.Groups.roleCache.Delete(groupID)
 	inst.Groups.membershipFullyLoaded.Delete(groupID)
 	inst.Groups.cachesWarmed = false
-	inst.Groups.WarmCaches()
+	inst.Groups.WarmCaches(context.Background())
 
 	if !inst.Groups.IsMember(groupID, memberA) {
 		t.Errorf("memberA missing from cache after WarmCaches; should have been loaded from kind-39002")
@@ -425,7 +429,7 @@ func TestGroupStore_WarmCaches_TailReplaysPostSnapshot(t *testing.T) {
 		return true
 	})
 	inst.Groups.cachesWarmed = false
-	inst.Groups.WarmCaches()
+	inst.Groups.WarmCaches(context.Background())
 
 	if !inst.Groups.IsMember(groupID, snapshotMember) {
 		t.Errorf("snapshotMember missing — should be loaded from kind-39002")
@@ -481,7 +485,7 @@ func TestGroupStore_WarmCaches_StaleAdminsSnapshotDoesNotOverride(t *testing.T)
 	inst.Groups.membershipCache.Delete(groupID)
 	inst.Groups.roleCache.Delete(groupID)
 	inst.Groups.cachesWarmed = false
-	inst.Groups.WarmCaches()
+	inst.Groups.WarmCaches(context.Background())
 
 	if !inst.Groups.IsMember(groupID, currentMember) {
 		t.Errorf("currentMember missing from cache after WarmCaches")
@@ -542,7 +546,7 @@ func TestGroupStore_IsMember_PartialWarmFallsBackToDB(t *testing.T) {
 		return true
 	})
 	inst.Groups.cachesWarmed = false
-	inst.Groups.WarmCaches()
+	inst.Groups.WarmCaches(context.Background())
 
 	// groupA: cache authoritative. memberA in cache → true.
 	if !inst.Groups.IsMember("groupA", memberA) {
@@ -604,9 +608,528 @@ func TestGroupStore_WarmCaches_StaysPreWarmWhenSnapshotReadsEmpty(t *testing.T)
 	})
 	inst.Groups.cachesWarmed = false
 
-	inst.Groups.WarmCaches()
+	inst.Groups.WarmCaches(context.Background())
 
 	if inst.Groups.cachesWarmed {
 		t.Errorf("cachesWarmed unexpectedly true: metadata has groups but no membership snapshots were read; should stay in pre-warm mode so IsMember falls back to DB")
 	}
 }
+
+// === Per-group policy overrides ===
+
+func TestGroupStore_GroupPolicy_Defaults(t *testing.T) {
+	groups, _ := createTestGroupStore()
+	groups.Config.Groups.AutoJoin = true
+	groups.Config.Groups.Retention.Default = "7d"
+	groups.WarmCaches(context.Background())
+
+	policy := groups.GroupPolicy("unknown")
+
+	if !policy.AutoJoin {
+		t.Error("AutoJoin should fall back to groups.auto_join")
+	}
+	if policy.WriteRestricted {
+		t.Error("WriteRestricted should be false for a group without the metadata flag")
+	}
+	if policy.MaxMembers != 0 {
+		t.Errorf("MaxMembers = %d, want 0 (unlimited)", policy.MaxMembers)
+	}
+	if policy.Retention != 7*24*time.Hour {
+		t.Errorf("Retention = %v, want 7d default", policy.Retention)
+	}
+	if policy.RateMultiplier != 1 {
+		t.Errorf("RateMultiplier = %v, want 1", policy.RateMultiplier)
+	}
+}
+
+func TestGroupStore_GroupPolicy_OverridePrecedence(t *testing.T) {
+	groups, _ := createTestGroupStore()
+	groups.Config.Groups.AutoJoin = true
+	groups.Config.Groups.Retention.Default = "7d"
+	groups.WarmCaches(context.Background())
+
+	// Metadata says write-restricted; the override lifts it.
+	groups.UpdateMetadata(nostr.Event{
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "general"}},
+		Content:   `{"name":"General","write-restricted":true}`,
+	})
+
+	no, yes := false, true
+	groups.Config.Groups.Overrides = map[string]GroupOverride{
+		"announcements": {WriteRestricted: &yes, RetentionExempt: true, AutoJoin: &no},
+		"general":       {WriteRestricted: &no, MaxMembers: 50, RateMultiplier: 2.5},
+	}
+
+	announcements := groups.GroupPolicy("announcements")
+	if !announcements.WriteRestricted {
+		t.Error("write_restricted override should force the flag on")
+	}
+	if announcements.Retention != 0 {
+		t.Errorf("retention_exempt group Retention = %v, want 0", announcements.Retention)
+	}
+	if announcements.AutoJoin {
+		t.Error("auto_join override should win over the global setting")
+	}
+
+	general := groups.GroupPolicy("general")
+	if general.WriteRestricted {
+		t.Error("write_restricted = false override should win over the metadata flag")
+	}
+	if general.MaxMembers != 50 || general.RateMultiplier != 2.5 {
+		t.Errorf("general policy = %+v, want max_members 50 and rate_multiplier 2.5", general)
+	}
+	if !general.AutoJoin {
+		t.Error("unset auto_join override should fall back to the global setting")
+	}
+
+	pk := nostr.Generate().Public()
+	groups.AddMember("general", pk)
+	if !groups.CanWrite("general", pk) {
+		t.Error("CanWrite should follow the override, not the metadata flag")
+	}
+}
+
+func TestGroupStore_GroupPolicy_MaxMembers(t *testing.T) {
+	groups, _ := createTestGroupStore()
+	groups.WarmCaches(context.Background())
+
+	groups.UpdateMetadata(nostr.Event{
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "small"}},
+		Content:   `{"name":"Small"}`,
+	})
+	groups.membershipFullyLoaded.Store("small", struct{}{})
+	groups.AddMember("small", nostr.Generate().Public())
+
+	groups.Config.Groups.Overrides = map[string]GroupOverride{"small": {MaxMembers: 1}}
+
+	join := nostr.Event{
+		Kind:   nostr.KindSimpleGroupJoinRequest,
+		PubKey: nostr.Generate().Public(),
+		Tags:   nostr.Tags{{"h", "small"}},
+	}
+	if msg := groups.CheckWrite(join); msg != "restricted: group is full" {
+		t.Errorf("CheckWrite() = %q, want group full rejection", msg)
+	}
+}
+
+func TestGroupStore_ApplyConfig_HotReload(t *testing.T) {
+	groups, _ := createTestGroupStore()
+	groups.WarmCaches(context.Background())
+
+	if groups.GroupPolicy("announcements").WriteRestricted {
+		t.Fatal("setup: announcements should not be write-restricted before reload")
+	}
+
+	yes := true
+	reloaded := &Config{Host: groups.Config.Host, secret: groups.Config.secret}
+	reloaded.Groups.Enabled = true
+	reloaded.Groups.AutoJoin = true
+	reloaded.Groups.Overrides = map[string]GroupOverride{
+		"announcements": {WriteRestricted: &yes},
+	}
+	groups.ApplyConfig(reloaded)
+
+	if !groups.GroupPolicy("announcements").WriteRestricted {
+		t.Error("ApplyConfig should make the new override visible to GroupPolicy")
+	}
+	if !groups.GroupPolicy("other").AutoJoin {
+		t.Error("ApplyConfig should also refresh the global defaults")
+	}
+	if groups.Config.Groups.AutoJoin {
+		t.Error("ApplyConfig should not mutate the original config")
+	}
+}
+
+func TestGroupStore_UpdateMetadata_MissingH(t *testing.T) {
+	groups, _ := createTestGroupStore()
+
+	edit := nostr.Event{
+		Kind:      nostr.KindSimpleGroupEditMetadata,
+		CreatedAt: nostr.Now(),
+		Content:   `{"name":"No Group"}`,
+	}
+	edit.Sign(nostr.Generate())
+
+	if err := groups.UpdateMetadata(edit); !errors.Is(err, ErrMissingDTag) {
+		t.Errorf("UpdateMetadata error = %v, want ErrMissingDTag", err)
+	}
+
+	if count, _ := groups.Events.CountEvents(nostr.Filter{Kinds: []nostr.Kind{nostr.KindSimpleGroupMetadata}}); count != 0 {
+		t.Errorf("%d metadata events stored, want 0", count)
+	}
+}
+
+func TestGroupStore_MaxMembers_FillToCap(t *testing.T) {
+	groups, _ := createTestGroupStore()
+	groups.WarmCaches(context.Background())
+
+	groups.UpdateMetadata(nostr.Event{
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "capped"}, {"max_members", "3"}},
+		Content:   `{"name":"Capped"}`,
+	})
+	groups.membershipFullyLoaded.Store("capped", struct{}{})
+
+	if max := groups.GroupPolicy("capped").MaxMembers; max != 3 {
+		t.Fatalf("MaxMembers = %d, want 3 from the metadata tag", max)
+	}
+
+	join := func(pubkey nostr.PubKey) nostr.Event {
+		return nostr.Event{
+			Kind:   nostr.KindSimpleGroupJoinRequest,
+			PubKey: pubkey,
+			Tags:   nostr.Tags{{"h", "capped"}},
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		pubkey := nostr.Generate().Public()
+		if msg := groups.CheckWrite(join(pubkey)); msg != "" {
+			t.Fatalf("join %d rejected: %q", i, msg)
+		}
+		if err := groups.AddMember("capped", pubkey); err != nil {
+			t.Fatalf("AddMember %d: %v", i, err)
+		}
+	}
+
+	late := nostr.Generate().Public()
+	if msg := groups.CheckWrite(join(late)); msg != "restricted: group is full" {
+		t.Errorf("CheckWrite() = %q, want group full rejection", msg)
+	}
+	if err := groups.AddMember("capped", late); !errors.Is(err, ErrGroupFull) {
+		t.Errorf("AddMember() error = %v, want ErrGroupFull", err)
+	}
+	if count := groups.GetMemberCount("capped"); count != 3 {
+		t.Errorf("member count = %d, want 3", count)
+	}
+}
+
+func TestGroupStore_MaxMembers_AdminAdd(t *testing.T) {
+	groups, _ := createTestGroupStore()
+	groups.WarmCaches(context.Background())
+
+	groups.UpdateMetadata(nostr.Event{
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "capped"}},
+		Content:   `{"name":"Capped"}`,
+	})
+	groups.membershipFullyLoaded.Store("capped", struct{}{})
+	groups.AddMember("capped", nostr.Generate().Public())
+	groups.Config.Groups.Overrides = map[string]GroupOverride{"capped": {MaxMembers: 1}}
+
+	put := nostr.Event{
+		Kind:   nostr.KindSimpleGroupPutUser,
+		PubKey: groups.Config.secret.Public(),
+		Tags:   nostr.Tags{{"h", "capped"}, {"p", nostr.Generate().Public().Hex()}},
+	}
+
+	if msg := groups.CheckWrite(put); msg != "restricted: group is full" {
+		t.Errorf("CheckWrite() = %q, want group full rejection", msg)
+	}
+
+	groups.Config.Groups.AdminsExceedMaxMembers = true
+	if msg := groups.CheckWrite(put); msg != "" {
+		t.Errorf("CheckWrite() = %q, admins should be allowed past the cap", msg)
+	}
+}
+
+func TestGroupStore_MaxMembers_CountsUnloadedAndBatches(t *testing.T) {
+	groups, _ := createTestGroupStore()
+	groups.WarmCaches(context.Background())
+
+	groups.UpdateMetadata(nostr.Event{
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "capped"}, {"max_members", "3"}},
+		Content:   `{"name":"Capped"}`,
+	})
+
+	// Members only in the log, as after a restart that missed the snapshot
+	existing := []nostr.PubKey{nostr.Generate().Public(), nostr.Generate().Public()}
+	for _, pubkey := range existing {
+		put := nostr.Event{
+			Kind:      nostr.KindSimpleGroupPutUser,
+			CreatedAt: nostr.Now(),
+			Tags:      nostr.Tags{{"h", "capped"}, {"p", pubkey.Hex()}},
+		}
+		if err := groups.Config.Sign(&put); err != nil {
+			t.Fatal(err)
+		}
+		if err := groups.Events.StoreEvent(put); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, loaded := groups.membershipFullyLoaded.Load("capped"); loaded {
+		t.Fatal("the group shouldn't be fully loaded")
+	}
+
+	put := func(pubkeys ...nostr.PubKey) nostr.Event {
+		tags := nostr.Tags{{"h", "capped"}}
+		for _, pubkey := range pubkeys {
+			tags = append(tags, nostr.Tag{"p", pubkey.Hex()})
+		}
+		return nostr.Event{Kind: nostr.KindSimpleGroupPutUser, PubKey: groups.Config.secret.Public(), Tags: tags}
+	}
+
+	if msg := groups.CheckWrite(put(nostr.Generate().Public(), nostr.Generate().Public())); msg != "restricted: group is full" {
+		t.Errorf("CheckWrite() = %q, want group full rejection for two adds into one free place", msg)
+	}
+	if msg := groups.CheckWrite(put(existing[0], nostr.Generate().Public())); msg != "" {
+		t.Errorf("CheckWrite() = %q, an existing member and one add fit", msg)
+	}
+	if err := groups.AddMember("capped", nostr.Generate().Public()); err != nil {
+		t.Fatalf("AddMember() error = %v, one place is free", err)
+	}
+}
+
+func TestGroupStore_MemberTags(t *testing.T) {
+	groups, mgmt := createTestGroupStore()
+	groups.WarmCaches(context.Background())
+
+	groups.UpdateMetadata(nostr.Event{
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "club"}},
+		Content:   `{"name":"Club"}`,
+	})
+
+	put := func(kind nostr.Kind, pubkeys ...string) nostr.Event {
+		tags := nostr.Tags{{"h", "club"}}
+		for _, pubkey := range pubkeys {
+			tags = append(tags, nostr.Tag{"p", pubkey})
+		}
+		return nostr.Event{Kind: kind, PubKey: groups.Config.secret.Public(), Tags: tags}
+	}
+	alice := nostr.Generate().Public().Hex()
+
+	if msg := groups.CheckWrite(put(nostr.KindSimpleGroupPutUser, alice)); msg != "" {
+		t.Errorf("CheckWrite() = %q for a valid put user", msg)
+	}
+
+	// The failing tag is named by its index
+	if msg := groups.CheckWrite(put(nostr.KindSimpleGroupPutUser, alice, "bob")); msg != `invalid: tag 2: "bob" is not a valid pubkey` {
+		t.Errorf("CheckWrite() = %q for an invalid p tag", msg)
+	}
+	if msg := groups.CheckWrite(put(nostr.KindSimpleGroupRemoveUser, "bob")); !strings.HasPrefix(msg, "invalid: tag 1:") {
+		t.Errorf("CheckWrite() = %q for an invalid p tag on remove user", msg)
+	}
+
+	many := make([]string, 51)
+	for i := range many {
+		many[i] = nostr.Generate().Public().Hex()
+	}
+	if msg := groups.CheckWrite(put(nostr.KindSimpleGroupPutUser, many...)); msg != "invalid: too many p tags: 51, at most 50 per event" {
+		t.Errorf("CheckWrite() = %q for 51 p tags", msg)
+	}
+	groups.Config.Groups.MaxMemberTags = 100
+	if msg := groups.CheckWrite(put(nostr.KindSimpleGroupPutUser, many...)); msg != "" {
+		t.Errorf("CheckWrite() = %q for 51 p tags with max_member_tags = 100", msg)
+	}
+
+	// Banned pubkeys can't be added, but can still be removed
+	banned := nostr.Generate().Public()
+	mgmt.AddBannedPubkey(banned, "spam")
+	if msg := groups.CheckWrite(put(nostr.KindSimpleGroupPutUser, alice, banned.Hex())); msg != "restricted: tag 2: "+banned.Hex()+" is banned from this relay" {
+		t.Errorf("CheckWrite() = %q for a banned pubkey", msg)
+	}
+	if msg := groups.CheckWrite(put(nostr.KindSimpleGroupRemoveUser, banned.Hex())); msg != "" {
+		t.Errorf("CheckWrite() = %q removing a banned pubkey", msg)
+	}
+}
+
+func TestGroupStore_Archived(t *testing.T) {
+	groups, _ := createTestGroupStore()
+	groups.WarmCaches(context.Background())
+
+	creator := nostr.Generate().Public()
+	member := nostr.Generate().Public()
+	outsider := nostr.Generate().Public()
+
+	groups.creatorCache.Store("frozen", creator)
+	groups.UpdateMetadata(nostr.Event{
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "frozen"}},
+		Content:   `{"name":"Frozen","archived":true}`,
+	})
+	groups.membershipFullyLoaded.Store("frozen", struct{}{})
+	groups.AddMember("frozen", member)
+
+	if !groups.IsArchived("frozen") {
+		t.Fatal("group should be archived")
+	}
+
+	write := func(kind nostr.Kind, pubkey nostr.PubKey) string {
+		return groups.CheckWrite(nostr.Event{
+			Kind:   kind,
+			PubKey: pubkey,
+			Tags:   nostr.Tags{{"h", "frozen"}},
+		})
+	}
+
+	cases := []struct {
+		name   string
+		kind   nostr.Kind
+		pubkey nostr.PubKey
+	}{
+		{"post", nostr.Kind(9), member},
+		{"join", nostr.KindSimpleGroupJoinRequest, outsider},
+		{"leave", nostr.KindSimpleGroupLeaveRequest, member},
+	}
+	for _, c := range cases {
+		if msg := write(c.kind, c.pubkey); msg != "restricted: group is archived" {
+			t.Errorf("%s: CheckWrite() = %q, want archived rejection", c.name, msg)
+		}
+	}
+
+	if !groups.CanRead(member, nostr.Event{Kind: nostr.Kind(9), Tags: nostr.Tags{{"h", "frozen"}}}) {
+		t.Error("members should still be able to read an archived group")
+	}
+
+	if msg := write(nostr.Kind(9), creator); msg != "" {
+		t.Errorf("creator post: CheckWrite() = %q, want allowed", msg)
+	}
+
+	// Unarchive by editing the flag away.
+	groups.UpdateMetadata(nostr.Event{
+		CreatedAt: nostr.Now() + 1,
+		Tags:      nostr.Tags{{"h", "frozen"}},
+		Content:   `{"name":"Frozen","archived":false}`,
+	})
+
+	if groups.IsArchived("frozen") {
+		t.Fatal("group should no longer be archived")
+	}
+	if msg := write(nostr.Kind(9), member); msg != "" {
+		t.Errorf("post after unarchive: CheckWrite() = %q, want allowed", msg)
+	}
+}
+
+func TestGroupStore_TrustedSigners(t *testing.T) {
+	instance := createTestInstance()
+	runTestAdmin(t, instance, "create-group", "mirror", "--private", "--closed")
+
+	upstream := nostr.Generate()
+	stranger := nostr.Generate()
+	instance.Config.trustedSigners = []nostr.PubKey{upstream.Public()}
+
+	write := func(author nostr.SecretKey, kind nostr.Kind, h string) string {
+		return instance.Groups.CheckWrite(signedBy(author, nostr.Event{
+			Kind: kind,
+			Tags: nostr.Tags{{"h", h}, {"p", stranger.Public().Hex()}},
+		}))
+	}
+
+	for _, kind := range []nostr.Kind{nostr.KindSimpleGroupPutUser, nostr.KindSimpleGroupRemoveUser, nostr.KindSimpleGroupEditMetadata} {
+		if msg := write(upstream, kind, "mirror"); msg != "" {
+			t.Errorf("kind %d from a trusted signer: CheckWrite() = %q, want allowed", kind, msg)
+		}
+		if msg := write(stranger, kind, "mirror"); msg == "" {
+			t.Errorf("kind %d from an untrusted key should be refused", kind)
+		}
+	}
+
+	if msg := write(upstream, nostr.KindSimpleGroupPutUser, "missing"); msg != "invalid: group not found" {
+		t.Errorf("put user in a missing group: CheckWrite() = %q", msg)
+	}
+	if msg := write(upstream, nostr.KindSimpleGroupDeleteGroup, "mirror"); msg == "" {
+		t.Error("trust should only cover membership and metadata changes")
+	}
+	if msg := write(upstream, nostr.KindSimpleGroupChatMessage, "mirror"); msg == "" {
+		t.Error("a trusted signer should not post in a closed group it isn't in")
+	}
+}
+
+// TestGroupStore_CheckMember_Uncached exercises the database path of
+// CheckMember, with put/remove events listing several pubkeys, the one
+// looked up first or last among them.
+func TestGroupStore_CheckMember_Uncached(t *testing.T) {
+	inst := createTestInstance()
+	relaySec := inst.Config.secret
+
+	alice := nostr.Generate().Public()
+	bob := nostr.Generate().Public()
+	carol := nostr.Generate().Public()
+
+	mkAndSave := func(kind nostr.Kind, ts nostr.Timestamp, h string, pubkeys ...nostr.PubKey) nostr.Event {
+		evt := nostr.Event{Kind: kind, CreatedAt: ts, Tags: nostr.Tags{{"h", h}}}
+		for _, pk := range pubkeys {
+			evt.Tags = append(evt.Tags, nostr.Tag{"p", pk.Hex()})
+		}
+		evt.Sign(relaySec)
+		if err := inst.Events.SaveEvent(evt); err != nil {
+			t.Fatalf("SaveEvent(kind=%d): %v", kind, err)
+		}
+		return evt
+	}
+
+	mkAndSave(nostr.KindSimpleGroupPutUser, 1000, "multi", alice, bob, carol)
+	mkAndSave(nostr.KindSimpleGroupRemoveUser, 2000, "multi", carol, alice)
+	// Later events in another group don't count
+	mkAndSave(nostr.KindSimpleGroupPutUser, 3000, "other", alice)
+	mkAndSave(nostr.KindSimpleGroupRemoveUser, 3000, "other", bob)
+
+	for _, tc := range []struct {
+		name   string
+		pubkey nostr.PubKey
+		want   bool
+	}{
+		{"removed, first p tag", carol, false},
+		{"removed, last p tag", alice, false},
+		{"never removed", bob, true},
+		{"never added", nostr.Generate().Public(), false},
+	} {
+		member, err := inst.Groups.CheckMember("multi", tc.pubkey)
+		if err != nil {
+			t.Fatalf("%s: CheckMember failed: %v", tc.name, err)
+		}
+		if member != tc.want {
+			t.Errorf("%s: CheckMember = %v, want %v", tc.name, member, tc.want)
+		}
+	}
+
+	// An add and a remove in the same second are decided by id, the same
+	// way every time
+	put := mkAndSave(nostr.KindSimpleGroupPutUser, 4000, "tie", alice, bob)
+	remove := mkAndSave(nostr.KindSimpleGroupRemoveUser, 4000, "tie", bob, alice)
+	want := bytes.Compare(put.ID[:], remove.ID[:]) > 0
+	for _, pk := range []nostr.PubKey{alice, bob} {
+		for range 3 {
+			if member, err := inst.Groups.CheckMember("tie", pk); err != nil || member != want {
+				t.Fatalf("CheckMember in the same second = %v %v, want %v", member, err, want)
+			}
+		}
+	}
+
+	// Once the group's cache is fully loaded it's used instead
+	inst.Groups.membershipCache.Store("multi", &memberSet{members: map[nostr.PubKey]struct{}{alice: {}}})
+	inst.Groups.membershipFullyLoaded.Store("multi", struct{}{})
+	if member, _ := inst.Groups.CheckMember("multi", alice); !member {
+		t.Error("CheckMember ignored the fully loaded cache")
+	}
+}
+
+func TestGroupStore_CheckMember_Error(t *testing.T) {
+	skipOnMemory(t, "failing queries")
+
+	inst := createTestInstance()
+	pk := nostr.Generate().Public()
+	if err := inst.Groups.AddMember("errgrp", pk); err != nil {
+		t.Fatalf("AddMember failed: %v", err)
+	}
+	inst.Groups.membershipFullyLoaded.Delete("errgrp")
+
+	events := inst.Events.Schema
+	if _, err := GetDb().Exec("ALTER TABLE " + events.Prefix("event_tags") + " RENAME TO " + events.Index("event_tags_away")); err != nil {
+		t.Fatalf("renaming the event_tags table: %v", err)
+	}
+	t.Cleanup(func() {
+		GetDb().Exec("ALTER TABLE " + events.Prefix("event_tags_away") + " RENAME TO " + events.Index("event_tags"))
+	})
+
+	if _, err := inst.Groups.CheckMember("errgrp", pk); err == nil {
+		t.Error("CheckMember didn't report the failed query")
+	}
+	if inst.Groups.IsMember("errgrp", pk) {
+		t.Error("IsMember didn't fail closed")
+	}
+}
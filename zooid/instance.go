@@ -2,21 +2,28 @@ package zooid
 
 import (
 	"context"
+	"fmt"
 	"iter"
 	"log"
 	"net/http"
 	"reflect"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 	"unsafe"
 
 	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
 	"fiatjaf.com/nostr/khatru"
+	"fiatjaf.com/nostr/nip11"
 	"github.com/fasthttp/websocket"
-	"github.com/gosimple/slug"
 )
 
+// version is the relay software's version, as given in its NIP-11 document
+// and stats event.
+const version = "v0.1.0"
+
 type Instance struct {
 	// Ctx is the service-level root context, propagated from main via
 	// signal.NotifyContext. Stored here so per-call DB timeouts in
@@ -29,6 +36,67 @@ type Instance struct {
 	Blossom    *BlossomStore
 	Management *ManagementStore
 	Groups     *GroupStore
+
+	// readiness is where the instance is in its startup, see state.go.
+	readiness readiness
+
+	// broadcast holds the events already broadcast, see writetiming.go.
+	broadcast broadcastEvents
+
+	// groupQueue moves OnEventSaved's list rewrites off the websocket
+	// goroutine. nil (as in tests) runs them inline.
+	groupQueue *groupQueue
+
+	// stopReconciler cancels the periodic cache check, if one was started.
+	stopReconciler context.CancelFunc
+
+	// stopStatsPublisher cancels the periodic stats event, see relaystats.go.
+	stopStatsPublisher context.CancelFunc
+
+	// stopPurgeWorker cancels the queued account purges, see purge.go.
+	stopPurgeWorker context.CancelFunc
+
+	// ephemeral rate limits ephemeral events per pubkey, see ephemeral.go.
+	ephemeral rateLimiter
+
+	// Notifier is told about mentions in group events, see push.go.
+	Notifier Notifier
+
+	// stopNotifier stops the push notifier, sending what it has queued.
+	stopNotifier context.CancelFunc
+
+	// connections tracks open websockets, see connections.go.
+	connections connections
+
+	// stopReauthenticator stops re-challenging connections, if that was
+	// started.
+	stopReauthenticator context.CancelFunc
+
+	// unsubscribeCaches stops listening for other instances' cache
+	// messages, see cachebus.go.
+	unsubscribeCaches func()
+
+	// SpamChecker is asked about events before they're accepted, see
+	// spam.go. nil accepts everything.
+	SpamChecker SpamChecker
+	spamHistory SpamHistory
+	shadowed    sync.Map // map[nostr.ID]struct{}, events to pretend to store
+
+	// Transformers see events before they're stored, see transform.go.
+	Transformers []EventTransformer
+
+	// shadowBuffer holds shadow-banned pubkeys' events, see shadowban.go.
+	shadowBuffer shadowBuffer
+
+	// relayLists caches everyone's newest relay list, see relaylists.go.
+	relayLists relayListCache
+
+	// replaced throttles updates to replaceable events, see replaceable.go.
+	replaced replaceThrottle
+
+	// sent remembers what was recently broadcast to each connection, see
+	// dedup.go.
+	sent sync.Map // map[*khatru.WebSocket]*sentEvents
 }
 
 func MakeInstance(ctx context.Context, filename string) (*Instance, error) {
@@ -37,6 +105,14 @@ func MakeInstance(ctx context.Context, filename string) (*Instance, error) {
 		return nil, err
 	}
 
+	schema, err := NewSchema(SchemaName(config.Schema), config.Storage.NativeSchema)
+	if err != nil {
+		return nil, err
+	}
+	if err := claimSchema(config, schema.Name); err != nil {
+		return nil, err
+	}
+
 	relay := khatru.NewRelay()
 
 	// Enable WebSocket per-message compression (permessage-deflate).
@@ -47,12 +123,12 @@ func MakeInstance(ctx context.Context, filename string) (*Instance, error) {
 	upgrader.EnableCompression = true
 
 	events := &EventStore{
-		Relay:  relay,
-		Config: config,
-		Schema: &Schema{
-			Name: slug.Make(config.Schema),
-		},
-		rootCtx: ctx,
+		Relay:        relay,
+		Config:       config,
+		Schema:       schema,
+		rootCtx:      ctx,
+		VerifyOnSave: config.Policy.VerifySignatures,
+		slots:        newDBSlots(config.Schema, config.Storage.DBMaxConcurrent),
 	}
 
 	blossom := &BlossomStore{
@@ -85,25 +161,35 @@ func MakeInstance(ctx context.Context, filename string) (*Instance, error) {
 		Management: management,
 		Groups:     groups,
 	}
+	instance.groupQueue = newGroupQueue(envInt("GROUP_WORKERS", 16), func(h string, batch *sideEffectBatch) {
+		batch.flush(instance)
+	})
+	management.onAccessLost = instance.dropConnections
+	management.onDeleteEvent = func(id nostr.ID) error {
+		return instance.DeleteEvent(context.Background(), id)
+	}
 
 	// NIP 11 info
 
 	// self := config.GetSelf()
-	owner := config.GetOwner()
 
 	instance.Relay.Negentropy = true
+	instance.Relay.MaxMessageSize = config.GetMaxMessageSize()
 	instance.Relay.Info.Name = config.Info.Name
 	instance.Relay.Info.Icon = config.Info.Icon
 	// instance.Relay.Info.Self = &self
-	instance.Relay.Info.PubKey = &owner
+	if owners := config.GetOwners(); len(owners) > 0 {
+		instance.Relay.Info.PubKey = &owners[0]
+	}
 	instance.Relay.Info.Description = config.Info.Description
 	instance.Relay.Info.Software = "https://github.com/coracle-social/zooid"
-	instance.Relay.Info.Version = "v0.1.0"
-	instance.Relay.Info.SupportedNIPs = append(instance.Relay.Info.SupportedNIPs, 43)
+	instance.Relay.Info.Version = version
+	instance.Relay.Info.SupportedNIPs = append(instance.Relay.Info.SupportedNIPs, 17, 43)
 
 	// Handlers
 
 	instance.Relay.OnConnect = instance.OnConnect
+	instance.Relay.OnDisconnect = instance.OnDisconnect
 	instance.Relay.PreventBroadcast = instance.PreventBroadcast
 	instance.Relay.StoreEvent = instance.StoreEvent
 	instance.Relay.ReplaceEvent = instance.ReplaceEvent
@@ -113,6 +199,8 @@ func MakeInstance(ctx context.Context, filename string) (*Instance, error) {
 	instance.Relay.OnEvent = instance.OnEvent
 	instance.Relay.OnEventSaved = instance.OnEventSaved
 	instance.Relay.OnEphemeralEvent = instance.OnEphemeralEvent
+	instance.Relay.OverwriteRelayInformation = instance.OverwriteRelayInformation
+	instance.timeWrites()
 
 	// Todo: when there's a new version of khatru
 	// instance.Relay.StartExpirationManager()
@@ -127,16 +215,28 @@ func MakeInstance(ctx context.Context, filename string) (*Instance, error) {
 
 	router.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
+	router.Handle("GET /e/{id}", HTTPAuth(http.HandlerFunc(instance.ServeEvent)))
+
+	router.HandleFunc("GET /readyz", instance.ServeReadyz)
+
+	router.Handle("GET /admin/groups", HTTPAuth(http.HandlerFunc(instance.ServeGroupActivity)))
+
+	if config.NIP05.Enabled {
+		router.HandleFunc("GET /.well-known/nostr.json", instance.ServeNIP05)
+	}
+
 	// Initialize the database
 
+	instance.setState(StateInitializing, nil)
 	if err := instance.Events.Init(); err != nil {
-		log.Fatal("Failed to initialize event store: ", err)
+		releaseSchema(config, schema.Name)
+		return nil, fmt.Errorf("failed to initialize event store: %w", err)
 	}
 
-	// Warm caches
+	// Warm caches, hearing about changes from other instances meanwhile
 
-	instance.Management.WarmCaches()
-	instance.Groups.WarmCaches()
+	instance.unsubscribeCaches = subscribeCaches(events, instance.onCacheMessage)
+	instance.warmCaches(instance.loadCaches)
 
 	// Enable extra functionality
 
@@ -164,7 +264,10 @@ func MakeInstance(ctx context.Context, filename string) (*Instance, error) {
 	// Update managed membership/admin lists
 
 	instance.Management.AllowPubkey(config.GetSelf())
-	instance.Management.AllowPubkey(config.GetOwner())
+
+	for _, owner := range config.GetOwners() {
+		instance.Management.AllowPubkey(owner)
+	}
 
 	for _, role := range config.Roles {
 		for _, hex := range role.Pubkeys {
@@ -174,18 +277,112 @@ func MakeInstance(ctx context.Context, filename string) (*Instance, error) {
 		}
 	}
 
+	reconcileCtx, stopReconciler := context.WithCancel(ctx)
+	instance.stopReconciler = stopReconciler
+	instance.startReconciler(reconcileCtx)
+
+	statsCtx, stopStatsPublisher := context.WithCancel(ctx)
+	instance.stopStatsPublisher = stopStatsPublisher
+	instance.startStatsPublisher(statsCtx)
+
+	purgeCtx, stopPurgeWorker := context.WithCancel(ctx)
+	instance.stopPurgeWorker = stopPurgeWorker
+	instance.startPurgeWorker(purgeCtx)
+
+	notifierCtx, stopNotifier := context.WithCancel(ctx)
+	instance.stopNotifier = stopNotifier
+	instance.startNotifier(notifierCtx)
+
+	instance.startSpamChecker()
+	instance.startTransformers()
+	instance.startPayments()
+
+	reauthCtx, stopReauthenticator := context.WithCancel(ctx)
+	instance.stopReauthenticator = stopReauthenticator
+	instance.startReauthenticator(reauthCtx)
+
 	return instance, nil
 }
 
 func (instance *Instance) Cleanup() {
+	defer releaseSchema(instance.Config, instance.Events.Schema.Name)
+
+	instance.readiness.stopWarm()
+
+	if instance.unsubscribeCaches != nil {
+		instance.unsubscribeCaches()
+	}
+
+	if instance.stopReconciler != nil {
+		instance.stopReconciler()
+	}
+
+	if instance.stopStatsPublisher != nil {
+		instance.stopStatsPublisher()
+	}
+
+	if instance.stopPurgeWorker != nil {
+		instance.stopPurgeWorker()
+	}
+
+	if instance.stopNotifier != nil {
+		instance.stopNotifier()
+	}
+
+	if instance.stopReauthenticator != nil {
+		instance.stopReauthenticator()
+	}
+
+	if instance.groupQueue != nil && !instance.groupQueue.Close(dbOpTimeout) {
+		log.Printf("Timed out draining group events for %s, dropped the rest", instance.Config.Schema)
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(instance.Ctx), dbOpTimeout)
+	defer cancel()
+	if err := instance.Management.FlushActivity(ctx); err != nil {
+		log.Printf("Failed to flush member activity for %s: %v", instance.Config.Schema, err)
+	}
+	if err := instance.Management.FlushUsage(ctx); err != nil {
+		log.Printf("Failed to flush usage for %s: %v", instance.Config.Schema, err)
+	}
+	if err := instance.SaveCacheSnapshots(ctx); err != nil {
+		log.Printf("Failed to save cache snapshot for %s: %v", instance.Config.Schema, err)
+	}
+
 	instance.Events.Close()
 }
 
+// ServeHTTP serves zooid's own NIP 86 methods and the relay information
+// document, and hands everything else to khatru.
+func (instance *Instance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if instance.Management.ServeAPI(w, r) {
+		return
+	}
+
+	if isRelayInfoRequest(r) {
+		instance.serveRelayInfo(w, r)
+		return
+	}
+
+	if isWebSocketUpgrade(r) {
+		if instance.refuseClient(w, r) {
+			return
+		}
+		w, r = instance.limitSendQueue(w, r)
+	}
+
+	instance.Relay.ServeHTTP(w, r)
+}
+
 // Utility methods
 
 func (instance *Instance) StripSignature(ctx context.Context, event nostr.Event) nostr.Event {
 	pubkey, _ := khatru.GetAuthed(ctx)
 
+	return instance.stripSignatureFor(pubkey, event)
+}
+
+func (instance *Instance) stripSignatureFor(pubkey nostr.PubKey, event nostr.Event) nostr.Event {
 	if instance.Config.Policy.StripSignatures && !instance.Config.CanManage(pubkey) {
 		var zeroSig [64]byte
 		event.Sig = zeroSig
@@ -217,18 +414,27 @@ func (instance *Instance) AllowRecipientEvent(event nostr.Event) bool {
 	return false
 }
 
+// IsInternalEvent reports whether event is the relay's own bookkeeping, its
+// zooid/ app data, like the ban lists and the reasons they record. Its
+// members list is for managers, see adminonly.go.
 func (instance *Instance) IsInternalEvent(event nostr.Event) bool {
 	if event.Kind == nostr.KindApplicationSpecificData {
 		tag := event.Tags.Find("d")
 
-		if tag != nil && strings.HasPrefix(tag[1], "zooid/") {
-			return true
-		}
+		// Read markers are the one kind of zooid/ app data users publish,
+		// and the relay's stats the one it publishes for them
+		return tag != nil && strings.HasPrefix(tag[1], "zooid/") && !isReadMarker(event) && !instance.isStatsEvent(event)
 	}
 
 	return false
 }
 
+// neverServed reports whether a stored event is kept from every client,
+// however they ask for it: by REQ, negentropy, broadcast or over HTTP.
+func (instance *Instance) neverServed(event nostr.Event) bool {
+	return event.Kind == RELAY_INVITE || instance.IsInternalEvent(event) || instance.IsWriteOnlyEvent(event)
+}
+
 func (instance *Instance) IsReadOnlyEvent(event nostr.Event) bool {
 	readOnlyEventKinds := []nostr.Kind{
 		RELAY_ADD_MEMBER,
@@ -243,6 +449,8 @@ func (instance *Instance) IsWriteOnlyEvent(event nostr.Event) bool {
 	writeOnlyEventKinds := []nostr.Kind{
 		RELAY_JOIN,
 		RELAY_LEAVE,
+		RELAY_NIP05_CLAIM,
+		RELAY_PURGE,
 	}
 
 	return slices.Contains(writeOnlyEventKinds, event.Kind)
@@ -286,39 +494,170 @@ func (instance *Instance) GenerateInviteEvent(pubkey nostr.PubKey) nostr.Event {
 // Handlers
 
 func (instance *Instance) OnConnect(ctx context.Context) {
+	if ws := khatru.GetConnection(ctx); ws != nil {
+		instance.connections.add(ws)
+		instance.watchAuth(ws)
+		instance.trackSent(ws)
+	}
 	khatru.RequestAuth(ctx)
 }
 
+func (instance *Instance) OverwriteRelayInformation(ctx context.Context, r *http.Request, info nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+	limitation := nip11.RelayLimitationDocument{}
+	if info.Limitation != nil {
+		limitation = *info.Limitation
+	}
+	limitation.MaxMessageLength = int(instance.Config.GetMaxMessageSize())
+	limitation.MaxLimit = instance.Config.GetMaxResults()
+	limitation.MaxEventTags = instance.Config.GetMaxEventTags()
+	if instance.Config.IsReadOnly() {
+		limitation.RestrictedWrites = true
+	}
+	limitation.PaymentRequired = instance.Config.Payments.Price > 0
+	info.Limitation = &limitation
+
+	if price := instance.Config.Payments.Price; price > 0 {
+		fees := nip11.RelayFeesDocument{}
+		fees.Subscription = slices.Grow(fees.Subscription, 1)[:1]
+		fees.Subscription[0].Amount = int(price * 1000)
+		fees.Subscription[0].Unit = "msats"
+		fees.Subscription[0].Period = int(instance.Config.GetPaymentPeriod().Seconds())
+		info.Fees = &fees
+	}
+
+	// The links go in separately, see relayinfo.go
+	info.PostingPolicy = instance.Config.Info.PostingPolicy
+	info.PaymentsURL = instance.Config.Info.PaymentsURL
+
+	return info
+}
+
 func (instance *Instance) PreventBroadcast(ws *khatru.WebSocket, filter nostr.Filter, event nostr.Event) bool {
-	return instance.IsWriteOnlyEvent(event) || isLargeListEvent(event)
+	if instance.hidesBroadcast(ws, event) {
+		return true
+	}
+
+	// Overlapping subscriptions would each get it, see dedup.go
+	return instance.alreadySent(ws, event)
+}
+
+// hidesBroadcast reports whether ws may not be sent event at all.
+func (instance *Instance) hidesBroadcast(ws *khatru.WebSocket, event nostr.Event) bool {
+	if instance.neverServed(event) || isLargeListEvent(event) {
+		return true
+	}
+
+	// Subscriptions outlive the access they were opened with, so it's
+	// checked again for every event, see connections.go
+	if !instance.canListen(ws) {
+		return true
+	}
+
+	if instance.hiddenByShadowBan(ws, event) {
+		return true
+	}
+
+	if instance.hidesAdminOnly(ws.AuthedPublicKeys, event) {
+		return true
+	}
+
+	if event.Kind == nostr.KindGiftWrap {
+		return hidesGiftWrap(ws.AuthedPublicKeys, event)
+	}
+
+	if isReadMarker(event) {
+		return !slices.Contains(ws.AuthedPublicKeys, event.PubKey)
+	}
+
+	if instance.Groups.IsGroupEvent(event) {
+		return !instance.canReceive(ws, event)
+	}
+
+	return false
 }
 
 func (instance *Instance) StoreEvent(ctx context.Context, event nostr.Event) error {
+	if instance.isShadowed(event) {
+		return eventstore.ErrDupEvent
+	}
+
+	if err := instance.transform(ctx, &event); err != nil {
+		return err
+	}
+
 	return instance.Events.StoreEvent(event)
 }
 
 func (instance *Instance) ReplaceEvent(ctx context.Context, event nostr.Event) error {
+	if instance.isShadowed(event) {
+		return eventstore.ErrDupEvent
+	}
+
+	if err := instance.transform(ctx, &event); err != nil {
+		return err
+	}
+
 	return instance.Events.ReplaceEvent(event)
 }
 
 func (instance *Instance) DeleteEvent(ctx context.Context, id nostr.ID) error {
+	if h, ok := instance.Groups.eventGroups.get(id); ok {
+		instance.Groups.forgetUnread(h)
+	}
+	instance.Groups.eventGroups.forget(id)
+	instance.relayLists.remove(id)
 	return instance.Events.DeleteEvent(id)
 }
 
 // Requests
 
 func (instance *Instance) OnRequest(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	if reject, msg := instance.checkReady(ctx); reject {
+		return reject, msg
+	}
+
+	// The stats event is for anyone, see relaystats.go
+	if isStatsFilter(filter) && !khatru.IsNegentropySession(ctx) {
+		return false, ""
+	}
+
 	pubkey, ok := khatru.GetAuthed(ctx)
 
 	if !ok {
-		return true, "auth-required: authentication is required for access"
+		return RejectAuthRequired.Reject("authentication is required for access")
+	}
+
+	if instance.authExpired(ctx) {
+		return RejectAuthRequired.Reject("your authentication has expired, please authenticate again")
+	}
+
+	if instance.Management.PubkeyIsBanned(pubkey) {
+		return RejectBlocked.Reject("you have been banned from this relay")
+	}
+
+	if reject, msg := instance.checkClient(ctx, pubkey, nil); reject {
+		return reject, msg
+	}
+
+	// Purged users are no longer members, but may fetch their receipts
+	if isPurgeReceiptFilter(pubkey, filter) && !khatru.IsNegentropySession(ctx) {
+		return false, ""
 	}
 
 	// If open policy, allow all authenticated users; otherwise require membership
 	if !instance.Config.Policy.Open && !instance.Management.IsMember(pubkey) {
-		return true, "restricted: you are not a member of this relay"
+		return RejectRestricted.Reject("you are not a member of this relay")
 	}
 
+	if khatru.IsNegentropySession(ctx) {
+		if reason := instance.checkNegentropy(pubkey, filter); reason != "" {
+			return true, reason
+		}
+	}
+
+	instance.Management.TouchMember(pubkey)
+	instance.Management.RecordUsage(pubkey, Usage{Queries: 1})
+
 	return false, ""
 }
 
@@ -334,10 +673,45 @@ func (instance *Instance) QueryStored(ctx context.Context, filter nostr.Filter)
 			pubkey, _ := khatru.GetAuthed(ctx)
 			generated := make([]nostr.Event, 0)
 
+			var served int64
+			defer func() { instance.Management.RecordUsage(pubkey, Usage{Served: served}) }()
+			send := yield
+			yield = func(event nostr.Event) bool {
+				served++
+				return send(event)
+			}
+
+			if khatru.IsNegentropySession(ctx) {
+				filter.Since = max(filter.Since, instance.Config.negentropySince(time.Now()))
+			}
+
+			if isRelayListFilter(filter) {
+				if lists, ok := instance.queryRelayLists(filter); ok {
+					for _, list := range lists {
+						if !yield(instance.StripSignature(ctx, list)) {
+							return
+						}
+					}
+					return
+				}
+			}
+
 			if slices.Contains(filter.Kinds, RELAY_INVITE) && instance.Config.CanInvite(pubkey) {
 				generated = append(generated, instance.GenerateInviteEvent(pubkey))
 			}
 
+			if instance.Config.Groups.Enabled {
+				for _, h := range pinListGroups(filter) {
+					if list, found := instance.Groups.PinsEvent(h); found && instance.Groups.CanRead(pubkey, list) {
+						generated = append(generated, list)
+					}
+				}
+
+				if slices.Contains(filter.Kinds, KindUnreadCounts) {
+					generated = append(generated, instance.Groups.UnreadCountsEvent(pubkey, filter.Tags["h"]))
+				}
+			}
+
 			for _, event := range generated {
 				if !filter.Matches(event) {
 					continue
@@ -348,16 +722,34 @@ func (instance *Instance) QueryStored(ctx context.Context, filter nostr.Filter)
 				}
 			}
 
-			for event := range instance.Events.QueryEvents(filter, 1000) {
-				if event.Kind == RELAY_INVITE {
+			// Without a limit, a REQ would otherwise get up to the full
+			// limits.max_results cap on every subscription.
+			if filter.Limit == 0 {
+				filter.Limit = instance.Config.GetDefaultLimit()
+			}
+
+			filter = instance.giftWrapFilter(pubkey, filter)
+			filter = instance.membershipFilter(pubkey, filter)
+
+			events := instance.Events.QueryEvents(filter, instance.Config.GetMaxResults())
+			if instance.Management.PubkeyIsShadowBanned(pubkey) {
+				events = mergeShadowed(instance.shadowBuffer.get(pubkey), filter, events)
+			}
+
+			for event := range events {
+				if instance.neverServed(event) {
+					continue
+				}
+
+				if isReadMarker(event) && event.PubKey != pubkey {
 					continue
 				}
 
-				if instance.IsInternalEvent(event) {
+				if !instance.canReadAdminOnly(pubkey, event) {
 					continue
 				}
 
-				if instance.IsWriteOnlyEvent(event) {
+				if event.Kind == nostr.KindGiftWrap && !instance.canReadGiftWrap(pubkey, event) {
 					continue
 				}
 
@@ -378,6 +770,29 @@ func (instance *Instance) QueryStored(ctx context.Context, filter nostr.Filter)
 // Event publishing
 
 func (instance *Instance) OnEvent(ctx context.Context, event nostr.Event) (reject bool, msg string) {
+	if reject, msg := instance.checkReady(ctx); reject {
+		return reject, msg
+	}
+
+	if instance.Config.IsReadOnly() {
+		return RejectBlocked.Reject("relay is in read-only maintenance mode")
+	}
+
+	// Checked before anything that might let the event through early, so
+	// forged group or membership lists are refused even with groups
+	// disabled.
+	if IsRelayOnlyKind(event.Kind) {
+		return true, ErrNotRelaySigned.Error()
+	}
+
+	if reason := checkTagLimits(instance.Config, event); reason != "" {
+		return true, reason
+	}
+
+	if event.Kind == nostr.KindGiftWrap {
+		return instance.checkGiftWrap(event)
+	}
+
 	if instance.AllowRecipientEvent(event) {
 		return false, ""
 	}
@@ -385,26 +800,63 @@ func (instance *Instance) OnEvent(ctx context.Context, event nostr.Event) (rejec
 	pubkey, isAuthenticated := khatru.GetAuthed(ctx)
 
 	if !isAuthenticated {
-		return true, "auth-required: authentication is required for access"
+		return RejectAuthRequired.Reject("authentication is required for access")
+	} else if instance.authExpired(ctx) {
+		return RejectAuthRequired.Reject("your authentication has expired, please authenticate again")
 	} else if pubkey != event.PubKey {
-		return true, "restricted: you cannot publish events on behalf of others"
+		return RejectRestricted.Reject("you cannot publish events on behalf of others")
+	}
+
+	if reject, msg := instance.checkClient(ctx, pubkey, &event); reject {
+		return reject, msg
+	}
+
+	if event.Kind.IsAddressable() && event.Tags.Find("d") == nil {
+		return RejectInvalid.Reject("missing d tag")
+	}
+
+	if event.Kind == nostr.KindDMRelayList {
+		if reason := checkDMRelayList(event); reason != "" {
+			return true, reason
+		}
+	}
+
+	if event.Kind.IsEphemeral() && !instance.ephemeral.allow(pubkey, instance.ephemeralPerMinute(event), time.Now()) {
+		return RejectRateLimited.Reject("too many ephemeral events, slow down")
 	}
 
 	if event.Kind == RELAY_JOIN {
 		return instance.Management.ValidateJoinRequest(event)
 	}
 
-	// If open policy, allow all authenticated users; otherwise require membership
-	if !instance.Config.Policy.Open && !instance.Management.IsMember(pubkey) {
-		return true, "restricted: you are not a member of this relay"
+	if event.Kind == RELAY_PURGE {
+		return instance.checkPurgeRequest(event)
+	}
+
+	// If open policy, allow all authenticated users; otherwise require
+	// membership. Trusted signers needn't be members to mirror group changes.
+	if !instance.Config.Policy.Open && !instance.Management.IsMember(pubkey) && !instance.Groups.isTrustedSignerEvent(event) {
+		return RejectRestricted.Reject("you are not a member of this relay")
 	}
 
 	if instance.IsInternalEvent(event) {
-		return true, "invalid: this event's kind is not accepted"
+		return RejectRestricted.Reject("this event's kind is not accepted")
+	}
+
+	if event.Kind == RELAY_NIP05_CLAIM {
+		if reason := instance.checkNIP05Claim(event); reason != "" {
+			return true, reason
+		}
+	}
+
+	if isReadMarker(event) {
+		if reason := instance.Groups.checkReadMarker(event); reason != "" {
+			return true, reason
+		}
 	}
 
 	if instance.IsReadOnlyEvent(event) {
-		return true, "invalid: this event's kind is not accepted"
+		return RejectRestricted.Reject("this event's kind is not accepted")
 	}
 
 	if instance.Groups.IsGroupEvent(event) {
@@ -414,43 +866,95 @@ func (instance *Instance) OnEvent(ctx context.Context, event nostr.Event) (rejec
 	}
 
 	if instance.Management.EventIsBanned(event.ID) {
-		return true, "restricted: this event has been banned from this relay"
+		return RejectBlocked.Reject("this event has been banned from this relay")
 	}
 
-	return false, ""
+	if reason := instance.checkReplaceInterval(event, time.Now()); reason != "" {
+		return true, reason
+	}
+
+	if instance.Management.PubkeyIsShadowBanned(pubkey) {
+		instance.shadowBan(event)
+		return false, ""
+	}
+
+	if event.Kind == RELAY_NIP05_CLAIM {
+		if reason := instance.reserveNIP05Claim(event); reason != "" {
+			return true, reason
+		}
+	}
+
+	return instance.checkSpam(pubkey, event)
 }
 
 func (instance *Instance) OnEventSaved(ctx context.Context, event nostr.Event) {
+	instance.Management.TouchMember(event.PubKey)
+	instance.Management.RecordUsage(event.PubKey, Usage{Events: 1, Bytes: int64(len(event.Content))})
+	instance.Groups.rememberEventGroup(event)
+	instance.Groups.recordUnread(event)
+	instance.Groups.recordActivity(event)
+	instance.rememberRelayList(event)
+	instance.notifyMentions(event)
+	instance.applyGroupEvent(event)
+}
+
+// applyGroupEvent does event's group bookkeeping, if it has any.
+func (instance *Instance) applyGroupEvent(event nostr.Event) {
+	if !hasGroupSideEffects(event) {
+		return
+	}
+
+	// Membership and caches change before returning, so the sender's next
+	// event sees them; only the list rewrites are queued.
 	h := GetGroupIDFromEvent(event)
+	batch := &sideEffectBatch{}
+	instance.processGroupEvent(h, event, batch)
+	if instance.groupQueue == nil || !instance.groupQueue.Enqueue(h, batch) {
+		batch.flush(instance)
+	}
+}
 
-	if event.Kind == nostr.KindSimpleGroupJoinRequest && instance.Config.Groups.AutoJoin {
-		if err := instance.Groups.AddMember(h, event.PubKey); err != nil {
-			log.Printf("Failed to add member %s to group %q: %v", event.PubKey, h, err)
-		}
-		if err := instance.Groups.ScheduleMembersListUpdate(h); err != nil {
-			log.Printf("Failed to update members list for group %q: %v", h, err)
-		}
-		if err := instance.Groups.ScheduleMemberCountRefresh(h); err != nil {
-			log.Printf("Failed to refresh member count for group %q: %v", h, err)
+// hasGroupSideEffects reports whether OnEventSaved has group bookkeeping to
+// do for event.
+func hasGroupSideEffects(event nostr.Event) bool {
+	switch event.Kind {
+	case nostr.KindSimpleGroupJoinRequest,
+		nostr.KindSimpleGroupLeaveRequest,
+		nostr.KindSimpleGroupPutUser,
+		nostr.KindSimpleGroupRemoveUser,
+		nostr.KindSimpleGroupCreateGroup,
+		nostr.KindSimpleGroupEditMetadata,
+		nostr.KindSimpleGroupDeleteGroup,
+		KindSimpleGroupPin:
+		return true
+	}
+
+	return slices.Contains(chatKinds, event.Kind) && GetGroupIDFromEvent(event) != ""
+}
+
+// processGroupEvent does the bookkeeping for a saved event from group h,
+// leaving the list rewrites in batch for the caller to flush.
+func (instance *Instance) processGroupEvent(h string, event nostr.Event, batch *sideEffectBatch) {
+	if event.Kind == nostr.KindSimpleGroupJoinRequest {
+		if instance.Groups.GroupPolicy(h).AutoJoin {
+			batch.apply(instance, event, "add_member", "schedule_members_list", "schedule_member_count")
 		}
+		batch.apply(instance, event, "update_join_requests")
 	}
 
 	if event.Kind == nostr.KindSimpleGroupLeaveRequest {
-		if err := instance.Groups.RemoveMember(h, event.PubKey); err != nil {
-			log.Printf("Failed to remove member %s from group %q: %v", event.PubKey, h, err)
-		}
-		if err := instance.Groups.ScheduleMembersListUpdate(h); err != nil {
-			log.Printf("Failed to update members list for group %q: %v", h, err)
-		}
-		if err := instance.Groups.ScheduleMemberCountRefresh(h); err != nil {
-			log.Printf("Failed to refresh member count for group %q: %v", h, err)
-		}
+		batch.apply(instance, event, "remove_member", "schedule_members_list", "schedule_member_count", "update_join_requests")
 	}
 
 	if event.Kind == nostr.KindSimpleGroupPutUser {
 		// Update membership and role caches for externally-received PutUser events
+		var joined []nostr.PubKey
 		for tag := range event.Tags.FindAll("p") {
 			if pubkey, err := nostr.PubKeyFromHex(tag[1]); err == nil {
+				if member, _ := instance.Groups.cachedMember(h, pubkey); !member {
+					joined = append(joined, pubkey)
+				}
+
 				ms := instance.Groups.getOrCreateMemberSet(h)
 				ms.mu.Lock()
 				ms.members[pubkey] = struct{}{}
@@ -464,16 +968,20 @@ func (instance *Instance) OnEventSaved(ctx context.Context, event nostr.Event) {
 				instance.Groups.SetMemberRoles(h, pubkey, roles)
 			}
 		}
-		if err := instance.Groups.ScheduleMembersListUpdate(h); err != nil {
-			log.Printf("Failed to update members list for group %q: %v", h, err)
-		}
-		if err := instance.Groups.ScheduleMemberCountRefresh(h); err != nil {
-			log.Printf("Failed to refresh member count for group %q: %v", h, err)
-		}
+		batch.apply(instance, event, instance.memberDeltaSteps(event, "schedule_members_list", "schedule_member_count", "update_join_requests")...)
+		instance.Groups.announcePresence(h, "join", joined...)
 	}
 
 	if event.Kind == nostr.KindSimpleGroupRemoveUser {
 		// Update membership and role caches for externally-received RemoveUser events
+		var left []nostr.PubKey
+		for tag := range event.Tags.FindAll("p") {
+			if pubkey, err := nostr.PubKeyFromHex(tag[1]); err == nil {
+				if member, known := instance.Groups.cachedMember(h, pubkey); member || !known {
+					left = append(left, pubkey)
+				}
+			}
+		}
 		if v, ok := instance.Groups.membershipCache.Load(h); ok {
 			ms := v.(*memberSet)
 			for tag := range event.Tags.FindAll("p") {
@@ -485,53 +993,52 @@ func (instance *Instance) OnEventSaved(ctx context.Context, event nostr.Event) {
 				}
 			}
 		}
-		if err := instance.Groups.ScheduleMembersListUpdate(h); err != nil {
-			log.Printf("Failed to update members list for group %q: %v", h, err)
-		}
-		if err := instance.Groups.ScheduleMemberCountRefresh(h); err != nil {
-			log.Printf("Failed to refresh member count for group %q: %v", h, err)
-		}
+		batch.apply(instance, event, instance.memberDeltaSteps(event, "schedule_members_list", "schedule_member_count", "update_join_requests")...)
+		instance.Groups.announcePresence(h, "leave", left...)
 	}
 
 	if event.Kind == nostr.KindSimpleGroupCreateGroup {
 		instance.Groups.creatorCache.Store(h, event.PubKey)
 		// Brand-new group: there are no pre-existing members beyond
 		// the creator we're about to add. Mark membership as fully
-		// loaded BEFORE AddMember/ScheduleMembersListUpdate run, so
-		// IsMember treats the cache as authoritative for this group
-		// from creation onward and the eventual UpdateMembersList
-		// publishes a correct snapshot the next restart's
-		// WarmCaches will accept. Issue #25.
+		// loaded BEFORE AddMember/UpdateMembersList run, so IsMember
+		// treats the cache as authoritative for this group from
+		// creation onward and the members list publishes a correct
+		// snapshot the next restart's WarmCaches will accept. Issue #25.
 		instance.Groups.membershipFullyLoaded.Store(h, struct{}{})
-		if err := instance.Groups.AddMember(h, event.PubKey); err != nil {
-			log.Printf("Failed to add creator %s to group %q: %v", event.PubKey, h, err)
-		}
-		if err := instance.Groups.UpdateMetadata(event); err != nil {
-			log.Printf("Failed to create metadata for group %q: %v", h, err)
-		}
-		if err := instance.Groups.ScheduleMembersListUpdate(h); err != nil {
-			log.Printf("Failed to update members list for group %q: %v", h, err)
-		}
-		if err := instance.Groups.UpdateAdminsList(h); err != nil {
-			log.Printf("Failed to update admins list for group %q: %v", h, err)
-		}
+		// The members list is written directly rather than debounced so
+		// that a failure lands in the dead-letter log with the rest of
+		// the group's initialization.
+		batch.apply(instance, event, "add_member", "update_metadata", "update_members_list", "update_admins_list")
 	}
 
 	if event.Kind == nostr.KindSimpleGroupEditMetadata {
-		if err := instance.Groups.UpdateMetadata(event); err != nil {
-			log.Printf("Failed to update metadata for group %q: %v", h, err)
-		}
-		if err := instance.Groups.UpdateAdminsList(h); err != nil {
-			log.Printf("Failed to update admins list for group %q: %v", h, err)
-		}
+		batch.apply(instance, event, "update_metadata", "update_admins_list")
+	}
+
+	if event.Kind == KindSimpleGroupPin {
+		batch.apply(instance, event, "update_pins")
+	}
+
+	if slices.Contains(chatKinds, event.Kind) {
+		instance.Groups.recordLastMessage(event)
 	}
 
 	if event.Kind == nostr.KindSimpleGroupDeleteGroup {
-		instance.Groups.DeleteGroup(h)
+		// Rewriting the lists of a deleted group would bring them back.
+		batch.discard()
+		if instance.groupQueue != nil {
+			instance.groupQueue.Discard(h)
+		}
+		instance.Groups.DeleteGroup(h, event.PubKey)
 	}
 }
 
 func (instance *Instance) OnEphemeralEvent(ctx context.Context, event nostr.Event) {
+	if instance.Config.IsReadOnly() {
+		return
+	}
+
 	if event.Kind == RELAY_JOIN {
 		instance.Management.AddMember(event.PubKey)
 	}
@@ -539,4 +1046,20 @@ func (instance *Instance) OnEphemeralEvent(ctx context.Context, event nostr.Even
 	if event.Kind == RELAY_LEAVE {
 		instance.Management.RemoveMember(event.PubKey)
 	}
+
+	if event.Kind == RELAY_PURGE {
+		// The connection may close before it's done
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), dbOpTimeout)
+		defer cancel()
+
+		if err := instance.RequestPurge(ctx, event); err != nil {
+			log.Printf("Failed to purge %s: %v", event.PubKey.Hex(), err)
+		}
+	}
+
+	if event.Kind == RELAY_NIP05_CLAIM {
+		if err := instance.Management.ClaimNIP05(event.Tags.Find("name")[1], event.PubKey); err != nil {
+			log.Printf("Failed to claim NIP-05 name for %s: %v", event.PubKey.Hex(), err)
+		}
+	}
 }
@@ -2,10 +2,13 @@ package zooid
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"testing"
 
 	"fiatjaf.com/nostr"
 	"fiatjaf.com/nostr/khatru"
+	"fiatjaf.com/nostr/nip11"
 )
 
 func createTestInstance() *Instance {
@@ -15,12 +18,7 @@ func createTestInstance() *Instance {
 	config := &Config{
 		Host:   "test.com",
 		secret: ownerSecret,
-		Info: struct {
-			Name        string `toml:"name"`
-			Icon        string `toml:"icon"`
-			Pubkey      string `toml:"pubkey"`
-			Description string `toml:"description"`
-		}{
+		Info: Info{
 			Name:   "Test Relay",
 			Pubkey: ownerPubkey.Hex(),
 		},
@@ -35,7 +33,7 @@ func createTestInstance() *Instance {
 	config.Groups.Enabled = true
 	config.Groups.AutoJoin = true
 
-	schema := &Schema{Name: "test_" + RandomString(8)}
+	schema := testSchema("test_")
 
 	relay := &khatru.Relay{}
 
@@ -58,16 +56,20 @@ func createTestInstance() *Instance {
 	}
 
 	instance := &Instance{
+		Ctx:        context.Background(),
 		Relay:      relay,
 		Config:     config,
 		Events:     events,
 		Management: management,
 		Groups:     groups,
 	}
+	management.onDeleteEvent = func(id nostr.ID) error {
+		return instance.DeleteEvent(context.Background(), id)
+	}
 
 	instance.Events.Init()
-	management.WarmCaches()
-	groups.WarmCaches()
+	management.WarmCaches(context.Background())
+	groups.WarmCaches(context.Background())
 
 	return instance
 }
@@ -191,6 +193,14 @@ func TestInstance_IsInternalEvent(t *testing.T) {
 			},
 			want: true,
 		},
+		{
+			name: "read marker",
+			event: nostr.Event{
+				Kind: nostr.KindApplicationSpecificData,
+				Tags: nostr.Tags{{"d", "zooid/read/general"}},
+			},
+			want: false,
+		},
 		{
 			name: "non-internal event",
 			event: nostr.Event{
@@ -314,7 +324,7 @@ func TestOnEventSaved_CreateGroup_MetadataSurvivesRestart(t *testing.T) {
 		Events:     instance.Events,
 		Management: instance.Management,
 	}
-	groups2.WarmCaches()
+	groups2.WarmCaches(context.Background())
 
 	meta, found := groups2.GetMetadata("persist")
 	if !found {
@@ -475,7 +485,7 @@ func TestWarmCaches_SelfHeals_MissingMetadata(t *testing.T) {
 	}
 
 	// WarmCaches should detect the missing metadata and regenerate it
-	groups.WarmCaches()
+	groups.WarmCaches(context.Background())
 
 	meta, found := groups.GetMetadata("broken")
 	if !found {
@@ -491,7 +501,7 @@ func TestWarmCaches_SelfHeals_MissingMetadata(t *testing.T) {
 		Events:     groups.Events,
 		Management: groups.Management,
 	}
-	groups2.WarmCaches()
+	groups2.WarmCaches(context.Background())
 
 	_, found = groups2.GetMetadata("broken")
 	if !found {
@@ -551,3 +561,201 @@ func TestOnEventSaved_LeaveRequest(t *testing.T) {
 		t.Errorf("member_count = %q after leave, want %q", memberCount, "1")
 	}
 }
+
+func TestInstance_ReadOnly_Config(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.ReadOnly = true
+
+	authorSecret := nostr.Generate()
+	event := nostr.Event{
+		Kind:      nostr.KindTextNote,
+		CreatedAt: nostr.Now(),
+		Content:   "hello",
+	}
+	event.Sign(authorSecret)
+
+	reject, msg := instance.OnEvent(context.Background(), event)
+	if !reject || msg != "blocked: relay is in read-only maintenance mode" {
+		t.Errorf("OnEvent = (%v, %q), want read-only rejection", reject, msg)
+	}
+
+	internal := nostr.Event{Kind: nostr.KindApplicationSpecificData, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"d", "toggle"}}}
+	if err := instance.Events.SignAndStoreEvent(&internal, false); err != ErrReadOnly {
+		t.Errorf("SignAndStoreEvent error = %v, want ErrReadOnly", err)
+	}
+
+	joiner := nostr.Generate().Public()
+	instance.OnEphemeralEvent(context.Background(), nostr.Event{Kind: RELAY_JOIN, PubKey: joiner})
+	if instance.Management.IsMember(joiner) {
+		t.Error("join should be ignored in read-only mode")
+	}
+
+	info := instance.OverwriteRelayInformation(context.Background(), nil, nip11.RelayInformationDocument{})
+	if info.Limitation == nil || !info.Limitation.RestrictedWrites {
+		t.Error("NIP-11 limitation should advertise restricted writes")
+	}
+}
+
+func TestInstance_ReadOnly_RuntimeToggle(t *testing.T) {
+	instance := createTestInstance()
+
+	instance.Config.SetReadOnly(true)
+	if !instance.Config.IsReadOnly() {
+		t.Fatal("SetReadOnly(true) should enable read-only mode")
+	}
+
+	event := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now()}
+	if reject, _ := instance.OnEvent(context.Background(), event); !reject {
+		t.Error("OnEvent should reject while read-only")
+	}
+
+	instance.Config.SetReadOnly(false)
+
+	if _, msg := instance.OnEvent(context.Background(), event); msg == "blocked: relay is in read-only maintenance mode" {
+		t.Error("OnEvent should not reject for read-only mode after it is turned off")
+	}
+
+	internal := nostr.Event{Kind: nostr.KindApplicationSpecificData, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"d", "toggle"}}}
+	if err := instance.Events.SignAndStoreEvent(&internal, false); err != nil {
+		t.Errorf("SignAndStoreEvent after toggle off: %v", err)
+	}
+
+	info := instance.OverwriteRelayInformation(context.Background(), nil, nip11.RelayInformationDocument{})
+	if info.Limitation != nil && info.Limitation.RestrictedWrites {
+		t.Error("NIP-11 should not advertise restricted writes after toggle off")
+	}
+
+	// A runtime override also wins over the config value
+	instance.Config.Policy.ReadOnly = true
+	instance.Config.SetReadOnly(false)
+	if instance.Config.IsReadOnly() {
+		t.Error("runtime override should take precedence over policy.read_only")
+	}
+}
+
+func TestInstance_QueryStored_DefaultLimit(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.DefaultLimit = 5
+
+	for i := 0; i < 8; i++ {
+		instance.Events.SaveEvent(createTestEvent(nostr.KindTextNote, fmt.Sprint(i)))
+	}
+
+	count := func(filter nostr.Filter) int {
+		n := 0
+		for range instance.QueryStored(context.Background(), filter) {
+			n++
+		}
+		return n
+	}
+
+	if n := count(nostr.Filter{Kinds: []nostr.Kind{nostr.KindTextNote}}); n != 5 {
+		t.Errorf("no-limit REQ returned %d events, want default limit 5", n)
+	}
+
+	if n := count(nostr.Filter{Kinds: []nostr.Kind{nostr.KindTextNote}, Limit: 7}); n != 7 {
+		t.Errorf("REQ with limit 7 returned %d events, want 7", n)
+	}
+
+	if n := count(nostr.Filter{Kinds: []nostr.Kind{nostr.KindTextNote}, LimitZero: true}); n != 0 {
+		t.Errorf("limit 0 REQ returned %d events, want 0", n)
+	}
+}
+
+func TestInstance_QueryStored_HidesInternalEvents(t *testing.T) {
+	instance := createTestInstance()
+
+	member := nostr.Generate().Public()
+	instance.Management.AddMember(member)
+	if err := instance.Management.BanPubkey(nostr.Generate().Public(), "spam"); err != nil {
+		t.Fatal(err)
+	}
+
+	relay := instance.Config.secret.Public()
+	filter := nostr.Filter{Authors: []nostr.PubKey{relay}, Kinds: []nostr.Kind{nostr.KindApplicationSpecificData}}
+	for event := range instance.QueryStored(authedContext(member), filter) {
+		t.Errorf("a member was served the relay's app data %s", event.Tags.GetD())
+	}
+	if _, found := instance.lookupEvent(firstEvent(t, instance, filter).ID); found {
+		t.Error("the relay's app data can be looked up by id")
+	}
+
+	banned := instance.Events.GetOrCreateApplicationSpecificData(BANNED_PUBKEYS)
+	if !instance.PreventBroadcast(&khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{member}}, nostr.Filter{}, banned) {
+		t.Error("the banned pubkeys list was broadcast to a member")
+	}
+	if !instance.PreventBroadcast(&khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{relay}}, nostr.Filter{}, banned) {
+		t.Error("the banned pubkeys list was broadcast to the relay's own key")
+	}
+}
+
+// firstEvent returns the first stored event matching filter, as the relay
+// itself sees them.
+func firstEvent(t *testing.T, instance *Instance, filter nostr.Filter) nostr.Event {
+	t.Helper()
+
+	for event := range instance.Events.QueryEvents(filter, 1) {
+		return event
+	}
+
+	t.Fatalf("no stored event matches %v", filter)
+	return nostr.Event{}
+}
+
+func TestInstance_OnEvent_RelayOnlyKinds(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Groups.Enabled = false
+
+	member := nostr.Generate().Public()
+	instance.Management.AddMember(member)
+
+	for _, kind := range []nostr.Kind{
+		nostr.KindSimpleGroupMetadata,
+		nostr.KindSimpleGroupAdmins,
+		nostr.KindSimpleGroupMembers,
+		nostr.KindSimpleGroupRoles,
+		RELAY_ADD_MEMBER,
+		RELAY_MEMBERS,
+	} {
+		// The p tag would otherwise let it through as a message to a member.
+		event := nostr.Event{
+			Kind:      kind,
+			CreatedAt: nostr.Now(),
+			Tags:      nostr.Tags{{"d", "grp"}, {"p", member.Hex()}},
+		}
+		event.Sign(nostr.Generate())
+
+		if reject, msg := instance.OnEvent(context.Background(), event); !reject || msg != ErrNotRelaySigned.Error() {
+			t.Errorf("kind %d: OnEvent = (%v, %q), want relay-only rejection", kind, reject, msg)
+		}
+	}
+}
+
+func TestEventStore_StoreEvent_ForgedMembersList(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Groups.Enabled = false
+	intruder := nostr.Generate().Public()
+
+	forged := nostr.Event{
+		Kind:      nostr.KindSimpleGroupMembers,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"d", "grp"}, {"p", intruder.Hex()}},
+	}
+	forged.Sign(nostr.Generate())
+
+	if err := instance.Events.StoreEvent(forged); !errors.Is(err, ErrNotRelaySigned) {
+		t.Errorf("StoreEvent error = %v, want ErrNotRelaySigned", err)
+	}
+	if err := instance.Events.ReplaceEvent(forged); !errors.Is(err, ErrNotRelaySigned) {
+		t.Errorf("ReplaceEvent error = %v, want ErrNotRelaySigned", err)
+	}
+	if count, _ := instance.Events.CountEvents(nostr.Filter{Kinds: []nostr.Kind{nostr.KindSimpleGroupMembers}}); count != 0 {
+		t.Errorf("%d members lists stored, want 0", count)
+	}
+
+	genuine := forged
+	genuine.Sign(instance.Config.secret)
+	if err := instance.Events.StoreEvent(genuine); err != nil {
+		t.Errorf("StoreEvent of a relay-signed list: %v", err)
+	}
+}
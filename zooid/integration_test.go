@@ -74,6 +74,8 @@ var (
 	nonAdminPubkey = nonAdminSecret.Public()
 	writerSecret   = nostr.MustSecretKeyFromHex("0000000000000000000000000000000000000000000000000000000000000003")
 	writerPubkey   = writerSecret.Public()
+	upstreamSecret = nostr.MustSecretKeyFromHex("0000000000000000000000000000000000000000000000000000000000000004")
+	upstreamPubkey = upstreamSecret.Public()
 	relaySecret    = nostr.MustSecretKeyFromHex("0000000000000000000000000000000000000000000000000000000000000099")
 )
 
@@ -100,6 +102,9 @@ type relayConfig struct {
 	adminCreateOnly         bool
 	privateAdminOnly        bool
 	privateRelayAdminAccess bool
+	trustedSigners          []nostr.PubKey
+	dmMaxAge                string
+	presenceNotices         bool
 }
 
 func setupRelay(ctx context.Context, t *testing.T, adminCreateOnly bool) *relayContainer {
@@ -147,6 +152,11 @@ func setupRelayWithConfig(ctx context.Context, t *testing.T, cfg relayConfig) *r
 	// DATABASE_URL for the relay container (uses the Docker network alias)
 	databaseURL := fmt.Sprintf("postgres://test:test@%s:5432/zooid_integration?sslmode=disable", pgAlias)
 
+	trustedSigners := make([]string, len(cfg.trustedSigners))
+	for i, pubkey := range cfg.trustedSigners {
+		trustedSigners[i] = fmt.Sprintf(`"%s"`, pubkey.Hex())
+	}
+
 	req := testcontainers.ContainerRequest{
 		Image:        image,
 		ExposedPorts: []string{"3334/tcp"},
@@ -160,6 +170,9 @@ func setupRelayWithConfig(ctx context.Context, t *testing.T, cfg relayConfig) *r
 			"GROUPS_ADMIN_CREATE_ONLY":          boolStr(cfg.adminCreateOnly),
 			"GROUPS_PRIVATE_ADMIN_ONLY":         boolStr(cfg.privateAdminOnly),
 			"GROUPS_PRIVATE_RELAY_ADMIN_ACCESS": boolStr(cfg.privateRelayAdminAccess),
+			"GROUPS_TRUSTED_SIGNERS":            strings.Join(trustedSigners, ","),
+			"DMS_MAX_AGE":                       cfg.dmMaxAge,
+			"GROUPS_PRESENCE_NOTICES":           boolStr(cfg.presenceNotices),
 		},
 		WaitingFor: wait.ForListeningPort("3334/tcp").WithStartupTimeout(30 * time.Second),
 	}
@@ -395,6 +408,67 @@ func (c *nostrClient) subscribe(ctx context.Context, t *testing.T, subID string,
 	}
 }
 
+// nextEvent waits up to timeout for the next event on an open
+// subscription, returning false if none arrives.
+func (c *nostrClient) nextEvent(ctx context.Context, t *testing.T, subID string, timeout time.Duration) (nostr.Event, bool) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		_, respData, err := c.conn.Read(timeoutCtx)
+		if err != nil {
+			return nostr.Event{}, false
+		}
+
+		var resp []json.RawMessage
+		json.Unmarshal(respData, &resp)
+		if len(resp) < 3 {
+			continue
+		}
+
+		var msgType, gotSubID string
+		json.Unmarshal(resp[0], &msgType)
+		json.Unmarshal(resp[1], &gotSubID)
+
+		if msgType == "EVENT" && gotSubID == subID {
+			var event nostr.Event
+			if err := json.Unmarshal(resp[2], &event); err == nil {
+				return event, true
+			}
+		}
+	}
+}
+
+// eventFrames counts the EVENT messages for id that arrive within timeout,
+// by subscription.
+func (c *nostrClient) eventFrames(ctx context.Context, t *testing.T, id nostr.ID, timeout time.Duration) map[string]int {
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	frames := make(map[string]int)
+	for {
+		_, respData, err := c.conn.Read(timeoutCtx)
+		if err != nil {
+			return frames
+		}
+
+		var resp []json.RawMessage
+		json.Unmarshal(respData, &resp)
+		if len(resp) < 3 {
+			continue
+		}
+
+		var msgType, subID string
+		json.Unmarshal(resp[0], &msgType)
+		json.Unmarshal(resp[1], &subID)
+
+		var event nostr.Event
+		if msgType == "EVENT" && json.Unmarshal(resp[2], &event) == nil && event.ID == id {
+			frames[subID]++
+		}
+	}
+}
+
 func (c *nostrClient) closeSubscription(ctx context.Context, t *testing.T, subID string) {
 	msg := []interface{}{"CLOSE", subID}
 	data, _ := json.Marshal(msg)
@@ -2861,3 +2935,524 @@ func TestIntegration_WriteRestrictedGroup_MembersListIncludesRoles(t *testing.T)
 
 	t.Logf("Members list correctly includes roles")
 }
+
+func TestIntegration_EphemeralGroupEvents_MembersOnly(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+
+	relay := setupRelay(ctx, t, false)
+	defer relay.Cleanup(ctx)
+
+	adminClient := newNostrClient(ctx, t, relay.URI, adminSecret)
+	defer adminClient.close()
+
+	createEvent := &nostr.Event{
+		Kind:      nostr.Kind(KindCreateGroup),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "typing"}},
+		Content:   `{"name":"Typing Test","private":true}`,
+	}
+	if result := adminClient.sendEvent(ctx, t, createEvent); result != "ok" {
+		t.Fatalf("Failed to create group: %s", result)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	putUserEvent := &nostr.Event{
+		Kind:      nostr.Kind(KindPutUser),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "typing"}, {"p", nonAdminPubkey.Hex()}},
+	}
+	if result := adminClient.sendEvent(ctx, t, putUserEvent); result != "ok" {
+		t.Fatalf("Failed to add member: %s", result)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// A member and an outsider both subscribe to typing indicators
+	filter := map[string]interface{}{
+		"kinds": []int{20001},
+		"#h":    []string{"typing"},
+	}
+
+	memberClient := newNostrClient(ctx, t, relay.URI, nonAdminSecret)
+	defer memberClient.close()
+	memberClient.subscribe(ctx, t, "typing-member", filter)
+
+	outsiderClient := newNostrClient(ctx, t, relay.URI, writerSecret)
+	defer outsiderClient.close()
+	outsiderClient.subscribe(ctx, t, "typing-outsider", filter)
+
+	typingEvent := &nostr.Event{
+		Kind:      nostr.Kind(20001),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "typing"}},
+	}
+	if result := adminClient.sendEvent(ctx, t, typingEvent); result != "ok" {
+		t.Fatalf("Admin should be able to send a typing event: %s", result)
+	}
+
+	if event, ok := memberClient.nextEvent(ctx, t, "typing-member", 3*time.Second); !ok {
+		t.Fatal("Member should receive the typing event")
+	} else if event.ID != typingEvent.ID {
+		t.Errorf("Member received %s, want the typing event", event.ID)
+	}
+
+	if _, ok := outsiderClient.nextEvent(ctx, t, "typing-outsider", time.Second); ok {
+		t.Fatal("Non-member should not receive typing events of a private group")
+	}
+
+	// Outsiders can't send them either
+	outsiderTyping := &nostr.Event{
+		Kind:      nostr.Kind(20001),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "typing"}},
+	}
+	if result := outsiderClient.sendEvent(ctx, t, outsiderTyping); result == "ok" {
+		t.Fatal("Non-member should not be able to send typing events to the group")
+	}
+
+	t.Logf("Typing events reach members only")
+}
+
+func TestIntegration_TrustedSignerMirrorsMembership(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+
+	relay := setupRelayWithConfig(ctx, t, relayConfig{
+		adminCreateOnly:  true,
+		privateAdminOnly: true,
+		trustedSigners:   []nostr.PubKey{upstreamPubkey},
+	})
+	defer relay.Cleanup(ctx)
+
+	adminClient := newNostrClient(ctx, t, relay.URI, adminSecret)
+	defer adminClient.close()
+
+	createEvent := &nostr.Event{
+		Kind:      nostr.Kind(KindCreateGroup),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "mirrored"}},
+		Content:   `{"name":"Mirrored","closed":true}`,
+	}
+	if result := adminClient.sendEvent(ctx, t, createEvent); result != "ok" {
+		t.Fatalf("Failed to create group: %s", result)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	upstreamClient := newNostrClient(ctx, t, relay.URI, upstreamSecret)
+	defer upstreamClient.close()
+
+	// The trusted signer isn't an admin here, but its membership changes
+	// are accepted
+	putUserEvent := &nostr.Event{
+		Kind:      nostr.Kind(KindPutUser),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "mirrored"}, {"p", nonAdminPubkey.Hex()}},
+	}
+	if result := upstreamClient.sendEvent(ctx, t, putUserEvent); result != "ok" {
+		t.Fatalf("Trusted signer should be able to add a member: %s", result)
+	}
+
+	// An untrusted key can't do the same
+	writerClient := newNostrClient(ctx, t, relay.URI, writerSecret)
+	defer writerClient.close()
+
+	untrustedPut := &nostr.Event{
+		Kind:      nostr.Kind(KindPutUser),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "mirrored"}, {"p", writerPubkey.Hex()}},
+	}
+	if result := writerClient.sendEvent(ctx, t, untrustedPut); result == "ok" {
+		t.Fatal("Untrusted non-admin should not be able to add members")
+	}
+
+	// Trust doesn't extend to missing groups, relay-level state or other kinds
+	missingPut := &nostr.Event{
+		Kind:      nostr.Kind(KindPutUser),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "no-such-group"}, {"p", writerPubkey.Hex()}},
+	}
+	if result := upstreamClient.sendEvent(ctx, t, missingPut); result == "ok" {
+		t.Fatal("Trusted signer should not be able to add members to a missing group")
+	}
+
+	relayPut := &nostr.Event{
+		Kind:      nostr.Kind(KindPutUser),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "_"}, {"p", upstreamPubkey.Hex(), "admin"}},
+	}
+	if result := upstreamClient.sendEvent(ctx, t, relayPut); result == "ok" {
+		t.Fatal("Trusted signer should not be able to change relay-level state")
+	}
+
+	chatEvent := &nostr.Event{
+		Kind:      nostr.Kind(KindGroupChatMessage),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "mirrored"}},
+		Content:   "not a member",
+	}
+	if result := upstreamClient.sendEvent(ctx, t, chatEvent); result == "ok" {
+		t.Fatal("Trusted signer should not be able to post in a closed group it isn't in")
+	}
+
+	// The mirrored member shows up in the members list
+	time.Sleep(500 * time.Millisecond)
+
+	filter := map[string]interface{}{
+		"kinds": []int{KindGroupMembers},
+		"#d":    []string{"mirrored"},
+	}
+	events := adminClient.subscribe(ctx, t, "mirrored-members", filter)
+	if len(events) == 0 {
+		t.Fatal("Members list not found")
+	}
+
+	found := false
+	for tag := range events[0].Tags.FindAll("p") {
+		if tag[1] == nonAdminPubkey.Hex() {
+			found = true
+		}
+		if tag[1] == writerPubkey.Hex() {
+			t.Error("Member added by an untrusted key should not be listed")
+		}
+	}
+	if !found {
+		t.Error("Member added by the trusted signer should be listed")
+	}
+}
+
+func TestIntegration_KickedMemberSubscriptionStopsReceiving(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+
+	relay := setupRelay(ctx, t, false)
+	defer relay.Cleanup(ctx)
+
+	adminClient := newNostrClient(ctx, t, relay.URI, adminSecret)
+	defer adminClient.close()
+
+	createEvent := &nostr.Event{
+		Kind:      nostr.Kind(KindCreateGroup),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "live-kick"}},
+		Content:   `{"name":"Live Kick","private":true}`,
+	}
+	if result := adminClient.sendEvent(ctx, t, createEvent); result != "ok" {
+		t.Fatalf("Failed to create group: %s", result)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	putUserEvent := &nostr.Event{
+		Kind:      nostr.Kind(KindPutUser),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "live-kick"}, {"p", nonAdminPubkey.Hex()}},
+	}
+	if result := adminClient.sendEvent(ctx, t, putUserEvent); result != "ok" {
+		t.Fatalf("Failed to add member: %s", result)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// The member subscribes while they still have access, and keeps the
+	// subscription open
+	memberClient := newNostrClient(ctx, t, relay.URI, nonAdminSecret)
+	defer memberClient.close()
+	memberClient.subscribe(ctx, t, "live", map[string]interface{}{
+		"kinds": []int{KindGroupChatMessage},
+		"#h":    []string{"live-kick"},
+	})
+
+	before := &nostr.Event{
+		Kind:      nostr.Kind(KindGroupChatMessage),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "live-kick"}},
+		Content:   "before the kick",
+	}
+	if result := adminClient.sendEvent(ctx, t, before); result != "ok" {
+		t.Fatalf("Failed to send message: %s", result)
+	}
+	if _, ok := memberClient.nextEvent(ctx, t, "live", 3*time.Second); !ok {
+		t.Fatal("Member should receive messages before being kicked")
+	}
+
+	// Wait to ensure different timestamp for the kick event
+	time.Sleep(1100 * time.Millisecond)
+
+	kickEvent := &nostr.Event{
+		Kind:      nostr.Kind(KindRemoveUser),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "live-kick"}, {"p", nonAdminPubkey.Hex()}},
+	}
+	if result := adminClient.sendEvent(ctx, t, kickEvent); result != "ok" {
+		t.Fatalf("Admin should be able to kick the member: %s", result)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	after := &nostr.Event{
+		Kind:      nostr.Kind(KindGroupChatMessage),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "live-kick"}},
+		Content:   "after the kick",
+	}
+	if result := adminClient.sendEvent(ctx, t, after); result != "ok" {
+		t.Fatalf("Failed to send message: %s", result)
+	}
+	if event, ok := memberClient.nextEvent(ctx, t, "live", 2*time.Second); ok {
+		t.Fatalf("Kicked member's open subscription received %q", event.Content)
+	}
+
+	t.Logf("Open subscriptions stop receiving a group's events once the member is kicked")
+}
+
+// giftWrap is a stand-in for a NIP 59 gift wrap to recipient; the relay
+// never looks inside, so the content needn't be real ciphertext.
+func giftWrap(recipient nostr.PubKey, createdAt nostr.Timestamp) *nostr.Event {
+	return &nostr.Event{
+		Kind:      nostr.KindGiftWrap,
+		CreatedAt: createdAt,
+		Tags:      nostr.Tags{{"p", recipient.Hex()}},
+		Content:   "ciphertext",
+	}
+}
+
+func TestIntegration_GiftWrapsReachOnlyTheirRecipient(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+
+	relay := setupRelay(ctx, t, false)
+	defer relay.Cleanup(ctx)
+
+	// Both are connected and subscribed to the recipient's gift wraps
+	filter := map[string]interface{}{
+		"kinds": []int{int(nostr.KindGiftWrap)},
+		"#p":    []string{nonAdminPubkey.Hex()},
+	}
+	recipientClient := newNostrClient(ctx, t, relay.URI, nonAdminSecret)
+	defer recipientClient.close()
+	recipientClient.subscribe(ctx, t, "inbox", filter)
+
+	otherClient := newNostrClient(ctx, t, relay.URI, writerSecret)
+	defer otherClient.close()
+	otherClient.subscribe(ctx, t, "snoop", filter)
+
+	// Gift wraps are signed by throwaway keys
+	senderClient := newNostrClient(ctx, t, relay.URI, nostr.Generate())
+	defer senderClient.close()
+
+	wrap := giftWrap(nonAdminPubkey, nostr.Now())
+	if result := senderClient.sendEvent(ctx, t, wrap); result != "ok" {
+		t.Fatalf("Gift wrap to a recipient who isn't a member was refused under the open policy: %s", result)
+	}
+
+	if event, ok := recipientClient.nextEvent(ctx, t, "inbox", 3*time.Second); !ok || event.ID != wrap.ID {
+		t.Fatal("Recipient's open subscription should receive the gift wrap")
+	}
+	if _, ok := otherClient.nextEvent(ctx, t, "snoop", 2*time.Second); ok {
+		t.Fatal("Someone else's subscription received the gift wrap")
+	}
+
+	received := recipientClient.subscribe(ctx, t, "inbox-stored", filter)
+	if len(received) != 1 || received[0].ID != wrap.ID {
+		t.Fatalf("Recipient should be served the stored gift wrap, got %d events", len(received))
+	}
+
+	if snooped := otherClient.subscribe(ctx, t, "snoop-stored", filter); len(snooped) != 0 {
+		t.Fatalf("Someone else was served %d of the recipient's gift wraps", len(snooped))
+	}
+
+	t.Logf("Gift wraps are accepted for their recipient and only served to them")
+}
+
+func TestIntegration_GiftWrapsExpire(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+
+	relay := setupRelayWithConfig(ctx, t, relayConfig{privateAdminOnly: true, dmMaxAge: "1h"})
+	defer relay.Cleanup(ctx)
+
+	senderClient := newNostrClient(ctx, t, relay.URI, nostr.Generate())
+	defer senderClient.close()
+
+	expired := giftWrap(nonAdminPubkey, nostr.Now()-2*60*60)
+	if result := senderClient.sendEvent(ctx, t, expired); !strings.HasPrefix(result, "rejected:invalid:") {
+		t.Fatalf("A gift wrap older than dms.max_age should be refused, got %s", result)
+	}
+
+	// Backdated so that it expires a few seconds from now
+	expiring := giftWrap(nonAdminPubkey, nostr.Now()-60*60+3)
+	if result := senderClient.sendEvent(ctx, t, expiring); result != "ok" {
+		t.Fatalf("Failed to send gift wrap: %s", result)
+	}
+
+	recipientClient := newNostrClient(ctx, t, relay.URI, nonAdminSecret)
+	defer recipientClient.close()
+
+	filter := map[string]interface{}{"kinds": []int{int(nostr.KindGiftWrap)}}
+	if received := recipientClient.subscribe(ctx, t, "before", filter); len(received) != 1 {
+		t.Fatalf("Recipient should be served the gift wrap before it expires, got %d events", len(received))
+	}
+
+	time.Sleep(4 * time.Second)
+
+	if received := recipientClient.subscribe(ctx, t, "after", filter); len(received) != 0 {
+		t.Fatalf("Recipient was served %d gift wraps after they expired", len(received))
+	}
+
+	t.Logf("Gift wraps older than dms.max_age are refused and stop being served")
+}
+
+func TestIntegration_OverlappingSubscriptionsGetEventsOnce(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+
+	relay := setupRelay(ctx, t, false)
+	defer relay.Cleanup(ctx)
+
+	adminClient := newNostrClient(ctx, t, relay.URI, adminSecret)
+	defer adminClient.close()
+
+	createEvent := &nostr.Event{
+		Kind:      nostr.Kind(KindCreateGroup),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "overlap"}},
+		Content:   `{"name":"Overlap"}`,
+	}
+	if result := adminClient.sendEvent(ctx, t, createEvent); result != "ok" {
+		t.Fatalf("Failed to create group: %s", result)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	listener := newNostrClient(ctx, t, relay.URI, adminSecret)
+	defer listener.close()
+	listener.subscribe(ctx, t, "by-group", map[string]interface{}{"#h": []string{"overlap"}})
+	listener.subscribe(ctx, t, "by-kind", map[string]interface{}{"kinds": []int{KindGroupChatMessage}})
+
+	message := &nostr.Event{
+		Kind:      nostr.Kind(KindGroupChatMessage),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "overlap"}},
+		Content:   "matches both subscriptions",
+	}
+	if result := adminClient.sendEvent(ctx, t, message); result != "ok" {
+		t.Fatalf("Failed to send message: %s", result)
+	}
+
+	frames := listener.eventFrames(ctx, t, message.ID, 2*time.Second)
+	total := 0
+	for _, n := range frames {
+		total += n
+	}
+	if total != 1 {
+		t.Fatalf("Message sent %d times over overlapping subscriptions (%v), want once", total, frames)
+	}
+
+	t.Logf("A connection gets each live event once however many of its subscriptions match")
+}
+
+func TestIntegration_PresenceNotices_MembersOnly(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+
+	relay := setupRelayWithConfig(ctx, t, relayConfig{presenceNotices: true})
+	defer relay.Cleanup(ctx)
+
+	adminClient := newNostrClient(ctx, t, relay.URI, adminSecret)
+	defer adminClient.close()
+
+	createEvent := &nostr.Event{
+		Kind:      nostr.Kind(KindCreateGroup),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "presence"}},
+		Content:   `{"name":"Presence Test","private":true}`,
+	}
+	if result := adminClient.sendEvent(ctx, t, createEvent); result != "ok" {
+		t.Fatalf("Failed to create group: %s", result)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	putUserEvent := &nostr.Event{
+		Kind:      nostr.Kind(KindPutUser),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "presence"}, {"p", nonAdminPubkey.Hex()}},
+	}
+	if result := adminClient.sendEvent(ctx, t, putUserEvent); result != "ok" {
+		t.Fatalf("Failed to add member: %s", result)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// A member and an outsider both subscribe to presence notices
+	filter := map[string]interface{}{
+		"kinds": []int{int(KindGroupPresence)},
+		"#h":    []string{"presence"},
+	}
+
+	memberClient := newNostrClient(ctx, t, relay.URI, nonAdminSecret)
+	defer memberClient.close()
+	memberClient.subscribe(ctx, t, "presence-member", filter)
+
+	outsiderClient := newNostrClient(ctx, t, relay.URI, writerSecret)
+	defer outsiderClient.close()
+	outsiderClient.subscribe(ctx, t, "presence-outsider", filter)
+
+	joinEvent := &nostr.Event{
+		Kind:      nostr.Kind(KindPutUser),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "presence"}, {"p", upstreamPubkey.Hex()}},
+	}
+	if result := adminClient.sendEvent(ctx, t, joinEvent); result != "ok" {
+		t.Fatalf("Failed to add member: %s", result)
+	}
+
+	if event, ok := memberClient.nextEvent(ctx, t, "presence-member", 3*time.Second); !ok {
+		t.Fatal("Member should receive the presence notice")
+	} else {
+		if event.PubKey != relaySecret.Public() {
+			t.Errorf("Presence notice signed by %s, want the relay", event.PubKey.Hex())
+		}
+		if tag := event.Tags.Find("p"); tag == nil || tag[1] != upstreamPubkey.Hex() {
+			t.Errorf("Presence notice p tag = %v, want %s", tag, upstreamPubkey.Hex())
+		}
+		if tag := event.Tags.Find("action"); tag == nil || tag[1] != "join" {
+			t.Errorf("Presence notice action = %v, want join", tag)
+		}
+	}
+
+	if _, ok := outsiderClient.nextEvent(ctx, t, "presence-outsider", time.Second); ok {
+		t.Fatal("Non-member should not receive presence notices of a private group")
+	}
+
+	// Nothing is stored
+	if events := adminClient.subscribe(ctx, t, "presence-stored", filter); len(events) != 0 {
+		t.Errorf("Found %d stored presence notices, want none", len(events))
+	}
+
+	t.Logf("Presence notices reach members only and aren't stored")
+}
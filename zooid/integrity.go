@@ -0,0 +1,95 @@
+package zooid
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// corruptScanBatch is how many rows FindCorruptEvents reads per query.
+const corruptScanBatch = 1000
+
+// CorruptEvent is a stored row that fails validation.
+type CorruptEvent struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// FindCorruptEvents scans every stored event, in id order and in batches, for
+// rows that can't be parsed or whose id doesn't match their content. With
+// remove set, those rows are deleted as they are found. Signatures aren't
+// checked; that would make a full scan far slower and khatru verified them
+// on the way in.
+func (events *EventStore) FindCorruptEvents(ctx context.Context, remove bool) ([]CorruptEvent, error) {
+	// Events in memory are never stored unparsed
+	if usesMemory() {
+		return make([]CorruptEvent, 0), nil
+	}
+
+	stmt := fmt.Sprintf(
+		"SELECT %s FROM %s WHERE id > $1 ORDER BY id LIMIT %d",
+		strings.Join(eventColumns, ", "), events.Schema.Prefix("events"), corruptScanBatch)
+
+	corrupt := make([]CorruptEvent, 0)
+	cursor := ""
+
+	for {
+		found, last, n, err := events.findCorruptBatch(ctx, stmt, cursor)
+		if err != nil {
+			return corrupt, err
+		}
+
+		for _, c := range found {
+			if remove {
+				if _, err := sb.Delete(events.Schema.Prefix("events")).Where("id = ?", c.ID).RunWith(GetDb()).ExecContext(ctx); err != nil {
+					return corrupt, fmt.Errorf("deleting corrupt event %s: %w", c.ID, err)
+				}
+				log.Printf("Deleted corrupt event %s from schema %s: %s", c.ID, events.Schema.Name, c.Reason)
+			}
+		}
+
+		corrupt = append(corrupt, found...)
+
+		if n < corruptScanBatch {
+			return corrupt, nil
+		}
+		cursor = last
+	}
+}
+
+func (events *EventStore) findCorruptBatch(ctx context.Context, stmt string, cursor string) ([]CorruptEvent, string, int, error) {
+	subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
+	defer cancel()
+
+	rows, err := GetDb().QueryContext(subctx, stmt, cursor)
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("scanning events: %w", err)
+	}
+	defer rows.Close()
+
+	var found []CorruptEvent
+	n := 0
+
+	for rows.Next() {
+		var row eventRow
+		if err := row.scan(rows); err != nil {
+			return nil, "", 0, fmt.Errorf("scanning events: %w", err)
+		}
+		n++
+		cursor = row.id
+
+		evt, err := row.event()
+		if err != nil {
+			found = append(found, CorruptEvent{ID: row.id, Reason: err.Error()})
+		} else if !evt.CheckID() {
+			found = append(found, CorruptEvent{ID: row.id, Reason: "id does not match content"})
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, "", 0, fmt.Errorf("scanning events: %w", err)
+	}
+
+	return found, cursor, n, nil
+}
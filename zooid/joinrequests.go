@@ -0,0 +1,162 @@
+package zooid
+
+import (
+	"log"
+	"strconv"
+
+	"fiatjaf.com/nostr"
+)
+
+// Pending join requests.
+//
+// Admins of a closed group would otherwise have to watch every kind 9021 to
+// notice someone waiting. Instead the relay keeps a KindSimpleGroupJoinRequests
+// event per group, with the group in its d and h tags, a ["count", <n>] tag
+// for the requests still pending and a ["newest", <timestamp>] tag for the
+// latest of them. A request is pending until a 9000 or 9001 names its author
+// or they send a 9022, so it's worked out from the log and the same after a
+// restart. The event is rewritten, and broadcast, whenever one of those kinds
+// is saved, and only those who can answer the requests may read it.
+
+const KindSimpleGroupJoinRequests nostr.Kind = 39012
+
+// joinRequestScan is how many of a group's latest join requests are looked
+// at; older ones are taken to have been dealt with some other way.
+const joinRequestScan = 1000
+
+// canAnswerJoinRequests reports whether pubkey may add people to group h, by
+// the same rules CheckWrite applies to moderation events.
+func (g *GroupStore) canAnswerJoinRequests(h string, pubkey nostr.PubKey) bool {
+	if g.IsPrivateGroup(h) && !g.Config.Groups.PrivateRelayAdminAccess {
+		return g.IsGroupCreator(h, pubkey)
+	}
+
+	return g.Config.CanManage(pubkey) || g.IsGroupCreator(h, pubkey)
+}
+
+// pendingJoinRequests returns who is waiting to join group h, with when they
+// last asked.
+func (g *GroupStore) pendingJoinRequests(h string) map[nostr.PubKey]nostr.Timestamp {
+	pending := make(map[nostr.PubKey]nostr.Timestamp)
+	oldest := nostr.Timestamp(0)
+
+	// Newest first, so the first request of each pubkey is their latest
+	requests := nostr.Filter{
+		Kinds: []nostr.Kind{nostr.KindSimpleGroupJoinRequest},
+		Tags:  nostr.TagMap{"h": []string{h}},
+	}
+	for event := range g.Events.QueryEvents(requests, joinRequestScan) {
+		if _, ok := pending[event.PubKey]; !ok {
+			pending[event.PubKey] = event.CreatedAt
+		}
+		oldest = event.CreatedAt
+	}
+	if len(pending) == 0 {
+		return pending
+	}
+
+	requesters := Keys(pending)
+	hexes := make([]string, len(requesters))
+	for i, pubkey := range requesters {
+		hexes[i] = pubkey.Hex()
+	}
+
+	// An answer in the same second as the request is taken to follow it
+	resolve := func(pubkey nostr.PubKey, at nostr.Timestamp) {
+		if asked, ok := pending[pubkey]; ok && at >= asked {
+			delete(pending, pubkey)
+		}
+	}
+
+	answers := nostr.Filter{
+		Kinds: []nostr.Kind{nostr.KindSimpleGroupPutUser, nostr.KindSimpleGroupRemoveUser},
+		Tags:  nostr.TagMap{"h": []string{h}, "p": hexes},
+		Since: oldest,
+	}
+	for event := range g.Events.QueryEvents(answers, 0) {
+		for tag := range event.Tags.FindAll("p") {
+			if pubkey, err := nostr.PubKeyFromHex(tag[1]); err == nil {
+				resolve(pubkey, event.CreatedAt)
+			}
+		}
+	}
+
+	leaves := nostr.Filter{
+		Kinds:   []nostr.Kind{nostr.KindSimpleGroupLeaveRequest},
+		Authors: requesters,
+		Tags:    nostr.TagMap{"h": []string{h}},
+		Since:   oldest,
+	}
+	for event := range g.Events.QueryEvents(leaves, 0) {
+		resolve(event.PubKey, event.CreatedAt)
+	}
+
+	return pending
+}
+
+// UpdateJoinRequests rewrites the pending join requests event of group h. A
+// group that never had a pending request doesn't get one.
+func (g *GroupStore) UpdateJoinRequests(h string) error {
+	if _, found := g.GetMetadata(h); !found {
+		return nil
+	}
+
+	g.joinRequestsMu.Lock()
+	defer g.joinRequestsMu.Unlock()
+
+	pending := g.pendingJoinRequests(h)
+	g.joinRequestsCache.Store(h, pending)
+
+	event := nostr.Event{
+		Kind:      KindSimpleGroupJoinRequests,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"d", h},
+			{"h", h},
+			{"count", strconv.Itoa(len(pending))},
+		},
+	}
+
+	if len(pending) == 0 {
+		filter := nostr.Filter{
+			Kinds:   []nostr.Kind{KindSimpleGroupJoinRequests},
+			Authors: []nostr.PubKey{g.Config.GetSelf()},
+			Tags:    nostr.TagMap{"d": []string{h}},
+		}
+		stored := false
+		for range g.Events.QueryEvents(filter, 1) {
+			stored = true
+		}
+		if !stored {
+			return nil
+		}
+	} else {
+		newest := nostr.Timestamp(0)
+		for _, at := range pending {
+			newest = max(newest, at)
+		}
+		event.Tags = append(event.Tags, nostr.Tag{"newest", strconv.FormatInt(int64(newest), 10)})
+	}
+
+	return g.Events.signAndStoreList("join_requests", &event, true)
+}
+
+// resolveJoinRequest updates group h's pending join requests if pubkey was
+// among them, after the relay added or removed them itself.
+func (g *GroupStore) resolveJoinRequest(h string, pubkey nostr.PubKey) {
+	if v, ok := g.joinRequestsCache.Load(h); ok {
+		if _, waiting := v.(map[nostr.PubKey]nostr.Timestamp)[pubkey]; !waiting {
+			return
+		}
+	}
+
+	if err := g.UpdateJoinRequests(h); err != nil {
+		log.Printf("Failed to update pending join requests of group %q: %v", h, err)
+	}
+}
+
+// forgetJoinRequests drops the cached pending join requests of a deleted
+// group.
+func (g *GroupStore) forgetJoinRequests(h string) {
+	g.joinRequestsCache.Delete(h)
+}
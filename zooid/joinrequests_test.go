@@ -0,0 +1,137 @@
+package zooid
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// queryJoinRequests returns the pending join requests event of h as reader
+// sees it, or false if they can't.
+func queryJoinRequests(t *testing.T, instance *Instance, reader nostr.PubKey, h string) (nostr.Event, bool) {
+	t.Helper()
+
+	filter := nostr.Filter{Kinds: []nostr.Kind{KindSimpleGroupJoinRequests}, Tags: nostr.TagMap{"d": []string{h}}}
+	for event := range instance.QueryStored(authedContext(reader), filter) {
+		if !instance.Config.IsSelf(event.PubKey) || !event.VerifySignature() {
+			t.Error("the pending join requests should be signed by the relay")
+		}
+		return event, true
+	}
+
+	return nostr.Event{}, false
+}
+
+func pendingCount(t *testing.T, instance *Instance, h string) (int, nostr.Timestamp) {
+	t.Helper()
+
+	event, found := queryJoinRequests(t, instance, instance.Config.secret.Public(), h)
+	if !found {
+		t.Fatalf("no pending join requests event for %q", h)
+	}
+
+	count, _ := strconv.Atoi(event.Tags.Find("count")[1])
+	var newest int64
+	if tag := event.Tags.Find("newest"); tag != nil {
+		newest, _ = strconv.ParseInt(tag[1], 10, 64)
+	}
+	return count, nostr.Timestamp(newest)
+}
+
+func TestJoinRequests_PendingAndResolved(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Groups.AutoJoin = false
+	runTestAdmin(t, instance, "create-group", "knock")
+
+	publish := func(event nostr.Event) {
+		t.Helper()
+		if reason := instance.Groups.CheckWrite(event); reason != "" {
+			t.Fatalf("kind %d refused: %s", event.Kind, reason)
+		}
+		if err := instance.Events.SaveEvent(event); err != nil {
+			t.Fatal(err)
+		}
+		instance.OnEventSaved(context.Background(), event)
+	}
+
+	if _, found := queryJoinRequests(t, instance, instance.Config.secret.Public(), "knock"); found {
+		t.Error("a group without join requests shouldn't have the event")
+	}
+
+	alice, bob := nostr.Generate(), nostr.Generate()
+	now := nostr.Now()
+	publish(signedAt(alice, nostr.KindSimpleGroupJoinRequest, now-10, nostr.Tags{{"h", "knock"}}))
+	if count, newest := pendingCount(t, instance, "knock"); count != 1 || newest != now-10 {
+		t.Errorf("after one request: count %d newest %d, want 1 %d", count, newest, now-10)
+	}
+
+	publish(signedAt(bob, nostr.KindSimpleGroupJoinRequest, now-5, nostr.Tags{{"h", "knock"}}))
+	if count, newest := pendingCount(t, instance, "knock"); count != 2 || newest != now-5 {
+		t.Errorf("after two requests: count %d newest %d, want 2 %d", count, newest, now-5)
+	}
+
+	// An admin's client approves alice
+	publish(signedAt(instance.Config.secret, nostr.KindSimpleGroupPutUser, now, nostr.Tags{{"h", "knock"}, {"p", alice.Public().Hex()}}))
+	if count, newest := pendingCount(t, instance, "knock"); count != 1 || newest != now-5 {
+		t.Errorf("after approving one: count %d newest %d, want 1 %d", count, newest, now-5)
+	}
+
+	// The relay turns bob away itself
+	runTestAdmin(t, instance, "remove-member", "knock", bob.Public().Hex())
+	if count, newest := pendingCount(t, instance, "knock"); count != 0 || newest != 0 {
+		t.Errorf("after answering both: count %d newest %d, want 0 and no newest", count, newest)
+	}
+
+	// Both are worked out from the log again after a restart
+	instance.Groups.joinRequestsCache.Clear()
+	if err := instance.Groups.UpdateJoinRequests("knock"); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := pendingCount(t, instance, "knock"); count != 0 {
+		t.Errorf("after reloading: count %d, want 0", count)
+	}
+}
+
+func TestJoinRequests_AdminsOnly(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+	instance.Config.Groups.AutoJoin = false
+	runTestAdmin(t, instance, "create-group", "closed")
+
+	member := nostr.Generate().Public()
+	runTestAdmin(t, instance, "add-member", "closed", member.Hex())
+
+	requester := nostr.Generate()
+	request := signedBy(requester, nostr.Event{Kind: nostr.KindSimpleGroupJoinRequest, Tags: nostr.Tags{{"h", "closed"}}})
+	if err := instance.Events.SaveEvent(request); err != nil {
+		t.Fatal(err)
+	}
+	instance.OnEventSaved(context.Background(), request)
+
+	summary, found := queryJoinRequests(t, instance, instance.Config.secret.Public(), "closed")
+	if !found {
+		t.Fatal("an admin can't read the pending join requests")
+	}
+	if _, found := queryJoinRequests(t, instance, member, "closed"); found {
+		t.Error("a member can read the pending join requests")
+	}
+	if _, found := queryJoinRequests(t, instance, requester.Public(), "closed"); found {
+		t.Error("a requester can read the pending join requests")
+	}
+
+	if !instance.PreventBroadcast(&khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{member}}, nostr.Filter{}, summary) {
+		t.Error("the pending join requests were broadcast to a member")
+	}
+	if instance.PreventBroadcast(&khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{instance.Config.secret.Public()}}, nostr.Filter{}, summary) {
+		t.Error("the pending join requests weren't broadcast to an admin")
+	}
+
+	// Nobody else may publish one
+	forged := signedBy(requester, nostr.Event{Kind: KindSimpleGroupJoinRequests, Tags: nostr.Tags{{"d", "closed"}, {"h", "closed"}, {"count", "0"}}})
+	if reject, _ := instance.OnEvent(authedContext(requester.Public()), forged); !reject {
+		t.Error("a forged pending join requests event was accepted")
+	}
+}
@@ -2,10 +2,16 @@ package zooid
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"slices"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/Masterminds/squirrel"
 )
 
 // ErrKVNotFound is the sentinel returned by KeyValueStore.Get when the key
@@ -19,7 +25,30 @@ var (
 	kvOnce sync.Once
 )
 
-type KeyValueStore struct{}
+type KeyValueStore struct {
+	cacheTTLs sync.Map // map[string]time.Duration (namespace -> cache TTL)
+	cache     sync.Map // map[string]kvCacheEntry
+
+	// memory holds the keys instead of the kv table with
+	// DATABASE_URL=memory://, see memory.go
+	memory *memoryKV
+}
+
+type kvCacheEntry struct {
+	value   string
+	found   bool
+	expires time.Time
+}
+
+// KeyValue is a single entry returned by List.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// kvNow is the clock used for TTL checks, swappable in tests so expiry
+// boundaries can be exercised without sleeping.
+var kvNow = func() int64 { return time.Now().Unix() }
 
 // GetKeyValueStore is a startup-time singleton — Migrate creates the kv
 // table once, before the connection pool sees production load. The ctx is
@@ -28,7 +57,11 @@ type KeyValueStore struct{}
 func GetKeyValueStore(ctx context.Context) *KeyValueStore {
 	kvOnce.Do(func() {
 		kv = &KeyValueStore{}
-		kv.Migrate(ctx)
+		if usesMemory() {
+			kv.memory = newMemoryKV()
+		} else {
+			kv.Migrate(ctx)
+		}
 	})
 
 	return kv
@@ -40,6 +73,21 @@ func (kv *KeyValueStore) Migrate(ctx context.Context) {
 			key TEXT PRIMARY KEY,
 			value TEXT NOT NULL
 		)`,
+		// Unix seconds; NULL means the key never expires. Additive so
+		// existing deployments migrate in place.
+		`ALTER TABLE kv ADD COLUMN IF NOT EXISTS expires_at BIGINT`,
+		`CREATE INDEX IF NOT EXISTS kv_expires_at_idx ON kv (expires_at) WHERE expires_at IS NOT NULL`,
+	}
+
+	// SQLite can't ADD COLUMN IF NOT EXISTS, and has no deployments from
+	// before expires_at to migrate
+	if usesSQLite() {
+		statements[0] = `CREATE TABLE IF NOT EXISTS kv (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL,
+			expires_at BIGINT
+		)`
+		statements = slices.Delete(statements, 1, 2)
 	}
 
 	for _, stmt := range statements {
@@ -59,58 +107,510 @@ func (kv *KeyValueStore) Migrate(ctx context.Context) {
 // ctx) bounds the pool wait and query — no business code creates its own
 // background context.
 func (kv *KeyValueStore) Get(ctx context.Context, key string) (string, error) {
+	ttl := kv.cacheTTL(key)
+
+	if ttl > 0 {
+		if v, ok := kv.cache.Load(key); ok {
+			entry := v.(kvCacheEntry)
+			if time.Now().Before(entry.expires) {
+				if !entry.found {
+					return "", fmt.Errorf("%w: %s", ErrKVNotFound, key)
+				}
+				return entry.value, nil
+			}
+		}
+	}
+
+	value, expiresAt, err := kv.get(ctx, key)
+
+	if ttl > 0 && (err == nil || errors.Is(err, ErrKVNotFound)) {
+		entry := kvCacheEntry{value: value, found: err == nil, expires: time.Now().Add(ttl)}
+		// Never serve a key from cache past its own TTL
+		if expiresAt != nil && time.Unix(*expiresAt, 0).Before(entry.expires) {
+			entry.expires = time.Unix(*expiresAt, 0)
+		}
+		kv.cache.Store(key, entry)
+	}
+
+	return value, err
+}
+
+func (kv *KeyValueStore) get(ctx context.Context, key string) (string, *int64, error) {
+	if kv.memory != nil {
+		return kv.memory.get(key)
+	}
+
 	subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
 	defer cancel()
 
-	rows, err := sb.Select("value").
+	rows, err := sb.Select("value", "expires_at").
 		From("kv").
 		Where("key = ?", key).
+		Where(kvLive()).
 		RunWith(GetDb()).
 		QueryContext(subctx)
 
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	defer rows.Close()
 
 	for rows.Next() {
 		var value string
+		var expiresAt *int64
 
-		err := rows.Scan(&value)
+		err := rows.Scan(&value, &expiresAt)
 		if err != nil {
-			return "", err
+			return "", nil, err
 		}
 
-		return value, nil
+		return value, expiresAt, nil
 	}
 
 	// rows.Err() surfaces context-cancel and driver errors that ended the
 	// iteration before any row arrived — without this check, the not-found
 	// branch below would mask them.
 	if err := rows.Err(); err != nil {
-		return "", fmt.Errorf("kv get %q: %w", key, err)
+		return "", nil, fmt.Errorf("kv get %q: %w", key, err)
 	}
 
-	return "", fmt.Errorf("%w: %s", ErrKVNotFound, key)
+	return "", nil, fmt.Errorf("%w: %s", ErrKVNotFound, key)
 }
 
 func (kv *KeyValueStore) Set(ctx context.Context, key string, value string) error {
+	return kv.set(ctx, key, value, nil)
+}
+
+// SetWithTTL stores value under key until ttl has elapsed, after which Get
+// and List treat the key as missing and the sweeper eventually deletes it.
+func (kv *KeyValueStore) SetWithTTL(ctx context.Context, key string, value string, ttl time.Duration) error {
+	expiresAt := kvNow() + int64(ttl/time.Second)
+	return kv.set(ctx, key, value, &expiresAt)
+}
+
+func (kv *KeyValueStore) set(ctx context.Context, key string, value string, expiresAt *int64) error {
+	defer kv.cache.Delete(key)
+
+	if kv.memory != nil {
+		kv.memory.set(key, value, expiresAt)
+		return nil
+	}
+
 	subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
 	defer cancel()
 
 	_, err := sb.Insert("kv").
+		Columns("key", "value", "expires_at").
+		Values(key, value, expiresAt).
+		Suffix("ON CONFLICT(key) DO UPDATE SET value = EXCLUDED.value, expires_at = EXCLUDED.expires_at").
+		RunWith(GetDb()).
+		ExecContext(subctx)
+
+	return err
+}
+
+// kvSetManyBatch bounds the rows per INSERT in SetMany, keeping each
+// statement well under PostgreSQL's parameter limit.
+const kvSetManyBatch = 1000
+
+// SetMany stores every item in as few statements as possible, without a
+// TTL. It is meant for periodic bulk writes where one Set per key would
+// mean one round trip per key.
+func (kv *KeyValueStore) SetMany(ctx context.Context, items []KeyValue) error {
+	if kv.memory != nil {
+		for _, item := range items {
+			kv.memory.set(item.Key, item.Value, nil)
+			kv.cache.Delete(item.Key)
+		}
+		return nil
+	}
+
+	for start := 0; start < len(items); start += kvSetManyBatch {
+		batch := items[start:min(start+kvSetManyBatch, len(items))]
+
+		qb := sb.Insert("kv").Columns("key", "value", "expires_at")
+		for _, item := range batch {
+			qb = qb.Values(item.Key, item.Value, nil)
+		}
+
+		subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
+		_, err := qb.Suffix("ON CONFLICT(key) DO UPDATE SET value = EXCLUDED.value, expires_at = EXCLUDED.expires_at").
+			RunWith(GetDb()).
+			ExecContext(subctx)
+		cancel()
+
+		for _, item := range batch {
+			kv.cache.Delete(item.Key)
+		}
+
+		if err != nil {
+			return fmt.Errorf("kv set many: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// CompareAndSwap sets key to new only if its current value is old, and
+// reports whether it did. The check and write are a single conditional
+// UPDATE, so it is safe across instances sharing the database. A missing or
+// expired key never matches. The key's TTL, if any, is left unchanged.
+func (kv *KeyValueStore) CompareAndSwap(ctx context.Context, key string, old string, new string) (bool, error) {
+	defer kv.cache.Delete(key)
+
+	if kv.memory != nil {
+		return kv.memory.compareAndSwap(key, old, new), nil
+	}
+
+	subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
+	defer cancel()
+
+	result, err := sb.Update("kv").
+		Set("value", new).
+		Where("key = ? AND value = ?", key, old).
+		Where(kvLive()).
+		RunWith(GetDb()).
+		ExecContext(subctx)
+
+	if err != nil {
+		return false, fmt.Errorf("kv compare-and-swap %q: %w", key, err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// SetIfAbsent stores value under key only if the key is missing or expired,
+// and reports whether it did. Like CompareAndSwap it's a single statement, so
+// of several callers racing for one key, across instances too, exactly one
+// wins.
+func (kv *KeyValueStore) SetIfAbsent(ctx context.Context, key string, value string) (bool, error) {
+	defer kv.cache.Delete(key)
+
+	if kv.memory != nil {
+		return kv.memory.setIfAbsent(key, value), nil
+	}
+
+	subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
+	defer cancel()
+
+	result, err := sb.Insert("kv").
+		Columns("key", "value", "expires_at").
+		Values(key, value, nil).
+		Suffix("ON CONFLICT(key) DO UPDATE SET value = EXCLUDED.value, expires_at = NULL WHERE kv.expires_at IS NOT NULL AND kv.expires_at <= ?", kvNow()).
+		RunWith(GetDb()).
+		ExecContext(subctx)
+
+	if err != nil {
+		return false, fmt.Errorf("kv set if absent %q: %w", key, err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// Increment atomically adds delta to the integer stored under key and
+// returns the new value. Missing or expired keys count as zero (and lose
+// their TTL). It fails if the stored value isn't an integer.
+func (kv *KeyValueStore) Increment(ctx context.Context, key string, delta int64) (int64, error) {
+	defer kv.cache.Delete(key)
+
+	if kv.memory != nil {
+		return kv.memory.increment(key, delta)
+	}
+
+	subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
+	defer cancel()
+
+	now := kvNow()
+
+	// SQLite casts anything to an integer, so there a value that doesn't
+	// survive the round trip becomes NULL, failing the NOT NULL constraint
+	// the way the cast fails on Postgres
+	current := "CAST(kv.value AS BIGINT)"
+	if usesSQLite() {
+		current = "CASE WHEN CAST(CAST(kv.value AS BIGINT) AS TEXT) = kv.value THEN CAST(kv.value AS BIGINT) END"
+	}
+
+	var value int64
+	err := sb.Insert("kv").
 		Columns("key", "value").
-		Values(key, value).
-		Suffix("ON CONFLICT(key) DO UPDATE SET value = EXCLUDED.value").
+		Values(key, fmt.Sprint(delta)).
+		Suffix(`ON CONFLICT(key) DO UPDATE SET
+			value = CAST(CASE WHEN kv.expires_at IS NOT NULL AND kv.expires_at <= ? THEN 0 ELSE `+current+` END + ? AS TEXT),
+			expires_at = CASE WHEN kv.expires_at IS NOT NULL AND kv.expires_at <= ? THEN NULL ELSE kv.expires_at END
+			RETURNING CAST(value AS BIGINT)`, now, delta, now).
+		RunWith(GetDb()).
+		QueryRowContext(subctx).
+		Scan(&value)
+
+	if err != nil {
+		return 0, fmt.Errorf("kv increment %q: %w", key, err)
+	}
+
+	return value, nil
+}
+
+// KeyDelta is an amount to add to a key, see IncrementMany.
+type KeyDelta struct {
+	Key   string
+	Delta int64
+}
+
+// IncrementMany adds every delta to its key in as few statements as
+// possible, as Increment does one at a time. Keys it creates, or finds
+// expired, expire after ttl, or never if ttl is 0; other keys keep their
+// TTL. The increments are applied together or not at all: if any fails,
+// no key changes.
+func (kv *KeyValueStore) IncrementMany(ctx context.Context, items []KeyDelta, ttl time.Duration) error {
+	var expiresAt *int64
+	if ttl > 0 {
+		at := kvNow() + int64(ttl/time.Second)
+		expiresAt = &at
+	}
+
+	defer func() {
+		for _, item := range items {
+			kv.cache.Delete(item.Key)
+		}
+	}()
+
+	if kv.memory != nil {
+		return kv.memory.incrementMany(items, expiresAt)
+	}
+
+	current := "CAST(kv.value AS BIGINT)"
+	if usesSQLite() {
+		current = "CASE WHEN CAST(CAST(kv.value AS BIGINT) AS TEXT) = kv.value THEN CAST(kv.value AS BIGINT) END"
+	}
+
+	subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
+	defer cancel()
+
+	tx, err := GetDb().BeginTx(subctx, nil)
+	if err != nil {
+		return fmt.Errorf("kv increment many: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := kvNow()
+	for start := 0; start < len(items); start += kvSetManyBatch {
+		batch := items[start:min(start+kvSetManyBatch, len(items))]
+
+		qb := sb.Insert("kv").Columns("key", "value", "expires_at")
+		for _, item := range batch {
+			qb = qb.Values(item.Key, fmt.Sprint(item.Delta), expiresAt)
+		}
+
+		_, err := qb.Suffix(`ON CONFLICT(key) DO UPDATE SET
+			value = CAST(CASE WHEN kv.expires_at IS NOT NULL AND kv.expires_at <= ? THEN 0 ELSE `+current+` END + CAST(EXCLUDED.value AS BIGINT) AS TEXT),
+			expires_at = CASE WHEN kv.expires_at IS NOT NULL AND kv.expires_at <= ? THEN EXCLUDED.expires_at ELSE kv.expires_at END`, now, now).
+			RunWith(tx).
+			ExecContext(subctx)
+		if err != nil {
+			return fmt.Errorf("kv increment many: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("kv increment many: %w", err)
+	}
+
+	return nil
+}
+
+// Delete removes key. Deleting a missing key is not an error.
+func (kv *KeyValueStore) Delete(ctx context.Context, key string) error {
+	defer kv.cache.Delete(key)
+
+	if kv.memory != nil {
+		kv.memory.delete(key)
+		return nil
+	}
+
+	subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
+	defer cancel()
+
+	_, err := sb.Delete("kv").
+		Where("key = ?", key).
 		RunWith(GetDb()).
 		ExecContext(subctx)
 
 	return err
 }
 
-// Namespaced kv. Currently unused by anything in the codebase but exposed
-// for future callers; kept ctx-aware for the same reason as the underlying
+// List returns every live key starting with prefix, ordered by key.
+func (kv *KeyValueStore) List(ctx context.Context, prefix string) ([]KeyValue, error) {
+	if kv.memory != nil {
+		return kv.memory.list(prefix), nil
+	}
+
+	subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
+	defer cancel()
+
+	rows, err := sb.Select("key", "value").
+		From("kv").
+		Where("key LIKE ? ESCAPE '\\'", escapeLike(prefix)+"%").
+		Where(kvLive()).
+		OrderBy("key").
+		RunWith(GetDb()).
+		QueryContext(subctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("kv list %q: %w", prefix, err)
+	}
+
+	defer rows.Close()
+
+	items := make([]KeyValue, 0)
+	for rows.Next() {
+		var item KeyValue
+		if err := rows.Scan(&item.Key, &item.Value); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("kv list %q: %w", prefix, err)
+	}
+
+	return items, nil
+}
+
+// DeleteExpired removes every key whose TTL has passed. Reads already
+// ignore expired keys; this only reclaims the rows.
+func (kv *KeyValueStore) DeleteExpired(ctx context.Context) (int64, error) {
+	if kv.memory != nil {
+		return kv.memory.deleteExpired(), nil
+	}
+
+	subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
+	defer cancel()
+
+	result, err := sb.Delete("kv").
+		Where("expires_at IS NOT NULL AND expires_at <= ?", kvNow()).
+		RunWith(GetDb()).
+		ExecContext(subctx)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// StartKVSweeper launches a background goroutine that periodically deletes
+// expired kv keys until ctx is cancelled.
+func StartKVSweeper(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if n, err := GetKeyValueStore(ctx).DeleteExpired(ctx); err != nil {
+					log.Printf("kv sweep failed: %v", err)
+				} else if n > 0 {
+					log.Printf("kv sweep: deleted %d expired keys", n)
+				}
+			}
+		}
+	}()
+}
+
+// SetCacheTTL caches reads of keys in namespace (the part of the key before
+// the first ":", as produced by KV.Key) in process for up to ttl. Writes
+// through this store invalidate the cached value immediately; ttl bounds how
+// long a write from another instance sharing the database can go unseen, so
+// keep it short. Only cache rarely-written, frequently-read keys such as
+// policy toggles — never counters. A ttl of 0 disables caching.
+func (kv *KeyValueStore) SetCacheTTL(namespace string, ttl time.Duration) {
+	if ttl <= 0 {
+		kv.cacheTTLs.Delete(namespace)
+	} else {
+		kv.cacheTTLs.Store(namespace, ttl)
+	}
+
+	kv.cache.Range(func(key, _ any) bool {
+		if kvNamespace(key.(string)) == namespace {
+			kv.cache.Delete(key)
+		}
+		return true
+	})
+}
+
+// forget drops cached values of keys under prefix, for rows changed without
+// going through the store.
+func (kv *KeyValueStore) forget(prefix string) {
+	kv.cache.Range(func(key, _ any) bool {
+		if strings.HasPrefix(key.(string), prefix) {
+			kv.cache.Delete(key)
+		}
+		return true
+	})
+}
+
+func (kv *KeyValueStore) cacheTTL(key string) time.Duration {
+	if v, ok := kv.cacheTTLs.Load(kvNamespace(key)); ok {
+		return v.(time.Duration)
+	}
+
+	return 0
+}
+
+func kvNamespace(key string) string {
+	namespace, _, _ := strings.Cut(key, ":")
+	return namespace
+}
+
+// GetJSON decodes the JSON value stored under key into v.
+func (kv *KeyValueStore) GetJSON(ctx context.Context, key string, v any) error {
+	value, err := kv.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return fmt.Errorf("kv decode %q: %w", key, err)
+	}
+
+	return nil
+}
+
+// SetJSON stores v under key as JSON.
+func (kv *KeyValueStore) SetJSON(ctx context.Context, key string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("kv encode %q: %w", key, err)
+	}
+
+	return kv.Set(ctx, key, string(value))
+}
+
+// kvLive matches rows that haven't expired. A key is expired from the
+// second its expires_at is reached.
+func kvLive() squirrel.Sqlizer {
+	return squirrel.Expr("(expires_at IS NULL OR expires_at > ?)", kvNow())
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Namespaced kv, kept ctx-aware for the same reason as the underlying
 // KeyValueStore.
 
 type KV struct {
@@ -128,3 +628,72 @@ func (kv *KV) Get(ctx context.Context, key string) (string, error) {
 func (kv *KV) Set(ctx context.Context, key string, value string) error {
 	return GetKeyValueStore(ctx).Set(ctx, kv.Key(key), value)
 }
+
+func (kv *KV) GetJSON(ctx context.Context, key string, v any) error {
+	return GetKeyValueStore(ctx).GetJSON(ctx, kv.Key(key), v)
+}
+
+func (kv *KV) SetJSON(ctx context.Context, key string, v any) error {
+	return GetKeyValueStore(ctx).SetJSON(ctx, kv.Key(key), v)
+}
+
+// SetCacheTTL enables in-process caching of reads in this namespace, see
+// KeyValueStore.SetCacheTTL.
+func (kv *KV) SetCacheTTL(ctx context.Context, ttl time.Duration) {
+	GetKeyValueStore(ctx).SetCacheTTL(kv.Name, ttl)
+}
+
+func (kv *KV) SetWithTTL(ctx context.Context, key string, value string, ttl time.Duration) error {
+	return GetKeyValueStore(ctx).SetWithTTL(ctx, kv.Key(key), value, ttl)
+}
+
+// SetMany stores items, whose keys are given without the namespace.
+func (kv *KV) SetMany(ctx context.Context, items []KeyValue) error {
+	namespaced := make([]KeyValue, len(items))
+	for i, item := range items {
+		namespaced[i] = KeyValue{Key: kv.Key(item.Key), Value: item.Value}
+	}
+
+	return GetKeyValueStore(ctx).SetMany(ctx, namespaced)
+}
+
+func (kv *KV) CompareAndSwap(ctx context.Context, key string, old string, new string) (bool, error) {
+	return GetKeyValueStore(ctx).CompareAndSwap(ctx, kv.Key(key), old, new)
+}
+
+func (kv *KV) SetIfAbsent(ctx context.Context, key string, value string) (bool, error) {
+	return GetKeyValueStore(ctx).SetIfAbsent(ctx, kv.Key(key), value)
+}
+
+func (kv *KV) Increment(ctx context.Context, key string, delta int64) (int64, error) {
+	return GetKeyValueStore(ctx).Increment(ctx, kv.Key(key), delta)
+}
+
+// IncrementMany adds items, whose keys are given without the namespace.
+func (kv *KV) IncrementMany(ctx context.Context, items []KeyDelta, ttl time.Duration) error {
+	namespaced := make([]KeyDelta, len(items))
+	for i, item := range items {
+		namespaced[i] = KeyDelta{Key: kv.Key(item.Key), Delta: item.Delta}
+	}
+
+	return GetKeyValueStore(ctx).IncrementMany(ctx, namespaced, ttl)
+}
+
+func (kv *KV) Delete(ctx context.Context, key string) error {
+	return GetKeyValueStore(ctx).Delete(ctx, kv.Key(key))
+}
+
+// List returns the namespace's live keys starting with prefix. Keys are
+// returned without the namespace.
+func (kv *KV) List(ctx context.Context, prefix string) ([]KeyValue, error) {
+	items, err := GetKeyValueStore(ctx).List(ctx, kv.Key(prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range items {
+		items[i].Key = strings.TrimPrefix(items[i].Key, kv.Key(""))
+	}
+
+	return items, nil
+}
@@ -0,0 +1,420 @@
+package zooid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setKVNow pins the kv clock for the duration of the test.
+func setKVNow(t *testing.T, now int64) {
+	t.Helper()
+
+	prev := kvNow
+	kvNow = func() int64 { return now }
+	t.Cleanup(func() { kvNow = prev })
+}
+
+func TestKeyValueStore_Delete(t *testing.T) {
+	ctx := context.Background()
+	store := GetKeyValueStore(ctx)
+	key := "test:" + RandomString(8)
+
+	if err := store.Set(ctx, key, "value"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Get(ctx, key); !errors.Is(err, ErrKVNotFound) {
+		t.Errorf("Get after Delete = %v, want ErrKVNotFound", err)
+	}
+	if err := store.Delete(ctx, key); err != nil {
+		t.Errorf("Delete of missing key: %v", err)
+	}
+}
+
+func TestKeyValueStore_TTLBoundary(t *testing.T) {
+	ctx := context.Background()
+	store := GetKeyValueStore(ctx)
+	key := "test:" + RandomString(8)
+
+	setKVNow(t, 1_000_000)
+	if err := store.SetWithTTL(ctx, key, "value", 10*time.Second); err != nil {
+		t.Fatalf("SetWithTTL: %v", err)
+	}
+
+	setKVNow(t, 1_000_009)
+	if value, err := store.Get(ctx, key); err != nil || value != "value" {
+		t.Errorf("Get one second before expiry = (%q, %v), want value", value, err)
+	}
+
+	setKVNow(t, 1_000_010)
+	if _, err := store.Get(ctx, key); !errors.Is(err, ErrKVNotFound) {
+		t.Errorf("Get at expiry = %v, want ErrKVNotFound", err)
+	}
+	if items, err := store.List(ctx, key); err != nil || len(items) != 0 {
+		t.Errorf("List at expiry = (%v, %v), want no items", items, err)
+	}
+
+	if _, err := store.DeleteExpired(ctx); err != nil {
+		t.Fatalf("DeleteExpired: %v", err)
+	}
+
+	// The row is gone, so rewinding the clock doesn't bring it back
+	setKVNow(t, 1_000_000)
+	if _, err := store.Get(ctx, key); !errors.Is(err, ErrKVNotFound) {
+		t.Errorf("Get after sweep = %v, want ErrKVNotFound", err)
+	}
+}
+
+func TestKeyValueStore_SetClearsTTL(t *testing.T) {
+	ctx := context.Background()
+	store := GetKeyValueStore(ctx)
+	key := "test:" + RandomString(8)
+
+	setKVNow(t, 1_000_000)
+	store.SetWithTTL(ctx, key, "temporary", time.Second)
+	store.Set(ctx, key, "permanent")
+
+	setKVNow(t, 2_000_000)
+	if value, err := store.Get(ctx, key); err != nil || value != "permanent" {
+		t.Errorf("Get = (%q, %v), want permanent", value, err)
+	}
+}
+
+func TestKeyValueStore_ListEscapesWildcards(t *testing.T) {
+	ctx := context.Background()
+	store := GetKeyValueStore(ctx)
+	base := "test:" + RandomString(8)
+
+	store.Set(ctx, base+":a_b", "1")
+	store.Set(ctx, base+":axb", "2")
+
+	items, err := store.List(ctx, base+":a_")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(items) != 1 || items[0].Key != base+":a_b" {
+		t.Errorf("List = %v, want only %s:a_b", items, base)
+	}
+}
+
+func TestKV_PrefixIsolation(t *testing.T) {
+	ctx := context.Background()
+	suffix := RandomString(8)
+	a := &KV{Name: "a" + suffix}
+	ab := &KV{Name: "ab" + suffix}
+
+	a.Set(ctx, "cursor:1", "x")
+	a.Set(ctx, "cursor:2", "y")
+	a.Set(ctx, "other", "z")
+	ab.Set(ctx, "cursor:3", "w")
+
+	items, err := a.List(ctx, "cursor:")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+
+	want := []KeyValue{{Key: "cursor:1", Value: "x"}, {Key: "cursor:2", Value: "y"}}
+	if len(items) != len(want) {
+		t.Fatalf("List = %v, want %v", items, want)
+	}
+	for i := range want {
+		if items[i] != want[i] {
+			t.Errorf("List[%d] = %v, want %v", i, items[i], want[i])
+		}
+	}
+
+	all, err := ab.List(ctx, "")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(all) != 1 || all[0].Key != "cursor:3" {
+		t.Errorf("namespace ab List = %v, want only cursor:3", all)
+	}
+
+	if err := a.Delete(ctx, "other"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := a.Get(ctx, "other"); !errors.Is(err, ErrKVNotFound) {
+		t.Errorf("Get after Delete = %v, want ErrKVNotFound", err)
+	}
+}
+
+func TestKeyValueStore_CompareAndSwap(t *testing.T) {
+	ctx := context.Background()
+	store := GetKeyValueStore(ctx)
+	key := "test:" + RandomString(8)
+
+	if swapped, err := store.CompareAndSwap(ctx, key, "", "a"); err != nil || swapped {
+		t.Errorf("CompareAndSwap on missing key = (%v, %v), want (false, nil)", swapped, err)
+	}
+
+	store.Set(ctx, key, "a")
+
+	if swapped, err := store.CompareAndSwap(ctx, key, "b", "c"); err != nil || swapped {
+		t.Errorf("CompareAndSwap with stale old = (%v, %v), want (false, nil)", swapped, err)
+	}
+	if swapped, err := store.CompareAndSwap(ctx, key, "a", "b"); err != nil || !swapped {
+		t.Errorf("CompareAndSwap with current old = (%v, %v), want (true, nil)", swapped, err)
+	}
+	if value, _ := store.Get(ctx, key); value != "b" {
+		t.Errorf("Get after swap = %q, want b", value)
+	}
+}
+
+func TestKeyValueStore_CompareAndSwap_SingleWinner(t *testing.T) {
+	ctx := context.Background()
+	store := GetKeyValueStore(ctx)
+	key := "test:" + RandomString(8)
+	store.Set(ctx, key, "unclaimed")
+
+	var wg sync.WaitGroup
+	var winners atomic.Int64
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if swapped, err := store.CompareAndSwap(ctx, key, "unclaimed", "claimed"); err == nil && swapped {
+				winners.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if winners.Load() != 1 {
+		t.Errorf("%d goroutines won the swap, want exactly 1", winners.Load())
+	}
+}
+
+func TestKeyValueStore_SetIfAbsent(t *testing.T) {
+	ctx := context.Background()
+	store := GetKeyValueStore(ctx)
+	key := "test:" + RandomString(8)
+
+	var wg sync.WaitGroup
+	var winners atomic.Int64
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if set, err := store.SetIfAbsent(ctx, key, fmt.Sprint(i)); err == nil && set {
+				winners.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := winners.Load(); n != 1 {
+		t.Errorf("%d callers set the key, want exactly 1", n)
+	}
+
+	expired := "test:" + RandomString(8)
+	store.SetWithTTL(ctx, expired, "old", -time.Second)
+	if set, err := store.SetIfAbsent(ctx, expired, "new"); err != nil || !set {
+		t.Errorf("SetIfAbsent on an expired key = (%v, %v), want (true, nil)", set, err)
+	}
+	if value, err := store.Get(ctx, expired); err != nil || value != "new" {
+		t.Errorf("Get after SetIfAbsent = (%q, %v), want new", value, err)
+	}
+}
+
+func TestKeyValueStore_Increment(t *testing.T) {
+	ctx := context.Background()
+	store := GetKeyValueStore(ctx)
+	key := "test:" + RandomString(8)
+
+	if n, err := store.Increment(ctx, key, 5); err != nil || n != 5 {
+		t.Errorf("Increment on missing key = (%d, %v), want 5", n, err)
+	}
+	if n, err := store.Increment(ctx, key, -2); err != nil || n != 3 {
+		t.Errorf("Increment by -2 = (%d, %v), want 3", n, err)
+	}
+
+	store.Set(ctx, key, "not a number")
+	if _, err := store.Increment(ctx, key, 1); err == nil {
+		t.Error("Increment of a non-integer value should fail")
+	}
+}
+
+func TestKeyValueStore_Increment_Expired(t *testing.T) {
+	ctx := context.Background()
+	store := GetKeyValueStore(ctx)
+	key := "test:" + RandomString(8)
+
+	setKVNow(t, 1_000_000)
+	store.SetWithTTL(ctx, key, "41", time.Second)
+
+	setKVNow(t, 1_000_001)
+	if n, err := store.Increment(ctx, key, 1); err != nil || n != 1 {
+		t.Errorf("Increment of expired key = (%d, %v), want 1", n, err)
+	}
+
+	setKVNow(t, 2_000_000)
+	if value, err := store.Get(ctx, key); err != nil || value != "1" {
+		t.Errorf("Get after increment = (%q, %v), want 1 with no TTL", value, err)
+	}
+}
+
+func TestKeyValueStore_IncrementMany(t *testing.T) {
+	ctx := context.Background()
+	store := GetKeyValueStore(ctx)
+	existing, fresh, expired := "test:"+RandomString(8), "test:"+RandomString(8), "test:"+RandomString(8)
+
+	setKVNow(t, 1_000_000)
+	store.Set(ctx, existing, "40")
+	store.SetWithTTL(ctx, expired, "41", time.Second)
+
+	setKVNow(t, 1_000_001)
+	items := []KeyDelta{{Key: existing, Delta: 2}, {Key: fresh, Delta: 5}, {Key: expired, Delta: 1}}
+	if err := store.IncrementMany(ctx, items, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]string{existing: "42", fresh: "5", expired: "1"} {
+		if value, err := store.Get(ctx, key); err != nil || value != want {
+			t.Errorf("Get(%s) = (%q, %v), want %s", key, value, err, want)
+		}
+	}
+
+	// New keys get the TTL, existing ones keep theirs
+	setKVNow(t, 1_000_001+3600)
+	if _, err := store.Get(ctx, fresh); !errors.Is(err, ErrKVNotFound) {
+		t.Errorf("a created key outlived its TTL: %v", err)
+	}
+	if value, err := store.Get(ctx, existing); err != nil || value != "42" {
+		t.Errorf("an existing key without a TTL expired: (%q, %v)", value, err)
+	}
+}
+
+func TestKeyValueStore_IncrementMany_AllOrNothing(t *testing.T) {
+	ctx := context.Background()
+	store := GetKeyValueStore(ctx)
+	prefix := "test:" + RandomString(8) + ":"
+
+	// The bad key comes after a full batch, so the first statement has
+	// already run when the second fails
+	items := make([]KeyDelta, 0, kvSetManyBatch+1)
+	for i := range kvSetManyBatch {
+		items = append(items, KeyDelta{Key: fmt.Sprintf("%s%d", prefix, i), Delta: 1})
+	}
+	store.Set(ctx, prefix+"bad", "not a number")
+	items = append(items, KeyDelta{Key: prefix + "bad", Delta: 1})
+
+	if err := store.IncrementMany(ctx, items, 0); err == nil {
+		t.Fatal("incrementing a value that isn't a number succeeded")
+	}
+
+	if value, err := store.Get(ctx, prefix+"0"); !errors.Is(err, ErrKVNotFound) {
+		t.Errorf("a failed IncrementMany still created a key: (%q, %v)", value, err)
+	}
+}
+
+func TestKV_Increment_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	counter := &KV{Name: "counter" + RandomString(8)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := counter.Increment(ctx, "hits", 1); err != nil {
+				t.Errorf("Increment: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, err := counter.Get(ctx, "hits"); err != nil || value != "50" {
+		t.Errorf("counter = (%q, %v), want 50", value, err)
+	}
+}
+
+func TestKV_JSONRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	store := &KV{Name: "json" + RandomString(8)}
+
+	type cursor struct {
+		Since  int64    `json:"since"`
+		Relays []string `json:"relays"`
+	}
+
+	in := cursor{Since: 1700000000, Relays: []string{"wss://a.example", "wss://b.example"}}
+	if err := store.SetJSON(ctx, "cursor", in); err != nil {
+		t.Fatalf("SetJSON: %v", err)
+	}
+
+	var out cursor
+	if err := store.GetJSON(ctx, "cursor", &out); err != nil {
+		t.Fatalf("GetJSON: %v", err)
+	}
+	if out.Since != in.Since || len(out.Relays) != 2 || out.Relays[1] != in.Relays[1] {
+		t.Errorf("GetJSON = %+v, want %+v", out, in)
+	}
+
+	if err := store.GetJSON(ctx, "missing", &out); !errors.Is(err, ErrKVNotFound) {
+		t.Errorf("GetJSON of missing key = %v, want ErrKVNotFound", err)
+	}
+
+	store.Set(ctx, "broken", "{")
+	if err := store.GetJSON(ctx, "broken", &out); err == nil {
+		t.Error("GetJSON of invalid JSON should fail")
+	}
+}
+
+func TestKV_Cache(t *testing.T) {
+	skipOnMemory(t, "kv table")
+	ctx := context.Background()
+	cached := &KV{Name: "cached" + RandomString(8)}
+	cached.SetCacheTTL(ctx, time.Minute)
+	t.Cleanup(func() { cached.SetCacheTTL(ctx, 0) })
+
+	cached.Set(ctx, "toggle", "on")
+	if value, _ := cached.Get(ctx, "toggle"); value != "on" {
+		t.Fatalf("Get = %q, want on", value)
+	}
+
+	// A write that bypasses this process (another instance) is hidden by the cache
+	if _, err := GetDb().Exec("UPDATE kv SET value = 'off' WHERE key = $1", cached.Key("toggle")); err != nil {
+		t.Fatalf("direct update: %v", err)
+	}
+	if value, _ := cached.Get(ctx, "toggle"); value != "on" {
+		t.Errorf("Get = %q, want cached value on", value)
+	}
+
+	// Local writes invalidate immediately
+	cached.Set(ctx, "toggle", "paused")
+	if value, _ := cached.Get(ctx, "toggle"); value != "paused" {
+		t.Errorf("Get after Set = %q, want paused", value)
+	}
+
+	cached.Delete(ctx, "toggle")
+	if _, err := cached.Get(ctx, "toggle"); !errors.Is(err, ErrKVNotFound) {
+		t.Errorf("Get after Delete = %v, want ErrKVNotFound", err)
+	}
+}
+
+func TestKV_CacheIsPerNamespace(t *testing.T) {
+	skipOnMemory(t, "kv table")
+	ctx := context.Background()
+	cached := &KV{Name: "cached" + RandomString(8)}
+	counters := &KV{Name: "counters" + RandomString(8)}
+	cached.SetCacheTTL(ctx, time.Minute)
+	t.Cleanup(func() { cached.SetCacheTTL(ctx, 0) })
+
+	counters.Set(ctx, "hits", "1")
+	counters.Get(ctx, "hits")
+
+	if _, err := GetDb().Exec("UPDATE kv SET value = '2' WHERE key = $1", counters.Key("hits")); err != nil {
+		t.Fatalf("direct update: %v", err)
+	}
+	if value, _ := counters.Get(ctx, "hits"); value != "2" {
+		t.Errorf("uncached namespace Get = %q, want 2", value)
+	}
+}
@@ -0,0 +1,224 @@
+package zooid
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Leader election.
+//
+// Background jobs that change a schema's data, like retention, the member
+// sweep and dead letter retries, would do the work twice, and race each
+// other, if every replica serving the schema ran them. So before running one
+// for an instance, a process checks it leads the schema: it holds a
+// PostgreSQL advisory lock keyed by the schema's name, taken with
+// pg_try_advisory_lock on a connection of its own. Whoever gets it first
+// keeps it for as long as that connection lives; when the process stops, or
+// the connection drops, the lock is released and another replica takes it on
+// its next check, which happens every leaderCheckInterval and before each
+// job. With SQLite or in memory there is only one process, so it leads
+// everything. Serving events doesn't depend on leading.
+
+const leaderCheckInterval = 10 * time.Second
+
+var (
+	leaderGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zooid_leader",
+		Help: "Whether this process runs the schema's background jobs (1) or another replica does (0)",
+	}, []string{"instance"})
+
+	leaderChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zooid_leader_changes_total",
+		Help: "Times this process took over or lost a schema's background jobs",
+	}, []string{"instance", "change"})
+)
+
+func init() {
+	prometheus.MustRegister(leaderGauge, leaderChanges)
+}
+
+// elector takes and keeps the advisory locks of the schemas a process leads.
+// They are all held by one connection, so serving many relays doesn't take
+// a connection each.
+type elector struct {
+	mu   sync.Mutex
+	conn *pgx.Conn
+	held map[string]struct{}
+}
+
+// processElector is the elector of this process.
+var processElector = &elector{}
+
+// leads reports whether this process leads schema, trying to take the lock
+// if it doesn't yet.
+func (e *elector) leads(ctx context.Context, schema string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Locks die with the connection, so a broken one leads nothing
+	if e.conn != nil {
+		if err := e.conn.Ping(ctx); err != nil {
+			log.Printf("Leader election connection lost: %v", err)
+			e.drop(ctx)
+		}
+	}
+
+	if _, ok := e.held[schema]; ok {
+		return true
+	}
+
+	if e.conn == nil {
+		conn, err := pgx.Connect(ctx, Env("DATABASE_URL"))
+		if err != nil {
+			log.Printf("Failed to connect for leader election: %v", err)
+			return false
+		}
+		e.conn = conn
+	}
+
+	var locked bool
+	if err := e.conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", schemaLockKey(schema, "leader")).Scan(&locked); err != nil {
+		log.Printf("Failed to take the leader lock of %s: %v", schema, err)
+		return false
+	}
+
+	if locked {
+		if e.held == nil {
+			e.held = make(map[string]struct{})
+		}
+		e.held[schema] = struct{}{}
+		leaderChanged(schema, true)
+	} else {
+		leaderGauge.With(prometheus.Labels{"instance": schema}).Set(0)
+	}
+
+	return locked
+}
+
+// release gives up leading schema, so another replica can take it on.
+func (e *elector) release(ctx context.Context, schema string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.held[schema]; !ok {
+		return
+	}
+
+	if _, err := e.conn.Exec(ctx, "SELECT pg_advisory_unlock($1)", schemaLockKey(schema, "leader")); err != nil {
+		log.Printf("Failed to release the leader lock of %s: %v", schema, err)
+		e.drop(ctx)
+		return
+	}
+
+	delete(e.held, schema)
+	leaderChanged(schema, false)
+	leaderGauge.DeleteLabelValues(schema)
+}
+
+// close gives up leading every schema.
+func (e *elector) close(ctx context.Context) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.drop(ctx)
+}
+
+// drop closes the connection, and with it every lock. The caller holds mu.
+func (e *elector) drop(ctx context.Context) {
+	if e.conn == nil {
+		return
+	}
+
+	e.conn.Close(context.WithoutCancel(ctx))
+	e.conn = nil
+
+	for schema := range e.held {
+		leaderChanged(schema, false)
+	}
+	clear(e.held)
+}
+
+// retain gives up leading the schemas not in schemas, once their relays
+// are no longer served.
+func (e *elector) retain(ctx context.Context, schemas map[string]struct{}) {
+	e.mu.Lock()
+	var gone []string
+	for schema := range e.held {
+		if _, ok := schemas[schema]; !ok {
+			gone = append(gone, schema)
+		}
+	}
+	e.mu.Unlock()
+
+	for _, schema := range gone {
+		e.release(ctx, schema)
+	}
+}
+
+func leaderChanged(schema string, leading bool) {
+	if leading {
+		log.Printf("Leading the background jobs of %s", schema)
+		leaderGauge.With(prometheus.Labels{"instance": schema}).Set(1)
+		leaderChanges.With(prometheus.Labels{"instance": schema, "change": "acquired"}).Inc()
+	} else {
+		log.Printf("No longer leading the background jobs of %s", schema)
+		leaderGauge.With(prometheus.Labels{"instance": schema}).Set(0)
+		leaderChanges.With(prometheus.Labels{"instance": schema, "change": "lost"}).Inc()
+	}
+}
+
+// leadsJobs reports whether this process should run the instance's
+// singleton background jobs.
+func (instance *Instance) leadsJobs(ctx context.Context) bool {
+	if usesMemory() || usesSQLite() {
+		return true
+	}
+
+	return processElector.leads(ctx, instance.Events.Schema.Name)
+}
+
+// leadingInstances returns the writable instances whose singleton
+// background jobs this process runs.
+func leadingInstances(ctx context.Context) []*Instance {
+	var instances []*Instance
+	for _, inst := range GetAllInstances() {
+		if !inst.Config.IsReadOnly() && inst.leadsJobs(ctx) {
+			instances = append(instances, inst)
+		}
+	}
+
+	return instances
+}
+
+// StartLeaderElection keeps checking which schemas this process leads, so a
+// replica takes over soon after the leader goes away, and gives them all up
+// when ctx is canceled.
+func StartLeaderElection(ctx context.Context) {
+	if usesMemory() || usesSQLite() {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(leaderCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				processElector.close(ctx)
+				return
+			case <-ticker.C:
+				schemas := make(map[string]struct{})
+				for _, inst := range leadingInstances(ctx) {
+					schemas[inst.Events.Schema.Name] = struct{}{}
+				}
+				processElector.retain(ctx, schemas)
+			}
+		}
+	}()
+}
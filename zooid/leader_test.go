@@ -0,0 +1,57 @@
+package zooid
+
+import (
+	"context"
+	"testing"
+)
+
+func TestElector_OneLeaderPerSchema(t *testing.T) {
+	skipOnSQLite(t, "advisory locks")
+	skipOnMemory(t, "advisory locks")
+
+	ctx := context.Background()
+	schema := "leader_" + RandomString(8)
+
+	// Two processes, each with a connection of its own
+	first, second := &elector{}, &elector{}
+	t.Cleanup(func() {
+		first.close(ctx)
+		second.close(ctx)
+	})
+
+	tick := func() (ran []*elector) {
+		for _, e := range []*elector{first, second} {
+			if e.leads(ctx, schema) {
+				ran = append(ran, e)
+			}
+		}
+		return ran
+	}
+
+	for i := range 3 {
+		if ran := tick(); len(ran) != 1 || ran[0] != first {
+			t.Fatalf("tick %d: the job ran %d times, want once by the first process", i, len(ran))
+		}
+	}
+
+	// Other schemas are led separately
+	if !second.leads(ctx, schema+"_other") {
+		t.Error("the second process couldn't lead another schema")
+	}
+
+	// The leader goes away, and the other process takes over
+	first.close(ctx)
+	if !second.leads(ctx, schema) {
+		t.Fatal("the second process didn't take over")
+	}
+	for i := range 3 {
+		if ran := tick(); len(ran) != 1 || ran[0] != second {
+			t.Fatalf("tick %d after failover: the job ran %d times, want once by the second process", i, len(ran))
+		}
+	}
+
+	second.release(ctx, schema)
+	if ran := tick(); len(ran) != 1 || ran[0] != first {
+		t.Error("the first process didn't take the released schema back")
+	}
+}
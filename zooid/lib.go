@@ -2,21 +2,194 @@ package zooid
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
+	"fiatjaf.com/nostr"
 	"github.com/fsnotify/fsnotify"
 )
 
 var (
 	instancesByHost map[string]*Instance
 	instancesByName map[string]*Instance
+	instancesInfo   map[string]*InstanceInfo // by config filename, loaded or not
 	instancesOnce   sync.Once
 	instancesMux    sync.RWMutex
+
+	// instanceRetries holds the configs that failed to load, by filename,
+	// until they load or are removed.
+	instanceRetries  map[string]*instanceRetry
+	instanceRetryDue = make(chan struct{}, 1)
+
+	// Failed configs are retried after instanceRetryMin, doubling with every
+	// failure up to instanceRetryMax.
+	instanceRetryMin = 5 * time.Second
+	instanceRetryMax = 5 * time.Minute
+
+	// makeInstance is MakeInstance, swapped out by tests.
+	makeInstance = MakeInstance
 )
 
+type instanceRetry struct {
+	attempts int
+	next     time.Time
+	loading  bool // a retry is in MakeInstance, outside instancesMux
+	stale    bool // the file changed while loading, so the result is dropped
+
+	// cancel stops the load in progress, cache warming included
+	cancel context.CancelFunc
+}
+
+// InstanceInfo describes a config file in the registry: the instance loaded
+// from it, or why none could be. A config that fails to load stays listed
+// with its error until it loads or is removed.
+type InstanceInfo struct {
+	Host       string          `json:"host,omitempty"`
+	Config     string          `json:"config"`
+	Schema     string          `json:"schema,omitempty"`
+	LoadedAt   nostr.Timestamp `json:"loaded_at,omitempty"`   // first load attempt
+	ReloadedAt nostr.Timestamp `json:"reloaded_at,omitempty"` // last reload attempt, 0 if never reloaded
+	Healthy    bool            `json:"healthy"`
+	Error      string          `json:"error,omitempty"`
+	RetryAt    nostr.Timestamp `json:"retry_at,omitempty"` // next automatic retry if it failed
+	State      string          `json:"state,omitempty"`    // of the loaded instance, see state.go
+}
+
+// ListInstances returns the registry, ordered by config filename.
+func ListInstances() []InstanceInfo {
+	instancesMux.RLock()
+	defer instancesMux.RUnlock()
+
+	infos := make([]InstanceInfo, 0, len(instancesInfo))
+	for filename, info := range instancesInfo {
+		info := *info
+		if retry, ok := instanceRetries[filename]; ok {
+			info.RetryAt = nostr.Timestamp(retry.next.Unix())
+		}
+		if instance, ok := instancesByName[filename]; ok {
+			info.State = instance.State().String()
+		}
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b InstanceInfo) int { return strings.Compare(a.Config, b.Config) })
+
+	return infos
+}
+
+// ServeInstances writes ListInstances as JSON, for the ops listener.
+func ServeInstances(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ListInstances())
+}
+
+// ServeRetryInstances retries every failed config now, for the ops listener.
+func ServeRetryInstances(w http.ResponseWriter, r *http.Request) {
+	RetryFailedInstances()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// initInstances creates the registry's maps. The caller holds instancesMux.
+func initInstances() {
+	instancesOnce.Do(func() {
+		instancesByHost = make(map[string]*Instance)
+		instancesByName = make(map[string]*Instance)
+		instancesInfo = make(map[string]*InstanceInfo)
+		instanceRetries = make(map[string]*instanceRetry)
+	})
+}
+
+// recordLoad registers the result of loading filename, keeping the host and
+// schema of its last good load if this one failed, and schedules a failed
+// config for a retry. The caller holds instancesMux.
+func recordLoad(filename string, instance *Instance, err error) {
+	info, reloaded := instancesInfo[filename]
+	if !reloaded {
+		info = &InstanceInfo{Config: filename, LoadedAt: nostr.Now()}
+		instancesInfo[filename] = info
+	} else {
+		info.ReloadedAt = nostr.Now()
+	}
+
+	info.Healthy = err == nil
+	info.Error = ""
+	if err != nil {
+		info.Error = err.Error()
+
+		retry, ok := instanceRetries[filename]
+		if !ok {
+			retry = &instanceRetry{}
+			instanceRetries[filename] = retry
+		}
+		delay := instanceRetryMax
+		if retry.attempts < 16 {
+			delay = min(instanceRetryMin<<retry.attempts, instanceRetryMax)
+		}
+		retry.attempts++
+		retry.next = time.Now().Add(delay)
+		log.Printf("Retrying %s in %s", filename, delay)
+
+		return
+	}
+
+	delete(instanceRetries, filename)
+	info.Host = instance.Config.Host
+	info.Schema = instance.Events.Schema.Name
+	instancesByHost[instance.Config.Host] = instance
+	instancesByName[filename] = instance
+}
+
+// loadInstances loads an instance for each of filenames and registers them,
+// failures included.
+func loadInstances(ctx context.Context, filenames []string) {
+	// Build instances outside the lock so MakeInstance (DB init, cache warming)
+	// doesn't block Dispatch or metrics collection.
+	loaded := make([]*Instance, len(filenames))
+	errs := make([]error, len(filenames))
+	for i, filename := range filenames {
+		loaded[i], errs[i] = makeInstance(ctx, filename)
+
+		if errs[i] != nil {
+			logInstanceError("Failed to make instance for", filename, errs[i])
+		} else {
+			log.Printf("Loaded %s", filename)
+		}
+	}
+
+	instancesMux.Lock()
+	defer instancesMux.Unlock()
+
+	initInstances()
+	for i, filename := range filenames {
+		recordLoad(filename, loaded[i], errs[i])
+	}
+}
+
+// logInstanceError logs why an instance couldn't be loaded. Config
+// validation failures are logged one problem per line so operators can see
+// everything that needs fixing in the file at once.
+func logInstanceError(action string, filename string, err error) {
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		log.Printf("%s %s: %v", action, filename, err)
+		return
+	}
+
+	problems := configErr.Problems()
+	log.Printf("%s %s: config has %d problem(s), skipping", action, filename, len(problems))
+	for _, problem := range problems {
+		log.Printf("  %s: %v", filename, problem)
+	}
+}
+
 func Dispatch(hostname string) (*Instance, bool) {
 	instancesMux.RLock()
 	defer instancesMux.RUnlock()
@@ -47,38 +220,15 @@ func Start(ctx context.Context) {
 		log.Fatalf("Failed to scan config directory: %v", err)
 	}
 
-	// Build instances outside the lock so MakeInstance (DB init, cache warming)
-	// doesn't block Dispatch or metrics collection.
-	newByHost := make(map[string]*Instance)
-	newByName := make(map[string]*Instance)
+	var filenames []string
 	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-
-		instance, err := MakeInstance(ctx, entry.Name())
-
-		if err != nil {
-			log.Printf("Failed to make instance for %s: %v", entry.Name(), err)
-		} else {
-			newByHost[instance.Config.Host] = instance
-			newByName[entry.Name()] = instance
-			log.Printf("Loaded %s", entry.Name())
+		if !entry.IsDir() {
+			filenames = append(filenames, entry.Name())
 		}
 	}
 
-	instancesMux.Lock()
-	instancesOnce.Do(func() {
-		instancesByHost = make(map[string]*Instance)
-		instancesByName = make(map[string]*Instance)
-	})
-	for k, v := range newByHost {
-		instancesByHost[k] = v
-	}
-	for k, v := range newByName {
-		instancesByName[k] = v
-	}
-	instancesMux.Unlock()
+	loadInstances(ctx, filenames)
+	go retryFailedInstances(ctx)
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -111,32 +261,7 @@ func Start(ctx context.Context) {
 
 			if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Remove) {
 				instancesMux.Lock()
-
-				if instance, exists := instancesByName[filename]; exists {
-					instance.Cleanup()
-
-					delete(instancesByHost, instance.Config.Host)
-					delete(instancesByName, filename)
-				}
-
-				if event.Has(fsnotify.Remove) {
-					log.Printf("Unloaded %s", filename)
-				} else {
-					instance, err := MakeInstance(ctx, filename)
-					if err != nil {
-						log.Printf("Failed to reload %s: %v", filename, err)
-					} else {
-						instancesByHost[instance.Config.Host] = instance
-						instancesByName[filename] = instance
-
-						if event.Has(fsnotify.Write) {
-							log.Printf("Reloaded %v", filename)
-						} else {
-							log.Printf("Loaded %v", filename)
-						}
-					}
-				}
-
+				reloadInstance(ctx, filename, event.Has(fsnotify.Remove))
 				instancesMux.Unlock()
 			}
 
@@ -149,3 +274,155 @@ func Start(ctx context.Context) {
 		}
 	}
 }
+
+// reloadInstance replaces the instance of filename after the file changed, or
+// unloads it if it was removed. The caller holds instancesMux.
+func reloadInstance(ctx context.Context, filename string, removed bool) {
+	if retry, ok := instanceRetries[filename]; ok && retry.loading {
+		// A retry is loading the old contents without the lock; rather than
+		// load the file a second time, have it stop, drop that and start
+		// over.
+		retry.stale = true
+		retry.cancel()
+		if removed {
+			delete(instanceRetries, filename)
+			delete(instancesInfo, filename)
+			log.Printf("Unloaded %s", filename)
+		}
+		return
+	}
+
+	if instance, exists := instancesByName[filename]; exists {
+		if !removed && applyGroupOverrides(instance, filename) {
+			recordLoad(filename, instance, nil)
+			log.Printf("Applied group overrides from %v", filename)
+			return
+		}
+
+		instance.Cleanup()
+
+		delete(instancesByHost, instance.Config.Host)
+		delete(instancesByName, filename)
+	}
+
+	if removed {
+		delete(instanceRetries, filename)
+		delete(instancesInfo, filename)
+		log.Printf("Unloaded %s", filename)
+		return
+	}
+
+	_, reloaded := instancesInfo[filename]
+	instance, err := makeInstance(ctx, filename)
+	if err != nil {
+		logInstanceError("Failed to reload", filename, err)
+	} else if reloaded {
+		log.Printf("Reloaded %v", filename)
+	} else {
+		log.Printf("Loaded %v", filename)
+	}
+	recordLoad(filename, instance, err)
+}
+
+// applyGroupOverrides hands instance the new config of filename if all that
+// changed is [groups.overrides], which can take effect without reloading,
+// and reports whether it did. Saving the file unchanged still reloads, as
+// that's how operators drop a relay's caches.
+func applyGroupOverrides(instance *Instance, filename string) bool {
+	config, err := LoadConfig(filename)
+	if err != nil {
+		return false
+	}
+
+	current := instance.Groups.policyConfig()
+	if reflect.DeepEqual(current.Groups.Overrides, config.Groups.Overrides) || !sameExceptOverrides(current, config) {
+		return false
+	}
+
+	instance.Groups.ApplyConfig(config)
+	return true
+}
+
+// RetryFailedInstances makes every config that failed to load due for a
+// retry now, instead of when its backoff runs out.
+func RetryFailedInstances() {
+	instancesMux.Lock()
+	for _, retry := range instanceRetries {
+		retry.next = time.Time{}
+	}
+	instancesMux.Unlock()
+
+	select {
+	case instanceRetryDue <- struct{}{}:
+	default:
+	}
+}
+
+// retryFailedInstances retries failed configs as they come due, until ctx is
+// canceled.
+func retryFailedInstances(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-instanceRetryDue:
+		}
+
+		retryDueInstances(ctx)
+	}
+}
+
+// retryDueInstances loads every failed config whose retry is due. Like
+// loadInstances it builds instances outside the lock; the loading flag keeps
+// the watcher from loading the same file meanwhile.
+func retryDueInstances(ctx context.Context) {
+	type due struct {
+		filename string
+		retry    *instanceRetry
+		ctx      context.Context
+	}
+
+	instancesMux.Lock()
+	var retries []due
+	now := time.Now()
+	for filename, retry := range instanceRetries {
+		if !retry.loading && !now.Before(retry.next) {
+			// The instance keeps this context for its lifetime, so it's
+			// only canceled if the load goes stale
+			loadCtx, cancel := context.WithCancel(ctx)
+			retry.loading = true
+			retry.cancel = cancel
+			retries = append(retries, due{filename, retry, loadCtx})
+		}
+	}
+	instancesMux.Unlock()
+
+	for _, d := range retries {
+		instance, err := makeInstance(d.ctx, d.filename)
+
+		instancesMux.Lock()
+		d.retry.loading = false
+		if d.retry.stale || instanceRetries[d.filename] != d.retry {
+			// Changed or removed while loading: drop the result and, if the
+			// file is still there, load it again on the next tick.
+			if instance != nil {
+				instance.Cleanup()
+			}
+			d.retry.stale = false
+			d.retry.attempts = 0
+			d.retry.next = time.Time{}
+		} else {
+			if err != nil {
+				logInstanceError("Failed to retry", d.filename, err)
+			} else {
+				log.Printf("Loaded %s after %d attempts", d.filename, d.retry.attempts+1)
+			}
+			recordLoad(d.filename, instance, err)
+		}
+		instancesMux.Unlock()
+	}
+}
@@ -0,0 +1,281 @@
+package zooid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestListInstances(t *testing.T) {
+	good := writeTestConfig(t, `
+host = "registry.example.com"
+schema = "registry_`+RandomString(8)+`"
+secret = "`+nostr.Generate().Hex()+`"
+`)
+	broken := writeTestConfig(t, `host = "not a hostname"`)
+
+	cleanupRegistry(t, good)
+	cleanupRegistry(t, broken)
+
+	loadInstances(context.Background(), []string{good, broken})
+
+	infos := make(map[string]InstanceInfo)
+	for _, info := range ListInstances() {
+		infos[info.Config] = info
+	}
+
+	if info, ok := infos[good]; !ok {
+		t.Errorf("%s is not listed", good)
+	} else {
+		if !info.Healthy || info.Error != "" {
+			t.Errorf("%s: healthy = %v, error = %q, want a healthy instance", good, info.Healthy, info.Error)
+		}
+		if info.Host != "registry.example.com" || info.Schema == "" || info.LoadedAt == 0 {
+			t.Errorf("%s: got %+v, want its host, schema and load time", good, info)
+		}
+		if info.ReloadedAt != 0 {
+			t.Errorf("%s: reloaded at %d, want 0 before any reload", good, info.ReloadedAt)
+		}
+	}
+
+	if info, ok := infos[broken]; !ok {
+		t.Errorf("%s is not listed", broken)
+	} else if info.Healthy || info.Error == "" {
+		t.Errorf("%s: healthy = %v, error = %q, want the load error", broken, info.Healthy, info.Error)
+	}
+
+	if _, ok := Dispatch("registry.example.com"); !ok {
+		t.Error("the healthy instance isn't dispatched to")
+	}
+
+	// The ops endpoint serves the same list
+	rec := httptest.NewRecorder()
+	ServeInstances(rec, httptest.NewRequest("GET", "/instances", nil))
+
+	var served []InstanceInfo
+	if err := json.NewDecoder(rec.Body).Decode(&served); err != nil {
+		t.Fatalf("decoding /instances: %v", err)
+	}
+	if len(served) != len(infos) {
+		t.Errorf("/instances lists %d configs, want %d", len(served), len(infos))
+	}
+}
+
+// failingMakeInstance makes makeInstance fail for filename the first
+// failures times, like a database that isn't up yet, and counts the calls.
+func failingMakeInstance(t *testing.T, filename string, failures int) *int {
+	calls := 0
+	makeInstance = func(ctx context.Context, name string) (*Instance, error) {
+		if name == filename {
+			calls++
+			if calls <= failures {
+				return nil, errors.New("database is starting up")
+			}
+		}
+		return MakeInstance(ctx, name)
+	}
+	t.Cleanup(func() { makeInstance = MakeInstance })
+
+	return &calls
+}
+
+// cleanupRegistry unloads filename and forgets it when the test ends.
+func cleanupRegistry(t *testing.T, filename string) {
+	t.Cleanup(func() {
+		instancesMux.Lock()
+		defer instancesMux.Unlock()
+
+		reloadInstance(context.Background(), filename, true)
+	})
+}
+
+func TestRetryFailedInstances(t *testing.T) {
+	oldMin := instanceRetryMin
+	instanceRetryMin = 0
+	t.Cleanup(func() { instanceRetryMin = oldMin })
+
+	filename := writeTestConfig(t, `
+host = "retry.example.com"
+schema = "retry_`+RandomString(8)+`"
+secret = "`+nostr.Generate().Hex()+`"
+`)
+	calls := failingMakeInstance(t, filename, 2)
+	cleanupRegistry(t, filename)
+
+	loadInstances(context.Background(), []string{filename})
+	if _, ok := Dispatch("retry.example.com"); ok {
+		t.Fatal("the instance loaded although its database failed")
+	}
+
+	retryDueInstances(context.Background())
+	if _, ok := Dispatch("retry.example.com"); ok {
+		t.Fatal("the instance loaded on the second attempt, want the third")
+	}
+
+	retryDueInstances(context.Background())
+	if _, ok := Dispatch("retry.example.com"); !ok {
+		t.Fatal("the instance didn't load on the third attempt")
+	}
+	if *calls != 3 {
+		t.Errorf("loaded %d times, want 3", *calls)
+	}
+
+	for _, info := range ListInstances() {
+		if info.Config == filename && (!info.Healthy || info.RetryAt != 0) {
+			t.Errorf("got %+v, want a healthy instance with no retry pending", info)
+		}
+	}
+
+	// Nothing is left to retry
+	retryDueInstances(context.Background())
+	if *calls != 3 {
+		t.Errorf("loaded %d times after it came up, want 3", *calls)
+	}
+}
+
+func TestRetryFailedInstances_Backoff(t *testing.T) {
+	filename := writeTestConfig(t, `host = "not a hostname"`)
+	cleanupRegistry(t, filename)
+
+	loadInstances(context.Background(), []string{filename})
+
+	// Not due until the backoff runs out...
+	calls := failingMakeInstance(t, filename, 0)
+	retryDueInstances(context.Background())
+	if *calls != 0 {
+		t.Fatalf("retried %d times before the backoff ran out", *calls)
+	}
+
+	// ...unless triggered
+	RetryFailedInstances()
+	retryDueInstances(context.Background())
+	if *calls != 1 {
+		t.Fatalf("retried %d times after a manual trigger, want 1", *calls)
+	}
+
+	instancesMux.RLock()
+	attempts, delay := instanceRetries[filename].attempts, time.Until(instanceRetries[filename].next)
+	instancesMux.RUnlock()
+
+	if attempts != 2 || delay <= instanceRetryMin || delay > 2*instanceRetryMin {
+		t.Errorf("after %d attempts the next retry is in %s, want twice %s", attempts, delay, instanceRetryMin)
+	}
+}
+
+func TestRetryFailedInstances_ConcurrentReload(t *testing.T) {
+	oldMin := instanceRetryMin
+	instanceRetryMin = 0
+	t.Cleanup(func() { instanceRetryMin = oldMin })
+
+	filename := writeTestConfig(t, `
+host = "reload.example.com"
+schema = "reload_`+RandomString(8)+`"
+secret = "`+nostr.Generate().Hex()+`"
+`)
+	failingMakeInstance(t, filename, 1)
+	cleanupRegistry(t, filename)
+
+	loadInstances(context.Background(), []string{filename})
+
+	// Hold the retry inside makeInstance while the watcher sees a write
+	entered, release := make(chan struct{}), make(chan struct{})
+	makeInstance = func(ctx context.Context, name string) (*Instance, error) {
+		if name == filename {
+			close(entered)
+			<-release
+		}
+		return MakeInstance(ctx, name)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		retryDueInstances(context.Background())
+		close(done)
+	}()
+
+	<-entered
+	instancesMux.Lock()
+	reloadInstance(context.Background(), filename, false)
+	loaded := instancesByName[filename]
+	instancesMux.Unlock()
+
+	if loaded != nil {
+		t.Error("the watcher loaded the file while a retry was loading it")
+	}
+
+	close(release)
+	<-done
+
+	if _, ok := Dispatch("reload.example.com"); ok {
+		t.Error("the retry kept what it loaded although the file changed meanwhile")
+	}
+
+	// The next retry loads the new contents
+	makeInstance = MakeInstance
+	retryDueInstances(context.Background())
+	if _, ok := Dispatch("reload.example.com"); !ok {
+		t.Error("the file wasn't loaded after the interrupted retry")
+	}
+}
+
+func TestReloadInstance_GroupOverrides(t *testing.T) {
+	config := `
+host = "overrides.example.com"
+schema = "overrides_` + RandomString(8) + `"
+secret = "` + nostr.Generate().Hex() + `"
+
+[groups]
+enabled = true
+`
+	filename := writeTestConfig(t, config)
+	cleanupRegistry(t, filename)
+	loadInstances(context.Background(), []string{filename})
+
+	rewrite := func(body string) *Instance {
+		t.Helper()
+
+		if err := os.WriteFile(filepath.Join(Env("CONFIG"), filename), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		instancesMux.Lock()
+		defer instancesMux.Unlock()
+
+		reloadInstance(context.Background(), filename, false)
+		return instancesByName[filename]
+	}
+
+	instance, _ := Dispatch("overrides.example.com")
+
+	// Only the overrides changed, so they apply to the running instance
+	reloaded := rewrite(config + `
+[groups.overrides.general]
+rate_multiplier = 2.0
+`)
+	if reloaded != instance {
+		t.Fatal("changing only the group overrides replaced the instance")
+	}
+	if m := instance.Groups.GroupPolicy("general").RateMultiplier; m != 2 {
+		t.Errorf("rate_multiplier after the reload = %v, want 2", m)
+	}
+
+	// Anything else needs a new instance, as does saving it unchanged
+	if reloaded := rewrite(config + `
+auto_join = true
+`); reloaded == instance {
+		t.Error("changing groups.auto_join kept the old instance")
+	}
+	instance, _ = Dispatch("overrides.example.com")
+	if reloaded := rewrite(config + `
+auto_join = true
+`); reloaded == instance {
+		t.Error("saving the config unchanged kept the old instance")
+	}
+}
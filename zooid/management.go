@@ -2,7 +2,14 @@ package zooid
 
 import (
 	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"fiatjaf.com/nostr"
 	"fiatjaf.com/nostr/khatru"
@@ -26,35 +33,104 @@ type ManagementStore struct {
 	Config *Config
 	Events *EventStore
 
-	relayMembers  sync.Map // map[nostr.PubKey]struct{}
-	bannedPubkeys sync.Map // map[nostr.PubKey]string (reason)
-	bannedEvents  sync.Map // map[nostr.ID]string (reason)
-	cachesWarmed  bool
+	relayMembers        sync.Map // map[nostr.PubKey]struct{}
+	memberExpiry        sync.Map // map[nostr.PubKey]nostr.Timestamp, only for members with an expiry
+	bannedPubkeys       sync.Map // map[nostr.PubKey]string (reason)
+	shadowBannedPubkeys sync.Map // map[nostr.PubKey]string (reason)
+	bannedEvents        sync.Map // map[nostr.ID]string (reason)
+	cachesWarmed        bool
+
+	nip05Names atomic.Pointer[map[string]nostr.PubKey] // see nip05.go
+	nip05Mu    sync.Mutex
+
+	// PaymentVerifier checks the payments join requests carry, see
+	// payments.go. nil refuses them.
+	PaymentVerifier PaymentVerifier
+	paymentsMu      sync.Mutex
+
+	activity memberActivity // last-seen timestamps, see activity.go
+	usage    usageCounters  // per-pubkey usage, see usage.go
+
+	apiMethods  map[string]APIMethod // custom NIP 86 methods, see management_api.go
+	reindexing  atomic.Bool
+	compressing atomic.Bool
+
+	// onAccessLost is told about pubkeys that have been banned or removed,
+	// so their connections can be closed. nil (as in tests) does nothing.
+	onAccessLost func(pubkey nostr.PubKey)
+
+	// onDeleteEvent deletes banned events through the instance, so its
+	// caches forget them too. nil deletes them from the store directly.
+	onDeleteEvent func(id nostr.ID) error
 }
 
-func (m *ManagementStore) WarmCaches() {
-	// Load relay members
+// WarmCaches loads the caches from the database. If a query fails they'd be
+// incomplete, so they're left unused, every lookup going to the database
+// instead, and the error is returned. So they are if ctx is canceled.
+func (m *ManagementStore) WarmCaches(ctx context.Context) error {
+	failures := m.Events.queryErrors.Load()
+
+	for _, load := range []func(){m.loadMembers, m.loadBannedPubkeys, m.loadShadowBannedPubkeys, m.loadBannedEvents, m.loadNIP05Names} {
+		if err := ctx.Err(); err != nil {
+			m.cachesWarmed = false
+			return fmt.Errorf("warming relay caches: %w", err)
+		}
+		load()
+	}
+
+	if n := m.Events.queryErrors.Load() - failures; n > 0 {
+		m.cachesWarmed = false
+		return fmt.Errorf("warming relay caches: %d queries failed", n)
+	}
+
+	m.cachesWarmed = true
+
+	m.loadActivityOnStartup()
+
+	return nil
+}
+
+func (m *ManagementStore) loadMembers() {
 	for tag := range m.Events.GetOrCreateRelayMembersList().Tags.FindAll("member") {
 		if pubkey, err := nostr.PubKeyFromHex(tag[1]); err == nil {
 			m.relayMembers.Store(pubkey, struct{}{})
+			if expires := memberTagExpiry(tag); expires != 0 {
+				m.memberExpiry.Store(pubkey, expires)
+			}
 		}
 	}
+}
 
-	// Load banned pubkeys
+func (m *ManagementStore) loadBannedPubkeys() {
 	for tag := range m.Events.GetOrCreateApplicationSpecificData(BANNED_PUBKEYS).Tags.FindAll("banned") {
 		if pubkey, err := nostr.PubKeyFromHex(tag[1]); err == nil {
 			m.bannedPubkeys.Store(pubkey, tag[2])
 		}
 	}
+}
 
-	// Load banned events
+func (m *ManagementStore) loadShadowBannedPubkeys() {
+	for tag := range m.Events.GetOrCreateApplicationSpecificData(SHADOW_BANNED_PUBKEYS).Tags.FindAll("banned") {
+		if pubkey, err := nostr.PubKeyFromHex(tag[1]); err == nil {
+			m.shadowBannedPubkeys.Store(pubkey, tag[2])
+		}
+	}
+}
+
+func (m *ManagementStore) loadBannedEvents() {
 	for tag := range m.Events.GetOrCreateApplicationSpecificData(BANNED_EVENTS).Tags.FindAll("event") {
 		if id, err := nostr.IDFromHex(tag[1]); err == nil {
 			m.bannedEvents.Store(id, tag[2])
 		}
 	}
+}
 
-	m.cachesWarmed = true
+func (m *ManagementStore) loadActivityOnStartup() {
+	ctx, cancel := context.WithTimeout(m.Events.rootCtx, dbOpTimeout)
+	defer cancel()
+	if err := m.loadActivity(ctx); err != nil {
+		log.Printf("Failed to load member activity for %s: %v", m.Events.Schema.Name, err)
+	}
 }
 
 // Banned events
@@ -86,7 +162,7 @@ func (m *ManagementStore) GetBannedEventItems() []nip86.IDReason {
 }
 
 func (m *ManagementStore) BanEvent(id nostr.ID, reason string) error {
-	if err := m.Events.DeleteEvent(id); err != nil {
+	if err := m.deleteEvent(id); err != nil {
 		return err
 	}
 
@@ -99,6 +175,7 @@ func (m *ManagementStore) BanEvent(id nostr.ID, reason string) error {
 	}
 
 	m.bannedEvents.Store(id, reason)
+	m.Events.announce(cacheMessage{Action: cacheBanEvent, Event: id.Hex()})
 	return nil
 }
 
@@ -114,6 +191,7 @@ func (m *ManagementStore) AllowEvent(id nostr.ID, reason string) error {
 	}
 
 	m.bannedEvents.Delete(id)
+	m.Events.announce(cacheMessage{Action: cacheBanEvent, Event: id.Hex()})
 	return nil
 }
 
@@ -167,9 +245,11 @@ func (m *ManagementStore) AddBannedPubkey(pubkey nostr.PubKey, reason string) er
 		if err := m.Events.SignAndStoreEvent(&event, false); err != nil {
 			return err
 		}
+		defer m.announcePubkey(cacheBanPubkey, pubkey)
 	}
 
 	m.bannedPubkeys.Store(pubkey, reason)
+	m.accessLost(pubkey)
 	return nil
 }
 
@@ -185,6 +265,7 @@ func (m *ManagementStore) RemoveBannedPubkey(pubkey nostr.PubKey) error {
 		if err := m.Events.SignAndStoreEvent(&event, false); err != nil {
 			return err
 		}
+		defer m.announcePubkey(cacheBanPubkey, pubkey)
 	}
 
 	m.bannedPubkeys.Delete(pubkey)
@@ -203,28 +284,125 @@ func (m *ManagementStore) PubkeyIsBanned(pubkey nostr.PubKey) bool {
 	return tag != nil
 }
 
+// Shadow banned pubkeys, see shadowban.go
+
+func (m *ManagementStore) GetShadowBannedPubkeyItems() []nip86.PubKeyReason {
+	items := make([]nip86.PubKeyReason, 0)
+
+	if m.cachesWarmed {
+		m.shadowBannedPubkeys.Range(func(key, value any) bool {
+			items = append(items, nip86.PubKeyReason{
+				PubKey: key.(nostr.PubKey),
+				Reason: value.(string),
+			})
+			return true
+		})
+		return items
+	}
+
+	for tag := range m.Events.GetOrCreateApplicationSpecificData(SHADOW_BANNED_PUBKEYS).Tags.FindAll("banned") {
+		if pubkey, err := nostr.PubKeyFromHex(tag[1]); err == nil {
+			items = append(items, nip86.PubKeyReason{
+				PubKey: pubkey,
+				Reason: tag[2],
+			})
+		}
+	}
+
+	return items
+}
+
+func (m *ManagementStore) ShadowBanPubkey(pubkey nostr.PubKey, reason string) error {
+	event := m.Events.GetOrCreateApplicationSpecificData(SHADOW_BANNED_PUBKEYS)
+
+	if event.Tags.FindWithValue("banned", pubkey.Hex()) == nil {
+		event.CreatedAt = nostr.Now()
+		event.Tags = append(event.Tags, nostr.Tag{"banned", pubkey.Hex(), reason})
+
+		if err := m.Events.SignAndStoreEvent(&event, false); err != nil {
+			return err
+		}
+		defer m.announcePubkey(cacheShadowBan, pubkey)
+	}
+
+	m.shadowBannedPubkeys.Store(pubkey, reason)
+	return nil
+}
+
+func (m *ManagementStore) UnshadowBanPubkey(pubkey nostr.PubKey) error {
+	event := m.Events.GetOrCreateApplicationSpecificData(SHADOW_BANNED_PUBKEYS)
+
+	if event.Tags.FindWithValue("banned", pubkey.Hex()) != nil {
+		event.CreatedAt = nostr.Now()
+		event.Tags = Filter(event.Tags, func(t nostr.Tag) bool {
+			return len(t) >= 2 && t[1] != pubkey.Hex()
+		})
+
+		if err := m.Events.SignAndStoreEvent(&event, false); err != nil {
+			return err
+		}
+		defer m.announcePubkey(cacheShadowBan, pubkey)
+	}
+
+	m.shadowBannedPubkeys.Delete(pubkey)
+	return nil
+}
+
+func (m *ManagementStore) PubkeyIsShadowBanned(pubkey nostr.PubKey) bool {
+	if m.cachesWarmed {
+		_, found := m.shadowBannedPubkeys.Load(pubkey)
+		return found
+	}
+
+	event := m.Events.GetOrCreateApplicationSpecificData(SHADOW_BANNED_PUBKEYS)
+	tag := event.Tags.FindWithValue("banned", pubkey.Hex())
+
+	return tag != nil
+}
+
 // Admins
 
 func (m *ManagementStore) IsAdmin(pubkey nostr.PubKey) bool {
 	return m.Config.IsOwner(pubkey) || m.Config.IsSelf(pubkey)
 }
 
+// GetAdmins returns the owners, the relay's own key and every managing role's
+// pubkeys, each once and in a stable order (roles by name), so the relay
+// admins list doesn't change from one call to the next. A role pubkey that
+// doesn't parse is logged and left out.
 func (m *ManagementStore) GetAdmins() []nostr.PubKey {
-	members := make([]nostr.PubKey, 0)
+	admins := make([]nostr.PubKey, 0)
+	seen := make(map[nostr.PubKey]bool)
+	add := func(pubkey nostr.PubKey) {
+		if !seen[pubkey] {
+			seen[pubkey] = true
+			admins = append(admins, pubkey)
+		}
+	}
 
-	members = append(members, m.Config.GetOwner())
+	for _, pubkey := range m.Config.GetOwners() {
+		add(pubkey)
+	}
+
+	add(m.Config.GetSelf())
 
-	members = append(members, m.Config.GetSelf())
+	for _, name := range slices.Sorted(maps.Keys(m.Config.Roles)) {
+		role := m.Config.Roles[name]
+		if !role.CanManage {
+			continue
+		}
 
-	for _, role := range m.Config.Roles {
-		if role.CanManage {
-			for _, pubkey := range role.Pubkeys {
-				members = append(members, nostr.MustPubKeyFromHex(pubkey))
+		for _, hex := range role.Pubkeys {
+			pubkey, err := nostr.PubKeyFromHex(hex)
+			if err != nil {
+				log.Printf("Skipping roles.%s pubkey %q in the admins list: %v", name, hex, err)
+				continue
 			}
+			add(pubkey)
 		}
 	}
 
-	return members
+	return admins
 }
 
 // Membership
@@ -233,7 +411,9 @@ func (m *ManagementStore) GetMembers() []nostr.PubKey {
 	if m.cachesWarmed {
 		pubkeys := make([]nostr.PubKey, 0)
 		m.relayMembers.Range(func(key, _ any) bool {
-			pubkeys = append(pubkeys, key.(nostr.PubKey))
+			if pubkey := key.(nostr.PubKey); m.cachedMembershipLive(pubkey) {
+				pubkeys = append(pubkeys, pubkey)
+			}
 			return true
 		})
 		return pubkeys
@@ -243,7 +423,7 @@ func (m *ManagementStore) GetMembers() []nostr.PubKey {
 	for tag := range m.Events.GetOrCreateRelayMembersList().Tags.FindAll("member") {
 		pubkey, err := nostr.PubKeyFromHex(tag[1])
 
-		if err == nil {
+		if err == nil && membershipLive(memberTagExpiry(tag)) {
 			pubkeys = append(pubkeys, pubkey)
 		}
 	}
@@ -251,29 +431,33 @@ func (m *ManagementStore) GetMembers() []nostr.PubKey {
 	return pubkeys
 }
 
+// IsMember reports whether pubkey is a relay member whose membership, if it
+// has an expiry, hasn't lapsed.
 func (m *ManagementStore) IsMember(pubkey nostr.PubKey) bool {
 	if m.cachesWarmed {
 		_, found := m.relayMembers.Load(pubkey)
-		return found
+		return found && m.cachedMembershipLive(pubkey)
 	}
 
-	return m.Events.GetOrCreateRelayMembersList().Tags.FindWithValue("member", pubkey.Hex()) != nil
+	tag := m.Events.GetOrCreateRelayMembersList().Tags.FindWithValue("member", pubkey.Hex())
+	return tag != nil && membershipLive(memberTagExpiry(tag))
 }
 
+// AddMember makes pubkey a member. A membership that has lapsed but not yet
+// been swept is revived without an expiry; a live one is left as it is.
 func (m *ManagementStore) AddMember(pubkey nostr.PubKey) error {
 	membersEvent := m.Events.GetOrCreateRelayMembersList()
 
-	if membersEvent.Tags.FindWithValue("member", pubkey.Hex()) == nil {
-		addMemberEvent := nostr.Event{
-			Kind:      RELAY_ADD_MEMBER,
-			CreatedAt: nostr.Now(),
-			Tags: nostr.Tags{
-				[]string{"-"},
-				[]string{"p", pubkey.Hex()},
-			},
+	if tag := membersEvent.Tags.FindWithValue("member", pubkey.Hex()); tag != nil && !membershipLive(memberTagExpiry(tag)) {
+		if err := m.RenewMember(pubkey, 0); err != nil {
+			return err
 		}
+		m.touch(pubkey, nostr.Now())
+		return nil
+	}
 
-		if err := m.Events.SignAndStoreEvent(&addMemberEvent, true); err != nil {
+	if membersEvent.Tags.FindWithValue("member", pubkey.Hex()) == nil {
+		if err := m.signMembershipEvent(RELAY_ADD_MEMBER, pubkey); err != nil {
 			return err
 		}
 
@@ -283,6 +467,11 @@ func (m *ManagementStore) AddMember(pubkey nostr.PubKey) error {
 		if err := m.Events.SignAndStoreEvent(&membersEvent, true); err != nil {
 			return err
 		}
+		defer m.announcePubkey(cacheMember, pubkey)
+
+		// Joining counts as activity, so new members aren't immediately
+		// listed as inactive.
+		m.touch(pubkey, nostr.Now())
 	}
 
 	m.relayMembers.Store(pubkey, struct{}{})
@@ -293,33 +482,209 @@ func (m *ManagementStore) RemoveMember(pubkey nostr.PubKey) error {
 	membersEvent := m.Events.GetOrCreateRelayMembersList()
 
 	if membersEvent.Tags.FindWithValue("member", pubkey.Hex()) != nil {
-		removeMemberEvent := nostr.Event{
-			Kind:      RELAY_REMOVE_MEMBER,
-			CreatedAt: nostr.Now(),
-			Tags: nostr.Tags{
-				[]string{"-"},
-				[]string{"p", pubkey.Hex()},
-			},
-		}
-
-		if err := m.Events.SignAndStoreEvent(&removeMemberEvent, true); err != nil {
+		if err := m.signMembershipEvent(RELAY_REMOVE_MEMBER, pubkey); err != nil {
 			return err
 		}
 
 		membersEvent.CreatedAt = nostr.Now()
 		membersEvent.Tags = Filter(membersEvent.Tags, func(t nostr.Tag) bool {
-			return len(t) >= 2 && t[1] != pubkey.Hex()
+			return len(t) < 2 || t[0] != "member" || t[1] != pubkey.Hex()
 		})
 
 		if err := m.Events.SignAndStoreEvent(&membersEvent, true); err != nil {
 			return err
 		}
+		defer m.announcePubkey(cacheMember, pubkey)
 	}
 
 	m.relayMembers.Delete(pubkey)
+	m.memberExpiry.Delete(pubkey)
+	m.accessLost(pubkey)
+	return nil
+}
+
+// announcePubkey tells the schema's other instances that list action has
+// changed for pubkey, see cachebus.go.
+func (m *ManagementStore) announcePubkey(action string, pubkey nostr.PubKey) {
+	m.Events.announce(cacheMessage{Action: action, PubKey: pubkey.Hex()})
+}
+
+func (m *ManagementStore) accessLost(pubkey nostr.PubKey) {
+	if m.onAccessLost != nil {
+		m.onAccessLost(pubkey)
+	}
+}
+
+// signMembershipEvent publishes a RELAY_ADD_MEMBER or RELAY_REMOVE_MEMBER
+// event for pubkey.
+func (m *ManagementStore) signMembershipEvent(kind nostr.Kind, pubkey nostr.PubKey) error {
+	event := nostr.Event{
+		Kind:      kind,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			[]string{"-"},
+			[]string{"p", pubkey.Hex()},
+		},
+	}
+
+	return m.Events.SignAndStoreEvent(&event, true)
+}
+
+// Membership expiry
+//
+// A member tag may carry a third element, the unix time at which the
+// membership lapses: ["member", <pubkey>, <expires_at>]. From that second on
+// IsMember treats the pubkey as a non-member; SweepExpiredMembers later drops
+// the tag and announces the removal. Group membership is separate and isn't
+// affected.
+
+// membershipNow is the clock for membership expiry, swappable in tests.
+var membershipNow = nostr.Now
+
+// memberTagExpiry returns the expiry recorded in a member tag, or 0 if the
+// membership doesn't expire.
+func memberTagExpiry(tag nostr.Tag) nostr.Timestamp {
+	if len(tag) < 3 {
+		return 0
+	}
+
+	expires, err := strconv.ParseInt(tag[2], 10, 64)
+	if err != nil || expires <= 0 {
+		return 0
+	}
+
+	return nostr.Timestamp(expires)
+}
+
+func membershipLive(expires nostr.Timestamp) bool {
+	return expires == 0 || membershipNow() < expires
+}
+
+func (m *ManagementStore) cachedMembershipLive(pubkey nostr.PubKey) bool {
+	expires, ok := m.memberExpiry.Load(pubkey)
+	return !ok || membershipLive(expires.(nostr.Timestamp))
+}
+
+// RenewMember makes pubkey a member until the given time, or indefinitely if
+// until is 0. It extends (or shortens) an existing membership, revives one
+// that has lapsed but not yet been swept, and adds pubkey if it isn't on the
+// list at all.
+func (m *ManagementStore) RenewMember(pubkey nostr.PubKey, until nostr.Timestamp) error {
+	membersEvent := m.Events.GetOrCreateRelayMembersList()
+
+	tag := nostr.Tag{"member", pubkey.Hex()}
+	if until != 0 {
+		tag = append(tag, strconv.FormatInt(int64(until), 10))
+	}
+
+	if membersEvent.Tags.FindWithValue("member", pubkey.Hex()) == nil {
+		if err := m.signMembershipEvent(RELAY_ADD_MEMBER, pubkey); err != nil {
+			return err
+		}
+
+		membersEvent.Tags = append(membersEvent.Tags, tag)
+	} else {
+		for i, t := range membersEvent.Tags {
+			if len(t) >= 2 && t[0] == "member" && t[1] == pubkey.Hex() {
+				membersEvent.Tags[i] = tag
+			}
+		}
+	}
+
+	membersEvent.CreatedAt = nostr.Now()
+	if err := m.Events.SignAndStoreEvent(&membersEvent, true); err != nil {
+		return err
+	}
+
+	m.relayMembers.Store(pubkey, struct{}{})
+	if until != 0 {
+		m.memberExpiry.Store(pubkey, until)
+	} else {
+		m.memberExpiry.Delete(pubkey)
+	}
+
+	m.announcePubkey(cacheMember, pubkey)
+
 	return nil
 }
 
+// SweepExpiredMembers removes every lapsed membership from the members list,
+// publishing a RELAY_REMOVE_MEMBER event for each so clients learn about it,
+// and returns how many were removed. The list is rewritten once.
+func (m *ManagementStore) SweepExpiredMembers() (int, error) {
+	membersEvent := m.Events.GetOrCreateRelayMembersList()
+
+	expired := make([]nostr.PubKey, 0)
+	kept := Filter(membersEvent.Tags, func(t nostr.Tag) bool {
+		if len(t) < 2 || t[0] != "member" || membershipLive(memberTagExpiry(t)) {
+			return true
+		}
+
+		if pubkey, err := nostr.PubKeyFromHex(t[1]); err == nil {
+			expired = append(expired, pubkey)
+		}
+
+		return false
+	})
+
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	for _, pubkey := range expired {
+		if err := m.signMembershipEvent(RELAY_REMOVE_MEMBER, pubkey); err != nil {
+			return 0, err
+		}
+	}
+
+	membersEvent.CreatedAt = nostr.Now()
+	membersEvent.Tags = kept
+	if err := m.Events.SignAndStoreEvent(&membersEvent, true); err != nil {
+		return 0, err
+	}
+
+	for _, pubkey := range expired {
+		m.relayMembers.Delete(pubkey)
+		m.memberExpiry.Delete(pubkey)
+		m.accessLost(pubkey)
+		m.announcePubkey(cacheMember, pubkey)
+	}
+
+	return len(expired), nil
+}
+
+// StartMembershipSweeper launches a background goroutine that removes lapsed
+// relay memberships once a day until ctx is cancelled. IsMember already
+// treats them as non-members, so the timing only affects when the removal is
+// announced.
+func StartMembershipSweeper(ctx context.Context) {
+	go func() {
+		sweepExpiredMembers(ctx)
+
+		ticker := time.NewTicker(24 * time.Hour)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sweepExpiredMembers(ctx)
+			}
+		}
+	}()
+}
+
+func sweepExpiredMembers(ctx context.Context) {
+	for _, inst := range leadingInstances(ctx) {
+		if n, err := inst.Management.SweepExpiredMembers(); err != nil {
+			log.Printf("Failed to sweep expired members for %s: %v", inst.Config.Schema, err)
+		} else if n > 0 {
+			log.Printf("Removed %d expired member(s) from %s", n, inst.Config.Schema)
+		}
+	}
+}
+
 // Banning
 
 func (m *ManagementStore) BanPubkey(pubkey nostr.PubKey, reason string) error {
@@ -341,12 +706,19 @@ func (m *ManagementStore) BanPubkey(pubkey nostr.PubKey, reason string) error {
 		toDelete = append(toDelete, event.ID)
 	}
 	for _, id := range toDelete {
-		m.Events.DeleteEvent(id)
+		m.deleteEvent(id)
 	}
 
 	return nil
 }
 
+func (m *ManagementStore) deleteEvent(id nostr.ID) error {
+	if m.onDeleteEvent != nil {
+		return m.onDeleteEvent(id)
+	}
+	return m.Events.DeleteEvent(id)
+}
+
 // Allowing
 
 func (m *ManagementStore) GetAllowedPubkeyItems() []nip86.PubKeyReason {
@@ -376,15 +748,30 @@ func (m *ManagementStore) AllowPubkey(pubkey nostr.PubKey) error {
 	return nil
 }
 
+// AllowPubkeyUntil is AllowPubkey for a membership that lasts until the
+// given time, see RenewMember.
+func (m *ManagementStore) AllowPubkeyUntil(pubkey nostr.PubKey, until nostr.Timestamp) error {
+	if err := m.RenewMember(pubkey, until); err != nil {
+		return err
+	}
+
+	return m.RemoveBannedPubkey(pubkey)
+}
+
 // Joining
 
 func (m *ManagementStore) ValidateJoinRequest(event nostr.Event) (reject bool, err string) {
-	if m.IsMember(event.PubKey) {
-		return false, ""
+	if m.PubkeyIsBanned(event.PubKey) {
+		return RejectBlocked.Reject("you have been banned from this relay")
 	}
 
-	if m.PubkeyIsBanned(event.PubKey) {
-		return true, "invalid: you have been banned from this relay"
+	// Members may pay to extend their membership, see payments.go
+	if proof, found := paymentProof(event); found {
+		return m.redeemPayment(event.PubKey, proof)
+	}
+
+	if m.IsMember(event.PubKey) {
+		return false, ""
 	}
 
 	if m.Config.Policy.PublicJoin {
@@ -394,7 +781,7 @@ func (m *ManagementStore) ValidateJoinRequest(event nostr.Event) (reject bool, e
 	claimTag := event.Tags.Find("claim")
 
 	if claimTag == nil {
-		return true, "invalid: no claim tag"
+		return RejectRestricted.Reject("no claim tag")
 	}
 
 	filter := nostr.Filter{
@@ -407,7 +794,7 @@ func (m *ManagementStore) ValidateJoinRequest(event nostr.Event) (reject bool, e
 		}
 	}
 
-	return true, "invalid: failed to validate invite code"
+	return RejectRestricted.Reject("failed to validate invite code")
 }
 
 // Middleware
@@ -417,11 +804,11 @@ func (m *ManagementStore) Enable(instance *Instance) {
 		pubkey, ok := khatru.GetAuthed(ctx)
 
 		if !ok {
-			return true, "blocked: please authenticate in order to manage this relay"
+			return RejectAuthRequired.Reject("please authenticate in order to manage this relay")
 		}
 
 		if !m.Config.CanManage(pubkey) {
-			return true, "blocked: only relay admins can manage this relay."
+			return RejectRestricted.Reject("only relay admins can manage this relay")
 		}
 
 		return false, ""
@@ -476,4 +863,6 @@ func (m *ManagementStore) Enable(instance *Instance) {
 	instance.Relay.ManagementAPI.ListBannedEvents = func(ctx context.Context) ([]nip86.IDReason, error) {
 		return m.GetBannedEventItems(), nil
 	}
+
+	m.enableAPIMethods(instance)
 }
@@ -0,0 +1,361 @@
+package zooid
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip86"
+)
+
+// Zooid-specific NIP 86 methods.
+//
+// khatru rejects any method name it doesn't know before handing the request to
+// ManagementAPI.Generic, so methods that aren't part of NIP 86 are intercepted
+// here, ahead of Relay.ServeHTTP. Authentication uses the same NIP 98 checks
+// as zooid's other HTTP endpoints.
+
+// APIMethod handles a single custom management method. params are the raw JSON
+// values from the request.
+type APIMethod func(ctx context.Context, params []any) (any, error)
+
+// RegisterAPIMethod adds a custom management method, replacing any existing
+// method with the same name.
+func (m *ManagementStore) RegisterAPIMethod(name string, method APIMethod) {
+	if m.apiMethods == nil {
+		m.apiMethods = make(map[string]APIMethod)
+	}
+
+	m.apiMethods[name] = method
+}
+
+// ServeAPI handles the request if it is a NIP 86 call to a custom method, and
+// reports whether it did. Anything else is left untouched for khatru.
+func (m *ManagementStore) ServeAPI(w http.ResponseWriter, r *http.Request) bool {
+	if len(m.apiMethods) == 0 || r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/nostr+json+rpc" {
+		return false
+	}
+
+	payload, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(payload))
+	if err != nil {
+		return false
+	}
+
+	var req nip86.Request
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return false
+	}
+
+	method, ok := m.apiMethods[req.Method]
+	if !ok {
+		return false
+	}
+
+	var resp nip86.Response
+	if pubkey, err := authenticateHTTPRequest(r, payload); err != nil {
+		resp.Error = err.Error()
+	} else if !m.Config.CanManage(pubkey) {
+		resp.Error = RejectRestricted.Reason("only relay admins can manage this relay")
+	} else if result, err := method(r.Context(), req.Params); err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Result = result
+	}
+
+	w.Header().Set("Content-Type", "application/nostr+json+rpc")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(resp)
+
+	return true
+}
+
+// RelayStats is the result of the relaystats management method.
+type RelayStats struct {
+	EventStats
+	Members int `json:"members"`
+	Groups  int `json:"groups"`
+}
+
+func (m *ManagementStore) enableAPIMethods(instance *Instance) {
+	m.RegisterAPIMethod("setreadonly", func(ctx context.Context, params []any) (any, error) {
+		if len(params) != 1 {
+			return nil, errors.New("invalid params: expected [boolean]")
+		}
+
+		readOnly, ok := params[0].(bool)
+		if !ok {
+			return nil, errors.New("invalid params: expected [boolean]")
+		}
+
+		m.Config.SetReadOnly(readOnly)
+
+		return true, nil
+	})
+
+	// Index builds on large tables take far longer than an HTTP request, so
+	// reindex only starts the work; progress and errors go to the log.
+	m.RegisterAPIMethod("reindex", func(ctx context.Context, params []any) (any, error) {
+		if !m.reindexing.CompareAndSwap(false, true) {
+			return nil, errors.New("a reindex is already running")
+		}
+
+		go func() {
+			defer m.reindexing.Store(false)
+
+			if err := m.Events.Reindex(m.Events.rootCtx); err != nil {
+				log.Printf("Reindex of schema %s failed: %v", m.Events.Schema.Name, err)
+			} else {
+				log.Printf("Reindex of schema %s complete", m.Events.Schema.Name)
+			}
+		}()
+
+		return true, nil
+	})
+
+	// Like reindex, compressing a large table runs in the background.
+	m.RegisterAPIMethod("compressevents", func(ctx context.Context, params []any) (any, error) {
+		if m.Config.GetCompressAbove() <= 0 {
+			return nil, errors.New("storage.compress_above is not set")
+		}
+		if !m.compressing.CompareAndSwap(false, true) {
+			return nil, errors.New("events are already being compressed")
+		}
+
+		go func() {
+			defer m.compressing.Store(false)
+
+			if _, err := m.Events.CompressEvents(m.Events.rootCtx); err != nil {
+				log.Printf("Compressing events in schema %s failed: %v", m.Events.Schema.Name, err)
+			}
+		}()
+
+		return true, nil
+	})
+
+	m.RegisterAPIMethod("listinactive", func(ctx context.Context, params []any) (any, error) {
+		if len(params) != 1 {
+			return nil, errors.New("invalid params: expected [seconds]")
+		}
+
+		seconds, ok := params[0].(float64)
+		if !ok || seconds < 0 {
+			return nil, errors.New("invalid params: expected [seconds]")
+		}
+
+		return m.GetInactiveMembers(time.Duration(seconds) * time.Second), nil
+	})
+
+	m.RegisterAPIMethod("listtopusers", func(ctx context.Context, params []any) (any, error) {
+		if len(params) != 2 {
+			return nil, errors.New("invalid params: expected [limit, seconds]")
+		}
+
+		limit, ok := params[0].(float64)
+		if !ok || limit < 1 {
+			return nil, errors.New("invalid params: expected [limit, seconds]")
+		}
+
+		seconds, ok := params[1].(float64)
+		if !ok || seconds < 0 {
+			return nil, errors.New("invalid params: expected [limit, seconds]")
+		}
+
+		return m.GetTopUsers(ctx, int(limit), time.Duration(seconds)*time.Second)
+	})
+
+	m.RegisterAPIMethod("renewmember", func(ctx context.Context, params []any) (any, error) {
+		if len(params) != 2 {
+			return nil, errors.New("invalid params: expected [pubkey, until]")
+		}
+
+		hex, _ := params[0].(string)
+		pubkey, err := nostr.PubKeyFromHex(hex)
+		if err != nil {
+			return nil, errors.New("invalid params: expected [pubkey, until]")
+		}
+
+		until, ok := params[1].(float64)
+		if !ok || until < 0 {
+			return nil, errors.New("invalid params: expected [pubkey, until]")
+		}
+
+		if err := m.RenewMember(pubkey, nostr.Timestamp(until)); err != nil {
+			return nil, err
+		}
+
+		return true, nil
+	})
+
+	m.RegisterAPIMethod("shadowbanpubkey", func(ctx context.Context, params []any) (any, error) {
+		if len(params) < 1 || len(params) > 2 {
+			return nil, errors.New("invalid params: expected [pubkey, reason]")
+		}
+
+		hex, _ := params[0].(string)
+		pubkey, err := nostr.PubKeyFromHex(hex)
+		if err != nil {
+			return nil, errors.New("invalid params: expected [pubkey, reason]")
+		}
+
+		reason := ""
+		if len(params) == 2 {
+			reason, _ = params[1].(string)
+		}
+
+		if err := m.ShadowBanPubkey(pubkey, reason); err != nil {
+			return nil, err
+		}
+
+		return true, nil
+	})
+
+	m.RegisterAPIMethod("unshadowbanpubkey", func(ctx context.Context, params []any) (any, error) {
+		if len(params) != 1 {
+			return nil, errors.New("invalid params: expected [pubkey]")
+		}
+
+		hex, _ := params[0].(string)
+		pubkey, err := nostr.PubKeyFromHex(hex)
+		if err != nil {
+			return nil, errors.New("invalid params: expected [pubkey]")
+		}
+
+		if err := m.UnshadowBanPubkey(pubkey); err != nil {
+			return nil, err
+		}
+		instance.shadowBuffer.forget(pubkey)
+
+		return true, nil
+	})
+
+	m.RegisterAPIMethod("listshadowbannedpubkeys", func(ctx context.Context, params []any) (any, error) {
+		return m.GetShadowBannedPubkeyItems(), nil
+	})
+
+	m.RegisterAPIMethod("restoreevent", func(ctx context.Context, params []any) (any, error) {
+		if len(params) != 1 {
+			return nil, errors.New("invalid params: expected [id]")
+		}
+
+		hex, _ := params[0].(string)
+		id, err := nostr.IDFromHex(hex)
+		if err != nil {
+			return nil, errors.New("invalid params: expected [id]")
+		}
+
+		if err := instance.RestoreEvent(ctx, id); err != nil {
+			return nil, err
+		}
+
+		return true, nil
+	})
+
+	for name, deny := range map[string]bool{"denypurge": true, "allowpurge": false} {
+		m.RegisterAPIMethod(name, func(ctx context.Context, params []any) (any, error) {
+			if len(params) != 1 {
+				return nil, errors.New("invalid params: expected [pubkey]")
+			}
+
+			hex, _ := params[0].(string)
+			pubkey, err := nostr.PubKeyFromHex(hex)
+			if err != nil {
+				return nil, errors.New("invalid params: expected [pubkey]")
+			}
+
+			if err := instance.DenyPurge(ctx, pubkey, deny); err != nil {
+				return nil, err
+			}
+
+			return true, nil
+		})
+	}
+
+	m.RegisterAPIMethod("listdeadletters", func(ctx context.Context, params []any) (any, error) {
+		return instance.ListDeadLetters(ctx)
+	})
+
+	m.RegisterAPIMethod("retrydeadletters", func(ctx context.Context, params []any) (any, error) {
+		resolved, remaining, err := instance.RetryDeadLetters(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]int{"resolved": resolved, "remaining": remaining}, nil
+	})
+
+	m.RegisterAPIMethod("verifycaches", func(ctx context.Context, params []any) (any, error) {
+		sample := 0
+		if len(params) > 0 {
+			n, ok := params[0].(float64)
+			if !ok || n < 0 {
+				return nil, errors.New("invalid params: expected [sample]")
+			}
+			sample = int(n)
+		}
+
+		groups, relay, err := instance.VerifyCaches(sample)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]DriftReport{"groups": groups, "relay": relay}, nil
+	})
+
+	m.RegisterAPIMethod("relaystats", func(ctx context.Context, params []any) (any, error) {
+		stats, err := m.Events.Stats(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		result := RelayStats{EventStats: stats, Members: len(m.GetMembers())}
+		instance.Groups.metadataCache.Range(func(_, _ any) bool {
+			result.Groups++
+			return true
+		})
+
+		return result, nil
+	})
+
+	m.RegisterAPIMethod("setnip05", func(ctx context.Context, params []any) (any, error) {
+		if len(params) != 2 {
+			return nil, errors.New("invalid params: expected [name, pubkey]")
+		}
+
+		name, _ := params[0].(string)
+		hex, _ := params[1].(string)
+		pubkey, err := nostr.PubKeyFromHex(hex)
+		if err != nil {
+			return nil, errors.New("invalid params: expected [name, pubkey]")
+		}
+
+		if err := m.SetNIP05(name, pubkey); err != nil {
+			return nil, err
+		}
+
+		return true, nil
+	})
+
+	m.RegisterAPIMethod("deletenip05", func(ctx context.Context, params []any) (any, error) {
+		if len(params) != 1 {
+			return nil, errors.New("invalid params: expected [name]")
+		}
+
+		name, ok := params[0].(string)
+		if !ok {
+			return nil, errors.New("invalid params: expected [name]")
+		}
+
+		if err := m.DeleteNIP05(name); err != nil {
+			return nil, err
+		}
+
+		return true, nil
+	})
+}
@@ -0,0 +1,107 @@
+package zooid
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip86"
+)
+
+func newTestAPIRequest(t *testing.T, secret nostr.SecretKey, method string, params ...any) *http.Request {
+	t.Helper()
+
+	body, _ := json.Marshal(nip86.Request{Method: method, Params: params})
+	hash := sha256.Sum256(body)
+
+	auth := nostr.Event{
+		Kind:      27235,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"u", "https://test.com"},
+			{"method", "POST"},
+			{"payload", hex.EncodeToString(hash[:])},
+		},
+	}
+	if err := auth.Sign(secret); err != nil {
+		t.Fatalf("failed to sign auth event: %v", err)
+	}
+	authj, _ := json.Marshal(auth)
+
+	r := httptest.NewRequest(http.MethodPost, "https://test.com/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/nostr+json+rpc")
+	r.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(authj))
+
+	return r
+}
+
+func serveTestAPIRequest(t *testing.T, m *ManagementStore, r *http.Request) nip86.Response {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	if !m.ServeAPI(w, r) {
+		t.Fatal("ServeAPI should handle custom methods")
+	}
+
+	var resp nip86.Response
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response body: %v", err)
+	}
+
+	return resp
+}
+
+func TestManagementStore_ServeAPI_SetReadOnly(t *testing.T) {
+	instance := createTestInstance()
+	instance.Management.enableAPIMethods(instance)
+
+	resp := serveTestAPIRequest(t, instance.Management, newTestAPIRequest(t, instance.Config.secret, "setreadonly", true))
+	if resp.Error != "" {
+		t.Fatalf("setreadonly returned error: %s", resp.Error)
+	}
+	if !instance.Config.IsReadOnly() {
+		t.Error("setreadonly true should enable read-only mode")
+	}
+
+	resp = serveTestAPIRequest(t, instance.Management, newTestAPIRequest(t, instance.Config.secret, "setreadonly", false))
+	if resp.Error != "" {
+		t.Fatalf("setreadonly returned error: %s", resp.Error)
+	}
+	if instance.Config.IsReadOnly() {
+		t.Error("setreadonly false should disable read-only mode")
+	}
+
+	resp = serveTestAPIRequest(t, instance.Management, newTestAPIRequest(t, instance.Config.secret, "setreadonly", "yes"))
+	if resp.Error == "" {
+		t.Error("setreadonly should reject non-boolean params")
+	}
+}
+
+func TestManagementStore_ServeAPI_RequiresAdmin(t *testing.T) {
+	instance := createTestInstance()
+	instance.Management.enableAPIMethods(instance)
+
+	resp := serveTestAPIRequest(t, instance.Management, newTestAPIRequest(t, nostr.Generate(), "setreadonly", true))
+	if resp.Error == "" {
+		t.Error("non-admins should not be able to call setreadonly")
+	}
+	if instance.Config.IsReadOnly() {
+		t.Error("read-only mode should be unchanged after a rejected call")
+	}
+}
+
+func TestManagementStore_ServeAPI_PassesThroughStandardMethods(t *testing.T) {
+	instance := createTestInstance()
+	instance.Management.enableAPIMethods(instance)
+
+	r := newTestAPIRequest(t, instance.Config.secret, "supportedmethods")
+	if instance.Management.ServeAPI(httptest.NewRecorder(), r) {
+		t.Error("standard NIP-86 methods should be left to khatru")
+	}
+}
@@ -2,6 +2,8 @@ package zooid
 
 import (
 	"context"
+	"errors"
+	"slices"
 	"testing"
 
 	"fiatjaf.com/nostr"
@@ -13,7 +15,7 @@ func createTestManagementStore() *ManagementStore {
 		Host:   "test.com",
 		secret: nostr.Generate(),
 	}
-	schema := &Schema{Name: "test_" + RandomString(8)}
+	schema := testSchema("test_")
 	relay := &khatru.Relay{}
 	events := &EventStore{
 		Relay:   relay,
@@ -142,3 +144,256 @@ func TestManagementStore_EventIsBanned_NotBanned(t *testing.T) {
 		t.Error("EventIsBanned() should return false for non-banned event")
 	}
 }
+
+func TestEventStore_GetOrCreateRelayMembersList_IgnoresDecoy(t *testing.T) {
+	mgmt := createTestManagementStore()
+	intruder := nostr.Generate().Public()
+
+	decoy := nostr.Event{
+		Kind:      RELAY_MEMBERS,
+		CreatedAt: nostr.Now() + 10,
+		Tags: nostr.Tags{
+			{"-"},
+			{"d", RELAY_MEMBERS_D},
+			{"member", intruder.Hex()},
+		},
+	}
+	decoy.Sign(nostr.Generate())
+	if err := mgmt.Events.StoreEvent(decoy); !errors.Is(err, ErrNotRelaySigned) {
+		t.Fatalf("StoreEvent(decoy) error = %v, want ErrNotRelaySigned", err)
+	}
+
+	// Write it underneath the check, as an older relay version could have.
+	if err := mgmt.Events.storeEvent(decoy); err != nil {
+		t.Fatalf("failed to store decoy: %v", err)
+	}
+
+	list := mgmt.Events.GetOrCreateRelayMembersList()
+	if list.ID == decoy.ID {
+		t.Fatal("members list from another pubkey should be ignored")
+	}
+	if list.PubKey != mgmt.Config.GetSelf() {
+		t.Error("members list should be signed by the relay")
+	}
+	if mgmt.IsMember(intruder) {
+		t.Error("decoy list should not grant membership")
+	}
+}
+
+func TestEventStore_GetOrCreateRelayMembersList_MigratesLegacyList(t *testing.T) {
+	mgmt := createTestManagementStore()
+	member := nostr.Generate().Public()
+
+	legacy := nostr.Event{
+		Kind:      RELAY_MEMBERS,
+		CreatedAt: nostr.Now() - 60,
+		Tags: nostr.Tags{
+			{"-"},
+			{"member", member.Hex()},
+		},
+	}
+	if err := mgmt.Events.SignAndStoreEvent(&legacy, false); err != nil {
+		t.Fatalf("failed to store legacy list: %v", err)
+	}
+
+	list := mgmt.Events.GetOrCreateRelayMembersList()
+	if list.Tags.GetD() != RELAY_MEMBERS_D {
+		t.Errorf("migrated list d tag = %q, want %q", list.Tags.GetD(), RELAY_MEMBERS_D)
+	}
+	if list.Tags.FindWithValue("member", member.Hex()) == nil {
+		t.Error("migrated list should keep existing members")
+	}
+
+	count, err := mgmt.Events.CountEvents(nostr.Filter{Kinds: []nostr.Kind{RELAY_MEMBERS}})
+	if err != nil || count != 1 {
+		t.Errorf("members lists after migration = (%d, %v), want 1", count, err)
+	}
+}
+
+func TestInstance_IsReadOnlyEvent_MembersList(t *testing.T) {
+	instance := createTestInstance()
+
+	if !instance.IsReadOnlyEvent(nostr.Event{Kind: RELAY_MEMBERS}) {
+		t.Error("clients must not be able to publish the relay members list kind")
+	}
+}
+
+func withMembershipNow(t *testing.T, now nostr.Timestamp) {
+	prev := membershipNow
+	membershipNow = func() nostr.Timestamp { return now }
+	t.Cleanup(func() { membershipNow = prev })
+}
+
+func TestManagementStore_MembershipExpiry_Boundary(t *testing.T) {
+	mgmt := createTestManagementStore()
+	pubkey := nostr.Generate().Public()
+	expires := nostr.Timestamp(2_000_000_000)
+
+	if err := mgmt.RenewMember(pubkey, expires); err != nil {
+		t.Fatalf("RenewMember() error = %v", err)
+	}
+
+	for _, warm := range []bool{false, true} {
+		mgmt.cachesWarmed = warm
+
+		withMembershipNow(t, expires-1)
+		if !mgmt.IsMember(pubkey) {
+			t.Errorf("warm=%v: member should be valid the second before expiry", warm)
+		}
+
+		withMembershipNow(t, expires)
+		if mgmt.IsMember(pubkey) {
+			t.Errorf("warm=%v: member should be expired at the expiry second", warm)
+		}
+		if len(mgmt.GetMembers()) != 0 {
+			t.Errorf("warm=%v: GetMembers() should exclude expired members", warm)
+		}
+	}
+}
+
+func TestManagementStore_RenewMember_Expired(t *testing.T) {
+	mgmt := createTestManagementStore()
+	pubkey := nostr.Generate().Public()
+	expires := nostr.Timestamp(2_000_000_000)
+
+	if err := mgmt.RenewMember(pubkey, expires); err != nil {
+		t.Fatalf("RenewMember() error = %v", err)
+	}
+
+	withMembershipNow(t, expires+10)
+	if mgmt.IsMember(pubkey) {
+		t.Fatal("member should have expired")
+	}
+
+	if err := mgmt.RenewMember(pubkey, expires+100); err != nil {
+		t.Fatalf("RenewMember() error = %v", err)
+	}
+	if !mgmt.IsMember(pubkey) {
+		t.Error("renewed member should be valid again")
+	}
+
+	tags := mgmt.Events.GetOrCreateRelayMembersList().Tags
+	count := 0
+	for range tags.FindAll("member") {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("members list should have one member tag, got %d", count)
+	}
+	if n, _ := mgmt.SweepExpiredMembers(); n != 0 {
+		t.Errorf("SweepExpiredMembers() removed %d renewed members", n)
+	}
+
+	if err := mgmt.RenewMember(pubkey, 0); err != nil {
+		t.Fatalf("RenewMember() error = %v", err)
+	}
+	withMembershipNow(t, expires+1000)
+	if !mgmt.IsMember(pubkey) {
+		t.Error("membership renewed without an expiry should not lapse")
+	}
+}
+
+func TestManagementStore_AddMember_Lapsed(t *testing.T) {
+	mgmt := createTestManagementStore()
+	lapsed := nostr.Generate().Public()
+	live := nostr.Generate().Public()
+	expires := nostr.Timestamp(2_000_000_000)
+
+	for _, pubkey := range []nostr.PubKey{lapsed, live} {
+		if err := mgmt.RenewMember(pubkey, expires); err != nil {
+			t.Fatalf("RenewMember() error = %v", err)
+		}
+	}
+	withMembershipNow(t, expires+10)
+	if err := mgmt.RenewMember(live, expires+100); err != nil {
+		t.Fatalf("RenewMember() error = %v", err)
+	}
+
+	for _, pubkey := range []nostr.PubKey{lapsed, live} {
+		if err := mgmt.AddMember(pubkey); err != nil {
+			t.Fatalf("AddMember() error = %v", err)
+		}
+	}
+
+	for _, warm := range []bool{false, true} {
+		mgmt.cachesWarmed = warm
+		if !mgmt.IsMember(lapsed) {
+			t.Errorf("warm=%v: re-added member should be valid again", warm)
+		}
+	}
+
+	tags := mgmt.Events.GetOrCreateRelayMembersList().Tags
+	if tag := tags.FindWithValue("member", lapsed.Hex()); memberTagExpiry(tag) != 0 {
+		t.Errorf("re-added member still expires at %d", memberTagExpiry(tag))
+	}
+	if tag := tags.FindWithValue("member", live.Hex()); memberTagExpiry(tag) != expires+100 {
+		t.Errorf("adding a live member changed its expiry to %d", memberTagExpiry(tag))
+	}
+	if n, _ := mgmt.SweepExpiredMembers(); n != 0 {
+		t.Errorf("SweepExpiredMembers() removed %d re-added members", n)
+	}
+}
+
+func TestManagementStore_SweepExpiredMembers(t *testing.T) {
+	mgmt := createTestManagementStore()
+	expired := nostr.Generate().Public()
+	permanent := nostr.Generate().Public()
+	expires := nostr.Timestamp(2_000_000_000)
+
+	if err := mgmt.RenewMember(expired, expires); err != nil {
+		t.Fatalf("RenewMember() error = %v", err)
+	}
+	if err := mgmt.AddMember(permanent); err != nil {
+		t.Fatalf("AddMember() error = %v", err)
+	}
+
+	withMembershipNow(t, expires)
+	n, err := mgmt.SweepExpiredMembers()
+	if err != nil {
+		t.Fatalf("SweepExpiredMembers() error = %v", err)
+	}
+	if n != 1 {
+		t.Errorf("SweepExpiredMembers() = %d, want 1", n)
+	}
+
+	tags := mgmt.Events.GetOrCreateRelayMembersList().Tags
+	if tags.FindWithValue("member", expired.Hex()) != nil {
+		t.Error("expired member tag should be removed")
+	}
+	if tags.FindWithValue("member", permanent.Hex()) == nil {
+		t.Error("permanent member tag should be kept")
+	}
+
+	removals := 0
+	filter := nostr.Filter{Kinds: []nostr.Kind{RELAY_REMOVE_MEMBER}, Tags: nostr.TagMap{"p": []string{expired.Hex()}}}
+	for range mgmt.Events.QueryEvents(filter, 0) {
+		removals++
+	}
+	if removals != 1 {
+		t.Errorf("expected one remove-member event, got %d", removals)
+	}
+}
+
+func TestManagementStore_GetAdmins_Dedup(t *testing.T) {
+	owner := nostr.Generate().Public()
+	moderator := nostr.Generate().Public()
+	config := &Config{
+		Host:   "test.com",
+		secret: nostr.Generate(),
+		Info:   Info{Pubkey: owner.Hex()},
+	}
+	self := config.GetSelf()
+	config.Roles = map[string]Role{
+		"admin":     {CanManage: true, Pubkeys: []string{owner.Hex(), self.Hex(), "not-a-pubkey", moderator.Hex()}},
+		"moderator": {CanManage: true, Pubkeys: []string{moderator.Hex(), owner.Hex()}},
+		"member":    {Pubkeys: []string{nostr.Generate().Public().Hex()}},
+	}
+	m := &ManagementStore{Config: config}
+
+	want := []nostr.PubKey{owner, self, moderator}
+	for range 10 {
+		if admins := m.GetAdmins(); !slices.Equal(admins, want) {
+			t.Fatalf("GetAdmins() = %v, want %v", admins, want)
+		}
+	}
+}
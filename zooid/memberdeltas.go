@@ -0,0 +1,179 @@
+package zooid
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"strconv"
+
+	"fiatjaf.com/nostr"
+)
+
+// Member list deltas.
+//
+// A group's 39002 lists every member, so clients of a large group would
+// download all of it on every change. Instead they can follow the deltas:
+// every change to a group's members is published as a relay-signed 9000
+// (put user) or 9001 (remove user), whether the relay made it, as when it
+// approves a join, or an admin published their own 9000 or 9001, which the
+// relay then signs again. Each delta carries ["seq", <n>], one more than the
+// group's previous one, and ["snapshot", <id>], the 39002 it follows. The
+// 39002 carries the seq of the latest change it includes.
+//
+// To sync a group, a client reads its 39002 and seq, then applies the
+// relay's 9000s and 9001s for the group in seq order, skipping those at or
+// below the snapshot's. Applying a delta is idempotent, since a snapshot may
+// already include changes after its seq. If a seq is missing, a delta was
+// lost, and the client reads the latest 39002 again. Sequence numbers are
+// kept in the kv store under zooid:<schema>:members_seq:<group>, shared by
+// replicas. The seq of an admin's change is allocated once, under
+// member_delta:<event id> until its delta is stored, so a dead letter retry
+// publishes it with the same seq instead of leaving a gap.
+
+func memberDeltaKV(events *EventStore) *KV {
+	return &KV{Name: "zooid:" + events.Schema.Name}
+}
+
+// MemberSeq returns the seq of the latest change to group h's members, 0 if
+// there's been none.
+func (g *GroupStore) MemberSeq(ctx context.Context, h string) (int64, error) {
+	value, err := memberDeltaKV(g.Events).Get(ctx, "members_seq:"+h)
+	if errors.Is(err, ErrKVNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// membersSnapshotID returns the id of group h's latest 39002.
+func (g *GroupStore) membersSnapshotID(h string) (nostr.ID, bool) {
+	if v, ok := g.memberSnapshots.Load(h); ok {
+		return v.(nostr.ID), true
+	}
+
+	filter := nostr.Filter{
+		Kinds:   []nostr.Kind{nostr.KindSimpleGroupMembers},
+		Authors: []nostr.PubKey{g.Config.GetSelf()},
+		Tags:    nostr.TagMap{"d": []string{h}},
+	}
+	for event := range g.Events.QueryEvents(filter, 1) {
+		g.memberSnapshots.Store(h, event.ID)
+		return event.ID, true
+	}
+
+	return nostr.ID{}, false
+}
+
+// publishMemberDelta signs and stores a delta of kind for group h, with
+// the p tags of the members it changes, dated createdAt, and the group's
+// next seq. Callers change the membership cache first, so a 39002 with this
+// delta's seq includes it.
+func (g *GroupStore) publishMemberDelta(kind nostr.Kind, h string, pTags []nostr.Tag, createdAt nostr.Timestamp) error {
+	ctx, cancel := context.WithTimeout(g.Events.rootCtx, dbOpTimeout)
+	defer cancel()
+
+	seq, err := memberDeltaKV(g.Events).Increment(ctx, "members_seq:"+h, 1)
+	if err != nil {
+		return err
+	}
+
+	return g.storeMemberDelta(kind, h, pTags, createdAt, seq)
+}
+
+// resignMemberDelta publishes the delta of an admin's 9000 or 9001 with the
+// seq allocated for it the first time it was tried.
+func (g *GroupStore) resignMemberDelta(event nostr.Event) error {
+	ctx, cancel := context.WithTimeout(g.Events.rootCtx, dbOpTimeout)
+	defer cancel()
+
+	h := GetGroupIDFromEvent(event)
+	key := "member_delta:" + event.ID.Hex()
+
+	seq, err := g.allocateMemberSeq(ctx, h, key)
+	if err != nil {
+		return err
+	}
+
+	if err := g.storeMemberDelta(event.Kind, h, slices.Collect(event.Tags.FindAll("p")), event.CreatedAt, seq); err != nil {
+		return err
+	}
+
+	if err := memberDeltaKV(g.Events).Delete(ctx, key); err != nil {
+		log.Printf("Failed to forget the seq of the delta for %s: %v", event.ID.Hex(), err)
+	}
+
+	return nil
+}
+
+// allocateMemberSeq returns the seq kept under key, taking group h's next
+// one and keeping it there if there's none yet.
+func (g *GroupStore) allocateMemberSeq(ctx context.Context, h string, key string) (int64, error) {
+	kv := memberDeltaKV(g.Events)
+
+	value, err := kv.Get(ctx, key)
+	if errors.Is(err, ErrKVNotFound) {
+		seq, err := kv.Increment(ctx, "members_seq:"+h, 1)
+		if err != nil {
+			return 0, err
+		}
+
+		stored, err := kv.SetIfAbsent(ctx, key, strconv.FormatInt(seq, 10))
+		if err != nil {
+			return 0, err
+		}
+		if stored {
+			return seq, nil
+		}
+
+		// Another attempt got there first, and its seq wins
+		value, err = kv.Get(ctx, key)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func (g *GroupStore) storeMemberDelta(kind nostr.Kind, h string, pTags []nostr.Tag, createdAt nostr.Timestamp, seq int64) error {
+	tags := make(nostr.Tags, 0, len(pTags)+3)
+	tags = append(tags, pTags...)
+	tags = append(tags, nostr.Tag{"h", h}, nostr.Tag{"seq", strconv.FormatInt(seq, 10)})
+	if id, ok := g.membersSnapshotID(h); ok {
+		tags = append(tags, nostr.Tag{"snapshot", id.Hex()})
+	}
+
+	event := nostr.Event{
+		Kind:      kind,
+		CreatedAt: createdAt,
+		Tags:      tags,
+	}
+
+	if err := g.Events.SignAndStoreEvent(&event, true); err != nil {
+		return err
+	}
+
+	g.recordActivity(event)
+
+	return nil
+}
+
+// isMemberDelta reports whether event is a relay-signed member list delta.
+func (g *GroupStore) isMemberDelta(event nostr.Event) bool {
+	return (event.Kind == nostr.KindSimpleGroupPutUser || event.Kind == nostr.KindSimpleGroupRemoveUser) &&
+		event.PubKey == g.Config.GetSelf()
+}
+
+// memberDeltaSteps returns steps with publish_member_delta first if event is
+// an admin's 9000 or 9001, which the relay signs again as a delta.
+func (instance *Instance) memberDeltaSteps(event nostr.Event, steps ...string) []string {
+	if instance.Groups.isMemberDelta(event) {
+		return steps
+	}
+
+	return append([]string{"publish_member_delta"}, steps...)
+}
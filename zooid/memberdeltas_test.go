@@ -0,0 +1,240 @@
+package zooid
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+// deltaSeq returns event's seq tag, 0 if it has none.
+func deltaSeq(event nostr.Event) int64 {
+	tag := event.Tags.Find("seq")
+	if tag == nil {
+		return 0
+	}
+	seq, _ := strconv.ParseInt(tag[1], 10, 64)
+	return seq
+}
+
+// memberSync follows a group's members the way the sync contract asks a
+// client to.
+type memberSync struct {
+	t        *testing.T
+	instance *Instance
+	h        string
+	members  map[nostr.PubKey]struct{}
+	seq      int64
+	reloads  int
+}
+
+// snapshot reads the group's 39002.
+func (s *memberSync) snapshot() {
+	s.t.Helper()
+
+	s.reloads++
+	s.members = make(map[nostr.PubKey]struct{})
+	list := firstEvent(s.t, s.instance, nostr.Filter{
+		Kinds: []nostr.Kind{nostr.KindSimpleGroupMembers},
+		Tags:  nostr.TagMap{"d": {s.h}},
+	})
+	for tag := range list.Tags.FindAll("p") {
+		s.members[nostr.MustPubKeyFromHex(tag[1])] = struct{}{}
+	}
+	s.seq = deltaSeq(list)
+}
+
+// catchUp applies the deltas after the last one seen, falling back to the
+// snapshot on a gap, and reports whether it did.
+func (s *memberSync) catchUp() (gap bool) {
+	s.t.Helper()
+
+	var deltas []nostr.Event
+	for event := range s.instance.Events.QueryEvents(nostr.Filter{
+		Kinds:   []nostr.Kind{nostr.KindSimpleGroupPutUser, nostr.KindSimpleGroupRemoveUser},
+		Authors: []nostr.PubKey{s.instance.Config.GetSelf()},
+		Tags:    nostr.TagMap{"h": {s.h}},
+	}, 0) {
+		if deltaSeq(event) > s.seq {
+			deltas = append(deltas, event)
+		}
+	}
+	slices.SortFunc(deltas, func(a, b nostr.Event) int { return cmp.Compare(deltaSeq(a), deltaSeq(b)) })
+
+	for _, delta := range deltas {
+		if deltaSeq(delta) != s.seq+1 {
+			s.snapshot()
+			return true
+		}
+		for tag := range delta.Tags.FindAll("p") {
+			if delta.Kind == nostr.KindSimpleGroupPutUser {
+				s.members[nostr.MustPubKeyFromHex(tag[1])] = struct{}{}
+			} else {
+				delete(s.members, nostr.MustPubKeyFromHex(tag[1]))
+			}
+		}
+		s.seq = deltaSeq(delta)
+	}
+
+	return false
+}
+
+func (s *memberSync) assertMembers(want ...nostr.PubKey) {
+	s.t.Helper()
+
+	if len(s.members) != len(want) {
+		s.t.Errorf("synced %d members, want %d", len(s.members), len(want))
+	}
+	for _, pubkey := range want {
+		if _, ok := s.members[pubkey]; !ok {
+			s.t.Errorf("synced members are missing %s", pubkey.Hex())
+		}
+	}
+}
+
+func TestMemberDeltas_Sequence(t *testing.T) {
+	instance := createTestInstance()
+	runTestAdmin(t, instance, "create-group", "big")
+	owner := instance.Config.secret.Public()
+
+	alice, bob := nostr.Generate().Public(), nostr.Generate().Public()
+	for _, pubkey := range []nostr.PubKey{alice, bob} {
+		if err := instance.Groups.AddMember("big", pubkey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := instance.Groups.UpdateMembersList("big"); err != nil {
+		t.Fatal(err)
+	}
+
+	list := firstEvent(t, instance, nostr.Filter{Kinds: []nostr.Kind{nostr.KindSimpleGroupMembers}, Tags: nostr.TagMap{"d": {"big"}}})
+	if seq := deltaSeq(list); seq != 3 {
+		t.Fatalf("members list has seq %d, want 3 after the owner, alice and bob", seq)
+	}
+
+	// An admin's own 9000 is signed again by the relay, following the list
+	moderator := nostr.Generate()
+	instance.Config.Roles["admin"] = Role{Pubkeys: []string{owner.Hex(), moderator.Public().Hex()}, CanManage: true}
+	admin := signedBy(moderator, nostr.Event{
+		Kind: nostr.KindSimpleGroupPutUser,
+		Tags: nostr.Tags{{"h", "big"}, {"p", alice.Hex(), "moderator"}},
+	})
+	if err := instance.Events.SaveEvent(admin); err != nil {
+		t.Fatal(err)
+	}
+	instance.OnEventSaved(context.Background(), admin)
+
+	var delta nostr.Event
+	for event := range instance.Events.QueryEvents(nostr.Filter{
+		Kinds:   []nostr.Kind{nostr.KindSimpleGroupPutUser},
+		Authors: []nostr.PubKey{instance.Config.GetSelf()},
+		Tags:    nostr.TagMap{"h": {"big"}},
+	}, 0) {
+		if deltaSeq(event) == 4 {
+			delta = event
+		}
+	}
+	if tag := delta.Tags.Find("p"); len(tag) != 3 || tag[1] != alice.Hex() || tag[2] != "moderator" {
+		t.Errorf("delta p tag = %v", tag)
+	}
+	if tag := delta.Tags.Find("snapshot"); tag == nil || tag[1] != list.ID.Hex() {
+		t.Errorf("delta snapshot = %v, want %s", tag, list.ID.Hex())
+	}
+
+	sync := &memberSync{t: t, instance: instance, h: "big"}
+	sync.snapshot()
+	sync.catchUp()
+	sync.assertMembers(owner, alice, bob)
+	if sync.seq != 4 {
+		t.Errorf("synced to seq %d, want 4", sync.seq)
+	}
+
+	if err := instance.Groups.RemoveMember("big", bob); err != nil {
+		t.Fatal(err)
+	}
+	if sync.catchUp() {
+		t.Error("gap after removing bob")
+	}
+	sync.assertMembers(owner, alice)
+}
+
+func TestMemberDeltas_GapFallsBackToSnapshot(t *testing.T) {
+	instance := createTestInstance()
+	runTestAdmin(t, instance, "create-group", "big")
+	owner := instance.Config.secret.Public()
+
+	sync := &memberSync{t: t, instance: instance, h: "big"}
+	sync.snapshot()
+
+	alice, bob, carol := nostr.Generate().Public(), nostr.Generate().Public(), nostr.Generate().Public()
+	for _, pubkey := range []nostr.PubKey{alice, bob, carol} {
+		if err := instance.Groups.AddMember("big", pubkey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := instance.Groups.UpdateMembersList("big"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lose bob's delta
+	lost := firstEvent(t, instance, nostr.Filter{
+		Kinds: []nostr.Kind{nostr.KindSimpleGroupPutUser},
+		Tags:  nostr.TagMap{"h": {"big"}, "p": {bob.Hex()}},
+	})
+	if err := instance.Events.DeleteEvent(lost.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if !sync.catchUp() {
+		t.Fatal("the missing delta went unnoticed")
+	}
+	if sync.reloads != 2 {
+		t.Errorf("read the snapshot %d times, want 2", sync.reloads)
+	}
+	sync.assertMembers(owner, alice, bob, carol)
+	if sync.seq != 4 {
+		t.Errorf("resumed from seq %d, want 4", sync.seq)
+	}
+}
+
+func TestMemberDeltas_RetryKeepsSeq(t *testing.T) {
+	instance := createTestInstance()
+	runTestAdmin(t, instance, "create-group", "big")
+	ctx := context.Background()
+
+	alice := nostr.Generate().Public()
+	admin := signedBy(instance.Config.secret, nostr.Event{
+		Kind: nostr.KindSimpleGroupPutUser,
+		Tags: nostr.Tags{{"h", "big"}, {"p", alice.Hex()}},
+	})
+
+	// A first attempt took a seq, then failed to store the delta
+	key := "member_delta:" + admin.ID.Hex()
+	seq, err := instance.Groups.allocateMemberSeq(ctx, "big", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := instance.Groups.AddMember("big", nostr.Generate().Public()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sideEffects["publish_member_delta"](instance, admin); err != nil {
+		t.Fatal(err)
+	}
+
+	delta := firstEvent(t, instance, nostr.Filter{
+		Kinds:   []nostr.Kind{nostr.KindSimpleGroupPutUser},
+		Authors: []nostr.PubKey{instance.Config.GetSelf()},
+		Tags:    nostr.TagMap{"h": {"big"}, "p": {alice.Hex()}},
+	})
+	if got := deltaSeq(delta); got != seq {
+		t.Errorf("retried delta has seq %d, want %d from the first attempt", got, seq)
+	}
+	if _, err := memberDeltaKV(instance.Events).Get(ctx, key); !errors.Is(err, ErrKVNotFound) {
+		t.Errorf("the seq is still kept after the delta was stored: %v", err)
+	}
+}
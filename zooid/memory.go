@@ -0,0 +1,608 @@
+package zooid
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"iter"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// In-memory storage.
+//
+// DATABASE_URL=memory:// keeps events and kv in the process instead of a
+// database, for tests that shouldn't need one (see the zooidtest package)
+// and for trying a relay out. Nothing survives the process, but an instance
+// that is stopped and loaded again finds its schema's events as it left
+// them, as it would in a database. Queries scan every event of the schema,
+// so it's no place for a real relay's history.
+//
+// Filters match as they do in SQL, tags included, so only the tags that
+// would be in event_tags (see taglimits.go) can be filtered on. Search works
+// as on SQLite: words and phrases match whole, ignoring case and diacritics,
+// without stemming. Backups, compression, native_schema, reindexing and
+// table sizes need a database.
+
+var (
+	memoryTablesMu sync.Mutex
+	memoryTables   = make(map[string]*memorySchema) // schema name -> tables
+)
+
+// memorySchema is the events and event_tags tables of one schema.
+type memorySchema struct {
+	mu     sync.RWMutex
+	events []memoryEvent // newest first
+	ids    map[nostr.ID]struct{}
+}
+
+// memoryEvent is a stored event, the tags event_tags would have for it, when
+// it was received and when it was soft-deleted, if it was.
+type memoryEvent struct {
+	event      nostr.Event
+	tags       []nostr.Tag
+	receivedAt nostr.Timestamp
+	deletedAt  nostr.Timestamp
+}
+
+// memoryTablesFor returns the tables of the schema called name, creating
+// them the first time.
+func memoryTablesFor(name string) *memorySchema {
+	memoryTablesMu.Lock()
+	defer memoryTablesMu.Unlock()
+
+	tables, ok := memoryTables[name]
+	if !ok {
+		tables = &memorySchema{ids: make(map[nostr.ID]struct{})}
+		memoryTables[name] = tables
+	}
+
+	return tables
+}
+
+// memoryEvents keeps an EventStore's events in its schema's memorySchema.
+type memoryEvents struct {
+	*EventStore
+	tables *memorySchema
+}
+
+func (events memoryEvents) query(filter nostr.Filter, maxLimit int, order queryOrder) iter.Seq[nostr.Event] {
+	return func(yield func(nostr.Event) bool) {
+		if filter.LimitZero {
+			return
+		}
+
+		if maxLimit > 0 && (filter.Limit == 0 || maxLimit < filter.Limit) {
+			filter.Limit = maxLimit
+		}
+
+		// Timed like the SQL queries, so the metrics and the tests that
+		// count queries by them work the same
+		totalObserver := QueryDuration.WithLabelValues(events.Config.Schema)
+		dbObserver := QueryDBDuration.WithLabelValues(events.Config.Schema)
+		drainObserver := QueryDrainDuration.WithLabelValues(events.Config.Schema)
+		queryStart := time.Now()
+		var drainTotal time.Duration
+		defer func() {
+			observeQueryTimings(totalObserver, dbObserver, drainObserver, queryStart, drainTotal)
+		}()
+
+		// Copied out first, so the caller can write while iterating and
+		// can't change the stored events
+		events.tables.mu.RLock()
+		var found []nostr.Event
+		for stored := range events.tables.matching(filter) {
+			found = append(found, cloneEvent(stored.event))
+			if order == newestFirst && filter.Limit > 0 && len(found) >= filter.Limit {
+				break
+			}
+		}
+		events.tables.mu.RUnlock()
+
+		if order == oldestFirst {
+			slices.SortFunc(found, CompareEvents)
+			if filter.Limit > 0 && len(found) > filter.Limit {
+				found = found[:filter.Limit]
+			}
+		}
+
+		for _, evt := range found {
+			yieldStart := time.Now()
+			cont := yield(evt)
+			drainTotal += time.Since(yieldStart)
+			if !cont {
+				return
+			}
+		}
+	}
+}
+
+func (events memoryEvents) count(filter nostr.Filter) (uint32, error) {
+	events.tables.mu.RLock()
+	defer events.tables.mu.RUnlock()
+
+	var count uint32
+	for range events.tables.matching(filter) {
+		count++
+	}
+
+	return count, nil
+}
+
+func (events memoryEvents) membership(h string, pubkey nostr.PubKey) (nostr.Kind, bool, error) {
+	filter := nostr.Filter{
+		Kinds: []nostr.Kind{nostr.KindSimpleGroupPutUser, nostr.KindSimpleGroupRemoveUser},
+		Tags:  nostr.TagMap{"p": []string{pubkey.Hex()}, "h": []string{h}},
+	}
+
+	events.tables.mu.RLock()
+	defer events.tables.mu.RUnlock()
+
+	// Newest first, so only events of the first second are compared
+	var latest *nostr.Event
+	for stored := range events.tables.matching(filter) {
+		if latest != nil && stored.event.CreatedAt < latest.CreatedAt {
+			break
+		}
+		if latest == nil || bytes.Compare(stored.event.ID[:], latest.ID[:]) > 0 {
+			latest = &stored.event
+		}
+	}
+	if latest == nil {
+		return 0, false, nil
+	}
+
+	return latest.Kind, true, nil
+}
+
+func (events memoryEvents) save(evt nostr.Event) error {
+	stored := events.stored(evt)
+
+	events.tables.mu.Lock()
+	defer events.tables.mu.Unlock()
+
+	return events.tables.insert(stored)
+}
+
+// replace decides and writes under one lock, which is what the serializable
+// transaction buys on PostgreSQL.
+func (events memoryEvents) replace(evt nostr.Event) error {
+	stored := events.stored(evt)
+
+	events.tables.mu.Lock()
+	defer events.tables.mu.Unlock()
+
+	previous := func(yield func(nostr.Event) bool) {
+		for match := range events.tables.matching(replaceableFilter(evt)) {
+			if !yield(match.event) {
+				return
+			}
+		}
+	}
+
+	save, replaced := replacement(evt, previous)
+
+	if save {
+		if err := events.tables.insert(stored); err != nil && err != eventstore.ErrDupEvent {
+			return fmt.Errorf("failed to save: %w", err)
+		}
+	}
+
+	for _, id := range replaced {
+		events.tables.remove(id)
+	}
+
+	return nil
+}
+
+func (events memoryEvents) delete(id nostr.ID) error {
+	events.tables.mu.Lock()
+	defer events.tables.mu.Unlock()
+
+	events.tables.remove(id)
+
+	return nil
+}
+
+// stored returns evt as the tables keep it, sharing nothing with the caller.
+func (events memoryEvents) stored(evt nostr.Event) memoryEvent {
+	evt = cloneEvent(evt)
+
+	return memoryEvent{event: evt, tags: events.indexedTags(evt), receivedAt: receivedNow()}
+}
+
+// stats counts what collectStats would count in the tables.
+func (events memoryEvents) stats() EventStats {
+	events.tables.mu.RLock()
+	defer events.tables.mu.RUnlock()
+
+	stats := EventStats{CollectedAt: nostr.Now(), TopKinds: make([]KindCount, 0)}
+	kinds := make(map[nostr.Kind]int64)
+	hourAgo := receivedNow() - 3600
+
+	for i, stored := range events.tables.events {
+		if stored.receivedAt >= hourAgo {
+			stats.ReceivedLastHour++
+		}
+		if i == 0 {
+			stats.NewestCreatedAt = stored.event.CreatedAt
+		}
+		stats.OldestCreatedAt = stored.event.CreatedAt
+		stats.Events++
+		stats.TagRows += int64(len(stored.tags))
+		kinds[stored.event.Kind]++
+	}
+
+	for kind, count := range kinds {
+		stats.TopKinds = append(stats.TopKinds, KindCount{Kind: kind, Count: count})
+	}
+	slices.SortFunc(stats.TopKinds, func(a, b KindCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Kind, b.Kind))
+	})
+	if len(stats.TopKinds) > statsTopKinds {
+		stats.TopKinds = stats.TopKinds[:statsTopKinds]
+	}
+
+	return stats
+}
+
+// matching yields the stored events matching filter, newest first, ignoring
+// its limit. The caller holds the lock.
+func (tables *memorySchema) matching(filter nostr.Filter) iter.Seq[memoryEvent] {
+	return func(yield func(memoryEvent) bool) {
+		for _, stored := range tables.events {
+			if stored.matches(filter) && !yield(stored) {
+				return
+			}
+		}
+	}
+}
+
+// insert adds stored in the order buildSelectQuery returns events in: newest
+// first, with ties broken by the higher id. The caller holds the lock.
+func (tables *memorySchema) insert(stored memoryEvent) error {
+	if _, ok := tables.ids[stored.event.ID]; ok {
+		return eventstore.ErrDupEvent
+	}
+
+	i := sort.Search(len(tables.events), func(i int) bool {
+		return CompareEvents(tables.events[i].event, stored.event) < 0
+	})
+	tables.events = slices.Insert(tables.events, i, stored)
+	tables.ids[stored.event.ID] = struct{}{}
+
+	return nil
+}
+
+// index returns where the event with id is in tables.events, or -1. The
+// caller holds the lock.
+func (tables *memorySchema) index(id nostr.ID) int {
+	if _, ok := tables.ids[id]; !ok {
+		return -1
+	}
+
+	return slices.IndexFunc(tables.events, func(stored memoryEvent) bool {
+		return stored.event.ID == id
+	})
+}
+
+// remove deletes the event with id, if it's stored. The caller holds the
+// lock.
+func (tables *memorySchema) remove(id nostr.ID) {
+	if _, ok := tables.ids[id]; !ok {
+		return
+	}
+
+	tables.events = slices.DeleteFunc(tables.events, func(stored memoryEvent) bool {
+		return stored.event.ID == id
+	})
+	delete(tables.ids, id)
+}
+
+// matches reports whether the event matches filter the way buildSelectQuery
+// would: tag conditions only look at single-letter keys with values, and
+// only at the indexed tags, and soft-deleted events match nothing.
+func (stored memoryEvent) matches(filter nostr.Filter) bool {
+	evt := stored.event
+
+	if stored.deletedAt != 0 {
+		return false
+	}
+
+	if len(filter.IDs) > 0 && !slices.Contains(filter.IDs, evt.ID) {
+		return false
+	}
+	if len(filter.Authors) > 0 && !slices.Contains(filter.Authors, evt.PubKey) {
+		return false
+	}
+	if len(filter.Kinds) > 0 && !slices.Contains(filter.Kinds, evt.Kind) {
+		return false
+	}
+	if filter.Since != 0 && evt.CreatedAt < filter.Since {
+		return false
+	}
+	if until, ok := untilBound(filter); ok && evt.CreatedAt > until {
+		return false
+	}
+
+	for key, values := range filter.Tags {
+		if len(values) == 0 || len(key) != 1 {
+			continue
+		}
+		found := slices.ContainsFunc(stored.tags, func(tag nostr.Tag) bool {
+			return tag[0] == key && slices.Contains(values, tag[1])
+		})
+		if !found {
+			return false
+		}
+	}
+
+	if filter.Search != "" && !matchesSearch(evt, filter.Search) {
+		return false
+	}
+
+	return true
+}
+
+// matchesSearch matches evt against search the way the SQLite search table
+// would, see parseSearch. Content and tags are searched separately, so a
+// phrase can't start in one and end in the other.
+func matchesSearch(evt nostr.Event, search string) bool {
+	clauses, exclude := parseSearch(search)
+	if len(clauses) == 0 {
+		return false
+	}
+
+	// The same tags as searchVector
+	var tags []string
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && slices.Contains([]string{"t", "title", "summary", "subject"}, tag[0]) {
+			tags = append(tags, tag[1])
+		}
+	}
+
+	documents := [][]string{searchWords(evt.Content), searchWords(strings.Join(tags, " "))}
+
+	contains := func(term string) bool {
+		phrase := searchWords(term)
+		if len(phrase) == 0 {
+			return false
+		}
+		for _, words := range documents {
+			for i := 0; i+len(phrase) <= len(words); i++ {
+				if slices.Equal(words[i:i+len(phrase)], phrase) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	for _, clause := range clauses {
+		if !slices.ContainsFunc(clause, contains) {
+			return false
+		}
+	}
+
+	return !slices.ContainsFunc(exclude, contains)
+}
+
+// searchWords splits text into lowercase words without diacritics, like
+// SQLite's unicode61 tokenizer.
+func searchWords(text string) []string {
+	folded, _, err := transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), text)
+	if err != nil {
+		folded = text
+	}
+
+	return strings.FieldsFunc(strings.ToLower(folded), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func cloneEvent(evt nostr.Event) nostr.Event {
+	tags := make(nostr.Tags, len(evt.Tags))
+	for i, tag := range evt.Tags {
+		tags[i] = slices.Clone(tag)
+	}
+	evt.Tags = tags
+
+	return evt
+}
+
+// memoryKV is the kv table, for KeyValueStore in memory.
+type memoryKV struct {
+	mu   sync.Mutex
+	rows map[string]memoryKVRow
+}
+
+type memoryKVRow struct {
+	value     string
+	expiresAt *int64 // nil if the key never expires
+}
+
+func newMemoryKV() *memoryKV {
+	return &memoryKV{rows: make(map[string]memoryKVRow)}
+}
+
+// live returns the row for key, unless it's missing or expired. The caller
+// holds the lock.
+func (m *memoryKV) live(key string) (memoryKVRow, bool) {
+	row, ok := m.rows[key]
+	if !ok || (row.expiresAt != nil && *row.expiresAt <= kvNow()) {
+		return memoryKVRow{}, false
+	}
+
+	return row, true
+}
+
+func (m *memoryKV) get(key string) (string, *int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	row, ok := m.live(key)
+	if !ok {
+		return "", nil, fmt.Errorf("%w: %s", ErrKVNotFound, key)
+	}
+
+	return row.value, row.expiresAt, nil
+}
+
+func (m *memoryKV) set(key string, value string, expiresAt *int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rows[key] = memoryKVRow{value: value, expiresAt: expiresAt}
+}
+
+func (m *memoryKV) compareAndSwap(key string, old string, new string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	row, ok := m.live(key)
+	if !ok || row.value != old {
+		return false
+	}
+
+	row.value = new
+	m.rows[key] = row
+
+	return true
+}
+
+func (m *memoryKV) setIfAbsent(key string, value string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.live(key); ok {
+		return false
+	}
+
+	m.rows[key] = memoryKVRow{value: value}
+
+	return true
+}
+
+func (m *memoryKV) increment(key string, delta int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	row, ok := m.live(key)
+	if !ok {
+		row = memoryKVRow{value: "0"}
+	}
+
+	current, err := strconv.ParseInt(row.value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("kv increment %q: %w", key, err)
+	}
+
+	row.value = strconv.FormatInt(current+delta, 10)
+	m.rows[key] = row
+
+	return current + delta, nil
+}
+
+// incrementMany is increment for IncrementMany, giving keys it creates
+// expiresAt. Every value is parsed before any is written, so a key that
+// isn't a number leaves them all unchanged.
+func (m *memoryKV) incrementMany(items []KeyDelta, expiresAt *int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rows := make(map[string]memoryKVRow, len(items))
+	for _, item := range items {
+		row, ok := rows[item.Key]
+		if !ok {
+			if row, ok = m.live(item.Key); !ok {
+				row = memoryKVRow{value: "0", expiresAt: expiresAt}
+			}
+		}
+
+		current, err := strconv.ParseInt(row.value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("kv increment many %q: %w", item.Key, err)
+		}
+
+		row.value = strconv.FormatInt(current+item.Delta, 10)
+		rows[item.Key] = row
+	}
+
+	for key, row := range rows {
+		m.rows[key] = row
+	}
+
+	return nil
+}
+
+func (m *memoryKV) delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.rows, key)
+}
+
+func (m *memoryKV) list(prefix string) []KeyValue {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	items := make([]KeyValue, 0)
+	for key := range m.rows {
+		if row, ok := m.live(key); ok && strings.HasPrefix(key, prefix) {
+			items = append(items, KeyValue{Key: key, Value: row.value})
+		}
+	}
+	slices.SortFunc(items, func(a, b KeyValue) int { return strings.Compare(a.Key, b.Key) })
+
+	return items
+}
+
+func (m *memoryKV) deleteExpired() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	for key := range m.rows {
+		if _, ok := m.live(key); !ok {
+			delete(m.rows, key)
+			n++
+		}
+	}
+
+	return n
+}
+
+// errNeedsDatabase is returned by what can't be done in memory.
+func errNeedsDatabase(what string) error {
+	return fmt.Errorf("%s needs a database, DATABASE_URL is memory://", what)
+}
+
+// deleteMatchingBatch deletes up to retentionDeleteBatchSize events matching
+// filter, for retention in memory, where there's no SQL to run.
+func deleteMatchingBatch(ctx context.Context, inst *Instance, filter nostr.Filter) (rowsAffected int64, more bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, false, err
+	}
+
+	filter.Limit = retentionDeleteBatchSize
+	for evt := range inst.Events.QueryEvents(filter, 0) {
+		if err := inst.Events.DeleteEvent(evt.ID); err != nil {
+			return rowsAffected, false, fmt.Errorf("exec delete: %w", err)
+		}
+		rowsAffected++
+	}
+
+	return rowsAffected, rowsAffected >= retentionDeleteBatchSize, nil
+}
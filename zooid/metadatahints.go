@@ -0,0 +1,82 @@
+package zooid
+
+import (
+	"slices"
+	"strconv"
+
+	"fiatjaf.com/nostr"
+)
+
+// Group metadata hints.
+//
+// The relay stamps each group's 39000 with tags clients can use to sort and
+// badge groups without reading their members or messages: ["updated_at", ts],
+// when the metadata was last edited, since the event's own created_at moves
+// whenever the hints do; ["member_count", n]; and ["last_message_at", ts],
+// the created_at of the group's latest chat message. The content JSON is
+// left as the editor wrote it. Hints a client puts on a 9002 are replaced by
+// the relay's, so an edit keeps them current. Private groups get only
+// updated_at, since the others give away who's in them and when they talk.
+// Joins and leaves schedule a rewrite of the 39000, debounced like the
+// members list, when they change member_count. Posts only move
+// last_message_at, which isn't worth a new 39000 on its own: it's brought up
+// to date the next time the 39000 is written for a join, leave or edit.
+
+// metadataHints are the tags the relay maintains on a group's 39000.
+var metadataHints = []string{"updated_at", "member_count", "last_message_at"}
+
+func isMetadataHint(tag nostr.Tag) bool {
+	return len(tag) >= 1 && slices.Contains(metadataHints, tag[0])
+}
+
+// metadataHintTags returns group h's hints, with updatedAt as the time its
+// metadata was last edited.
+func (g *GroupStore) metadataHintTags(h string, private bool, updatedAt nostr.Timestamp) nostr.Tags {
+	tags := nostr.Tags{{"updated_at", strconv.FormatInt(int64(updatedAt), 10)}}
+	if private {
+		return tags
+	}
+
+	tags = append(tags, nostr.Tag{"member_count", strconv.Itoa(g.GetMemberCount(h))})
+	if at := g.lastMessageAt(h); at > 0 {
+		tags = append(tags, nostr.Tag{"last_message_at", strconv.FormatInt(int64(at), 10)})
+	}
+
+	return tags
+}
+
+// lastMessageAt returns the created_at of group h's latest chat message, 0
+// if it has none.
+func (g *GroupStore) lastMessageAt(h string) nostr.Timestamp {
+	if v, ok := g.lastMessages.Load(h); ok {
+		return v.(nostr.Timestamp)
+	}
+
+	var at nostr.Timestamp
+	filter := nostr.Filter{
+		Kinds: chatKinds,
+		Tags:  nostr.TagMap{"h": []string{h}},
+	}
+	for event := range g.Events.QueryEvents(filter, 1) {
+		at = event.CreatedAt
+	}
+
+	if v, loaded := g.lastMessages.LoadOrStore(h, at); loaded {
+		return v.(nostr.Timestamp)
+	}
+
+	return at
+}
+
+// recordLastMessage remembers event as its group's latest chat message,
+// unless a later one is already known.
+func (g *GroupStore) recordLastMessage(event nostr.Event) {
+	h := GetGroupIDFromEvent(event)
+	current := g.lastMessageAt(h)
+	for current < event.CreatedAt {
+		if g.lastMessages.CompareAndSwap(h, current, event.CreatedAt) {
+			return
+		}
+		current = g.lastMessageAt(h)
+	}
+}
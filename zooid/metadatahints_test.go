@@ -0,0 +1,76 @@
+package zooid
+
+import (
+	"strconv"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestMetadataHints_Refresh(t *testing.T) {
+	instance := createTestInstance()
+	runTestAdmin(t, instance, "create-group", "lobby", "--name", "Lobby")
+	runTestAdmin(t, instance, "create-group", "secret", "--private")
+
+	hint := func(h, name string) string {
+		t.Helper()
+
+		meta, found := instance.Groups.GetMetadata(h)
+		if !found {
+			t.Fatalf("no metadata for %s", h)
+		}
+		return findTagValue(meta.Tags, name)
+	}
+
+	created := hint("lobby", "updated_at")
+	if created == "" || hint("lobby", "member_count") != "1" || hint("lobby", "last_message_at") != "" {
+		t.Errorf("hints on a new group: updated_at %q, member_count %q, last_message_at %q",
+			created, hint("lobby", "member_count"), hint("lobby", "last_message_at"))
+	}
+
+	// A post is only recorded, the 39000 isn't rewritten for it
+	before, _ := instance.Groups.GetMetadata("lobby")
+	alice := nostr.Generate()
+	posted := saveGroupEvent(t, instance, alice, nostr.Event{
+		Kind:    nostr.KindSimpleGroupChatMessage,
+		Content: "hello",
+		Tags:    nostr.Tags{{"h", "lobby"}},
+	}).CreatedAt
+	if after, _ := instance.Groups.GetMetadata("lobby"); after.ID != before.ID {
+		t.Errorf("a post rewrote the 39000: %s", after.Tags)
+	}
+
+	// A join refreshes member_count, and last_message_at with it
+	saveGroupEvent(t, instance, alice, nostr.Event{Kind: nostr.KindSimpleGroupJoinRequest, Tags: nostr.Tags{{"h", "lobby"}}})
+	if n := hint("lobby", "member_count"); n != "2" {
+		t.Errorf("member_count after a join = %q, want 2", n)
+	}
+	if at := hint("lobby", "last_message_at"); at != strconv.FormatInt(int64(posted), 10) {
+		t.Errorf("last_message_at after a join = %q, want %d", at, posted)
+	}
+	if at := hint("lobby", "updated_at"); at != created {
+		t.Errorf("updated_at after a join = %q, want %q", at, created)
+	}
+
+	// An edit keeps the relay's hints, not the editor's
+	edited := saveGroupEvent(t, instance, instance.Config.secret, nostr.Event{
+		Kind:    nostr.KindSimpleGroupEditMetadata,
+		Content: `{"name":"Lobby","about":"Say hi"}`,
+		Tags:    nostr.Tags{{"h", "lobby"}, {"member_count", "999"}, {"last_message_at", "1"}},
+	}).CreatedAt
+	if meta, _ := instance.Groups.GetMetadata("lobby"); meta.Content != `{"name":"Lobby","about":"Say hi"}` {
+		t.Errorf("content after an edit = %s", meta.Content)
+	}
+	if at := hint("lobby", "updated_at"); at != strconv.FormatInt(int64(edited), 10) {
+		t.Errorf("updated_at after an edit = %q, want %d", at, edited)
+	}
+	if n, at := hint("lobby", "member_count"), hint("lobby", "last_message_at"); n != "2" || at != strconv.FormatInt(int64(posted), 10) {
+		t.Errorf("hints after an edit: member_count %q, last_message_at %q", n, at)
+	}
+
+	// Private groups only say when they were edited
+	saveGroupEvent(t, instance, instance.Config.secret, nostr.Event{Kind: nostr.KindSimpleGroupChatMessage, Content: "psst", Tags: nostr.Tags{{"h", "secret"}}})
+	if hint("secret", "updated_at") == "" || hint("secret", "member_count") != "" || hint("secret", "last_message_at") != "" {
+		t.Error("private group metadata has activity hints")
+	}
+}
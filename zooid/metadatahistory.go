@@ -0,0 +1,143 @@
+package zooid
+
+import (
+	"errors"
+	"fmt"
+
+	"fiatjaf.com/nostr"
+)
+
+// Group metadata history.
+//
+// A group's 39000 only holds its current metadata, but every version it has
+// had is still in the log, as the kind 9007 that created the group and the
+// kind 9002 edits since. GetMetadataHistory lists them, newest first, and
+// RestoreMetadata publishes an old version again: as a 9002 signed by the
+// relay, so the restore shows up in the history itself, and then as the
+// current 39000. Only the people who could have made the edit may restore
+// it, see canEditMetadata.
+
+// MetadataVersion is one version of a group's metadata.
+type MetadataVersion struct {
+	ID        nostr.ID        `json:"id"`
+	Kind      nostr.Kind      `json:"kind"`
+	PubKey    nostr.PubKey    `json:"pubkey"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+	Content   string          `json:"content"`
+	Tags      nostr.Tags      `json:"tags"`
+}
+
+var ErrVersionNotFound = errors.New("no such metadata version for this group")
+
+var metadataKinds = []nostr.Kind{nostr.KindSimpleGroupCreateGroup, nostr.KindSimpleGroupEditMetadata}
+
+func newMetadataVersion(event nostr.Event) MetadataVersion {
+	tags := make(nostr.Tags, 0, len(event.Tags))
+	for _, tag := range event.Tags {
+		if len(tag) >= 1 && tag[0] == "h" || isMetadataHint(tag) {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+
+	return MetadataVersion{
+		ID:        event.ID,
+		Kind:      event.Kind,
+		PubKey:    event.PubKey,
+		CreatedAt: event.CreatedAt,
+		Content:   event.Content,
+		Tags:      tags,
+	}
+}
+
+// GetMetadataHistory returns up to limit versions of h's metadata, newest
+// first.
+func (g *GroupStore) GetMetadataHistory(h string, limit int) []MetadataVersion {
+	filter := nostr.Filter{
+		Kinds: metadataKinds,
+		Tags:  nostr.TagMap{"h": []string{h}},
+	}
+
+	versions := make([]MetadataVersion, 0)
+	for event := range g.Events.QueryEvents(filter, limit) {
+		versions = append(versions, newMetadataVersion(event))
+	}
+
+	return versions
+}
+
+// GetMetadataVersion returns the version of h's metadata published by the
+// event with id.
+func (g *GroupStore) GetMetadataVersion(h string, id nostr.ID) (MetadataVersion, error) {
+	filter := nostr.Filter{
+		IDs:   []nostr.ID{id},
+		Kinds: metadataKinds,
+		Tags:  nostr.TagMap{"h": []string{h}},
+	}
+
+	for event := range g.Events.QueryEvents(filter, 1) {
+		return newMetadataVersion(event), nil
+	}
+
+	return MetadataVersion{}, ErrVersionNotFound
+}
+
+// canEditMetadata reports whether pubkey may edit h's metadata, by the same
+// rules CheckWrite applies to a kind 9002, content being the new metadata.
+// The relay itself always may.
+func (g *GroupStore) canEditMetadata(h string, pubkey nostr.PubKey, content string) bool {
+	if g.Config.IsSelf(pubkey) {
+		return true
+	}
+
+	if g.IsPrivateGroup(h) && !g.Config.Groups.PrivateRelayAdminAccess {
+		if !g.IsGroupCreator(h, pubkey) {
+			return false
+		}
+	} else if !g.Config.CanManage(pubkey) && !g.IsGroupCreator(h, pubkey) {
+		return false
+	}
+
+	// Only relay admins can change the write-restricted flag
+	return g.Config.CanManage(pubkey) || g.IsWriteRestricted(h) == isWriteRestrictedGroupContent(content)
+}
+
+// RestoreMetadata makes the version of h's metadata published by the event
+// with id current again, on behalf of by. It returns the kind 9002 the relay
+// published for it.
+func (g *GroupStore) RestoreMetadata(h string, id nostr.ID, by nostr.PubKey) (nostr.Event, error) {
+	if _, found := g.GetMetadata(h); !found {
+		return nostr.Event{}, fmt.Errorf("group %q not found", h)
+	}
+
+	version, err := g.GetMetadataVersion(h, id)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+
+	if !g.canEditMetadata(h, by, version.Content) {
+		return nostr.Event{}, errors.New(RejectRestricted.Reason("you are not authorized to edit this group's metadata"))
+	}
+
+	event := nostr.Event{
+		Kind:      nostr.KindSimpleGroupEditMetadata,
+		CreatedAt: nostr.Now(),
+		Content:   version.Content,
+		Tags:      append(nostr.Tags{{"h", h}}, version.Tags...),
+	}
+
+	if err := g.Events.SignAndStoreEvent(&event, true); err != nil {
+		return nostr.Event{}, err
+	}
+
+	// What OnEventSaved does for a 9002; whether the group is private
+	// decides who its admins are
+	if err := g.UpdateMetadata(event); err != nil {
+		return event, err
+	}
+	if err := g.UpdateAdminsList(h); err != nil {
+		return event, err
+	}
+
+	return event, nil
+}
@@ -0,0 +1,74 @@
+package zooid
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestMetadataHistory_EditAndRestore(t *testing.T) {
+	instance := createTestInstance()
+	creator := nostr.Generate()
+
+	publish := func(kind nostr.Kind, name string, age nostr.Timestamp) nostr.Event {
+		t.Helper()
+
+		content, _ := json.Marshal(map[string]any{"name": name})
+		event := nostr.Event{Kind: kind, CreatedAt: nostr.Now() - age, Content: string(content), Tags: nostr.Tags{{"h", "history"}}}
+		event.Sign(creator)
+		if err := instance.Events.StoreEvent(event); err != nil {
+			t.Fatalf("StoreEvent failed: %v", err)
+		}
+		instance.OnEventSaved(context.Background(), event)
+
+		return event
+	}
+	currentName := func() string {
+		t.Helper()
+
+		metadata, found := instance.Groups.GetMetadata("history")
+		if !found {
+			t.Fatal("the group has no metadata")
+		}
+		var content struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal([]byte(metadata.Content), &content)
+		return content.Name
+	}
+
+	first := publish(nostr.KindSimpleGroupCreateGroup, "First", 10)
+	publish(nostr.KindSimpleGroupEditMetadata, "Second", 5)
+	third := publish(nostr.KindSimpleGroupEditMetadata, "Vandalized", 4)
+
+	history := instance.Groups.GetMetadataHistory("history", 10)
+	if len(history) != 3 || history[0].ID != third.ID || history[2].ID != first.ID {
+		t.Fatalf("history = %+v, want the three versions newest first", history)
+	}
+
+	if _, err := instance.Groups.RestoreMetadata("history", first.ID, nostr.Generate().Public()); err == nil {
+		t.Error("a stranger restored the group's metadata")
+	}
+	if name := currentName(); name != "Vandalized" {
+		t.Errorf("name after a refused restore = %q", name)
+	}
+
+	restore, err := instance.Groups.RestoreMetadata("history", first.ID, creator.Public())
+	if err != nil {
+		t.Fatalf("RestoreMetadata failed: %v", err)
+	}
+	if name := currentName(); name != "First" {
+		t.Errorf("name after restoring = %q, want First", name)
+	}
+
+	history = instance.Groups.GetMetadataHistory("history", 10)
+	if len(history) != 4 || history[0].ID != restore.ID || !instance.Config.IsSelf(history[0].PubKey) {
+		t.Errorf("history = %+v, want the relay's restore on top", history)
+	}
+
+	if _, err := instance.Groups.RestoreMetadata("history", nostr.ID{}, creator.Public()); err != ErrVersionNotFound {
+		t.Errorf("restoring a missing version = %v, want ErrVersionNotFound", err)
+	}
+}
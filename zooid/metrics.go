@@ -3,7 +3,6 @@ package zooid
 import (
 	"context"
 	"log"
-	"strings"
 	"sync"
 	"time"
 
@@ -141,6 +140,7 @@ func init() {
 		QueryDuration,
 		QueryDBDuration,
 		QueryDrainDuration,
+		cacheDrift,
 	)
 }
 
@@ -217,6 +217,7 @@ func collectMetrics(ctx context.Context) {
 		label := instanceLabel(inst)
 		currentInstances[label] = struct{}{}
 		collectCacheMetrics(inst)
+		collectGroupActivity(inst)
 		collectDBMetrics(ctx, inst)
 	}
 
@@ -236,6 +237,11 @@ func collectMetrics(ctx context.Context) {
 			bannedEventsTotal.DeletePartialMatch(match)
 			eventsTotal.DeletePartialMatch(match)
 			messagesTotal.DeletePartialMatch(match)
+			cacheDrift.DeletePartialMatch(match)
+			groupMessagesPerMinute.DeletePartialMatch(match)
+			groupActiveAuthors.DeletePartialMatch(match)
+			groupJoinsPerMinute.DeletePartialMatch(match)
+			groupLeavesPerMinute.DeletePartialMatch(match)
 		}
 	}
 
@@ -331,20 +337,28 @@ func collectCacheMetrics(inst *Instance) {
 func collectDBMetrics(ctx context.Context, inst *Instance) {
 	instLabel := instanceLabel(inst)
 	label := prometheus.Labels{"instance": instLabel}
-	eventsTable := inst.Events.Schema.Prefix("events")
 
 	// Use Postgres reltuples estimate — no sequential scan, instant.
-	// GREATEST handles -1 (never-analyzed tables). PostgreSQL lowercases
-	// unquoted identifiers, so match against lowercase.
+	// GREATEST handles -1 (never-analyzed tables).
 	subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
 	defer cancel()
 
+	table := inst.Events.Schema.Prefix("events")
+	estimate, args := "SELECT GREATEST(COALESCE(reltuples, 0), 0) FROM pg_class WHERE oid = to_regclass($1)", []any{table}
+	if usesSQLite() {
+		// No estimate, but a SQLite database is small enough to count
+		estimate, args = "SELECT COUNT(*) FROM "+table, nil
+	}
+
 	var eventsEst float64
-	err := GetDb().QueryRowContext(
-		subctx,
-		"SELECT GREATEST(COALESCE(reltuples, 0), 0) FROM pg_class WHERE relname = $1",
-		strings.ToLower(eventsTable),
-	).Scan(&eventsEst)
+	var err error
+	if usesMemory() {
+		var n uint32
+		n, err = inst.Events.CountEvents(nostr.Filter{})
+		eventsEst = float64(n)
+	} else {
+		err = GetDb().QueryRowContext(subctx, estimate, args...).Scan(&eventsEst)
+	}
 	if err != nil {
 		log.Printf("metrics: failed to estimate events: %v", err)
 	} else {
@@ -407,9 +421,25 @@ func collectGroupMessageCounts(ctx context.Context, inst *Instance, instLabel st
 		return
 	}
 
+	// Memory has no GROUP BY, but counts quickly enough one group at a time
+	if usesMemory() {
+		for _, group := range visibleGroups {
+			count, err := inst.Events.CountEvents(nostr.Filter{Kinds: chatKinds, Tags: nostr.TagMap{"h": {group}}})
+			if err != nil || count == 0 {
+				continue
+			}
+			groupMessages.With(prometheus.Labels{
+				"instance": instLabel,
+				"group":    group,
+			}).Set(float64(count))
+		}
+		return
+	}
+
 	// Build: SELECT t.value, COUNT(*) FROM {event_tags} t
 	//        JOIN {events} e ON e.id = t.event_id
 	//        WHERE t.key = 'h' AND t.value IN (...) AND e.kind IN (9, 10)
+	//          AND e.deleted_at IS NULL
 	//        GROUP BY t.value
 	eventsTable := inst.Events.Schema.Prefix("events")
 	tagsTable := inst.Events.Schema.Prefix("event_tags")
@@ -429,6 +459,7 @@ func collectGroupMessageCounts(ctx context.Context, inst *Instance, instLabel st
 		Where(squirrel.Eq{"t.key": "h"}).
 		Where(squirrel.Eq{"t.value": groupArgs}).
 		Where(squirrel.Eq{"e.kind": kindArgs}).
+		Where("e.deleted_at IS NULL").
 		GroupBy("t.value")
 
 	subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
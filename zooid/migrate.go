@@ -2,87 +2,286 @@ package zooid
 
 import (
 	"context"
+	"database/sql"
 	"embed"
 	"errors"
 	"fmt"
 	"log"
-	"sort"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// Migrations.
+//
+// A schema is at the version of the latest migration applied to it, and its
+// schema_migrations table records each one with its version, name and when it
+// ran. Migrations are applied in order of version, each in a transaction of
+// its own along with its record, under an advisory lock, so replicas starting
+// together don't both run one. Most are SQL files in migrations/ named
+// <version>_<name>.sql and templated with the schema, see Schema.Render;
+// those that need more are in goMigrations. A migration runs in a
+// transaction, so it can't CREATE INDEX CONCURRENTLY.
+//
+// Init refuses a schema at a newer version than the build knows, as left
+// behind by a newer release, rather than run against tables it doesn't
+// understand.
+//
+// Schemas from before the table existed were tracked by file name in the kv
+// table; a migration recorded there is recorded in schema_migrations without
+// running again.
+
 //go:embed migrations/*.sql
 var migrationFiles embed.FS
 
-// RunMigrations executes pending SQL migration files for the given schema.
-// Migrations are embedded from zooid/migrations/, templated with the schema
-// prefix, and tracked in the global kv table so each runs at most once per
-// schema. Statements within a file are split on ";" and executed individually.
-//
-// ctx is the service root context; it bounds the kv lookups, kv writes, and
-// the migration Execs so a stalled DB at startup fails fast instead of
-// hanging the boot.
-func RunMigrations(ctx context.Context, schema *Schema) error {
-	kv := GetKeyValueStore(ctx)
+// ErrSchemaTooNew is returned by RunMigrations for a schema at a newer
+// version than this build knows.
+var ErrSchemaTooNew = errors.New("schema is at a newer version than this build")
 
+type migration struct {
+	Version int
+	Name    string
+	up      func(ctx context.Context, tx *sql.Tx, schema *Schema) error
+}
+
+// String returns the migration's name as schema_migrations and backups
+// record it.
+func (m migration) String() string {
+	return fmt.Sprintf("%03d_%s", m.Version, m.Name)
+}
+
+// goMigrations are the migrations that aren't SQL files.
+var goMigrations = []migration{
+	{Version: 1, Name: "base", up: migrateBase},
+}
+
+// legacyMigrations are the kv names migrations had before versions, by
+// version.
+var legacyMigrations = map[int]string{
+	2: "001_covering_indexes.sql",
+	3: "002_event_tags_kind.sql",
+	4: "003_superseded_relay_lists.sql",
+}
+
+// migrateBase creates the tables and the indexes whose definitions reference
+// only columns present in them. Indexes on columns added by later migrations
+// are created by those.
+func migrateBase(ctx context.Context, tx *sql.Tx, schema *Schema) error {
+	statements := []string{
+		schema.Render(`
+			CREATE TABLE IF NOT EXISTS {{.Prefix "events"}} (
+				id TEXT PRIMARY KEY,
+				created_at BIGINT NOT NULL,
+				kind INTEGER NOT NULL,
+				pubkey TEXT NOT NULL,
+				content TEXT NOT NULL,
+				tags TEXT NOT NULL,
+				sig TEXT NOT NULL
+			)`),
+		schema.Render(`
+			CREATE TABLE IF NOT EXISTS {{.Prefix "event_tags"}} (
+				event_id TEXT NOT NULL,
+				key TEXT NOT NULL,
+				value TEXT NOT NULL,
+				kind INTEGER,
+				FOREIGN KEY (event_id) REFERENCES {{.Prefix "events"}}(id) ON DELETE CASCADE
+			)`),
+		// The search trigger reads compressed, see compression.go
+		schema.Render(`ALTER TABLE {{.Prefix "events"}} ADD COLUMN IF NOT EXISTS content_zstd BYTEA`),
+		schema.Render(`ALTER TABLE {{.Prefix "events"}} ADD COLUMN IF NOT EXISTS compressed BOOLEAN NOT NULL DEFAULT false`),
+	}
+
+	for _, idx := range initIndexes {
+		statements = append(statements, schema.Render(idx.create(false)))
+	}
+
+	return execMigration(ctx, tx, statements)
+}
+
+// sqlMigration runs the statements of the migration file name.
+func sqlMigration(name string) func(ctx context.Context, tx *sql.Tx, schema *Schema) error {
+	return func(ctx context.Context, tx *sql.Tx, schema *Schema) error {
+		raw, err := migrationFiles.ReadFile("migrations/" + name)
+		if err != nil {
+			return err
+		}
+
+		return execMigration(ctx, tx, strings.Split(schema.Render(string(raw)), ";"))
+	}
+}
+
+// execMigration runs statements in tx, each with a fresh deadline derived
+// from ctx. The caller's ctx is typically the long-lived service root with
+// no deadline, so without one a stalled DB at startup hangs forever.
+func execMigration(ctx context.Context, tx *sql.Tx, statements []string) error {
+	for _, stmt := range statements {
+		stmt = strings.TrimSpace(stmt)
+		if stmt == "" {
+			continue
+		}
+
+		subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
+		_, err := tx.ExecContext(subctx, stmt)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// allMigrations returns every migration this build knows, in order.
+func allMigrations() ([]migration, error) {
 	entries, err := migrationFiles.ReadDir("migrations")
 	if err != nil {
-		return fmt.Errorf("reading migrations dir: %w", err)
+		return nil, fmt.Errorf("reading migrations dir: %w", err)
 	}
 
-	// Sort by filename to ensure execution order.
-	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].Name() < entries[j].Name()
-	})
-
+	migrations := slices.Clone(goMigrations)
 	for _, entry := range entries {
-		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+		name, ok := strings.CutSuffix(entry.Name(), ".sql")
+		if entry.IsDir() || !ok {
 			continue
 		}
 
-		kvKey := fmt.Sprintf("migration:%s:%s", schema.Name, entry.Name())
+		prefix, rest, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil || rest == "" {
+			return nil, fmt.Errorf("migration %s isn't named <version>_<name>.sql", entry.Name())
+		}
+		migrations = append(migrations, migration{Version: version, Name: rest, up: sqlMigration(entry.Name())})
+	}
 
-		// Distinguish "key not found" (migration pending) from any other
-		// error (ctx cancel, DB fault). Treating all errors as "not found"
-		// would silently re-run migrations against a sick DB, risking
-		// duplicate-apply effects on non-idempotent migrations.
-		_, err := kv.Get(ctx, kvKey)
-		if err == nil {
-			continue
+	slices.SortFunc(migrations, func(a, b migration) int { return a.Version - b.Version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", migrations[i-1], migrations[i])
+		}
+	}
+
+	return migrations, nil
+}
+
+// knownMigration reports whether name is a migration this build knows, by
+// its name or its name before versions.
+func knownMigration(name string) bool {
+	migrations, err := allMigrations()
+	if err != nil {
+		return false
+	}
+
+	for _, m := range migrations {
+		if m.String() == name || legacyMigrations[m.Version] == name {
+			return true
 		}
-		if !errors.Is(err, ErrKVNotFound) {
-			return fmt.Errorf("checking migration %s applied state: %w", entry.Name(), err)
+	}
+	return false
+}
+
+// SchemaVersion returns the version schema is at, 0 if nothing was applied.
+func SchemaVersion(ctx context.Context, schema *Schema) (int, error) {
+	var version int
+	query := fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %s", schema.Prefix("schema_migrations"))
+	err := GetDb().QueryRowContext(ctx, query).Scan(&version)
+	return version, err
+}
+
+// RunMigrations applies the migrations schema doesn't have yet.
+//
+// ctx is the service root context; it bounds the lookups, the records and
+// each statement, so a stalled DB at startup fails fast instead of hanging
+// the boot.
+func RunMigrations(ctx context.Context, schema *Schema) error {
+	migrations, err := allMigrations()
+	if err != nil {
+		return err
+	}
+
+	create := schema.Render(`
+		CREATE TABLE IF NOT EXISTS {{.Prefix "schema_migrations"}} (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at BIGINT NOT NULL
+		)`)
+	if _, err := GetDb().ExecContext(ctx, create); err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	current, err := SchemaVersion(ctx, schema)
+	if err != nil {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+	if latest := migrations[len(migrations)-1].Version; current > latest {
+		return fmt.Errorf("%w: %s is at version %d, this build knows up to %d", ErrSchemaTooNew, schema.Name, current, latest)
+	}
+
+	for _, m := range migrations {
+		if err := applyMigration(ctx, schema, m); err != nil {
+			return fmt.Errorf("migration %s failed: %w", m, err)
 		}
+	}
 
-		raw, err := migrationFiles.ReadFile("migrations/" + entry.Name())
-		if err != nil {
-			return fmt.Errorf("reading migration %s: %w", entry.Name(), err)
+	return nil
+}
+
+// applyMigration runs m on schema and records it, unless it already was.
+func applyMigration(ctx context.Context, schema *Schema, m migration) error {
+	// Distinguish "key not found" (never applied) from any other error (ctx
+	// cancel, DB fault). Treating all errors as "not found" would re-run
+	// migrations against a sick DB.
+	adopted := false
+	if legacy, ok := legacyMigrations[m.Version]; ok {
+		_, err := GetKeyValueStore(ctx).Get(ctx, fmt.Sprintf("migration:%s:%s", schema.Name, legacy))
+		if err != nil && !errors.Is(err, ErrKVNotFound) {
+			return fmt.Errorf("checking applied state: %w", err)
 		}
+		adopted = err == nil
+	}
+
+	tx, err := GetDb().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-		rendered := schema.Render(string(raw))
-
-		// Split on semicolons to execute each statement individually. Each
-		// statement gets a fresh per-statement deadline derived from ctx —
-		// the caller's ctx is typically the long-lived service root with no
-		// deadline, so without this a stalled DB at startup hangs forever
-		// despite ExecContext being used.
-		for _, stmt := range strings.Split(rendered, ";") {
-			stmt = strings.TrimSpace(stmt)
-			if stmt == "" {
-				continue
-			}
-			subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
-			_, err := GetDb().ExecContext(subctx, stmt)
-			cancel()
-			if err != nil {
-				return fmt.Errorf("migration %s failed: %w", entry.Name(), err)
-			}
+	// SQLite has one process, and takes the write lock as the transaction
+	// begins
+	if !usesSQLite() {
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", schemaLockKey(schema.Name, "migrate")); err != nil {
+			return err
 		}
+	}
+
+	var applied bool
+	query := fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE version = $1)", schema.Prefix("schema_migrations"))
+	if err := tx.QueryRowContext(ctx, query, m.Version).Scan(&applied); err != nil {
+		return err
+	}
+	if applied {
+		return nil
+	}
 
-		if err := kv.Set(ctx, kvKey, "applied"); err != nil {
-			return fmt.Errorf("recording migration %s: %w", entry.Name(), err)
+	// SQLite tables are created as the migrations leave them, see sqlite.go
+	run := !adopted && !usesSQLite()
+	if run {
+		if err := m.up(ctx, tx, schema); err != nil {
+			return err
 		}
+	}
+
+	insert := fmt.Sprintf("INSERT INTO %s (version, name, applied_at) VALUES ($1, $2, $3)", schema.Prefix("schema_migrations"))
+	if _, err := tx.ExecContext(ctx, insert, m.Version, m.String(), time.Now().Unix()); err != nil {
+		return fmt.Errorf("recording: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
 
-		log.Printf("Applied migration %s for schema %s", entry.Name(), schema.Name)
+	if run {
+		log.Printf("Applied migration %s for schema %s", m, schema.Name)
 	}
 
 	return nil
@@ -1,29 +1,77 @@
 package zooid
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"strings"
+	"slices"
 	"testing"
+
+	"fiatjaf.com/nostr"
 )
 
-func TestRunMigrations_AppliesAndTracks(t *testing.T) {
-	store := createTestEventStore()
-	store.Init()
+// appliedVersions returns the versions schema_migrations records for schema.
+func appliedVersions(t *testing.T, schema *Schema) []int {
+	t.Helper()
 
-	kv := GetKeyValueStore(context.Background())
+	rows, err := GetDb().Query("SELECT version FROM " + schema.Prefix("schema_migrations") + " ORDER BY version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var versions []int
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+// forgetMigrations makes schema look like it was only migrated up to
+// version.
+func forgetMigrations(t *testing.T, schema *Schema, version int) {
+	t.Helper()
+
+	if _, err := GetDb().Exec("DELETE FROM "+schema.Prefix("schema_migrations")+" WHERE version > $1", version); err != nil {
+		t.Fatal(err)
+	}
+}
 
-	key := fmt.Sprintf("migration:%s:001_covering_indexes.sql", store.Schema.Name)
-	val, err := kv.Get(context.Background(), key)
+func TestRunMigrations_FromScratch(t *testing.T) {
+	skipOnMemory(t, "migrations")
+	store := createTestEventStore()
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	migrations, err := allMigrations()
 	if err != nil {
-		t.Fatalf("Migration not tracked in kv: %v", err)
+		t.Fatal(err)
+	}
+	var want []int
+	for _, m := range migrations {
+		want = append(want, m.Version)
+	}
+	if got := appliedVersions(t, store.Schema); !slices.Equal(got, want) {
+		t.Errorf("applied versions = %v, want %v", got, want)
+	}
+
+	version, err := SchemaVersion(context.Background(), store.Schema)
+	if err != nil || version != want[len(want)-1] {
+		t.Errorf("SchemaVersion = %d %v, want %d", version, err, want[len(want)-1])
 	}
-	if val != "applied" {
-		t.Errorf("Migration kv value = %q, want %q", val, "applied")
+	if want[0] != 1 || migrations[0].Name != "base" {
+		t.Errorf("the first migration is %s, want 001_base", migrations[0])
 	}
 }
 
 func TestRunMigrations_Idempotent(t *testing.T) {
+	skipOnMemory(t, "migrations")
 	store := createTestEventStore()
 	store.Init()
 
@@ -32,13 +80,188 @@ func TestRunMigrations_Idempotent(t *testing.T) {
 	}
 }
 
+func TestRunMigrations_FromMidVersion(t *testing.T) {
+	skipOnMemory(t, "migrations")
+	store := createTestEventStore()
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	want := appliedVersions(t, store.Schema)
+
+	// As the schema was before event_tags had a kind
+	if !usesSQLite() {
+		if _, err := GetDb().Exec("DROP INDEX " + store.Schema.Prefix("idx_event_tags_key_value_kind_event_id")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := GetDb().Exec("ALTER TABLE " + store.Schema.Prefix("event_tags") + " DROP COLUMN kind"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	forgetMigrations(t, store.Schema, 2)
+
+	if err := store.Init(); err != nil {
+		t.Fatalf("Init from version 2: %v", err)
+	}
+	if got := appliedVersions(t, store.Schema); !slices.Equal(got, want) {
+		t.Errorf("applied versions = %v, want %v", got, want)
+	}
+
+	// The kind column is back
+	event := createTestEvent(nostr.KindTextNote, "hello")
+	if err := store.SaveEvent(event); err != nil {
+		t.Fatalf("SaveEvent after migrating: %v", err)
+	}
+}
+
+func TestRunMigrations_RefusesNewerSchema(t *testing.T) {
+	skipOnMemory(t, "migrations")
+	store := createTestEventStore()
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	version, _ := SchemaVersion(context.Background(), store.Schema)
+	insert := "INSERT INTO " + store.Schema.Prefix("schema_migrations") + " (version, name, applied_at) VALUES ($1, $2, 0)"
+	if _, err := GetDb().Exec(insert, version+1, "from_the_future"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Init(); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Init of a newer schema = %v, want ErrSchemaTooNew", err)
+	}
+}
+
+func TestRunMigrations_AdoptsLegacyRecords(t *testing.T) {
+	skipOnSQLite(t, "migrations")
+	skipOnMemory(t, "migrations")
+	store := createTestEventStore()
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Superseded lists, which 004 would delete if it ran
+	author := nostr.Generate()
+	for _, list := range []nostr.Event{relayList(author, 100), relayList(author, 200)} {
+		if err := store.SaveEvent(list); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Applied by the runner from before versions
+	ctx := context.Background()
+	forgetMigrations(t, store.Schema, 3)
+	if err := GetKeyValueStore(ctx).Set(ctx, fmt.Sprintf("migration:%s:003_superseded_relay_lists.sql", store.Schema.Name), "applied"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RunMigrations(ctx, store.Schema); err != nil {
+		t.Fatal(err)
+	}
+	if got := appliedVersions(t, store.Schema); !slices.Contains(got, 4) {
+		t.Errorf("applied versions = %v, want 4 recorded", got)
+	}
+	n := 0
+	for range store.QueryEvents(nostr.Filter{Kinds: []nostr.Kind{nostr.KindRelayListMetadata}}, 0) {
+		n++
+	}
+	if n != 2 {
+		t.Errorf("%d relay lists left, want both: the migration ran again", n)
+	}
+}
+
+func TestMigration_DeletesSupersededRelayLists(t *testing.T) {
+	skipOnSQLite(t, "migrations")
+	skipOnMemory(t, "migrations")
+	store := createTestEventStore()
+	store.Init()
+
+	author := nostr.Generate()
+	other := nostr.Generate()
+	lists := []nostr.Event{
+		relayList(author, 100),
+		relayList(author, 200, "wss://a.example.com"),
+		relayList(author, 200, "wss://b.example.com"),
+		relayList(other, 100),
+	}
+
+	// Saved without replacing, as lists were before ReplaceEvent was fixed
+	for _, list := range lists {
+		if err := store.SaveEvent(list); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	forgetMigrations(t, store.Schema, 3)
+	if err := RunMigrations(ctx, store.Schema); err != nil {
+		t.Fatal(err)
+	}
+
+	want := lists[1]
+	if bytes.Compare(lists[2].ID[:], lists[1].ID[:]) < 0 {
+		want = lists[2]
+	}
+
+	var kept []nostr.ID
+	for event := range store.QueryEvents(nostr.Filter{Kinds: []nostr.Kind{nostr.KindRelayListMetadata}}, 0) {
+		kept = append(kept, event.ID)
+	}
+	if len(kept) != 2 || !slices.Contains(kept, want.ID) || !slices.Contains(kept, lists[3].ID) {
+		t.Errorf("kept %v, want the newest list of each author: %s and %s", kept, want.ID, lists[3].ID)
+	}
+}
+
+func TestMigration_BackfillsReceivedAt(t *testing.T) {
+	skipOnMemory(t, "migrations")
+	store := createTestEventStore()
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	event := createTestEvent(nostr.KindTextNote, "from before")
+	event.CreatedAt = 1234
+	event.Sign(nostr.Generate())
+	if err := store.SaveEvent(event); err != nil {
+		t.Fatal(err)
+	}
+
+	// As the schema was before received_at
+	for _, stmt := range []string{
+		"DROP INDEX " + store.Schema.Prefix("idx_events_received_at_id"),
+		"ALTER TABLE " + store.Schema.Prefix("events") + " DROP COLUMN received_at",
+	} {
+		if _, err := GetDb().Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	forgetMigrations(t, store.Schema, 5)
+
+	if err := store.Init(); err != nil {
+		t.Fatalf("Init from version 5: %v", err)
+	}
+
+	times, err := store.ReceivedTimes([]nostr.ID{event.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if times[event.ID] != 1234 {
+		t.Errorf("received_at after migrating = %d, want created_at 1234", times[event.ID])
+	}
+}
+
 func TestInit_CoveringIndexesExistAndValid(t *testing.T) {
+	skipOnSQLite(t, "pg_class")
+	skipOnMemory(t, "pg_class")
 	store := createTestEventStore()
 	store.Init()
 
 	indexes := []string{
-		strings.ToLower(store.Schema.Prefix("idx_event_tags_key_value_event_id")),
-		strings.ToLower(store.Schema.Prefix("idx_events_kind_created_at")),
+		store.Schema.Prefix("idx_event_tags_key_value_event_id"),
+		store.Schema.Prefix("idx_events_kind_created_at"),
+		store.Schema.Prefix("idx_events_created_at_id"),
+		store.Schema.Prefix("idx_events_kind_created_at_id_desc"),
+		store.Schema.Prefix("idx_event_tags_key_value_kind_event_id"),
+		store.Schema.Prefix("idx_events_received_at_id"),
 	}
 
 	for _, idx := range indexes {
@@ -47,7 +270,7 @@ func TestInit_CoveringIndexesExistAndValid(t *testing.T) {
 			SELECT pg_index.indisvalid
 			FROM pg_class
 			JOIN pg_index ON pg_index.indexrelid = pg_class.oid
-			WHERE pg_class.relname = $1
+			WHERE pg_class.oid = to_regclass($1)
 		`, idx).Scan(&valid)
 		if err != nil {
 			t.Errorf("Index %s not found: %v", idx, err)
@@ -58,3 +281,34 @@ func TestInit_CoveringIndexesExistAndValid(t *testing.T) {
 		}
 	}
 }
+
+func TestEventStore_Reindex_RecreatesMissingIndex(t *testing.T) {
+	skipOnSQLite(t, "pg_class")
+	skipOnMemory(t, "pg_class")
+	store := createTestEventStore()
+	store.Init()
+
+	idx := store.Schema.Prefix("idx_events_kind_created_at_id_desc")
+	if _, err := GetDb().Exec("DROP INDEX " + idx); err != nil {
+		t.Fatalf("DROP INDEX: %v", err)
+	}
+
+	if err := store.Reindex(context.Background()); err != nil {
+		t.Fatalf("Reindex: %v", err)
+	}
+
+	var valid bool
+	if err := GetDb().QueryRow(`
+		SELECT pg_index.indisvalid
+		FROM pg_class
+		JOIN pg_index ON pg_index.indexrelid = pg_class.oid
+		WHERE pg_class.oid = to_regclass($1)
+	`, idx).Scan(&valid); err != nil || !valid {
+		t.Errorf("index %s after Reindex: valid=%v err=%v", idx, valid, err)
+	}
+
+	// Nothing to do the second time round
+	if err := store.Reindex(context.Background()); err != nil {
+		t.Errorf("second Reindex: %v", err)
+	}
+}
@@ -1,10 +1,10 @@
 -- Covering index on event_tags: enables index-only scan for tag lookups.
 -- The planner can now resolve (key, value) -> event_id without touching the heap.
-CREATE INDEX IF NOT EXISTS {{.Name}}__idx_event_tags_key_value_event_id
-  ON {{.Name}}__event_tags(key, value, event_id);
+CREATE INDEX IF NOT EXISTS {{.Index "idx_event_tags_key_value_event_id"}}
+  ON {{.Prefix "event_tags"}}(key, value, event_id);
 
 -- Composite index on events: avoids post-filtering non-matching kinds after
 -- the created_at index scan. Lets the planner satisfy both kind= and
 -- ORDER BY created_at DESC from a single index.
-CREATE INDEX IF NOT EXISTS {{.Name}}__idx_events_kind_created_at
-  ON {{.Name}}__events(kind, created_at DESC);
+CREATE INDEX IF NOT EXISTS {{.Index "idx_events_kind_created_at"}}
+  ON {{.Prefix "events"}}(kind, created_at DESC);
@@ -21,6 +21,6 @@
 -- #23. Until the backfill is verified complete, the read path
 -- emits `kind IN (...) OR kind IS NULL` so un-backfilled rows still
 -- match.
-ALTER TABLE {{.Name}}__event_tags ADD COLUMN IF NOT EXISTS kind INTEGER;
-CREATE INDEX IF NOT EXISTS {{.Name}}__idx_event_tags_key_value_kind_event_id
-  ON {{.Name}}__event_tags(key, value, kind, event_id);
+ALTER TABLE {{.Prefix "event_tags"}} ADD COLUMN IF NOT EXISTS kind INTEGER;
+CREATE INDEX IF NOT EXISTS {{.Index "idx_event_tags_key_value_kind_event_id"}}
+  ON {{.Prefix "event_tags"}}(key, value, kind, event_id);
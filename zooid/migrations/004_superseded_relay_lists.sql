@@ -0,0 +1,19 @@
+-- Delete relay lists (kind 10002) that a newer list from the same author
+-- replaces. ReplaceEvent keeps only the newest replaceable event per author,
+-- but before it ran in a serializable transaction, concurrent saves could
+-- leave older copies behind, and a REQ for someone's relay list returned
+-- them alongside the current one.
+--
+-- "Newer" is the NIP-01 order ReplaceEvent uses: the later created_at, and
+-- on a tie the lower id. ids are compared bytewise (COLLATE "C") so the
+-- database's locale can't reorder them. CASCADE on the event_tags foreign
+-- key removes the tags.
+DELETE FROM {{.Prefix "events"}} e
+ WHERE e.kind = 10002
+   AND EXISTS (
+     SELECT 1 FROM {{.Prefix "events"}} n
+      WHERE n.kind = 10002
+        AND n.pubkey = e.pubkey
+        AND (n.created_at > e.created_at
+             OR (n.created_at = e.created_at AND n.id COLLATE "C" < e.id COLLATE "C"))
+   );
@@ -0,0 +1,15 @@
+-- Queries order by created_at DESC, id DESC, so events of the same second
+-- come back in the same order every time and a limit-1 lookup of a
+-- replaceable event superseded within a second always finds the same one.
+-- These indexes serve that order scanned forwards, and the oldest-first
+-- order of log replays scanned backwards. They replace
+-- idx_events_kind_created_at_id, whose id ran the other way.
+--
+-- Like 003, the CREATE INDEXes won't finish within the runner's 30s
+-- statement deadline on a big production schema: create them beforehand
+-- with CREATE INDEX CONCURRENTLY, so these are no-ops.
+CREATE INDEX IF NOT EXISTS {{.Index "idx_events_created_at_id"}}
+  ON {{.Prefix "events"}}(created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS {{.Index "idx_events_kind_created_at_id_desc"}}
+  ON {{.Prefix "events"}}(kind, created_at DESC, id DESC);
+DROP INDEX IF EXISTS {{.Index "idx_events_kind_created_at_id"}};
@@ -0,0 +1,14 @@
+-- When the relay stored each event, as opposed to created_at, which is
+-- whatever the author says. Events already stored are taken to have arrived
+-- when they were created. The default covers inserts by instances that
+-- don't know about the column yet, during a rolling deploy.
+--
+-- Like 003, the UPDATE and CREATE INDEX won't finish within the runner's
+-- 30s statement deadline on a big production schema: run them beforehand,
+-- the index with CREATE INDEX CONCURRENTLY, so these are quick.
+ALTER TABLE {{.Prefix "events"}} ADD COLUMN IF NOT EXISTS received_at BIGINT;
+UPDATE {{.Prefix "events"}} SET received_at = created_at WHERE received_at IS NULL;
+ALTER TABLE {{.Prefix "events"}} ALTER COLUMN received_at SET DEFAULT EXTRACT(EPOCH FROM now())::BIGINT;
+ALTER TABLE {{.Prefix "events"}} ALTER COLUMN received_at SET NOT NULL;
+CREATE INDEX IF NOT EXISTS {{.Index "idx_events_received_at_id"}}
+  ON {{.Prefix "events"}}(received_at DESC, id DESC);
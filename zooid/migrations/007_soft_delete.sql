@@ -0,0 +1,5 @@
+-- When an event was deleted with storage.soft_delete on, NULL for the events
+-- that are live. Rows are purged once it's older than soft_delete_window.
+ALTER TABLE {{.Prefix "events"}} ADD COLUMN IF NOT EXISTS deleted_at BIGINT;
+CREATE INDEX IF NOT EXISTS {{.Index "idx_events_deleted_at"}}
+  ON {{.Prefix "events"}}(deleted_at);
@@ -0,0 +1,72 @@
+package zooid
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Native schemas.
+//
+// With storage.native_schema, Init creates a Postgres schema for the
+// instance and its tables in it, see Schema. Turning it on for an instance
+// whose tables are still prefixed moves them over on the next start: the
+// tables go into the schema, and they and their indexes lose the prefix. The
+// search trigger and its function are recreated by Init, so the old ones are
+// dropped. Turning it off again isn't supported.
+
+// initNativeSchema creates the instance's Postgres schema and moves its
+// prefixed tables into it, if they exist and it has none yet.
+func (events *EventStore) initNativeSchema(ctx context.Context) error {
+	namespace := pgx.Identifier{events.Schema.Name}.Sanitize()
+	if _, err := GetDb().ExecContext(ctx, "CREATE SCHEMA IF NOT EXISTS "+namespace); err != nil {
+		return fmt.Errorf("creating schema: %w", err)
+	}
+
+	prefixed := &Schema{Name: events.Schema.Name}
+
+	var move bool
+	err := GetDb().QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL AND to_regclass($2) IS NULL",
+		prefixed.Prefix("events"), events.Schema.Prefix("events")).Scan(&move)
+	if err != nil || !move {
+		return err
+	}
+
+	statements := []string{
+		prefixed.Render(`DROP TRIGGER IF EXISTS {{.Trigger "events_search_update"}} ON {{.Prefix "events"}}`),
+		prefixed.Render(`DROP FUNCTION IF EXISTS {{.Function "update_search_vector"}}()`),
+	}
+	// Schemas from before schema_migrations don't have it yet
+	for _, table := range []string{"events", "event_tags", "schema_migrations"} {
+		statements = append(statements,
+			fmt.Sprintf("ALTER TABLE IF EXISTS %s SET SCHEMA %s", prefixed.Prefix(table), namespace),
+			fmt.Sprintf("ALTER TABLE IF EXISTS %s.%s RENAME TO %s", namespace, prefixed.Prefix(table), pgx.Identifier{table}.Sanitize()),
+		)
+	}
+	for _, idx := range slices.Concat(initIndexes, migratedIndexes, []eventIndex{{Name: "idx_events_search"}, {Name: "idx_events_kind_created_at_id"}}) {
+		statements = append(statements, fmt.Sprintf("ALTER INDEX IF EXISTS %s.%s RENAME TO %s",
+			namespace, prefixed.Index(idx.Name), events.Schema.Index(idx.Name)))
+	}
+
+	tx, err := GetDb().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("moving tables into schema %s: %w", events.Schema.Name, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Moved the tables of %s into their own schema", events.Schema.Name)
+	return nil
+}
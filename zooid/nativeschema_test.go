@@ -0,0 +1,67 @@
+package zooid
+
+import (
+	"context"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestNativeSchema_MovesPrefixedTables(t *testing.T) {
+	skipOnSQLite(t, "native schemas")
+	skipOnMemory(t, "native schemas")
+	prefixed := createTestEventStore()
+	prefixed.Schema.Native = false
+	if err := prefixed.Init(); err != nil {
+		t.Fatalf("prefixed Init: %v", err)
+	}
+
+	event := createTestEvent(1, "written before the move")
+	if err := prefixed.SaveEvent(event); err != nil {
+		t.Fatalf("SaveEvent: %v", err)
+	}
+
+	native := &EventStore{
+		Config:  prefixed.Config,
+		Schema:  &Schema{Name: prefixed.Schema.Name, Native: true},
+		rootCtx: context.Background(),
+	}
+	if err := native.Init(); err != nil {
+		t.Fatalf("native Init: %v", err)
+	}
+
+	var moved, left bool
+	if err := GetDb().QueryRow("SELECT to_regclass($1) IS NOT NULL, to_regclass($2) IS NOT NULL",
+		native.Schema.Prefix("event_tags"), prefixed.Schema.Prefix("event_tags")).Scan(&moved, &left); err != nil {
+		t.Fatal(err)
+	}
+	if !moved || left {
+		t.Fatalf("event_tags in the schema: %v, still prefixed: %v", moved, left)
+	}
+
+	// Stored events, their tags and the search trigger all came along
+	var found int
+	for range native.QueryEvents(nostr.Filter{Tags: nostr.TagMap{"t": []string{"test"}}}, 10) {
+		found++
+	}
+	if found != 1 {
+		t.Errorf("found %d events by tag after the move, want 1", found)
+	}
+
+	searched := createTestEvent(1, "a distinctive aardvark")
+	if err := native.SaveEvent(searched); err != nil {
+		t.Fatalf("SaveEvent after the move: %v", err)
+	}
+	found = 0
+	for range native.QueryEvents(nostr.Filter{Search: "aardvark"}, 10) {
+		found++
+	}
+	if found != 1 {
+		t.Errorf("found %d events by search after the move, want 1", found)
+	}
+
+	// Starting again finds nothing left to move
+	if err := native.Init(); err != nil {
+		t.Fatalf("second native Init: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package zooid
+
+import (
+	"slices"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip29"
+)
+
+// Negentropy.
+//
+// NIP-77 sync sessions reconcile a client's event ids against everything a
+// filter matches. khatru runs them through OnRequest and QueryStored like a
+// REQ, so events the client can't read are already left out, but a filter
+// naming a group would still tell the client whether that group has events
+// at all. Filters that name groups must be readable by the client, the same
+// as for pin lists. [negentropy] can also restrict sessions to admins or to
+// recent events.
+
+// negentropyGroups returns the groups a negentropy filter is scoped to.
+func negentropyGroups(filter nostr.Filter) []string {
+	groups := slices.Clone(filter.Tags["h"])
+
+	// Group metadata events are addressed by d tag instead
+	if slices.ContainsFunc(filter.Kinds, nip29.MetadataEventKinds.Includes) {
+		groups = append(groups, filter.Tags["d"]...)
+	}
+
+	return groups
+}
+
+// checkNegentropy returns why pubkey can't open a negentropy session for
+// filter, or "" if it can.
+func (instance *Instance) checkNegentropy(pubkey nostr.PubKey, filter nostr.Filter) string {
+	if instance.Config.Negentropy.AdminsOnly && !instance.Config.CanManage(pubkey) {
+		return RejectRestricted.Reason("negentropy sync is limited to admins")
+	}
+
+	for _, h := range negentropyGroups(filter) {
+		if h == "_" {
+			continue
+		}
+
+		// Missing groups get the same answer as unreadable ones, so this
+		// can't be used to probe for hidden groups
+		if !instance.Config.Groups.Enabled || !instance.Groups.CanRead(pubkey, groupProbe(h)) {
+			return RejectRestricted.Reason("you can't read that group")
+		}
+	}
+
+	return ""
+}
+
+// negentropySince returns the oldest created_at a negentropy session may
+// reconcile, or 0 if there's no window.
+func (config *Config) negentropySince(now time.Time) nostr.Timestamp {
+	window := config.GetNegentropyWindow()
+	if window <= 0 {
+		return 0
+	}
+
+	return nostr.Timestamp(now.Add(-window).Unix())
+}
@@ -0,0 +1,92 @@
+package zooid
+
+import (
+	"context"
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+func TestNegentropy_GroupFiltersNeedReadAccess(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+	runTestAdmin(t, instance, "create-group", "secret", "--private", "--closed")
+
+	member := nostr.Generate()
+	outsider := nostr.Generate()
+	runTestAdmin(t, instance, "add-member", "secret", member.Public().Hex())
+
+	open := func(pubkey nostr.PubKey, filter nostr.Filter) (bool, string) {
+		return instance.OnRequest(khatru.SetNegentropy(authedContext(pubkey)), filter)
+	}
+	byH := nostr.Filter{Kinds: []nostr.Kind{nostr.KindSimpleGroupChatMessage}, Tags: nostr.TagMap{"h": []string{"secret"}}}
+
+	reject, msg := open(outsider.Public(), byH)
+	if !reject {
+		t.Fatal("a non-member's negentropy filter on a private group should be refused")
+	}
+	assertPrefix(t, "outsider", msg, RejectRestricted)
+
+	// A group that doesn't exist looks the same
+	missing := nostr.Filter{Tags: nostr.TagMap{"h": []string{"nope"}}}
+	if _, missingMsg := open(outsider.Public(), missing); missingMsg != msg {
+		t.Errorf("missing group: %q, want the same answer as a private one (%q)", missingMsg, msg)
+	}
+
+	metadata := nostr.Filter{Kinds: []nostr.Kind{nostr.KindSimpleGroupMembers}, Tags: nostr.TagMap{"d": []string{"secret"}}}
+	if reject, _ := open(outsider.Public(), metadata); !reject {
+		t.Error("a non-member's negentropy filter on a private group's members should be refused")
+	}
+
+	if reject, msg := open(member.Public(), byH); reject {
+		t.Errorf("member refused: %s", msg)
+	}
+
+	// Plain REQs are left to QueryStored's filtering
+	if reject, msg := instance.OnRequest(authedContext(outsider.Public()), byH); reject {
+		t.Errorf("REQ refused: %s", msg)
+	}
+}
+
+func TestNegentropy_AdminsOnlyAndWindow(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+	instance.Config.Negentropy.AdminsOnly = true
+	instance.Config.Negentropy.Window = "1d"
+
+	user := nostr.Generate()
+	if reject, _ := instance.OnRequest(khatru.SetNegentropy(authedContext(user.Public())), nostr.Filter{}); !reject {
+		t.Error("non-admins should be refused with admins_only")
+	}
+
+	admin := instance.Config.GetSelf()
+	if reject, msg := instance.OnRequest(khatru.SetNegentropy(authedContext(admin)), nostr.Filter{}); reject {
+		t.Errorf("admin refused: %s", msg)
+	}
+
+	old := signedBy(user, nostr.Event{Kind: nostr.KindTextNote, Content: "old"})
+	old.CreatedAt = nostr.Now() - 2*24*60*60
+	old.Sign(user)
+	recent := signedBy(user, nostr.Event{Kind: nostr.KindTextNote, Content: "recent"})
+	for _, event := range []nostr.Event{old, recent} {
+		if err := instance.Events.SaveEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := func(ctx context.Context) int {
+		n := 0
+		filter := nostr.Filter{Kinds: []nostr.Kind{nostr.KindTextNote}, Authors: []nostr.PubKey{user.Public()}}
+		for range instance.QueryStored(ctx, filter) {
+			n++
+		}
+		return n
+	}
+	if n := query(khatru.SetNegentropy(authedContext(admin))); n != 1 {
+		t.Errorf("negentropy saw %d events, want only the recent one", n)
+	}
+	if n := query(authedContext(admin)); n != 2 {
+		t.Errorf("a REQ saw %d events, want both", n)
+	}
+}
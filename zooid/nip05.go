@@ -0,0 +1,339 @@
+package zooid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"fiatjaf.com/nostr"
+)
+
+// NIP-05 identifiers.
+//
+// With nip05.enabled the relay serves /.well-known/nostr.json for the names
+// in its zooid/nip05 app data, one ["name", <name>, <pubkey>] tag each, so
+// its members can be name@host. Managers set and delete names with the
+// setnip05 and deletenip05 NIP-86 methods. Members claim one for themselves
+// by sending a RELAY_NIP05_CLAIM event with a name tag; a claim is marked
+// with a fourth "claim" element, and a member's new claim replaces their
+// previous one but leaves the names managers gave them alone. A name belongs
+// to one pubkey, and the reserved names (the defaults and nip05.reserved)
+// can only be given out by managers.
+//
+// Lookups are answered from a cache of the whole list, which is small,
+// reloaded whenever it changes here or on another instance. Names of banned
+// pubkeys aren't served.
+//
+// The list is rewritten after a claim is accepted, so two members claiming
+// the same name on different instances could both be told yes. OnEvent
+// reserves a claimed name first, inserting zooid:<schema>:nip05:<name> in
+// the kv store only if it's absent, and refuses the claim if another pubkey
+// got there first. The list changes keep the reservations in step.
+
+// ErrNIP05Invalid is returned for a name NIP-05 doesn't allow.
+var ErrNIP05Invalid = errors.New("names may only have the characters a-z0-9-_. and be at most 64 long")
+
+// ErrNIP05Taken is returned for a name someone else holds.
+var ErrNIP05Taken = errors.New("name is taken")
+
+// ErrNIP05Reserved is returned for a member's claim of a reserved name.
+var ErrNIP05Reserved = errors.New("name is reserved")
+
+// defaultReservedNames can't be claimed by members whatever nip05.reserved
+// says.
+var defaultReservedNames = []string{"_", "admin", "administrator", "root", "support", "abuse", "postmaster", "hostmaster", "webmaster", "relay", "www", "security", "help", "info", "mod", "moderator"}
+
+var nip05NamePattern = regexp.MustCompile(`^[a-z0-9\-_.]{1,64}$`)
+
+// normalizeNIP05Name lowercases name, as NIP-05 names are case-insensitive,
+// and checks it's valid.
+func normalizeNIP05Name(name string) (string, error) {
+	name = strings.ToLower(name)
+	if !nip05NamePattern.MatchString(name) {
+		return "", ErrNIP05Invalid
+	}
+
+	return name, nil
+}
+
+// IsReservedNIP05Name reports whether name can only be given out by managers.
+func (config *Config) IsReservedNIP05Name(name string) bool {
+	name = strings.ToLower(name)
+	return slices.Contains(defaultReservedNames, name) || slices.ContainsFunc(config.NIP05.Reserved, func(reserved string) bool {
+		return strings.ToLower(reserved) == name
+	})
+}
+
+// storedNIP05Names reads the names from the app data.
+func (m *ManagementStore) storedNIP05Names() map[string]nostr.PubKey {
+	names := make(map[string]nostr.PubKey)
+	for tag := range m.Events.GetOrCreateApplicationSpecificData(NIP05_NAMES).Tags.FindAll("name") {
+		if len(tag) < 3 {
+			continue
+		}
+		if pubkey, err := nostr.PubKeyFromHex(tag[2]); err == nil {
+			names[tag[1]] = pubkey
+		}
+	}
+
+	return names
+}
+
+func (m *ManagementStore) loadNIP05Names() {
+	names := m.storedNIP05Names()
+	m.nip05Names.Store(&names)
+}
+
+// NIP05Names returns the names and the pubkeys they belong to.
+func (m *ManagementStore) NIP05Names() map[string]nostr.PubKey {
+	if m.cachesWarmed {
+		if names := m.nip05Names.Load(); names != nil {
+			return *names
+		}
+	}
+
+	return m.storedNIP05Names()
+}
+
+// LookupNIP05 returns the pubkey name belongs to.
+func (m *ManagementStore) LookupNIP05(name string) (nostr.PubKey, bool) {
+	pubkey, found := m.NIP05Names()[strings.ToLower(name)]
+	return pubkey, found
+}
+
+// SetNIP05 gives name to pubkey, reserved or not. It fails with
+// ErrNIP05Taken if another pubkey holds it.
+func (m *ManagementStore) SetNIP05(name string, pubkey nostr.PubKey) error {
+	return m.putNIP05(name, pubkey, false)
+}
+
+// ClaimNIP05 gives name to pubkey in place of the name they claimed before,
+// unless it's reserved or another pubkey holds or has reserved it.
+func (m *ManagementStore) ClaimNIP05(name string, pubkey nostr.PubKey) error {
+	if m.Config.IsReservedNIP05Name(name) {
+		return ErrNIP05Reserved
+	}
+
+	name, err := normalizeNIP05Name(name)
+	if err != nil {
+		return err
+	}
+	if err := m.reserveNIP05(name, pubkey); err != nil {
+		return err
+	}
+
+	if err := m.putNIP05(name, pubkey, true); err != nil {
+		// Don't hold a name the list doesn't give pubkey
+		if holder, found := m.LookupNIP05(name); !found || holder != pubkey {
+			m.syncNIP05Reservations(nil, nostr.PubKey{}, []string{name})
+		}
+		return err
+	}
+
+	return nil
+}
+
+func nip05KV(events *EventStore) *KV {
+	return &KV{Name: "zooid:" + events.Schema.Name}
+}
+
+// reserveNIP05 reserves the normalized name for pubkey, failing with
+// ErrNIP05Taken if another pubkey reserved it first. Reserving a name
+// pubkey already has succeeds.
+func (m *ManagementStore) reserveNIP05(name string, pubkey nostr.PubKey) error {
+	ctx, cancel := context.WithTimeout(m.Events.rootCtx, dbOpTimeout)
+	defer cancel()
+
+	kv := nip05KV(m.Events)
+	reserved, err := kv.SetIfAbsent(ctx, "nip05:"+name, pubkey.Hex())
+	if err != nil || reserved {
+		return err
+	}
+
+	holder, err := kv.Get(ctx, "nip05:"+name)
+	if errors.Is(err, ErrKVNotFound) {
+		// Freed in the meantime; the claim can be sent again
+		return ErrNIP05Taken
+	}
+	if err != nil {
+		return err
+	}
+	if holder != pubkey.Hex() {
+		return ErrNIP05Taken
+	}
+
+	return nil
+}
+
+// syncNIP05Reservations gives names to holder in the kv store and frees
+// freed, after the list changed.
+func (m *ManagementStore) syncNIP05Reservations(names []string, holder nostr.PubKey, freed []string) {
+	ctx, cancel := context.WithTimeout(m.Events.rootCtx, dbOpTimeout)
+	defer cancel()
+
+	kv := nip05KV(m.Events)
+	for _, name := range names {
+		if err := kv.Set(ctx, "nip05:"+name, holder.Hex()); err != nil {
+			log.Printf("Failed to reserve NIP-05 name %q: %v", name, err)
+		}
+	}
+	for _, name := range freed {
+		if err := kv.Delete(ctx, "nip05:"+name); err != nil {
+			log.Printf("Failed to free NIP-05 name %q: %v", name, err)
+		}
+	}
+}
+
+func (m *ManagementStore) putNIP05(name string, pubkey nostr.PubKey, claim bool) error {
+	name, err := normalizeNIP05Name(name)
+	if err != nil {
+		return err
+	}
+
+	m.nip05Mu.Lock()
+	defer m.nip05Mu.Unlock()
+
+	event := m.Events.GetOrCreateApplicationSpecificData(NIP05_NAMES)
+	if tag := event.Tags.FindWithValue("name", name); tag != nil && len(tag) >= 3 && tag[2] != pubkey.Hex() {
+		return ErrNIP05Taken
+	}
+
+	var freed []string
+	event.CreatedAt = nostr.Now()
+	event.Tags = Filter(event.Tags, func(t nostr.Tag) bool {
+		if len(t) < 3 || t[0] != "name" {
+			return true
+		}
+		if t[1] == name {
+			return false
+		}
+		// A new claim replaces the old one
+		if claim && t[2] == pubkey.Hex() && isNIP05Claim(t) {
+			freed = append(freed, t[1])
+			return false
+		}
+		return true
+	})
+
+	tag := nostr.Tag{"name", name, pubkey.Hex()}
+	if claim {
+		tag = append(tag, "claim")
+	}
+	event.Tags = append(event.Tags, tag)
+
+	if err := m.Events.SignAndStoreEvent(&event, false); err != nil {
+		return err
+	}
+
+	m.syncNIP05Reservations([]string{name}, pubkey, freed)
+	m.loadNIP05Names()
+	m.Events.announce(cacheMessage{Action: cacheNIP05})
+	return nil
+}
+
+// DeleteNIP05 frees name.
+func (m *ManagementStore) DeleteNIP05(name string) error {
+	name = strings.ToLower(name)
+
+	m.nip05Mu.Lock()
+	defer m.nip05Mu.Unlock()
+
+	event := m.Events.GetOrCreateApplicationSpecificData(NIP05_NAMES)
+	if event.Tags.FindWithValue("name", name) == nil {
+		return nil
+	}
+
+	event.CreatedAt = nostr.Now()
+	event.Tags = Filter(event.Tags, func(t nostr.Tag) bool {
+		return len(t) < 2 || t[0] != "name" || t[1] != name
+	})
+
+	if err := m.Events.SignAndStoreEvent(&event, false); err != nil {
+		return err
+	}
+
+	m.syncNIP05Reservations(nil, nostr.PubKey{}, []string{name})
+	m.loadNIP05Names()
+	m.Events.announce(cacheMessage{Action: cacheNIP05})
+	return nil
+}
+
+func isNIP05Claim(tag nostr.Tag) bool {
+	return len(tag) >= 4 && tag[3] == "claim"
+}
+
+// refreshNIP05Names reloads the names after another instance changed them.
+func (m *ManagementStore) refreshNIP05Names() {
+	if !m.cachesWarmed {
+		return
+	}
+
+	m.loadNIP05Names()
+}
+
+// checkNIP05Claim returns why a member's claim can't be accepted, or "" if
+// it can.
+func (instance *Instance) checkNIP05Claim(event nostr.Event) string {
+	if !instance.Config.NIP05.Enabled {
+		return RejectRestricted.Reason("NIP-05 names aren't enabled on this relay")
+	}
+
+	tag := event.Tags.Find("name")
+	if tag == nil {
+		return RejectInvalid.Reason("missing name tag")
+	}
+
+	name, err := normalizeNIP05Name(tag[1])
+	if err != nil {
+		return RejectInvalid.Reason(err.Error())
+	}
+	if instance.Config.IsReservedNIP05Name(name) {
+		return RejectRestricted.Reason(ErrNIP05Reserved.Error())
+	}
+	if holder, found := instance.Management.LookupNIP05(name); found && holder != event.PubKey {
+		return RejectRestricted.Reason(ErrNIP05Taken.Error())
+	}
+
+	return ""
+}
+
+// reserveNIP05Claim reserves the name a member's claim asks for, returning
+// why it can't be accepted if another pubkey has it. OnEvent calls it after
+// every other check, so a refused claim doesn't hold a name.
+func (instance *Instance) reserveNIP05Claim(event nostr.Event) string {
+	name, err := normalizeNIP05Name(event.Tags.Find("name")[1])
+	if err != nil {
+		return RejectInvalid.Reason(err.Error())
+	}
+
+	err = instance.Management.reserveNIP05(name, event.PubKey)
+	if errors.Is(err, ErrNIP05Taken) {
+		return RejectRestricted.Reason(ErrNIP05Taken.Error())
+	}
+	if err != nil {
+		log.Printf("Failed to reserve NIP-05 name %q for %s: %v", name, event.PubKey.Hex(), err)
+		return RejectError.Reason("couldn't claim the name, try again")
+	}
+
+	return ""
+}
+
+// ServeNIP05 handles GET /.well-known/nostr.json?name=<name>. Without a
+// name the response has no names, so members can't be listed.
+func (instance *Instance) ServeNIP05(w http.ResponseWriter, r *http.Request) {
+	names := make(map[string]string)
+	if name := strings.ToLower(r.URL.Query().Get("name")); name != "" {
+		if pubkey, found := instance.Management.LookupNIP05(name); found && !instance.Management.PubkeyIsBanned(pubkey) {
+			names[name] = pubkey.Hex()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(map[string]any{"names": names})
+}
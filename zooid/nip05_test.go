@@ -0,0 +1,155 @@
+package zooid
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func lookupNIP05(t *testing.T, instance *Instance, name string) map[string]string {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "https://test.com/.well-known/nostr.json?name="+name, nil)
+	w := httptest.NewRecorder()
+	instance.ServeNIP05(w, r)
+
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("no CORS header: %v", w.Header())
+	}
+
+	var doc struct {
+		Names map[string]string `json:"names"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid document %q: %v", w.Body.String(), err)
+	}
+	return doc.Names
+}
+
+func TestNIP05_Claim(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.NIP05.Enabled = true
+
+	alice := nostr.Generate()
+	bob := nostr.Generate()
+	instance.Management.AddMember(alice.Public())
+	instance.Management.AddMember(bob.Public())
+
+	claim := func(secret nostr.SecretKey, name string) string {
+		t.Helper()
+		event := signedBy(secret, nostr.Event{Kind: RELAY_NIP05_CLAIM, Tags: nostr.Tags{{"name", name}}})
+		if reject, msg := instance.OnEvent(authedContext(secret.Public()), event); reject {
+			return msg
+		}
+		instance.OnEphemeralEvent(context.Background(), event)
+		return ""
+	}
+
+	if msg := claim(alice, "Alice"); msg != "" {
+		t.Fatalf("claim refused: %s", msg)
+	}
+	if names := lookupNIP05(t, instance, "alice"); names["alice"] != alice.Public().Hex() {
+		t.Errorf("lookup of alice = %v", names)
+	}
+	if names := lookupNIP05(t, instance, ""); len(names) != 0 {
+		t.Errorf("lookup without a name = %v, want none", names)
+	}
+
+	// Taken, reserved and invalid names
+	if msg := claim(bob, "alice"); msg == "" {
+		t.Error("bob claimed alice's name")
+	} else {
+		assertPrefix(t, "taken", msg, RejectRestricted)
+	}
+	if msg := claim(bob, "admin"); msg == "" {
+		t.Error("bob claimed a reserved name")
+	}
+	if msg := claim(bob, "bob smith"); msg == "" {
+		t.Error("bob claimed an invalid name")
+	}
+	if err := instance.Management.SetNIP05("alice", bob.Public()); err != ErrNIP05Taken {
+		t.Errorf("SetNIP05 of a taken name = %v, want %v", err, ErrNIP05Taken)
+	}
+
+	// Managers may give out reserved names, and a new claim leaves them alone
+	if err := instance.Management.SetNIP05("_", alice.Public()); err != nil {
+		t.Fatal(err)
+	}
+	if msg := claim(alice, "al"); msg != "" {
+		t.Fatalf("second claim refused: %s", msg)
+	}
+	names := instance.Management.NIP05Names()
+	if _, found := names["alice"]; found || names["al"] != alice.Public() || names["_"] != alice.Public() {
+		t.Errorf("names after a new claim: %v, want al and _ for alice", names)
+	}
+
+	// The old name is free again
+	if msg := claim(bob, "alice"); msg != "" {
+		t.Errorf("claim of a released name refused: %s", msg)
+	}
+}
+
+func TestNIP05_ConcurrentClaims(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.NIP05.Enabled = true
+
+	alice, bob := nostr.Generate(), nostr.Generate()
+	instance.Management.AddMember(alice.Public())
+	instance.Management.AddMember(bob.Public())
+
+	// Both claims reach OnEvent before either is written to the list, as
+	// on two instances at once
+	first := signedBy(alice, nostr.Event{Kind: RELAY_NIP05_CLAIM, Tags: nostr.Tags{{"name", "dave"}}})
+	second := signedBy(bob, nostr.Event{Kind: RELAY_NIP05_CLAIM, Tags: nostr.Tags{{"name", "Dave"}}})
+	if reject, msg := instance.OnEvent(authedContext(alice.Public()), first); reject {
+		t.Fatalf("first claim refused: %s", msg)
+	}
+	reject, msg := instance.OnEvent(authedContext(bob.Public()), second)
+	if !reject {
+		t.Fatal("a claim of a name reserved by someone else was accepted")
+	}
+	assertPrefix(t, "taken", msg, RejectRestricted)
+
+	instance.OnEphemeralEvent(context.Background(), first)
+	if names := lookupNIP05(t, instance, "dave"); names["dave"] != alice.Public().Hex() {
+		t.Errorf("lookup of dave = %v, want alice", names)
+	}
+
+	// Freeing the name frees the reservation
+	if err := instance.Management.DeleteNIP05("dave"); err != nil {
+		t.Fatal(err)
+	}
+	if reject, msg := instance.OnEvent(authedContext(bob.Public()), second); reject {
+		t.Errorf("claim of a freed name refused: %s", msg)
+	}
+}
+
+func TestNIP05_Delete(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.NIP05.Enabled = true
+
+	pubkey := nostr.Generate().Public()
+	if err := instance.Management.SetNIP05("carol", pubkey); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restart loads the names from the app data
+	instance.Management.nip05Names.Store(nil)
+	if err := instance.Management.WarmCaches(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := instance.Management.LookupNIP05("CAROL"); got != pubkey {
+		t.Errorf("lookup after warming = %s, want %s", got.Hex(), pubkey.Hex())
+	}
+
+	if err := instance.Management.DeleteNIP05("carol"); err != nil {
+		t.Fatal(err)
+	}
+	if names := lookupNIP05(t, instance, "carol"); len(names) != 0 {
+		t.Errorf("lookup of a deleted name = %v", names)
+	}
+}
@@ -0,0 +1,190 @@
+package zooid
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"fiatjaf.com/nostr"
+)
+
+// NIP 98 HTTP auth, shared by every HTTP endpoint zooid serves itself.
+//
+// HTTPAuth validates the Authorization header and puts the pubkey on the
+// request context; RequireAdmin and RequireMember layer access checks on top.
+// Handlers read the result with GetHTTPAuthed.
+
+// KindHTTPAuth is the NIP 98 HTTP auth event kind.
+const KindHTTPAuth nostr.Kind = 27235
+
+// httpAuthWindow is how far an auth event's created_at may be from now, in
+// seconds, in either direction.
+const httpAuthWindow = 60
+
+// seenHTTPAuth holds the ids of auth events that have already been accepted,
+// so a captured header can't be replayed while it's still fresh. Entries map
+// to the time after which they can no longer pass the freshness check anyway.
+var (
+	seenHTTPAuth      sync.Map // nostr.ID -> nostr.Timestamp
+	seenHTTPAuthCount atomic.Int64
+)
+
+type httpAuthKey struct{}
+
+// GetHTTPAuthed returns the pubkey HTTPAuth authenticated for this request.
+func GetHTTPAuthed(ctx context.Context) (nostr.PubKey, bool) {
+	pubkey, ok := ctx.Value(httpAuthKey{}).(nostr.PubKey)
+	return pubkey, ok
+}
+
+// HTTPAuth validates a NIP 98 Authorization header, if the request has one,
+// and passes the pubkey to next through the request context. Requests without
+// the header pass through unauthenticated; invalid ones get a 401.
+func HTTPAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		payload, err := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(payload))
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		pubkey, err := authenticateHTTPRequest(r, payload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), httpAuthKey{}, pubkey)))
+	})
+}
+
+// RequireAdmin only lets through requests authenticated as a relay admin.
+func (instance *Instance) RequireAdmin(next http.Handler) http.Handler {
+	return requireHTTPAuth(next, instance.Config.CanManage, RejectRestricted.Reason("only relay admins can access this"))
+}
+
+// RequireMember only lets through requests authenticated as a relay member.
+func (instance *Instance) RequireMember(next http.Handler) http.Handler {
+	return requireHTTPAuth(next, instance.Management.IsMember, RejectRestricted.Reason("you are not a member of this relay"))
+}
+
+func requireHTTPAuth(next http.Handler, allowed func(nostr.PubKey) bool, msg string) http.Handler {
+	return HTTPAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pubkey, ok := GetHTTPAuthed(r.Context())
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Nostr")
+			http.Error(w, RejectAuthRequired.Reason("authentication is required for access"), http.StatusUnauthorized)
+			return
+		}
+
+		if !allowed(pubkey) {
+			http.Error(w, msg, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// authenticateHTTPRequest validates the NIP 98 Authorization header of r,
+// whose body is payload, and returns the authenticated pubkey. The auth event
+// must be bound to the request's method, URL and (when there is a body)
+// payload hash, be fresh, and not have been used before.
+func authenticateHTTPRequest(r *http.Request, payload []byte) (nostr.PubKey, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !ok {
+		return nostr.PubKey{}, errors.New("missing auth")
+	}
+
+	evtj, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nostr.PubKey{}, errors.New("invalid base64 auth")
+	}
+
+	var evt nostr.Event
+	if err := json.Unmarshal(evtj, &evt); err != nil {
+		return nostr.PubKey{}, errors.New("invalid auth event json")
+	}
+
+	if evt.Kind != KindHTTPAuth || !evt.VerifySignature() {
+		return nostr.PubKey{}, errors.New("invalid auth event")
+	}
+
+	now := nostr.Now()
+	if evt.CreatedAt < now-httpAuthWindow {
+		return nostr.PubKey{}, errors.New("auth event is too old")
+	}
+	if evt.CreatedAt > now+httpAuthWindow {
+		return nostr.PubKey{}, errors.New("auth event is in the future")
+	}
+
+	if tag := evt.Tags.Find("method"); tag == nil || !strings.EqualFold(tag[1], r.Method) {
+		return nostr.PubKey{}, errors.New("invalid \"method\" tag")
+	}
+
+	// Normalizing lets NIP 86 clients sign the bare relay URL for POST /.
+	expected := nostr.NormalizeURL(requestBaseURL(r) + r.URL.RequestURI())
+	if tag := evt.Tags.Find("u"); tag == nil || nostr.NormalizeURL(tag[1]) != expected {
+		return nostr.PubKey{}, errors.New("invalid \"u\" tag")
+	}
+
+	if len(payload) > 0 {
+		hash := sha256.Sum256(payload)
+		if evt.Tags.FindWithValue("payload", hex.EncodeToString(hash[:])) == nil {
+			return nostr.PubKey{}, errors.New("invalid auth event payload hash")
+		}
+	}
+
+	if _, seen := seenHTTPAuth.LoadOrStore(evt.ID, evt.CreatedAt+httpAuthWindow); seen {
+		return nostr.PubKey{}, errors.New("auth event has already been used")
+	}
+
+	if seenHTTPAuthCount.Add(1)%1000 == 0 {
+		seenHTTPAuth.Range(func(key, value any) bool {
+			if value.(nostr.Timestamp) < now {
+				seenHTTPAuth.Delete(key)
+			}
+			return true
+		})
+	}
+
+	return evt.PubKey, nil
+}
+
+// requestBaseURL reproduces khatru's (unexported) base URL detection, which
+// NIP 86 clients sign as the "u" tag.
+func requestBaseURL(r *http.Request) string {
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		if host == "localhost" || strings.Contains(host, ":") {
+			proto = "http"
+		} else if _, err := strconv.Atoi(strings.ReplaceAll(host, ".", "")); err == nil {
+			proto = "http"
+		} else {
+			proto = "https"
+		}
+	}
+
+	return proto + "://" + host
+}
@@ -0,0 +1,175 @@
+package zooid
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func signTestHTTPAuth(t *testing.T, secret nostr.SecretKey, createdAt nostr.Timestamp, tags nostr.Tags) string {
+	t.Helper()
+
+	auth := nostr.Event{Kind: KindHTTPAuth, CreatedAt: createdAt, Tags: tags}
+	if err := auth.Sign(secret); err != nil {
+		t.Fatalf("failed to sign auth event: %v", err)
+	}
+	authj, _ := json.Marshal(auth)
+
+	return "Nostr " + base64.StdEncoding.EncodeToString(authj)
+}
+
+func authedTestPubkey(t *testing.T, r *http.Request) (int, nostr.PubKey) {
+	t.Helper()
+
+	var pubkey nostr.PubKey
+	w := httptest.NewRecorder()
+	HTTPAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pubkey, _ = GetHTTPAuthed(r.Context())
+	})).ServeHTTP(w, r)
+
+	return w.Code, pubkey
+}
+
+func TestHTTPAuth_Valid(t *testing.T) {
+	secret := nostr.Generate()
+	body := []byte(`{"hello":"world"}`)
+	hash := sha256.Sum256(body)
+
+	r := httptest.NewRequest(http.MethodPost, "https://test.com/export?since=1", bytes.NewReader(body))
+	r.Header.Set("Authorization", signTestHTTPAuth(t, secret, nostr.Now(), nostr.Tags{
+		{"u", "https://test.com/export?since=1"},
+		{"method", "POST"},
+		{"payload", hex.EncodeToString(hash[:])},
+	}))
+
+	code, pubkey := authedTestPubkey(t, r)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if pubkey != secret.Public() {
+		t.Errorf("expected pubkey %s on the context, got %s", secret.Public(), pubkey)
+	}
+}
+
+func TestHTTPAuth_Anonymous(t *testing.T) {
+	code, pubkey := authedTestPubkey(t, httptest.NewRequest(http.MethodGet, "https://test.com/e/00", nil))
+	if code != http.StatusOK {
+		t.Errorf("requests without auth should pass through, got %d", code)
+	}
+	if pubkey != (nostr.PubKey{}) {
+		t.Error("anonymous requests should have no pubkey")
+	}
+}
+
+func TestHTTPAuth_Rejections(t *testing.T) {
+	secret := nostr.Generate()
+	url := "https://test.com/e/00"
+	bound := nostr.Tags{{"u", url}, {"method", "GET"}}
+
+	tests := []struct {
+		name      string
+		method    string
+		body      string
+		createdAt nostr.Timestamp
+		tags      nostr.Tags
+	}{
+		{"expired", http.MethodGet, "", nostr.Now() - 2*httpAuthWindow, bound},
+		{"future", http.MethodGet, "", nostr.Now() + 2*httpAuthWindow, bound},
+		{"wrong url", http.MethodGet, "", nostr.Now(), nostr.Tags{{"u", "https://test.com/e/01"}, {"method", "GET"}}},
+		{"wrong host", http.MethodGet, "", nostr.Now(), nostr.Tags{{"u", "https://other.com/e/00"}, {"method", "GET"}}},
+		{"wrong method", http.MethodDelete, "", nostr.Now(), bound},
+		{"missing method", http.MethodGet, "", nostr.Now(), nostr.Tags{{"u", url}}},
+		{"payload mismatch", http.MethodPost, "body", nostr.Now(), nostr.Tags{{"u", url}, {"method", "POST"}, {"payload", "00"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, url, bytes.NewReader([]byte(tt.body)))
+			r.Header.Set("Authorization", signTestHTTPAuth(t, secret, tt.createdAt, tt.tags))
+
+			if code, _ := authedTestPubkey(t, r); code != http.StatusUnauthorized {
+				t.Errorf("expected 401, got %d", code)
+			}
+		})
+	}
+}
+
+func TestHTTPAuth_Replay(t *testing.T) {
+	secret := nostr.Generate()
+	header := signTestHTTPAuth(t, secret, nostr.Now(), nostr.Tags{{"u", "https://test.com/e/00"}, {"method", "GET"}})
+
+	first := httptest.NewRequest(http.MethodGet, "https://test.com/e/00", nil)
+	first.Header.Set("Authorization", header)
+	if code, _ := authedTestPubkey(t, first); code != http.StatusOK {
+		t.Fatalf("first use should be accepted, got %d", code)
+	}
+
+	replay := httptest.NewRequest(http.MethodGet, "https://test.com/e/00", nil)
+	replay.Header.Set("Authorization", header)
+	if code, _ := authedTestPubkey(t, replay); code != http.StatusUnauthorized {
+		t.Errorf("replayed auth should be rejected, got %d", code)
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	adminSecret := nostr.Generate()
+	instance := &Instance{Config: &Config{
+		Host:   "test.com",
+		secret: nostr.Generate(),
+		Roles:  map[string]Role{"admin": {Pubkeys: []string{adminSecret.Public().Hex()}, CanManage: true}},
+	}}
+
+	handler := instance.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name   string
+		secret *nostr.SecretKey
+		want   int
+	}{
+		{"anonymous", nil, http.StatusUnauthorized},
+		{"non-admin", func() *nostr.SecretKey { s := nostr.Generate(); return &s }(), http.StatusForbidden},
+		{"admin", &adminSecret, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "https://test.com/admin", nil)
+			if tt.secret != nil {
+				r.Header.Set("Authorization", signTestHTTPAuth(t, *tt.secret, nostr.Now(), nostr.Tags{{"u", "https://test.com/admin"}, {"method", "GET"}}))
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, w.Code)
+			}
+		})
+	}
+}
+
+func TestRequireMember(t *testing.T) {
+	instance := createTestInstance()
+	memberSecret := nostr.Generate()
+	instance.Management.AddMember(memberSecret.Public())
+	outsiderSecret := nostr.Generate()
+
+	handler := instance.RequireMember(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for secret, want := range map[*nostr.SecretKey]int{&memberSecret: http.StatusOK, &outsiderSecret: http.StatusForbidden} {
+		r := httptest.NewRequest(http.MethodGet, "https://test.com/media", nil)
+		r.Header.Set("Authorization", signTestHTTPAuth(t, *secret, nostr.Now(), nostr.Tags{{"u", "https://test.com/media"}, {"method", "GET"}}))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("expected %d, got %d", want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package zooid
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// Paid membership.
+//
+// With payments.price set, a RELAY_JOIN event may carry proof of payment
+// instead of an invite claim: ["preimage", <hex>] for a paid lightning
+// invoice, or ["cashu", <token>]. ValidateJoinRequest hands the proof to
+// ManagementStore.PaymentVerifier, and if it paid at least the price, makes
+// the sender a member for payments.period, or extends their membership by
+// that much. Each payment is redeemed once: it's reserved under
+// zooid:<schema>:payment:<id> before the membership is granted, and the
+// redeemed ones are listed in zooid/payments app data. Members who joined some other way are members
+// indefinitely and have nothing to pay for.
+//
+// The built-in verifiers ask an LNbits wallet or an LND node, named by
+// payments.backend and payments.url, whether the invoice whose payment hash
+// is the preimage's hash was paid. They don't redeem cashu tokens; an
+// embedder can set its own PaymentVerifier for that.
+
+const (
+	defaultPaymentPeriod = 30 * 24 * time.Hour
+
+	// paymentVerifyTimeout bounds how long a join waits for the verifier.
+	paymentVerifyTimeout = 10 * time.Second
+)
+
+// ErrPaymentUnknown is returned by a PaymentVerifier for a proof that
+// matches no payment.
+var ErrPaymentUnknown = errors.New("no invoice matches this preimage")
+
+// ErrPaymentUnpaid is returned by a PaymentVerifier for an invoice that
+// hasn't been paid.
+var ErrPaymentUnpaid = errors.New("invoice hasn't been paid")
+
+// ErrPaymentInvalid is returned by a PaymentVerifier for a malformed proof.
+var ErrPaymentInvalid = errors.New("preimage must be 32 bytes of hex")
+
+// ErrPaymentUnsupported is returned by a PaymentVerifier for a kind of proof
+// it can't check.
+var ErrPaymentUnsupported = errors.New("this kind of payment isn't accepted")
+
+// PaymentProof is the proof of payment a join request carries. Type is the
+// name of its tag, "preimage" or "cashu".
+type PaymentProof struct {
+	Type  string
+	Value string
+}
+
+// Payment is a verified payment. ID tells it apart from other payments, so
+// it's redeemed once, and Amount is in sats.
+type Payment struct {
+	ID     string
+	Amount int64
+}
+
+// PaymentVerifier checks proofs of payment. It returns ErrPaymentUnknown,
+// ErrPaymentUnpaid, ErrPaymentInvalid or ErrPaymentUnsupported, wrapped or
+// not, when the proof doesn't show a payment; their text is what the client
+// is told. Any other error is taken to mean the payment couldn't be checked.
+type PaymentVerifier interface {
+	VerifyPayment(ctx context.Context, proof PaymentProof) (Payment, error)
+}
+
+// paymentProof returns the proof of payment event carries, if any.
+func paymentProof(event nostr.Event) (PaymentProof, bool) {
+	for _, name := range []string{"preimage", "cashu"} {
+		if tag := event.Tags.Find(name); tag != nil {
+			return PaymentProof{Type: name, Value: tag[1]}, true
+		}
+	}
+
+	return PaymentProof{}, false
+}
+
+// redeemPayment makes pubkey a member for the period proof paid for, or
+// says why it can't.
+func (m *ManagementStore) redeemPayment(pubkey nostr.PubKey, proof PaymentProof) (reject bool, msg string) {
+	price := m.Config.Payments.Price
+	if price <= 0 || m.PaymentVerifier == nil {
+		return RejectRestricted.Reject("this relay doesn't sell membership")
+	}
+
+	ctx, cancel := context.WithTimeout(m.Events.rootCtx, paymentVerifyTimeout)
+	defer cancel()
+
+	payment, err := m.PaymentVerifier.VerifyPayment(ctx, proof)
+	for _, known := range []error{ErrPaymentUnknown, ErrPaymentUnpaid, ErrPaymentInvalid, ErrPaymentUnsupported} {
+		if errors.Is(err, known) {
+			return RejectRestricted.Reject(err.Error())
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to verify payment from %s: %v", pubkey.Hex(), err)
+		return RejectError.Reject("couldn't verify the payment, try again later")
+	}
+
+	if payment.Amount < price {
+		return RejectRestricted.Reject(fmt.Sprintf("paid %d sats, membership costs %d", payment.Amount, price))
+	}
+
+	// Reserved before anything else, so of two joins racing with one
+	// payment, on this instance or another sharing the database, only one
+	// gets the membership
+	reserved, err := m.paymentsKV().SetIfAbsent(m.Events.rootCtx, "payment:"+payment.ID, pubkey.Hex())
+	if err != nil {
+		log.Printf("Failed to reserve payment %s from %s: %v", payment.ID, pubkey.Hex(), err)
+		return RejectError.Reject("couldn't verify the payment, try again later")
+	}
+	if !reserved {
+		return RejectRestricted.Reject("this payment has already been redeemed")
+	}
+
+	m.paymentsMu.Lock()
+	defer m.paymentsMu.Unlock()
+
+	payments := m.Events.GetOrCreateApplicationSpecificData(REDEEMED_PAYMENTS)
+	if payments.Tags.FindWithValue("payment", payment.ID) != nil {
+		return RejectRestricted.Reject("this payment has already been redeemed")
+	}
+
+	start := membershipNow()
+	if tag := m.Events.GetOrCreateRelayMembersList().Tags.FindWithValue("member", pubkey.Hex()); tag != nil {
+		expires := memberTagExpiry(tag)
+		if expires == 0 {
+			m.releasePayment(payment.ID)
+			return RejectRestricted.Reject("you're already a member")
+		}
+		start = max(start, expires)
+	}
+	until := start + nostr.Timestamp(m.Config.GetPaymentPeriod().Seconds())
+
+	if err := m.AllowPubkeyUntil(pubkey, until); err != nil {
+		log.Printf("Failed to add paying member %s: %v", pubkey.Hex(), err)
+		m.releasePayment(payment.ID)
+		return RejectError.Reject("payment verified, but membership couldn't be saved, try again later")
+	}
+
+	payments.CreatedAt = nostr.Now()
+	payments.Tags = append(payments.Tags, nostr.Tag{"payment", payment.ID, pubkey.Hex(), strconv.FormatInt(int64(until), 10)})
+	if err := m.Events.SignAndStoreEvent(&payments, false); err != nil {
+		log.Printf("Failed to record payment %s from %s: %v", payment.ID, pubkey.Hex(), err)
+	}
+
+	return false, ""
+}
+
+func (m *ManagementStore) paymentsKV() *KV {
+	return &KV{Name: "zooid:" + m.Events.Schema.Name}
+}
+
+// releasePayment gives up the reservation of a payment that wasn't
+// redeemed after all, so it can be tried again.
+func (m *ManagementStore) releasePayment(id string) {
+	ctx, cancel := context.WithTimeout(m.Events.rootCtx, dbOpTimeout)
+	defer cancel()
+
+	if err := m.paymentsKV().Delete(ctx, "payment:"+id); err != nil {
+		log.Printf("Failed to release payment %s: %v", id, err)
+	}
+}
+
+// startPayments sets up the verifier payments.backend names, unless an
+// embedder has set one.
+func (instance *Instance) startPayments() {
+	if instance.Management.PaymentVerifier != nil {
+		return
+	}
+
+	payments := instance.Config.Payments
+	client := &http.Client{Timeout: paymentVerifyTimeout}
+	switch payments.Backend {
+	case "lnbits":
+		instance.Management.PaymentVerifier = lnbitsVerifier{url: strings.TrimSuffix(payments.URL, "/"), key: payments.Key, client: client}
+	case "lnd":
+		instance.Management.PaymentVerifier = lndVerifier{url: strings.TrimSuffix(payments.URL, "/"), macaroon: payments.Key, client: client}
+	}
+}
+
+// paymentHash returns the payment hash of the invoice a preimage proof is
+// for.
+func paymentHash(proof PaymentProof) (string, error) {
+	if proof.Type != "preimage" {
+		return "", ErrPaymentUnsupported
+	}
+
+	preimage, err := hex.DecodeString(proof.Value)
+	if err != nil || len(preimage) != 32 {
+		return "", ErrPaymentInvalid
+	}
+
+	hash := sha256.Sum256(preimage)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// getInvoice GETs url with header set to value and decodes the response
+// into v. A 404 is ErrPaymentUnknown.
+func getInvoice(ctx context.Context, client *http.Client, url, header, value string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(header, value)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return ErrPaymentUnknown
+	}
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("payment backend returned %s", res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// lnbitsVerifier checks invoices of an LNbits wallet, with its invoice key.
+type lnbitsVerifier struct {
+	url    string
+	key    string
+	client *http.Client
+}
+
+func (v lnbitsVerifier) VerifyPayment(ctx context.Context, proof PaymentProof) (Payment, error) {
+	hash, err := paymentHash(proof)
+	if err != nil {
+		return Payment{}, err
+	}
+
+	var invoice struct {
+		Paid    bool `json:"paid"`
+		Details struct {
+			Amount int64 `json:"amount"` // msats
+		} `json:"details"`
+	}
+	if err := getInvoice(ctx, v.client, v.url+"/api/v1/payments/"+hash, "X-Api-Key", v.key, &invoice); err != nil {
+		return Payment{}, err
+	}
+
+	if !invoice.Paid {
+		return Payment{}, ErrPaymentUnpaid
+	}
+	if invoice.Details.Amount < 0 {
+		// An outgoing payment of the wallet's, not an invoice
+		return Payment{}, ErrPaymentUnknown
+	}
+
+	return Payment{ID: hash, Amount: invoice.Details.Amount / 1000}, nil
+}
+
+// lndVerifier checks invoices of an LND node over its REST API, with a
+// hex-encoded invoice macaroon.
+type lndVerifier struct {
+	url      string
+	macaroon string
+	client   *http.Client
+}
+
+func (v lndVerifier) VerifyPayment(ctx context.Context, proof PaymentProof) (Payment, error) {
+	hash, err := paymentHash(proof)
+	if err != nil {
+		return Payment{}, err
+	}
+
+	var invoice struct {
+		State      string `json:"state"`
+		AmtPaidSat int64  `json:"amt_paid_sat,string"`
+	}
+	if err := getInvoice(ctx, v.client, v.url+"/v1/invoice/"+hash, "Grpc-Metadata-macaroon", v.macaroon, &invoice); err != nil {
+		return Payment{}, err
+	}
+
+	if invoice.State != "SETTLED" {
+		return Payment{}, ErrPaymentUnpaid
+	}
+
+	return Payment{ID: hash, Amount: invoice.AmtPaidSat}, nil
+}
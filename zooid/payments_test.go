@@ -0,0 +1,198 @@
+package zooid
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+	"fiatjaf.com/nostr/nip11"
+)
+
+// fakeVerifier knows the payments in paid, by preimage.
+type fakeVerifier struct {
+	paid map[string]int64
+	err  error
+}
+
+func (v fakeVerifier) VerifyPayment(ctx context.Context, proof PaymentProof) (Payment, error) {
+	if v.err != nil {
+		return Payment{}, v.err
+	}
+	if proof.Type != "preimage" {
+		return Payment{}, ErrPaymentUnsupported
+	}
+
+	amount, ok := v.paid[proof.Value]
+	if !ok {
+		return Payment{}, ErrPaymentUnknown
+	}
+	return Payment{ID: "hash-" + proof.Value, Amount: amount}, nil
+}
+
+func TestPayments_Join(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Payments.Price = 1000
+	instance.Config.Payments.Period = "30d"
+	instance.Management.PaymentVerifier = fakeVerifier{paid: map[string]int64{"full": 1000, "again": 2000, "short": 500}}
+
+	now := nostr.Timestamp(1_700_000_000)
+	prev := membershipNow
+	membershipNow = func() nostr.Timestamp { return now }
+	t.Cleanup(func() { membershipNow = prev })
+
+	payer := nostr.Generate()
+	join := func(tags nostr.Tags) string {
+		t.Helper()
+		event := signedBy(payer, nostr.Event{Kind: RELAY_JOIN, Tags: tags})
+		_, msg := instance.Management.ValidateJoinRequest(event)
+		return msg
+	}
+	expiry := func() nostr.Timestamp {
+		t.Helper()
+		tag := instance.Events.GetOrCreateRelayMembersList().Tags.FindWithValue("member", payer.Public().Hex())
+		if tag == nil {
+			t.Fatal("the payer isn't a member")
+		}
+		return memberTagExpiry(tag)
+	}
+	period := nostr.Timestamp(30 * 24 * time.Hour / time.Second)
+
+	for _, c := range []struct {
+		proof nostr.Tag
+		want  string
+	}{
+		{nostr.Tag{"preimage", "short"}, "restricted: paid 500 sats, membership costs 1000"},
+		{nostr.Tag{"preimage", "unknown"}, "restricted: " + ErrPaymentUnknown.Error()},
+		{nostr.Tag{"cashu", "cashuA..."}, "restricted: " + ErrPaymentUnsupported.Error()},
+	} {
+		if msg := join(nostr.Tags{c.proof}); msg != c.want {
+			t.Errorf("join with %v: %q, want %q", c.proof, msg, c.want)
+		}
+	}
+	if instance.Management.IsMember(payer.Public()) {
+		t.Fatal("a failed payment made the payer a member")
+	}
+
+	if msg := join(nostr.Tags{{"preimage", "full"}}); msg != "" {
+		t.Fatalf("join with a payment refused: %s", msg)
+	}
+	if !instance.Management.IsMember(payer.Public()) || expiry() != now+period {
+		t.Errorf("membership expires at %d, want %d", expiry(), now+period)
+	}
+
+	if msg := join(nostr.Tags{{"preimage", "full"}}); !strings.Contains(msg, "already been redeemed") {
+		t.Errorf("redeeming a payment twice: %q", msg)
+	}
+
+	// Paying again extends the membership
+	if msg := join(nostr.Tags{{"preimage", "again"}}); msg != "" {
+		t.Fatalf("renewal refused: %s", msg)
+	}
+	if expiry() != now+2*period {
+		t.Errorf("renewed membership expires at %d, want %d", expiry(), now+2*period)
+	}
+
+	// The verifier being down isn't the payer's fault
+	instance.Management.PaymentVerifier = fakeVerifier{err: context.DeadlineExceeded}
+	if msg := join(nostr.Tags{{"preimage", "later"}}); !strings.HasPrefix(msg, "error: ") {
+		t.Errorf("join while the verifier is down: %q", msg)
+	}
+}
+
+func TestPayments_RedeemedOnce(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Payments.Price = 1000
+	instance.Management.PaymentVerifier = fakeVerifier{paid: map[string]int64{"shared": 1000, "elsewhere": 1000}}
+
+	var wg sync.WaitGroup
+	var members atomic.Int64
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			payer := nostr.Generate()
+			event := signedBy(payer, nostr.Event{Kind: RELAY_JOIN, Tags: nostr.Tags{{"preimage", "shared"}}})
+			if _, msg := instance.Management.ValidateJoinRequest(event); msg == "" && instance.Management.IsMember(payer.Public()) {
+				members.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := members.Load(); n != 1 {
+		t.Errorf("one payment made %d members, want 1", n)
+	}
+
+	// As another instance sharing the database would have reserved it
+	ctx := context.Background()
+	if _, err := instance.Management.paymentsKV().SetIfAbsent(ctx, "payment:hash-elsewhere", "someone"); err != nil {
+		t.Fatal(err)
+	}
+	payer := nostr.Generate()
+	event := signedBy(payer, nostr.Event{Kind: RELAY_JOIN, Tags: nostr.Tags{{"preimage", "elsewhere"}}})
+	if _, msg := instance.Management.ValidateJoinRequest(event); !strings.Contains(msg, "already been redeemed") {
+		t.Errorf("join with a payment reserved elsewhere: %q", msg)
+	}
+	if instance.Management.IsMember(payer.Public()) {
+		t.Error("a payment reserved elsewhere made the payer a member")
+	}
+}
+
+func TestPayments_LNbits(t *testing.T) {
+	preimage := strings.Repeat("ab", 32)
+	raw, _ := hex.DecodeString(preimage)
+	sum := sha256.Sum256(raw)
+	hash := hex.EncodeToString(sum[:])
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "invoice-key" || r.URL.Path != "/api/v1/payments/"+hash {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"paid": true, "details": map[string]any{"amount": 21000}})
+	}))
+	defer server.Close()
+
+	instance := createTestInstance()
+	instance.Config.Payments.Backend = "lnbits"
+	instance.Config.Payments.URL = server.URL + "/"
+	instance.Config.Payments.Key = "invoice-key"
+	instance.startPayments()
+
+	payment, err := instance.Management.PaymentVerifier.VerifyPayment(context.Background(), PaymentProof{Type: "preimage", Value: preimage})
+	if err != nil || payment.ID != hash || payment.Amount != 21 {
+		t.Errorf("VerifyPayment = %+v, %v; want 21 sats for %s", payment, err, hash)
+	}
+
+	if _, err := instance.Management.PaymentVerifier.VerifyPayment(context.Background(), PaymentProof{Type: "preimage", Value: strings.Repeat("cd", 32)}); err != ErrPaymentUnknown {
+		t.Errorf("VerifyPayment of an unknown invoice = %v, want %v", err, ErrPaymentUnknown)
+	}
+	if _, err := instance.Management.PaymentVerifier.VerifyPayment(context.Background(), PaymentProof{Type: "preimage", Value: "nope"}); err != ErrPaymentInvalid {
+		t.Errorf("VerifyPayment of a malformed preimage = %v, want %v", err, ErrPaymentInvalid)
+	}
+}
+
+func TestPayments_RelayInfo(t *testing.T) {
+	instance := createTestInstance()
+	instance.Relay = khatru.NewRelay()
+	instance.Config.Payments.Price = 1000
+	instance.Config.Info.PaymentsURL = "https://example.com/pay"
+
+	info := instance.OverwriteRelayInformation(context.Background(), nil, nip11.RelayInformationDocument{})
+	if !info.Limitation.PaymentRequired || info.PaymentsURL != "https://example.com/pay" {
+		t.Errorf("payment_required %v, payments_url %q", info.Limitation.PaymentRequired, info.PaymentsURL)
+	}
+	if info.Fees == nil || len(info.Fees.Subscription) != 1 || info.Fees.Subscription[0].Amount != 1_000_000 || info.Fees.Subscription[0].Period != 30*24*60*60 {
+		t.Errorf("fees = %+v", info.Fees)
+	}
+}
@@ -1,6 +1,7 @@
 package zooid
 
 import (
+	"context"
 	"testing"
 
 	"fiatjaf.com/nostr"
@@ -43,6 +44,11 @@ func TestFTS_TsvectorSearch(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			if tt.search == "jump" {
+				skipOnSQLite(t, "stemming")
+				skipOnMemory(t, "stemming")
+			}
+
 			filter := nostr.Filter{Search: tt.search}
 			var results []nostr.Event
 			for evt := range store.QueryEvents(filter, 0) {
@@ -56,6 +62,101 @@ func TestFTS_TsvectorSearch(t *testing.T) {
 	}
 }
 
+func searchTestStore(t *testing.T, events ...nostr.Event) *EventStore {
+	t.Helper()
+
+	store := createTestEventStore()
+	store.Init()
+
+	for _, evt := range events {
+		if err := store.SaveEvent(evt); err != nil {
+			t.Fatalf("SaveEvent: %v", err)
+		}
+	}
+
+	return store
+}
+
+func searchIDs(store *EventStore, search string) []nostr.ID {
+	var ids []nostr.ID
+	for evt := range store.QueryEvents(nostr.Filter{Search: search}, 0) {
+		ids = append(ids, evt.ID)
+	}
+	return ids
+}
+
+func TestFTS_TagValues(t *testing.T) {
+	article := nostr.Event{
+		Kind:      nostr.KindArticle,
+		CreatedAt: nostr.Now(),
+		Content:   "Body text without the interesting words",
+		Tags: nostr.Tags{
+			{"d", "article"},
+			{"title", "Quarterly roadmap"},
+			{"t", "governance"},
+			{"p", "0000000000000000000000000000000000000000000000000000000000000001"},
+		},
+	}
+	article.Sign(nostr.Generate())
+
+	store := searchTestStore(t, article)
+
+	for _, search := range []string{"roadmap", "governance"} {
+		if ids := searchIDs(store, search); len(ids) != 1 || ids[0] != article.ID {
+			t.Errorf("search %q = %v, want the article matched by its tags", search, ids)
+		}
+	}
+
+	// Only descriptive tags are indexed
+	if ids := searchIDs(store, "0000000000000000000000000000000000000000000000000000000000000001"); len(ids) != 0 {
+		t.Errorf("p tag values should not be searchable, got %v", ids)
+	}
+}
+
+func TestFTS_PhrasesAndExclusions(t *testing.T) {
+	phrase := createTestEvent(nostr.KindTextNote, "The release notes are out")
+	scattered := createTestEvent(nostr.KindTextNote, "Notes on the next release")
+
+	store := searchTestStore(t, phrase, scattered)
+
+	if ids := searchIDs(store, `"release notes"`); len(ids) != 1 || ids[0] != phrase.ID {
+		t.Errorf(`search "release notes" = %v, want only the exact phrase`, ids)
+	}
+
+	if ids := searchIDs(store, "release notes"); len(ids) != 2 {
+		t.Errorf("unquoted search should match both events, got %v", ids)
+	}
+
+	if ids := searchIDs(store, "release -next"); len(ids) != 1 || ids[0] != phrase.ID {
+		t.Errorf("search with exclusion = %v, want only %s", ids, phrase.ID)
+	}
+
+	// Unbalanced quotes must not error
+	if ids := searchIDs(store, `"release`); len(ids) != 2 {
+		t.Errorf("search with unbalanced quote = %v, want both events", ids)
+	}
+}
+
+func TestFTS_RebuildRecordsFingerprint(t *testing.T) {
+	skipOnSQLite(t, "search_vector")
+	skipOnMemory(t, "search_vector")
+	evt := createTestEvent(nostr.KindTextNote, "rebuild me")
+	store := searchTestStore(t, evt)
+
+	if err := store.rebuildSearchVectors(context.Background(), store.searchFingerprint()); err != nil {
+		t.Fatalf("rebuildSearchVectors: %v", err)
+	}
+
+	kv := GetKeyValueStore(context.Background())
+	if value, err := kv.Get(context.Background(), store.searchKey("fingerprint")); err != nil || value != store.searchFingerprint() {
+		t.Errorf("fingerprint = (%q, %v), want %q", value, err, store.searchFingerprint())
+	}
+
+	if ids := searchIDs(store, "rebuild"); len(ids) != 1 {
+		t.Errorf("search after rebuild = %v, want 1 result", ids)
+	}
+}
+
 func TestBIGINT_LargeTimestamps(t *testing.T) {
 	store := createTestEventStore()
 	store.Init()
@@ -302,3 +403,82 @@ func TestDollarPlaceholders_KindAndTagFilter(t *testing.T) {
 		t.Errorf("Kind+Tag+Author filter: got %d results, want 1", len(results))
 	}
 }
+
+func TestFTS_SearchLanguageAndUnaccent(t *testing.T) {
+	skipOnSQLite(t, "search languages")
+	skipOnMemory(t, "search languages")
+	store := createTestEventStore()
+	store.Config.SearchLanguage = "portuguese"
+	if err := store.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	evt := createTestEvent(nostr.KindTextNote, "As notícias da comunidade")
+	if err := store.SaveEvent(evt); err != nil {
+		t.Fatalf("SaveEvent: %v", err)
+	}
+
+	// Portuguese stemming matches the singular against the plural
+	if ids := searchIDs(store, "notícia"); len(ids) != 1 {
+		t.Errorf("search %q = %v, want 1 result", "notícia", ids)
+	}
+
+	if !store.searchUnaccent {
+		t.Skip("unaccent extension not available")
+	}
+
+	if ids := searchIDs(store, "noticia"); len(ids) != 1 {
+		t.Errorf("unaccented search %q = %v, want 1 result", "noticia", ids)
+	}
+}
+
+func TestFTS_UnknownSearchLanguage(t *testing.T) {
+	skipOnSQLite(t, "search languages")
+	skipOnMemory(t, "search languages")
+	store := createTestEventStore()
+	store.Config.SearchLanguage = "klingon"
+
+	if err := store.Init(); err == nil {
+		t.Error("Init should fail for an unknown search_language")
+	}
+}
+
+func TestStats(t *testing.T) {
+	secret := nostr.Generate()
+	note := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: 1000, Content: "first", Tags: nostr.Tags{{"t", "test"}}}
+	note.Sign(secret)
+	other := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: 3000, Content: "second"}
+	other.Sign(secret)
+	reaction := nostr.Event{Kind: nostr.KindReaction, CreatedAt: 2000, Content: "+", Tags: nostr.Tags{{"e", note.ID.Hex()}}}
+	reaction.Sign(secret)
+
+	store := searchTestStore(t, note, other, reaction)
+
+	stats, err := store.Stats(context.Background())
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+
+	if stats.Events != 3 {
+		t.Errorf("Events = %d, want 3", stats.Events)
+	}
+	if stats.OldestCreatedAt != 1000 || stats.NewestCreatedAt != 3000 {
+		t.Errorf("created_at range = %d..%d, want 1000..3000", stats.OldestCreatedAt, stats.NewestCreatedAt)
+	}
+	if stats.TagRows < 1 {
+		t.Errorf("TagRows = %d, want at least 1", stats.TagRows)
+	}
+	if len(stats.TopKinds) != 2 || stats.TopKinds[0].Kind != nostr.KindTextNote || stats.TopKinds[0].Count != 2 {
+		t.Errorf("TopKinds = %+v, want text notes first with 2", stats.TopKinds)
+	}
+	if !testSQLite && !testMemory && (stats.EventsTableBytes <= 0 || stats.EventsIndexBytes <= 0 || stats.TagsIndexBytes <= 0) {
+		t.Errorf("expected non-zero sizes, got %+v", stats)
+	}
+
+	// Results are cached, so new events don't show up straight away.
+	store.SaveEvent(createTestEvent(nostr.KindTextNote, "third"))
+	cached, _ := store.Stats(context.Background())
+	if cached.Events != 3 {
+		t.Errorf("expected cached Events = 3, got %d", cached.Events)
+	}
+}
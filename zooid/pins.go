@@ -0,0 +1,294 @@
+package zooid
+
+import (
+	"log"
+	"slices"
+
+	"fiatjaf.com/nostr"
+)
+
+// Pinned messages.
+//
+// The group creator, admins and moderators pin messages with a
+// KindSimpleGroupPin event carrying ["pin", <event id>] and ["unpin",
+// <event id>] tags, applied in order. The current list of each group is kept
+// in zooid/groups/<h>/pins app data and cached in memory. Clients read it by
+// asking for KindSimpleGroupPins with the group in a #d or #h filter, and get
+// a relay-signed event listing the pinned ids in e tags, newest pin first.
+// Pins of events that are no longer stored are dropped when the list is read.
+
+const (
+	KindSimpleGroupPin  nostr.Kind = 9010
+	KindSimpleGroupPins nostr.Kind = 39010
+)
+
+// groupPins is the cached pin list of a group. Values in pinsCache are
+// replaced, never modified.
+type groupPins struct {
+	ids       []nostr.ID
+	updatedAt nostr.Timestamp
+	list      *nostr.Event // signed KindSimpleGroupPins event, built on first read
+}
+
+func groupPinsD(h string) string {
+	return "zooid/groups/" + h + "/pins"
+}
+
+// CanPin reports whether pubkey may pin messages in group h: whoever can
+// moderate the group, or a member with the moderator or admin role.
+func (g *GroupStore) CanPin(h string, pubkey nostr.PubKey) bool {
+	if g.IsGroupCreator(h, pubkey) {
+		return true
+	}
+
+	if g.IsMember(h, pubkey) && (g.HasRole(h, pubkey, "moderator") || g.HasRole(h, pubkey, "admin")) {
+		return true
+	}
+
+	// As for moderation events, relay admins can't manage private groups
+	// unless private_relay_admin_access is set
+	if g.IsPrivateGroup(h) && !g.Config.Groups.PrivateRelayAdminAccess {
+		return false
+	}
+
+	return g.Config.CanManage(pubkey)
+}
+
+// checkPin returns why a pin event can't be accepted, or "" if it can.
+func (g *GroupStore) checkPin(h string, event nostr.Event) string {
+	if !g.CanPin(h, event.PubKey) {
+		return RejectRestricted.Reason("only group admins and moderators can pin messages")
+	}
+
+	var pinned []nostr.ID
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || (tag[0] != "pin" && tag[0] != "unpin") {
+			continue
+		}
+
+		id, err := nostr.IDFromHex(tag[1])
+		if err != nil {
+			return RejectInvalid.Reason("invalid event id in " + tag[0] + " tag")
+		}
+		if tag[0] == "pin" {
+			pinned = append(pinned, id)
+		}
+	}
+
+	if len(pinned) == 0 && event.Tags.Find("unpin") == nil {
+		return RejectInvalid.Reason("pin event has no pin or unpin tags")
+	}
+
+	if len(pinned) > 0 {
+		want := make(map[nostr.ID]struct{}, len(pinned))
+		for _, id := range pinned {
+			want[id] = struct{}{}
+		}
+
+		found := 0
+		for range g.Events.QueryEvents(nostr.Filter{IDs: Keys(want), Tags: nostr.TagMap{"h": []string{h}}}, 0) {
+			found++
+		}
+		if found < len(want) {
+			return RejectInvalid.Reason("pinned event not found in this group")
+		}
+	}
+
+	return ""
+}
+
+// GetPins returns the ids pinned in group h, newest pin first.
+func (g *GroupStore) GetPins(h string) []nostr.ID {
+	return slices.Clone(g.loadPins(h).ids)
+}
+
+func (g *GroupStore) loadPins(h string) *groupPins {
+	if v, ok := g.pinsCache.Load(h); ok {
+		return v.(*groupPins)
+	}
+
+	pins := &groupPins{}
+	filter := nostr.Filter{
+		Kinds:   []nostr.Kind{nostr.KindApplicationSpecificData},
+		Authors: []nostr.PubKey{g.Config.GetSelf()},
+		Tags:    nostr.TagMap{"d": []string{groupPinsD(h)}},
+	}
+	for event := range g.Events.QueryEvents(filter, 1) {
+		pins.updatedAt = event.CreatedAt
+		for tag := range event.Tags.FindAll("e") {
+			if id, err := nostr.IDFromHex(tag[1]); err == nil {
+				pins.ids = append(pins.ids, id)
+			}
+		}
+	}
+
+	v, _ := g.pinsCache.LoadOrStore(h, pins)
+	return v.(*groupPins)
+}
+
+// savePins stores ids as the pin list of group h.
+func (g *GroupStore) savePins(h string, ids []nostr.ID) error {
+	event := nostr.Event{
+		Kind:      nostr.KindApplicationSpecificData,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"d", groupPinsD(h)}},
+	}
+	for _, id := range ids {
+		event.Tags = append(event.Tags, nostr.Tag{"e", id.Hex()})
+	}
+
+	if err := g.Events.SignAndStoreEvent(&event, false); err != nil {
+		return err
+	}
+
+	g.pinsCache.Store(h, &groupPins{ids: ids, updatedAt: event.CreatedAt})
+	return nil
+}
+
+// UpdatePins applies the pin and unpin tags of a pin event to its group's
+// list. Pinning a pinned event or unpinning one that isn't changes nothing,
+// so applying the same event twice is harmless.
+func (g *GroupStore) UpdatePins(event nostr.Event) error {
+	h := GetGroupIDFromEvent(event)
+
+	g.pinsMu.Lock()
+	defer g.pinsMu.Unlock()
+
+	ids := g.GetPins(h)
+	changed := false
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		id, err := nostr.IDFromHex(tag[1])
+		if err != nil {
+			continue
+		}
+
+		switch tag[0] {
+		case "pin":
+			if !slices.Contains(ids, id) {
+				ids = slices.Insert(ids, 0, id)
+				changed = true
+			}
+		case "unpin":
+			if i := slices.Index(ids, id); i >= 0 {
+				ids = slices.Delete(ids, i, i+1)
+				changed = true
+			}
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return g.savePins(h, ids)
+}
+
+// PinsEvent returns the current pin list of group h as a relay-signed
+// KindSimpleGroupPins event, or false if there's no such group.
+func (g *GroupStore) PinsEvent(h string) (nostr.Event, bool) {
+	meta, found := g.GetMetadata(h)
+	if !found {
+		return nostr.Event{}, false
+	}
+
+	pins := g.prunePins(h)
+	if pins.list != nil {
+		return *pins.list, true
+	}
+
+	// A group that never had pins gets an empty list as old as the group
+	createdAt := pins.updatedAt
+	if createdAt == 0 {
+		createdAt = meta.CreatedAt
+	}
+
+	list := nostr.Event{
+		Kind:      KindSimpleGroupPins,
+		CreatedAt: createdAt,
+		Tags:      nostr.Tags{{"d", h}, {"h", h}},
+	}
+	for _, id := range pins.ids {
+		list.Tags = append(list.Tags, nostr.Tag{"e", id.Hex()})
+	}
+	if err := g.Config.Sign(&list); err != nil {
+		log.Printf("Failed to sign pin list of %s: %v", h, err)
+		return list, true
+	}
+
+	g.pinsCache.CompareAndSwap(h, pins, &groupPins{ids: pins.ids, updatedAt: pins.updatedAt, list: &list})
+	return list, true
+}
+
+// prunePins drops pins of events that are no longer stored from group h's
+// list and returns what's left.
+func (g *GroupStore) prunePins(h string) *groupPins {
+	pins := g.loadPins(h)
+	if len(pins.ids) == 0 {
+		return pins
+	}
+
+	missing := make(map[nostr.ID]struct{}, len(pins.ids))
+	for _, id := range pins.ids {
+		missing[id] = struct{}{}
+	}
+	for event := range g.Events.QueryEvents(nostr.Filter{IDs: pins.ids}, 0) {
+		delete(missing, event.ID)
+	}
+	if len(missing) == 0 {
+		return pins
+	}
+
+	// Pins added since the query are kept
+	g.pinsMu.Lock()
+	defer g.pinsMu.Unlock()
+
+	ids := Filter(g.GetPins(h), func(id nostr.ID) bool {
+		_, gone := missing[id]
+		return !gone
+	})
+	if err := g.savePins(h, ids); err != nil {
+		log.Printf("Failed to prune pins of %s: %v", h, err)
+		return &groupPins{ids: ids, updatedAt: nostr.Now()}
+	}
+
+	return g.loadPins(h)
+}
+
+// deletePins forgets the pin list of a deleted group.
+func (g *GroupStore) deletePins(h string) {
+	filter := nostr.Filter{
+		Kinds: []nostr.Kind{nostr.KindApplicationSpecificData},
+		Tags:  nostr.TagMap{"d": []string{groupPinsD(h)}},
+	}
+
+	var toDelete []nostr.ID
+	for event := range g.Events.QueryEvents(filter, 0) {
+		toDelete = append(toDelete, event.ID)
+	}
+	for _, id := range toDelete {
+		g.Events.DeleteEvent(id)
+	}
+
+	g.pinsCache.Delete(h)
+}
+
+// pinListGroups returns the groups a filter asks for pin lists of.
+func pinListGroups(filter nostr.Filter) []string {
+	if !slices.Contains(filter.Kinds, KindSimpleGroupPins) {
+		return nil
+	}
+
+	var groups []string
+	for _, key := range []string{"d", "h"} {
+		for _, h := range filter.Tags[key] {
+			if h != "" && h != "_" && !slices.Contains(groups, h) {
+				groups = append(groups, h)
+			}
+		}
+	}
+
+	return groups
+}
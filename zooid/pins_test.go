@@ -0,0 +1,113 @@
+package zooid
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func queryPinList(t *testing.T, instance *Instance, reader nostr.PubKey, h string) []string {
+	t.Helper()
+
+	var lists []nostr.Event
+	filter := nostr.Filter{Kinds: []nostr.Kind{KindSimpleGroupPins}, Tags: nostr.TagMap{"d": []string{h}}}
+	for event := range instance.QueryStored(authedContext(reader), filter) {
+		lists = append(lists, event)
+	}
+	if len(lists) != 1 {
+		t.Fatalf("got %d pin lists, want 1", len(lists))
+	}
+	if !instance.Config.IsSelf(lists[0].PubKey) || !lists[0].VerifySignature() {
+		t.Error("the pin list should be signed by the relay")
+	}
+
+	var ids []string
+	for tag := range lists[0].Tags.FindAll("e") {
+		ids = append(ids, tag[1])
+	}
+	return ids
+}
+
+func TestPins_PinReadUnpin(t *testing.T) {
+	instance := createTestInstance()
+	runTestAdmin(t, instance, "create-group", "pinned")
+
+	member := nostr.Generate()
+	moderator := nostr.Generate()
+	runTestAdmin(t, instance, "add-member", "pinned", member.Public().Hex())
+	runTestAdmin(t, instance, "add-member", "pinned", moderator.Public().Hex(), "--role", "moderator")
+
+	message := signedBy(member, nostr.Event{Kind: nostr.KindSimpleGroupChatMessage, Content: "read the rules", Tags: nostr.Tags{{"h", "pinned"}}})
+	if err := instance.Events.SaveEvent(message); err != nil {
+		t.Fatal(err)
+	}
+
+	// The content only keeps repeated pins within a second from sharing an id
+	published := 0
+	publish := func(author nostr.SecretKey, tags ...nostr.Tag) string {
+		published++
+		event := signedBy(author, nostr.Event{Kind: KindSimpleGroupPin, Content: strconv.Itoa(published), Tags: append(nostr.Tags{{"h", "pinned"}}, tags...)})
+		if reason := instance.Groups.CheckWrite(event); reason != "" {
+			return reason
+		}
+		if err := instance.Events.SaveEvent(event); err != nil {
+			t.Fatal(err)
+		}
+		instance.OnEventSaved(context.Background(), event)
+		return ""
+	}
+
+	// Only moderators and up may pin, and only events of the group
+	if reason := publish(member, nostr.Tag{"pin", message.ID.Hex()}); reason == "" {
+		t.Error("a plain member should not be able to pin")
+	} else {
+		assertPrefix(t, "member pin", reason, RejectRestricted)
+	}
+	other := signedBy(member, nostr.Event{Kind: nostr.KindTextNote, Content: "elsewhere"})
+	instance.Events.SaveEvent(other)
+	if reason := publish(moderator, nostr.Tag{"pin", other.ID.Hex()}); reason == "" {
+		t.Error("pinning an event from outside the group should be refused")
+	}
+
+	if reason := publish(moderator, nostr.Tag{"pin", message.ID.Hex()}); reason != "" {
+		t.Fatalf("moderator pin refused: %s", reason)
+	}
+	if ids := queryPinList(t, instance, member.Public(), "pinned"); len(ids) != 1 || ids[0] != message.ID.Hex() {
+		t.Errorf("pin list = %v, want the message", ids)
+	}
+
+	// The list survives a cache reload
+	instance.Groups.pinsCache.Clear()
+	if ids := instance.Groups.GetPins("pinned"); len(ids) != 1 || ids[0] != message.ID {
+		t.Errorf("reloaded pins = %v", ids)
+	}
+
+	if reason := publish(moderator, nostr.Tag{"unpin", message.ID.Hex()}); reason != "" {
+		t.Fatalf("unpin refused: %s", reason)
+	}
+	if ids := queryPinList(t, instance, member.Public(), "pinned"); len(ids) != 0 {
+		t.Errorf("pin list after unpinning = %v", ids)
+	}
+
+	// Deleted events drop out of the list
+	if reason := publish(moderator, nostr.Tag{"pin", message.ID.Hex()}); reason != "" {
+		t.Fatalf("pin refused: %s", reason)
+	}
+	if err := instance.Events.DeleteEvent(message.ID); err != nil {
+		t.Fatal(err)
+	}
+	if ids := queryPinList(t, instance, member.Public(), "pinned"); len(ids) != 0 {
+		t.Errorf("pin list after deleting the message = %v", ids)
+	}
+	if ids := instance.Groups.GetPins("pinned"); len(ids) != 0 {
+		t.Errorf("pins after pruning = %v", ids)
+	}
+
+	// Clients can't publish the list themselves
+	forged := signedBy(moderator, nostr.Event{Kind: KindSimpleGroupPins, Tags: nostr.Tags{{"d", "pinned"}, {"h", "pinned"}}})
+	if reject, _ := instance.OnEvent(authedContext(moderator.Public()), forged); !reject {
+		t.Error("a client-signed pin list should be refused")
+	}
+}
@@ -0,0 +1,75 @@
+package zooid
+
+import (
+	"log"
+
+	"fiatjaf.com/nostr"
+)
+
+// Group presence notices.
+//
+// Clients that show "alice joined" toasts needn't diff the members list:
+// with groups.presence_notices set, whenever someone joins or leaves a group
+// the relay broadcasts a relay-signed KindGroupPresence event with the
+// group's h tag, a p tag for each of them and ["action", "join"] or
+// ["action", "leave"]. It's ephemeral, so it's never stored, and like the
+// group's other ephemeral events it's only sent to subscribers who can read
+// the group, so a private group's comings and goings don't leak. Role
+// changes aren't announced. It's off by default, as some operators consider
+// even joins sensitive.
+
+const KindGroupPresence nostr.Kind = 28938
+
+// announcePresence broadcasts a presence notice that pubkeys have joined or
+// left group h, action being "join" or "leave".
+func (g *GroupStore) announcePresence(h string, action string, pubkeys ...nostr.PubKey) {
+	if !g.Config.Groups.PresenceNotices || len(pubkeys) == 0 {
+		return
+	}
+
+	event, err := g.presenceNotice(h, action, pubkeys)
+	if err != nil {
+		log.Printf("Failed to sign presence notice for group %q: %v", h, err)
+		return
+	}
+
+	g.Events.Relay.BroadcastEvent(event)
+}
+
+func (g *GroupStore) presenceNotice(h string, action string, pubkeys []nostr.PubKey) (nostr.Event, error) {
+	tags := nostr.Tags{{"h", h}}
+	for _, pubkey := range pubkeys {
+		tags = append(tags, nostr.Tag{"p", pubkey.Hex()})
+	}
+	tags = append(tags, nostr.Tag{"action", action})
+
+	event := nostr.Event{
+		Kind:      KindGroupPresence,
+		CreatedAt: nostr.Now(),
+		Tags:      tags,
+	}
+
+	err := g.Config.Sign(&event)
+	return event, err
+}
+
+// cachedMember reports whether the membership cache has pubkey as a member
+// of h, and whether it knows. The event being processed is already stored,
+// so the database can't say what membership was before it.
+func (g *GroupStore) cachedMember(h string, pubkey nostr.PubKey) (member bool, known bool) {
+	if _, fullyLoaded := g.membershipFullyLoaded.Load(h); !fullyLoaded {
+		return false, false
+	}
+
+	v, ok := g.membershipCache.Load(h)
+	if !ok {
+		return false, false
+	}
+
+	ms := v.(*memberSet)
+	ms.mu.RLock()
+	_, member = ms.members[pubkey]
+	ms.mu.RUnlock()
+
+	return member, true
+}
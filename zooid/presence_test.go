@@ -0,0 +1,42 @@
+package zooid
+
+import (
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+func TestPresence_MembersOnly(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Groups.PresenceNotices = true
+	runTestAdmin(t, instance, "create-group", "hideout", "--private")
+
+	member, outsider := nostr.Generate(), nostr.Generate()
+	for _, pubkey := range []nostr.PubKey{member.Public(), outsider.Public()} {
+		instance.Management.AddMember(pubkey)
+	}
+	if err := instance.Groups.AddMember("hideout", member.Public()); err != nil {
+		t.Fatal(err)
+	}
+
+	notice, err := instance.Groups.presenceNotice("hideout", "join", []nostr.PubKey{member.Public()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.PreventBroadcast(&khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{member.Public()}}, nostr.Filter{}, notice) {
+		t.Error("a member isn't sent the group's presence notice")
+	}
+	if !instance.PreventBroadcast(&khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{outsider.Public()}}, nostr.Filter{}, notice) {
+		t.Error("an outsider is sent a private group's presence notice")
+	}
+
+	// Nothing is stored, and nobody else may send one
+	if n, _ := instance.Events.CountEvents(nostr.Filter{Kinds: []nostr.Kind{KindGroupPresence}}); n != 0 {
+		t.Errorf("%d presence notices stored, want none", n)
+	}
+	forged := signedBy(member, nostr.Event{Kind: KindGroupPresence, Tags: nostr.Tags{{"h", "hideout"}, {"p", outsider.Public().Hex()}, {"action", "join"}}})
+	if reject, _ := instance.OnEvent(authedContext(member.Public()), forged); !reject {
+		t.Error("a member's presence notice was accepted")
+	}
+}
@@ -0,0 +1,288 @@
+package zooid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// Self-service purge.
+//
+// With policy.allow_self_purge set, a user can leave the relay and take
+// their data with them by publishing a RELAY_PURGE event. The relay removes
+// them from its members list and from every group they're in, publishing
+// the 9001s as for any removal, and queues their stored events for deletion.
+// The purge worker deletes them in the background and then publishes a
+// relay-signed RELAY_PURGE_RECEIPT with the user in a p tag, the request in
+// an e tag and ["deleted", <n>], the number of events deleted. Like the
+// relay's member add and remove events, the receipt is only served to
+// managers and the user it names, who can ask for it even once they're no
+// longer a member. With storage.soft_delete on, the events can still be
+// restored until soft_delete_window has passed.
+//
+// Managers of a community that must keep its records can deny purges to a
+// pubkey with the denypurge NIP-86 method, and allow them again with
+// allowpurge; a purge denied after it was queued is dropped with nothing
+// deleted. Queued purges are kept in the kv store, so they survive a
+// restart, and only the replica that leads the schema works on them.
+
+const purgeInterval = time.Minute
+
+var ErrPurgeDenied = errors.New("purging this account has been denied by an admin")
+
+// PurgeRequest is a purge waiting for the worker.
+type PurgeRequest struct {
+	Request     nostr.ID        `json:"request"`
+	PubKey      nostr.PubKey    `json:"pubkey"`
+	RequestedAt nostr.Timestamp `json:"requested_at"`
+}
+
+func (instance *Instance) purgeKV() *KV {
+	return &KV{Name: "zooid:" + instance.Events.Schema.Name}
+}
+
+// checkPurgeRequest returns why a purge request can't be accepted, if it
+// can't.
+func (instance *Instance) checkPurgeRequest(event nostr.Event) (reject bool, msg string) {
+	if !instance.Config.Policy.AllowSelfPurge {
+		return RejectRestricted.Reject("purging accounts is not allowed on this relay")
+	}
+
+	ctx, cancel := context.WithTimeout(instance.Ctx, dbOpTimeout)
+	defer cancel()
+
+	if denied, err := instance.PurgeDenied(ctx, event.PubKey); err != nil {
+		return RejectError.Reject("couldn't check whether purging is allowed, try again")
+	} else if denied {
+		return RejectRestricted.Reject(ErrPurgeDenied.Error())
+	}
+
+	return false, ""
+}
+
+// PurgeDenied reports whether a manager has denied purges to pubkey.
+func (instance *Instance) PurgeDenied(ctx context.Context, pubkey nostr.PubKey) (bool, error) {
+	_, err := instance.purgeKV().Get(ctx, "purge_denied:"+pubkey.Hex())
+	if errors.Is(err, ErrKVNotFound) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// DenyPurge keeps pubkey from purging their account, or allows it again.
+func (instance *Instance) DenyPurge(ctx context.Context, pubkey nostr.PubKey, deny bool) error {
+	if !deny {
+		return instance.purgeKV().Delete(ctx, "purge_denied:"+pubkey.Hex())
+	}
+
+	return instance.purgeKV().Set(ctx, "purge_denied:"+pubkey.Hex(), strconv.FormatInt(int64(nostr.Now()), 10))
+}
+
+// RequestPurge queues the author of purge request event for purging, then
+// removes them from the relay and its groups. The request is queued first so
+// that if the removals fail partway, the worker finishes them.
+func (instance *Instance) RequestPurge(ctx context.Context, event nostr.Event) error {
+	err := instance.purgeKV().SetJSON(ctx, "purge:"+event.PubKey.Hex(), PurgeRequest{
+		Request:     event.ID,
+		PubKey:      event.PubKey,
+		RequestedAt: event.CreatedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("queueing the purge: %w", err)
+	}
+
+	return instance.removeEverywhere(event.PubKey)
+}
+
+// removeEverywhere removes pubkey from the relay and every group they're
+// in. It's safe to repeat.
+func (instance *Instance) removeEverywhere(pubkey nostr.PubKey) error {
+	if err := instance.Management.RemoveMember(pubkey); err != nil {
+		return fmt.Errorf("removing relay membership: %w", err)
+	}
+
+	if !instance.Config.Groups.Enabled {
+		return nil
+	}
+
+	for _, h := range instance.Groups.memberGroups(pubkey) {
+		if err := instance.Groups.RemoveMember(h, pubkey); err != nil {
+			return fmt.Errorf("removing from group %q: %w", h, err)
+		}
+		if err := instance.Groups.ScheduleMembersListUpdate(h); err != nil {
+			return fmt.Errorf("updating members of group %q: %w", h, err)
+		}
+		if err := instance.Groups.ScheduleMemberCountRefresh(h); err != nil {
+			return fmt.Errorf("updating member count of group %q: %w", h, err)
+		}
+	}
+
+	return nil
+}
+
+// memberGroups returns the groups pubkey is a member of.
+func (g *GroupStore) memberGroups(pubkey nostr.PubKey) []string {
+	candidates := make(map[string]struct{})
+	g.membershipCache.Range(func(key, _ any) bool {
+		candidates[key.(string)] = struct{}{}
+		return true
+	})
+
+	// Groups whose members aren't all cached are found by their put users
+	filter := nostr.Filter{
+		Kinds: []nostr.Kind{nostr.KindSimpleGroupPutUser},
+		Tags:  nostr.TagMap{"p": []string{pubkey.Hex()}},
+	}
+	for event := range g.Events.QueryEvents(filter, 0) {
+		if h := GetGroupIDFromEvent(event); h != "" {
+			candidates[h] = struct{}{}
+		}
+	}
+
+	var groups []string
+	for h := range candidates {
+		if g.IsMember(h, pubkey) {
+			groups = append(groups, h)
+		}
+	}
+
+	return groups
+}
+
+// RunPurges carries out the queued purges, and returns how many it
+// completed.
+func (instance *Instance) RunPurges(ctx context.Context) (int, error) {
+	if instance.Config.IsReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	items, err := instance.purgeKV().List(ctx, "purge:")
+	if err != nil {
+		return 0, err
+	}
+
+	completed := 0
+	for _, item := range items {
+		var request PurgeRequest
+		if err := json.Unmarshal([]byte(item.Value), &request); err != nil {
+			log.Printf("Skipping unreadable purge request %s: %v", item.Key, err)
+			continue
+		}
+
+		err := instance.purge(ctx, request)
+		denied := errors.Is(err, ErrPurgeDenied)
+		if denied {
+			// Denied after it was queued, so it's dropped untouched
+			log.Printf("Dropping the purge of %s: %v", request.PubKey.Hex(), err)
+		} else if err != nil {
+			return completed, fmt.Errorf("purging %s: %w", request.PubKey.Hex(), err)
+		}
+
+		if err := instance.purgeKV().Delete(ctx, item.Key); err != nil {
+			return completed, err
+		}
+		if !denied {
+			completed++
+		}
+	}
+
+	return completed, nil
+}
+
+// purgeBatch is how many events purge deletes per query.
+const purgeBatch = 500
+
+// purge deletes the events of request's author and publishes the receipt,
+// unless purging them has been denied since the request was queued. A
+// failed lookup stops it with an error, like a failed deletion, so the
+// request stays queued; what was deleted stays deleted, and the next run
+// picks up the rest.
+func (instance *Instance) purge(ctx context.Context, request PurgeRequest) error {
+	if denied, err := instance.PurgeDenied(ctx, request.PubKey); err != nil {
+		return err
+	} else if denied {
+		return ErrPurgeDenied
+	}
+
+	if err := instance.removeEverywhere(request.PubKey); err != nil {
+		return err
+	}
+
+	// What's deleted no longer matches, so each page starts from the top
+	filter := nostr.Filter{Authors: []nostr.PubKey{request.PubKey}, Limit: purgeBatch}
+	deleted := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		failures := instance.Events.queryErrors.Load()
+		ids := make([]nostr.ID, 0, purgeBatch)
+		for event := range instance.Events.QueryEvents(filter, purgeBatch) {
+			ids = append(ids, event.ID)
+		}
+		if instance.Events.queryErrors.Load() != failures {
+			return errors.New("looking up events to delete failed")
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		for _, id := range ids {
+			if err := instance.DeleteEvent(ctx, id); err != nil {
+				return err
+			}
+		}
+		deleted += len(ids)
+	}
+
+	receipt := nostr.Event{
+		Kind:      RELAY_PURGE_RECEIPT,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"p", request.PubKey.Hex()},
+			{"e", request.Request.Hex()},
+			{"deleted", strconv.Itoa(deleted)},
+		},
+	}
+
+	return instance.Events.SignAndStoreEvent(&receipt, true)
+}
+
+// isPurgeReceiptFilter reports whether filter asks for pubkey's own purge
+// receipts and nothing else.
+func isPurgeReceiptFilter(pubkey nostr.PubKey, filter nostr.Filter) bool {
+	return len(filter.Kinds) == 1 && filter.Kinds[0] == RELAY_PURGE_RECEIPT &&
+		len(filter.Tags) == 1 && len(filter.Tags["p"]) == 1 && filter.Tags["p"][0] == pubkey.Hex() &&
+		len(filter.IDs) == 0 && filter.Search == ""
+}
+
+func (instance *Instance) startPurgeWorker(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(purgeInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if instance.Config.IsReadOnly() || !instance.leadsJobs(ctx) {
+					continue
+				}
+				if n, err := instance.RunPurges(ctx); err != nil {
+					log.Printf("Failed to run purges for %s: %v", instance.Config.Schema, err)
+				} else if n > 0 {
+					log.Printf("Purged %d account(s) from %s", n, instance.Config.Schema)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,164 @@
+package zooid
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestPurge_FullFlow(t *testing.T) {
+	instance := createTestInstance()
+	runTestAdmin(t, instance, "create-group", "club")
+
+	alice := nostr.Generate()
+	instance.Management.AddMember(alice.Public())
+	if err := instance.Groups.AddMember("club", alice.Public()); err != nil {
+		t.Fatal(err)
+	}
+	saveGroupEvent(t, instance, alice, nostr.Event{Kind: nostr.KindTextNote, Content: "hello"})
+	saveGroupEvent(t, instance, alice, nostr.Event{Kind: nostr.KindSimpleGroupChatMessage, Content: "hi club", Tags: nostr.Tags{{"h", "club"}}})
+
+	request := signedBy(alice, nostr.Event{Kind: RELAY_PURGE})
+	ctx := authedContext(alice.Public())
+
+	// Off unless the relay allows it
+	reject, msg := instance.OnEvent(ctx, request)
+	if !reject {
+		t.Fatal("a purge request was accepted with allow_self_purge off")
+	}
+	assertPrefix(t, "purge request", msg, RejectRestricted)
+
+	instance.Config.Policy.AllowSelfPurge = true
+	if reject, msg := instance.OnEvent(ctx, request); reject {
+		t.Fatalf("purge request refused: %s", msg)
+	}
+	instance.OnEphemeralEvent(ctx, request)
+
+	if instance.Management.IsMember(alice.Public()) {
+		t.Error("alice is still a relay member")
+	}
+	if instance.Groups.IsMember("club", alice.Public()) {
+		t.Error("alice is still a member of club")
+	}
+	firstEvent(t, instance, nostr.Filter{
+		Kinds:   []nostr.Kind{nostr.KindSimpleGroupRemoveUser},
+		Authors: []nostr.PubKey{instance.Config.GetSelf()},
+		Tags:    nostr.TagMap{"h": {"club"}, "p": {alice.Public().Hex()}},
+	})
+
+	// Events go in the background
+	if n, _ := instance.Events.CountEvents(nostr.Filter{Authors: []nostr.PubKey{alice.Public()}}); n != 2 {
+		t.Errorf("alice has %d events before the worker runs, want 2", n)
+	}
+	if n, err := instance.RunPurges(context.Background()); err != nil || n != 1 {
+		t.Fatalf("RunPurges = %d, %v", n, err)
+	}
+	if n, _ := instance.Events.CountEvents(nostr.Filter{Authors: []nostr.PubKey{alice.Public()}}); n != 0 {
+		t.Errorf("alice has %d events after the purge, want none", n)
+	}
+	if n, err := instance.RunPurges(context.Background()); err != nil || n != 0 {
+		t.Errorf("RunPurges again = %d, %v", n, err)
+	}
+
+	// The receipt is for alice, even on a closed relay they've left
+	receiptFilter := nostr.Filter{Kinds: []nostr.Kind{RELAY_PURGE_RECEIPT}, Tags: nostr.TagMap{"p": {alice.Public().Hex()}}}
+	receipt := firstEvent(t, instance, receiptFilter)
+	if receipt.PubKey != instance.Config.GetSelf() {
+		t.Errorf("receipt signed by %s, want the relay", receipt.PubKey.Hex())
+	}
+	if tag := receipt.Tags.Find("e"); tag == nil || tag[1] != request.ID.Hex() {
+		t.Errorf("receipt e tag = %v, want %s", tag, request.ID.Hex())
+	}
+	if tag := receipt.Tags.Find("deleted"); tag == nil || tag[1] != "2" {
+		t.Errorf("receipt deleted tag = %v, want 2", tag)
+	}
+
+	instance.Config.Policy.Open = false
+	if reject, msg := instance.OnRequest(ctx, receiptFilter); reject {
+		t.Errorf("purged user's request for their receipt refused: %s", msg)
+	}
+	if reject, _ := instance.OnRequest(ctx, nostr.Filter{Kinds: []nostr.Kind{nostr.KindTextNote}}); !reject {
+		t.Error("purged user may still read the relay")
+	}
+	if !instance.hidesAdminOnly([]nostr.PubKey{nostr.Generate().Public()}, receipt) {
+		t.Error("someone else is sent alice's receipt")
+	}
+}
+
+func TestPurge_Denied(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.AllowSelfPurge = true
+
+	bob := nostr.Generate()
+	ctx := authedContext(bob.Public())
+	if err := instance.DenyPurge(context.Background(), bob.Public(), true); err != nil {
+		t.Fatal(err)
+	}
+
+	reject, msg := instance.OnEvent(ctx, signedBy(bob, nostr.Event{Kind: RELAY_PURGE}))
+	if !reject {
+		t.Fatal("a denied purge request was accepted")
+	}
+	assertPrefix(t, "denied purge request", msg, RejectRestricted)
+
+	if err := instance.DenyPurge(context.Background(), bob.Public(), false); err != nil {
+		t.Fatal(err)
+	}
+	if reject, msg := instance.OnEvent(ctx, signedBy(bob, nostr.Event{Kind: RELAY_PURGE, Content: "again"})); reject {
+		t.Errorf("purge request refused once allowed again: %s", msg)
+	}
+}
+
+func TestPurge_DeniedAfterQueueing(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.AllowSelfPurge = true
+
+	carol := nostr.Generate()
+	instance.Management.AddMember(carol.Public())
+	saveGroupEvent(t, instance, carol, nostr.Event{Kind: nostr.KindTextNote, Content: "keep me"})
+
+	ctx := context.Background()
+	if err := instance.RequestPurge(ctx, signedBy(carol, nostr.Event{Kind: RELAY_PURGE})); err != nil {
+		t.Fatal(err)
+	}
+	if err := instance.DenyPurge(ctx, carol.Public(), true); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := instance.RunPurges(ctx); err != nil || n != 0 {
+		t.Fatalf("RunPurges = %d, %v, want nothing purged", n, err)
+	}
+	if n, _ := instance.Events.CountEvents(nostr.Filter{Authors: []nostr.PubKey{carol.Public()}}); n != 1 {
+		t.Errorf("carol has %d events, want her note kept", n)
+	}
+	if items, _ := instance.purgeKV().List(ctx, "purge:"); len(items) != 0 {
+		t.Errorf("the denied purge is still queued: %v", items)
+	}
+}
+
+func TestPurge_ManyEvents(t *testing.T) {
+	instance := createTestInstance()
+
+	dave := nostr.Generate()
+	for i := range purgeBatch + 10 {
+		saveGroupEvent(t, instance, dave, nostr.Event{Kind: nostr.KindTextNote, Content: fmt.Sprint(i)})
+	}
+
+	ctx := context.Background()
+	if err := instance.RequestPurge(ctx, signedBy(dave, nostr.Event{Kind: RELAY_PURGE})); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := instance.RunPurges(ctx); err != nil || n != 1 {
+		t.Fatalf("RunPurges = %d, %v", n, err)
+	}
+
+	if n, _ := instance.Events.CountEvents(nostr.Filter{Authors: []nostr.PubKey{dave.Public()}}); n != 0 {
+		t.Errorf("dave has %d events after the purge, want none", n)
+	}
+	receipt := firstEvent(t, instance, nostr.Filter{Kinds: []nostr.Kind{RELAY_PURGE_RECEIPT}, Tags: nostr.TagMap{"p": {dave.Public().Hex()}}})
+	if tag := receipt.Tags.Find("deleted"); tag == nil || tag[1] != fmt.Sprint(purgeBatch+10) {
+		t.Errorf("receipt deleted tag = %v, want %d", tag, purgeBatch+10)
+	}
+}
@@ -0,0 +1,209 @@
+package zooid
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// Push notifications.
+//
+// When a chat message, thread or reply p-tags people, Instance.Notifier is
+// told who to wake. Mentions of the author, of people who aren't members of
+// the group and of people who can't read the event are dropped first, so a
+// notifier never learns about a group from someone outside it. The default
+// notifier does nothing. With [push] url set, mentions are batched and POSTed
+// to that url as JSON every push.interval, at most push.per_minute per
+// recipient. A batch that fails to send is logged and dropped.
+
+const (
+	defaultPushInterval  = 5 * time.Second
+	defaultPushPerMinute = 10
+
+	// pushMaxPending bounds how many mentions wait for the next batch.
+	pushMaxPending = 1000
+)
+
+// Mention is a group event that mentions Recipients, all of whom are members
+// of Group and can read Event.
+type Mention struct {
+	Event      nostr.Event
+	Group      string
+	Recipients []nostr.PubKey
+}
+
+// Notifier is told about mentions in group events. Notify is called on the
+// goroutine that saved the event, so it shouldn't block.
+type Notifier interface {
+	Notify(mention Mention)
+}
+
+type noopNotifier struct{}
+
+func (noopNotifier) Notify(Mention) {}
+
+// mentionRecipients returns the pubkeys event p-tags who should be notified.
+func (g *GroupStore) mentionRecipients(h string, event nostr.Event) []nostr.PubKey {
+	var recipients []nostr.PubKey
+	seen := make(map[nostr.PubKey]struct{})
+
+	for tag := range event.Tags.FindAll("p") {
+		pubkey, err := nostr.PubKeyFromHex(tag[1])
+		if err != nil || pubkey == event.PubKey {
+			continue
+		}
+		if _, ok := seen[pubkey]; ok {
+			continue
+		}
+		seen[pubkey] = struct{}{}
+
+		if g.IsMember(h, pubkey) && g.CanRead(pubkey, event) {
+			recipients = append(recipients, pubkey)
+		}
+	}
+
+	return recipients
+}
+
+// notifyMentions hands the mentions in a saved group event to the notifier.
+func (instance *Instance) notifyMentions(event nostr.Event) {
+	if instance.Notifier == nil || !isThreadKind(event.Kind) {
+		return
+	}
+
+	h := GetGroupIDFromEvent(event)
+	if h == "" {
+		return
+	}
+
+	if recipients := instance.Groups.mentionRecipients(h, event); len(recipients) > 0 {
+		instance.Notifier.Notify(Mention{Event: event, Group: h, Recipients: recipients})
+	}
+}
+
+// pushNotification is one entry of a webhook batch.
+type pushNotification struct {
+	Group      string         `json:"group"`
+	Recipients []nostr.PubKey `json:"recipients"`
+	Event      nostr.Event    `json:"event"`
+}
+
+// webhookNotifier POSTs batches of mentions to a url.
+type webhookNotifier struct {
+	url       string
+	perMinute int
+	client    *http.Client
+	limiter   rateLimiter
+
+	mu      sync.Mutex
+	pending []pushNotification
+}
+
+func newWebhookNotifier(url string, perMinute int) *webhookNotifier {
+	return &webhookNotifier{
+		url:       url,
+		perMinute: perMinute,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (n *webhookNotifier) Notify(mention Mention) {
+	now := time.Now()
+
+	var recipients []nostr.PubKey
+	for _, pubkey := range mention.Recipients {
+		if n.limiter.allow(pubkey, n.perMinute, now) {
+			recipients = append(recipients, pubkey)
+		}
+	}
+	if len(recipients) == 0 {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.pending) >= pushMaxPending {
+		log.Printf("Push queue full, dropping mention in %s", mention.Group)
+		return
+	}
+	n.pending = append(n.pending, pushNotification{Group: mention.Group, Recipients: recipients, Event: mention.Event})
+}
+
+// flush sends the pending mentions, if there are any.
+func (n *webhookNotifier) flush(ctx context.Context) error {
+	n.mu.Lock()
+	batch := n.pending
+	n.pending = nil
+	n.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(map[string]any{"notifications": batch})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("push endpoint returned %s for %d notifications", res.Status, len(batch))
+	}
+
+	return nil
+}
+
+// run sends a batch every interval until ctx is cancelled, then sends what's
+// left.
+func (n *webhookNotifier) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			final, cancel := context.WithTimeout(context.WithoutCancel(ctx), dbOpTimeout)
+			if err := n.flush(final); err != nil {
+				log.Printf("Failed to send push notifications: %v", err)
+			}
+			cancel()
+			return
+		case <-ticker.C:
+			if err := n.flush(ctx); err != nil {
+				log.Printf("Failed to send push notifications: %v", err)
+			}
+		}
+	}
+}
+
+// startNotifier sets up the webhook notifier if push.url is configured, and
+// the no-op one otherwise.
+func (instance *Instance) startNotifier(ctx context.Context) {
+	if instance.Config.Push.URL == "" {
+		instance.Notifier = noopNotifier{}
+		return
+	}
+
+	notifier := newWebhookNotifier(instance.Config.Push.URL, instance.Config.GetPushPerMinute())
+	instance.Notifier = notifier
+	go notifier.run(ctx, instance.Config.GetPushInterval())
+}
@@ -0,0 +1,122 @@
+package zooid
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+type fakeNotifier struct {
+	mu       sync.Mutex
+	mentions []Mention
+}
+
+func (n *fakeNotifier) Notify(mention Mention) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.mentions = append(n.mentions, mention)
+}
+
+func TestNotifyMentions_OnlyReadersInTheGroup(t *testing.T) {
+	instance := createTestInstance()
+	notifier := &fakeNotifier{}
+	instance.Notifier = notifier
+
+	runTestAdmin(t, instance, "create-group", "team", "--private")
+	runTestAdmin(t, instance, "create-group", "other", "--private")
+
+	author := nostr.Generate()
+	member := nostr.Generate()
+	outsider := nostr.Generate() // member of another group only
+	runTestAdmin(t, instance, "add-member", "team", author.Public().Hex())
+	runTestAdmin(t, instance, "add-member", "team", member.Public().Hex())
+	runTestAdmin(t, instance, "add-member", "other", outsider.Public().Hex())
+
+	message := signedBy(author, nostr.Event{
+		Kind:    nostr.KindSimpleGroupChatMessage,
+		Content: "ping",
+		Tags: nostr.Tags{
+			{"h", "team"},
+			{"p", member.Public().Hex()},
+			{"p", member.Public().Hex()},
+			{"p", outsider.Public().Hex()},
+			{"p", author.Public().Hex()},
+		},
+	})
+	instance.OnEventSaved(context.Background(), message)
+
+	if len(notifier.mentions) != 1 {
+		t.Fatalf("got %d notifications, want 1", len(notifier.mentions))
+	}
+	mention := notifier.mentions[0]
+	if mention.Group != "team" || mention.Event.ID != message.ID {
+		t.Errorf("notified about %s in %q", mention.Event.ID, mention.Group)
+	}
+	if len(mention.Recipients) != 1 || mention.Recipients[0] != member.Public() {
+		t.Errorf("recipients = %v, want only the member", mention.Recipients)
+	}
+
+	// Nobody left to notify means no call
+	lonely := signedBy(author, nostr.Event{
+		Kind: nostr.KindSimpleGroupChatMessage,
+		Tags: nostr.Tags{{"h", "team"}, {"p", outsider.Public().Hex()}},
+	})
+	instance.OnEventSaved(context.Background(), lonely)
+	if len(notifier.mentions) != 1 {
+		t.Errorf("a mention of a non-member should not be notified")
+	}
+
+	// Only content kinds notify
+	put := signedBy(author, nostr.Event{
+		Kind: nostr.KindSimpleGroupPutUser,
+		Tags: nostr.Tags{{"h", "team"}, {"p", member.Public().Hex()}},
+	})
+	instance.OnEventSaved(context.Background(), put)
+	if len(notifier.mentions) != 1 {
+		t.Errorf("a put-user event should not be notified")
+	}
+}
+
+func TestWebhookNotifier_BatchesAndLimits(t *testing.T) {
+	var batches [][]pushNotification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Notifications []pushNotification `json:"notifications"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("bad batch: %v", err)
+		}
+		batches = append(batches, body.Notifications)
+	}))
+	defer server.Close()
+
+	notifier := newWebhookNotifier(server.URL, 2)
+	recipient := nostr.Generate().Public()
+	event := signedBy(nostr.Generate(), nostr.Event{Kind: nostr.KindSimpleGroupChatMessage, Tags: nostr.Tags{{"h", "g"}}})
+
+	for range 3 {
+		notifier.Notify(Mention{Event: event, Group: "g", Recipients: []nostr.PubKey{recipient}})
+	}
+
+	if err := notifier.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batches) != 1 {
+		t.Fatalf("got %d batches, want 1 (empty flushes send nothing)", len(batches))
+	}
+	if len(batches[0]) != 2 {
+		t.Errorf("batch has %d notifications, want 2 after rate limiting", len(batches[0]))
+	}
+	if batches[0][0].Group != "g" || batches[0][0].Recipients[0] != recipient || batches[0][0].Event.ID != event.ID {
+		t.Errorf("unexpected notification %+v", batches[0][0])
+	}
+}
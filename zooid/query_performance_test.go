@@ -238,7 +238,7 @@ func TestIntegration_QueryPerformance(t *testing.T) {
 	}
 
 	store := seedPerfData(t)
-	eventsTable := store.Schema.Prefix("events")
+	eventsTable := store.Schema.RelName("events")
 
 	// Each group has perfNumEvents/perfNumGroups = 50K events.
 	eventsPerGroup := perfNumEvents / perfNumGroups
@@ -0,0 +1,193 @@
+package zooid
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"iter"
+	"log"
+	"slices"
+	"strconv"
+
+	"fiatjaf.com/nostr"
+	"github.com/Masterminds/squirrel"
+)
+
+// Received times.
+//
+// created_at is whatever the author says, so a backfilled or imported event
+// can be years old when it arrives. The events table also records
+// received_at, when the relay stored the event, set as SaveEvent and
+// ReplaceEvent insert it. Filters and replaceable ordering never look at it:
+// it's for operators asking what arrived lately, through
+// QueryEventsReceivedSince, the stats and exports. Events stored before it
+// was recorded are taken to have arrived when they were created.
+
+// receivedNow is the clock received_at is set from, swappable in tests.
+var receivedNow = nostr.Now
+
+// ReceivedEvent is a stored event and when the relay stored it.
+type ReceivedEvent struct {
+	nostr.Event
+	ReceivedAt nostr.Timestamp
+}
+
+// MarshalJSON writes the event as nostr does, with a received_at field
+// added. The embedded event's MarshalJSON would otherwise leave it out.
+func (evt ReceivedEvent) MarshalJSON() ([]byte, error) {
+	b, err := evt.Event.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	b = append(b[:len(b)-1], `,"received_at":`...)
+	b = strconv.AppendInt(b, int64(evt.ReceivedAt), 10)
+	return append(b, '}'), nil
+}
+
+// QueryEventsReceivedSince returns up to maxLimit events stored at or after
+// since, most recently received first. maxLimit 0 returns them all.
+func (events *EventStore) QueryEventsReceivedSince(since nostr.Timestamp, maxLimit int) iter.Seq[ReceivedEvent] {
+	return events.backend().receivedSince(since, maxLimit)
+}
+
+// ReceivedTimes returns when the events with ids that are stored were
+// received.
+func (events *EventStore) ReceivedTimes(ids []nostr.ID) (map[nostr.ID]nostr.Timestamp, error) {
+	return events.backend().receivedTimes(ids)
+}
+
+func (events sqlEvents) receivedSince(since nostr.Timestamp, maxLimit int) iter.Seq[ReceivedEvent] {
+	return func(yield func(ReceivedEvent) bool) {
+		ctx, cancel := context.WithTimeout(events.rootCtx, dbOpTimeout)
+		defer cancel()
+
+		release, err := events.slots.acquire(ctx, events.reserved)
+		if err != nil {
+			log.Printf("QueryEventsReceivedSince: %v", err)
+			return
+		}
+		defer release()
+
+		qb := sb.Select(append(slices.Clone(eventColumns), "received_at")...).
+			From(events.Schema.Prefix("events")).
+			Where(squirrel.GtOrEq{"received_at": int64(since)}).
+			Where("deleted_at IS NULL").
+			OrderBy("received_at DESC", "id DESC")
+		if maxLimit > 0 {
+			qb = qb.Limit(uint64(maxLimit))
+		}
+
+		rows, err := qb.RunWith(GetDb()).QueryContext(ctx)
+		if err != nil {
+			log.Printf("QueryEventsReceivedSince: %v", err)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var row eventRow
+			var receivedAt int64
+			if err := rows.Scan(&row.id, &row.createdAt, &row.kind, &row.pubkey, &row.content, &row.tags, &row.sig, &row.zstd, &receivedAt); err != nil {
+				continue
+			}
+
+			evt, err := row.event()
+			if err != nil {
+				continue
+			}
+
+			if !yield(ReceivedEvent{Event: evt, ReceivedAt: nostr.Timestamp(receivedAt)}) {
+				return
+			}
+		}
+
+		if err := rows.Err(); err != nil {
+			log.Printf("QueryEventsReceivedSince: %v", err)
+		}
+	}
+}
+
+func (events sqlEvents) receivedTimes(ids []nostr.ID) (map[nostr.ID]nostr.Timestamp, error) {
+	times := make(map[nostr.ID]nostr.Timestamp, len(ids))
+	if len(ids) == 0 {
+		return times, nil
+	}
+
+	ctx, cancel := context.WithTimeout(events.rootCtx, dbOpTimeout)
+	defer cancel()
+
+	hexes := make([]string, len(ids))
+	for i, id := range ids {
+		hexes[i] = id.Hex()
+	}
+
+	rows, err := sb.Select("id", "received_at").
+		From(events.Schema.Prefix("events")).
+		Where(squirrel.Eq{"id": hexes}).
+		RunWith(GetDb()).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading received times: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hex string
+		var receivedAt int64
+		if err := rows.Scan(&hex, &receivedAt); err != nil {
+			return nil, fmt.Errorf("reading received times: %w", err)
+		}
+		if id, err := nostr.IDFromHex(hex); err == nil {
+			times[id] = nostr.Timestamp(receivedAt)
+		}
+	}
+
+	return times, rows.Err()
+}
+
+func (events memoryEvents) receivedSince(since nostr.Timestamp, maxLimit int) iter.Seq[ReceivedEvent] {
+	return func(yield func(ReceivedEvent) bool) {
+		events.tables.mu.RLock()
+		var found []ReceivedEvent
+		for _, stored := range events.tables.events {
+			if stored.receivedAt >= since && stored.deletedAt == 0 {
+				found = append(found, ReceivedEvent{Event: cloneEvent(stored.event), ReceivedAt: stored.receivedAt})
+			}
+		}
+		events.tables.mu.RUnlock()
+
+		slices.SortFunc(found, func(a, b ReceivedEvent) int {
+			return cmp.Or(cmp.Compare(b.ReceivedAt, a.ReceivedAt), bytes.Compare(b.ID[:], a.ID[:]))
+		})
+		if maxLimit > 0 && len(found) > maxLimit {
+			found = found[:maxLimit]
+		}
+
+		for _, evt := range found {
+			if !yield(evt) {
+				return
+			}
+		}
+	}
+}
+
+func (events memoryEvents) receivedTimes(ids []nostr.ID) (map[nostr.ID]nostr.Timestamp, error) {
+	events.tables.mu.RLock()
+	defer events.tables.mu.RUnlock()
+
+	wanted := make(map[nostr.ID]struct{}, len(ids))
+	for _, id := range ids {
+		wanted[id] = struct{}{}
+	}
+
+	times := make(map[nostr.ID]nostr.Timestamp, len(ids))
+	for _, stored := range events.tables.events {
+		if _, ok := wanted[stored.event.ID]; ok {
+			times[stored.event.ID] = stored.receivedAt
+		}
+	}
+
+	return times, nil
+}
@@ -0,0 +1,149 @@
+package zooid
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+// receivedAt makes events stored from now on look received at ts.
+func receivedAt(t *testing.T, ts nostr.Timestamp) {
+	t.Helper()
+
+	previous := receivedNow
+	receivedNow = func() nostr.Timestamp { return ts }
+	t.Cleanup(func() { receivedNow = previous })
+}
+
+func TestEventStore_ReceivedAt(t *testing.T) {
+	store := createTestEventStore()
+	store.Init()
+
+	// A backfill of old events, then a new one
+	secret := nostr.Generate()
+	signed := func(kind nostr.Kind, at nostr.Timestamp, content string) nostr.Event {
+		event := nostr.Event{Kind: kind, CreatedAt: at, Content: content}
+		event.Sign(secret)
+		return event
+	}
+
+	receivedAt(t, 5000)
+	backfilled := signed(nostr.KindTextNote, 100, "old")
+	if err := store.SaveEvent(backfilled); err != nil {
+		t.Fatal(err)
+	}
+	receivedAt(t, 6000)
+	fresh := signed(nostr.KindTextNote, 6000, "new")
+	if err := store.SaveEvent(fresh); err != nil {
+		t.Fatal(err)
+	}
+	profile := signed(nostr.KindProfileMetadata, 200, "{}")
+	if err := store.ReplaceEvent(profile); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(received []ReceivedEvent) []nostr.ID {
+		var ids []nostr.ID
+		for _, evt := range received {
+			ids = append(ids, evt.ID)
+		}
+		return ids
+	}
+
+	got := slices.Collect(store.QueryEventsReceivedSince(5500, 0))
+	if len(got) != 2 || !slices.Contains(ids(got), fresh.ID) || !slices.Contains(ids(got), profile.ID) {
+		t.Errorf("received since 5500: %v, want the new note and the profile", ids(got))
+	}
+	for _, evt := range got {
+		if evt.ReceivedAt != 6000 {
+			t.Errorf("%s received at %d, want 6000", evt.ID, evt.ReceivedAt)
+		}
+	}
+
+	got = slices.Collect(store.QueryEventsReceivedSince(0, 0))
+	if len(got) != 3 || got[2].ID != backfilled.ID || got[2].ReceivedAt != 5000 || got[2].CreatedAt != 100 {
+		t.Errorf("received since 0: %v, want the backfilled event last, received at 5000", ids(got))
+	}
+	if got := slices.Collect(store.QueryEventsReceivedSince(0, 1)); len(got) != 1 {
+		t.Errorf("received with a limit of 1: %d events", len(got))
+	}
+
+	times, err := store.ReceivedTimes([]nostr.ID{backfilled.ID, fresh.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if times[backfilled.ID] != 5000 || times[fresh.ID] != 6000 {
+		t.Errorf("ReceivedTimes = %v", times)
+	}
+
+	// Filters still go by created_at
+	var recent []nostr.ID
+	for event := range store.QueryEvents(nostr.Filter{Authors: []nostr.PubKey{secret.Public()}, Since: 1000}, 0) {
+		recent = append(recent, event.ID)
+	}
+	if len(recent) != 1 || recent[0] != fresh.ID {
+		t.Errorf("events created since 1000: %v, want only the new note", recent)
+	}
+}
+
+func TestReceivedEvent_MarshalJSON(t *testing.T) {
+	event := createTestEvent(nostr.KindTextNote, "hello")
+	b, err := json.Marshal(ReceivedEvent{Event: event, ReceivedAt: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatalf("invalid JSON %s: %v", b, err)
+	}
+	if fields["id"] != event.ID.Hex() || fields["pubkey"] != event.PubKey.Hex() || fields["content"] != "hello" {
+		t.Errorf("%s doesn't carry the event's fields", b)
+	}
+	if fields["received_at"] != float64(42) {
+		t.Errorf("%s has no received_at of 42", b)
+	}
+}
+
+func TestAdmin_ExportReceivedAt(t *testing.T) {
+	instance := createTestInstance()
+
+	receivedAt(t, 7000)
+	event := createTestEvent(nostr.KindTextNote, "exported")
+	if err := instance.Events.SaveEvent(event); err != nil {
+		t.Fatal(err)
+	}
+
+	if out := runTestAdmin(t, instance, "export", "--kind", "1"); strings.Contains(out, "received_at") {
+		t.Errorf("export without --received-at wrote %q", out)
+	}
+
+	out := runTestAdmin(t, instance, "export", "--kind", "1", "--received-at")
+	var line struct {
+		ID         string `json:"id"`
+		ReceivedAt int64  `json:"received_at"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(out)), &line); err != nil {
+		t.Fatalf("invalid export line %q: %v", out, err)
+	}
+	if line.ID != event.ID.Hex() || line.ReceivedAt != 7000 {
+		t.Errorf("exported %s received at %d, want %s at 7000", line.ID, line.ReceivedAt, event.ID.Hex())
+	}
+
+	receivedAt(t, nostr.Now())
+	latest := createTestEvent(nostr.KindTextNote, "just now")
+	if err := instance.Events.SaveEvent(latest); err != nil {
+		t.Fatal(err)
+	}
+
+	out = runTestAdmin(t, instance, "received", "--since", "1h")
+	if !strings.Contains(out, latest.ID.Hex()) {
+		t.Error("an event received just now isn't listed as received in the last hour")
+	}
+	if strings.Contains(out, event.ID.Hex()) {
+		t.Error("an event received long ago is listed as received in the last hour")
+	}
+}
@@ -0,0 +1,411 @@
+package zooid
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Cache reconciliation.
+//
+// The group and relay caches are kept in sync by the live event handlers, so
+// any disagreement with the database is a bug. VerifyCaches recomputes cached
+// state from the stored events and reports every difference; with
+// reconcile.repair set it also overwrites the cache with the stored state.
+// Events saved while a check runs can show up as drift that isn't real, and
+// repairing it is harmless since the database is the source of truth.
+
+// Drift is one cache entry that disagrees with the database. Cached and
+// Stored describe the two values, e.g. "member" and "absent".
+type Drift struct {
+	Cache  string `json:"cache"`
+	Group  string `json:"group,omitempty"`
+	Key    string `json:"key,omitempty"`
+	Cached string `json:"cached"`
+	Stored string `json:"stored"`
+}
+
+// DriftReport is the result of a cache check. Repaired reports whether the
+// drift found was written back to the cache.
+type DriftReport struct {
+	Checked  int     `json:"checked"`
+	Drift    []Drift `json:"drift"`
+	Repaired bool    `json:"repaired"`
+}
+
+// Groups
+
+// VerifyCaches compares the membership, metadata and creator caches of up to
+// sample groups, chosen at random, with the event log. A sample of 0 checks
+// every group. Groups whose membership cache isn't authoritative yet are
+// only checked for metadata and creator.
+func (g *GroupStore) VerifyCaches(sample int) (DriftReport, error) {
+	repair := g.policyConfig().Reconcile.Repair
+	report := DriftReport{Drift: make([]Drift, 0), Repaired: repair}
+
+	groups := make(map[string]struct{})
+	collect := func(key, _ any) bool {
+		groups[key.(string)] = struct{}{}
+		return true
+	}
+	g.metadataCache.Range(collect)
+	g.creatorCache.Range(collect)
+
+	ids := Keys(groups)
+	slices.Sort(ids)
+	if sample > 0 && sample < len(ids) {
+		rand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+		ids = ids[:sample]
+	}
+
+	for _, h := range ids {
+		report.Drift = append(report.Drift, g.verifyMetadata(h, repair)...)
+		report.Drift = append(report.Drift, g.verifyCreator(h, repair)...)
+		report.Drift = append(report.Drift, g.verifyMembership(h, repair)...)
+		report.Checked++
+	}
+
+	return report, nil
+}
+
+func (g *GroupStore) verifyMetadata(h string, repair bool) []Drift {
+	var stored nostr.Event
+	var found bool
+	filter := nostr.Filter{
+		Kinds: []nostr.Kind{nostr.KindSimpleGroupMetadata},
+		Tags:  nostr.TagMap{"d": []string{h}},
+	}
+	for event := range g.Events.QueryEvents(filter, 1) {
+		stored, found = event, true
+	}
+
+	cached := "absent"
+	if v, ok := g.metadataCache.Load(h); ok && v.(*groupMetaCache).found {
+		cached = v.(*groupMetaCache).event.ID.Hex()
+	}
+
+	want := "absent"
+	if found {
+		want = stored.ID.Hex()
+	}
+
+	if cached == want {
+		return nil
+	}
+
+	if repair {
+		if found {
+			g.metadataCache.Store(h, newGroupMetaCache(stored))
+		} else {
+			g.metadataCache.Delete(h)
+		}
+	}
+
+	return []Drift{{Cache: "metadata", Group: h, Cached: cached, Stored: want}}
+}
+
+func (g *GroupStore) verifyCreator(h string, repair bool) []Drift {
+	var stored nostr.PubKey
+	var found bool
+	filter := nostr.Filter{
+		Kinds: []nostr.Kind{nostr.KindSimpleGroupCreateGroup},
+		Tags:  nostr.TagMap{"h": []string{h}},
+	}
+	// Newest first, matching WarmCaches.
+	for event := range g.Events.QueryEvents(filter, 1) {
+		stored, found = event.PubKey, true
+	}
+
+	cached := "absent"
+	if v, ok := g.creatorCache.Load(h); ok {
+		cached = v.(nostr.PubKey).Hex()
+	}
+
+	want := "absent"
+	if found {
+		want = stored.Hex()
+	}
+
+	if cached == want {
+		return nil
+	}
+
+	if repair {
+		if found {
+			g.creatorCache.Store(h, stored)
+		} else {
+			g.creatorCache.Delete(h)
+		}
+	}
+
+	return []Drift{{Cache: "creator", Group: h, Cached: cached, Stored: want}}
+}
+
+func (g *GroupStore) verifyMembership(h string, repair bool) []Drift {
+	if _, fullyLoaded := g.membershipFullyLoaded.Load(h); !fullyLoaded {
+		return nil
+	}
+
+	stored := g.membersFromLog(h)
+	ms := g.getOrCreateMemberSet(h)
+
+	drift := make([]Drift, 0)
+	ms.mu.Lock()
+	for pubkey := range ms.members {
+		if _, ok := stored[pubkey]; !ok {
+			drift = append(drift, Drift{Cache: "membership", Group: h, Key: pubkey.Hex(), Cached: "member", Stored: "absent"})
+			if repair {
+				delete(ms.members, pubkey)
+			}
+		}
+	}
+	for pubkey := range stored {
+		if _, ok := ms.members[pubkey]; !ok {
+			drift = append(drift, Drift{Cache: "membership", Group: h, Key: pubkey.Hex(), Cached: "absent", Stored: "member"})
+			if repair {
+				ms.members[pubkey] = struct{}{}
+			}
+		}
+	}
+	ms.mu.Unlock()
+
+	if repair && len(drift) > 0 {
+		if err := g.ScheduleMembersListUpdate(h); err != nil {
+			log.Printf("Failed to rewrite members list for group %q after repair: %v", h, err)
+		}
+	}
+
+	return drift
+}
+
+// membersFromLog replays the put/remove user events for h, oldest first with
+// ties broken by id as in IsMember.
+func (g *GroupStore) membersFromLog(h string) map[nostr.PubKey]struct{} {
+	filter := nostr.Filter{
+		Kinds: []nostr.Kind{nostr.KindSimpleGroupPutUser, nostr.KindSimpleGroupRemoveUser},
+		Tags:  nostr.TagMap{"h": []string{h}},
+	}
+
+	members := make(map[nostr.PubKey]struct{})
+	for event := range g.Events.QueryEventsOldestFirst(filter, 0) {
+		for tag := range event.Tags.FindAll("p") {
+			if pubkey, err := nostr.PubKeyFromHex(tag[1]); err == nil {
+				if event.Kind == nostr.KindSimpleGroupPutUser {
+					members[pubkey] = struct{}{}
+				} else {
+					delete(members, pubkey)
+				}
+			}
+		}
+	}
+
+	return members
+}
+
+// Relay
+
+// VerifyCaches compares the relay membership and ban caches with the lists
+// they're loaded from. sample limits how many relay members are compared,
+// chosen at random; 0 compares all of them. Bans are always compared in full.
+func (m *ManagementStore) VerifyCaches(sample int) (DriftReport, error) {
+	repair := m.Config.Reconcile.Repair
+	report := DriftReport{Drift: make([]Drift, 0), Repaired: repair}
+
+	// Members, with their expiry ("0" for none)
+	stored := make(map[nostr.PubKey]string)
+	for tag := range m.Events.GetOrCreateRelayMembersList().Tags.FindAll("member") {
+		if pubkey, err := nostr.PubKeyFromHex(tag[1]); err == nil {
+			stored[pubkey] = strconv.FormatInt(int64(memberTagExpiry(tag)), 10)
+		}
+	}
+
+	cached := make(map[nostr.PubKey]string)
+	m.relayMembers.Range(func(key, _ any) bool {
+		expires := nostr.Timestamp(0)
+		if v, ok := m.memberExpiry.Load(key); ok {
+			expires = v.(nostr.Timestamp)
+		}
+		cached[key.(nostr.PubKey)] = strconv.FormatInt(int64(expires), 10)
+		return true
+	})
+
+	pubkeys := Keys(stored)
+	for pubkey := range cached {
+		if _, ok := stored[pubkey]; !ok {
+			pubkeys = append(pubkeys, pubkey)
+		}
+	}
+	if sample > 0 && sample < len(pubkeys) {
+		rand.Shuffle(len(pubkeys), func(i, j int) { pubkeys[i], pubkeys[j] = pubkeys[j], pubkeys[i] })
+		pubkeys = pubkeys[:sample]
+	}
+
+	for _, pubkey := range pubkeys {
+		report.Checked++
+
+		have, inCache := cached[pubkey]
+		want, inStore := stored[pubkey]
+		if inCache == inStore && have == want {
+			continue
+		}
+
+		report.Drift = append(report.Drift, Drift{
+			Cache:  "relay_members",
+			Key:    pubkey.Hex(),
+			Cached: describeMembership(have, inCache),
+			Stored: describeMembership(want, inStore),
+		})
+
+		if repair {
+			m.memberExpiry.Delete(pubkey)
+			if !inStore {
+				m.relayMembers.Delete(pubkey)
+				continue
+			}
+
+			m.relayMembers.Store(pubkey, struct{}{})
+			if expires, _ := strconv.ParseInt(want, 10, 64); expires != 0 {
+				m.memberExpiry.Store(pubkey, nostr.Timestamp(expires))
+			}
+		}
+	}
+
+	// Bans
+	bannedPubkeys := make(map[string]string)
+	for tag := range m.Events.GetOrCreateApplicationSpecificData(BANNED_PUBKEYS).Tags.FindAll("banned") {
+		if pubkey, err := nostr.PubKeyFromHex(tag[1]); err == nil {
+			bannedPubkeys[pubkey.Hex()] = tag[2]
+		}
+	}
+	report.Drift = append(report.Drift, verifyBans("banned_pubkeys", &m.bannedPubkeys, bannedPubkeys, func(key any) string {
+		return key.(nostr.PubKey).Hex()
+	}, func(hex string) any {
+		return nostr.MustPubKeyFromHex(hex)
+	}, repair)...)
+
+	bannedEvents := make(map[string]string)
+	for tag := range m.Events.GetOrCreateApplicationSpecificData(BANNED_EVENTS).Tags.FindAll("event") {
+		if id, err := nostr.IDFromHex(tag[1]); err == nil {
+			bannedEvents[id.Hex()] = tag[2]
+		}
+	}
+	report.Drift = append(report.Drift, verifyBans("banned_events", &m.bannedEvents, bannedEvents, func(key any) string {
+		return key.(nostr.ID).Hex()
+	}, func(hex string) any {
+		id, _ := nostr.IDFromHex(hex)
+		return id
+	}, repair)...)
+
+	report.Checked += len(bannedPubkeys) + len(bannedEvents)
+
+	return report, nil
+}
+
+func describeMembership(expires string, present bool) string {
+	if !present {
+		return "absent"
+	}
+	if expires == "0" {
+		return "member"
+	}
+	return "member until " + expires
+}
+
+// verifyBans compares a ban cache, keyed by pubkey or event id and holding
+// the reason, with the stored list.
+func verifyBans(name string, cache *sync.Map, stored map[string]string, hex func(key any) string, key func(hex string) any, repair bool) []Drift {
+	drift := make([]Drift, 0)
+
+	cached := make(map[string]string)
+	cache.Range(func(k, v any) bool {
+		cached[hex(k)] = v.(string)
+		return true
+	})
+
+	for id, reason := range cached {
+		if want, ok := stored[id]; !ok || want != reason {
+			drift = append(drift, Drift{Cache: name, Key: id, Cached: "banned", Stored: banState(want, ok)})
+			if repair && !ok {
+				cache.Delete(key(id))
+			}
+		}
+	}
+	for id, reason := range stored {
+		if _, ok := cached[id]; !ok {
+			drift = append(drift, Drift{Cache: name, Key: id, Cached: "absent", Stored: "banned"})
+		}
+		if repair {
+			cache.Store(key(id), reason)
+		}
+	}
+
+	return drift
+}
+
+func banState(reason string, banned bool) string {
+	if !banned {
+		return "absent"
+	}
+	return "banned: " + reason
+}
+
+// Scheduling
+
+var cacheDrift = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "zooid_cache_drift",
+	Help: "Cache entries that disagreed with the database in the last reconciliation",
+}, []string{"instance", "cache"})
+
+// VerifyCaches checks both the group and relay caches, logs any drift and
+// records it in the zooid_cache_drift gauge.
+func (instance *Instance) VerifyCaches(sample int) (groups DriftReport, relay DriftReport, err error) {
+	if groups, err = instance.Groups.VerifyCaches(sample); err != nil {
+		return groups, relay, err
+	}
+	if relay, err = instance.Management.VerifyCaches(sample); err != nil {
+		return groups, relay, err
+	}
+
+	label := instanceLabel(instance)
+	cacheDrift.With(prometheus.Labels{"instance": label, "cache": "groups"}).Set(float64(len(groups.Drift)))
+	cacheDrift.With(prometheus.Labels{"instance": label, "cache": "relay"}).Set(float64(len(relay.Drift)))
+
+	for _, drift := range append(groups.Drift, relay.Drift...) {
+		log.Printf("Cache drift in %s: %s group=%q key=%s cached=%q stored=%q repaired=%v",
+			instance.Config.Schema, drift.Cache, drift.Group, drift.Key, drift.Cached, drift.Stored, groups.Repaired)
+	}
+
+	return groups, relay, nil
+}
+
+// startReconciler runs VerifyCaches every reconcile.interval until ctx is
+// cancelled. It does nothing if no interval is configured.
+func (instance *Instance) startReconciler(ctx context.Context) {
+	interval, err := ParseRetentionDuration(instance.Config.Reconcile.Interval)
+	if err != nil || interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, _, err := instance.VerifyCaches(instance.Config.Reconcile.Sample); err != nil {
+					log.Printf("Cache reconciliation failed for %s: %v", instance.Config.Schema, err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,115 @@
+package zooid
+
+import (
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGroupStore_VerifyCaches(t *testing.T) {
+	instance := createTestInstance()
+	groups := instance.Groups
+
+	create := nostr.Event{Kind: nostr.KindSimpleGroupCreateGroup, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"h", "recon"}}}
+	if err := groups.Events.SignAndStoreEvent(&create, false); err != nil {
+		t.Fatalf("failed to store create event: %v", err)
+	}
+	groups.creatorCache.Store("recon", create.PubKey)
+	groups.UpdateMetadata(nostr.Event{CreatedAt: nostr.Now(), Tags: nostr.Tags{{"h", "recon"}}, Content: `{"name":"Recon"}`})
+	groups.membershipFullyLoaded.Store("recon", struct{}{})
+
+	member := nostr.Generate().Public()
+	if err := groups.AddMember("recon", member); err != nil {
+		t.Fatalf("AddMember failed: %v", err)
+	}
+
+	report, err := groups.VerifyCaches(0)
+	if err != nil {
+		t.Fatalf("VerifyCaches failed: %v", err)
+	}
+	if report.Checked != 1 || len(report.Drift) != 0 {
+		t.Fatalf("expected a clean check of 1 group, got %+v", report)
+	}
+
+	// Corrupt the caches behind the store's back
+	ghost := nostr.Generate().Public()
+	ms := groups.getOrCreateMemberSet("recon")
+	ms.mu.Lock()
+	delete(ms.members, member)
+	ms.members[ghost] = struct{}{}
+	ms.mu.Unlock()
+	groups.metadataCache.Delete("recon")
+
+	report, _ = groups.VerifyCaches(0)
+	if len(report.Drift) != 3 || report.Repaired {
+		t.Fatalf("expected 3 unrepaired drift entries, got %+v", report)
+	}
+	if groups.IsMember("recon", member) || !groups.IsMember("recon", ghost) {
+		t.Error("caches should be left alone without reconcile.repair")
+	}
+
+	groups.Config.Reconcile.Repair = true
+
+	report, _ = groups.VerifyCaches(0)
+	if len(report.Drift) != 3 || !report.Repaired {
+		t.Fatalf("expected 3 repaired drift entries, got %+v", report)
+	}
+	if !groups.IsMember("recon", member) || groups.IsMember("recon", ghost) {
+		t.Error("membership cache was not repaired")
+	}
+	if _, found := groups.GetMetadata("recon"); !found {
+		t.Error("metadata cache was not repaired")
+	}
+
+	report, _ = groups.VerifyCaches(0)
+	if len(report.Drift) != 0 {
+		t.Errorf("expected no drift after repair, got %+v", report.Drift)
+	}
+}
+
+func TestManagementStore_VerifyCaches(t *testing.T) {
+	instance := createTestInstance()
+	m := instance.Management
+
+	member := nostr.Generate().Public()
+	banned := nostr.Generate().Public()
+	m.AddMember(member)
+	m.BanPubkey(banned, "spam")
+
+	if report, _ := m.VerifyCaches(0); len(report.Drift) != 0 {
+		t.Fatalf("expected no drift, got %+v", report.Drift)
+	}
+
+	ghost := nostr.Generate().Public()
+	m.relayMembers.Store(ghost, struct{}{})
+	m.memberExpiry.Store(member, nostr.Timestamp(1))
+	m.bannedPubkeys.Delete(banned)
+
+	m.Config.Reconcile.Repair = true
+
+	groups, relay, err := instance.VerifyCaches(0)
+	if err != nil {
+		t.Fatalf("VerifyCaches failed: %v", err)
+	}
+	if len(groups.Drift) != 0 || len(relay.Drift) != 3 {
+		t.Fatalf("expected 3 relay drift entries, got %+v", relay.Drift)
+	}
+	if v := testutil.ToFloat64(cacheDrift.WithLabelValues(instanceLabel(instance), "relay")); v != 3 {
+		t.Errorf("zooid_cache_drift = %v, want 3", v)
+	}
+
+	if m.IsMember(ghost) {
+		t.Error("ghost member was not removed")
+	}
+	if _, ok := m.memberExpiry.Load(member); ok {
+		t.Error("bogus expiry was not removed")
+	}
+	if !m.PubkeyIsBanned(banned) {
+		t.Error("ban was not restored")
+	}
+
+	if report, _ := m.VerifyCaches(0); len(report.Drift) != 0 {
+		t.Errorf("expected no drift after repair, got %+v", report.Drift)
+	}
+}
@@ -0,0 +1,55 @@
+package zooid
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+)
+
+// Reindex creates any missing indexes with CREATE INDEX CONCURRENTLY and
+// rebuilds any left invalid by an interrupted concurrent build. Unlike Init,
+// it never blocks writes, so it's the way to roll out new indexes on large
+// production tables: run it (e.g. via the reindex management method) before
+// deploying code whose Init would otherwise build them inline.
+//
+// Concurrent builds can take a long time on big tables, so no per-statement
+// timeout is applied; ctx bounds the whole run.
+func (events *EventStore) Reindex(ctx context.Context) error {
+	if usesSQLite() {
+		return events.sqliteReindex(ctx)
+	}
+	if usesMemory() {
+		return errNeedsDatabase("reindexing")
+	}
+
+	for _, idx := range slices.Concat(initIndexes, migratedIndexes) {
+		name := events.Schema.Prefix(idx.Name)
+
+		var valid *bool
+		err := GetDb().QueryRowContext(ctx, `
+			SELECT (SELECT pg_index.indisvalid FROM pg_index WHERE pg_index.indexrelid = pg_class.oid)
+			FROM pg_class
+			WHERE pg_class.oid = to_regclass($1) AND pg_class.relkind = 'i'
+		`, name).Scan(&valid)
+
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			log.Printf("Creating missing index %s", name)
+			if _, err := GetDb().ExecContext(ctx, events.Schema.Render(idx.create(true))); err != nil {
+				return fmt.Errorf("creating index %s: %w", name, err)
+			}
+		case err != nil:
+			return fmt.Errorf("checking index %s: %w", name, err)
+		case valid == nil || !*valid:
+			log.Printf("Rebuilding invalid index %s", name)
+			if _, err := GetDb().ExecContext(ctx, "REINDEX INDEX CONCURRENTLY "+name); err != nil {
+				return fmt.Errorf("rebuilding index %s: %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,40 @@
+package zooid
+
+// RejectPrefix is the machine-readable reason at the start of a NIP-01 OK or
+// CLOSED message. Clients branch on it, so zooid picks them consistently:
+//
+//   - auth-required: the client hasn't authenticated (NIP-42 or NIP-98).
+//   - restricted: the client is authenticated but not allowed to do this,
+//     e.g. it isn't a member, lacks a role, or needs an invite code.
+//   - blocked: the pubkey or event is banned, or the relay refuses all
+//     writes (read-only mode).
+//   - invalid: the event itself is wrong: missing tags, an unknown group, a
+//     group that already exists, or a bad id or signature.
+//   - duplicate: the request would change nothing, e.g. joining a group the
+//     client is already in.
+//
+// One deliberate exception: writes to a hidden group from someone without
+// access get "invalid: group not found", exactly as for a group that doesn't
+// exist, so the response doesn't reveal that it does.
+type RejectPrefix string
+
+const (
+	RejectAuthRequired RejectPrefix = "auth-required"
+	RejectRestricted   RejectPrefix = "restricted"
+	RejectBlocked      RejectPrefix = "blocked"
+	RejectInvalid      RejectPrefix = "invalid"
+	RejectDuplicate    RejectPrefix = "duplicate"
+	RejectRateLimited  RejectPrefix = "rate-limited"
+	RejectError        RejectPrefix = "error"
+)
+
+// Reason formats a rejection message, e.g. "restricted: group is full".
+func (p RejectPrefix) Reason(msg string) string {
+	return string(p) + ": " + msg
+}
+
+// Reject returns the (reject, msg) pair khatru's OnEvent and OnRequest hooks
+// expect.
+func (p RejectPrefix) Reject(msg string) (bool, string) {
+	return true, p.Reason(msg)
+}
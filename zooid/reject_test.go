@@ -0,0 +1,137 @@
+package zooid
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// authedContext mimics a khatru connection on which pubkey has completed
+// NIP-42 auth. khatru keys the connection by its first (zero) context key.
+func authedContext(pubkey nostr.PubKey) context.Context {
+	return context.WithValue(context.Background(), 0, &khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{pubkey}})
+}
+
+func signedBy(secret nostr.SecretKey, event nostr.Event) nostr.Event {
+	event.CreatedAt = nostr.Now()
+	event.Sign(secret)
+	return event
+}
+
+func assertPrefix(t *testing.T, name string, msg string, want RejectPrefix) {
+	t.Helper()
+	if !strings.HasPrefix(msg, string(want)+": ") {
+		t.Errorf("%s: message %q, want prefix %q", name, msg, want)
+	}
+}
+
+func TestRejectPrefix_Reason(t *testing.T) {
+	if got := RejectRestricted.Reason("group is full"); got != "restricted: group is full" {
+		t.Errorf("Reason() = %q", got)
+	}
+	if reject, msg := RejectBlocked.Reject("banned"); !reject || msg != "blocked: banned" {
+		t.Errorf("Reject() = (%v, %q)", reject, msg)
+	}
+}
+
+func TestOnEvent_RejectPrefixes(t *testing.T) {
+	instance := createTestInstance()
+
+	member := nostr.Generate()
+	instance.Management.AddMember(member.Public())
+	outsider := nostr.Generate()
+	banned := nostr.Generate()
+	instance.Management.BanPubkey(banned.Public(), "spam")
+
+	bannedNote := signedBy(member, nostr.Event{Kind: nostr.KindTextNote, Content: "banned"})
+	instance.Management.BanEvent(bannedNote.ID, "spam")
+
+	cases := []struct {
+		name  string
+		ctx   context.Context
+		event nostr.Event
+		want  RejectPrefix
+	}{
+		{"unauthenticated", context.Background(), signedBy(member, nostr.Event{Kind: nostr.KindTextNote}), RejectAuthRequired},
+		{"relay-only kind", authedContext(member.Public()), signedBy(member, nostr.Event{Kind: RELAY_MEMBERS, Tags: nostr.Tags{{"d", RELAY_MEMBERS_D}}}), RejectRestricted},
+		{"on behalf of others", authedContext(member.Public()), signedBy(outsider, nostr.Event{Kind: nostr.KindTextNote}), RejectRestricted},
+		{"missing d tag", authedContext(member.Public()), signedBy(member, nostr.Event{Kind: nostr.Kind(30023)}), RejectInvalid},
+		{"join while banned", authedContext(banned.Public()), signedBy(banned, nostr.Event{Kind: RELAY_JOIN}), RejectBlocked},
+		{"join without claim", authedContext(outsider.Public()), signedBy(outsider, nostr.Event{Kind: RELAY_JOIN}), RejectRestricted},
+		{"join with bad claim", authedContext(outsider.Public()), signedBy(outsider, nostr.Event{Kind: RELAY_JOIN, Tags: nostr.Tags{{"claim", "nope"}}}), RejectRestricted},
+		{"not a member", authedContext(outsider.Public()), signedBy(outsider, nostr.Event{Kind: nostr.KindTextNote}), RejectRestricted},
+		{"internal event", authedContext(member.Public()), signedBy(member, nostr.Event{Kind: nostr.KindApplicationSpecificData, Tags: nostr.Tags{{"d", "zooid/x"}}}), RejectRestricted},
+		{"banned event", authedContext(member.Public()), bannedNote, RejectBlocked},
+	}
+
+	for _, c := range cases {
+		reject, msg := instance.OnEvent(c.ctx, c.event)
+		if !reject {
+			t.Errorf("%s: OnEvent accepted the event", c.name)
+			continue
+		}
+		assertPrefix(t, c.name, msg, c.want)
+	}
+
+	instance.Config.SetReadOnly(true)
+	_, msg := instance.OnEvent(authedContext(member.Public()), signedBy(member, nostr.Event{Kind: nostr.KindTextNote}))
+	assertPrefix(t, "read-only", msg, RejectBlocked)
+}
+
+func TestOnRequest_RejectPrefixes(t *testing.T) {
+	instance := createTestInstance()
+
+	_, msg := instance.OnRequest(context.Background(), nostr.Filter{})
+	assertPrefix(t, "unauthenticated", msg, RejectAuthRequired)
+
+	_, msg = instance.OnRequest(authedContext(nostr.Generate().Public()), nostr.Filter{})
+	assertPrefix(t, "not a member", msg, RejectRestricted)
+}
+
+func TestCheckWrite_RejectPrefixes(t *testing.T) {
+	instance := createTestInstance()
+	groups := instance.Groups
+	groups.Config.Groups.AdminCreateOnly = true
+
+	creator := nostr.Generate().Public()
+	member := nostr.Generate().Public()
+	outsider := nostr.Generate().Public()
+
+	groups.creatorCache.Store("open", creator)
+	groups.UpdateMetadata(nostr.Event{CreatedAt: nostr.Now(), Tags: nostr.Tags{{"h", "open"}}, Content: `{"name":"Open"}`})
+	groups.UpdateMetadata(nostr.Event{CreatedAt: nostr.Now(), Tags: nostr.Tags{{"h", "closed"}}, Content: `{"name":"Closed","closed":true}`})
+	groups.UpdateMetadata(nostr.Event{CreatedAt: nostr.Now(), Tags: nostr.Tags{{"h", "hidden"}}, Content: `{"name":"Hidden","hidden":true}`})
+	groups.membershipFullyLoaded.Store("open", struct{}{})
+	groups.AddMember("open", member)
+
+	event := func(kind nostr.Kind, pubkey nostr.PubKey, h string) nostr.Event {
+		return nostr.Event{Kind: kind, PubKey: pubkey, Tags: nostr.Tags{{"h", h}}}
+	}
+
+	cases := []struct {
+		name  string
+		event nostr.Event
+		want  RejectPrefix
+	}{
+		{"metadata set directly", event(nostr.KindSimpleGroupMetadata, creator, "open"), RejectRestricted},
+		{"group already exists", event(nostr.KindSimpleGroupCreateGroup, creator, "open"), RejectInvalid},
+		{"create without admin", event(nostr.KindSimpleGroupCreateGroup, outsider, "new"), RejectRestricted},
+		{"group not found", event(nostr.Kind(9), member, "missing"), RejectInvalid},
+		{"moderate without admin", event(nostr.KindSimpleGroupPutUser, outsider, "open"), RejectRestricted},
+		{"already a member", event(nostr.KindSimpleGroupJoinRequest, member, "open"), RejectDuplicate},
+		{"leave without membership", event(nostr.KindSimpleGroupLeaveRequest, outsider, "open"), RejectDuplicate},
+		{"hidden group is masked", event(nostr.Kind(9), outsider, "hidden"), RejectInvalid},
+		{"hidden join is masked", event(nostr.KindSimpleGroupJoinRequest, outsider, "hidden"), RejectInvalid},
+		{"closed group", event(nostr.Kind(9), outsider, "closed"), RejectRestricted},
+	}
+
+	for _, c := range cases {
+		assertPrefix(t, c.name, groups.CheckWrite(c.event), c.want)
+	}
+
+	groups.Config.Groups.Enabled = false
+	assertPrefix(t, "groups disabled", groups.CheckWrite(event(nostr.Kind(9), member, "open")), RejectInvalid)
+}
@@ -0,0 +1,124 @@
+package zooid
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Relay information.
+//
+// khatru answers requests with Accept: application/nostr+json with the
+// NIP-11 document, which OverwriteRelayInformation fills in from the config.
+// [info] may also name a posting policy and a payments page, which NIP-11
+// has fields for, and community links, which it doesn't, so they're added as
+// "links". Clients fetch the document on every connection, so it's served
+// with an ETag and a short max-age, and a refetch of an unchanged document is
+// a 304. khatru's CORS headers let browsers read it; the ETag is exposed to
+// them too.
+
+// relayInfoMaxAge is how long clients may use the document without asking
+// again.
+const relayInfoMaxAge = "60"
+
+// InfoLink is a community link in the relay information document.
+type InfoLink struct {
+	Name string `toml:"name" json:"name"`
+	URL  string `toml:"url" json:"url"`
+}
+
+// isRelayInfoRequest reports whether khatru would answer r with the relay
+// information document.
+func isRelayInfoRequest(r *http.Request) bool {
+	return !isWebSocketUpgrade(r) && r.Header.Get("Accept") == "application/nostr+json"
+}
+
+// serveRelayInfo serves khatru's relay information document with the
+// community links added, and caching headers.
+func (instance *Instance) serveRelayInfo(w http.ResponseWriter, r *http.Request) {
+	rec := &infoRecorder{header: make(http.Header), status: http.StatusOK}
+	instance.Relay.ServeHTTP(rec, r)
+
+	body := rec.body.Bytes()
+	if rec.status == http.StatusOK && len(instance.Config.Info.Links) > 0 {
+		var err error
+		if body, err = withLinks(body, instance.Config.Info.Links); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	for key, values := range rec.header {
+		w.Header()[key] = values
+	}
+	if rec.status != http.StatusOK {
+		w.WriteHeader(rec.status)
+		w.Write(body)
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age="+relayInfoMaxAge)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "ETag")
+	w.Header().Add("Vary", "Accept")
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Write(body)
+}
+
+// withLinks adds links to the document as a "links" field. khatru always
+// writes some fields, so there's one to follow.
+func withLinks(doc []byte, links []InfoLink) ([]byte, error) {
+	encoded, err := json.Marshal(links)
+	if err != nil {
+		return nil, err
+	}
+
+	doc = bytes.TrimRight(doc, "\n")
+	doc = append(doc[:len(doc)-1], `,"links":`...)
+	doc = append(doc, encoded...)
+	return append(doc, '}', '\n'), nil
+}
+
+// etagMatches reports whether an If-None-Match header names etag.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// infoRecorder keeps what khatru writes, so the document can be amended
+// before it's sent.
+type infoRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *infoRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *infoRecorder) Write(b []byte) (int, error) {
+	return rec.body.Write(b)
+}
+
+func (rec *infoRecorder) WriteHeader(status int) {
+	rec.status = status
+}
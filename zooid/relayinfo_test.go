@@ -0,0 +1,72 @@
+package zooid
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"fiatjaf.com/nostr/khatru"
+)
+
+func TestServeRelayInfo(t *testing.T) {
+	instance := createTestInstance()
+	instance.Relay = khatru.NewRelay()
+	instance.Relay.Info.Name = instance.Config.Info.Name
+	instance.Relay.OverwriteRelayInformation = instance.OverwriteRelayInformation
+	instance.Config.Info.PostingPolicy = "https://example.com/rules"
+	instance.Config.Info.PaymentsURL = "https://example.com/pay"
+	instance.Config.Info.Links = []InfoLink{{Name: "Chat", URL: "https://chat.example.com"}}
+
+	fetch := func(etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "https://test.com/", nil)
+		r.Header.Set("Accept", "application/nostr+json")
+		r.Header.Set("Origin", "https://coracle.social")
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+
+		w := httptest.NewRecorder()
+		instance.ServeHTTP(w, r)
+		return w
+	}
+
+	w := fetch("")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	var doc struct {
+		Name          string     `json:"name"`
+		PostingPolicy string     `json:"posting_policy"`
+		PaymentsURL   string     `json:"payments_url"`
+		Links         []InfoLink `json:"links"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid document %q: %v", w.Body.String(), err)
+	}
+	if doc.Name != "Test Relay" || doc.PostingPolicy != "https://example.com/rules" || doc.PaymentsURL != "https://example.com/pay" {
+		t.Errorf("document %s is missing the configured fields", w.Body.String())
+	}
+	if len(doc.Links) != 1 || doc.Links[0] != instance.Config.Info.Links[0] {
+		t.Errorf("links = %v", doc.Links)
+	}
+
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Header().Get("Cache-Control") == "" {
+		t.Errorf("no caching headers: %v", w.Header())
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Access-Control-Expose-Headers") != "ETag" {
+		t.Errorf("CORS headers: %v", w.Header())
+	}
+
+	if w := fetch(etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("refetch with the ETag got %d and %d bytes, want a bare 304", w.Code, w.Body.Len())
+	}
+
+	// A changed document gets a new ETag
+	instance.Config.Info.Links = nil
+	if w := fetch(etag); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("refetch of a changed document got %d with ETag %s", w.Code, w.Header().Get("ETag"))
+	}
+}
@@ -0,0 +1,188 @@
+package zooid
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"iter"
+	"slices"
+	"sync"
+
+	"fiatjaf.com/nostr"
+)
+
+// Relay lists (NIP 65).
+//
+// Outbox-model clients ask for the kind 10002 relay lists of everyone they
+// follow at once, to find out which of them use this relay. The newest list
+// of every author is cached, and a REQ of exactly the shape
+//
+//	{"kinds": [10002], "authors": [...], "limit": n}
+//
+// (limit optional) is answered from the cache without touching the
+// database. Anything else in the filter, such as since or a tag, sends it to
+// the database as usual.
+//
+// Relay lists are replaceable, so ReplaceEvent only ever keeps the newest
+// one per author. Migration 003 deletes older lists stored before it did.
+
+// relayListCache holds the newest relay list of every author. The zero value
+// is empty and not ready to serve from.
+type relayListCache struct {
+	mu     sync.RWMutex
+	lists  map[nostr.PubKey]nostr.Event
+	ids    map[nostr.ID]nostr.PubKey
+	warmed bool
+}
+
+// load replaces the cache's contents with events and marks it ready.
+func (c *relayListCache) load(events iter.Seq[nostr.Event]) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lists = make(map[nostr.PubKey]nostr.Event)
+	c.ids = make(map[nostr.ID]nostr.PubKey)
+	for event := range events {
+		c.putLocked(event)
+	}
+	c.warmed = true
+}
+
+// unload drops the cache's contents, so lookups go to the database.
+func (c *relayListCache) unload() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lists, c.ids, c.warmed = nil, nil, false
+}
+
+// put caches event unless a newer list from its author is cached already.
+func (c *relayListCache) put(event nostr.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.putLocked(event)
+}
+
+func (c *relayListCache) putLocked(event nostr.Event) {
+	if c.lists == nil {
+		c.lists = make(map[nostr.PubKey]nostr.Event)
+		c.ids = make(map[nostr.ID]nostr.PubKey)
+	}
+
+	if previous, ok := c.lists[event.PubKey]; ok {
+		if !supersedes(event, previous) {
+			return
+		}
+		delete(c.ids, previous.ID)
+	}
+
+	c.lists[event.PubKey] = event
+	c.ids[event.ID] = event.PubKey
+}
+
+// remove forgets the list with id, if it's cached.
+func (c *relayListCache) remove(id nostr.ID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if pubkey, ok := c.ids[id]; ok {
+		delete(c.ids, id)
+		delete(c.lists, pubkey)
+	}
+}
+
+// get returns the cached lists of authors, newest first, and false if the
+// cache hasn't been loaded.
+func (c *relayListCache) get(authors []nostr.PubKey) ([]nostr.Event, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if !c.warmed {
+		return nil, false
+	}
+
+	lists := make([]nostr.Event, 0, len(authors))
+	seen := make(map[nostr.PubKey]struct{}, len(authors))
+	for _, author := range authors {
+		if _, ok := seen[author]; ok {
+			continue
+		}
+		seen[author] = struct{}{}
+
+		if list, ok := c.lists[author]; ok {
+			lists = append(lists, list)
+		}
+	}
+
+	slices.SortFunc(lists, func(a, b nostr.Event) int {
+		return cmp.Compare(b.CreatedAt, a.CreatedAt)
+	})
+
+	return lists, true
+}
+
+// isRelayListFilter reports whether filter has the shape served from the
+// relay list cache.
+func isRelayListFilter(filter nostr.Filter) bool {
+	return len(filter.Kinds) == 1 && filter.Kinds[0] == nostr.KindRelayListMetadata &&
+		len(filter.Authors) > 0 && len(filter.IDs) == 0 && len(filter.Tags) == 0 &&
+		filter.Since == 0 && filter.Until == 0 && filter.Search == ""
+}
+
+// loadRelayLists fills the relay list cache from the database, unless ctx is
+// canceled first.
+func (instance *Instance) loadRelayLists(ctx context.Context) error {
+	failures := instance.Events.queryErrors.Load()
+
+	instance.relayLists.load(func(yield func(nostr.Event) bool) {
+		for event := range instance.Events.QueryEvents(nostr.Filter{
+			Kinds: []nostr.Kind{nostr.KindRelayListMetadata},
+		}, 0) {
+			if ctx.Err() != nil || !yield(event) {
+				return
+			}
+		}
+	})
+
+	if err := ctx.Err(); err != nil {
+		instance.relayLists.unload()
+		return fmt.Errorf("loading relay lists: %w", err)
+	}
+	if n := instance.Events.queryErrors.Load() - failures; n > 0 {
+		instance.relayLists.unload()
+		return fmt.Errorf("loading relay lists: %d queries failed", n)
+	}
+
+	return nil
+}
+
+// rememberRelayList caches a newly saved relay list.
+func (instance *Instance) rememberRelayList(event nostr.Event) {
+	if event.Kind == nostr.KindRelayListMetadata {
+		instance.relayLists.put(event)
+	}
+}
+
+// queryRelayLists serves a relay list filter from the cache, reporting
+// false if the cache isn't ready and the database has to answer.
+func (instance *Instance) queryRelayLists(filter nostr.Filter) ([]nostr.Event, bool) {
+	lists, ok := instance.relayLists.get(filter.Authors)
+	if !ok {
+		return nil, false
+	}
+
+	// Bans in other processes delete events behind this cache's back
+	lists = slices.DeleteFunc(lists, func(list nostr.Event) bool {
+		return instance.Management.PubkeyIsBanned(list.PubKey) || instance.Management.EventIsBanned(list.ID)
+	})
+
+	if filter.LimitZero {
+		return nil, true
+	}
+	if filter.Limit > 0 && len(lists) > filter.Limit {
+		lists = lists[:filter.Limit]
+	}
+
+	return lists, true
+}
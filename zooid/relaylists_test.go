@@ -0,0 +1,165 @@
+package zooid
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func relayList(author nostr.SecretKey, createdAt nostr.Timestamp, urls ...string) nostr.Event {
+	tags := nostr.Tags{}
+	for _, url := range urls {
+		tags = append(tags, nostr.Tag{"r", url})
+	}
+	return signedAt(author, nostr.KindRelayListMetadata, createdAt, tags)
+}
+
+func TestRelayListCache_Replacement(t *testing.T) {
+	var cache relayListCache
+	author := nostr.Generate()
+
+	if _, ok := cache.get([]nostr.PubKey{author.Public()}); ok {
+		t.Fatal("an unloaded cache shouldn't answer")
+	}
+	cache.load(slices.Values([]nostr.Event(nil)))
+
+	older := relayList(author, 100, "wss://old.example.com")
+	newer := relayList(author, 200, "wss://new.example.com")
+
+	// Arrival order doesn't matter, the newest wins
+	cache.put(newer)
+	cache.put(older)
+	if lists, _ := cache.get([]nostr.PubKey{author.Public()}); len(lists) != 1 || lists[0].ID != newer.ID {
+		t.Fatalf("cached %v, want only the newer list", lists)
+	}
+
+	// On equal timestamps, the lowest id wins
+	tie := relayList(author, 200, "wss://tie.example.com")
+	want := newer
+	if bytes.Compare(tie.ID[:], newer.ID[:]) < 0 {
+		want = tie
+	}
+	cache.put(tie)
+	cache.put(newer)
+	if lists, _ := cache.get([]nostr.PubKey{author.Public()}); len(lists) != 1 || lists[0].ID != want.ID {
+		t.Errorf("on a tie cached %v, want %s", lists, want.ID)
+	}
+
+	cache.remove(older.ID)
+	if lists, _ := cache.get([]nostr.PubKey{author.Public()}); len(lists) != 1 {
+		t.Error("removing a list that was replaced forgot the current one")
+	}
+	cache.remove(want.ID)
+	if lists, _ := cache.get([]nostr.PubKey{author.Public()}); len(lists) != 0 {
+		t.Error("deleted list still cached")
+	}
+}
+
+func TestRelayListCache_NewestFirst(t *testing.T) {
+	var cache relayListCache
+	a, b, c := nostr.Generate(), nostr.Generate(), nostr.Generate()
+	cache.load(slices.Values([]nostr.Event{relayList(a, 100), relayList(b, 300), relayList(c, 200)}))
+
+	lists, _ := cache.get([]nostr.PubKey{a.Public(), b.Public(), c.Public(), a.Public(), nostr.Generate().Public()})
+	var got []nostr.Timestamp
+	for _, list := range lists {
+		got = append(got, list.CreatedAt)
+	}
+	if want := []nostr.Timestamp{300, 200, 100}; !slices.Equal(got, want) {
+		t.Errorf("got lists from %v, want %v", got, want)
+	}
+}
+
+func TestIsRelayListFilter(t *testing.T) {
+	authors := []nostr.PubKey{nostr.Generate().Public()}
+	kinds := []nostr.Kind{nostr.KindRelayListMetadata}
+
+	for _, c := range []struct {
+		name   string
+		filter nostr.Filter
+		want   bool
+	}{
+		{"documented shape", nostr.Filter{Kinds: kinds, Authors: authors}, true},
+		{"with a limit", nostr.Filter{Kinds: kinds, Authors: authors, Limit: 10}, true},
+		{"no authors", nostr.Filter{Kinds: kinds}, false},
+		{"other kinds too", nostr.Filter{Kinds: []nostr.Kind{nostr.KindRelayListMetadata, nostr.KindProfileMetadata}, Authors: authors}, false},
+		{"since", nostr.Filter{Kinds: kinds, Authors: authors, Since: 1}, false},
+		{"tags", nostr.Filter{Kinds: kinds, Authors: authors, Tags: nostr.TagMap{"r": []string{"wss://x"}}}, false},
+	} {
+		if got := isRelayListFilter(c.filter); got != c.want {
+			t.Errorf("%s: %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRelayLists_ServedFromCache(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+	instance.loadRelayLists(context.Background())
+
+	author := nostr.Generate()
+	save := func(list nostr.Event) {
+		t.Helper()
+		if err := instance.ReplaceEvent(context.Background(), list); err != nil {
+			t.Fatal(err)
+		}
+		instance.OnEventSaved(context.Background(), list)
+	}
+
+	older := relayList(author, nostr.Now()-10, "wss://old.example.com")
+	newer := relayList(author, nostr.Now(), "wss://new.example.com")
+	save(newer)
+	save(older)
+
+	// Only in the cache, so finding it shows the database wasn't asked
+	cachedOnly := nostr.Generate()
+	instance.relayLists.put(relayList(cachedOnly, nostr.Now(), "wss://cached.example.com"))
+
+	query := func(filter nostr.Filter) []nostr.ID {
+		var ids []nostr.ID
+		for event := range instance.QueryStored(authedContext(author.Public()), filter) {
+			ids = append(ids, event.ID)
+		}
+		return ids
+	}
+
+	filter := nostr.Filter{Kinds: []nostr.Kind{nostr.KindRelayListMetadata}, Authors: []nostr.PubKey{author.Public(), cachedOnly.Public()}}
+	if ids := query(filter); len(ids) != 2 || !slices.Contains(ids, newer.ID) {
+		t.Fatalf("served %d lists from the cache, want the newer list and the cached one", len(ids))
+	}
+
+	filter.Since = 1
+	if ids := query(filter); len(ids) != 1 || ids[0] != newer.ID {
+		t.Errorf("the database returned %d lists, want only the newer one", len(ids))
+	}
+}
+
+func TestRelayLists_ForgottenWhenBanned(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+	instance.loadRelayLists(context.Background())
+
+	banned, author := nostr.Generate(), nostr.Generate()
+	bannedList := relayList(banned, nostr.Now(), "wss://banned.example.com")
+	list := relayList(author, nostr.Now(), "wss://list.example.com")
+	for _, event := range []nostr.Event{bannedList, list} {
+		if err := instance.ReplaceEvent(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+		instance.OnEventSaved(context.Background(), event)
+	}
+
+	if err := instance.Management.BanPubkey(banned.Public(), "spam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := instance.Management.BanEvent(list.ID, "spam"); err != nil {
+		t.Fatal(err)
+	}
+
+	if lists, _ := instance.relayLists.get([]nostr.PubKey{banned.Public(), author.Public()}); len(lists) != 0 {
+		t.Errorf("%d banned lists still cached", len(lists))
+	}
+}
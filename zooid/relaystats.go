@@ -0,0 +1,142 @@
+package zooid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// Relay statistics event.
+//
+// Every stats.interval the relay publishes its member and group counts, the
+// events created in the last 24 hours and its software version as the JSON
+// content of a kind 30078 event with d tag zooid/stats, signed by itself. It
+// is addressable, so only the latest is kept, and unlike the relay's other
+// zooid/ app data it's aggregate data anyone may read: a REQ for it alone
+// needs neither authentication nor membership, so status pages can follow
+// it. Nobody else may publish one. stats.fields picks what's included, and a
+// version that matches the stored one isn't written, so a quiet relay
+// doesn't churn it. Only the replica that leads the schema publishes.
+
+// statsFields are the names of what a stats event can include.
+var statsFields = []string{"members", "groups", "events_24h", "version"}
+
+// isStatsEvent reports whether event is the relay's own statistics event.
+func (instance *Instance) isStatsEvent(event nostr.Event) bool {
+	return event.Kind == nostr.KindApplicationSpecificData &&
+		event.PubKey == instance.Config.GetSelf() && event.Tags.GetD() == RELAY_STATS
+}
+
+// isStatsFilter reports whether filter asks for statistics events and
+// nothing else.
+func isStatsFilter(filter nostr.Filter) bool {
+	return len(filter.Kinds) == 1 && filter.Kinds[0] == nostr.KindApplicationSpecificData &&
+		len(filter.Tags) == 1 && len(filter.Tags["d"]) == 1 && filter.Tags["d"][0] == RELAY_STATS &&
+		len(filter.IDs) == 0 && filter.Search == ""
+}
+
+// collectRelayStats returns the fields stats.fields includes. current is the
+// stored stats event, if there is one.
+func (instance *Instance) collectRelayStats(current *nostr.Event) (map[string]any, error) {
+	stats := make(map[string]any)
+	for _, field := range instance.Config.GetStatsFields() {
+		switch field {
+		case "members":
+			stats[field] = len(instance.Management.GetMembers())
+		case "groups":
+			groups := 0
+			instance.Groups.metadataCache.Range(func(_, _ any) bool {
+				groups++
+				return true
+			})
+			stats[field] = groups
+		case "events_24h":
+			since := nostr.Now() - 24*60*60
+			count, err := instance.Events.CountEvents(nostr.Filter{Since: since})
+			if err != nil {
+				return nil, fmt.Errorf("counting events: %w", err)
+			}
+
+			// The last stats event doesn't count, or it would never match
+			if current != nil && current.CreatedAt >= since && count > 0 {
+				count--
+			}
+			stats[field] = count
+		case "version":
+			stats[field] = version
+		}
+	}
+
+	return stats, nil
+}
+
+// PublishStats publishes the relay's statistics event, unless the stored one
+// already says the same, and reports whether it did.
+func (instance *Instance) PublishStats() (bool, error) {
+	var current *nostr.Event
+	for event := range instance.Events.reservedBackend().query(nostr.Filter{
+		Kinds:   []nostr.Kind{nostr.KindApplicationSpecificData},
+		Authors: []nostr.PubKey{instance.Config.GetSelf()},
+		Tags:    nostr.TagMap{"d": []string{RELAY_STATS}},
+	}, 1, newestFirst) {
+		current = &event
+	}
+
+	stats, err := instance.collectRelayStats(current)
+	if err != nil {
+		return false, err
+	}
+
+	// Maps marshal with sorted keys, so equal stats give equal content
+	content, err := json.Marshal(stats)
+	if err != nil {
+		return false, err
+	}
+
+	event := nostr.Event{
+		Kind:      nostr.KindApplicationSpecificData,
+		CreatedAt: nostr.Now(),
+		Content:   string(content),
+		Tags:      nostr.Tags{{"d", RELAY_STATS}},
+	}
+
+	if current != nil && current.Content == event.Content {
+		return false, nil
+	}
+
+	if err := instance.Events.SignAndStoreEvent(&event, true); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (instance *Instance) startStatsPublisher(ctx context.Context) {
+	interval, err := ParseRetentionDuration(instance.Config.Stats.Interval)
+	if err != nil || interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if instance.Config.IsReadOnly() || !instance.leadsJobs(ctx) {
+					continue
+				}
+				if _, err := instance.PublishStats(); err != nil {
+					log.Printf("Failed to publish stats for %s: %v", instance.Config.Schema, err)
+				}
+			}
+		}
+	}()
+}
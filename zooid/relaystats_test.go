@@ -0,0 +1,76 @@
+package zooid
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestRelayStats_Publish(t *testing.T) {
+	instance := createTestInstance()
+	runTestAdmin(t, instance, "create-group", "news")
+
+	filter := nostr.Filter{Kinds: []nostr.Kind{nostr.KindApplicationSpecificData}, Tags: nostr.TagMap{"d": {RELAY_STATS}}}
+	latest := func() (nostr.Event, map[string]any) {
+		t.Helper()
+
+		// Anyone may read it, without authenticating
+		if reject, msg := instance.OnRequest(context.Background(), filter); reject {
+			t.Fatalf("unauthenticated request refused: %s", msg)
+		}
+		for event := range instance.QueryStored(context.Background(), filter) {
+			var stats map[string]any
+			if err := json.Unmarshal([]byte(event.Content), &stats); err != nil {
+				t.Fatal(err)
+			}
+			return event, stats
+		}
+		t.Fatal("no stats event")
+		return nostr.Event{}, nil
+	}
+
+	if published, err := instance.PublishStats(); err != nil || !published {
+		t.Fatalf("PublishStats = %v, %v", published, err)
+	}
+	first, stats := latest()
+	if stats["groups"] != 1.0 || stats["version"] != version {
+		t.Errorf("stats = %v", stats)
+	}
+
+	// Nothing changed, so nothing's written
+	if published, err := instance.PublishStats(); err != nil || published {
+		t.Errorf("PublishStats without changes = %v, %v", published, err)
+	}
+
+	secret := nostr.Generate()
+	instance.Management.AddMember(secret.Public())
+	note := signedBy(secret, nostr.Event{Kind: nostr.KindTextNote, Content: "hello"})
+	if err := instance.Events.SaveEvent(note); err != nil {
+		t.Fatal(err)
+	}
+
+	if published, err := instance.PublishStats(); err != nil || !published {
+		t.Fatalf("PublishStats after activity = %v, %v", published, err)
+	}
+	second, updated := latest()
+	if second.ID == first.ID || updated["members"] != stats["members"].(float64)+1 || updated["events_24h"].(float64) <= stats["events_24h"].(float64) {
+		t.Errorf("stats after activity = %v, before %v", updated, stats)
+	}
+
+	// Only the fields asked for are included
+	instance.Config.Stats.Fields = []string{"groups"}
+	instance.PublishStats()
+	if _, stats := latest(); len(stats) != 1 || stats["groups"] != 1.0 {
+		t.Errorf("stats with fields = [groups]: %v", stats)
+	}
+
+	// Nobody else may publish one
+	fake := signedBy(secret, nostr.Event{Kind: nostr.KindApplicationSpecificData, Tags: nostr.Tags{{"d", RELAY_STATS}}, Content: "{}"})
+	reject, msg := instance.OnEvent(authedContext(secret.Public()), fake)
+	if !reject {
+		t.Error("a member's stats event was accepted")
+	}
+	assertPrefix(t, "member's stats event", msg, RejectRestricted)
+}
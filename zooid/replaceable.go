@@ -0,0 +1,92 @@
+package zooid
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// Replaceable event churn.
+//
+// Every update to a replaceable or addressable event is a query, an insert
+// and a delete, so a client stuck republishing its profile many times a
+// second keeps the database busy for nothing. Once one version of an event
+// is accepted, further versions for the same pubkey, kind and d tag are
+// refused as rate-limited until policy.replace_interval, divided by the
+// rate_multiplier of the group the event is tagged with, has passed. Setting
+// it to "0" turns this off. The relay's own writes don't go through OnEvent,
+// so they're never held back, and neither are read markers: a client marks a
+// group read whenever it's looked at, and a refused marker would leave its
+// unread count stale.
+
+const defaultReplaceInterval = 2 * time.Second
+
+// replaceThrottle remembers when each replaceable event was last accepted.
+// The zero value is ready to use.
+type replaceThrottle struct {
+	mu        sync.Mutex
+	accepted  map[string]time.Time
+	lastSweep time.Time
+}
+
+// allow reports whether an update to the event at key may be accepted at
+// now, counting it as accepted if so.
+func (r *replaceThrottle) allow(key string, interval time.Duration, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Keys that are past the interval are no different from missing ones
+	if now.Sub(r.lastSweep) >= time.Minute {
+		for k, at := range r.accepted {
+			if now.Sub(at) >= interval {
+				delete(r.accepted, k)
+			}
+		}
+		r.lastSweep = now
+	}
+
+	if r.accepted == nil {
+		r.accepted = make(map[string]time.Time)
+	}
+
+	if at, ok := r.accepted[key]; ok && now.Sub(at) < interval {
+		return false
+	}
+	r.accepted[key] = now
+
+	return true
+}
+
+// replaceKey identifies the stored version an event would replace, or
+// returns false if it doesn't replace anything.
+func replaceKey(event nostr.Event) (string, bool) {
+	switch {
+	case event.Kind.IsReplaceable():
+		return fmt.Sprintf("%s:%d", event.PubKey.Hex(), event.Kind), true
+	case event.Kind.IsAddressable():
+		return fmt.Sprintf("%s:%d:%s", event.PubKey.Hex(), event.Kind, event.Tags.GetD()), true
+	}
+
+	return "", false
+}
+
+// checkReplaceInterval refuses an update to a replaceable event that comes
+// too soon after the last one.
+func (instance *Instance) checkReplaceInterval(event nostr.Event, now time.Time) string {
+	key, ok := replaceKey(event)
+	if !ok || isReadMarker(event) {
+		return ""
+	}
+
+	interval := time.Duration(float64(instance.Config.GetReplaceInterval()) / instance.Groups.RateMultiplier(event))
+	if interval <= 0 {
+		return ""
+	}
+	if !instance.replaced.allow(key, interval, now) {
+		return RejectRateLimited.Reason("replaceable event updated too frequently")
+	}
+
+	return ""
+}
@@ -0,0 +1,81 @@
+package zooid
+
+import (
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestReplaceThrottle(t *testing.T) {
+	var throttle replaceThrottle
+	now := time.Now()
+
+	if !throttle.allow("profile", 2*time.Second, now) {
+		t.Fatal("first update refused")
+	}
+	if throttle.allow("profile", 2*time.Second, now.Add(time.Second)) {
+		t.Error("update within the interval accepted")
+	}
+	if !throttle.allow("other", 2*time.Second, now.Add(time.Second)) {
+		t.Error("other events should be throttled separately")
+	}
+
+	// Refused updates don't push the window back
+	if !throttle.allow("profile", 2*time.Second, now.Add(2*time.Second)) {
+		t.Error("update after the interval refused")
+	}
+
+	throttle.allow("profile", 2*time.Second, now.Add(2*time.Minute))
+	if len(throttle.accepted) != 1 {
+		t.Errorf("%d keys after a sweep, want 1", len(throttle.accepted))
+	}
+}
+
+func TestCheckReplaceInterval(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+
+	author := nostr.Generate()
+	ctx := authedContext(author.Public())
+	publish := func(kind nostr.Kind, tags nostr.Tags) (bool, string) {
+		return instance.OnEvent(ctx, signedBy(author, nostr.Event{Kind: kind, Tags: tags}))
+	}
+
+	if reject, msg := publish(nostr.KindProfileMetadata, nil); reject {
+		t.Fatalf("profile refused: %s", msg)
+	}
+	reject, msg := publish(nostr.KindProfileMetadata, nil)
+	if !reject {
+		t.Fatal("profile republished straight away accepted")
+	}
+	assertPrefix(t, "profile churn", msg, RejectRateLimited)
+
+	// Addressable events are keyed by their d tag as well
+	for _, d := range []string{"one", "two"} {
+		if reject, msg := publish(nostr.KindArticle, nostr.Tags{{"d", d}}); reject {
+			t.Errorf("article %q refused: %s", d, msg)
+		}
+	}
+	if reject, _ := publish(nostr.KindArticle, nostr.Tags{{"d", "one"}}); !reject {
+		t.Error("article republished straight away accepted")
+	}
+
+	for range 2 {
+		if reject, msg := publish(nostr.KindTextNote, nil); reject {
+			t.Errorf("regular events aren't throttled, but one was refused: %s", msg)
+		}
+	}
+
+	if err := instance.checkReplaceInterval(signedBy(author, nostr.Event{Kind: nostr.KindProfileMetadata}), time.Now().Add(3*time.Second)); err != "" {
+		t.Errorf("profile refused after the interval: %s", err)
+	}
+
+	// "0" turns the limit off
+	instance.Config.Policy.ReplaceInterval = "0"
+	for range 2 {
+		if reject, msg := publish(nostr.KindProfileMetadata, nil); reject {
+			t.Errorf("profile refused with the limit off: %s", msg)
+		}
+	}
+}
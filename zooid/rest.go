@@ -0,0 +1,89 @@
+package zooid
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"fiatjaf.com/nostr"
+)
+
+// ServeEvent handles GET /e/{id} behind HTTPAuth, returning a single event as JSON so clients
+// can look events up without opening a websocket. Access follows the same
+// rules as QueryStored, except that public events don't need authentication
+// when the relay is open. Anything the caller may not see is a 404.
+func (instance *Instance) ServeEvent(w http.ResponseWriter, r *http.Request) {
+	id, err := nostr.IDFromHex(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid event id", http.StatusBadRequest)
+		return
+	}
+
+	pubkey, authed := GetHTTPAuthed(r.Context())
+
+	if !instance.Config.Policy.Open {
+		if !authed {
+			http.Error(w, RejectAuthRequired.Reason("authentication is required for access"), http.StatusUnauthorized)
+			return
+		}
+		if !instance.Management.IsMember(pubkey) {
+			http.Error(w, RejectRestricted.Reason("you are not a member of this relay"), http.StatusForbidden)
+			return
+		}
+	}
+
+	event, found := instance.lookupEvent(id)
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !instance.canReadAdminOnly(pubkey, event) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Read markers are private to their author
+	if isReadMarker(event) && (!authed || event.PubKey != pubkey) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if instance.Groups.IsGroupEvent(event) {
+		if !authed {
+			http.Error(w, RejectAuthRequired.Reason("authentication is required for group events"), http.StatusUnauthorized)
+			return
+		}
+		if !instance.Groups.CanRead(pubkey, event) {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	contentType := "application/json"
+	if strings.Contains(r.Header.Get("Accept"), "application/nostr+json") {
+		contentType = "application/nostr+json"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(instance.stripSignatureFor(pubkey, event))
+}
+
+// lookupEvent finds a stored event by id, skipping anything QueryStored would
+// never hand to a client.
+func (instance *Instance) lookupEvent(id nostr.ID) (nostr.Event, bool) {
+	if instance.Management.EventIsBanned(id) {
+		return nostr.Event{}, false
+	}
+
+	for event := range instance.Events.QueryEvents(nostr.Filter{IDs: []nostr.ID{id}}, 1) {
+		if instance.neverServed(event) {
+			return nostr.Event{}, false
+		}
+
+		return event, true
+	}
+
+	return nostr.Event{}, false
+}
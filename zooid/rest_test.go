@@ -0,0 +1,175 @@
+package zooid
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func newTestEventRequest(t *testing.T, id nostr.ID, secret *nostr.SecretKey) *http.Request {
+	t.Helper()
+
+	url := "https://test.com/e/" + id.Hex()
+	r := httptest.NewRequest(http.MethodGet, url, nil)
+	r.SetPathValue("id", id.Hex())
+
+	if secret != nil {
+		auth := nostr.Event{
+			Kind:      KindHTTPAuth,
+			CreatedAt: nostr.Now(),
+			Tags:      nostr.Tags{{"u", url}, {"method", "GET"}},
+		}
+		if err := auth.Sign(*secret); err != nil {
+			t.Fatalf("failed to sign auth event: %v", err)
+		}
+		authj, _ := json.Marshal(auth)
+		r.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(authj))
+	}
+
+	return r
+}
+
+func serveTestEventRequest(instance *Instance, w http.ResponseWriter, r *http.Request) {
+	HTTPAuth(http.HandlerFunc(instance.ServeEvent)).ServeHTTP(w, r)
+}
+
+func TestServeEvent_PublicNote(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+
+	note := createTestEvent(nostr.KindTextNote, "hello")
+	instance.Events.SaveEvent(note)
+
+	r := newTestEventRequest(t, note.ID, nil)
+	r.Header.Set("Accept", "application/nostr+json")
+	w := httptest.NewRecorder()
+	serveTestEventRequest(instance, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/nostr+json" {
+		t.Errorf("expected application/nostr+json, got %q", ct)
+	}
+
+	var got nostr.Event
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid body: %v", err)
+	}
+	if got.ID != note.ID || got.Content != "hello" {
+		t.Errorf("unexpected event %+v", got)
+	}
+
+	w = httptest.NewRecorder()
+	serveTestEventRequest(instance, w, newTestEventRequest(t, nostr.ID{1}, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing event, got %d", w.Code)
+	}
+}
+
+func TestServeEvent_ClosedRelayRequiresAuth(t *testing.T) {
+	instance := createTestInstance()
+
+	note := createTestEvent(nostr.KindTextNote, "hello")
+	instance.Events.SaveEvent(note)
+
+	w := httptest.NewRecorder()
+	serveTestEventRequest(instance, w, newTestEventRequest(t, note.ID, nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without auth on a closed relay, got %d", w.Code)
+	}
+
+	outsiderSecret := nostr.Generate()
+	w = httptest.NewRecorder()
+	serveTestEventRequest(instance, w, newTestEventRequest(t, note.ID, &outsiderSecret))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a non-member, got %d", w.Code)
+	}
+
+	memberSecret := nostr.Generate()
+	instance.Management.AddMember(memberSecret.Public())
+	w = httptest.NewRecorder()
+	serveTestEventRequest(instance, w, newTestEventRequest(t, note.ID, &memberSecret))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 for a member, got %d", w.Code)
+	}
+}
+
+func TestServeEvent_PrivateGroupMessage(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+
+	instance.Groups.UpdateMetadata(nostr.Event{
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", "secret"}},
+		Content:   `{"name":"Secret","private":true}`,
+	})
+
+	memberSecret := nostr.Generate()
+	instance.Groups.AddMember("secret", memberSecret.Public())
+	outsiderSecret := nostr.Generate()
+
+	message := nostr.Event{Kind: nostr.Kind(9), CreatedAt: nostr.Now(), Content: "psst", Tags: nostr.Tags{{"h", "secret"}}}
+	message.Sign(memberSecret)
+	instance.Events.SaveEvent(message)
+
+	tests := []struct {
+		name   string
+		secret *nostr.SecretKey
+		want   int
+	}{
+		{"no auth", nil, http.StatusUnauthorized},
+		{"outsider", &outsiderSecret, http.StatusNotFound},
+		{"member", &memberSecret, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			serveTestEventRequest(instance, w, newTestEventRequest(t, message.ID, tt.secret))
+			if w.Code != tt.want {
+				t.Errorf("expected %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServeEvent_BannedEvent(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+
+	note := createTestEvent(nostr.KindTextNote, "spam")
+	instance.Events.SaveEvent(note)
+	if err := instance.Management.BanEvent(note.ID, "spam"); err != nil {
+		t.Fatalf("BanEvent: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	serveTestEventRequest(instance, w, newTestEventRequest(t, note.ID, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a banned event, got %d", w.Code)
+	}
+}
+
+func TestServeEvent_WrongAuthURL(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+
+	note := createTestEvent(nostr.KindTextNote, "hello")
+	instance.Events.SaveEvent(note)
+
+	// Auth bound to a different event's URL must not be accepted.
+	r := newTestEventRequest(t, nostr.ID{2}, &instance.Config.secret)
+	r.SetPathValue("id", note.ID.Hex())
+	r.URL.Path = "/e/" + note.ID.Hex()
+
+	w := httptest.NewRecorder()
+	serveTestEventRequest(instance, w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for auth bound to another URL, got %d", w.Code)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"sync"
 	"time"
 
+	"fiatjaf.com/nostr"
 	"github.com/Masterminds/squirrel"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -34,9 +35,10 @@ func init() {
 
 // StartRetentionCleaner launches a background goroutine that periodically
 // deletes expired chat messages (kinds 9, 10) based on per-group retention
-// policies defined in the TOML config. ctx is the service root context;
-// when it cancels (SIGTERM), the cleaner exits and any in-flight DELETE
-// aborts via the per-batch derived context.
+// policies defined in the TOML config, gift wraps older than dms.max_age and
+// events soft-deleted more than storage.soft_delete_window ago. ctx is the
+// service root context; when it cancels (SIGTERM), the cleaner exits and any
+// in-flight DELETE aborts via the per-batch derived context.
 func StartRetentionCleaner(ctx context.Context) {
 	go func() {
 		cleanExpiredMessages(ctx)
@@ -63,10 +65,20 @@ func cleanExpiredMessages(ctx context.Context) {
 	retentionMu.Lock()
 	defer retentionMu.Unlock()
 
-	instances := GetAllInstances()
+	instances := leadingInstances(ctx)
 
 	currentInstances := make(map[string]struct{}, len(instances))
 	for _, inst := range instances {
+		if cutoff := inst.Config.dmSince(time.Now()); cutoff > 0 {
+			if deleted := deleteExpiredGiftWraps(ctx, inst, int64(cutoff)); deleted > 0 {
+				log.Printf("retention: deleted %d gift wraps (instance %s)", deleted, inst.Config.Schema)
+			}
+		}
+
+		if purged := purgeDeletedEvents(ctx, inst); purged > 0 {
+			log.Printf("retention: purged %d deleted events (instance %s)", purged, inst.Config.Schema)
+		}
+
 		if !inst.Config.Groups.Enabled || !inst.Config.HasRetention() {
 			continue
 		}
@@ -79,7 +91,7 @@ func cleanExpiredMessages(ctx context.Context) {
 
 		inst.Groups.metadataCache.Range(func(key, _ any) bool {
 			groupID := key.(string)
-			retention := inst.Config.GetRetention(groupID)
+			retention := inst.Groups.GroupPolicy(groupID).Retention
 			if retention <= 0 {
 				return true
 			}
@@ -110,11 +122,17 @@ func cleanExpiredMessages(ctx context.Context) {
 	activeRetentionInstances = currentInstances
 }
 
-// deleteOneRetentionBatch runs one bounded DELETE batch. Pulled out so the
-// per-iteration ctx can use `defer cancel()` and survive any future early
-// returns added inside the batch logic. ctx is the service root passed
-// down from the cleaner — derives a per-batch dbOpTimeout from it.
+// deleteOneRetentionBatch runs one bounded DELETE batch of a group's expired
+// messages.
 func deleteOneRetentionBatch(ctx context.Context, inst *Instance, groupID string, cutoff int64) (rowsAffected int64, more bool, err error) {
+	if usesMemory() {
+		return deleteMatchingBatch(ctx, inst, nostr.Filter{
+			Kinds: []nostr.Kind{9, 10},
+			Tags:  nostr.TagMap{"h": {groupID}},
+			Until: Until(nostr.Timestamp(cutoff - 1)),
+		})
+	}
+
 	eventsTable := inst.Events.Schema.Prefix("events")
 	tagsTable := inst.Events.Schema.Prefix("event_tags")
 
@@ -127,6 +145,17 @@ func deleteOneRetentionBatch(ctx context.Context, inst *Instance, groupID string
 		Where(squirrel.Lt{"e.created_at": cutoff}).
 		Limit(retentionDeleteBatchSize)
 
+	return deleteRetentionBatch(ctx, inst, subquery)
+}
+
+// deleteRetentionBatch deletes the events whose ids subquery selects, which
+// should select at most retentionDeleteBatchSize. Pulled out so the
+// per-iteration ctx can use `defer cancel()` and survive any future early
+// returns added inside the batch logic. ctx is the service root passed
+// down from the cleaner — derives a per-batch dbOpTimeout from it.
+func deleteRetentionBatch(ctx context.Context, inst *Instance, subquery squirrel.SelectBuilder) (rowsAffected int64, more bool, err error) {
+	eventsTable := inst.Events.Schema.Prefix("events")
+
 	subSQL, subArgs, err := subquery.ToSql()
 	if err != nil {
 		return 0, false, fmt.Errorf("build subquery: %w", err)
@@ -166,3 +195,37 @@ func deleteExpiredGroupMessages(ctx context.Context, inst *Instance, groupID str
 	}
 	return totalDeleted
 }
+
+func deleteExpiredGiftWraps(ctx context.Context, inst *Instance, cutoff int64) int64 {
+	subquery := sb.Select("id").
+		From(inst.Events.Schema.Prefix("events")).
+		Where(squirrel.Eq{"kind": int(nostr.KindGiftWrap)}).
+		Where(squirrel.Lt{"created_at": cutoff}).
+		Limit(retentionDeleteBatchSize)
+
+	batch := func() (int64, bool, error) {
+		return deleteRetentionBatch(ctx, inst, subquery)
+	}
+	if usesMemory() {
+		batch = func() (int64, bool, error) {
+			return deleteMatchingBatch(ctx, inst, nostr.Filter{
+				Kinds: []nostr.Kind{nostr.KindGiftWrap},
+				Until: Until(nostr.Timestamp(cutoff - 1)),
+			})
+		}
+	}
+
+	var totalDeleted int64
+	for {
+		rows, more, err := batch()
+		if err != nil {
+			log.Printf("retention: %s for gift wraps", err)
+			return totalDeleted
+		}
+		totalDeleted += rows
+		if !more {
+			break
+		}
+	}
+	return totalDeleted
+}
@@ -0,0 +1,148 @@
+package zooid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"fiatjaf.com/nostr"
+)
+
+// Key rotation.
+//
+// Everything the relay publishes (membership and ban lists, group metadata,
+// admin and member lists, moderation events) is signed with the relay secret
+// and found again by its pubkey, so replacing a leaked secret means moving all
+// of those events to the new key. RotateKey re-signs them page by page, each
+// copy stored before its original is deleted, and only then writes the new
+// secret to the config. An interrupted rotation can simply be run again: the
+// config still holds the old key, and only the events not yet moved are
+// found under it.
+//
+// Re-signing changes event ids, so events that refer to a relay-signed event
+// by id (e.g. a deletion) keep pointing at the old one.
+
+// rotateKeyBatch is how many events RotateKey re-signs per query.
+const rotateKeyBatch = 500
+
+// RotateKey re-signs every event authored by the relay with newSecret,
+// switches the config over to it and republishes the lists that name the
+// relay's own pubkey. A relay process sharing the config picks the new key up
+// when it reloads the file.
+func (instance *Instance) RotateKey(newSecret nostr.SecretKey) error {
+	config := instance.Config
+	if config.IsReadOnly() {
+		return ErrReadOnly
+	}
+
+	oldSecret := config.secret
+	oldSelf, newSelf := config.GetSelf(), newSecret.Public()
+	if oldSelf == newSelf {
+		return errors.New("the new key is the current key")
+	}
+
+	resigned, err := instance.Events.resignEvents(oldSelf, newSecret)
+	if err != nil {
+		return fmt.Errorf("re-signing events: %w", err)
+	}
+
+	config.secret = newSecret
+	if err := config.Save(); err != nil {
+		config.secret = oldSecret
+		return fmt.Errorf("re-signed %d events but couldn't save the new key, run the rotation again: %w", resigned, err)
+	}
+
+	// The cached lists and metadata are copies of the events just replaced
+	instance.Management.clearCaches()
+	instance.Groups.clearCaches()
+	instance.warmCaches(func(ctx context.Context) error {
+		return errors.Join(instance.Management.WarmCaches(ctx), instance.Groups.WarmCaches(ctx))
+	})
+
+	if err := instance.Management.AllowPubkey(newSelf); err != nil {
+		return fmt.Errorf("adding the new key to the relay members: %w", err)
+	}
+	if !config.IsOwner(oldSelf) && len(config.GetAssignedRoles(oldSelf)) == 0 {
+		if err := instance.Management.RemoveMember(oldSelf); err != nil {
+			return fmt.Errorf("removing the old key from the relay members: %w", err)
+		}
+	}
+
+	if config.Groups.Enabled {
+		groups := []string{"_"}
+		instance.Groups.metadataCache.Range(func(key, value any) bool {
+			if value.(*groupMetaCache).found {
+				groups = append(groups, key.(string))
+			}
+			return true
+		})
+
+		for _, h := range groups {
+			if err := instance.Groups.UpdateAdminsList(h); err != nil {
+				return fmt.Errorf("republishing the admin list of %s: %w", h, err)
+			}
+		}
+	}
+
+	if err := instance.SaveCacheSnapshots(instance.Ctx); err != nil {
+		log.Printf("Failed to save cache snapshots after key rotation: %v", err)
+	}
+
+	log.Printf("AUDIT: rotated the relay key of %s from %s to %s, re-signing %d events", instance.Events.Schema.Name, oldSelf.Hex(), newSelf.Hex(), resigned)
+
+	return nil
+}
+
+// resignEvents moves every event authored by from to the key secret, keeping
+// content, tags and timestamps, and returns how many it moved. Each copy is
+// stored before the original is deleted, so nothing is lost if it stops
+// halfway.
+func (events *EventStore) resignEvents(from nostr.PubKey, secret nostr.SecretKey) (int, error) {
+	filter := nostr.Filter{Authors: []nostr.PubKey{from}}
+
+	total := 0
+	for {
+		var batch []nostr.Event
+		for event := range events.QueryEvents(filter, rotateKeyBatch) {
+			batch = append(batch, event)
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, original := range batch {
+			event := nostr.Event{
+				Kind:      original.Kind,
+				CreatedAt: original.CreatedAt,
+				Tags:      original.Tags,
+				Content:   original.Content,
+			}
+			if err := event.Sign(secret); err != nil {
+				return total, err
+			}
+
+			// Just signed, so there's nothing to verify
+			if err := events.storeEvent(event); err != nil {
+				return total, fmt.Errorf("storing %s: %w", original.ID, err)
+			}
+			if err := events.DeleteEvent(original.ID); err != nil {
+				return total, fmt.Errorf("deleting %s: %w", original.ID, err)
+			}
+
+			total++
+		}
+	}
+
+	// QueryEvents ends quietly on a failed query or skips rows it can't
+	// read, so make sure nothing was left behind before the key is switched
+	left, err := events.CountEvents(filter)
+	if err != nil {
+		return total, err
+	}
+	if left > 0 {
+		return total, fmt.Errorf("%d events by %s could not be read", left, from.Hex())
+	}
+
+	return total, nil
+}
@@ -0,0 +1,94 @@
+package zooid
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestRotateKey(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.path = filepath.Join(t.TempDir(), "relay.toml")
+
+	// A relay key of its own, rather than the owner's, which the lists
+	// created along with the instance move to
+	owner := instance.Config.GetSelf()
+	instance.Config.secret = nostr.Generate()
+	oldSelf := instance.Config.GetSelf()
+	if _, err := instance.Events.resignEvents(owner, instance.Config.secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := instance.Management.AllowPubkey(oldSelf); err != nil {
+		t.Fatal(err)
+	}
+
+	spammer := nostr.Generate().Public()
+	if err := instance.Management.BanPubkey(spammer, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	runTestAdmin(t, instance, "create-group", "rotated", "--name", "Rotated")
+	if err := instance.Groups.UpdateAdminsList("_"); err != nil {
+		t.Fatal(err)
+	}
+
+	newSecret := nostr.Generate()
+	newSelf := newSecret.Public()
+	admin := &Admin{Instance: instance, In: strings.NewReader(newSecret.Hex() + "\n"), Out: &bytes.Buffer{}}
+	if err := admin.Run([]string{"rotate-key"}); err != nil {
+		t.Fatalf("rotate-key failed: %v", err)
+	}
+
+	if !instance.Config.IsSelf(newSelf) {
+		t.Fatal("the config should use the new key")
+	}
+	saved, err := os.ReadFile(instance.Config.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(saved), newSecret.Hex()) {
+		t.Error("the new secret should be saved to the config file")
+	}
+
+	if n, err := instance.Events.CountEvents(nostr.Filter{Authors: []nostr.PubKey{oldSelf}}); err != nil || n != 0 {
+		t.Errorf("%d events (%v) are still signed by the old key", n, err)
+	}
+
+	bans := instance.Events.GetOrCreateApplicationSpecificData(BANNED_PUBKEYS)
+	if bans.PubKey != newSelf || !bans.VerifySignature() {
+		t.Errorf("banned pubkeys list is signed by %s", bans.PubKey.Hex())
+	}
+	if bans.Tags.FindWithValue("banned", spammer.Hex()) == nil || !instance.Management.PubkeyIsBanned(spammer) {
+		t.Error("the ban should survive the rotation")
+	}
+
+	metadata, found := instance.Groups.GetMetadata("rotated")
+	if !found {
+		t.Fatal("group metadata missing after rotation")
+	}
+	if metadata.PubKey != newSelf || !metadata.VerifySignature() {
+		t.Errorf("group metadata is signed by %s", metadata.PubKey.Hex())
+	}
+
+	if !instance.Management.IsMember(newSelf) || instance.Management.IsMember(oldSelf) {
+		t.Error("the new key should replace the old one as a relay member")
+	}
+
+	var admins nostr.Event
+	for event := range instance.Events.QueryEvents(nostr.Filter{
+		Kinds: []nostr.Kind{nostr.KindSimpleGroupAdmins},
+		Tags:  nostr.TagMap{"d": []string{"_"}},
+	}, 0) {
+		admins = event
+	}
+	if admins.Tags.FindWithValue("p", newSelf.Hex()) == nil || admins.Tags.FindWithValue("p", oldSelf.Hex()) != nil {
+		t.Errorf("relay admin list = %v", admins.Tags)
+	}
+
+	if err := instance.RotateKey(newSecret); err == nil {
+		t.Error("rotating to the current key should fail")
+	}
+}
@@ -2,24 +2,170 @@ package zooid
 
 import (
 	"bytes"
+	"fmt"
 	"log"
+	"regexp"
+	"strings"
+	"sync"
 	"text/template"
+
+	"github.com/gosimple/slug"
+	"github.com/jackc/pgx/v5"
 )
 
+// Schema names the tables of one instance. By default they're all called
+// <name>__<table>, side by side with every other instance's in the
+// database's default schema. With storage.native_schema they're in a
+// Postgres schema called <name> instead, under their own names, so a tenant
+// can be dumped, restored or dropped with the usual Postgres tools. Every
+// statement that touches them is built by Render or Prefix, so the name is
+// checked before it goes anywhere near SQL, and identifiers are written
+// quoted and, in a native schema, qualified.
+
+// schemaNamePattern is what a schema name may look like. Names are never
+// longer than 41 bytes, leaving room under Postgres' 63 byte identifier
+// limit for the longest index name.
+var schemaNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,40}$`)
+
 type Schema struct {
 	Name string
+
+	// Native keeps the tables in a Postgres schema called Name rather than
+	// prefixing their names with it.
+	Native bool
+}
+
+// SchemaName returns the schema name a config's schema setting stands for:
+// its slug, with underscores for hyphens.
+func SchemaName(schema string) string {
+	return strings.ReplaceAll(slug.Make(schema), "-", "_")
 }
 
+// NewSchema returns the schema called name, or an error if name isn't a
+// valid schema name.
+func NewSchema(name string, native bool) (*Schema, error) {
+	if !schemaNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid schema name %q (a lowercase letter, then up to 40 lowercase letters, digits and underscores)", name)
+	}
+	if native && strings.HasPrefix(name, "pg_") {
+		return nil, fmt.Errorf("invalid schema name %q (Postgres reserves names starting with pg_)", name)
+	}
+
+	return &Schema{Name: name, Native: native}, nil
+}
+
+// Render executes the template t, in which {{.Prefix "table"}},
+// {{.Index "idx"}}, {{.Function "f"}} and {{.Trigger "t"}} stand for the
+// schema's quoted identifiers.
 func (s *Schema) Render(t string) string {
+	if !schemaNamePattern.MatchString(s.Name) {
+		log.Fatalf("Refusing to render SQL for invalid schema name %q", s.Name)
+	}
+
 	var buf bytes.Buffer
 	err := template.Must(template.New("schema").Parse(t)).Execute(&buf, s)
 	if err != nil {
-		log.Fatal("Failed to create template: %w", err)
+		log.Fatalf("Failed to render template: %v", err)
 	}
 
 	return buf.String()
 }
 
+// Prefix returns the quoted identifier of the schema's table or index t.
 func (s *Schema) Prefix(t string) string {
-	return s.Render("{{.Name}}__" + t)
+	if s.Native {
+		return pgx.Identifier{s.Name, t}.Sanitize()
+	}
+
+	return pgx.Identifier{s.Name + "__" + t}.Sanitize()
+}
+
+// Index returns the quoted name to give the schema's index idx in CREATE
+// INDEX, which puts an index next to its table and takes no schema.
+func (s *Schema) Index(idx string) string {
+	return pgx.Identifier{s.RelName(idx)}.Sanitize()
+}
+
+// Function returns the quoted identifier of the schema's function f.
+func (s *Schema) Function(f string) string {
+	if s.Native {
+		return pgx.Identifier{s.Name, f}.Sanitize()
+	}
+
+	return pgx.Identifier{s.Name + "_" + f}.Sanitize()
+}
+
+// Trigger returns the quoted name of the schema's trigger t. Triggers belong
+// to their table and take no schema.
+func (s *Schema) Trigger(t string) string {
+	if s.Native {
+		return pgx.Identifier{t}.Sanitize()
+	}
+
+	return pgx.Identifier{s.Name + "_" + t}.Sanitize()
+}
+
+// RelName returns the unquoted name of the schema's table or index t, as
+// EXPLAIN and the system catalogs show it.
+func (s *Schema) RelName(t string) string {
+	if s.Native {
+		return t
+	}
+
+	return s.Name + "__" + t
+}
+
+// Schema claims.
+//
+// Two configs with the same schema share its tables. For two different
+// hosts that's almost always a copied config whose schema wasn't changed,
+// and it mixes their events, members and bans, so an instance isn't loaded
+// while an instance for another host has its schema, unless both configs set
+// allow_shared_schema.
+
+type schemaClaim struct {
+	host   string
+	shared bool
+}
+
+var (
+	schemaClaimsMu sync.Mutex
+	schemaClaims   = make(map[string]map[string]schemaClaim) // schema -> config path -> claim
+)
+
+// claimSchema records that config's instance uses schema, or returns an
+// error if an instance for another host uses it already and the two configs
+// don't both allow sharing it.
+func claimSchema(config *Config, schema string) error {
+	schemaClaimsMu.Lock()
+	defer schemaClaimsMu.Unlock()
+
+	claims := schemaClaims[schema]
+	for path, claim := range claims {
+		if path == config.path || claim.host == config.Host {
+			continue
+		}
+		if !claim.shared || !config.AllowSharedSchema {
+			return fmt.Errorf("schema %q is already used by %s for host %s (set allow_shared_schema in both configs to share it)", schema, path, claim.host)
+		}
+	}
+
+	if claims == nil {
+		claims = make(map[string]schemaClaim)
+		schemaClaims[schema] = claims
+	}
+	claims[config.path] = schemaClaim{host: config.Host, shared: config.AllowSharedSchema}
+
+	return nil
+}
+
+// releaseSchema forgets config's claim on schema.
+func releaseSchema(config *Config, schema string) {
+	schemaClaimsMu.Lock()
+	defer schemaClaimsMu.Unlock()
+
+	delete(schemaClaims[schema], config.path)
+	if len(schemaClaims[schema]) == 0 {
+		delete(schemaClaims, schema)
+	}
 }
@@ -1,25 +1,132 @@
 package zooid
 
 import (
+	"strings"
 	"testing"
 )
 
 func TestSchema_Render(t *testing.T) {
 	schema := Schema{Name: "test_db"}
-	result := schema.Render("CREATE TABLE {{.Name}}_events")
-	expected := "CREATE TABLE test_db_events"
+	template := `CREATE INDEX {{.Index "idx"}} ON {{.Prefix "events"}}; CREATE TRIGGER {{.Trigger "update"}} EXECUTE FUNCTION {{.Function "update"}}()`
 
+	result := schema.Render(template)
+	expected := `CREATE INDEX "test_db__idx" ON "test_db__events"; CREATE TRIGGER "test_db_update" EXECUTE FUNCTION "test_db_update"()`
 	if result != expected {
 		t.Errorf("Schema.Render() = %q, expected %q", result, expected)
 	}
+
+	native := Schema{Name: "test_db", Native: true}
+	result = native.Render(template)
+	expected = `CREATE INDEX "idx" ON "test_db"."events"; CREATE TRIGGER "update" EXECUTE FUNCTION "test_db"."update"()`
+	if result != expected {
+		t.Errorf("native Schema.Render() = %q, expected %q", result, expected)
+	}
 }
 
 func TestSchema_Prefix(t *testing.T) {
 	schema := Schema{Name: "test_db"}
 	result := schema.Prefix("events")
-	expected := "test_db__events"
+	expected := `"test_db__events"`
 
 	if result != expected {
 		t.Errorf("Schema.Prefix() = %q, expected %q", result, expected)
 	}
+
+	if name := schema.RelName("events"); name != "test_db__events" {
+		t.Errorf("Schema.RelName() = %q, expected %q", name, "test_db__events")
+	}
+
+	native := Schema{Name: "test_db", Native: true}
+	if result := native.Prefix("events"); result != `"test_db"."events"` {
+		t.Errorf("native Schema.Prefix() = %q", result)
+	}
+	if name := native.RelName("events"); name != "events" {
+		t.Errorf("native Schema.RelName() = %q", name)
+	}
+}
+
+func TestSchemaName(t *testing.T) {
+	tests := []struct {
+		schema string
+		want   string
+		valid  bool
+	}{
+		{"relay", "relay", true},
+		{"My Relay", "my_relay", true},
+		{"relay-2", "relay_2", true},
+		{"a; DROP TABLE kv", "a_drop_table_kv", true},
+		{`x"; --`, "x", true},
+		{"1relay", "1relay", false},
+		{"_relay", "relay", true},
+		{strings.Repeat("r", 41), strings.Repeat("r", 41), true},
+		{strings.Repeat("r", 42), strings.Repeat("r", 42), false},
+	}
+
+	for _, tt := range tests {
+		name := SchemaName(tt.schema)
+		if name != tt.want {
+			t.Errorf("SchemaName(%q) = %q, want %q", tt.schema, name, tt.want)
+		}
+
+		_, err := NewSchema(name, false)
+		if (err == nil) != tt.valid {
+			t.Errorf("NewSchema(%q) = %v, want valid %v", name, err, tt.valid)
+		}
+	}
+
+	if _, err := NewSchema("pg_relay", false); err != nil {
+		t.Errorf("NewSchema(pg_relay) = %v, want a prefixed schema", err)
+	}
+	if _, err := NewSchema("pg_relay", true); err == nil {
+		t.Error("NewSchema(pg_relay) made a native schema Postgres would refuse")
+	}
+}
+
+func TestClaimSchema(t *testing.T) {
+	config := func(path, host string, shared bool) *Config {
+		c := &Config{Host: host, AllowSharedSchema: shared}
+		c.path = path
+		return c
+	}
+
+	schema := testSchemaName("test_claim_")
+	first := config("first.toml", "first.example.com", false)
+	if err := claimSchema(first, schema); err != nil {
+		t.Fatalf("first claim: %v", err)
+	}
+
+	// Reloading the same file, or another file for the same host, is fine
+	if err := claimSchema(first, schema); err != nil {
+		t.Errorf("reclaim: %v", err)
+	}
+	if err := claimSchema(config("alias.toml", "first.example.com", false), schema); err != nil {
+		t.Errorf("same host: %v", err)
+	}
+
+	// Another host is refused unless both configs allow sharing
+	if err := claimSchema(config("second.toml", "second.example.com", true), schema); err == nil || !strings.Contains(err.Error(), "first.example.com") {
+		t.Errorf("another host: %v, want an error naming first.example.com", err)
+	}
+
+	releaseSchema(first, schema)
+	releaseSchema(config("alias.toml", "first.example.com", false), schema)
+
+	shared := config("first.toml", "first.example.com", true)
+	if err := claimSchema(shared, schema); err != nil {
+		t.Fatalf("shared claim: %v", err)
+	}
+	if err := claimSchema(config("second.toml", "second.example.com", false), schema); err == nil {
+		t.Error("sharing allowed by only one config")
+	}
+	if err := claimSchema(config("second.toml", "second.example.com", true), schema); err != nil {
+		t.Errorf("sharing allowed by both: %v", err)
+	}
+
+	// Once released, the schema is free for anyone
+	releaseSchema(shared, schema)
+	releaseSchema(config("second.toml", "second.example.com", true), schema)
+	if err := claimSchema(config("third.toml", "third.example.com", false), schema); err != nil {
+		t.Errorf("after release: %v", err)
+	}
+	releaseSchema(config("third.toml", "third.example.com", false), schema)
 }
@@ -0,0 +1,199 @@
+package zooid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// searchVectorVersion identifies how the search trigger builds search_vector.
+// Bump it whenever the trigger changes so rows indexed the old way get
+// rebuilt.
+const searchVectorVersion = 2
+
+const searchRebuildBatchSize = 1000
+
+// searchFingerprint describes the current search_vector definition. Rows are
+// rebuilt whenever the fingerprint recorded for the schema differs, e.g.
+// after search_language changes.
+func (events *EventStore) searchFingerprint() string {
+	fingerprint := fmt.Sprintf("v%d:%s", searchVectorVersion, events.Config.GetSearchLanguage())
+	if events.searchUnaccent {
+		fingerprint += ":unaccent"
+	}
+
+	return fingerprint
+}
+
+// searchDocument returns the SQL turning the text expression expr into a
+// tsvector. The language is validated by Config.Validate before it gets here.
+func (events *EventStore) searchDocument(expr string) string {
+	if events.searchUnaccent {
+		expr = "unaccent(" + expr + ")"
+	}
+
+	return fmt.Sprintf("to_tsvector('%s', %s)", events.Config.GetSearchLanguage(), expr)
+}
+
+// searchVector returns the SQL for an event's search_vector, given SQL
+// expressions for its content and its tags as JSON. Content carries full
+// weight; a few descriptive tag values are indexed at lower weight so
+// tag-only matches are found.
+func (events *EventStore) searchVector(content, tags string) string {
+	return `setweight(` + events.searchDocument(`COALESCE(`+content+`, '')`) + `, 'A') ||
+		setweight(` + events.searchDocument(`COALESCE((
+			SELECT string_agg(tag->>1, ' ')
+			FROM jsonb_array_elements((`+tags+`)::jsonb) AS tag
+			WHERE tag->>0 IN ('t', 'title', 'summary', 'subject')
+		), '')`) + `, 'C')`
+}
+
+// searchQuery returns the SQL matching search_vector against a user query.
+// It takes two placeholders: the language, then the query text.
+// websearch_to_tsquery understands "quoted phrases", -exclusions and OR, and
+// never errors on malformed input.
+func (events *EventStore) searchQuery() string {
+	if events.searchUnaccent {
+		return "websearch_to_tsquery(?::regconfig, unaccent(?))"
+	}
+
+	return "websearch_to_tsquery(?::regconfig, ?)"
+}
+
+// detectUnaccent enables the unaccent extension if possible and reports
+// whether it's available. Creating an extension needs elevated privileges,
+// so failure just means search stays accent-sensitive.
+func detectUnaccent(ctx context.Context) bool {
+	subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
+	defer cancel()
+
+	if _, err := GetDb().ExecContext(subctx, `CREATE EXTENSION IF NOT EXISTS unaccent`); err != nil {
+		log.Printf("unaccent extension unavailable, search will be accent-sensitive: %v", err)
+	}
+
+	var available bool
+	err := GetDb().QueryRowContext(subctx, `SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'unaccent')`).Scan(&available)
+
+	return err == nil && available
+}
+
+func (events *EventStore) searchKey(suffix string) string {
+	return fmt.Sprintf("fts:%s:%s", events.Schema.Name, suffix)
+}
+
+// scheduleSearchRebuild starts a background rebuild of search_vector if the
+// rows were indexed under a different fingerprint. Searches keep working
+// during the rebuild; not-yet-rebuilt rows simply match the old way.
+func (events *EventStore) scheduleSearchRebuild() error {
+	kv := GetKeyValueStore(events.rootCtx)
+	fingerprint := events.searchFingerprint()
+
+	current, err := kv.Get(events.rootCtx, events.searchKey("fingerprint"))
+	if err == nil && current == fingerprint {
+		return nil
+	}
+	if err != nil && !errors.Is(err, ErrKVNotFound) {
+		return fmt.Errorf("checking search index state: %w", err)
+	}
+
+	go func() {
+		if err := events.rebuildSearchVectors(events.rootCtx, fingerprint); err != nil {
+			log.Printf("Failed to rebuild search index for schema %s: %v", events.Schema.Name, err)
+		}
+	}()
+
+	return nil
+}
+
+// rebuildSearchVectors re-runs the search trigger over every event in id
+// order, one batch per statement so no long transaction holds row locks. The
+// cursor is saved after each batch, so a restart resumes where it left off.
+func (events *EventStore) rebuildSearchVectors(ctx context.Context, fingerprint string) error {
+	kv := GetKeyValueStore(ctx)
+	cursorKey := events.searchKey("cursor:" + fingerprint)
+
+	cursor, err := kv.Get(ctx, cursorKey)
+	if err != nil && !errors.Is(err, ErrKVNotFound) {
+		return err
+	}
+
+	stmt := events.Schema.Render(`
+		WITH batch AS (
+			SELECT id FROM {{.Prefix "events"}} WHERE id > $1 ORDER BY id LIMIT $2
+		)
+		UPDATE {{.Prefix "events"}} e SET search_vector = NULL
+		FROM batch WHERE e.id = batch.id
+		RETURNING e.id, e.compressed`)
+
+	var total int
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		last, n, err := events.rebuildSearchBatch(ctx, stmt, cursor)
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			break
+		}
+
+		total += n
+		cursor = last
+		if err := kv.Set(ctx, cursorKey, cursor); err != nil {
+			return err
+		}
+	}
+
+	if err := kv.Set(ctx, events.searchKey("fingerprint"), fingerprint); err != nil {
+		return err
+	}
+	if err := kv.Delete(ctx, cursorKey); err != nil {
+		return err
+	}
+
+	if total > 0 {
+		log.Printf("Rebuilt search index for %d events in schema %s", total, events.Schema.Name)
+	}
+
+	return nil
+}
+
+// rebuildSearchBatch touches the next batch after cursor (the BEFORE UPDATE
+// trigger recomputes search_vector, and compressed rows are indexed here)
+// and returns the largest id updated.
+func (events *EventStore) rebuildSearchBatch(ctx context.Context, stmt string, cursor string) (string, int, error) {
+	subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
+	defer cancel()
+
+	rows, err := GetDb().QueryContext(subctx, stmt, cursor, searchRebuildBatchSize)
+	if err != nil {
+		return "", 0, fmt.Errorf("search rebuild batch: %w", err)
+	}
+	defer rows.Close()
+
+	var last string
+	var n int
+	var compressed []string
+	for rows.Next() {
+		var id string
+		var isCompressed bool
+		if err := rows.Scan(&id, &isCompressed); err != nil {
+			return "", 0, err
+		}
+		last = max(last, id)
+		n++
+		if isCompressed {
+			compressed = append(compressed, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", 0, err
+	}
+	rows.Close()
+
+	return last, n, events.indexCompressed(subctx, compressed)
+}
@@ -0,0 +1,430 @@
+package zooid
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Per-connection send queues.
+//
+// khatru writes to a websocket synchronously, with no deadline, while
+// holding that connection's write lock. A client that stops reading would
+// block every write to it, including broadcasts, with the relay buffering
+// whatever it was about to send. So the connection khatru gets is wrapped:
+// writes go into a queue of at most limits.send_queue_bytes, drained by a
+// goroutine that gives each write limits.write_timeout. A connection whose
+// queue overflows is sent a NOTICE and a close frame once the message being
+// written is complete, and is dropped; one whose writes time out is dropped
+// straight away. Either way it's counted in zooid_slow_consumers_total.
+//
+// The connection khatru is handed is kept on the request's context, so
+// closeConnection can later close it the same way, see connections.go.
+
+const (
+	defaultMaxMessageSize = 512000
+	defaultMaxResults     = 1000
+	defaultSendQueueBytes = 4 << 20
+	defaultWriteTimeout   = 10 * time.Second
+
+	// Websocket close code for "policy violation"
+	closePolicyViolation = 1008
+)
+
+var slowConsumers = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "zooid_slow_consumers_total",
+	Help: "Connections dropped for not reading fast enough (reason = overflow or timeout)",
+}, []string{"instance", "reason"})
+
+func init() {
+	prometheus.MustRegister(slowConsumers)
+}
+
+// isWebSocketUpgrade reports whether r asks for a websocket, the same way
+// khatru decides.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") == "websocket"
+}
+
+type sendQueueKey struct{}
+
+// limitSendQueue wraps w so the connection it hijacks for a websocket has a
+// bounded send queue, and returns r with a way to find that connection.
+func (instance *Instance) limitSendQueue(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	label := instanceLabel(instance)
+
+	writer := &sendQueueWriter{
+		ResponseWriter: w,
+		wrap: func(conn net.Conn) *sendQueueConn {
+			return newSendQueueConn(conn, instance.Config.GetSendQueueBytes(), instance.Config.GetWriteTimeout(), func(reason string) {
+				slowConsumers.WithLabelValues(label, reason).Inc()
+			})
+		},
+	}
+
+	return writer, r.WithContext(context.WithValue(r.Context(), sendQueueKey{}, writer))
+}
+
+// sendQueueOf returns the queued connection r was upgraded to, if any.
+func sendQueueOf(r *http.Request) *sendQueueConn {
+	if r == nil {
+		return nil
+	}
+	if writer, ok := r.Context().Value(sendQueueKey{}).(*sendQueueWriter); ok {
+		return writer.conn
+	}
+	return nil
+}
+
+type sendQueueWriter struct {
+	http.ResponseWriter
+	wrap func(net.Conn) *sendQueueConn
+	conn *sendQueueConn
+}
+
+func (w *sendQueueWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w.conn = w.wrap(conn)
+	return w.conn, brw, nil
+}
+
+func (w *sendQueueWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type sendQueueState int
+
+const (
+	sendQueueOpen     sendQueueState = iota
+	sendQueueClosing                 // finishing the current message before saying goodbye
+	sendQueueDraining                // NOTICE and close queued, accepting nothing more
+	sendQueueClosed
+)
+
+// sendQueueConn is a net.Conn whose writes are queued and sent by a
+// goroutine of its own. Reads go straight to the underlying connection,
+// watched for AUTH messages once watchAuth is called, see connections.go.
+type sendQueueConn struct {
+	net.Conn
+
+	maxQueued    int
+	writeTimeout time.Duration
+	onDrop       func(reason string)
+
+	mu         sync.Mutex
+	wake       *sync.Cond
+	queue      [][]byte
+	queued     int
+	state      sendQueueState
+	handshaken bool // the first write, the HTTP handshake response, is done
+	frames     frameTracker
+	farewell   [][]byte // the NOTICE and close frames to send when closing
+	dropOnce   sync.Once
+	closeOnce  sync.Once
+
+	auth   authReader // only used by Read, which khatru calls from one goroutine
+	onAuth atomic.Pointer[func(nostr.Event)]
+}
+
+func newSendQueueConn(conn net.Conn, maxQueued int, writeTimeout time.Duration, onDrop func(reason string)) *sendQueueConn {
+	c := &sendQueueConn{
+		Conn:         conn,
+		maxQueued:    maxQueued,
+		writeTimeout: writeTimeout,
+		onDrop:       onDrop,
+	}
+	c.wake = sync.NewCond(&c.mu)
+
+	go c.writer()
+
+	return c
+}
+
+func (c *sendQueueConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if found := c.onAuth.Load(); found != nil && n > 0 {
+		c.auth.consume(p[:n], *found)
+	}
+
+	return n, err
+}
+
+// watchAuth has found called with the event of every AUTH message read
+// from now on.
+func (c *sendQueueConn) watchAuth(found func(nostr.Event)) {
+	c.onAuth.Store(&found)
+}
+
+func (c *sendQueueConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state >= sendQueueDraining {
+		return 0, net.ErrClosed
+	}
+
+	if c.state == sendQueueOpen && c.queued+len(p) > c.maxQueued {
+		c.startClosing(RejectError.Reason("you're not reading fast enough, closing the connection"), closePolicyViolation, "slow consumer")
+		c.drop("overflow")
+	}
+
+	c.queue = append(c.queue, append([]byte(nil), p...))
+	c.queued += len(p)
+
+	// Everything after the handshake response is websocket frames
+	if c.handshaken {
+		c.frames.consume(p)
+	}
+	c.handshaken = true
+
+	c.sendFarewell()
+
+	c.wake.Signal()
+	return len(p), nil
+}
+
+// closeWith sends notice and a close frame once the message being written is
+// complete, then closes the connection.
+func (c *sendQueueConn) closeWith(notice string, code uint16, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state != sendQueueOpen {
+		return
+	}
+
+	c.startClosing(notice, code, reason)
+	c.sendFarewell()
+	c.wake.Signal()
+}
+
+func (c *sendQueueConn) startClosing(notice string, code uint16, reason string) {
+	envelope, _ := json.Marshal([]string{"NOTICE", notice})
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	payload = append(payload, reason...)
+
+	c.farewell = [][]byte{wsFrame(0x1, envelope), wsFrame(0x8, payload)}
+	c.state = sendQueueClosing
+}
+
+// sendFarewell queues the farewell frames if the connection is closing and
+// no message is half written.
+func (c *sendQueueConn) sendFarewell() {
+	if c.state != sendQueueClosing || !c.frames.atMessageBoundary() {
+		return
+	}
+
+	c.queue = append(c.queue, c.farewell...)
+	c.farewell = nil
+	c.state = sendQueueDraining
+}
+
+// writer sends queued writes until the connection is closed or a write
+// fails, closing the underlying connection when it's done.
+func (c *sendQueueConn) writer() {
+	defer c.closeConn()
+
+	for {
+		c.mu.Lock()
+		for len(c.queue) == 0 && c.state != sendQueueDraining && c.state != sendQueueClosed {
+			c.wake.Wait()
+		}
+		if c.state == sendQueueClosed || len(c.queue) == 0 {
+			c.mu.Unlock()
+			return
+		}
+		chunk := c.queue[0]
+		c.queue[0] = nil
+		c.queue = c.queue[1:]
+		c.queued -= len(chunk)
+		c.mu.Unlock()
+
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+		if _, err := c.Conn.Write(chunk); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				c.drop("timeout")
+			}
+			return
+		}
+	}
+}
+
+// drop reports the connection as a slow consumer, once, whatever gives out
+// first.
+func (c *sendQueueConn) drop(reason string) {
+	c.dropOnce.Do(func() { c.onDrop(reason) })
+}
+
+func (c *sendQueueConn) closeConn() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.state = sendQueueClosed
+		c.queue = nil
+		c.wake.Broadcast()
+		c.mu.Unlock()
+
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// Close drops whatever is still queued and closes the connection.
+func (c *sendQueueConn) Close() error {
+	return c.closeConn()
+}
+
+// Deadlines only apply to reads; the writer sets its own.
+func (c *sendQueueConn) SetDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *sendQueueConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// frameTracker follows the websocket frames written by the server to know
+// when a message is complete.
+type frameTracker struct {
+	header    []byte // header bytes of the next frame seen so far
+	remaining uint64 // payload bytes left in the current frame
+	inFrame   bool
+	fin       bool
+	opcode    byte
+	inMessage bool // a fragmented data message isn't finished
+}
+
+func (f *frameTracker) consume(p []byte) {
+	for len(p) > 0 {
+		if f.inFrame {
+			n := min(uint64(len(p)), f.remaining)
+			p = p[n:]
+			f.remaining -= n
+			if f.remaining == 0 {
+				f.endFrame()
+			}
+			continue
+		}
+
+		f.header = append(f.header, p[0])
+		p = p[1:]
+
+		if length, ok := f.parseHeader(); ok {
+			f.header = f.header[:0]
+			f.remaining = length
+			f.inFrame = true
+			if length == 0 {
+				f.endFrame()
+			}
+		}
+	}
+}
+
+// parseHeader returns the payload length of the frame in f.header, or false
+// if the header isn't complete yet.
+func (f *frameTracker) parseHeader() (uint64, bool) {
+	header, ok := parseFrameHeader(f.header)
+	if !ok {
+		return 0, false
+	}
+
+	f.fin = header.fin
+	f.opcode = header.opcode
+	return header.length, true
+}
+
+type frameHeader struct {
+	fin    bool
+	opcode byte
+	length uint64
+	mask   [4]byte // zero for the server's frames, which aren't masked
+}
+
+// parseFrameHeader parses the websocket frame header in h, or returns false
+// if it isn't complete yet.
+func parseFrameHeader(h []byte) (frameHeader, bool) {
+	if len(h) < 2 {
+		return frameHeader{}, false
+	}
+
+	need := 2
+	switch h[1] & 0x7f {
+	case 126:
+		need += 2
+	case 127:
+		need += 8
+	}
+	masked := h[1]&0x80 != 0
+	if masked {
+		need += 4
+	}
+	if len(h) < need {
+		return frameHeader{}, false
+	}
+
+	header := frameHeader{
+		fin:    h[0]&0x80 != 0,
+		opcode: h[0] & 0x0f,
+	}
+
+	switch length := h[1] & 0x7f; length {
+	case 126:
+		header.length = uint64(binary.BigEndian.Uint16(h[2:4]))
+	case 127:
+		header.length = binary.BigEndian.Uint64(h[2:10])
+	default:
+		header.length = uint64(length)
+	}
+	if masked {
+		copy(header.mask[:], h[need-4:need])
+	}
+
+	return header, true
+}
+
+func (f *frameTracker) endFrame() {
+	f.inFrame = false
+
+	// Control frames (opcode 8 and up) can come between a message's
+	// fragments without ending it
+	if f.opcode < 0x8 {
+		f.inMessage = !f.fin
+	}
+}
+
+func (f *frameTracker) atMessageBoundary() bool {
+	return !f.inFrame && len(f.header) == 0 && !f.inMessage
+}
+
+// wsFrame builds an unmasked, unfragmented server frame.
+func wsFrame(opcode byte, payload []byte) []byte {
+	frame := []byte{0x80 | opcode}
+
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	return append(frame, payload...)
+}
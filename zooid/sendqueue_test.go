@@ -0,0 +1,196 @@
+package zooid
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr/nip11"
+)
+
+// tcpPair returns both ends of a loopback TCP connection with small socket
+// buffers, so a reader that stops reading is felt quickly.
+func tcpPair(t *testing.T) (server net.Conn, client net.Conn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+
+	client, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+
+	server.(*net.TCPConn).SetWriteBuffer(4096)
+	client.(*net.TCPConn).SetReadBuffer(4096)
+
+	return server, client
+}
+
+type closeNotifyConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *closeNotifyConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+type dropRecorder struct {
+	mu      sync.Mutex
+	reasons []string
+}
+
+func (r *dropRecorder) record(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reasons = append(r.reasons, reason)
+}
+
+func (r *dropRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.reasons...)
+}
+
+func TestSendQueue_DropsReaderThatStopsReading(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		maxQueued int
+		writes    int
+		reason    string
+	}{
+		// Writes outpace the queue
+		{"overflow", 64 << 10, 1000, "overflow"},
+		// Everything fits in the queue, but the socket never drains
+		{"timeout", 64 << 20, 64, "timeout"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			server, client := tcpPair(t)
+			defer client.Close()
+
+			underlying := &closeNotifyConn{Conn: server, closed: make(chan struct{})}
+			drops := &dropRecorder{}
+			conn := newSendQueueConn(underlying, c.maxQueued, 200*time.Millisecond, drops.record)
+
+			conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n\r\n"))
+
+			// The client never reads
+			frame := wsFrame(0x1, bytes.Repeat([]byte("x"), 16<<10))
+			for range c.writes {
+				if _, err := conn.Write(frame); err != nil {
+					break
+				}
+			}
+
+			select {
+			case <-underlying.closed:
+			case <-time.After(2 * time.Second):
+				t.Fatal("the connection of a reader that stopped reading was not closed")
+			}
+
+			if reasons := drops.get(); len(reasons) != 1 || reasons[0] != c.reason {
+				t.Errorf("drop reasons = %v, want [%s]", reasons, c.reason)
+			}
+			if _, err := conn.Write(frame); err == nil {
+				t.Error("writes after the drop should fail")
+			}
+		})
+	}
+}
+
+func TestSendQueue_PassesThroughForAReader(t *testing.T) {
+	server, client := tcpPair(t)
+	defer client.Close()
+
+	conn := newSendQueueConn(server, 1<<20, time.Second, func(reason string) {
+		t.Errorf("dropped a reading client: %s", reason)
+	})
+	defer conn.Close()
+
+	want := append([]byte("handshake"), wsFrame(0x1, []byte(`["EOSE","x"]`))...)
+	conn.Write(want[:9])
+	conn.Write(want[9:])
+
+	got := make([]byte, len(want))
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for n := 0; n < len(got); {
+		m, err := client.Read(got[n:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += m
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("read %q, want %q", got, want)
+	}
+}
+
+func TestFrameTracker_MessageBoundaries(t *testing.T) {
+	var f frameTracker
+
+	f.consume(wsFrame(0x1, []byte("whole")))
+	if !f.atMessageBoundary() {
+		t.Error("a complete frame should end its message")
+	}
+
+	first := wsFrame(0x1, []byte("frag"))
+	first[0] &^= 0x80 // not the final fragment
+	f.consume(first[:1])
+	if f.atMessageBoundary() {
+		t.Error("half a header is not a boundary")
+	}
+	f.consume(first[1:])
+	if f.atMessageBoundary() {
+		t.Error("a message isn't done until its final fragment")
+	}
+
+	f.consume(wsFrame(0x9, nil)) // a ping between fragments
+	if f.atMessageBoundary() {
+		t.Error("control frames don't end a fragmented message")
+	}
+
+	f.consume(wsFrame(0x0, []byte("ment")))
+	if !f.atMessageBoundary() {
+		t.Error("the final fragment should end the message")
+	}
+
+	big := wsFrame(0x2, make([]byte, 70000))
+	f.consume(big[:100])
+	if f.atMessageBoundary() {
+		t.Error("a partly written frame is not a boundary")
+	}
+	f.consume(big[100:])
+	if !f.atMessageBoundary() {
+		t.Error("a large frame should end its message once fully written")
+	}
+}
+
+func TestLimits_AdvertisedInNIP11(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Limits.MaxResults = 250
+	instance.Config.Limits.MaxMessageSize = 65536
+
+	info := instance.OverwriteRelayInformation(context.Background(), nil, nip11.RelayInformationDocument{})
+	if info.Limitation == nil || info.Limitation.MaxLimit != 250 || info.Limitation.MaxMessageLength != 65536 {
+		t.Errorf("limitation = %+v, want max_limit 250 and max_message_length 65536", info.Limitation)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -14,9 +15,62 @@ import (
 	"github.com/testcontainers/testcontainers-go/wait"
 )
 
+// testSQLite runs the tests against SQLite instead of PostgreSQL when
+// ZOOID_TEST_DATABASE=sqlite, which needs -tags sqlite_fts5. CI runs them
+// both ways.
+var testSQLite = os.Getenv("ZOOID_TEST_DATABASE") == "sqlite"
+
+// testMemory runs the tests with DATABASE_URL=memory:// when
+// ZOOID_TEST_DATABASE=memory, so the in-memory storage is held to the same
+// suite as the databases.
+var testMemory = os.Getenv("ZOOID_TEST_DATABASE") == "memory"
+
+// skipOnSQLite skips a test of something the SQLite backend doesn't do.
+func skipOnSQLite(t *testing.T, what string) {
+	t.Helper()
+	if testSQLite {
+		t.Skipf("SQLite has no %s", what)
+	}
+}
+
+// skipOnMemory skips a test of something memory storage doesn't do, or one
+// that reaches into the database directly.
+func skipOnMemory(t *testing.T, what string) {
+	t.Helper()
+	if testMemory {
+		t.Skipf("memory storage has no %s", what)
+	}
+}
+
 func TestMain(m *testing.M) {
 	ctx := context.Background()
 
+	// Keep the configs and media the tests write out of the source tree
+	dir, err := os.MkdirTemp("", "zooid_test")
+	if err != nil {
+		log.Fatalf("Failed to create test directory: %v", err)
+	}
+	os.Setenv("CONFIG", filepath.Join(dir, "config"))
+	os.Setenv("MEDIA", filepath.Join(dir, "media"))
+	os.MkdirAll(filepath.Join(dir, "config"), 0755)
+	os.MkdirAll(filepath.Join(dir, "media"), 0755)
+
+	if testMemory {
+		os.Setenv("DATABASE_URL", "memory://")
+
+		code := m.Run()
+		os.RemoveAll(dir)
+		os.Exit(code)
+	}
+
+	if testSQLite {
+		os.Setenv("DATABASE_URL", "sqlite://"+filepath.Join(dir, "zooid_test.db"))
+
+		code := m.Run()
+		os.RemoveAll(dir)
+		os.Exit(code)
+	}
+
 	// Start PostgreSQL container for unit tests
 	pgContainer, err := postgres.Run(ctx, "postgres:16-alpine",
 		postgres.WithDatabase("zooid_test"),
@@ -53,15 +107,12 @@ func TestMain(m *testing.M) {
 
 	os.Setenv("DATABASE_URL", connStr)
 
-	// Create required directories for tests (media and config still needed)
-	os.MkdirAll("./media", 0755)
-	os.MkdirAll("./config", 0755)
-
 	// Run tests
 	code := m.Run()
 
 	// Terminate container explicitly before os.Exit (which skips defers)
 	pgContainer.Terminate(ctx)
+	os.RemoveAll(dir)
 
 	os.Exit(code)
 }
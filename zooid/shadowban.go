@@ -0,0 +1,171 @@
+package zooid
+
+import (
+	"cmp"
+	"fmt"
+	"iter"
+	"slices"
+	"sync"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// Shadow bans.
+//
+// A shadow-banned pubkey can still publish, and every event gets an OK, but
+// nothing it publishes is stored or sent to anyone else. Unlike a hard ban it
+// isn't told, so it doesn't just come back with a new key. The list is kept
+// in its own application data event and managed with the shadowbanpubkey and
+// unshadowbanpubkey management methods.
+//
+// So that the pubkey doesn't notice, its own view is kept consistent: its
+// last shadowBufferSize events are buffered in memory, echoed to its own open
+// subscriptions, and merged into the results of its REQs. The buffer follows
+// the usual rules for replaceable events and deletions, but it isn't saved,
+// so the events disappear on restart and when the ban is lifted.
+
+const shadowBufferSize = 100
+
+// shadowBuffer holds the recent events of shadow-banned pubkeys. The zero
+// value is ready to use.
+type shadowBuffer struct {
+	mu     sync.Mutex
+	events map[nostr.PubKey][]nostr.Event // oldest first
+}
+
+// shadowAddress is the address of a replaceable or addressable event.
+func shadowAddress(event nostr.Event) string {
+	d := ""
+	if event.Kind.IsAddressable() {
+		d = event.Tags.GetD()
+	}
+
+	return fmt.Sprintf("%d:%s:%s", event.Kind, event.PubKey.Hex(), d)
+}
+
+// add buffers event, applying it as a relay would: a deletion removes the
+// events it refers to, and a replaceable event replaces older versions.
+func (b *shadowBuffer) add(event nostr.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.events == nil {
+		b.events = make(map[nostr.PubKey][]nostr.Event)
+	}
+
+	events := b.events[event.PubKey]
+
+	switch {
+	case event.Kind == nostr.KindDeletion:
+		events = slices.DeleteFunc(events, func(buffered nostr.Event) bool {
+			return event.Tags.FindWithValue("e", buffered.ID.Hex()) != nil ||
+				(!buffered.Kind.IsRegular() && event.Tags.FindWithValue("a", shadowAddress(buffered)) != nil)
+		})
+	case !event.Kind.IsRegular():
+		address := shadowAddress(event)
+		for _, buffered := range events {
+			if shadowAddress(buffered) == address && buffered.CreatedAt > event.CreatedAt {
+				return
+			}
+		}
+		events = slices.DeleteFunc(events, func(buffered nostr.Event) bool {
+			return shadowAddress(buffered) == address
+		})
+	}
+
+	events = append(events, event)
+	if len(events) > shadowBufferSize {
+		events = slices.Delete(events, 0, len(events)-shadowBufferSize)
+	}
+
+	b.events[event.PubKey] = events
+}
+
+// get returns a copy of the events buffered for pubkey.
+func (b *shadowBuffer) get(pubkey nostr.PubKey) []nostr.Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return slices.Clone(b.events[pubkey])
+}
+
+func (b *shadowBuffer) forget(pubkey nostr.PubKey) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.events, pubkey)
+}
+
+// mergeShadowed merges the buffered events matching filter into stored, the
+// newest-first results of a query for filter, keeping them newest first and
+// within filter.Limit. Stored versions of replaceable events that have been
+// buffered since are left out.
+func mergeShadowed(buffered []nostr.Event, filter nostr.Filter, stored iter.Seq[nostr.Event]) iter.Seq[nostr.Event] {
+	replaced := make(map[string]struct{})
+	matches := make([]nostr.Event, 0, len(buffered))
+	for _, event := range buffered {
+		if !event.Kind.IsRegular() {
+			replaced[shadowAddress(event)] = struct{}{}
+		}
+		if filter.Matches(event) && !filter.LimitZero {
+			matches = append(matches, event)
+		}
+	}
+
+	slices.SortStableFunc(matches, func(a, b nostr.Event) int {
+		return cmp.Compare(b.CreatedAt, a.CreatedAt)
+	})
+
+	return func(yield func(nostr.Event) bool) {
+		sent := 0
+		emit := func(event nostr.Event) bool {
+			sent++
+			return yield(event) && (filter.Limit == 0 || sent < filter.Limit)
+		}
+
+		for event := range stored {
+			if !event.Kind.IsRegular() {
+				if _, ok := replaced[shadowAddress(event)]; ok {
+					continue
+				}
+			}
+
+			for len(matches) > 0 && matches[0].CreatedAt > event.CreatedAt {
+				if !emit(matches[0]) {
+					return
+				}
+				matches = matches[1:]
+			}
+
+			if !emit(event) {
+				return
+			}
+		}
+
+		for _, event := range matches {
+			if !emit(event) {
+				return
+			}
+		}
+	}
+}
+
+// shadowBan accepts an event from a shadow-banned pubkey without storing it,
+// and shows it to the pubkey's own subscriptions.
+func (instance *Instance) shadowBan(event nostr.Event) {
+	if event.Kind.IsEphemeral() {
+		// Not stored anyway, and PreventBroadcast keeps it from others
+		return
+	}
+
+	instance.shadowBuffer.add(event)
+	instance.shadowed.Store(event.ID, struct{}{})
+	instance.Relay.BroadcastEvent(event)
+}
+
+// hiddenByShadowBan reports whether event, from a shadow-banned pubkey,
+// should be kept from ws: only the pubkey itself sees it.
+func (instance *Instance) hiddenByShadowBan(ws *khatru.WebSocket, event nostr.Event) bool {
+	return instance.Management.PubkeyIsShadowBanned(event.PubKey) && !slices.Contains(ws.AuthedPublicKeys, event.PubKey)
+}
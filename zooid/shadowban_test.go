@@ -0,0 +1,152 @@
+package zooid
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// signedAt signs an event keeping its created_at, which the buffer orders by.
+func signedAt(secret nostr.SecretKey, kind nostr.Kind, createdAt nostr.Timestamp, tags nostr.Tags) nostr.Event {
+	event := nostr.Event{Kind: kind, CreatedAt: createdAt, Tags: tags}
+	event.Sign(secret)
+	return event
+}
+
+func TestShadowBuffer_KeepsRecentEventsPerPubkey(t *testing.T) {
+	var buffer shadowBuffer
+	author := nostr.Generate()
+	other := nostr.Generate()
+
+	for i := range shadowBufferSize + 10 {
+		buffer.add(signedAt(author, nostr.KindTextNote, nostr.Timestamp(1000+i), nil))
+	}
+	buffer.add(signedAt(other, nostr.KindTextNote, 1000, nil))
+
+	events := buffer.get(author.Public())
+	if len(events) != shadowBufferSize {
+		t.Fatalf("%d events buffered, want %d", len(events), shadowBufferSize)
+	}
+	if events[0].CreatedAt != 1010 {
+		t.Errorf("oldest buffered event at %d, want the oldest ones dropped", events[0].CreatedAt)
+	}
+	if len(buffer.get(other.Public())) != 1 {
+		t.Error("another pubkey's events should be buffered separately")
+	}
+
+	buffer.forget(author.Public())
+	if len(buffer.get(author.Public())) != 0 {
+		t.Error("forgotten events still buffered")
+	}
+}
+
+func TestShadowBuffer_ReplacesAndDeletes(t *testing.T) {
+	var buffer shadowBuffer
+	author := nostr.Generate()
+
+	profile := signedAt(author, nostr.KindProfileMetadata, 100, nil)
+	newer := signedAt(author, nostr.KindProfileMetadata, 200, nil)
+	note := signedAt(author, nostr.KindTextNote, 150, nil)
+	article := signedAt(author, nostr.KindArticle, 150, nostr.Tags{{"d", "post"}})
+
+	for _, event := range []nostr.Event{profile, newer, profile, note, article} {
+		buffer.add(event)
+	}
+
+	events := buffer.get(author.Public())
+	if len(events) != 3 || !slices.ContainsFunc(events, func(e nostr.Event) bool { return e.ID == newer.ID }) {
+		t.Fatalf("buffered %d events, want only the newest profile next to the note and article", len(events))
+	}
+
+	buffer.add(signedAt(author, nostr.KindDeletion, 300, nostr.Tags{{"e", note.ID.Hex()}, {"a", shadowAddress(article)}}))
+
+	for _, event := range buffer.get(author.Public()) {
+		if event.ID == note.ID || event.ID == article.ID {
+			t.Errorf("deleted event of kind %d still buffered", event.Kind)
+		}
+	}
+}
+
+func TestMergeShadowed(t *testing.T) {
+	author := nostr.Generate()
+	at := func(kind nostr.Kind, createdAt nostr.Timestamp) nostr.Event {
+		return signedAt(author, kind, createdAt, nil)
+	}
+
+	stored := []nostr.Event{at(nostr.KindTextNote, 500), at(nostr.KindProfileMetadata, 400), at(nostr.KindTextNote, 300)}
+	buffered := []nostr.Event{at(nostr.KindTextNote, 450), at(nostr.KindTextNote, 600), at(nostr.KindProfileMetadata, 350), at(nostr.KindReaction, 550)}
+
+	merge := func(filter nostr.Filter) []nostr.Timestamp {
+		var got []nostr.Timestamp
+		for event := range mergeShadowed(buffered, filter, slices.Values(stored)) {
+			got = append(got, event.CreatedAt)
+		}
+		return got
+	}
+
+	// The buffered profile replaces the stored one, though it's older
+	if got, want := merge(nostr.Filter{Kinds: []nostr.Kind{nostr.KindTextNote, nostr.KindProfileMetadata}}), []nostr.Timestamp{600, 500, 450, 350, 300}; !slices.Equal(got, want) {
+		t.Errorf("merged %v, want %v", got, want)
+	}
+	if got, want := merge(nostr.Filter{Kinds: []nostr.Kind{nostr.KindTextNote}, Limit: 3}), []nostr.Timestamp{600, 500, 450}; !slices.Equal(got, want) {
+		t.Errorf("with a limit, merged %v, want %v", got, want)
+	}
+	for event := range mergeShadowed(buffered, nostr.Filter{LimitZero: true}, slices.Values([]nostr.Event(nil))) {
+		t.Errorf("limit 0 returned the buffered event at %d", event.CreatedAt)
+	}
+}
+
+func TestShadowBan_OnlyTheAuthorSees(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+
+	author := nostr.Generate()
+	if err := instance.Management.ShadowBanPubkey(author.Public(), "spam"); err != nil {
+		t.Fatal(err)
+	}
+	if !instance.Management.PubkeyIsShadowBanned(author.Public()) || instance.Management.PubkeyIsBanned(author.Public()) {
+		t.Fatal("a shadow ban should be kept apart from hard bans")
+	}
+
+	note := signedBy(author, nostr.Event{Kind: nostr.KindTextNote, Content: "hello"})
+	if reject, msg := instance.OnEvent(authedContext(author.Public()), note); reject {
+		t.Fatalf("shadow-banned pubkey's event refused: %s", msg)
+	}
+	if err := instance.StoreEvent(context.Background(), note); err != eventstore.ErrDupEvent {
+		t.Fatalf("storing a shadow-banned event returned %v, want a pretend duplicate", err)
+	}
+
+	query := func(pubkey nostr.PubKey) bool {
+		for event := range instance.QueryStored(authedContext(pubkey), nostr.Filter{Authors: []nostr.PubKey{author.Public()}}) {
+			if event.ID == note.ID {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !query(author.Public()) {
+		t.Error("the author should see their own event")
+	}
+	if query(nostr.Generate().Public()) {
+		t.Error("someone else saw a shadow-banned event")
+	}
+
+	if !instance.PreventBroadcast(&khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{nostr.Generate().Public()}}, nostr.Filter{}, note) {
+		t.Error("a shadow-banned event was sent to someone else")
+	}
+	if instance.PreventBroadcast(&khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{author.Public()}}, nostr.Filter{}, note) {
+		t.Error("a shadow-banned event was kept from its author")
+	}
+
+	if err := instance.Management.UnshadowBanPubkey(author.Public()); err != nil {
+		t.Fatal(err)
+	}
+	if query(author.Public()) {
+		t.Error("the event should be gone once the ban is lifted")
+	}
+}
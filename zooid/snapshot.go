@@ -0,0 +1,528 @@
+package zooid
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// Cache snapshots.
+//
+// WarmCaches reads every group's metadata, creator and member snapshot from
+// the event log, which on a large relay is slow enough that the first
+// requests after a restart fall back to the database. Instead the caches are
+// saved to the KV store every cacheSnapshotInterval and on shutdown, and
+// LoadCaches restores them and replays only the events stored since. A
+// snapshot that is missing, unreadable, from another version or older than
+// cacheSnapshotMaxAge is ignored in favour of a full warm.
+//
+// The replay can't see events deleted after the snapshot was taken, other
+// than whole groups (delete-group events are kept), which is why old
+// snapshots are discarded rather than replayed.
+
+const (
+	cacheSnapshotVersion  = 2
+	cacheSnapshotInterval = 10 * time.Minute
+	cacheSnapshotMaxAge   = 24 * time.Hour
+)
+
+var errSnapshotStale = errors.New("snapshot is stale")
+
+type groupCacheSnapshot struct {
+	Version int                      `json:"version"`
+	TakenAt nostr.Timestamp          `json:"taken_at"`
+	Groups  map[string]groupSnapshot `json:"groups"`
+}
+
+type groupSnapshot struct {
+	Metadata    *nostr.Event        `json:"metadata,omitempty"`
+	Creator     string              `json:"creator,omitempty"`
+	Members     []string            `json:"members,omitempty"`
+	Roles       map[string][]string `json:"roles,omitempty"`
+	FullyLoaded bool                `json:"fully_loaded,omitempty"`
+}
+
+type managementCacheSnapshot struct {
+	Version             int               `json:"version"`
+	TakenAt             nostr.Timestamp   `json:"taken_at"`
+	Members             map[string]int64  `json:"members"` // pubkey -> expiry, 0 for none
+	BannedPubkeys       map[string]string `json:"banned_pubkeys"`
+	ShadowBannedPubkeys map[string]string `json:"shadow_banned_pubkeys"`
+	BannedEvents        map[string]string `json:"banned_events"`
+}
+
+func snapshotKV(events *EventStore) *KV {
+	return &KV{Name: "zooid:" + events.Schema.Name}
+}
+
+func checkSnapshot(version int, takenAt nostr.Timestamp) error {
+	if version != cacheSnapshotVersion {
+		return fmt.Errorf("snapshot version %d, want %d", version, cacheSnapshotVersion)
+	}
+	if age := time.Since(takenAt.Time()); age > cacheSnapshotMaxAge {
+		return fmt.Errorf("%w: taken %s ago", errSnapshotStale, age.Round(time.Second))
+	}
+	return nil
+}
+
+// Groups
+
+// LoadCaches restores the caches from the last snapshot, falling back to
+// WarmCaches if there is no usable one.
+func (g *GroupStore) LoadCaches(ctx context.Context) error {
+	if err := g.restoreSnapshot(); err != nil {
+		if !errors.Is(err, ErrKVNotFound) {
+			log.Printf("Not using group cache snapshot for %s: %v", g.Events.Schema.Name, err)
+		}
+
+		// Drop anything a partly read snapshot left behind
+		g.clearCaches()
+		return g.WarmCaches(ctx)
+	}
+
+	return nil
+}
+
+func (g *GroupStore) clearCaches() {
+	g.metadataCache.Clear()
+	g.creatorCache.Clear()
+	g.membershipCache.Clear()
+	g.membershipFullyLoaded.Clear()
+	g.roleCache.Clear()
+	g.pinsCache.Clear()
+	g.eventGroups.clear()
+	g.unreadLogs.Clear()
+}
+
+func (g *GroupStore) snapshot() groupCacheSnapshot {
+	snapshot := groupCacheSnapshot{
+		Version: cacheSnapshotVersion,
+		TakenAt: nostr.Now(),
+		Groups:  make(map[string]groupSnapshot),
+	}
+
+	update := func(h string, fn func(*groupSnapshot)) {
+		group := snapshot.Groups[h]
+		fn(&group)
+		snapshot.Groups[h] = group
+	}
+
+	g.metadataCache.Range(func(key, value any) bool {
+		if cached := value.(*groupMetaCache); cached.found {
+			update(key.(string), func(group *groupSnapshot) { group.Metadata = &cached.event })
+		}
+		return true
+	})
+
+	g.creatorCache.Range(func(key, value any) bool {
+		update(key.(string), func(group *groupSnapshot) { group.Creator = value.(nostr.PubKey).Hex() })
+		return true
+	})
+
+	g.membershipCache.Range(func(key, value any) bool {
+		h := key.(string)
+		ms := value.(*memberSet)
+
+		ms.mu.RLock()
+		members := make([]string, 0, len(ms.members))
+		for pubkey := range ms.members {
+			members = append(members, pubkey.Hex())
+		}
+		ms.mu.RUnlock()
+		slices.Sort(members)
+
+		_, fullyLoaded := g.membershipFullyLoaded.Load(h)
+		update(h, func(group *groupSnapshot) {
+			group.Members = members
+			group.FullyLoaded = fullyLoaded
+		})
+		return true
+	})
+
+	g.roleCache.Range(func(key, value any) bool {
+		rs := value.(*roleSet)
+
+		rs.mu.RLock()
+		roles := make(map[string][]string, len(rs.roles))
+		for pubkey, names := range rs.roles {
+			roles[pubkey.Hex()] = Keys(names)
+			slices.Sort(roles[pubkey.Hex()])
+		}
+		rs.mu.RUnlock()
+
+		if len(roles) > 0 {
+			update(key.(string), func(group *groupSnapshot) { group.Roles = roles })
+		}
+		return true
+	})
+
+	return snapshot
+}
+
+// SaveCacheSnapshot saves the group caches for the next LoadCaches. Caches
+// that never finished warming aren't saved, since restoring them would skip
+// the database fallback they still rely on.
+func (g *GroupStore) SaveCacheSnapshot(ctx context.Context) error {
+	if !g.cachesWarmed {
+		return nil
+	}
+
+	return snapshotKV(g.Events).SetJSON(ctx, "snapshot:groups", g.snapshot())
+}
+
+func (g *GroupStore) restoreSnapshot() error {
+	ctx, cancel := context.WithTimeout(g.Events.rootCtx, dbOpTimeout)
+	defer cancel()
+
+	var snapshot groupCacheSnapshot
+	if err := snapshotKV(g.Events).GetJSON(ctx, "snapshot:groups", &snapshot); err != nil {
+		return err
+	}
+	if err := checkSnapshot(snapshot.Version, snapshot.TakenAt); err != nil {
+		return err
+	}
+
+	for h, group := range snapshot.Groups {
+		if group.Metadata != nil {
+			g.metadataCache.Store(h, newGroupMetaCache(*group.Metadata))
+		}
+
+		if group.Creator != "" {
+			creator, err := nostr.PubKeyFromHex(group.Creator)
+			if err != nil {
+				return fmt.Errorf("group %q: creator: %w", h, err)
+			}
+			g.creatorCache.Store(h, creator)
+		}
+
+		if group.Members != nil {
+			ms := g.getOrCreateMemberSet(h)
+			for _, hex := range group.Members {
+				pubkey, err := nostr.PubKeyFromHex(hex)
+				if err != nil {
+					return fmt.Errorf("group %q: member: %w", h, err)
+				}
+				ms.members[pubkey] = struct{}{}
+			}
+		}
+
+		if group.FullyLoaded {
+			g.membershipFullyLoaded.Store(h, struct{}{})
+		}
+
+		if group.Roles != nil {
+			rs := g.getOrCreateRoleSet(h)
+			for hex, names := range group.Roles {
+				pubkey, err := nostr.PubKeyFromHex(hex)
+				if err != nil {
+					return fmt.Errorf("group %q: role holder: %w", h, err)
+				}
+				rs.roles[pubkey] = make(map[string]struct{}, len(names))
+				for _, name := range names {
+					rs.roles[pubkey][name] = struct{}{}
+				}
+			}
+		}
+	}
+
+	g.replaySince(snapshot.TakenAt)
+	g.cachesWarmed = true
+
+	return nil
+}
+
+// replaySince applies the group events stored since the snapshot, by when
+// they were received rather than created, since a backdated event can
+// arrive long after its created_at. They're replayed in the order they
+// arrived, as OnEventSaved applied them. Events from the snapshot's own
+// second are replayed too, which is harmless since each one sets state
+// rather than toggling it.
+func (g *GroupStore) replaySince(since nostr.Timestamp) {
+	kinds := []nostr.Kind{
+		nostr.KindSimpleGroupMetadata,
+		nostr.KindSimpleGroupCreateGroup,
+		nostr.KindSimpleGroupDeleteGroup,
+		nostr.KindSimpleGroupPutUser,
+		nostr.KindSimpleGroupRemoveUser,
+	}
+
+	var tail []ReceivedEvent
+	for received := range g.Events.QueryEventsReceivedSince(since, 0) {
+		if slices.Contains(kinds, received.Kind) {
+			tail = append(tail, received)
+		}
+	}
+
+	// received_at is in seconds, so within one the order is as in IsMember
+	slices.SortFunc(tail, func(a, b ReceivedEvent) int {
+		return cmp.Or(cmp.Compare(a.ReceivedAt, b.ReceivedAt), cmp.Compare(a.CreatedAt, b.CreatedAt), bytes.Compare(a.ID[:], b.ID[:]))
+	})
+
+	for _, received := range tail {
+		event := received.Event
+		switch event.Kind {
+		case nostr.KindSimpleGroupMetadata:
+			if h := event.Tags.GetD(); h != "" {
+				g.metadataCache.Store(h, newGroupMetaCache(event))
+			}
+		case nostr.KindSimpleGroupCreateGroup:
+			if h := GetGroupIDFromEvent(event); h != "" {
+				g.creatorCache.Store(h, event.PubKey)
+				g.membershipFullyLoaded.Store(h, struct{}{})
+			}
+		case nostr.KindSimpleGroupDeleteGroup:
+			if h := GetGroupIDFromEvent(event); h != "" {
+				g.metadataCache.Delete(h)
+				g.membershipCache.Delete(h)
+				g.membershipFullyLoaded.Delete(h)
+				g.roleCache.Delete(h)
+				g.creatorCache.Delete(h)
+			}
+		default:
+			h := GetGroupIDFromEvent(event)
+			if h == "" {
+				continue
+			}
+
+			ms := g.getOrCreateMemberSet(h)
+			rs := g.getOrCreateRoleSet(h)
+			ms.mu.Lock()
+			rs.mu.Lock()
+			for tag := range event.Tags.FindAll("p") {
+				pubkey, err := nostr.PubKeyFromHex(tag[1])
+				if err != nil {
+					continue
+				}
+
+				if event.Kind == nostr.KindSimpleGroupRemoveUser {
+					delete(ms.members, pubkey)
+					delete(rs.roles, pubkey)
+					continue
+				}
+
+				// As in WarmCaches, a put replaces the member's roles
+				ms.members[pubkey] = struct{}{}
+				if len(tag) > 2 {
+					roles := make(map[string]struct{}, len(tag)-2)
+					for _, name := range tag[2:] {
+						roles[name] = struct{}{}
+					}
+					rs.roles[pubkey] = roles
+				} else {
+					delete(rs.roles, pubkey)
+				}
+			}
+			rs.mu.Unlock()
+			ms.mu.Unlock()
+		}
+	}
+}
+
+// Relay
+
+// LoadCaches restores the caches from the last snapshot, falling back to
+// WarmCaches if there is no usable one.
+func (m *ManagementStore) LoadCaches(ctx context.Context) error {
+	if err := m.restoreSnapshot(); err != nil {
+		if !errors.Is(err, ErrKVNotFound) {
+			log.Printf("Not using management cache snapshot for %s: %v", m.Events.Schema.Name, err)
+		}
+
+		// Drop anything a partly read snapshot left behind
+		m.clearCaches()
+		return m.WarmCaches(ctx)
+	}
+
+	return nil
+}
+
+func (m *ManagementStore) clearCaches() {
+	m.relayMembers.Clear()
+	m.memberExpiry.Clear()
+	m.bannedPubkeys.Clear()
+	m.shadowBannedPubkeys.Clear()
+	m.bannedEvents.Clear()
+}
+
+func (m *ManagementStore) snapshot() managementCacheSnapshot {
+	snapshot := managementCacheSnapshot{
+		Version:             cacheSnapshotVersion,
+		TakenAt:             nostr.Now(),
+		Members:             make(map[string]int64),
+		BannedPubkeys:       make(map[string]string),
+		ShadowBannedPubkeys: make(map[string]string),
+		BannedEvents:        make(map[string]string),
+	}
+
+	m.relayMembers.Range(func(key, _ any) bool {
+		expires := int64(0)
+		if v, ok := m.memberExpiry.Load(key); ok {
+			expires = int64(v.(nostr.Timestamp))
+		}
+		snapshot.Members[key.(nostr.PubKey).Hex()] = expires
+		return true
+	})
+
+	m.bannedPubkeys.Range(func(key, value any) bool {
+		snapshot.BannedPubkeys[key.(nostr.PubKey).Hex()] = value.(string)
+		return true
+	})
+
+	m.shadowBannedPubkeys.Range(func(key, value any) bool {
+		snapshot.ShadowBannedPubkeys[key.(nostr.PubKey).Hex()] = value.(string)
+		return true
+	})
+
+	m.bannedEvents.Range(func(key, value any) bool {
+		snapshot.BannedEvents[key.(nostr.ID).Hex()] = value.(string)
+		return true
+	})
+
+	return snapshot
+}
+
+// SaveCacheSnapshot saves the relay membership and ban caches for the next
+// LoadCaches.
+func (m *ManagementStore) SaveCacheSnapshot(ctx context.Context) error {
+	if !m.cachesWarmed {
+		return nil
+	}
+
+	return snapshotKV(m.Events).SetJSON(ctx, "snapshot:management", m.snapshot())
+}
+
+func (m *ManagementStore) restoreSnapshot() error {
+	ctx, cancel := context.WithTimeout(m.Events.rootCtx, dbOpTimeout)
+	defer cancel()
+
+	var snapshot managementCacheSnapshot
+	if err := snapshotKV(m.Events).GetJSON(ctx, "snapshot:management", &snapshot); err != nil {
+		return err
+	}
+	if err := checkSnapshot(snapshot.Version, snapshot.TakenAt); err != nil {
+		return err
+	}
+
+	// The lists are replaceable events, so anything stored since the
+	// snapshot replaces the snapshot's copy of that list outright.
+	var membersChanged, pubkeysChanged, shadowChanged, eventsChanged bool
+	for event := range m.Events.QueryEvents(nostr.Filter{
+		Kinds:   []nostr.Kind{RELAY_MEMBERS, nostr.KindApplicationSpecificData},
+		Authors: []nostr.PubKey{m.Config.GetSelf()},
+		Since:   snapshot.TakenAt,
+	}, 0) {
+		switch {
+		case event.Kind == RELAY_MEMBERS:
+			membersChanged = true
+		case event.Tags.GetD() == BANNED_PUBKEYS:
+			pubkeysChanged = true
+		case event.Tags.GetD() == SHADOW_BANNED_PUBKEYS:
+			shadowChanged = true
+		case event.Tags.GetD() == BANNED_EVENTS:
+			eventsChanged = true
+		}
+	}
+
+	if membersChanged {
+		m.loadMembers()
+	} else {
+		for hex, expires := range snapshot.Members {
+			pubkey, err := nostr.PubKeyFromHex(hex)
+			if err != nil {
+				return fmt.Errorf("member: %w", err)
+			}
+			m.relayMembers.Store(pubkey, struct{}{})
+			if expires != 0 {
+				m.memberExpiry.Store(pubkey, nostr.Timestamp(expires))
+			}
+		}
+	}
+
+	if pubkeysChanged {
+		m.loadBannedPubkeys()
+	} else {
+		for hex, reason := range snapshot.BannedPubkeys {
+			pubkey, err := nostr.PubKeyFromHex(hex)
+			if err != nil {
+				return fmt.Errorf("banned pubkey: %w", err)
+			}
+			m.bannedPubkeys.Store(pubkey, reason)
+		}
+	}
+
+	if shadowChanged {
+		m.loadShadowBannedPubkeys()
+	} else {
+		for hex, reason := range snapshot.ShadowBannedPubkeys {
+			pubkey, err := nostr.PubKeyFromHex(hex)
+			if err != nil {
+				return fmt.Errorf("shadow banned pubkey: %w", err)
+			}
+			m.shadowBannedPubkeys.Store(pubkey, reason)
+		}
+	}
+
+	if eventsChanged {
+		m.loadBannedEvents()
+	} else {
+		for hex, reason := range snapshot.BannedEvents {
+			id, err := nostr.IDFromHex(hex)
+			if err != nil {
+				return fmt.Errorf("banned event: %w", err)
+			}
+			m.bannedEvents.Store(id, reason)
+		}
+	}
+
+	m.cachesWarmed = true
+	m.loadActivityOnStartup()
+
+	return nil
+}
+
+// Scheduling
+
+// SaveCacheSnapshots saves the instance's group and relay caches.
+func (instance *Instance) SaveCacheSnapshots(ctx context.Context) error {
+	return errors.Join(
+		instance.Management.SaveCacheSnapshot(ctx),
+		instance.Groups.SaveCacheSnapshot(ctx),
+	)
+}
+
+// StartCacheSnapshotter launches a background goroutine that saves every
+// instance's cache snapshot every cacheSnapshotInterval, and once more when
+// ctx is cancelled.
+func StartCacheSnapshotter(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(cacheSnapshotInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				final, cancel := context.WithTimeout(context.WithoutCancel(ctx), dbOpTimeout)
+				saveAllCacheSnapshots(final)
+				cancel()
+				return
+			case <-ticker.C:
+				saveAllCacheSnapshots(ctx)
+			}
+		}
+	}()
+}
+
+func saveAllCacheSnapshots(ctx context.Context) {
+	for _, inst := range GetAllInstances() {
+		if err := inst.SaveCacheSnapshots(ctx); err != nil {
+			log.Printf("Failed to save cache snapshot for %s: %v", inst.Config.Schema, err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package zooid
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+func populateSnapshotInstance(t *testing.T) *Instance {
+	t.Helper()
+
+	instance := createTestInstance()
+	instance.Config.Schema = instance.Events.Schema.Name
+	groups := instance.Groups
+
+	for _, h := range []string{"alpha", "beta"} {
+		create := nostr.Event{Kind: nostr.KindSimpleGroupCreateGroup, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"h", h}}}
+		if err := groups.Events.SignAndStoreEvent(&create, false); err != nil {
+			t.Fatalf("failed to store create event: %v", err)
+		}
+		groups.creatorCache.Store(h, create.PubKey)
+		groups.UpdateMetadata(nostr.Event{CreatedAt: nostr.Now(), Tags: nostr.Tags{{"h", h}}, Content: `{"name":"` + h + `"}`})
+		groups.membershipFullyLoaded.Store(h, struct{}{})
+		groups.AddMember(h, nostr.Generate().Public())
+		groups.UpdateMembersList(h)
+	}
+
+	instance.Management.AddMember(nostr.Generate().Public())
+	instance.Management.BanPubkey(nostr.Generate().Public(), "spam")
+
+	return instance
+}
+
+// restartStores returns fresh stores over the same database, as after a
+// restart.
+func restartStores(instance *Instance) (*ManagementStore, *GroupStore) {
+	management := &ManagementStore{Config: instance.Config, Events: instance.Events}
+	groups := &GroupStore{Config: instance.Config, Events: instance.Events, Management: management}
+	return management, groups
+}
+
+// countQueries returns how many event queries fn ran, going by the
+// per-schema query histogram.
+func countQueries(t *testing.T, instance *Instance, fn func()) uint64 {
+	t.Helper()
+	before, _ := readHistogram(t, QueryDuration, instance.Config.Schema)
+	fn()
+	after, _ := readHistogram(t, QueryDuration, instance.Config.Schema)
+	return after - before
+}
+
+func snapshotJSON(t *testing.T, m *ManagementStore, g *GroupStore) string {
+	t.Helper()
+	relay := m.snapshot()
+	relay.TakenAt = 0
+	data, err := json.Marshal(map[string]any{"groups": g.snapshot().Groups, "relay": relay})
+	if err != nil {
+		t.Fatalf("failed to marshal snapshot: %v", err)
+	}
+	return string(data)
+}
+
+func TestCacheSnapshot_Restore(t *testing.T) {
+	instance := populateSnapshotInstance(t)
+	if err := instance.SaveCacheSnapshots(context.Background()); err != nil {
+		t.Fatalf("SaveCacheSnapshots failed: %v", err)
+	}
+
+	// Changes after the snapshot must be replayed
+	late := nostr.Generate().Public()
+	instance.Groups.AddMember("alpha", late)
+	// A second after the join, so the replay order is unambiguous
+	gone := instance.Groups.GetMembers("beta")[0]
+	instance.Groups.RemoveMember("beta", gone)
+	remove := nostr.Event{Kind: nostr.KindSimpleGroupRemoveUser, CreatedAt: nostr.Now() + 1, Tags: nostr.Tags{{"p", gone.Hex()}, {"h", "beta"}}}
+	instance.Events.SignAndStoreEvent(&remove, false)
+	instance.Management.AddMember(late)
+
+	warmM, warmG := restartStores(instance)
+	full := countQueries(t, instance, func() {
+		warmM.WarmCaches(context.Background())
+		warmG.WarmCaches(context.Background())
+	})
+
+	restoredM, restoredG := restartStores(instance)
+	restored := countQueries(t, instance, func() {
+		restoredM.LoadCaches(context.Background())
+		restoredG.LoadCaches(context.Background())
+	})
+
+	if restored >= full {
+		t.Errorf("restoring ran %d queries, a full warm ran %d", restored, full)
+	}
+
+	if got, want := snapshotJSON(t, restoredM, restoredG), snapshotJSON(t, instance.Management, instance.Groups); got != want {
+		t.Errorf("restored caches differ from the running ones:\n got %s\nwant %s", got, want)
+	}
+
+	if !restoredG.IsMember("alpha", late) || !restoredM.IsMember(late) {
+		t.Error("member added after the snapshot is missing")
+	}
+	if len(restoredG.GetMembers("beta")) != 0 {
+		t.Error("member removed after the snapshot is still present")
+	}
+	if !restoredG.cachesWarmed || !restoredM.cachesWarmed {
+		t.Error("restored caches should count as warmed")
+	}
+}
+
+func TestCacheSnapshot_ReplaysBackdatedEvents(t *testing.T) {
+	instance := populateSnapshotInstance(t)
+	if err := instance.SaveCacheSnapshots(context.Background()); err != nil {
+		t.Fatalf("SaveCacheSnapshots failed: %v", err)
+	}
+
+	// Created an hour before the snapshot, but only received after it
+	late := nostr.Generate().Public()
+	put := nostr.Event{Kind: nostr.KindSimpleGroupPutUser, CreatedAt: nostr.Now() - 3600, Tags: nostr.Tags{{"p", late.Hex()}, {"h", "alpha"}}}
+	if err := instance.Events.SignAndStoreEvent(&put, false); err != nil {
+		t.Fatal(err)
+	}
+
+	_, restored := restartStores(instance)
+	if err := restored.LoadCaches(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.IsMember("alpha", late) {
+		t.Error("backdated put received after the snapshot wasn't replayed")
+	}
+}
+
+func TestCacheSnapshot_FallsBackToWarm(t *testing.T) {
+	instance := populateSnapshotInstance(t)
+	ctx := context.Background()
+	kv := snapshotKV(instance.Events)
+
+	stale := instance.Groups.snapshot()
+	stale.TakenAt = nostr.Timestamp(time.Now().Add(-2 * cacheSnapshotMaxAge).Unix())
+	otherVersion := instance.Groups.snapshot()
+	otherVersion.Version = cacheSnapshotVersion + 1
+
+	cases := map[string]func() error{
+		"corrupt":       func() error { return kv.Set(ctx, "snapshot:groups", "{not json") },
+		"stale":         func() error { return kv.SetJSON(ctx, "snapshot:groups", stale) },
+		"other version": func() error { return kv.SetJSON(ctx, "snapshot:groups", otherVersion) },
+		"bad pubkey": func() error {
+			return kv.Set(ctx, "snapshot:groups", `{"version":1,"taken_at":`+strconv.FormatInt(int64(nostr.Now()), 10)+`,"groups":{"alpha":{"members":["nope"]}}}`)
+		},
+	}
+
+	want := snapshotJSON(t, instance.Management, instance.Groups)
+
+	for name, store := range cases {
+		if err := store(); err != nil {
+			t.Fatalf("%s: failed to store snapshot: %v", name, err)
+		}
+
+		m, g := restartStores(instance)
+		m.LoadCaches(context.Background())
+		g.LoadCaches(context.Background())
+
+		if got := snapshotJSON(t, m, g); got != want {
+			t.Errorf("%s: caches differ from the running ones:\n got %s\nwant %s", name, got, want)
+		}
+	}
+}
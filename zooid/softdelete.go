@@ -0,0 +1,272 @@
+package zooid
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"github.com/Masterminds/squirrel"
+)
+
+// Soft deletion.
+//
+// Bans, group deletions, NIP-09 requests and moderators all delete events
+// through DeleteEvent, and a mistake used to be final. With
+// storage.soft_delete, DeleteEvent marks the event deleted instead of
+// removing it. Queries leave marked events out, tag filters included, as if
+// the row and its tags were gone, and RestoreEvent (restoreevent over NIP-86)
+// brings one back until the retention job purges it, soft_delete_window
+// after it was deleted. Publishing it again meanwhile is a duplicate, so it
+// stays deleted.
+//
+// Replaceable events a newer version replaces are still removed for good,
+// and an event that was replaced while it was deleted can't be restored.
+
+// ErrNotDeleted is returned by RestoreEvent for an event that isn't
+// soft-deleted: live, purged already, or never stored.
+var ErrNotDeleted = errors.New("event isn't deleted, or was purged")
+
+// ErrRestoreReplaced is returned by RestoreEvent for a replaceable event
+// that a newer one replaced while it was deleted.
+var ErrRestoreReplaced = errors.New("event was replaced by a newer one since it was deleted")
+
+// RestoreEvent brings back the soft-deleted event with id.
+func (events *EventStore) RestoreEvent(id nostr.ID) error {
+	return events.backend().restore(id)
+}
+
+// RestoreEvent restores the event with id, and takes it off the banned
+// events list if it's on it, so it's served again.
+func (m *ManagementStore) RestoreEvent(id nostr.ID) error {
+	if err := m.Events.RestoreEvent(id); err != nil {
+		return err
+	}
+
+	if m.EventIsBanned(id) {
+		return m.AllowEvent(id, "")
+	}
+
+	return nil
+}
+
+// RestoreEvent restores the event with id and caches it again as
+// OnEventSaved did, the reverse of DeleteEvent. A restored put user, remove
+// user or edit metadata event is applied again too, since the group's
+// caches may have been rebuilt without it while it was deleted.
+func (instance *Instance) RestoreEvent(ctx context.Context, id nostr.ID) error {
+	if err := instance.Management.RestoreEvent(id); err != nil {
+		return err
+	}
+
+	for event := range instance.Events.QueryEvents(nostr.Filter{IDs: []nostr.ID{id}}, 1) {
+		instance.Groups.rememberEventGroup(event)
+		instance.rememberRelayList(event)
+
+		switch event.Kind {
+		case nostr.KindSimpleGroupPutUser, nostr.KindSimpleGroupRemoveUser, nostr.KindSimpleGroupEditMetadata:
+			instance.applyGroupEvent(event)
+		}
+	}
+
+	return nil
+}
+
+// purgeDeletedEvents removes the events soft-deleted more than
+// soft_delete_window ago, for the retention cleaner. It runs whether or not
+// soft_delete is on, so none are left behind when it's turned off.
+func purgeDeletedEvents(ctx context.Context, inst *Instance) int64 {
+	before := nostr.Timestamp(time.Now().Add(-inst.Config.GetSoftDeleteWindow()).Unix())
+
+	var totalDeleted int64
+	for {
+		rows, more, err := inst.Events.backend().purgeDeleted(ctx, before)
+		if err != nil {
+			log.Printf("retention: %s for deleted events", err)
+			return totalDeleted
+		}
+		totalDeleted += rows
+		if !more {
+			break
+		}
+	}
+	return totalDeleted
+}
+
+func (events sqlEvents) softDelete(id nostr.ID, at nostr.Timestamp) error {
+	ctx, cancel := context.WithTimeout(events.rootCtx, dbOpTimeout)
+	defer cancel()
+
+	release, err := events.slots.acquire(ctx, events.reserved)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	_, err = sb.Update(events.Schema.Prefix("events")).
+		Set("deleted_at", int64(at)).
+		Where(squirrel.Eq{"id": id.Hex(), "deleted_at": nil}).
+		RunWith(GetDb()).
+		ExecContext(ctx)
+	return err
+}
+
+// restore clears deleted_at in a serializable transaction, like replace, so
+// a newer version can't be stored between the check and the update.
+func (events sqlEvents) restore(id nostr.ID) error {
+	ctx, cancel := context.WithTimeout(events.rootCtx, saveEventTxTimeout)
+	defer cancel()
+
+	release, err := events.slots.acquire(ctx, events.reserved)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	tx, err := GetDb().BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var row eventRow
+	err = sb.Select(eventColumns...).
+		From(events.Schema.Prefix("events")).
+		Where(squirrel.Eq{"id": id.Hex()}).
+		Where("deleted_at IS NOT NULL").
+		RunWith(tx).
+		QueryRowContext(ctx).
+		Scan(&row.id, &row.createdAt, &row.kind, &row.pubkey, &row.content, &row.tags, &row.sig, &row.zstd)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotDeleted
+	} else if err != nil {
+		return fmt.Errorf("failed to look up deleted event: %w", err)
+	}
+
+	evt, err := row.event()
+	if err != nil {
+		return err
+	}
+
+	if evt.Kind.IsReplaceable() || evt.Kind.IsAddressable() {
+		restore, replaced := replacement(evt, events.queryEventsWith(ctx, tx, replaceableFilter(evt), 0, newestFirst))
+		if !restore {
+			return ErrRestoreReplaced
+		}
+
+		for _, id := range replaced {
+			if err := events.deleteEventWith(ctx, tx, id); err != nil {
+				return fmt.Errorf("failed to delete old event: %w", err)
+			}
+		}
+	}
+
+	_, err = sb.Update(events.Schema.Prefix("events")).
+		Set("deleted_at", nil).
+		Where(squirrel.Eq{"id": id.Hex()}).
+		RunWith(tx).
+		ExecContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to restore event: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// purgeDeleted removes a batch of the events deleted before before. Tags go
+// with them through the cascade.
+func (events sqlEvents) purgeDeleted(ctx context.Context, before nostr.Timestamp) (rowsAffected int64, more bool, err error) {
+	subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
+	defer cancel()
+
+	table := events.Schema.Prefix("events")
+	// Nested, so with ? placeholders for the outer query to number
+	ids := squirrel.Select("id").
+		From(table).
+		Where(squirrel.Lt{"deleted_at": int64(before)}).
+		Limit(retentionDeleteBatchSize)
+
+	result, err := sb.Delete(table).
+		Where(squirrel.Expr("id IN (?)", ids)).
+		RunWith(GetDb()).
+		ExecContext(subctx)
+	if err != nil {
+		return 0, false, fmt.Errorf("exec delete: %w", err)
+	}
+
+	rowsAffected, err = result.RowsAffected()
+	if err != nil {
+		return 0, false, fmt.Errorf("rows affected: %w", err)
+	}
+	return rowsAffected, rowsAffected >= retentionDeleteBatchSize, nil
+}
+
+func (events memoryEvents) softDelete(id nostr.ID, at nostr.Timestamp) error {
+	events.tables.mu.Lock()
+	defer events.tables.mu.Unlock()
+
+	if i := events.tables.index(id); i >= 0 && events.tables.events[i].deletedAt == 0 {
+		events.tables.events[i].deletedAt = at
+	}
+
+	return nil
+}
+
+func (events memoryEvents) restore(id nostr.ID) error {
+	events.tables.mu.Lock()
+	defer events.tables.mu.Unlock()
+
+	i := events.tables.index(id)
+	if i < 0 || events.tables.events[i].deletedAt == 0 {
+		return ErrNotDeleted
+	}
+
+	evt := events.tables.events[i].event
+	if evt.Kind.IsReplaceable() || evt.Kind.IsAddressable() {
+		previous := func(yield func(nostr.Event) bool) {
+			for match := range events.tables.matching(replaceableFilter(evt)) {
+				if !yield(match.event) {
+					return
+				}
+			}
+		}
+
+		restore, replaced := replacement(evt, previous)
+		if !restore {
+			return ErrRestoreReplaced
+		}
+
+		for _, id := range replaced {
+			events.tables.remove(id)
+		}
+	}
+
+	events.tables.events[events.tables.index(id)].deletedAt = 0
+
+	return nil
+}
+
+func (events memoryEvents) purgeDeleted(ctx context.Context, before nostr.Timestamp) (rowsAffected int64, more bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, false, err
+	}
+
+	events.tables.mu.Lock()
+	defer events.tables.mu.Unlock()
+
+	events.tables.events = slices.DeleteFunc(events.tables.events, func(stored memoryEvent) bool {
+		if stored.deletedAt == 0 || stored.deletedAt >= before {
+			return false
+		}
+
+		delete(events.tables.ids, stored.event.ID)
+		rowsAffected++
+		return true
+	})
+
+	return rowsAffected, false, nil
+}
@@ -0,0 +1,167 @@
+package zooid
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+)
+
+func TestSoftDelete_Restore(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Storage.SoftDelete = true
+
+	event := createTestEvent(nostr.KindTextNote, "deleted by mistake")
+	if err := instance.Events.SaveEvent(event); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := instance.Management.BanEvent(event.ID, "oops"); err != nil {
+		t.Fatal(err)
+	}
+
+	byID := nostr.Filter{IDs: []nostr.ID{event.ID}}
+	byTag := nostr.Filter{Tags: nostr.TagMap{"t": []string{"test"}}}
+	for _, filter := range []nostr.Filter{byID, byTag} {
+		if n, _ := instance.Events.CountEvents(filter); n != 0 {
+			t.Errorf("a soft-deleted event matches %v", filter)
+		}
+	}
+
+	// Publishing it again doesn't bring it back
+	if err := instance.Events.SaveEvent(event); !errors.Is(err, eventstore.ErrDupEvent) {
+		t.Errorf("SaveEvent of a soft-deleted event = %v, want a duplicate", err)
+	}
+	if n, _ := instance.Events.CountEvents(byID); n != 0 {
+		t.Error("publishing a soft-deleted event again restored it")
+	}
+
+	if err := instance.RestoreEvent(context.Background(), event.ID); err != nil {
+		t.Fatal(err)
+	}
+	if restored := firstEvent(t, instance, byTag); restored.ID != event.ID {
+		t.Errorf("the restored event isn't found by its tags, got %s", restored.ID)
+	}
+	if instance.Management.EventIsBanned(event.ID) {
+		t.Error("the restored event is still banned")
+	}
+
+	if err := instance.Events.RestoreEvent(event.ID); err != ErrNotDeleted {
+		t.Errorf("RestoreEvent of a live event = %v, want %v", err, ErrNotDeleted)
+	}
+}
+
+func TestSoftDelete_Purge(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Storage.SoftDelete = true
+
+	event := createTestEvent(nostr.KindTextNote, "deleted for good")
+	if err := instance.Events.SaveEvent(event); err != nil {
+		t.Fatal(err)
+	}
+	if err := instance.Events.DeleteEvent(event.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleted just now, well within the window
+	if purged := purgeDeletedEvents(context.Background(), instance); purged != 0 {
+		t.Errorf("purged %d events deleted within the window", purged)
+	}
+
+	if n, _, err := instance.Events.backend().purgeDeleted(context.Background(), nostr.Now()+1); err != nil || n != 1 {
+		t.Fatalf("purgeDeleted = %d, %v; want the deleted event purged", n, err)
+	}
+
+	if err := instance.Events.RestoreEvent(event.ID); err != ErrNotDeleted {
+		t.Errorf("RestoreEvent of a purged event = %v, want %v", err, ErrNotDeleted)
+	}
+
+	// Gone for good, so it can be published again
+	if err := instance.Events.SaveEvent(event); err != nil {
+		t.Errorf("SaveEvent of a purged event = %v", err)
+	}
+}
+
+func TestSoftDelete_RestoreReplaced(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Storage.SoftDelete = true
+
+	secret := nostr.Generate()
+	version := func(name string, at nostr.Timestamp) nostr.Event {
+		event := nostr.Event{Kind: nostr.KindProfileMetadata, CreatedAt: at, Content: `{"name":"` + name + `"}`}
+		event.Sign(secret)
+		return event
+	}
+
+	old := version("old", 100)
+	if err := instance.Events.ReplaceEvent(old); err != nil {
+		t.Fatal(err)
+	}
+	if err := instance.Events.DeleteEvent(old.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	newer := version("new", 200)
+	if err := instance.Events.ReplaceEvent(newer); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := instance.Events.RestoreEvent(old.ID); err != ErrRestoreReplaced {
+		t.Errorf("RestoreEvent of a replaced profile = %v, want %v", err, ErrRestoreReplaced)
+	}
+
+	// Restoring the newer one replaces the older one that took its place
+	if err := instance.Events.DeleteEvent(newer.ID); err != nil {
+		t.Fatal(err)
+	}
+	older := version("older", 150)
+	if err := instance.Events.ReplaceEvent(older); err != nil {
+		t.Fatal(err)
+	}
+	if err := instance.Events.RestoreEvent(newer.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	profile := nostr.Filter{Kinds: []nostr.Kind{nostr.KindProfileMetadata}, Authors: []nostr.PubKey{secret.Public()}}
+	if n, _ := instance.Events.CountEvents(profile); n != 1 {
+		t.Errorf("%d profiles after restoring the newest, want 1", n)
+	}
+	if got := firstEvent(t, instance, profile); got.ID != newer.ID {
+		t.Errorf("the profile is %s, want the restored one", got.Content)
+	}
+}
+
+func TestSoftDelete_RestoreAppliesMembership(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Storage.SoftDelete = true
+	ctx := context.Background()
+	runTestAdmin(t, instance, "create-group", "restored")
+
+	alice := nostr.Generate().Public()
+	put := signedBy(instance.Config.secret, nostr.Event{
+		Kind: nostr.KindSimpleGroupPutUser,
+		Tags: nostr.Tags{{"h", "restored"}, {"p", alice.Hex()}},
+	})
+	if err := instance.Events.SaveEvent(put); err != nil {
+		t.Fatal(err)
+	}
+	instance.OnEventSaved(ctx, put)
+
+	// Deleted by mistake, and the cache repaired to match the log
+	if err := instance.DeleteEvent(ctx, put.ID); err != nil {
+		t.Fatal(err)
+	}
+	instance.Groups.verifyMembership("restored", true)
+	if instance.Groups.IsMember("restored", alice) {
+		t.Fatal("the repair should have dropped the member")
+	}
+
+	if err := instance.RestoreEvent(ctx, put.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !instance.Groups.IsMember("restored", alice) {
+		t.Error("restoring the put user event didn't make its member a member again")
+	}
+}
@@ -0,0 +1,227 @@
+package zooid
+
+import (
+	"crypto/sha256"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// Spam checks.
+//
+// OnEvent asks Instance.SpamChecker about every stored event it would
+// otherwise accept, except deletions and events from relay admins. The
+// checker sees the event, who is publishing it and a SpamHistory of recent
+// posts, and can allow it, deny it, or shadow it: a shadowed event gets an
+// OK but is never stored or broadcast, so its sender doesn't learn to try
+// something else.
+//
+// The built-in checker, enabled by spam.duplicates, is for waves of the same
+// message posted across groups from throwaway keys. Content is normalized
+// (case and whitespace) and hashed, and a group post is refused once the
+// same content has been posted more than spam.duplicates times within
+// spam.window by people who aren't members of the groups they posted to, in
+// more than one group. Members and admins of the group are never refused.
+// Only spamKinds count: reactions and the like repeat the same few strings
+// by nature.
+
+const (
+	defaultSpamWindow = 10 * time.Minute
+
+	// spamHistorySweep is how many posts are recorded between sweeps of
+	// posts that have left the window.
+	spamHistorySweep = 1000
+)
+
+// spamKinds are the kinds whose content the built-in checker compares:
+// chat messages, threads and comments.
+var spamKinds = slices.Concat(chatKinds, []nostr.Kind{11, 1111})
+
+// SpamVerdict is what a SpamChecker decides about an event.
+type SpamVerdict int
+
+const (
+	SpamAllow SpamVerdict = iota
+	SpamDeny
+	SpamShadow
+)
+
+// SpamChecker decides whether an event is spam. pubkey is who published it.
+type SpamChecker interface {
+	CheckSpam(event nostr.Event, pubkey nostr.PubKey, history *SpamHistory) SpamVerdict
+}
+
+// SpamPost is one recorded post of some content.
+type SpamPost struct {
+	Group  string // empty outside groups
+	Kind   nostr.Kind
+	PubKey nostr.PubKey
+	Member bool // whether PubKey was a member of Group
+	At     time.Time
+}
+
+// SpamHistory remembers who posted what, by content hash, for spam.window.
+// Every event the checker is asked about is recorded after it decides,
+// whatever the verdict. The zero value keeps posts for ten minutes.
+type SpamHistory struct {
+	window time.Duration
+
+	mu       sync.Mutex
+	posts    map[[32]byte][]SpamPost
+	recorded int
+}
+
+// ContentHash hashes content after lowercasing it and collapsing whitespace,
+// so trivial variations of a message hash the same.
+func ContentHash(content string) [32]byte {
+	return sha256.Sum256([]byte(strings.Join(strings.Fields(strings.ToLower(content)), " ")))
+}
+
+// Posts returns the posts of content with hash that are still in the window.
+func (h *SpamHistory) Posts(hash [32]byte, now time.Time) []SpamPost {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]SpamPost(nil), h.prune(hash, now)...)
+}
+
+// Record remembers a post of content.
+func (h *SpamHistory) Record(content string, post SpamPost) {
+	if strings.TrimSpace(content) == "" {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.posts == nil {
+		h.posts = make(map[[32]byte][]SpamPost)
+	}
+
+	hash := ContentHash(content)
+	h.posts[hash] = append(h.prune(hash, post.At), post)
+
+	h.recorded++
+	if h.recorded%spamHistorySweep == 0 {
+		for hash := range h.posts {
+			h.prune(hash, post.At)
+		}
+	}
+}
+
+// prune drops the posts of hash that have left the window and returns the
+// rest.
+func (h *SpamHistory) prune(hash [32]byte, now time.Time) []SpamPost {
+	posts := h.posts[hash]
+
+	window := h.window
+	if window <= 0 {
+		window = defaultSpamWindow
+	}
+
+	i := 0
+	for i < len(posts) && now.Sub(posts[i].At) > window {
+		i++
+	}
+	posts = posts[i:]
+
+	if len(posts) == 0 {
+		delete(h.posts, hash)
+		return nil
+	}
+
+	h.posts[hash] = posts
+	return posts
+}
+
+// duplicateChecker refuses content posted too often across groups by
+// non-members.
+type duplicateChecker struct {
+	groups  *GroupStore
+	limit   int
+	verdict SpamVerdict
+}
+
+func (c *duplicateChecker) CheckSpam(event nostr.Event, pubkey nostr.PubKey, history *SpamHistory) SpamVerdict {
+	h := GetGroupIDFromEvent(event)
+	if h == "" || !slices.Contains(spamKinds, event.Kind) || strings.TrimSpace(event.Content) == "" {
+		return SpamAllow
+	}
+	if c.groups.IsMember(h, pubkey) || c.groups.IsAdmin(h, pubkey) {
+		return SpamAllow
+	}
+
+	count := 1
+	groups := map[string]struct{}{h: {}}
+	for _, post := range history.Posts(ContentHash(event.Content), time.Now()) {
+		if post.Group != "" && !post.Member && slices.Contains(spamKinds, post.Kind) {
+			count++
+			groups[post.Group] = struct{}{}
+		}
+	}
+
+	if count > c.limit && len(groups) > 1 {
+		return c.verdict
+	}
+
+	return SpamAllow
+}
+
+// checkSpam asks the spam checker about event and records it in the
+// history.
+func (instance *Instance) checkSpam(pubkey nostr.PubKey, event nostr.Event) (reject bool, msg string) {
+	if instance.SpamChecker == nil || event.Kind.IsEphemeral() || event.Kind == nostr.KindDeletion || instance.Config.CanManage(pubkey) {
+		return false, ""
+	}
+
+	verdict := instance.SpamChecker.CheckSpam(event, pubkey, &instance.spamHistory)
+
+	h := GetGroupIDFromEvent(event)
+	instance.spamHistory.Record(event.Content, SpamPost{
+		Group:  h,
+		Kind:   event.Kind,
+		PubKey: pubkey,
+		Member: h != "" && instance.Groups.IsMember(h, pubkey),
+		At:     time.Now(),
+	})
+
+	switch verdict {
+	case SpamDeny:
+		return RejectBlocked.Reject("this looks like spam")
+	case SpamShadow:
+		instance.shadowed.Store(event.ID, struct{}{})
+	}
+
+	return false, ""
+}
+
+// isShadowed reports whether event was shadowed, forgetting it: the store
+// hooks call this once, and pretend the event was a duplicate.
+func (instance *Instance) isShadowed(event nostr.Event) bool {
+	_, ok := instance.shadowed.LoadAndDelete(event.ID)
+	return ok
+}
+
+// startSpamChecker sets up the built-in checker if spam.duplicates is set.
+// An embedder's own checker is left alone.
+func (instance *Instance) startSpamChecker() {
+	instance.spamHistory.window = instance.Config.GetSpamWindow()
+
+	if instance.SpamChecker != nil || instance.Config.Spam.Duplicates <= 0 {
+		return
+	}
+
+	verdict := SpamDeny
+	if instance.Config.Spam.Shadow {
+		verdict = SpamShadow
+	}
+
+	instance.SpamChecker = &duplicateChecker{
+		groups:  instance.Groups,
+		limit:   instance.Config.Spam.Duplicates,
+		verdict: verdict,
+	}
+}
@@ -0,0 +1,146 @@
+package zooid
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+)
+
+func TestSpamHistory_SlidingWindow(t *testing.T) {
+	var history SpamHistory
+	hash := ContentHash("free airdrop")
+	start := time.Now()
+
+	history.Record("Free   AIRDROP", SpamPost{Group: "a", At: start})
+	history.Record("free airdrop\n", SpamPost{Group: "b", At: start.Add(5 * time.Minute)})
+	history.Record("something else", SpamPost{Group: "c", At: start.Add(5 * time.Minute)})
+
+	if posts := history.Posts(hash, start.Add(5*time.Minute)); len(posts) != 2 {
+		t.Errorf("%d posts of normalized content, want 2", len(posts))
+	}
+	if posts := history.Posts(hash, start.Add(11*time.Minute)); len(posts) != 1 || posts[0].Group != "b" {
+		t.Errorf("posts = %+v, want only the one still in the window", posts)
+	}
+	if posts := history.Posts(hash, start.Add(30*time.Minute)); len(posts) != 0 {
+		t.Errorf("%d posts after the window, want 0", len(posts))
+	}
+	if _, ok := history.posts[hash]; ok {
+		t.Error("content with no posts left should be forgotten")
+	}
+}
+
+func TestDuplicateChecker_AcrossGroups(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+	instance.Config.Spam.Duplicates = 2
+	instance.startSpamChecker()
+
+	for _, h := range []string{"one", "two", "three", "four"} {
+		runTestAdmin(t, instance, "create-group", h)
+	}
+	member := nostr.Generate()
+	runTestAdmin(t, instance, "add-member", "three", member.Public().Hex())
+
+	post := func(author nostr.SecretKey, h string) (bool, string) {
+		event := signedBy(author, nostr.Event{
+			Kind:    nostr.KindSimpleGroupChatMessage,
+			Content: "Claim your AIRDROP now!",
+			Tags:    nostr.Tags{{"h", h}},
+		})
+		return instance.OnEvent(authedContext(author.Public()), event)
+	}
+
+	// Throwaway keys, none of them members
+	for _, h := range []string{"one", "two"} {
+		if reject, msg := post(nostr.Generate(), h); reject {
+			t.Fatalf("post in %s refused: %s", h, msg)
+		}
+	}
+
+	reject, msg := post(nostr.Generate(), "three")
+	if !reject {
+		t.Fatal("content posted across groups more than the limit allowed")
+	}
+	assertPrefix(t, "duplicate content", msg, RejectBlocked)
+
+	// Members of the group, and relay admins, are exempt
+	if reject, msg := post(member, "three"); reject {
+		t.Errorf("member refused: %s", msg)
+	}
+	if reject, msg := post(instance.Config.secret, "four"); reject {
+		t.Errorf("relay admin refused: %s", msg)
+	}
+}
+
+func TestDuplicateChecker_Shadow(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+	instance.Config.Spam.Duplicates = 1
+	instance.Config.Spam.Shadow = true
+	instance.startSpamChecker()
+
+	runTestAdmin(t, instance, "create-group", "one")
+	runTestAdmin(t, instance, "create-group", "two")
+
+	first := signedBy(nostr.Generate(), nostr.Event{Kind: nostr.KindSimpleGroupChatMessage, Content: "spam", Tags: nostr.Tags{{"h", "one"}}})
+	second := signedBy(nostr.Generate(), nostr.Event{Kind: nostr.KindSimpleGroupChatMessage, Content: "spam", Tags: nostr.Tags{{"h", "two"}}})
+
+	for _, event := range []nostr.Event{first, second} {
+		if reject, msg := instance.OnEvent(authedContext(event.PubKey), event); reject {
+			t.Fatalf("shadowed event refused: %s", msg)
+		}
+	}
+
+	if err := instance.StoreEvent(context.Background(), first); err != nil {
+		t.Fatal(err)
+	}
+	if err := instance.StoreEvent(context.Background(), second); err != eventstore.ErrDupEvent {
+		t.Fatalf("storing a shadowed event returned %v, want a pretend duplicate", err)
+	}
+
+	for range instance.Events.QueryEvents(nostr.Filter{IDs: []nostr.ID{second.ID}}, 1) {
+		t.Error("the shadowed event was stored")
+	}
+}
+
+func TestDuplicateChecker_OnlyContentKinds(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+	instance.Config.Spam.Duplicates = 1
+	instance.startSpamChecker()
+
+	for _, h := range []string{"one", "two", "three"} {
+		runTestAdmin(t, instance, "create-group", h)
+	}
+
+	publish := func(kind nostr.Kind, h string) (bool, string) {
+		author := nostr.Generate()
+		tags := nostr.Tags{}
+		if h != "" {
+			tags = append(tags, nostr.Tag{"h", h})
+		}
+		event := signedBy(author, nostr.Event{Kind: kind, Content: "+", Tags: tags})
+		return instance.OnEvent(authedContext(author.Public()), event)
+	}
+
+	// Reactions repeat the same content across groups all the time
+	for _, h := range []string{"one", "two", "three"} {
+		if reject, msg := publish(nostr.KindReaction, h); reject {
+			t.Fatalf("reaction in %s refused: %s", h, msg)
+		}
+	}
+
+	// Neither they nor posts outside groups count against a chat message
+	if reject, msg := publish(nostr.KindTextNote, ""); reject {
+		t.Fatalf("note outside groups refused: %s", msg)
+	}
+	if reject, msg := publish(nostr.KindSimpleGroupChatMessage, "one"); reject {
+		t.Fatalf("first chat message refused: %s", msg)
+	}
+	if reject, _ := publish(nostr.KindSimpleGroupChatMessage, "two"); !reject {
+		t.Error("repeated chat message across groups allowed")
+	}
+}
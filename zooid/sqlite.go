@@ -0,0 +1,301 @@
+package zooid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"fiatjaf.com/nostr"
+	"github.com/Masterminds/squirrel"
+)
+
+// SQLite.
+//
+// DATABASE_URL=sqlite:///var/lib/zooid/zooid.db keeps everything in one
+// SQLite file, for a small community that doesn't want to run PostgreSQL.
+// The driver needs cgo, and search needs FTS5, so build with
+//
+//	CGO_ENABLED=1 go build -tags sqlite_fts5
+//
+// The file is opened in WAL mode, so reads never wait for writes, and
+// transactions take the write lock as they begin, so writers queue up one at
+// a time instead of failing when two try to upgrade their read locks. A
+// writer waits up to dbOpTimeout for its turn.
+//
+// The SQL is the same as on PostgreSQL except for:
+//   - tables, which are created at their current shape, so migrations are
+//     recorded as applied without running. Columns added since SQLite was
+//     first supported are added to older files before the indexes.
+//   - search, which uses an FTS5 table kept up to date by triggers and
+//     matches whole words, without stemming, whatever search_language says
+//   - compression, which is off, since the triggers can't read compressed
+//     contents
+//   - getOrCreate's advisory lock, which is a mutex, since only one process
+//     can use the file
+//   - native_schema, reindexing and table sizes, which aren't available
+
+// sqliteDSN returns the go-sqlite3 data source name for the file at path.
+func sqliteDSN(path string) string {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+
+	return fmt.Sprintf("file:%s%s_foreign_keys=1&_journal_mode=WAL&_txlock=immediate&_busy_timeout=%d",
+		path, separator, dbOpTimeout.Milliseconds())
+}
+
+// initSQLite creates the schema's tables, indexes and search table.
+func (events *EventStore) initSQLite() error {
+	if events.Schema.Native {
+		return errors.New("storage.native_schema needs PostgreSQL")
+	}
+
+	statements := []string{
+		events.Schema.Render(`
+			CREATE TABLE IF NOT EXISTS {{.Prefix "events"}} (
+				id TEXT PRIMARY KEY,
+				created_at BIGINT NOT NULL,
+				kind INTEGER NOT NULL,
+				pubkey TEXT NOT NULL,
+				content TEXT NOT NULL,
+				tags TEXT NOT NULL,
+				sig TEXT NOT NULL,
+				content_zstd BLOB,
+				compressed BOOLEAN NOT NULL DEFAULT false,
+				received_at BIGINT,
+				deleted_at BIGINT
+			)`),
+		events.Schema.Render(`
+			CREATE TABLE IF NOT EXISTS {{.Prefix "event_tags"}} (
+				event_id TEXT NOT NULL,
+				key TEXT NOT NULL,
+				value TEXT NOT NULL,
+				kind INTEGER,
+				FOREIGN KEY (event_id) REFERENCES {{.Prefix "events"}}(id) ON DELETE CASCADE
+			)`),
+	}
+
+	for _, idx := range slices.Concat(initIndexes, migratedIndexes) {
+		statements = append(statements, events.Schema.Render(idx.create(false)))
+	}
+
+	// Only the rowid is stored, the text stays in the events table
+	statements = append(statements,
+		events.Schema.Render(`
+			CREATE VIRTUAL TABLE IF NOT EXISTS {{.Prefix "events_search"}} USING fts5(
+				content, tags, content = '', contentless_delete = 1,
+				tokenize = 'unicode61 remove_diacritics 2'
+			)`),
+		events.Schema.Render(`
+			CREATE TRIGGER IF NOT EXISTS {{.Trigger "events_search_insert"}}
+			AFTER INSERT ON {{.Prefix "events"}} BEGIN
+				`+sqliteSearchInsert+`;
+			END`),
+		events.Schema.Render(`
+			CREATE TRIGGER IF NOT EXISTS {{.Trigger "events_search_update"}}
+			AFTER UPDATE OF content, tags ON {{.Prefix "events"}} BEGIN
+				DELETE FROM {{.Prefix "events_search"}} WHERE rowid = OLD.rowid;
+				`+sqliteSearchInsert+`;
+			END`),
+		events.Schema.Render(`
+			CREATE TRIGGER IF NOT EXISTS {{.Trigger "events_search_delete"}}
+			AFTER DELETE ON {{.Prefix "events"}} BEGIN
+				DELETE FROM {{.Prefix "events_search"}} WHERE rowid = OLD.rowid;
+			END`),
+	)
+
+	// Files from before received_at or deleted_at don't have them, and
+	// their indexes need them
+	if err := events.addSQLiteColumns(); err != nil {
+		return fmt.Errorf("schema init failed: %w", err)
+	}
+
+	for _, stmt := range statements {
+		if _, err := GetDb().ExecContext(events.rootCtx, stmt); err != nil {
+			if strings.Contains(err.Error(), "no such module: fts5") {
+				return fmt.Errorf("schema init failed: SQLite was built without FTS5, build with -tags sqlite_fts5")
+			}
+			return fmt.Errorf("schema init failed: %w", err)
+		}
+	}
+
+	if err := RunMigrations(events.rootCtx, events.Schema); err != nil {
+		return fmt.Errorf("migrations failed: %w", err)
+	}
+
+	return nil
+}
+
+// sqliteAddedColumns are the events columns added since SQLite was first
+// supported, and what fills them in for the rows already there, as their
+// migrations do on PostgreSQL.
+var sqliteAddedColumns = []struct{ name, backfill string }{
+	{"received_at", "created_at"},
+	{"deleted_at", ""},
+}
+
+// addSQLiteColumns adds sqliteAddedColumns to an events table created
+// without them.
+func (events *EventStore) addSQLiteColumns() error {
+	table := events.Schema.Prefix("events")
+
+	for _, column := range sqliteAddedColumns {
+		var columns, has int
+		query := "SELECT COUNT(*), COALESCE(SUM(name = $1), 0) FROM pragma_table_info($2)"
+		if err := GetDb().QueryRowContext(events.rootCtx, query, column.name, events.Schema.RelName("events")).Scan(&columns, &has); err != nil {
+			return err
+		}
+
+		// Not created yet, or already there
+		if columns == 0 || has > 0 {
+			continue
+		}
+
+		statements := []string{"ALTER TABLE " + table + " ADD COLUMN " + column.name + " BIGINT"}
+		if column.backfill != "" {
+			statements = append(statements, "UPDATE "+table+" SET "+column.name+" = "+column.backfill)
+		}
+		for _, stmt := range statements {
+			if _, err := GetDb().ExecContext(events.rootCtx, stmt); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// sqliteSearchInsert indexes the NEW row of a trigger, with the same tags
+// as searchVector.
+const sqliteSearchInsert = `
+	INSERT INTO {{.Prefix "events_search"}} (rowid, content, tags)
+	VALUES (NEW.rowid, NEW.content, (
+		SELECT group_concat(value ->> 1, ' ')
+		FROM json_each(NEW.tags)
+		WHERE value ->> 0 IN ('t', 'title', 'summary', 'subject')
+	))`
+
+// sqliteSearch matches events against search, col being "" or the events
+// table's alias followed by a dot.
+func (events *EventStore) sqliteSearch(col string, search string) squirrel.Sqlizer {
+	query := ftsQuery(search)
+	if query == "" {
+		return squirrel.Expr("1 = 0")
+	}
+
+	table := events.Schema.Prefix("events_search")
+	return squirrel.Expr(col+"rowid IN (SELECT rowid FROM "+table+" WHERE "+table+" MATCH ?)", query)
+}
+
+// ftsQuery turns a search into an FTS5 query that reads it the way
+// websearch_to_tsquery does, see parseSearch. Every term is quoted, so
+// nothing typed is FTS5 syntax and the query always parses. A search with
+// nothing to match returns "".
+func ftsQuery(search string) string {
+	clauses, exclude := parseSearch(search)
+	if len(clauses) == 0 {
+		return ""
+	}
+
+	terms := make([]string, len(clauses))
+	for i, clause := range clauses {
+		quoted := make([]string, len(clause))
+		for j, term := range clause {
+			quoted[j] = quoteFTS(term)
+		}
+		terms[i] = strings.Join(quoted, " OR ")
+		if len(clause) > 1 {
+			terms[i] = "(" + terms[i] + ")"
+		}
+	}
+
+	query := strings.Join(terms, " AND ")
+	for _, term := range exclude {
+		query += " NOT " + quoteFTS(term)
+	}
+
+	return query
+}
+
+// parseSearch splits a search the way websearch_to_tsquery reads it: words
+// and "quoted phrases" must all match, unless joined by or, and -word
+// excludes. Each clause matches if any of its terms does.
+func parseSearch(search string) (clauses [][]string, exclude []string) {
+	or := false
+
+	add := func(term string) {
+		if or {
+			clauses[len(clauses)-1] = append(clauses[len(clauses)-1], term)
+		} else {
+			clauses = append(clauses, []string{term})
+		}
+		or = false
+	}
+
+	for i, part := range strings.Split(search, `"`) {
+		if i%2 == 1 {
+			if phrase := strings.Join(strings.Fields(part), " "); phrase != "" {
+				add(phrase)
+			}
+			continue
+		}
+
+		for _, word := range strings.Fields(part) {
+			switch {
+			case strings.EqualFold(word, "or"):
+				or = len(clauses) > 0
+			case len(word) > 1 && word[0] == '-':
+				exclude = append(exclude, word[1:])
+				or = false
+			default:
+				add(word)
+			}
+		}
+	}
+
+	return clauses, exclude
+}
+
+func quoteFTS(term string) string {
+	return `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+}
+
+// creationLocks serializes getOrCreate on SQLite and in memory, one mutex
+// per lock key.
+var creationLocks sync.Map // map[int64]*sync.Mutex
+
+// getOrCreateLocally is getOrCreate for SQLite and memory, where only this
+// process can be creating the event.
+func (events *EventStore) getOrCreateLocally(name string, filter nostr.Filter, create func() nostr.Event) nostr.Event {
+	lock, _ := creationLocks.LoadOrStore(events.advisoryLockKey(name), &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	for event := range events.QueryEvents(filter, 1) {
+		return event
+	}
+
+	event := create()
+	if err := events.SignAndStoreEvent(&event, false); err != nil && !errors.Is(err, ErrReadOnly) {
+		log.Printf("Failed to create %q: %v", name, err)
+	}
+
+	return event
+}
+
+// sqliteReindex creates any missing indexes. SQLite has no concurrent or
+// invalid indexes, so that's all Reindex can do.
+func (events *EventStore) sqliteReindex(ctx context.Context) error {
+	for _, idx := range slices.Concat(initIndexes, migratedIndexes) {
+		if _, err := GetDb().ExecContext(ctx, events.Schema.Render(idx.create(false))); err != nil {
+			return fmt.Errorf("creating index %s: %w", idx.Name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package zooid
+
+import (
+	"slices"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestFTSQuery(t *testing.T) {
+	tests := []struct {
+		search string
+		want   string
+	}{
+		{"bitcoin", `"bitcoin"`},
+		{"bitcoin  nostr", `"bitcoin" AND "nostr"`},
+		{`"digital  currency" nostr`, `"digital currency" AND "nostr"`},
+		{"bitcoin or nostr relay", `("bitcoin" OR "nostr") AND "relay"`},
+		{"bitcoin -scam", `"bitcoin" NOT "scam"`},
+		{"-scam", ""},
+		{"or", ""},
+		{"", ""},
+		{`NEAR(a b) * ^c`, `"NEAR(a" AND "b)" AND "*" AND "^c"`},
+		{`unclosed "quote`, `"unclosed" AND "quote"`},
+	}
+
+	for _, tt := range tests {
+		if got := ftsQuery(tt.search); got != tt.want {
+			t.Errorf("ftsQuery(%q) = %s, want %s", tt.search, got, tt.want)
+		}
+	}
+}
+
+func TestSQLite_Search(t *testing.T) {
+	// Memory storage searches the same way
+	if !testSQLite && !testMemory {
+		t.Skip("SQLite and memory only, run with ZOOID_TEST_DATABASE=sqlite or memory")
+	}
+
+	news := createTestEvent(nostr.KindTextNote, "As notícias da comunidade")
+	currency := createTestEvent(nostr.KindTextNote, "Bitcoin is a decentralized digital currency")
+	tagged := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Content: "untitled", Tags: nostr.Tags{{"t", "governance"}}}
+	tagged.Sign(nostr.Generate())
+	store := searchTestStore(t, news, currency, tagged)
+
+	tests := []struct {
+		search string
+		want   []nostr.ID
+	}{
+		{"noticias", []nostr.ID{news.ID}},
+		{"NOTÍCIAS", []nostr.ID{news.ID}},
+		{`"digital currency"`, []nostr.ID{currency.ID}},
+		{`"currency digital"`, nil},
+		{"bitcoin or governance", []nostr.ID{currency.ID, tagged.ID}},
+		{"bitcoin -currency", nil},
+		{"governance", []nostr.ID{tagged.ID}},
+		{"-bitcoin", nil},
+		{`"`, nil},
+		{"!!!", nil},
+	}
+
+	for _, tt := range tests {
+		got := searchIDs(store, tt.search)
+		if len(got) != len(tt.want) {
+			t.Errorf("search %q = %v, want %v", tt.search, got, tt.want)
+			continue
+		}
+		for _, id := range tt.want {
+			if !slices.Contains(got, id) {
+				t.Errorf("search %q = %v, want %v", tt.search, got, tt.want)
+			}
+		}
+	}
+
+	// Deleted events leave the search table
+	if err := store.DeleteEvent(currency.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchIDs(store, "bitcoin"); len(got) != 0 {
+		t.Errorf("search after deleting = %v, want none", got)
+	}
+}
@@ -0,0 +1,251 @@
+package zooid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Readiness.
+//
+// An instance is initializing while its tables are set up and warming while
+// its caches are filled, at startup and again after a restore or key
+// rotation. Meanwhile client REQs and EVENTs are refused with "error:", or
+// with policy.queue_until_ready held for up to readyWait until it's done.
+// Then it's ready, or degraded if a cache couldn't be filled: the caches
+// that failed are bypassed and answers come from the database, slower but
+// right. GET /readyz reports the state, with a 503 until it's settled.
+//
+// Warming scans whole tables, so only WARM_CONCURRENCY instances warm at
+// once, the rest waiting their turn, and a config update that reloads every
+// relay doesn't take the whole connection pool from live traffic. A warm that
+// is superseded, by a newer one or the instance being cleaned up, is
+// canceled.
+
+// InstanceState is where an instance is in its startup.
+type InstanceState int32
+
+const (
+	// StateReady is the zero value, so instances built by hand (as in
+	// tests) serve straight away.
+	StateReady InstanceState = iota
+	StateInitializing
+	StateWarming
+	StateDegraded
+)
+
+// readyWait is how long policy.queue_until_ready holds a request.
+const readyWait = 10 * time.Second
+
+func (s InstanceState) String() string {
+	switch s {
+	case StateInitializing:
+		return "initializing"
+	case StateWarming:
+		return "warming"
+	case StateDegraded:
+		return "degraded"
+	default:
+		return "ready"
+	}
+}
+
+// starting reports whether requests have to wait for the instance.
+func (s InstanceState) starting() bool {
+	return s == StateInitializing || s == StateWarming
+}
+
+// readiness holds an instance's state. The zero value is ready.
+type readiness struct {
+	mu      sync.Mutex
+	state   InstanceState
+	settled chan struct{} // closed when the state stops being starting
+
+	warms      uint64             // counts warms, to tell the latest one
+	cancelWarm context.CancelFunc // cancels the warm in progress, if any
+}
+
+func (r *readiness) get() InstanceState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.state
+}
+
+func (r *readiness) set(state InstanceState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if state.starting() && !r.state.starting() {
+		r.settled = make(chan struct{})
+	} else if !state.starting() && r.state.starting() {
+		close(r.settled)
+	}
+	r.state = state
+}
+
+// wait returns the state once it has settled, or after timeout or when ctx
+// is done, whichever is first.
+func (r *readiness) wait(ctx context.Context, timeout time.Duration) InstanceState {
+	r.mu.Lock()
+	state, settled := r.state, r.settled
+	r.mu.Unlock()
+
+	if !state.starting() {
+		return state
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-settled:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	return r.get()
+}
+
+// startWarm cancels any warm in progress in favor of a new one, canceled by
+// cancel, and returns the new one's number.
+func (r *readiness) startWarm(cancel context.CancelFunc) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cancelWarm != nil {
+		r.cancelWarm()
+	}
+	r.warms++
+	r.cancelWarm = cancel
+
+	return r.warms
+}
+
+// endWarm reports whether warm is still the latest one, forgetting how to
+// cancel it if so.
+func (r *readiness) endWarm(warm uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if warm != r.warms {
+		return false
+	}
+	r.cancelWarm = nil
+
+	return true
+}
+
+// stopWarm cancels the warm in progress, if any.
+func (r *readiness) stopWarm() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cancelWarm != nil {
+		r.cancelWarm()
+		r.cancelWarm = nil
+	}
+}
+
+// warmSlots bounds how many instances warm their caches at once.
+var (
+	warmSlotsOnce sync.Once
+	warmSlots     chan struct{}
+)
+
+func warmSlot() chan struct{} {
+	warmSlotsOnce.Do(func() {
+		warmSlots = make(chan struct{}, max(envInt("WARM_CONCURRENCY", 2), 1))
+	})
+	return warmSlots
+}
+
+// State returns where the instance is in its startup.
+func (instance *Instance) State() InstanceState {
+	return instance.readiness.get()
+}
+
+func (instance *Instance) setState(state InstanceState, err error) {
+	instance.readiness.set(state)
+
+	if err != nil {
+		log.Printf("%s is %s: %v", instance.Config.Host, state, err)
+	} else {
+		log.Printf("%s is %s", instance.Config.Host, state)
+	}
+}
+
+// warmCaches fills the caches with load, holding off client requests
+// meanwhile, and leaves the instance ready, or degraded if load failed. load
+// should stop when its ctx is canceled.
+func (instance *Instance) warmCaches(load func(ctx context.Context) error) {
+	ctx, cancel := context.WithCancel(instance.Ctx)
+	defer cancel()
+
+	warm := instance.readiness.startWarm(cancel)
+	instance.setState(StateWarming, nil)
+
+	err := func() error {
+		slots := warmSlot()
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return fmt.Errorf("waiting to warm caches: %w", ctx.Err())
+		}
+		defer func() { <-slots }()
+
+		return load(ctx)
+	}()
+
+	// A newer warm has taken over and will settle the state
+	if !instance.readiness.endWarm(warm) {
+		return
+	}
+
+	if err != nil {
+		instance.setState(StateDegraded, err)
+	} else {
+		instance.setState(StateReady, nil)
+	}
+}
+
+// loadCaches fills every cache, from the last snapshot where there is one.
+func (instance *Instance) loadCaches(ctx context.Context) error {
+	return errors.Join(
+		instance.Management.LoadCaches(ctx),
+		instance.Groups.LoadCaches(ctx),
+		instance.loadRelayLists(ctx),
+	)
+}
+
+// checkReady refuses client requests while the instance is starting, or
+// with policy.queue_until_ready waits for it first.
+func (instance *Instance) checkReady(ctx context.Context) (reject bool, msg string) {
+	state := instance.State()
+	if state.starting() && instance.Config.Policy.QueueUntilReady {
+		state = instance.readiness.wait(ctx, readyWait)
+	}
+
+	if state.starting() {
+		return RejectError.Reject("relay is starting up, try again shortly")
+	}
+
+	return false, ""
+}
+
+// ServeReadyz reports the instance's state, with a 503 while it's starting.
+// A degraded instance serves correct answers, so it counts as ready.
+func (instance *Instance) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	state := instance.State()
+
+	w.Header().Set("Content-Type", "application/json")
+	if state.starting() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"state": state.String()})
+}
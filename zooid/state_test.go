@@ -0,0 +1,208 @@
+package zooid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// readyz returns the status code and state ServeReadyz answers with.
+func readyz(t *testing.T, instance *Instance) (int, string) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	instance.ServeReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+
+	var body struct {
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding /readyz: %v", err)
+	}
+
+	return rec.Code, body.State
+}
+
+func TestInstance_DegradedWhenWarmingFails(t *testing.T) {
+	skipOnMemory(t, "failing queries")
+
+	instance := createTestInstance()
+	member := nostr.Generate().Public()
+	if err := instance.Management.AddMember(member); err != nil {
+		t.Fatalf("AddMember failed: %v", err)
+	}
+
+	// Take the events table away, so every warming query fails
+	events := instance.Events.Schema
+	if _, err := GetDb().Exec("ALTER TABLE " + events.Prefix("events") + " RENAME TO " + events.Index("events_away")); err != nil {
+		t.Fatalf("renaming the events table: %v", err)
+	}
+	instance.warmCaches(instance.loadCaches)
+	if _, err := GetDb().Exec("ALTER TABLE " + events.Prefix("events_away") + " RENAME TO " + events.Index("events")); err != nil {
+		t.Fatalf("renaming the events table back: %v", err)
+	}
+
+	if state := instance.State(); state != StateDegraded {
+		t.Fatalf("state = %s, want degraded", state)
+	}
+	if instance.Management.cachesWarmed || instance.Groups.cachesWarmed {
+		t.Error("a store uses caches that failed to load")
+	}
+
+	// The empty caches are bypassed, so the member is still found
+	if !instance.Management.IsMember(member) {
+		t.Error("a degraded instance doesn't know its member")
+	}
+	if reject, msg := instance.checkReady(context.Background()); reject {
+		t.Errorf("a degraded instance refused a request: %s", msg)
+	}
+	if code, state := readyz(t, instance); code != 200 || state != "degraded" {
+		t.Errorf("/readyz = %d %s, want 200 degraded", code, state)
+	}
+
+	// The next warm-up that works makes it ready
+	instance.warmCaches(instance.loadCaches)
+	if state := instance.State(); state != StateReady {
+		t.Errorf("state after warming again = %s, want ready", state)
+	}
+}
+
+func TestInstance_RefusesWhileWarming(t *testing.T) {
+	instance := createTestInstance()
+
+	if code, state := readyz(t, instance); code != 200 || state != "ready" {
+		t.Errorf("/readyz = %d %s, want 200 ready", code, state)
+	}
+
+	instance.readiness.set(StateWarming)
+
+	if code, state := readyz(t, instance); code != 503 || state != "warming" {
+		t.Errorf("/readyz = %d %s, want 503 warming", code, state)
+	}
+
+	reject, msg := instance.OnRequest(context.Background(), nostr.Filter{})
+	if !reject || !strings.HasPrefix(msg, "error:") {
+		t.Errorf("OnRequest while warming = %v %q, want an error", reject, msg)
+	}
+	event := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now()}
+	event.Sign(nostr.Generate())
+	reject, msg = instance.OnEvent(context.Background(), event)
+	if !reject || !strings.HasPrefix(msg, "error:") {
+		t.Errorf("OnEvent while warming = %v %q, want an error", reject, msg)
+	}
+
+	// Queued requests go on once it's ready
+	instance.Config.Policy.QueueUntilReady = true
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		instance.readiness.set(StateReady)
+	}()
+
+	start := time.Now()
+	if reject, msg := instance.checkReady(context.Background()); reject {
+		t.Errorf("a queued request was refused: %s", msg)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond || waited > readyWait {
+		t.Errorf("a queued request waited %s, want until the instance was ready", waited)
+	}
+}
+
+func TestWarmCaches_BoundedConcurrency(t *testing.T) {
+	warmSlot()
+	oldSlots := warmSlots
+	warmSlots = make(chan struct{}, 1)
+	t.Cleanup(func() { warmSlots = oldSlots })
+
+	// Each warm holds a slow query's worth of time
+	var active, peak atomic.Int32
+	slowLoad := func(ctx context.Context) error {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(30 * time.Millisecond)
+		return nil
+	}
+
+	instances := []*Instance{createTestInstance(), createTestInstance(), createTestInstance()}
+	var wg sync.WaitGroup
+	for _, instance := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			instance.warmCaches(slowLoad)
+		}()
+	}
+	wg.Wait()
+
+	if n := peak.Load(); n != 1 {
+		t.Errorf("%d instances warmed at once, want 1", n)
+	}
+	for _, instance := range instances {
+		if state := instance.State(); state != StateReady {
+			t.Errorf("state after warming = %s, want ready", state)
+		}
+	}
+}
+
+func TestWarmCaches_Canceled(t *testing.T) {
+	instance := createTestInstance()
+	blocking := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	// A newer warm supersedes one in progress
+	done := make(chan struct{})
+	go func() {
+		instance.warmCaches(blocking)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	instance.warmCaches(func(ctx context.Context) error { return nil })
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the superseded warm is still running")
+	}
+	if state := instance.State(); state != StateReady {
+		t.Errorf("state = %s, want the newer warm's ready", state)
+	}
+
+	// Cleanup stops a warm in progress
+	done = make(chan struct{})
+	go func() {
+		instance.warmCaches(blocking)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	instance.readiness.stopWarm()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the stopped warm is still running")
+	}
+	if state := instance.State(); state != StateDegraded {
+		t.Errorf("state = %s, want degraded", state)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := instance.Groups.WarmCaches(ctx); !errors.Is(err, context.Canceled) || instance.Groups.cachesWarmed {
+		t.Errorf("WarmCaches with a canceled context = %v, want context.Canceled and no caches", err)
+	}
+}
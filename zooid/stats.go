@@ -0,0 +1,122 @@
+package zooid
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// statsCacheTTL bounds how often Stats hits the database. The counts scan
+// whole tables, so admins refreshing a dashboard shouldn't trigger them
+// every time.
+const statsCacheTTL = 5 * time.Minute
+
+// statsTopKinds is how many kinds EventStats.TopKinds lists.
+const statsTopKinds = 10
+
+type KindCount struct {
+	Kind  nostr.Kind `json:"kind"`
+	Count int64      `json:"count"`
+}
+
+// EventStats describes the size of a relay's schema.
+type EventStats struct {
+	Events           int64           `json:"events"`
+	TopKinds         []KindCount     `json:"top_kinds"`
+	TagRows          int64           `json:"tag_rows"`
+	OldestCreatedAt  nostr.Timestamp `json:"oldest_created_at"`
+	NewestCreatedAt  nostr.Timestamp `json:"newest_created_at"`
+	ReceivedLastHour int64           `json:"received_last_hour"`
+	EventsTableBytes int64           `json:"events_table_bytes"`
+	EventsIndexBytes int64           `json:"events_index_bytes"`
+	TagsTableBytes   int64           `json:"tags_table_bytes"`
+	TagsIndexBytes   int64           `json:"tags_index_bytes"`
+	CollectedAt      nostr.Timestamp `json:"collected_at"`
+}
+
+// Stats returns table statistics for this schema, cached for statsCacheTTL.
+func (events *EventStore) Stats(ctx context.Context) (EventStats, error) {
+	events.statsMu.Lock()
+	defer events.statsMu.Unlock()
+
+	if events.stats != nil && time.Since(events.stats.CollectedAt.Time()) < statsCacheTTL {
+		return *events.stats, nil
+	}
+
+	stats, err := events.collectStats(ctx)
+	if err != nil {
+		return EventStats{}, err
+	}
+
+	events.stats = &stats
+
+	return stats, nil
+}
+
+func (events *EventStore) collectStats(ctx context.Context) (EventStats, error) {
+	if memory, ok := events.backend().(memoryEvents); ok {
+		return memory.stats(), nil
+	}
+
+	subctx, cancel := context.WithTimeout(ctx, dbOpTimeout)
+	defer cancel()
+
+	eventsTable := events.Schema.Prefix("events")
+	tagsTable := events.Schema.Prefix("event_tags")
+	stats := EventStats{CollectedAt: nostr.Now(), TopKinds: make([]KindCount, 0)}
+
+	err := GetDb().QueryRowContext(subctx,
+		"SELECT COUNT(*), COALESCE(MIN(created_at), 0), COALESCE(MAX(created_at), 0) FROM "+eventsTable,
+	).Scan(&stats.Events, &stats.OldestCreatedAt, &stats.NewestCreatedAt)
+	if err != nil {
+		return stats, fmt.Errorf("counting events: %w", err)
+	}
+
+	// Imports and backfills arrive with old created_at, see received.go
+	err = GetDb().QueryRowContext(subctx,
+		"SELECT COUNT(*) FROM "+eventsTable+" WHERE received_at >= $1", int64(receivedNow()-3600),
+	).Scan(&stats.ReceivedLastHour)
+	if err != nil {
+		return stats, fmt.Errorf("counting received events: %w", err)
+	}
+
+	rows, err := GetDb().QueryContext(subctx,
+		"SELECT kind, COUNT(*) FROM "+eventsTable+" GROUP BY kind ORDER BY COUNT(*) DESC, kind LIMIT $1",
+		statsTopKinds)
+	if err != nil {
+		return stats, fmt.Errorf("counting kinds: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kc KindCount
+		if err := rows.Scan(&kc.Kind, &kc.Count); err != nil {
+			return stats, fmt.Errorf("counting kinds: %w", err)
+		}
+		stats.TopKinds = append(stats.TopKinds, kc)
+	}
+	if err := rows.Err(); err != nil {
+		return stats, fmt.Errorf("counting kinds: %w", err)
+	}
+
+	if err := GetDb().QueryRowContext(subctx, "SELECT COUNT(*) FROM "+tagsTable).Scan(&stats.TagRows); err != nil {
+		return stats, fmt.Errorf("counting tags: %w", err)
+	}
+
+	// SQLite doesn't size tables, so they're left at 0
+	if usesSQLite() {
+		return stats, nil
+	}
+
+	sizes := "SELECT pg_relation_size($1::regclass), pg_indexes_size($1::regclass)"
+	if err := GetDb().QueryRowContext(subctx, sizes, eventsTable).Scan(&stats.EventsTableBytes, &stats.EventsIndexBytes); err != nil {
+		return stats, fmt.Errorf("sizing events table: %w", err)
+	}
+	if err := GetDb().QueryRowContext(subctx, sizes, tagsTable).Scan(&stats.TagsTableBytes, &stats.TagsIndexBytes); err != nil {
+		return stats, fmt.Errorf("sizing tags table: %w", err)
+	}
+
+	return stats, nil
+}
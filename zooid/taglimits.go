@@ -0,0 +1,82 @@
+package zooid
+
+import (
+	"fmt"
+	"log"
+
+	"fiatjaf.com/nostr"
+)
+
+// Tag limits.
+//
+// Every single-letter tag of an event is a row in event_tags, so an event
+// with tens of thousands of tags costs as many index inserts, and a value
+// longer than a btree entry can hold fails the insert outright. Events from
+// clients with more than limits.max_event_tags tags, or any tag element
+// longer than limits.max_tag_value_length bytes, are refused.
+//
+// Contact lists (kind 3) are the exception, since following thousands of
+// people is legitimate: they're stored whole, but only their first
+// max_event_tags tags are indexed. The rest can't be found through a #p
+// filter. Whatever the limits, values over maxIndexedTagValue bytes are
+// never indexed, so events that reach the store some other way, such as the
+// relay's own, can't fail the insert either.
+
+const (
+	defaultMaxEventTags      = 2000
+	defaultMaxTagValueLength = 4096
+
+	// Postgres btree entries top out around 2700 bytes, and the
+	// (key, value, kind, event_id) index needs room for the rest
+	maxIndexedTagValue = 2048
+)
+
+// checkTagLimits refuses an event with too many tags or a tag that's too
+// long.
+func checkTagLimits(config *Config, event nostr.Event) string {
+	if limit := config.GetMaxEventTags(); len(event.Tags) > limit && event.Kind != nostr.KindFollowList {
+		return RejectInvalid.Reason(fmt.Sprintf("event has more than %d tags", limit))
+	}
+
+	limit := config.GetMaxTagValueLength()
+	for _, tag := range event.Tags {
+		for _, value := range tag {
+			if len(value) > limit {
+				return RejectInvalid.Reason(fmt.Sprintf("tag value is longer than %d bytes", limit))
+			}
+		}
+	}
+
+	return ""
+}
+
+// indexedTags returns the tags of evt that go into event_tags.
+func (events *EventStore) indexedTags(evt nostr.Event) []nostr.Tag {
+	maxTags := defaultMaxEventTags
+	if events.Config != nil {
+		maxTags = events.Config.GetMaxEventTags()
+	}
+
+	var indexed []nostr.Tag
+	skipped := 0
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 || len(tag[0]) != 1 {
+			continue
+		}
+		if len(tag[1]) > maxIndexedTagValue {
+			skipped++
+			continue
+		}
+		if evt.Kind == nostr.KindFollowList && len(indexed) >= maxTags {
+			skipped++
+			continue
+		}
+		indexed = append(indexed, tag)
+	}
+
+	if skipped > 0 {
+		log.Printf("event %s (kind %d): %d tags not indexed, over limits.max_event_tags or too long to index", evt.ID, evt.Kind, skipped)
+	}
+
+	return indexed
+}
@@ -0,0 +1,98 @@
+package zooid
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func pTags(n int) nostr.Tags {
+	tags := make(nostr.Tags, n)
+	for i := range tags {
+		tags[i] = nostr.Tag{"p", fmt.Sprintf("%064x", i)}
+	}
+	return tags
+}
+
+func TestCheckTagLimits(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+
+	author := nostr.Generate()
+	ctx := authedContext(author.Public())
+
+	reject, msg := instance.OnEvent(ctx, signedBy(author, nostr.Event{Kind: nostr.KindTextNote, Tags: pTags(50000)}))
+	if !reject {
+		t.Fatal("note with 50000 tags accepted")
+	}
+	assertPrefix(t, "too many tags", msg, RejectInvalid)
+
+	reject, msg = instance.OnEvent(ctx, signedBy(author, nostr.Event{Kind: nostr.KindTextNote, Tags: nostr.Tags{{"t", strings.Repeat("x", 5000)}}}))
+	if !reject {
+		t.Fatal("tag longer than limits.max_tag_value_length accepted")
+	}
+	assertPrefix(t, "long tag", msg, RejectInvalid)
+
+	if reject, msg := instance.OnEvent(ctx, signedBy(author, nostr.Event{Kind: nostr.KindFollowList, Tags: pTags(50000)})); reject {
+		t.Errorf("contact list with 50000 tags refused: %s", msg)
+	}
+
+	instance.Config.Limits.MaxEventTags = 10
+	if reject, _ := instance.OnEvent(ctx, signedBy(author, nostr.Event{Kind: nostr.KindTextNote, Tags: pTags(11)})); !reject {
+		t.Error("limits.max_event_tags not applied")
+	}
+}
+
+func TestSaveEvent_TagIndexing(t *testing.T) {
+	skipOnMemory(t, "event_tags table")
+	store := createTestEventStore()
+	store.Init()
+
+	indexed := func(event nostr.Event) int {
+		var n int
+		query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE event_id = $1", store.Schema.Prefix("event_tags"))
+		if err := GetDb().QueryRow(query, event.ID.Hex()).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	found := func(tag nostr.Tag) bool {
+		for range store.QueryEvents(nostr.Filter{Tags: nostr.TagMap{tag[0]: []string{tag[1]}}}, 1) {
+			return true
+		}
+		return false
+	}
+
+	// Contact lists are stored whole but indexed only so far
+	list := signedBy(nostr.Generate(), nostr.Event{Kind: nostr.KindFollowList, Tags: pTags(50000)})
+	if err := store.SaveEvent(list); err != nil {
+		t.Fatal(err)
+	}
+	if n := indexed(list); n != defaultMaxEventTags {
+		t.Errorf("%d contact list tags indexed, want %d", n, defaultMaxEventTags)
+	}
+	if !found(list.Tags[0]) || found(list.Tags[len(list.Tags)-1]) {
+		t.Error("contact list should be found by its first tags and not past the cap")
+	}
+	for event := range store.QueryEvents(nostr.Filter{IDs: []nostr.ID{list.ID}}, 1) {
+		if len(event.Tags) != len(list.Tags) {
+			t.Errorf("contact list stored with %d tags, want all %d", len(event.Tags), len(list.Tags))
+		}
+	}
+
+	// Other events get all their tags indexed, over several inserts, except
+	// values too long for the index
+	long := nostr.Tag{"t", strings.Repeat("x", maxIndexedTagValue+1)}
+	event := signedBy(nostr.Generate(), nostr.Event{Kind: nostr.KindTextNote, Tags: append(pTags(20000), long)})
+	if err := store.SaveEvent(event); err != nil {
+		t.Fatal(err)
+	}
+	if n := indexed(event); n != 20000 {
+		t.Errorf("%d tags indexed, want 20000", n)
+	}
+	if !found(event.Tags[19999]) {
+		t.Error("event not found by a tag from its last insert")
+	}
+}
@@ -0,0 +1,159 @@
+package zooid
+
+import (
+	"slices"
+	"sync"
+
+	"fiatjaf.com/nostr"
+)
+
+// Threaded replies.
+//
+// Threads (kind 11) and their replies (kind 12) point at their root and
+// parent with e tags, as do chat messages (kinds 9 and 10) that reply with a
+// "root" or "reply" marker. Those events must be in the same group as the
+// reply, so a reply can't leak a private group's event into another group or
+// hang off nothing. Which group recent events belong to is cached, so most
+// replies don't cost a query.
+
+// eventGroupCacheSize bounds how many event → group mappings are kept.
+const eventGroupCacheSize = 10000
+
+// eventGroupCache maps event ids to their group, forgetting the oldest entry
+// once full. The zero value is ready to use.
+type eventGroupCache struct {
+	mu     sync.Mutex
+	groups map[nostr.ID]string
+	order  []nostr.ID // ring of ids in insertion order
+	next   int        // slot of order to overwrite once it's full
+}
+
+func (c *eventGroupCache) get(id nostr.ID) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.groups[id]
+	return h, ok
+}
+
+func (c *eventGroupCache) put(id nostr.ID, h string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.groups == nil {
+		c.groups = make(map[nostr.ID]string)
+	}
+	if _, ok := c.groups[id]; ok {
+		c.groups[id] = h
+		return
+	}
+
+	if len(c.order) < eventGroupCacheSize {
+		c.order = append(c.order, id)
+	} else {
+		delete(c.groups, c.order[c.next])
+		c.order[c.next] = id
+		c.next = (c.next + 1) % eventGroupCacheSize
+	}
+	c.groups[id] = h
+}
+
+func (c *eventGroupCache) forget(id nostr.ID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.groups, id)
+}
+
+func (c *eventGroupCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.groups, c.order, c.next = nil, nil, 0
+}
+
+// isThreadKind reports whether events of kind can reply to group events.
+func isThreadKind(kind nostr.Kind) bool {
+	switch kind {
+	case nostr.KindSimpleGroupChatMessage,
+		nostr.KindSimpleGroupThreadedReply,
+		nostr.KindSimpleGroupThread,
+		nostr.KindSimpleGroupReply:
+		return true
+	}
+
+	return false
+}
+
+// threadParents returns the ids event replies to: its e tags marked "root"
+// or "reply", or for threads and thread replies without markers, all of its
+// unmarked e tags. Mentions and malformed ids are ignored.
+func threadParents(event nostr.Event) []nostr.ID {
+	if !isThreadKind(event.Kind) {
+		return nil
+	}
+
+	var marked, unmarked []nostr.ID
+	for tag := range event.Tags.FindAll("e") {
+		id, err := nostr.IDFromHex(tag[1])
+		if err != nil {
+			continue
+		}
+
+		marker := ""
+		if len(tag) >= 4 {
+			marker = tag[3]
+		}
+
+		switch {
+		case marker == "root" || marker == "reply":
+			marked = append(marked, id)
+		case marker == "" && (event.Kind == nostr.KindSimpleGroupThread || event.Kind == nostr.KindSimpleGroupReply):
+			unmarked = append(unmarked, id)
+		}
+	}
+
+	if len(marked) > 0 {
+		return marked
+	}
+	return unmarked
+}
+
+// rememberEventGroup caches the group of a stored event that replies may
+// refer to.
+func (g *GroupStore) rememberEventGroup(event nostr.Event) {
+	if !isThreadKind(event.Kind) {
+		return
+	}
+
+	if h := GetGroupIDFromEvent(event); h != "" {
+		g.eventGroups.put(event.ID, h)
+	}
+}
+
+// checkParents returns why event's parents can't be accepted in group h, or
+// "" if they can.
+func (g *GroupStore) checkParents(h string, event nostr.Event) string {
+	parents := threadParents(event)
+	if len(parents) == 0 {
+		return ""
+	}
+
+	var uncached []nostr.ID
+	for _, id := range parents {
+		if _, ok := g.eventGroups.get(id); !ok && !slices.Contains(uncached, id) {
+			uncached = append(uncached, id)
+		}
+	}
+
+	if len(uncached) > 0 {
+		for parent := range g.Events.QueryEvents(nostr.Filter{IDs: uncached}, 0) {
+			g.eventGroups.put(parent.ID, GetGroupIDFromEvent(parent))
+		}
+	}
+
+	for _, id := range parents {
+		if parent, ok := g.eventGroups.get(id); !ok || parent != h {
+			return RejectInvalid.Reason("parent event not found in this group")
+		}
+	}
+
+	return ""
+}
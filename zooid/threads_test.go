@@ -0,0 +1,112 @@
+package zooid
+
+import (
+	"context"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestThreadParents(t *testing.T) {
+	root := nostr.Generate().Public().Hex() // any 64 hex characters will do
+	parent := nostr.Generate().Public().Hex()
+
+	cases := []struct {
+		name  string
+		event nostr.Event
+		want  int
+	}{
+		{"unmarked reply", nostr.Event{Kind: nostr.KindSimpleGroupReply, Tags: nostr.Tags{{"e", root}}}, 1},
+		{"marked reply", nostr.Event{Kind: nostr.KindSimpleGroupReply, Tags: nostr.Tags{{"e", root, "", "root"}, {"e", parent, "", "reply"}, {"e", parent, "", "mention"}}}, 2},
+		{"chat mention", nostr.Event{Kind: nostr.KindSimpleGroupChatMessage, Tags: nostr.Tags{{"e", root}}}, 0},
+		{"chat reply", nostr.Event{Kind: nostr.KindSimpleGroupChatMessage, Tags: nostr.Tags{{"e", root, "", "reply"}}}, 1},
+		{"other kind", nostr.Event{Kind: nostr.KindTextNote, Tags: nostr.Tags{{"e", root, "", "reply"}}}, 0},
+		{"bad id", nostr.Event{Kind: nostr.KindSimpleGroupReply, Tags: nostr.Tags{{"e", "nope"}}}, 0},
+	}
+
+	for _, c := range cases {
+		if got := threadParents(c.event); len(got) != c.want {
+			t.Errorf("%s: %d parents, want %d", c.name, len(got), c.want)
+		}
+	}
+}
+
+func TestCheckWrite_ThreadReplies(t *testing.T) {
+	instance := createTestInstance()
+	runTestAdmin(t, instance, "create-group", "one")
+	runTestAdmin(t, instance, "create-group", "two")
+
+	member := nostr.Generate()
+	runTestAdmin(t, instance, "add-member", "one", member.Public().Hex())
+	runTestAdmin(t, instance, "add-member", "two", member.Public().Hex())
+
+	post := func(event nostr.Event) nostr.Event {
+		event = signedBy(member, event)
+		if err := instance.Events.SaveEvent(event); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+
+	thread := post(nostr.Event{Kind: nostr.KindSimpleGroupThread, Content: "topic", Tags: nostr.Tags{{"h", "one"}}})
+	elsewhere := post(nostr.Event{Kind: nostr.KindSimpleGroupThread, Content: "other topic", Tags: nostr.Tags{{"h", "two"}}})
+
+	reply := func(h string, parent nostr.ID) string {
+		return instance.Groups.CheckWrite(signedBy(member, nostr.Event{
+			Kind:    nostr.KindSimpleGroupReply,
+			Content: "reply",
+			Tags:    nostr.Tags{{"h", h}, {"e", parent.Hex(), "", "root"}},
+		}))
+	}
+
+	if reason := reply("one", thread.ID); reason != "" {
+		t.Errorf("reply in the thread's group refused: %s", reason)
+	}
+
+	if reason := reply("one", elsewhere.ID); reason != "invalid: parent event not found in this group" {
+		t.Errorf("cross-group reply: %q", reason)
+	}
+
+	missing := signedBy(member, nostr.Event{Kind: nostr.KindSimpleGroupThread, Content: "never stored", Tags: nostr.Tags{{"h", "one"}}})
+	if reason := reply("one", missing.ID); reason != "invalid: parent event not found in this group" {
+		t.Errorf("reply to a missing parent: %q", reason)
+	}
+
+	// Saved events are cached, and deleted ones forgotten
+	fresh := post(nostr.Event{Kind: nostr.KindSimpleGroupThread, Content: "new topic", Tags: nostr.Tags{{"h", "one"}}})
+	instance.OnEventSaved(context.Background(), fresh)
+	if h, ok := instance.Groups.eventGroups.get(fresh.ID); !ok || h != "one" {
+		t.Errorf("cached group of a saved thread = %q, %v", h, ok)
+	}
+	if err := instance.DeleteEvent(context.Background(), fresh.ID); err != nil {
+		t.Fatal(err)
+	}
+	if reason := reply("one", fresh.ID); reason == "" {
+		t.Error("a reply to a deleted thread should be refused")
+	}
+
+	// A chat message only counts as a reply with a marker
+	mention := signedBy(member, nostr.Event{Kind: nostr.KindSimpleGroupChatMessage, Tags: nostr.Tags{{"h", "one"}, {"e", elsewhere.ID.Hex()}}})
+	if reason := instance.Groups.CheckWrite(mention); reason != "" {
+		t.Errorf("chat message mentioning another group's event refused: %s", reason)
+	}
+}
+
+func TestEventGroupCache_Evicts(t *testing.T) {
+	var cache eventGroupCache
+	ids := make([]nostr.ID, eventGroupCacheSize+1)
+	for i := range ids {
+		ids[i] = nostr.ID(nostr.Generate().Public()) // 32 random bytes
+		cache.put(ids[i], "g")
+	}
+
+	if _, ok := cache.get(ids[0]); ok {
+		t.Error("the oldest entry should have been evicted")
+	}
+	if _, ok := cache.get(ids[len(ids)-1]); !ok {
+		t.Error("the newest entry should be cached")
+	}
+	if len(cache.groups) != eventGroupCacheSize {
+		t.Errorf("cache holds %d entries, want %d", len(cache.groups), eventGroupCacheSize)
+	}
+}
@@ -0,0 +1,94 @@
+package zooid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"fiatjaf.com/nostr"
+)
+
+// Ingest transforms.
+//
+// StoreEvent and ReplaceEvent run every event a client publishes through
+// Instance.Transformers, in order, before it's stored, and SignAndStoreEvent
+// does the same for the relay's own events once it has signed them. A
+// transformer can refuse the event by returning an error, whose message is
+// the client's OK reason, or note something about it elsewhere, keyed by its
+// id. Only events the relay signed may be changed, and they're signed again
+// afterwards; changing anyone else's would break its signature, so an event
+// that comes out different is refused instead. The copy of a client's event
+// that khatru broadcasts and passes to OnEventSaved is the one received; the
+// relay's own are broadcast as stored.
+//
+// MakeInstance puts the built-in transformer in front of any others:
+// transforms.strip_tags removes the listed tags from the relay's events and
+// refuses other events that have them. When each event arrived is recorded
+// by the store itself, see received.go.
+
+// EventTransformer sees an event before it's stored, see above.
+type EventTransformer func(ctx context.Context, instance *Instance, event *nostr.Event) error
+
+// errTransformChanged refuses an event a transformer changed but the relay
+// can't sign again.
+var errTransformChanged = errors.New(RejectError.Reason("event was changed before it was stored"))
+
+// transform runs event through the instance's transformers. A changed event
+// is signed again before the next one sees it, so they all see its final id.
+func (instance *Instance) transform(ctx context.Context, event *nostr.Event) error {
+	for _, transformer := range instance.Transformers {
+		if err := transformer(ctx, instance, event); err != nil {
+			return err
+		}
+
+		if event.GetID() == event.ID {
+			continue
+		}
+
+		if !instance.Config.IsSelf(event.PubKey) {
+			return errTransformChanged
+		}
+
+		if err := event.Sign(instance.Config.secret); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startTransformers puts the built-in transformers the config enables in
+// front of any others, and has the relay's own events go through them too.
+func (instance *Instance) startTransformers() {
+	var builtin []EventTransformer
+
+	if len(instance.Config.Transforms.StripTags) > 0 {
+		builtin = append(builtin, stripTags(instance.Config.Transforms.StripTags))
+	}
+
+	instance.Transformers = append(builtin, instance.Transformers...)
+	instance.Events.transform = instance.transform
+}
+
+// stripTags removes tags named any of names from the relay's events, and
+// refuses other events that have them.
+func stripTags(names []string) EventTransformer {
+	return func(ctx context.Context, instance *Instance, event *nostr.Event) error {
+		strip := func(tag nostr.Tag) bool {
+			return len(tag) > 0 && slices.Contains(names, tag[0])
+		}
+
+		i := slices.IndexFunc(event.Tags, strip)
+		if i < 0 {
+			return nil
+		}
+
+		if !instance.Config.IsSelf(event.PubKey) {
+			return errors.New(RejectBlocked.Reason(fmt.Sprintf("%q tags aren't accepted", event.Tags[i][0])))
+		}
+
+		event.Tags = slices.DeleteFunc(slices.Clone(event.Tags), strip)
+		return nil
+	}
+}
@@ -0,0 +1,96 @@
+package zooid
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestTransformers_Order(t *testing.T) {
+	instance := createTestInstance()
+
+	var ran []string
+	step := func(name string, err error) EventTransformer {
+		return func(ctx context.Context, instance *Instance, event *nostr.Event) error {
+			ran = append(ran, name)
+			return err
+		}
+	}
+
+	instance.Transformers = []EventTransformer{step("first", nil), step("second", nil)}
+	if err := instance.StoreEvent(context.Background(), createTestEvent(nostr.KindTextNote, "ordered")); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ran, ",") != "first,second" {
+		t.Errorf("transformers ran as %v, want first then second", ran)
+	}
+
+	ran = nil
+	refused := errors.New("blocked: no")
+	instance.Transformers = []EventTransformer{step("first", refused), step("second", nil)}
+	event := createTestEvent(nostr.KindTextNote, "refused")
+	if err := instance.StoreEvent(context.Background(), event); err != refused {
+		t.Errorf("StoreEvent = %v, want the transformer's refusal", err)
+	}
+	if len(ran) != 1 {
+		t.Errorf("transformers after a refusal ran: %v", ran)
+	}
+	if n, _ := instance.Events.CountEvents(nostr.Filter{IDs: []nostr.ID{event.ID}}); n != 0 {
+		t.Error("a refused event was stored")
+	}
+}
+
+func TestTransformers_OnlyChangeRelayEvents(t *testing.T) {
+	instance := createTestInstance()
+
+	instance.Transformers = []EventTransformer{
+		func(ctx context.Context, instance *Instance, event *nostr.Event) error {
+			event.Content = "changed"
+			return nil
+		},
+	}
+
+	if err := instance.StoreEvent(context.Background(), createTestEvent(nostr.KindTextNote, "theirs")); err != errTransformChanged {
+		t.Errorf("StoreEvent of a changed user event = %v, want %v", err, errTransformChanged)
+	}
+
+	ours := signedBy(instance.Config.secret, nostr.Event{Kind: nostr.KindTextNote, Content: "ours"})
+	if err := instance.StoreEvent(context.Background(), ours); err != nil {
+		t.Fatal(err)
+	}
+	stored := firstEvent(t, instance, nostr.Filter{Authors: []nostr.PubKey{instance.Config.secret.Public()}, Kinds: []nostr.Kind{nostr.KindTextNote}})
+	if stored.Content != "changed" || !stored.VerifySignature() {
+		t.Errorf("the relay's event was stored as %q, signed %v; want it changed and signed again", stored.Content, stored.VerifySignature())
+	}
+}
+
+func TestStripTags(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Transforms.StripTags = []string{"client"}
+	instance.startTransformers()
+
+	user := signedBy(nostr.Generate(), nostr.Event{Kind: nostr.KindTextNote, Tags: nostr.Tags{{"client", "spammy"}}})
+	if err := instance.StoreEvent(context.Background(), user); err == nil || !strings.HasPrefix(err.Error(), "blocked:") {
+		t.Errorf("StoreEvent of a user event with a stripped tag = %v, want it blocked", err)
+	}
+
+	if err := instance.StoreEvent(context.Background(), createTestEvent(nostr.KindTextNote, "plain")); err != nil {
+		t.Errorf("StoreEvent of an event without the tag = %v", err)
+	}
+
+	// The relay's own events are stored through its signing path
+	ours := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"client", "zooid"}, {"t", "kept"}}}
+	if err := instance.Events.SignAndStoreEvent(&ours, false); err != nil {
+		t.Fatal(err)
+	}
+	stored := firstEvent(t, instance, nostr.Filter{Authors: []nostr.PubKey{instance.Config.secret.Public()}, Kinds: []nostr.Kind{nostr.KindTextNote}})
+	if stored.Tags.Find("client") != nil || stored.Tags.Find("t") == nil {
+		t.Errorf("the relay's event was stored with tags %v, want only the t tag", stored.Tags)
+	}
+	if stored.ID != ours.ID || !stored.VerifySignature() {
+		t.Error("the relay's stripped event wasn't signed again")
+	}
+}
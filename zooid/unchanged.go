@@ -0,0 +1,67 @@
+package zooid
+
+import (
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Unchanged lists.
+//
+// The relay re-signs its admin and member lists whenever something may have
+// changed them, which includes every startup. An update whose tags match the
+// stored version (in any order) signed by the current key isn't written: a new
+// created_at would only make mirrors re-sync and clients drop their cached
+// copy. After a key rotation the stored version is someone else's, so the
+// lists are written again.
+
+var listUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "zooid_list_updates_total",
+	Help: "Updates to the relay's admin, member and pending join request lists, written or skipped as unchanged",
+}, []string{"instance", "list", "result"})
+
+func init() {
+	prometheus.MustRegister(listUpdates)
+}
+
+// signAndStoreList is SignAndStoreEvent for the relay's own lists, which
+// skips updates that wouldn't change the stored list. list names it in
+// zooid_list_updates_total.
+func (events *EventStore) signAndStoreList(list string, event *nostr.Event, broadcast bool) error {
+	event.PubKey = events.Config.GetSelf()
+	for current := range events.reservedBackend().query(replaceableFilter(*event), 1, newestFirst) {
+		if current.Content == event.Content && sameTags(current.Tags, event.Tags) {
+			listUpdates.WithLabelValues(events.Config.Schema, list, "skipped").Inc()
+			return nil
+		}
+	}
+
+	if err := events.SignAndStoreEvent(event, broadcast); err != nil {
+		return err
+	}
+
+	listUpdates.WithLabelValues(events.Config.Schema, list, "written").Inc()
+	return nil
+}
+
+// sameTags reports whether a and b hold the same tags, ignoring order.
+func sameTags(a, b nostr.Tags) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	counts := make(map[string]int, len(a))
+	for _, tag := range a {
+		counts[strings.Join(tag, "\x00")]++
+	}
+	for _, tag := range b {
+		key := strings.Join(tag, "\x00")
+		if counts[key] == 0 {
+			return false
+		}
+		counts[key]--
+	}
+
+	return true
+}
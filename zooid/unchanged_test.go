@@ -0,0 +1,92 @@
+package zooid
+
+import (
+	"context"
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// storedList returns the ID of the relay's stored kind list for h.
+func storedList(t *testing.T, instance *Instance, kind nostr.Kind, h string) nostr.ID {
+	t.Helper()
+
+	filter := nostr.Filter{Kinds: []nostr.Kind{kind}, Authors: []nostr.PubKey{instance.Config.GetSelf()}, Tags: nostr.TagMap{"d": []string{h}}}
+	for event := range instance.Events.QueryEvents(filter, 1) {
+		return event.ID
+	}
+
+	t.Fatalf("no kind %d list for %q", kind, h)
+	return nostr.ID{}
+}
+
+func TestUnchangedLists_Restart(t *testing.T) {
+	filename := writeTestConfig(t, `
+host = "lists.example.com"
+schema = "lists_`+RandomString(8)+`"
+secret = "`+nostr.Generate().Hex()+`"
+
+[groups]
+enabled = true
+`)
+	cleanupRegistry(t, filename)
+
+	dispatch := func() *Instance {
+		instance, ok := Dispatch("lists.example.com")
+		if !ok {
+			t.Fatal("the instance didn't load")
+		}
+		return instance
+	}
+
+	loadInstances(context.Background(), []string{filename})
+	instance := dispatch()
+	admins := storedList(t, instance, nostr.KindSimpleGroupAdmins, "_")
+	skipped := testutil.ToFloat64(listUpdates.WithLabelValues(instance.Config.Schema, "admins", "skipped"))
+
+	instancesMux.Lock()
+	reloadInstance(context.Background(), filename, false)
+	instancesMux.Unlock()
+
+	instance = dispatch()
+	if id := storedList(t, instance, nostr.KindSimpleGroupAdmins, "_"); id != admins {
+		t.Error("an unchanged relay admins list was written again on restart")
+	}
+	if n := testutil.ToFloat64(listUpdates.WithLabelValues(instance.Config.Schema, "admins", "skipped")); n != skipped+1 {
+		t.Errorf("skipped admins list updates = %v, want %v", n, skipped+1)
+	}
+}
+
+func TestUnchangedLists_Members(t *testing.T) {
+	instance := createTestInstance()
+	runTestAdmin(t, instance, "create-group", "lists")
+	runTestAdmin(t, instance, "add-member", "lists", nostr.Generate().Public().Hex())
+
+	members := storedList(t, instance, nostr.KindSimpleGroupMembers, "lists")
+	if err := instance.Groups.UpdateMembersList("lists"); err != nil {
+		t.Fatalf("UpdateMembersList failed: %v", err)
+	}
+	if id := storedList(t, instance, nostr.KindSimpleGroupMembers, "lists"); id != members {
+		t.Error("an unchanged members list was written again")
+	}
+
+	runTestAdmin(t, instance, "add-member", "lists", nostr.Generate().Public().Hex())
+	if id := storedList(t, instance, nostr.KindSimpleGroupMembers, "lists"); id == members {
+		t.Error("a changed members list wasn't written")
+	}
+}
+
+func TestSameTags(t *testing.T) {
+	a := nostr.Tags{{"d", "x"}, {"p", "1"}, {"p", "2", "admin"}}
+
+	if !sameTags(a, nostr.Tags{{"p", "2", "admin"}, {"d", "x"}, {"p", "1"}}) {
+		t.Error("reordered tags should be the same")
+	}
+	if sameTags(a, nostr.Tags{{"d", "x"}, {"p", "1"}, {"p", "2"}}) {
+		t.Error("a dropped role should make a difference")
+	}
+	if sameTags(a, nostr.Tags{{"d", "x"}, {"p", "1"}, {"p", "1"}}) {
+		t.Error("a repeated tag should make a difference")
+	}
+}
@@ -0,0 +1,254 @@
+package zooid
+
+import (
+	"cmp"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"fiatjaf.com/nostr"
+)
+
+// Read markers and unread counts.
+//
+// A user marks a group read up to now by publishing kind 30078 app data with
+// d tag zooid/read/<h>. Markers are stored like any other addressable event,
+// but only their author can fetch them. Chat messages, threads and replies
+// newer than the marker, not written by the user, are unread. They are
+// counted from a per-group log of recent message timestamps, loaded once and
+// kept up to date as messages are saved, so counting costs no query beyond
+// the marker lookup. The log keeps the newest unreadLogSize messages, so
+// counts stop there. Clients ask for KindUnreadCounts and get a relay-signed
+// event with an ["unread", <h>, <count>] tag per group they have a marker in,
+// or per group in the filter's #h.
+
+const KindUnreadCounts nostr.Kind = 39011
+
+const (
+	readMarkerPrefix = "zooid/read/"
+	unreadLogSize    = 1000
+)
+
+func readMarkerD(h string) string {
+	return readMarkerPrefix + h
+}
+
+// isReadMarker reports whether event is a user's read marker.
+func isReadMarker(event nostr.Event) bool {
+	if event.Kind != nostr.KindApplicationSpecificData {
+		return false
+	}
+
+	tag := event.Tags.Find("d")
+	return tag != nil && strings.HasPrefix(tag[1], readMarkerPrefix)
+}
+
+// readMarkerGroup returns the group a read marker is for.
+func readMarkerGroup(event nostr.Event) string {
+	return strings.TrimPrefix(event.Tags.Find("d")[1], readMarkerPrefix)
+}
+
+type unreadEntry struct {
+	id     nostr.ID
+	at     nostr.Timestamp
+	pubkey nostr.PubKey
+}
+
+// unreadLog holds the newest messages of a group, oldest first.
+type unreadLog struct {
+	mu      sync.Mutex
+	loaded  bool
+	entries []unreadEntry
+}
+
+// add inserts a message in timestamp order, ignoring it if it's already
+// there. The caller holds l.mu.
+func (l *unreadLog) add(entry unreadEntry) {
+	i, _ := slices.BinarySearchFunc(l.entries, entry.at, func(e unreadEntry, at nostr.Timestamp) int {
+		return cmp.Compare(e.at, at)
+	})
+	for j := i; j < len(l.entries) && l.entries[j].at == entry.at; j++ {
+		if l.entries[j].id == entry.id {
+			return
+		}
+	}
+
+	l.entries = slices.Insert(l.entries, i, entry)
+	if len(l.entries) > unreadLogSize {
+		l.entries = slices.Delete(l.entries, 0, len(l.entries)-unreadLogSize)
+	}
+}
+
+// count returns how many messages newer than since weren't written by pubkey.
+// The caller holds l.mu.
+func (l *unreadLog) count(since nostr.Timestamp, pubkey nostr.PubKey) int {
+	i, _ := slices.BinarySearchFunc(l.entries, since+1, func(e unreadEntry, at nostr.Timestamp) int {
+		return cmp.Compare(e.at, at)
+	})
+
+	n := 0
+	for _, entry := range l.entries[i:] {
+		if entry.pubkey != pubkey {
+			n++
+		}
+	}
+	return n
+}
+
+// loadUnreadLog returns the message log of group h, reading it from the
+// store the first time. The log is returned locked.
+func (g *GroupStore) loadUnreadLog(h string) *unreadLog {
+	v, _ := g.unreadLogs.LoadOrStore(h, &unreadLog{})
+	l := v.(*unreadLog)
+
+	l.mu.Lock()
+	if !l.loaded {
+		filter := nostr.Filter{
+			Kinds: []nostr.Kind{
+				nostr.KindSimpleGroupChatMessage,
+				nostr.KindSimpleGroupThreadedReply,
+				nostr.KindSimpleGroupThread,
+				nostr.KindSimpleGroupReply,
+			},
+			Tags:  nostr.TagMap{"h": []string{h}},
+			Limit: unreadLogSize,
+		}
+
+		for event := range g.Events.QueryEvents(filter, unreadLogSize) {
+			l.add(unreadEntry{id: event.ID, at: event.CreatedAt, pubkey: event.PubKey})
+		}
+		l.loaded = true
+	}
+
+	return l
+}
+
+// recordUnread adds a saved message to its group's log, if the log has been
+// loaded. Logs that haven't been will find it in the store.
+func (g *GroupStore) recordUnread(event nostr.Event) {
+	if !isThreadKind(event.Kind) {
+		return
+	}
+
+	v, ok := g.unreadLogs.Load(GetGroupIDFromEvent(event))
+	if !ok {
+		return
+	}
+
+	l := v.(*unreadLog)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.loaded {
+		l.add(unreadEntry{id: event.ID, at: event.CreatedAt, pubkey: event.PubKey})
+	}
+}
+
+// forgetUnread drops the message log of group h, to be reloaded when next
+// needed.
+func (g *GroupStore) forgetUnread(h string) {
+	g.unreadLogs.Delete(h)
+}
+
+// GetReadMarker returns when pubkey last marked group h read, or 0 if never.
+func (g *GroupStore) GetReadMarker(h string, pubkey nostr.PubKey) nostr.Timestamp {
+	filter := nostr.Filter{
+		Kinds:   []nostr.Kind{nostr.KindApplicationSpecificData},
+		Authors: []nostr.PubKey{pubkey},
+		Tags:    nostr.TagMap{"d": []string{readMarkerD(h)}},
+	}
+	for event := range g.Events.QueryEvents(filter, 1) {
+		return event.CreatedAt
+	}
+
+	return 0
+}
+
+// GetUnreadCount returns how many messages in group h pubkey hasn't read,
+// up to unreadLogSize.
+func (g *GroupStore) GetUnreadCount(h string, pubkey nostr.PubKey) int {
+	since := g.GetReadMarker(h, pubkey)
+
+	l := g.loadUnreadLog(h)
+	defer l.mu.Unlock()
+
+	return l.count(since, pubkey)
+}
+
+// checkReadMarker returns why a read marker can't be accepted, or "" if it
+// can.
+func (g *GroupStore) checkReadMarker(event nostr.Event) string {
+	h := readMarkerGroup(event)
+	if !g.Config.Groups.Enabled {
+		return RejectRestricted.Reason("groups are not enabled on this relay")
+	}
+	if _, found := g.GetMetadata(h); !found {
+		return RejectInvalid.Reason("group not found")
+	}
+	if !g.CanRead(event.PubKey, groupProbe(h)) {
+		return RejectRestricted.Reason("you can't read that group")
+	}
+
+	return ""
+}
+
+// groupProbe stands in for a chat message of group h when asking CanRead
+// about the group as a whole.
+func groupProbe(h string) nostr.Event {
+	return nostr.Event{Kind: nostr.KindSimpleGroupChatMessage, Tags: nostr.Tags{{"h", h}}}
+}
+
+// markedGroups returns the groups pubkey has read markers in.
+func (g *GroupStore) markedGroups(pubkey nostr.PubKey) []string {
+	filter := nostr.Filter{
+		Kinds:   []nostr.Kind{nostr.KindApplicationSpecificData},
+		Authors: []nostr.PubKey{pubkey},
+	}
+
+	var groups []string
+	for event := range g.Events.QueryEvents(filter, 0) {
+		if isReadMarker(event) {
+			groups = append(groups, readMarkerGroup(event))
+		}
+	}
+
+	return groups
+}
+
+// UnreadCountsEvent returns a relay-signed KindUnreadCounts event with
+// pubkey's unread count in each of groups, or in every group pubkey has a
+// read marker in if groups is empty. Groups pubkey can't read are left out.
+func (g *GroupStore) UnreadCountsEvent(pubkey nostr.PubKey, groups []string) nostr.Event {
+	if len(groups) == 0 {
+		groups = g.markedGroups(pubkey)
+	}
+
+	event := nostr.Event{
+		Kind:      KindUnreadCounts,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"d", pubkey.Hex()}, {"p", pubkey.Hex()}},
+	}
+
+	seen := make(map[string]struct{}, len(groups))
+	for _, h := range groups {
+		if _, ok := seen[h]; ok {
+			continue
+		}
+		seen[h] = struct{}{}
+
+		if _, found := g.GetMetadata(h); !found || !g.CanRead(pubkey, groupProbe(h)) {
+			continue
+		}
+
+		count := g.GetUnreadCount(h, pubkey)
+		event.Tags = append(event.Tags, nostr.Tag{"h", h}, nostr.Tag{"unread", h, strconv.Itoa(count)})
+	}
+
+	if err := g.Config.Sign(&event); err != nil {
+		log.Printf("Failed to sign unread counts: %v", err)
+	}
+
+	return event
+}
@@ -0,0 +1,152 @@
+package zooid
+
+import (
+	"context"
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+func TestUnread_MarkerLowersCount(t *testing.T) {
+	instance := createTestInstance()
+	runTestAdmin(t, instance, "create-group", "news")
+
+	reader := nostr.Generate()
+	poster := nostr.Generate()
+	instance.Management.AddMember(reader.Public())
+	instance.Management.AddMember(poster.Public())
+	runTestAdmin(t, instance, "add-member", "news", reader.Public().Hex())
+	runTestAdmin(t, instance, "add-member", "news", poster.Public().Hex())
+
+	start := nostr.Now() - 100
+
+	// publish saves event at the given time the way khatru would
+	publish := func(author nostr.SecretKey, at nostr.Timestamp, event nostr.Event) string {
+		event.CreatedAt = at
+		event.Sign(author)
+		if reject, msg := instance.OnEvent(authedContext(author.Public()), event); reject {
+			return msg
+		}
+		save := instance.Events.SaveEvent
+		if event.Kind.IsAddressable() {
+			save = instance.Events.ReplaceEvent
+		}
+		if err := save(event); err != nil {
+			t.Fatal(err)
+		}
+		instance.OnEventSaved(context.Background(), event)
+		return ""
+	}
+	post := func(author nostr.SecretKey, at nostr.Timestamp) {
+		event := nostr.Event{Kind: nostr.KindSimpleGroupChatMessage, Content: "hi", Tags: nostr.Tags{{"h", "news"}}}
+		if reason := publish(author, at, event); reason != "" {
+			t.Fatalf("message refused: %s", reason)
+		}
+	}
+	markRead := func(at nostr.Timestamp) {
+		marker := nostr.Event{Kind: nostr.KindApplicationSpecificData, Tags: nostr.Tags{{"d", readMarkerD("news")}}}
+		if reason := publish(reader, at, marker); reason != "" {
+			t.Fatalf("read marker refused: %s", reason)
+		}
+	}
+
+	post(poster, start+1)
+	post(poster, start+2)
+	post(reader, start+3) // your own messages are never unread
+
+	if n := instance.Groups.GetUnreadCount("news", reader.Public()); n != 2 {
+		t.Errorf("unread before any marker = %d, want 2", n)
+	}
+
+	markRead(start + 1)
+	if n := instance.Groups.GetUnreadCount("news", reader.Public()); n != 1 {
+		t.Errorf("unread after marking the first message read = %d, want 1", n)
+	}
+
+	// New messages land in the cached log
+	post(poster, start+10)
+	if n := instance.Groups.GetUnreadCount("news", reader.Public()); n != 2 {
+		t.Errorf("unread after a new message = %d, want 2", n)
+	}
+
+	markRead(start + 10)
+	if n := instance.Groups.GetUnreadCount("news", reader.Public()); n != 0 {
+		t.Errorf("unread after catching up = %d, want 0", n)
+	}
+
+	// The summary event lists the marked group
+	post(poster, start+20)
+	filter := nostr.Filter{Kinds: []nostr.Kind{KindUnreadCounts}}
+	var summaries []nostr.Event
+	for event := range instance.QueryStored(authedContext(reader.Public()), filter) {
+		summaries = append(summaries, event)
+	}
+	if len(summaries) != 1 {
+		t.Fatalf("got %d unread summaries, want 1", len(summaries))
+	}
+	if tag := summaries[0].Tags.Find("unread"); tag == nil || tag[1] != "news" || tag[2] != "1" {
+		t.Errorf("unread tag = %v, want [unread news 1]", tag)
+	}
+	if !instance.Config.IsSelf(summaries[0].PubKey) || !summaries[0].VerifySignature() {
+		t.Error("the summary should be signed by the relay")
+	}
+}
+
+func TestUnread_MarkersArePrivate(t *testing.T) {
+	instance := createTestInstance()
+	instance.Config.Policy.Open = true
+	runTestAdmin(t, instance, "create-group", "quiet", "--private")
+
+	reader := nostr.Generate()
+	other := nostr.Generate()
+	runTestAdmin(t, instance, "add-member", "quiet", reader.Public().Hex())
+
+	marker := signedBy(reader, nostr.Event{Kind: nostr.KindApplicationSpecificData, Tags: nostr.Tags{{"d", readMarkerD("quiet")}}})
+	if reject, msg := instance.OnEvent(authedContext(reader.Public()), marker); reject {
+		t.Fatalf("read marker refused: %s", msg)
+	}
+	if err := instance.Events.SaveEvent(marker); err != nil {
+		t.Fatal(err)
+	}
+
+	// Non-members can't mark a private group read, nor can anyone mark a
+	// group that doesn't exist
+	outsider := signedBy(other, nostr.Event{Kind: nostr.KindApplicationSpecificData, Tags: nostr.Tags{{"d", readMarkerD("quiet")}}})
+	if reject, _ := instance.OnEvent(authedContext(other.Public()), outsider); !reject {
+		t.Error("a non-member's read marker should be refused")
+	}
+	missing := signedBy(reader, nostr.Event{Kind: nostr.KindApplicationSpecificData, Tags: nostr.Tags{{"d", readMarkerD("nope")}}})
+	if reject, _ := instance.OnEvent(authedContext(reader.Public()), missing); !reject {
+		t.Error("a read marker for a missing group should be refused")
+	}
+
+	count := func(pubkey nostr.PubKey) int {
+		n := 0
+		filter := nostr.Filter{Kinds: []nostr.Kind{nostr.KindApplicationSpecificData}, Authors: []nostr.PubKey{reader.Public()}}
+		for range instance.QueryStored(authedContext(pubkey), filter) {
+			n++
+		}
+		return n
+	}
+	if n := count(reader.Public()); n != 1 {
+		t.Errorf("author sees %d markers, want 1", n)
+	}
+	if n := count(other.Public()); n != 0 {
+		t.Errorf("someone else sees %d markers, want 0", n)
+	}
+
+	filter := nostr.Filter{Kinds: []nostr.Kind{nostr.KindApplicationSpecificData}}
+	if !instance.PreventBroadcast(&khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{other.Public()}}, filter, marker) {
+		t.Error("markers should not be broadcast to others")
+	}
+	if instance.PreventBroadcast(&khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{reader.Public()}}, filter, marker) {
+		t.Error("markers should be broadcast to their author")
+	}
+
+	// Summaries leave out groups the asker can't read
+	summary := instance.Groups.UnreadCountsEvent(other.Public(), []string{"quiet"})
+	if summary.Tags.Find("unread") != nil {
+		t.Error("a non-member's summary should not include the private group")
+	}
+}
@@ -0,0 +1,258 @@
+package zooid
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// Usage accounting.
+//
+// For each pubkey the relay counts the events it stored from them and the
+// bytes of their content, and the REQ filters they sent and the stored
+// events they were served in return. Counts go to memory first and are
+// added to the kv store with the activity flush, every
+// activityFlushInterval, in batches, under
+// zooid:<schema>:usage:<day>:<metric>:<pubkey>, one key per UTC day. A crash
+// loses at most that long's counts. Days are kept for usageRetention, and
+// windows are whole days: the current one and as many before it as the
+// window reaches into. Live broadcasts and requests from unauthenticated
+// connections aren't counted.
+
+// usageRetention is how long daily counts are kept, and so the longest
+// window they can be summed over.
+const usageRetention = 31 * 24 * time.Hour
+
+// usageMetrics are the names of the counts in keys and listtopusers results.
+var usageMetrics = []string{"events", "bytes", "queries", "served"}
+
+// Usage is what a pubkey used of the relay.
+type Usage struct {
+	Events  int64 `json:"events"`  // events stored
+	Bytes   int64 `json:"bytes"`   // content bytes of those events
+	Queries int64 `json:"queries"` // REQ filters
+	Served  int64 `json:"served"`  // stored events sent in answer
+}
+
+// UserUsage is one pubkey's usage, for listtopusers.
+type UserUsage struct {
+	PubKey nostr.PubKey `json:"pubkey"`
+	Usage
+}
+
+func (u *Usage) add(other Usage) {
+	u.Events += other.Events
+	u.Bytes += other.Bytes
+	u.Queries += other.Queries
+	u.Served += other.Served
+}
+
+func (u *Usage) metric(name string) *int64 {
+	switch name {
+	case "events":
+		return &u.Events
+	case "bytes":
+		return &u.Bytes
+	case "queries":
+		return &u.Queries
+	default:
+		return &u.Served
+	}
+}
+
+// usageBucket is a pubkey's counts for one day, yyyymmdd.
+type usageBucket struct {
+	day    string
+	pubkey nostr.PubKey
+}
+
+// usageCounters holds the counts not yet added to the kv store.
+type usageCounters struct {
+	mu      sync.Mutex
+	pending map[usageBucket]Usage
+}
+
+// usageNow is the clock days are counted by, swappable in tests.
+var usageNow = time.Now
+
+func usageDay(t time.Time) string {
+	return t.UTC().Format("20060102")
+}
+
+// usageDays returns the days a window ending now reaches into, today first.
+func usageDays(window time.Duration) []string {
+	now := usageNow()
+	window = min(window, usageRetention)
+
+	var days []string
+	oldest := now.Add(-window).UTC().Truncate(24 * time.Hour)
+	for day := now.UTC().Truncate(24 * time.Hour); !day.Before(oldest); day = day.AddDate(0, 0, -1) {
+		days = append(days, usageDay(day))
+	}
+
+	return days
+}
+
+// RecordUsage counts usage by pubkey.
+func (m *ManagementStore) RecordUsage(pubkey nostr.PubKey, usage Usage) {
+	if pubkey == nostr.ZeroPK || usage == (Usage{}) {
+		return
+	}
+
+	bucket := usageBucket{day: usageDay(usageNow()), pubkey: pubkey}
+
+	m.usage.mu.Lock()
+	defer m.usage.mu.Unlock()
+
+	if m.usage.pending == nil {
+		m.usage.pending = make(map[usageBucket]Usage)
+	}
+
+	counts := m.usage.pending[bucket]
+	counts.add(usage)
+	m.usage.pending[bucket] = counts
+}
+
+// FlushUsage adds the counts recorded since the last flush to the kv store.
+// If that fails they're kept for the next flush.
+func (m *ManagementStore) FlushUsage(ctx context.Context) error {
+	m.usage.mu.Lock()
+	pending := m.usage.pending
+	m.usage.pending = nil
+	m.usage.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	items := make([]KeyDelta, 0, len(pending)*len(usageMetrics))
+	for bucket, counts := range pending {
+		for _, name := range usageMetrics {
+			if n := *counts.metric(name); n != 0 {
+				items = append(items, KeyDelta{Key: "usage:" + bucket.day + ":" + name + ":" + bucket.pubkey.Hex(), Delta: n})
+			}
+		}
+	}
+
+	if err := m.activityKV().IncrementMany(ctx, items, usageRetention); err != nil {
+		m.usage.mu.Lock()
+		if m.usage.pending == nil {
+			m.usage.pending = make(map[usageBucket]Usage)
+		}
+		for bucket, counts := range pending {
+			merged := m.usage.pending[bucket]
+			merged.add(counts)
+			m.usage.pending[bucket] = merged
+		}
+		m.usage.mu.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+// usageSince sums the usage of every pubkey over window, flushed and not.
+func (m *ManagementStore) usageSince(ctx context.Context, window time.Duration) (map[nostr.PubKey]*Usage, error) {
+	totals := make(map[nostr.PubKey]*Usage)
+	total := func(pubkey nostr.PubKey) *Usage {
+		if totals[pubkey] == nil {
+			totals[pubkey] = &Usage{}
+		}
+		return totals[pubkey]
+	}
+
+	days := usageDays(window)
+	for _, day := range days {
+		items, err := m.activityKV().List(ctx, "usage:"+day+":")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range items {
+			name, hex, found := strings.Cut(strings.TrimPrefix(item.Key, "usage:"+day+":"), ":")
+			if !found || !slices.Contains(usageMetrics, name) {
+				continue
+			}
+			pubkey, err := nostr.PubKeyFromHex(hex)
+			if err != nil {
+				continue
+			}
+			n, err := strconv.ParseInt(item.Value, 10, 64)
+			if err != nil {
+				continue
+			}
+
+			*total(pubkey).metric(name) += n
+		}
+	}
+
+	m.usage.mu.Lock()
+	for bucket, counts := range m.usage.pending {
+		if slices.Contains(days, bucket.day) {
+			total(bucket.pubkey).add(counts)
+		}
+	}
+	m.usage.mu.Unlock()
+
+	return totals, nil
+}
+
+// GetUsage returns what pubkey used of the relay over the days that are
+// kept.
+func (m *ManagementStore) GetUsage(ctx context.Context, pubkey nostr.PubKey) (Usage, error) {
+	totals, err := m.usageSince(ctx, usageRetention)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	if usage, ok := totals[pubkey]; ok {
+		return *usage, nil
+	}
+
+	return Usage{}, nil
+}
+
+// GetTopUsers returns, for each metric, the n pubkeys with the most of it
+// over window, most first.
+func (m *ManagementStore) GetTopUsers(ctx context.Context, n int, window time.Duration) (map[string][]UserUsage, error) {
+	totals, err := m.usageSince(ctx, window)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]UserUsage, 0, len(totals))
+	for pubkey, usage := range totals {
+		users = append(users, UserUsage{PubKey: pubkey, Usage: *usage})
+	}
+
+	top := make(map[string][]UserUsage, len(usageMetrics))
+	for _, name := range usageMetrics {
+		ranked := slices.Clone(users)
+		ranked = slices.DeleteFunc(ranked, func(u UserUsage) bool { return *u.metric(name) == 0 })
+		slices.SortFunc(ranked, func(a, b UserUsage) int {
+			if c := cmp.Compare(*b.metric(name), *a.metric(name)); c != 0 {
+				return c
+			}
+			return strings.Compare(a.PubKey.Hex(), b.PubKey.Hex())
+		})
+		top[name] = ranked[:min(n, len(ranked))]
+	}
+
+	return top, nil
+}
+
+func flushAllUsage(ctx context.Context) {
+	for _, inst := range GetAllInstances() {
+		if err := inst.Management.FlushUsage(ctx); err != nil {
+			log.Printf("Failed to flush usage for %s: %v", inst.Config.Schema, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package zooid
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// usageAt makes usage from now on count as happening at t.
+func usageAt(t *testing.T, at time.Time) {
+	t.Helper()
+
+	previous := usageNow
+	usageNow = func() time.Time { return at }
+	t.Cleanup(func() { usageNow = previous })
+}
+
+func TestUsage_Accumulates(t *testing.T) {
+	instance := createTestInstance()
+	secret := nostr.Generate()
+	pubkey := secret.Public()
+	instance.Management.AddMember(pubkey)
+
+	for _, content := range []string{"hello", "world!"} {
+		event := signedBy(secret, nostr.Event{Kind: nostr.KindTextNote, Content: content})
+		if err := instance.Events.SaveEvent(event); err != nil {
+			t.Fatal(err)
+		}
+		instance.OnEventSaved(context.Background(), event)
+	}
+
+	ctx := authedContext(pubkey)
+	filter := nostr.Filter{Authors: []nostr.PubKey{pubkey}}
+	if reject, msg := instance.OnRequest(ctx, filter); reject {
+		t.Fatalf("request refused: %s", msg)
+	}
+	for range instance.QueryStored(ctx, filter) {
+	}
+
+	usage, err := instance.Management.GetUsage(context.Background(), pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Usage{Events: 2, Bytes: 11, Queries: 1, Served: 2}); usage != want {
+		t.Errorf("usage = %+v, want %+v", usage, want)
+	}
+}
+
+func TestUsage_FlushSurvivesRestart(t *testing.T) {
+	instance := createTestInstance()
+	pubkey := nostr.Generate().Public()
+	ctx := context.Background()
+
+	instance.Management.RecordUsage(pubkey, Usage{Events: 3, Bytes: 100})
+	if err := instance.Management.FlushUsage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	instance.Management.RecordUsage(pubkey, Usage{Events: 1, Queries: 2})
+	if err := instance.Management.FlushUsage(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh store over the same schema, as after a restart
+	restarted := &ManagementStore{Config: instance.Config, Events: instance.Events}
+	restarted.RecordUsage(pubkey, Usage{Served: 7})
+
+	usage, err := restarted.GetUsage(ctx, pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Usage{Events: 4, Bytes: 100, Queries: 2, Served: 7}); usage != want {
+		t.Errorf("usage after a restart = %+v, want %+v", usage, want)
+	}
+}
+
+func TestUsage_TopUsers(t *testing.T) {
+	instance := createTestInstance()
+	m := instance.Management
+	ctx := context.Background()
+
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	heavy, light, old := nostr.Generate().Public(), nostr.Generate().Public(), nostr.Generate().Public()
+
+	usageAt(t, now.AddDate(0, 0, -5))
+	m.RecordUsage(old, Usage{Events: 1000})
+	if err := m.FlushUsage(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	usageAt(t, now.Add(-24*time.Hour))
+	m.RecordUsage(heavy, Usage{Events: 50, Bytes: 10})
+	if err := m.FlushUsage(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	usageAt(t, now)
+	m.RecordUsage(heavy, Usage{Events: 10})
+	m.RecordUsage(light, Usage{Events: 5, Bytes: 500, Queries: 1})
+
+	top, err := m.GetTopUsers(ctx, 1, 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top["events"]) != 1 || top["events"][0].PubKey != heavy || top["events"][0].Events != 60 {
+		t.Errorf("top by events = %+v, want heavy with 60", top["events"])
+	}
+	if len(top["bytes"]) != 1 || top["bytes"][0].PubKey != light {
+		t.Errorf("top by bytes = %+v, want light", top["bytes"])
+	}
+	if len(top["served"]) != 0 {
+		t.Errorf("top by served = %+v, want nobody", top["served"])
+	}
+
+	// A longer window reaches the older day
+	top, err = m.GetTopUsers(ctx, 3, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top["events"]) != 3 || top["events"][0].PubKey != old {
+		t.Errorf("top by events over a week = %+v, want old first", top["events"])
+	}
+}
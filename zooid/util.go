@@ -1,23 +1,49 @@
 package zooid
 
 import (
+	"bytes"
+	"cmp"
 	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip29"
 	"math/rand"
 	"slices"
 	"strings"
 )
 
 const (
-	RELAY_ADD_MEMBER    = 8000
-	RELAY_REMOVE_MEMBER = 8001
-	RELAY_MEMBERS       = 13534
-	RELAY_JOIN          = 28934
-	RELAY_INVITE        = 28935
-	RELAY_LEAVE         = 28936
-	BANNED_PUBKEYS      = "zooid/banned_pubkeys"
-	BANNED_EVENTS       = "zooid/banned_events"
+	RELAY_ADD_MEMBER      = 8000
+	RELAY_REMOVE_MEMBER   = 8001
+	RELAY_MEMBERS         = 13534
+	RELAY_JOIN            = 28934
+	RELAY_INVITE          = 28935
+	RELAY_LEAVE           = 28936
+	RELAY_NIP05_CLAIM     = 28937
+	RELAY_PURGE           = 28939
+	RELAY_PURGE_RECEIPT   = 8002
+	BANNED_PUBKEYS        = "zooid/banned_pubkeys"
+	SHADOW_BANNED_PUBKEYS = "zooid/shadow_banned_pubkeys"
+	BANNED_EVENTS         = "zooid/banned_events"
+	RELAY_MEMBERS_D       = "zooid/members"
+	NIP05_NAMES           = "zooid/nip05"
+	REDEEMED_PAYMENTS     = "zooid/payments"
+	RELAY_STATS           = "zooid/stats"
 )
 
+// IsRelayOnlyKind reports whether events of this kind are only ever written
+// by the relay itself: the NIP-29 group metadata, admins, members and roles
+// lists, group pin lists and presence notices, and the relay membership list,
+// its add/remove announcements and purge receipts.
+// Clients rely on these being relay-signed, so copies from any other key are
+// refused whether or not groups are enabled.
+func IsRelayOnlyKind(kind nostr.Kind) bool {
+	switch kind {
+	case RELAY_ADD_MEMBER, RELAY_REMOVE_MEMBER, RELAY_MEMBERS, RELAY_PURGE_RECEIPT, KindSimpleGroupPins, KindUnreadCounts, KindSimpleGroupJoinRequests, KindGroupPresence:
+		return true
+	}
+
+	return nip29.MetadataEventKinds.Includes(kind)
+}
+
 func First[T any](s []T) T {
 	if len(s) == 0 {
 		var zero T
@@ -65,6 +91,15 @@ func Reversed[T any](slice []T) []T {
 	return slice
 }
 
+// CompareEvents orders events oldest first, breaking created_at ties by id so
+// the order is the same everywhere an event log is replayed.
+func CompareEvents(a, b nostr.Event) int {
+	if c := cmp.Compare(a.CreatedAt, b.CreatedAt); c != 0 {
+		return c
+	}
+	return bytes.Compare(a.ID[:], b.ID[:])
+}
+
 const letters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
 func RandomString(n int) string {
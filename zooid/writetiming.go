@@ -0,0 +1,158 @@
+package zooid
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Write path timing.
+//
+// Each stage a client's event goes through is timed, by kind class: OnEvent's
+// checks, the database write, OnEventSaved's side effects (group bookkeeping
+// is queued, so only handing it off counts), and the broadcast to
+// subscribers. khatru has no hook after its broadcast, so stored events are
+// broadcast at the end of OnEventSaved instead, where it can be timed, and
+// PreventBroadcast drops khatru's own pass. That's the same point in the
+// pipeline, before the OK is sent. Deletions, which khatru only broadcasts
+// once they've been carried out, are left to it and not timed. An event that
+// spends longer than SLOW_EVENT_MS in one stage is logged.
+
+const (
+	stageValidate    = "validate"
+	stageStore       = "store"
+	stageSideEffects = "side_effects"
+	stageBroadcast   = "broadcast"
+)
+
+var eventStageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "zooid_event_stage_seconds",
+	Help:    "Time an event from a client spends in each stage of the write path",
+	Buckets: queryDurationBuckets,
+}, []string{"instance", "stage", "class"})
+
+func init() {
+	prometheus.MustRegister(eventStageDuration)
+}
+
+// slowEvent is read from env once, as observeStage runs several times per
+// event. 0 turns the log off.
+var (
+	slowEventOnce sync.Once
+	slowEvent     time.Duration
+)
+
+func slowEventThreshold() time.Duration {
+	slowEventOnce.Do(func() {
+		slowEvent = time.Duration(envInt("SLOW_EVENT_MS", 1000)) * time.Millisecond
+	})
+	return slowEvent
+}
+
+// kindClass groups kinds for the write path metrics: moderation (group and
+// relay membership, deletions, reports), metadata (replaceable and
+// addressable events) or content.
+func kindClass(kind nostr.Kind) string {
+	switch {
+	case kind >= 9000 && kind <= 9030, kind == RELAY_ADD_MEMBER, kind == RELAY_REMOVE_MEMBER,
+		kind == nostr.KindDeletion, kind == nostr.KindReporting:
+		return "moderation"
+	case kind.IsReplaceable() || kind.IsAddressable():
+		return "metadata"
+	default:
+		return "content"
+	}
+}
+
+// observeStage records the time event spent in stage since start, logging it
+// if that's longer than SLOW_EVENT_MS.
+func (instance *Instance) observeStage(stage string, event nostr.Event, start time.Time) {
+	elapsed := time.Since(start)
+	eventStageDuration.WithLabelValues(instance.Config.Schema, stage, kindClass(event.Kind)).Observe(elapsed.Seconds())
+
+	if slow := slowEventThreshold(); slow > 0 && elapsed > slow {
+		log.Printf("Slow %s for kind %d event %s in group %q on %s: %s",
+			stage, event.Kind, event.ID, GetGroupIDFromEvent(event), instance.Config.Host, elapsed.Round(time.Millisecond))
+	}
+}
+
+// timeWrites wraps the relay's write path hooks to time them.
+func (instance *Instance) timeWrites() {
+	relay := instance.Relay
+	onEvent, storeEvent, replaceEvent := relay.OnEvent, relay.StoreEvent, relay.ReplaceEvent
+	onEventSaved, preventBroadcast := relay.OnEventSaved, relay.PreventBroadcast
+
+	relay.OnEvent = func(ctx context.Context, event nostr.Event) (bool, string) {
+		defer instance.observeStage(stageValidate, event, time.Now())
+		return onEvent(ctx, event)
+	}
+
+	relay.StoreEvent = func(ctx context.Context, event nostr.Event) error {
+		defer instance.observeStage(stageStore, event, time.Now())
+		return storeEvent(ctx, event)
+	}
+
+	relay.ReplaceEvent = func(ctx context.Context, event nostr.Event) error {
+		defer instance.observeStage(stageStore, event, time.Now())
+		return replaceEvent(ctx, event)
+	}
+
+	relay.OnEventSaved = func(ctx context.Context, event nostr.Event) {
+		start := time.Now()
+		onEventSaved(ctx, event)
+		instance.observeStage(stageSideEffects, event, start)
+
+		if event.Kind != nostr.KindDeletion {
+			start = time.Now()
+			relay.BroadcastEvent(event)
+			instance.broadcast.add(event.ID)
+			instance.observeStage(stageBroadcast, event, start)
+		}
+	}
+
+	relay.PreventBroadcast = func(ws *khatru.WebSocket, filter nostr.Filter, event nostr.Event) bool {
+		return instance.broadcast.has(event.ID) || preventBroadcast(ws, filter, event)
+	}
+}
+
+// broadcastEvents remembers the events OnEventSaved has broadcast, for long
+// enough for khatru's own broadcast of them to be skipped.
+type broadcastEvents struct {
+	mu     sync.Mutex
+	ids    map[nostr.ID]time.Time
+	purged time.Time
+}
+
+const broadcastMemory = time.Minute
+
+func (b *broadcastEvents) add(id nostr.ID) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.ids == nil {
+		b.ids = make(map[nostr.ID]time.Time)
+	}
+	if now.Sub(b.purged) > broadcastMemory {
+		for id, at := range b.ids {
+			if now.Sub(at) > broadcastMemory {
+				delete(b.ids, id)
+			}
+		}
+		b.purged = now
+	}
+	b.ids[id] = now
+}
+
+func (b *broadcastEvents) has(id nostr.ID) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.ids[id]
+	return ok
+}
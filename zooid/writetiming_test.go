@@ -0,0 +1,86 @@
+package zooid
+
+import (
+	"context"
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// stageCount returns how many times stage was observed for class.
+func stageCount(t *testing.T, instance *Instance, stage, class string) uint64 {
+	t.Helper()
+	m, err := eventStageDuration.GetMetricWithLabelValues(instance.Config.Schema, stage, class)
+	if err != nil {
+		t.Fatalf("GetMetricWithLabelValues: %v", err)
+	}
+	var pb dto.Metric
+	if err := m.(prometheus.Metric).Write(&pb); err != nil {
+		t.Fatalf("histogram.Write: %v", err)
+	}
+	return pb.GetHistogram().GetSampleCount()
+}
+
+func TestTimeWrites(t *testing.T) {
+	instance := createMetricsTestInstance(t)
+	relay := instance.Relay
+	relay.OnEvent = instance.OnEvent
+	relay.StoreEvent = instance.StoreEvent
+	relay.ReplaceEvent = instance.ReplaceEvent
+	relay.OnEventSaved = instance.OnEventSaved
+	relay.PreventBroadcast = instance.PreventBroadcast
+	instance.timeWrites()
+
+	ctx := context.Background()
+	note := createTestEvent(nostr.KindTextNote, "hello")
+	metadata := createTestEvent(nostr.KindProfileMetadata, "{}")
+
+	// The path khatru takes for each
+	relay.OnEvent(ctx, note)
+	if err := relay.StoreEvent(ctx, note); err != nil {
+		t.Fatalf("StoreEvent failed: %v", err)
+	}
+	relay.OnEventSaved(ctx, note)
+
+	relay.OnEvent(ctx, metadata)
+	if err := relay.ReplaceEvent(ctx, metadata); err != nil {
+		t.Fatalf("ReplaceEvent failed: %v", err)
+	}
+	relay.OnEventSaved(ctx, metadata)
+
+	for _, class := range []string{"content", "metadata"} {
+		for _, stage := range []string{stageValidate, stageStore, stageSideEffects, stageBroadcast} {
+			if n := stageCount(t, instance, stage, class); n != 1 {
+				t.Errorf("%s %s observed %d times, want 1", class, stage, n)
+			}
+		}
+	}
+	if n := stageCount(t, instance, stageStore, "moderation"); n != 0 {
+		t.Errorf("moderation store observed %d times, want 0", n)
+	}
+
+	// khatru's own broadcast afterwards doesn't send it again
+	if !relay.PreventBroadcast(&khatru.WebSocket{}, nostr.Filter{}, note) {
+		t.Error("a stored event would be broadcast twice")
+	}
+}
+
+func TestKindClass(t *testing.T) {
+	for kind, want := range map[nostr.Kind]string{
+		nostr.KindTextNote:               "content",
+		nostr.KindSimpleGroupChatMessage: "content",
+		nostr.KindDeletion:               "moderation",
+		nostr.KindSimpleGroupPutUser:     "moderation",
+		nostr.KindSimpleGroupJoinRequest: "moderation",
+		RELAY_ADD_MEMBER:                 "moderation",
+		nostr.KindProfileMetadata:        "metadata",
+		nostr.KindSimpleGroupMetadata:    "metadata",
+	} {
+		if got := kindClass(kind); got != want {
+			t.Errorf("kindClass(%d) = %s, want %s", kind, got, want)
+		}
+	}
+}
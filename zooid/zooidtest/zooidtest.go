@@ -0,0 +1,81 @@
+// Package zooidtest runs zooid instances with everything in memory, for
+// tests of relay policy and caches that shouldn't need a database. Call Main
+// from TestMain, then NewInstance from each test:
+//
+//	func TestMain(m *testing.M) {
+//		zooidtest.Main(m)
+//	}
+//
+//	func TestMembersOnly(t *testing.T) {
+//		instance := zooidtest.NewInstance(t, `
+//			host = "relay.example.com"
+//
+//			[groups]
+//			enabled = true
+//		`)
+//		...
+//	}
+package zooidtest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"fiatjaf.com/nostr"
+
+	"zooid/zooid"
+)
+
+// instances numbers the configs NewInstance writes, so every instance gets
+// its own schema.
+var instances atomic.Int64
+
+// Main runs the tests of m with DATABASE_URL=memory:// and the config
+// directory in a temporary directory, and exits with their result.
+func Main(m *testing.M) {
+	dir, err := os.MkdirTemp("", "zooidtest")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "zooidtest: %v\n", err)
+		os.Exit(1)
+	}
+
+	os.Setenv("DATABASE_URL", "memory://")
+	os.Setenv("CONFIG", dir)
+	os.Setenv("MEDIA", filepath.Join(dir, "media"))
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// NewInstance loads an instance from config, the TOML of a relay config
+// without its secret and schema, which are generated. The instance is
+// cleaned up when the test ends.
+func NewInstance(t testing.TB, config string) *zooid.Instance {
+	t.Helper()
+
+	if zooid.Env("DATABASE_URL") != "memory://" {
+		t.Fatal("zooidtest: call zooidtest.Main from TestMain")
+	}
+
+	n := instances.Add(1)
+	filename := fmt.Sprintf("zooidtest_%d.toml", n)
+	config = fmt.Sprintf("secret = %q\nschema = \"zooidtest_%d\"\n%s", nostr.Generate().Hex(), n, config)
+
+	path := filepath.Join(zooid.Env("CONFIG"), filename)
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatalf("zooidtest: %v", err)
+	}
+
+	instance, err := zooid.MakeInstance(context.Background(), filename)
+	if err != nil {
+		t.Fatalf("zooidtest: %v", err)
+	}
+	t.Cleanup(instance.Cleanup)
+
+	return instance
+}
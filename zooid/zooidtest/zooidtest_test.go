@@ -0,0 +1,52 @@
+package zooidtest_test
+
+import (
+	"testing"
+
+	"fiatjaf.com/nostr"
+
+	"zooid/zooid/zooidtest"
+)
+
+func TestMain(m *testing.M) {
+	zooidtest.Main(m)
+}
+
+func TestNewInstance(t *testing.T) {
+	instance := zooidtest.NewInstance(t, `
+		host = "relay.example.com"
+
+		[groups]
+		enabled = true
+	`)
+
+	member := nostr.Generate().Public()
+	if err := instance.Management.AddMember(member); err != nil {
+		t.Fatalf("AddMember failed: %v", err)
+	}
+	if !instance.Management.IsMember(member) {
+		t.Error("expected the new member to be a member")
+	}
+
+	note := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Content: "hello"}
+	if err := instance.Events.SignAndStoreEvent(&note, false); err != nil {
+		t.Fatalf("SignAndStoreEvent failed: %v", err)
+	}
+
+	var found []nostr.ID
+	for event := range instance.Events.QueryEvents(nostr.Filter{Kinds: []nostr.Kind{nostr.KindTextNote}}, 0) {
+		found = append(found, event.ID)
+	}
+	if len(found) != 1 || found[0] != note.ID {
+		t.Errorf("query found %v, want [%s]", found, note.ID)
+	}
+
+	// Every instance has its own schema
+	other := zooidtest.NewInstance(t, `host = "other.example.com"`)
+	if other.Management.IsMember(member) {
+		t.Error("a member of one instance is a member of another")
+	}
+	if n, err := other.Events.CountEvents(nostr.Filter{Kinds: []nostr.Kind{nostr.KindTextNote}}); err != nil || n != 0 {
+		t.Errorf("other instance counts %d notes (%v), want 0", n, err)
+	}
+}